@@ -16,7 +16,7 @@
 
     $(".online-status").each(function(){
         const onlineStatusID = "#" + $(this).attr('id');
-        $.get( "/user/status?pkey=" + encodeURIComponent($(this).attr('data-pkey')), function( data ) {
+        $.get( $(this).attr('data-url') + "?pkey=" + encodeURIComponent($(this).attr('data-pkey')), function( data ) {
             console.log(onlineStatusID + " " + data)
             if(data === true) {
                 $(onlineStatusID).html('<i class="fas fa-link text-success"></i>');
@@ -30,6 +30,73 @@
             this.form.submit();
         });
     });
+    $('select.allowedip-preset').change(function() {
+        const target = $($(this).attr('data-target'));
+        const selected = $(this).find('option:selected');
+        if (selected.val() === "0") {
+            target.prop('readonly', false);
+        } else {
+            target.val(selected.attr('data-allowedips')).prop('readonly', true);
+        }
+    });
+    // select or deselect all checkboxes of a bulk action
+    $('input.bulk-select-all').change(function() {
+        $($(this).attr('data-target')).prop('checked', this.checked);
+    });
+    // inherited settings show the global default and cannot be edited
+    $('input[data-inherit-target]').change(function() {
+        const target = $($(this).attr('data-inherit-target'));
+        if (this.checked) {
+            target.val($(this).attr('data-inherit-value')).prop('readonly', true);
+        } else {
+            target.prop('readonly', false);
+        }
+    });
+    // the allowed IPs of new peers are derived from the tunnel mode of the interface
+    $('#server_TunnelMode').change(function() {
+        const custom = $(this).val() === '';
+        $('#server_InheritAllowedIPs').prop('disabled', !custom);
+        $('#server_AllowedIP').prop('readonly', !custom || $('#server_InheritAllowedIPs').prop('checked'));
+    });
+    // suggest existing tags for the last entry of a comma separated tag list
+    $('input[data-tags]').on('input focus', function() {
+        const input = $(this);
+        const tags = input.attr('data-tags') ? input.attr('data-tags').split(',') : [];
+        const entries = input.val().split(',');
+        const current = entries.pop().trim().toLowerCase();
+        const prefix = entries.length > 0 ? entries.join(',') + ', ' : '';
+        const used = entries.map(function(entry) { return entry.trim().toLowerCase(); });
+        const list = $('#' + input.attr('list')).empty();
+        tags.forEach(function(tag) {
+            if (tag.startsWith(current) && used.indexOf(tag) === -1) {
+                list.append($('<option>').attr('value', prefix + tag));
+            }
+        });
+    });
+    // keep the remaining lifetime of guest peers up to date
+    function updateGuestCountdowns() {
+        const now = Date.now() / 1000;
+        $('.guest-countdown[data-expires]').each(function() {
+            const left = parseInt($(this).attr('data-expires'), 10) - now;
+            if (left <= 0) {
+                $(this).text('expired');
+                return;
+            }
+            const days = Math.floor(left / 86400);
+            const hours = Math.floor((left % 86400) / 3600);
+            const minutes = Math.floor((left % 3600) / 60);
+            if (days > 0) {
+                $(this).text(days + 'd ' + hours + 'h');
+            } else if (hours > 0) {
+                $(this).text(hours + 'h ' + minutes + 'm');
+            } else {
+                $(this).text(Math.max(minutes, 1) + 'm');
+            }
+        });
+    }
+    if ($('.guest-countdown[data-expires]').length > 0) {
+        setInterval(updateGuestCountdowns, 30000);
+    }
     $('[data-toggle=confirmation]').confirmation({
         rootSelector: '[data-toggle=confirmation]',
         // other options
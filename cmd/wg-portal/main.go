@@ -6,7 +6,6 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"git.prolicht.digital/pub/healthcheck"
 	"github.com/h44z/wg-portal/internal/server"
@@ -14,6 +13,15 @@ import (
 )
 
 func main() {
+	// Maintenance commands work on the database without starting the server
+	if len(os.Args) > 1 {
+		if _, ok := os.LookupEnv("LOG_LEVEL"); !ok {
+			os.Setenv("LOG_LEVEL", "warn") // keep the output of the commands readable
+		}
+		_ = setupLogger(logrus.StandardLogger())
+		os.Exit(server.RunCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	_ = setupLogger(logrus.StandardLogger())
 
 	c := make(chan os.Signal, 1)
@@ -41,13 +49,17 @@ func main() {
 	}()
 
 	// Start main process in background
-	go service.Run()
+	stopped := make(chan struct{})
+	go func() {
+		service.Run()
+		close(stopped)
+	}()
 
 	<-ctx.Done() // Wait until the context gets canceled
 
-	// Give goroutines some time to stop gracefully
+	// Run returns once the web service and all background workers have stopped
 	logrus.Info("stopping WireGuard Portal Server...")
-	time.Sleep(2 * time.Second)
+	<-stopped
 
 	logrus.Infof("stopped WireGuard Portal Server...")
 	logrus.Exit(0)
@@ -73,6 +85,8 @@ func setupLogger(logger *logrus.Logger) error {
 	switch level {
 	case "off":
 		logger.SetOutput(ioutil.Discard)
+	case "warn":
+		logger.SetLevel(logrus.WarnLevel)
 	case "info":
 		logger.SetLevel(logrus.InfoLevel)
 	case "debug":
@@ -5,6 +5,9 @@ import "embed"
 //go:embed assets/tpl/*
 var Templates embed.FS
 
+//go:embed assets/i18n/*
+var Translations embed.FS
+
 //go:embed assets/css/*
 //go:embed assets/fonts/*
 //go:embed assets/img/*
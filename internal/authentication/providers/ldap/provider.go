@@ -67,7 +67,7 @@ func (provider Provider) Login(ctx *authentication.AuthContext) (string, error)
 	defer provider.close(client)
 
 	// Search for the given username
-	attrs := []string{"dn", provider.config.EmailAttribute}
+	attrs := provider.config.UserAttributeNames()
 	loginFilter := strings.Replace(provider.config.LoginFilter, "{{login_identifier}}", username, -1)
 	searchRequest := ldap.NewSearchRequest(
 		provider.config.BaseDN,
@@ -93,7 +93,8 @@ func (provider Provider) Login(ctx *authentication.AuthContext) (string, error)
 		return "", errors.Wrapf(err, "invalid credentials")
 	}
 
-	return sr.Entries[0].GetAttributeValue(provider.config.EmailAttribute), nil
+	userData := ldapconfig.NewRawLdapData(sr.Entries[0], attrs)
+	return ldapconfig.MapUserAttributes(provider.config, &userData).Email, nil
 }
 
 func (provider Provider) Logout(context *authentication.AuthContext) error {
@@ -115,8 +116,7 @@ func (provider Provider) GetUserModel(ctx *authentication.AuthContext) (*authent
 	defer provider.close(client)
 
 	// Search for the given username
-	attrs := []string{"dn", provider.config.EmailAttribute, provider.config.FirstNameAttribute, provider.config.LastNameAttribute,
-		provider.config.PhoneAttribute, provider.config.GroupMemberAttribute}
+	attrs := provider.config.UserAttributeNames()
 	loginFilter := strings.Replace(provider.config.LoginFilter, "{{login_identifier}}", username, -1)
 	searchRequest := ldap.NewSearchRequest(
 		provider.config.BaseDN,
@@ -135,19 +135,16 @@ func (provider Provider) GetUserModel(ctx *authentication.AuthContext) (*authent
 		return nil, errors.Wrapf(err, "invalid amount of ldap entries (%d)", len(sr.Entries))
 	}
 
+	userData := ldapconfig.NewRawLdapData(sr.Entries[0], attrs)
+	mapped := ldapconfig.MapUserAttributes(provider.config, &userData)
 	user := &authentication.User{
-		Firstname: sr.Entries[0].GetAttributeValue(provider.config.FirstNameAttribute),
-		Lastname:  sr.Entries[0].GetAttributeValue(provider.config.LastNameAttribute),
-		Email:     sr.Entries[0].GetAttributeValue(provider.config.EmailAttribute),
-		Phone:     sr.Entries[0].GetAttributeValue(provider.config.PhoneAttribute),
-		IsAdmin:   false,
-	}
-
-	for _, group := range sr.Entries[0].GetAttributeValues(provider.config.GroupMemberAttribute) {
-		if group == provider.config.AdminLdapGroup {
-			user.IsAdmin = true
-			break
-		}
+		Email:       mapped.Email,
+		IsAdmin:     mapped.IsAdmin,
+		Username:    mapped.Username,
+		DisplayName: mapped.DisplayName,
+		Firstname:   mapped.Firstname,
+		Lastname:    mapped.Lastname,
+		Phone:       mapped.Phone,
 	}
 
 	return user, nil
@@ -12,6 +12,7 @@ import (
 	"github.com/h44z/wg-portal/internal/common"
 	"github.com/h44z/wg-portal/internal/users"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -20,11 +21,12 @@ var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z
 
 // Provider implements a password login method for a database backend.
 type Provider struct {
-	db *gorm.DB
+	db     *gorm.DB
+	policy users.PasswordPolicy
 }
 
-func New(cfg *common.DatabaseConfig) (*Provider, error) {
-	p := &Provider{}
+func New(cfg *common.DatabaseConfig, policy users.PasswordPolicy) (*Provider, error) {
+	p := &Provider{policy: policy}
 
 	var err error
 	p.db, err = common.GetDatabaseForConfig(cfg)
@@ -76,6 +78,16 @@ func (provider Provider) Login(ctx *authentication.AuthContext) (string, error)
 		return "", errors.New("invalid password")
 	}
 
+	// Upgrade hashes that were created with a lower cost, the plain password is only available during the login
+	if provider.policy.NeedsRehash(user.Password) {
+		if hashedPassword, err := provider.policy.Hash(password); err != nil {
+			logrus.Warnf("failed to rehash password of %s: %v", user.Email, err)
+		} else if err := provider.db.Model(&users.User{}).Where("email = ?", user.Email).
+			UpdateColumn("password", hashedPassword).Error; err != nil {
+			logrus.Warnf("failed to store rehashed password of %s: %v", user.Email, err)
+		}
+	}
+
 	return user.Email, nil
 }
 
@@ -130,13 +142,13 @@ func (provider Provider) InitializeAdmin(email, password string) error {
 			fmt.Println("This information will only be displayed once!")
 			fmt.Println("#############################################")
 		}
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hashedPassword, err := provider.policy.Hash(password)
 		if err != nil {
 			return errors.Wrap(err, "failed to hash admin password")
 		}
 
 		admin.Email = email
-		admin.Password = users.PrivateString(hashedPassword)
+		admin.Password = hashedPassword
 		admin.Firstname = "WireGuard"
 		admin.Lastname = "Administrator"
 		admin.CreatedAt = time.Now()
@@ -165,12 +177,12 @@ func (provider Provider) InitializeAdmin(email, password string) error {
 			fmt.Println("#############################################")
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		hashedPassword, err := provider.policy.Hash(password)
 		if err != nil {
 			return errors.Wrap(err, "failed to hash admin password")
 		}
 
-		admin.Password = users.PrivateString(hashedPassword)
+		admin.Password = hashedPassword
 		admin.IsAdmin = true
 		admin.UpdatedAt = time.Now()
 
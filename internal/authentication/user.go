@@ -6,7 +6,9 @@ type User struct {
 	IsAdmin bool
 
 	// optional fields
-	Firstname string
-	Lastname  string
-	Phone     string
+	Username    string
+	DisplayName string
+	Firstname   string
+	Lastname    string
+	Phone       string
 }
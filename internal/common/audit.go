@@ -0,0 +1,49 @@
+package common
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// AuditEntry records an action that should stay traceable, even if the affected record is deleted afterwards.
+type AuditEntry struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	Actor     string    `gorm:"index"` // email of the user, or the name of the background job
+	Action    string    `gorm:"index"`
+	Interface string
+	Target    string // e.g. the public key of a peer
+	Details   string
+}
+
+// AuditLog stores audit entries in the database.
+type AuditLog struct {
+	db *gorm.DB
+}
+
+func NewAuditLog(db *gorm.DB) (*AuditLog, error) {
+	return &AuditLog{db: db}, nil
+}
+
+// Record stores a new entry. Failures are only logged, so that auditing never blocks the recorded action.
+func (a *AuditLog) Record(entry AuditEntry) {
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now()
+	}
+	logrus.WithFields(logrus.Fields{"actor": entry.Actor, "interface": entry.Interface, "target": entry.Target}).
+		Infof("audit: %s %s", entry.Action, entry.Details)
+
+	if err := a.db.Create(&entry).Error; err != nil {
+		logrus.Errorf("failed to store audit entry %s of %s: %v", entry.Action, entry.Actor, err)
+	}
+}
+
+// GetEntries returns the most recent entries, newest first.
+func (a *AuditLog) GetEntries(limit int) []AuditEntry {
+	entries := make([]AuditEntry, 0, limit)
+	a.db.Order("created_at DESC, id DESC").Limit(limit).Find(&entries)
+
+	return entries
+}
@@ -4,57 +4,73 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-func init() {
-	migrations = append(migrations, Migration{
-		version: "1.0.7",
-		migrateFn: func(db *gorm.DB) error {
-			if err := db.Exec("UPDATE users SET email = LOWER(email)").Error; err != nil {
-				return errors.Wrap(err, "failed to convert user emails to lower case")
-			}
-			if err := db.Exec("UPDATE peers SET email = LOWER(email)").Error; err != nil {
-				return errors.Wrap(err, "failed to convert peer emails to lower case")
-			}
-			logrus.Infof("upgraded database format to version 1.0.7")
-			return nil
-		},
-	})
-	migrations = append(migrations, Migration{
-		version: "1.0.8",
-		migrateFn: func(db *gorm.DB) error {
-			logrus.Infof("upgraded database format to version 1.0.8")
-			return nil
-		},
-	})
-}
-
 type SupportedDatabase string
 
 const (
-	SupportedDatabaseMySQL  SupportedDatabase = "mysql"
-	SupportedDatabaseSQLite SupportedDatabase = "sqlite"
+	SupportedDatabaseMySQL    SupportedDatabase = "mysql"
+	SupportedDatabasePostgres SupportedDatabase = "postgres"
+	SupportedDatabaseSQLite   SupportedDatabase = "sqlite"
 )
 
 type DatabaseConfig struct {
-	Typ      SupportedDatabase `yaml:"typ" envconfig:"DATABASE_TYPE"` //mysql or sqlite
+	Typ      SupportedDatabase `yaml:"typ" envconfig:"DATABASE_TYPE"` //mysql, postgres or sqlite
 	Host     string            `yaml:"host" envconfig:"DATABASE_HOST"`
 	Port     int               `yaml:"port" envconfig:"DATABASE_PORT"`
 	Database string            `yaml:"database" envconfig:"DATABASE_NAME"` // On SQLite: the database file-path, otherwise the database name
 	User     string            `yaml:"user" envconfig:"DATABASE_USERNAME"`
 	Password string            `yaml:"password" envconfig:"DATABASE_PASSWORD"`
+	DSN      string            `yaml:"dsn" envconfig:"DATABASE_DSN"` // MySQL and PostgreSQL: replaces host, port, database, user and password
+
+	// Connection pool of MySQL and PostgreSQL, 0 keeps the default of database/sql
+	MaxOpenConns    int           `yaml:"maxOpenConns" envconfig:"DATABASE_MAX_OPEN_CONNS"`
+	MaxIdleConns    int           `yaml:"maxIdleConns" envconfig:"DATABASE_MAX_IDLE_CONNS"`
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime" envconfig:"DATABASE_CONN_MAX_LIFETIME"`
+}
+
+// dsn returns the connection string of a MySQL or PostgreSQL database. The MySQL connection reports the matched
+// instead of the changed rows, like the other databases, the update queries rely on it.
+func (cfg *DatabaseConfig) dsn() string {
+	if cfg.DSN != "" {
+		return cfg.DSN
+	}
+	port := cfg.Port
+	switch cfg.Typ {
+	case SupportedDatabaseMySQL:
+		if port == 0 {
+			port = 3306
+		}
+		return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local&clientFoundRows=true",
+			cfg.User, cfg.Password, cfg.Host, port, cfg.Database)
+	default:
+		if port == 0 {
+			port = 5432
+		}
+		return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s", postgresValue(cfg.Host), port,
+			postgresValue(cfg.User), postgresValue(cfg.Password), postgresValue(cfg.Database))
+	}
+}
+
+// postgresValue quotes a value of a PostgreSQL key/value connection string.
+func postgresValue(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
 }
 
 func GetDatabaseForConfig(cfg *DatabaseConfig) (db *gorm.DB, err error) {
+	// the relations are maintained by the managers, e.g. peers may be stored before their interface
+	gormCfg := &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true}
+
 	switch cfg.Typ {
 	case SupportedDatabaseSQLite:
 		if _, err = os.Stat(filepath.Dir(cfg.Database)); os.IsNotExist(err) {
@@ -62,25 +78,36 @@ func GetDatabaseForConfig(cfg *DatabaseConfig) (db *gorm.DB, err error) {
 				return
 			}
 		}
-		db, err = gorm.Open(sqlite.Open(cfg.Database), &gorm.Config{DisableForeignKeyConstraintWhenMigrating: true})
+		db, err = gorm.Open(sqlite.Open(cfg.Database), gormCfg)
 		if err != nil {
 			return
 		}
-	case SupportedDatabaseMySQL:
-		connectionString := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
-		db, err = gorm.Open(mysql.Open(connectionString), &gorm.Config{})
+	case SupportedDatabaseMySQL, SupportedDatabasePostgres:
+		if cfg.Typ == SupportedDatabaseMySQL {
+			db, err = gorm.Open(mysql.Open(cfg.dsn()), gormCfg)
+		} else {
+			db, err = gorm.Open(postgres.Open(cfg.dsn()), gormCfg)
+		}
 		if err != nil {
-			return
+			return nil, errors.Wrapf(err, "failed to open %s database", cfg.Typ)
 		}
 
 		sqlDB, _ := db.DB()
-		sqlDB.SetConnMaxLifetime(time.Minute * 5)
-		sqlDB.SetMaxIdleConns(2)
-		sqlDB.SetMaxOpenConns(10)
+		if cfg.ConnMaxLifetime > 0 {
+			sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+		}
+		if cfg.MaxIdleConns > 0 {
+			sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+		}
+		if cfg.MaxOpenConns > 0 {
+			sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+		}
 		err = sqlDB.Ping() // This DOES open a connection if necessary. This makes sure the database is accessible
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to ping mysql authentication database")
+			return nil, errors.Wrapf(err, "failed to ping %s database", cfg.Typ)
 		}
+	default:
+		return nil, errors.Errorf("unsupported database type %q, use mysql, postgres or sqlite", cfg.Typ)
 	}
 
 	// Enable Logger (logrus)
@@ -99,62 +126,15 @@ func GetDatabaseForConfig(cfg *DatabaseConfig) (db *gorm.DB, err error) {
 	return
 }
 
-type DatabaseMigrationInfo struct {
-	Version string `gorm:"primaryKey"`
-	Applied time.Time
+// SchemaError adds a hint to an error of a migration, the portal does not start with an incomplete schema.
+func SchemaError(db *gorm.DB, err error) error {
+	return errors.WithMessagef(err, "could not create the database schema on %s, make sure that the database exists "+
+		"and that the database user may create and alter tables and indexes", db.Dialector.Name())
 }
 
-type Migration struct {
-	version   string
-	migrateFn func(db *gorm.DB) error
-}
-
-var migrations []Migration
-
-func MigrateDatabase(db *gorm.DB, version string) error {
-	if err := db.AutoMigrate(&DatabaseMigrationInfo{}); err != nil {
-		return errors.Wrap(err, "failed to migrate version database")
-	}
-
-	existingMigration := DatabaseMigrationInfo{}
-	db.Where("version = ?", version).FirstOrInit(&existingMigration)
-
-	if existingMigration.Version == "" {
-		lastVersion := DatabaseMigrationInfo{}
-		db.Order("applied desc, version desc").FirstOrInit(&lastVersion)
-
-		if lastVersion.Version == "" {
-			// fresh database, no migrations to apply
-			res := db.Create(&DatabaseMigrationInfo{
-				Version: version,
-				Applied: time.Now(),
-			})
-			if res.Error != nil {
-				return errors.Wrapf(res.Error, "failed to write version %s to database", version)
-			}
-			return nil
-		}
-
-		sort.Slice(migrations, func(i, j int) bool {
-			return migrations[i].version < migrations[j].version
-		})
-
-		for _, migration := range migrations {
-			if migration.version > lastVersion.Version {
-				if err := migration.migrateFn(db); err != nil {
-					return errors.Wrapf(err, "failed to migrate to version %s", migration.version)
-				}
-
-				res := db.Create(&DatabaseMigrationInfo{
-					Version: migration.version,
-					Applied: time.Now(),
-				})
-				if res.Error != nil {
-					return errors.Wrapf(res.Error, "failed to write version %s to database", migration.version)
-				}
-			}
-		}
-	}
-
-	return nil
+// SqlLikePattern returns a case-insensitive LIKE pattern that matches the search string anywhere. Wildcard characters
+// in the search string are escaped, the pattern must be used with ESCAPE '!' and a LOWER() column.
+func SqlLikePattern(search string) string {
+	search = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(strings.ToLower(search))
+	return "%" + search + "%"
 }
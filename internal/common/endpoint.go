@@ -0,0 +1,119 @@
+package common
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var nonPublicNetworks = mustParseCIDRs(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", // private and carrier-grade NAT
+	"127.0.0.0/8", "169.254.0.0/16", // loopback and link local
+	"::1/128", "fc00::/7", "fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// IsPublicIP returns false for loopback, link local and private addresses.
+func IsPublicIP(ip net.IP) bool {
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return !ip.IsUnspecified()
+}
+
+// HostFromUrl returns the host name (without port) of the given url, or an empty string if the url is invalid.
+func HostFromUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// ValidateEndpoint checks that the endpoint is a valid host:port combination and that the host can be resolved. The
+// returned boolean is true if the host only resolves to non-public addresses.
+func ValidateEndpoint(endpoint string) (bool, error) {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid endpoint %s", endpoint)
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || port <= 0 || port > 65535 {
+		return false, errors.Errorf("invalid port in endpoint %s", endpoint)
+	}
+	if host == "" {
+		return false, errors.Errorf("missing host in endpoint %s", endpoint)
+	}
+
+	ips, err := lookupHost(host)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to resolve endpoint host %s", host)
+	}
+
+	return !containsPublicIP(ips), nil
+}
+
+// IsPublicHost returns true if the given host name or ip address resolves to at least one public address.
+func IsPublicHost(host string) bool {
+	ips, err := lookupHost(host)
+	return err == nil && containsPublicIP(ips)
+}
+
+// EndpointHostname returns the host of the host:port endpoint if it is a host name, or an empty string if the host is
+// an ip address or the endpoint is invalid.
+func EndpointHostname(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil || net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// ResolveHost returns the addresses of the given host name or ip address.
+func ResolveHost(host string) ([]net.IP, error) {
+	return lookupHost(host)
+}
+
+func lookupHost(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	return ips, nil
+}
+
+func containsPublicIP(ips []net.IP) bool {
+	for _, ip := range ips {
+		if IsPublicIP(ip) {
+			return true
+		}
+	}
+	return false
+}
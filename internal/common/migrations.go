@@ -0,0 +1,175 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	schemaLockID      = 1
+	schemaLockTimeout = 5 * time.Minute  // how long an instance waits for the migrations of another instance
+	schemaLockStale   = 30 * time.Minute // older locks are left over from an instance that crashed while migrating
+	schemaLockPoll    = time.Second
+)
+
+// Migration is a versioned change of the database schema, the migrations are applied in the order of their version.
+// A migration must not use the models of the managers, they change with later versions. It declares the tables as
+// they are at its version instead, see schema.go.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration.
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// SchemaLock is held by the instance that applies the migrations, so that replicas sharing the database do not
+// migrate concurrently. The lock is a row of a table, this works the same way on all databases.
+type SchemaLock struct {
+	ID       uint `gorm:"primaryKey;autoIncrement:false"`
+	Owner    string
+	LockedAt time.Time
+}
+
+// MigrationResult is the outcome of MigrateDatabase.
+type MigrationResult struct {
+	FromVersion int
+	ToVersion   int
+	Applied     []SchemaMigration
+}
+
+// LatestSchemaVersion returns the version of the last migration, the schema version this binary works with.
+func LatestSchemaVersion() int {
+	latest := 0
+	for _, migration := range schemaMigrations {
+		if migration.Version > latest {
+			latest = migration.Version
+		}
+	}
+	return latest
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for an empty database.
+func SchemaVersion(db *gorm.DB) (int, error) {
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+	var current SchemaMigration
+	if err := db.Order("version DESC").Limit(1).Find(&current).Error; err != nil {
+		return 0, errors.Wrap(err, "failed to read the schema version")
+	}
+	return current.Version, nil
+}
+
+// MigrateDatabase applies the pending migrations. Each migration runs in a transaction together with its record,
+// MySQL commits schema changes immediately, so a failed migration may be partially applied there. A database with a
+// newer schema than this binary is refused, the migrations of a newer version cannot be undone.
+func MigrateDatabase(db *gorm.DB) (MigrationResult, error) {
+	result := MigrationResult{}
+
+	unlock, err := lockSchema(db)
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return result, SchemaError(db, errors.Wrap(err, "failed to create the schema version table"))
+	}
+	version, err := SchemaVersion(db)
+	if err != nil {
+		return result, err
+	}
+	result.FromVersion, result.ToVersion = version, version
+
+	if latest := LatestSchemaVersion(); version > latest {
+		return result, errors.Errorf("the database schema version %d is newer than the version %d of this binary, "+
+			"upgrade wg-portal or restore a backup of the database", version, latest)
+	}
+
+	migrations := append([]Migration(nil), schemaMigrations...)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		applied := SchemaMigration{Version: migration.Version, Name: migration.Name}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			applied.AppliedAt = time.Now()
+			return tx.Create(&applied).Error
+		})
+		if err != nil {
+			return result, SchemaError(db, errors.WithMessagef(err, "failed to apply migration %d (%s)",
+				migration.Version, migration.Name))
+		}
+		logrus.Infof("applied database migration %d: %s", migration.Version, migration.Name)
+		result.ToVersion = migration.Version
+		result.Applied = append(result.Applied, applied)
+	}
+
+	return result, nil
+}
+
+// lockSchema waits until no other instance applies migrations and takes the lock. The returned function releases it.
+func lockSchema(db *gorm.DB) (func(), error) {
+	if err := db.AutoMigrate(&SchemaLock{}); err != nil {
+		// another instance may have created the table at the same time
+		time.Sleep(schemaLockPoll)
+		if err := db.AutoMigrate(&SchemaLock{}); err != nil {
+			return nil, SchemaError(db, errors.Wrap(err, "failed to create the schema lock table"))
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	deadline := time.Now().Add(schemaLockTimeout)
+	waiting := false
+	for {
+		err := db.Create(&SchemaLock{ID: schemaLockID, Owner: owner, LockedAt: time.Now()}).Error
+		if err == nil {
+			return func() {
+				if err := db.Where("id = ? AND owner = ?", schemaLockID, owner).Delete(&SchemaLock{}).Error; err != nil {
+					logrus.Errorf("failed to release the schema lock: %v", err)
+				}
+			}, nil
+		}
+
+		var lock SchemaLock
+		if db.Where("id = ?", schemaLockID).Limit(1).Find(&lock).Error == nil && lock.Owner != "" {
+			if time.Since(lock.LockedAt) > schemaLockStale {
+				logrus.Warnf("removing the stale schema lock of %s from %s", lock.Owner,
+					lock.LockedAt.Format(time.RFC3339))
+				db.Where("id = ? AND owner = ?", schemaLockID, lock.Owner).Delete(&SchemaLock{})
+				continue
+			}
+			if !waiting {
+				logrus.Infof("waiting for the database migrations of %s", lock.Owner)
+				waiting = true
+			}
+		}
+		if time.Now().After(deadline) {
+			if lock.Owner == "" {
+				return nil, errors.Wrap(err, "failed to take the schema lock")
+			}
+			return nil, errors.Errorf("the database migrations are locked by %s since %s, remove the row from "+
+				"schema_locks if that instance is gone", lock.Owner, lock.LockedAt.Format(time.RFC3339))
+		}
+		time.Sleep(schemaLockPoll)
+	}
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The tables as they were created by AutoMigrate in release 1.0.8, before the versioned migrations.
+
+type baselineUser struct {
+	Email     string `gorm:"primaryKey"`
+	Source    string
+	IsAdmin   bool
+	Firstname string
+	Lastname  string
+	Phone     string
+	Password  string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineDevice struct {
+	Type                       string
+	DeviceName                 string `gorm:"primaryKey"`
+	DisplayName                string
+	PrivateKey                 string
+	ListenPort                 int
+	FirewallMark               int32
+	PublicKey                  string
+	Mtu                        int
+	IPsStr                     string
+	DNSStr                     string
+	RoutingTable               string
+	PreUp                      string
+	PostUp                     string
+	PreDown                    string
+	PostDown                   string
+	SaveConfig                 bool
+	DefaultEndpoint            string
+	DefaultAllowedIPsStr       string
+	DefaultPersistentKeepalive int
+	CreatedAt                  time.Time
+	UpdatedAt                  time.Time
+}
+
+func (baselineDevice) TableName() string { return "devices" }
+
+type baselinePeer struct {
+	UID                  string
+	DeviceName           string `gorm:"index"`
+	Identifier           string
+	Email                string `gorm:"index"`
+	IgnoreGlobalSettings bool
+	PublicKey            string `gorm:"primaryKey"`
+	PresharedKey         string
+	AllowedIPsStr        string
+	AllowedIPsSrvStr     string
+	Endpoint             string
+	PersistentKeepalive  int
+	PrivateKey           string
+	IPsStr               string
+	DNSStr               string
+	Mtu                  int
+	DeactivatedAt        *time.Time
+	CreatedBy            string
+	UpdatedBy            string
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+func (baselinePeer) TableName() string { return "peers" }
+
+type baselineMigrationInfo struct {
+	Version string `gorm:"primaryKey"`
+	Applied time.Time
+}
+
+func (baselineMigrationInfo) TableName() string { return "database_migration_infos" }
+
+func newTestDatabase(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := GetDatabaseForConfig(&DatabaseConfig{Typ: SupportedDatabaseSQLite,
+		Database: filepath.Join(t.TempDir(), "wg_portal.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// createBaselineDatabase creates the tables of release 1.0.8 with one device, user and peer. The emails are mixed
+// case, releases before 1.0.7 did not convert them.
+func createBaselineDatabase(t *testing.T, db *gorm.DB, release string) {
+	t.Helper()
+
+	if err := db.AutoMigrate(&baselineMigrationInfo{}, &baselineUser{}, &baselineDevice{}, &baselinePeer{}); err != nil {
+		t.Fatal(err)
+	}
+	rows := []interface{}{
+		&baselineMigrationInfo{Version: release, Applied: time.Now()},
+		&baselineDevice{Type: "server", DeviceName: "wg0", PrivateKey: "device-key", IPsStr: "10.0.0.1/24",
+			DefaultEndpoint: "vpn.example.org:51820"},
+		&baselineUser{Email: "Alice@Example.org", Source: "db", Firstname: "Alice", Password: "hash"},
+		&baselinePeer{UID: "u1", DeviceName: "wg0", Identifier: "laptop", Email: "Alice@Example.org",
+			PublicKey: "peer-key", PrivateKey: "peer-private-key", IPsStr: "10.0.0.2/32"},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertLatestSchema(t *testing.T, db *gorm.DB) {
+	t.Helper()
+
+	version, err := SchemaVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("schema version %d, want %d", version, LatestSchemaVersion())
+	}
+	models := []interface{}{&v1AuditEntry{}, &v1User{}, &v1Device{}, &v1Peer{}, &v1AllowedIPsPreset{},
+		&v1IPReservation{}, &v1PeerStatistic{}, &v1PeerConnection{}, &v1PeerTrafficDay{}, &v1UserTrafficMonth{},
+		&v1DownloadLink{}, &v1ApiToken{}, &v1Branding{}}
+	for _, model := range models {
+		if !db.Migrator().HasTable(model) {
+			t.Errorf("table of %T missing", model)
+		}
+	}
+	for _, column := range []string{"description", "tags_str", "deactivation_reason", "managed", "expires_at"} {
+		if !db.Migrator().HasColumn(&v1Peer{}, column) {
+			t.Errorf("column peers.%s missing", column)
+		}
+	}
+	if !db.Migrator().HasIndex(&v1Peer{}, "ExpiresAt") {
+		t.Error("index of peers.expires_at missing")
+	}
+	var locks int64
+	db.Model(&SchemaLock{}).Count(&locks)
+	if locks != 0 {
+		t.Error("the schema lock was not released")
+	}
+}
+
+func TestMigrateDatabaseOnEmptyDatabase(t *testing.T) {
+	db := newTestDatabase(t)
+
+	result, err := MigrateDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FromVersion != 0 || result.ToVersion != LatestSchemaVersion() {
+		t.Errorf("migrated from %d to %d, want 0 to %d", result.FromVersion, result.ToVersion, LatestSchemaVersion())
+	}
+	if len(result.Applied) != len(schemaMigrations) {
+		t.Errorf("%d migrations applied, want %d", len(result.Applied), len(schemaMigrations))
+	}
+	assertLatestSchema(t, db)
+
+	// a second run finds nothing to do
+	result, err = MigrateDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || result.FromVersion != LatestSchemaVersion() {
+		t.Errorf("second run applied %d migrations from version %d", len(result.Applied), result.FromVersion)
+	}
+}
+
+func TestMigrateDatabaseFromBaselineSchema(t *testing.T) {
+	for release, wantEmail := range map[string]string{"1.0.8": "Alice@Example.org", "1.0.6": "alice@example.org"} {
+		t.Run(release, func(t *testing.T) {
+			db := newTestDatabase(t)
+			createBaselineDatabase(t, db, release)
+
+			result, err := MigrateDatabase(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.FromVersion != 0 || len(result.Applied) != len(schemaMigrations) {
+				t.Errorf("applied %d migrations from version %d", len(result.Applied), result.FromVersion)
+			}
+			assertLatestSchema(t, db)
+
+			var device v1Device
+			if err := db.Where("device_name = ?", "wg0").First(&device).Error; err != nil {
+				t.Fatal(err)
+			}
+			if device.PrivateKey != "device-key" || device.DefaultEndpoint != "vpn.example.org:51820" {
+				t.Errorf("device settings lost: %+v", device)
+			}
+			if !device.GeneratePresharedKeys {
+				t.Error("the existing device did not get the default of the new column")
+			}
+
+			var user v1User
+			if err := db.First(&user).Error; err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != wantEmail || user.Password != "hash" {
+				t.Errorf("user %s with password %q, want %s", user.Email, user.Password, wantEmail)
+			}
+			if user.State != "active" {
+				t.Errorf("existing user has state %q, want active", user.State)
+			}
+
+			var peer v1Peer
+			if err := db.Where("public_key = ?", "peer-key").First(&peer).Error; err != nil {
+				t.Fatal(err)
+			}
+			if peer.Email != wantEmail || peer.PrivateKey != "peer-private-key" || peer.IPsStr != "10.0.0.2/32" {
+				t.Errorf("peer data lost: %+v", peer)
+			}
+		})
+	}
+}
+
+func TestMigrateDatabaseRefusesNewerSchema(t *testing.T) {
+	db := newTestDatabase(t)
+	if _, err := MigrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	newer := SchemaMigration{Version: LatestSchemaVersion() + 1, Name: "from the future", AppliedAt: time.Now()}
+	if err := db.Create(&newer).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateDatabase(db); err == nil {
+		t.Fatal("expected a database with a newer schema to be refused")
+	}
+}
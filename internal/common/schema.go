@@ -0,0 +1,293 @@
+package common
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// schemaMigrations are the migrations of the database schema. Append a migration with the next version for every
+// change of a stored model, applied migrations must never be changed.
+var schemaMigrations = []Migration{
+	{Version: 1, Name: "initial schema", Up: migrateInitialSchema},
+	{Version: 2, Name: "lower case emails of databases before 1.0.7", Up: migrateLowerCaseEmails},
+}
+
+// migrateInitialSchema creates the tables as they were before the versioned migrations. The tables of earlier
+// installations were created by AutoMigrate, the missing columns and indexes are added to them.
+func migrateInitialSchema(tx *gorm.DB) error {
+	// the peers were stored in the table users up to release 1.0.2
+	if tx.Migrator().HasTable("users") && !tx.Migrator().HasTable("peers") {
+		if err := tx.Migrator().RenameTable("users", "peers"); err != nil {
+			return errors.Wrap(err, "failed to rename the peer table of release 1.0.2")
+		}
+	}
+
+	// the defaults of the peers were renamed in release 1.0.4
+	renamedColumns := map[string]string{"endpoint": "default_endpoint",
+		"allowed_ips_str": "default_allowed_ips_str", "persistent_keepalive": "default_persistent_keepalive"}
+	for old, renamed := range renamedColumns {
+		if tx.Migrator().HasTable("devices") && tx.Migrator().HasColumn(&v1Device{}, old) {
+			if err := tx.Migrator().RenameColumn(&v1Device{}, old, renamed); err != nil {
+				return errors.Wrapf(err, "failed to rename the device column %s of release 1.0.3", old)
+			}
+		}
+	}
+
+	return tx.AutoMigrate(&v1AuditEntry{}, &v1User{}, &v1Device{}, &v1Peer{}, &v1AllowedIPsPreset{},
+		&v1IPReservation{}, &v1PeerStatistic{}, &v1PeerConnection{}, &v1PeerTrafficDay{}, &v1UserTrafficMonth{},
+		&v1DownloadLink{}, &v1ApiToken{}, &v1Branding{})
+}
+
+// migrateLowerCaseEmails converts the emails of databases of releases before 1.0.7. Later releases recorded their
+// version in the table database_migration_infos, on an empty database the conversion does nothing.
+func migrateLowerCaseEmails(tx *gorm.DB) error {
+	if tx.Migrator().HasTable("database_migration_infos") {
+		var versions []string
+		if err := tx.Table("database_migration_infos").Pluck("version", &versions).Error; err != nil {
+			return errors.Wrap(err, "failed to read the release version of the database")
+		}
+		for _, version := range versions {
+			if version >= "1.0.7" {
+				return nil
+			}
+		}
+	}
+
+	if err := tx.Exec("UPDATE users SET email = LOWER(email)").Error; err != nil {
+		return errors.Wrap(err, "failed to convert user emails to lower case")
+	}
+	if err := tx.Exec("UPDATE peers SET email = LOWER(email)").Error; err != nil {
+		return errors.Wrap(err, "failed to convert peer emails to lower case")
+	}
+	return nil
+}
+
+// The tables of schema version 1. The enum types of the models are plain strings in the database.
+
+type v1AuditEntry struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"index"`
+	Actor     string    `gorm:"index"`
+	Action    string    `gorm:"index"`
+	Interface string
+	Target    string
+	Details   string
+}
+
+func (v1AuditEntry) TableName() string { return "audit_entries" }
+
+type v1User struct {
+	Email       string `gorm:"primaryKey"`
+	Source      string
+	IsAdmin     bool
+	Firstname   string
+	Lastname    string
+	Phone       string
+	Username    string
+	DisplayName string
+	Theme       string `gorm:"default:system"`
+	State       string `gorm:"default:active;index"`
+	StateReason string
+	Password    string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+}
+
+func (v1User) TableName() string { return "users" }
+
+type v1Device struct {
+	Type                       string
+	DeviceName                 string `gorm:"primaryKey"`
+	DisplayName                string
+	PrivateKey                 string
+	ListenPort                 int
+	FirewallMark               int32
+	PublicKey                  string
+	Mtu                        int
+	IPsStr                     string
+	DNSStr                     string
+	RoutingTable               string
+	PreUp                      string
+	PostUp                     string
+	PreDown                    string
+	PostDown                   string
+	SaveConfig                 bool
+	DefaultEndpoint            string
+	EndpointCandidatesStr      string
+	DefaultAllowedIPsStr       string
+	DefaultPersistentKeepalive int
+	DefaultAllowedIPsPresetID  uint
+	DefaultGuestDays           int
+	TunnelMode                 string
+	InheritDNS                 bool
+	InheritAllowedIPs          bool
+	InheritKeepalive           bool
+	UpstreamInterface          string
+	Namespace                  string
+	InactivityDisableDays      int
+	MaxPeers                   int
+	GeneratePresharedKeys      bool `gorm:"default:true"`
+	SelfService                bool
+	DisabledAt                 *time.Time
+	DisableConfigFile          bool
+	CreatedAt                  time.Time
+	UpdatedAt                  time.Time
+}
+
+func (v1Device) TableName() string { return "devices" }
+
+type v1Peer struct {
+	UID                  string
+	DeviceName           string `gorm:"index"`
+	Identifier           string
+	Email                string `gorm:"index"`
+	IgnoreGlobalSettings bool
+	Description          string
+	TagsStr              string
+	Notes                string
+	PublicKey            string `gorm:"primaryKey"`
+	PresharedKey         string
+	AllowedIPsStr        string
+	AllowedIPsPresetID   uint `gorm:"index"`
+	AllowedIPsSrvStr     string
+	Endpoint             string
+	PersistentKeepalive  int
+	SiteEndpoint         string
+	PrivateKey           string
+	IPsStr               string
+	DNSStr               string
+	Mtu                  int
+	OverrideDNS          bool
+	OverrideMtu          bool
+	OverrideKeepalive    bool
+	OverrideEndpoint     bool
+	DeactivatedAt        *time.Time
+	DeactivationReason   string
+	ReactivatedAt        *time.Time
+	PreviousPublicKey    string
+	KeysRotatedAt        *time.Time
+	ExpiresAt            *time.Time `gorm:"index"`
+	Managed              bool
+	EnrollmentDevice     string `gorm:"index"`
+	CreatedBy            string
+	UpdatedBy            string
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+func (v1Peer) TableName() string { return "peers" }
+
+type v1AllowedIPsPreset struct {
+	ID            uint   `gorm:"primaryKey"`
+	DeviceName    string `gorm:"index"`
+	Name          string
+	AllowedIPsStr string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (v1AllowedIPsPreset) TableName() string { return "allowed_ips_presets" }
+
+type v1IPReservation struct {
+	ID          uint   `gorm:"primaryKey"`
+	DeviceName  string `gorm:"index"`
+	Network     string
+	Email       string
+	Identifier  string
+	Description string
+	CreatedBy   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (v1IPReservation) TableName() string { return "ip_reservations" }
+
+type v1PeerStatistic struct {
+	ID            uint      `gorm:"primaryKey"`
+	PublicKey     string    `gorm:"index"`
+	DeviceName    string    `gorm:"index"`
+	CollectedAt   time.Time `gorm:"index"`
+	LastHandshake *time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+	ReceiveDelta  int64
+	TransmitDelta int64
+}
+
+func (v1PeerStatistic) TableName() string { return "peer_statistics" }
+
+type v1PeerConnection struct {
+	ID             uint   `gorm:"primaryKey"`
+	PublicKey      string `gorm:"index"`
+	DeviceName     string `gorm:"index"`
+	Endpoint       string
+	FirstHandshake time.Time
+	LastHandshake  time.Time `gorm:"index"`
+}
+
+func (v1PeerConnection) TableName() string { return "peer_connections" }
+
+type v1PeerTrafficDay struct {
+	ID            uint   `gorm:"primaryKey"`
+	Day           string `gorm:"index;size:10"`
+	PublicKey     string `gorm:"index"`
+	DeviceName    string
+	Identifier    string
+	Email         string `gorm:"index"`
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+func (v1PeerTrafficDay) TableName() string { return "peer_traffic_days" }
+
+type v1UserTrafficMonth struct {
+	ID            uint   `gorm:"primaryKey"`
+	Month         string `gorm:"index;size:7"`
+	Email         string `gorm:"index"`
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+func (v1UserTrafficMonth) TableName() string { return "user_traffic_months" }
+
+type v1DownloadLink struct {
+	ID        uint   `gorm:"primaryKey"`
+	TokenHash string `gorm:"uniqueIndex;size:64"`
+	PeerKey   string `gorm:"index"`
+	CreatedAt time.Time
+	CreatedBy string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	UsedFrom  string
+	RevokedAt *time.Time
+	RevokedBy string
+}
+
+func (v1DownloadLink) TableName() string { return "download_links" }
+
+type v1ApiToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	TokenHash  string `gorm:"uniqueIndex;size:64"`
+	Email      string `gorm:"index"`
+	Name       string
+	Scope      string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+func (v1ApiToken) TableName() string { return "api_tokens" }
+
+type v1Branding struct {
+	ID           uint `gorm:"primaryKey"`
+	Logo         []byte
+	LogoType     string
+	PrimaryColor string
+	CustomCSS    string
+	UpdatedBy    string
+	UpdatedAt    time.Time
+}
+
+func (v1Branding) TableName() string { return "brandings" }
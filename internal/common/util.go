@@ -40,6 +40,12 @@ func IsIPv6(address string) bool {
 	return ip.To4() == nil
 }
 
+// IsLinkLocal checks if the address of the given cidr is a link-local unicast address, e.g. fe80::1/64.
+func IsLinkLocal(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.IsLinkLocalUnicast()
+}
+
 // ParseStringList converts a comma separated string into a list of strings.
 // It also trims spaces from each element of the list.
 func ParseStringList(lst string) []string {
@@ -84,3 +90,18 @@ func ByteCountSI(b int64) string {
 	return fmt.Sprintf("%.1f %cB",
 		float64(b)/float64(div), "kMGTPE"[exp])
 }
+
+// NormalizeCIDRList parses a comma separated list of networks, clears the host bits and removes duplicates.
+func NormalizeCIDRList(lst string) (string, error) {
+	networks := make([]string, 0)
+	for _, cidr := range ParseStringList(lst) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return "", fmt.Errorf("invalid network %s: %v", cidr, err)
+		}
+		if !ListContains(networks, network.String()) {
+			networks = append(networks, network.String())
+		}
+	}
+	return ListToString(networks), nil
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type WebhookEventType string
+
+const (
+	WebhookEventPeerCreated      WebhookEventType = "peer.created"
+	WebhookEventPeerUpdated      WebhookEventType = "peer.updated"
+	WebhookEventPeerDeleted      WebhookEventType = "peer.deleted"
+	WebhookEventPeerExpired      WebhookEventType = "peer.expired"
+	WebhookEventPeerKeysRotated  WebhookEventType = "peer.keys_rotated" // PeerKey is the new public key
+	WebhookEventInterfaceCreated WebhookEventType = "interface.created"
+	WebhookEventInterfaceUpdated WebhookEventType = "interface.updated"
+	WebhookEventInterfaceDeleted WebhookEventType = "interface.deleted"
+)
+
+// WebhookSignatureHeader contains the hex encoded HMAC-SHA256 of the request body, prefixed with "sha256=".
+const WebhookSignatureHeader = "X-WGP-Signature"
+
+type WebhookConfig struct {
+	Urls       []string      `yaml:"urls" envconfig:"WEBHOOK_URLS"`
+	Secret     string        `yaml:"secret" envconfig:"WEBHOOK_SECRET"` // used to sign the payload, no signature is sent if empty
+	Timeout    time.Duration `yaml:"timeout" envconfig:"WEBHOOK_TIMEOUT"`
+	MaxRetries int           `yaml:"maxRetries" envconfig:"WEBHOOK_MAX_RETRIES"`
+}
+
+type WebhookEvent struct {
+	Type      WebhookEventType `json:"type"`
+	Interface string           `json:"interface"`
+	PeerKey   string           `json:"peer_key,omitempty"`
+	Actor     string           `json:"actor"`
+	Timestamp time.Time        `json:"timestamp"`
+}
+
+// WebhookDispatcher delivers events to all configured webhook urls. Deliveries run in the background and are retried
+// with an exponential backoff, so they never block the operation that caused the event.
+type WebhookDispatcher struct {
+	ctx    context.Context
+	cfg    WebhookConfig
+	client *http.Client
+}
+
+func NewWebhookDispatcher(ctx context.Context, cfg WebhookConfig) *WebhookDispatcher {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	return &WebhookDispatcher{
+		ctx:    ctx,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// Dispatch sends the event to all configured webhook urls.
+func (d *WebhookDispatcher) Dispatch(event WebhookEvent) {
+	if len(d.cfg.Urls) == 0 {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if event.Actor == "" {
+		event.Actor = "system"
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logrus.Errorf("failed to encode webhook event %s: %v", event.Type, err)
+		return
+	}
+
+	for _, url := range d.cfg.Urls {
+		go d.deliver(url, event.Type, payload)
+	}
+}
+
+func (d *WebhookDispatcher) deliver(url string, eventType WebhookEventType, payload []byte) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := d.send(url, eventType, payload)
+		if err == nil {
+			return
+		}
+
+		if attempt >= d.cfg.MaxRetries {
+			logrus.Errorf("failed to deliver webhook event %s to %s after %d attempts: %v", eventType, url, attempt+1, err)
+			return
+		}
+
+		logrus.Debugf("failed to deliver webhook event %s to %s, retrying in %s: %v", eventType, url, backoff, err)
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (d *WebhookDispatcher) send(url string, eventType WebhookEventType, payload []byte) error {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-WGP-Event", string(eventType))
+	if d.cfg.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhookPayload(d.cfg.Secret, payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 of the payload.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,205 @@
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SourceLanguage is the language of the messages in the templates and the code. It is always available, also without
+// catalog file.
+const SourceLanguage = "en"
+
+// NameKey is the key of the display name of the language in a catalog file, e.g. "Deutsch".
+const NameKey = "@name"
+
+// Language is an available language of the catalog.
+type Language struct {
+	Tag  string // e.g. "de" or "pt-br"
+	Name string
+}
+
+// Catalog holds the translations of the messages. Each language is a JSON file named after the language tag, e.g.
+// de.json, that maps the English messages to their translation. Messages without translation, or with an empty
+// translation, are shown in English.
+type Catalog struct {
+	languages map[string]map[string]string
+}
+
+// NewCatalog returns a catalog that only contains the source language.
+func NewCatalog() *Catalog {
+	return &Catalog{languages: map[string]map[string]string{SourceLanguage: {NameKey: "English"}}}
+}
+
+// Load adds the catalog files (*.json) of the directory of the file system. Languages that are already loaded are
+// extended, translations of later files win.
+func (c *Catalog) Load(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return errors.Wrap(err, "failed to list catalog files")
+	}
+	for _, file := range files {
+		raw, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read catalog %s", file)
+		}
+		messages := make(map[string]string)
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return errors.Wrapf(err, "invalid catalog %s", file)
+		}
+		tag := NormalizeTag(strings.TrimSuffix(path.Base(file), ".json"))
+		if c.languages[tag] == nil {
+			c.languages[tag] = make(map[string]string, len(messages))
+		}
+		for msg, translation := range messages {
+			if translation != "" {
+				c.languages[tag][msg] = translation
+			}
+		}
+	}
+	return nil
+}
+
+// LoadDir adds the catalog files of a directory on disk, see Load.
+func (c *Catalog) LoadDir(dir string) error {
+	return c.Load(os.DirFS(dir), ".")
+}
+
+// Has reports whether the language is available.
+func (c *Catalog) Has(tag string) bool {
+	_, ok := c.languages[NormalizeTag(tag)]
+	return ok
+}
+
+// Languages returns the available languages, sorted by tag.
+func (c *Catalog) Languages() []Language {
+	languages := make([]Language, 0, len(c.languages))
+	for tag, messages := range c.languages {
+		name := messages[NameKey]
+		if name == "" {
+			name = tag
+		}
+		languages = append(languages, Language{Tag: tag, Name: name})
+	}
+	sort.Slice(languages, func(i, j int) bool { return languages[i].Tag < languages[j].Tag })
+	return languages
+}
+
+// Translate returns the translation of the message, formatted with the arguments like fmt.Sprintf. The message itself
+// is used if the language has no translation for it.
+func (c *Catalog) Translate(tag, msg string, args ...interface{}) string {
+	if translation, ok := c.languages[tag][msg]; ok {
+		msg = translation
+	}
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// Negotiate returns the available language that matches the Accept-Language header best, or an empty string if none
+// matches. Regional variants match their base language, e.g. de-AT matches de.
+func (c *Catalog) Negotiate(acceptLanguage string) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	requested := make([]weighted, 0)
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		tag := NormalizeTag(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if q > 0 {
+			requested = append(requested, weighted{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(requested, func(i, j int) bool { return requested[i].q > requested[j].q })
+
+	for _, r := range requested {
+		if c.Has(r.tag) {
+			return r.tag
+		}
+		if i := strings.Index(r.tag, "-"); i > 0 && c.Has(r.tag[:i]) {
+			return r.tag[:i]
+		}
+	}
+	return ""
+}
+
+// NormalizeTag returns the lower case language tag with dashes, e.g. pt_BR becomes pt-br.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+var (
+	markedMu sync.Mutex
+	marked   = make(map[string]struct{})
+)
+
+// Mark registers a message of the code for Extract and returns it unchanged. The message still has to be translated
+// where it is shown, e.g. with the t function of the templates.
+func Mark(msg string) string {
+	markedMu.Lock()
+	defer markedMu.Unlock()
+	marked[msg] = struct{}{}
+	return msg
+}
+
+// templateMessage matches the string literals passed to the t function of the templates, e.g. {{t "Login"}} or
+// (t "Hello %s" .Name).
+var templateMessage = regexp.MustCompile(`(?:\{\{-?|\()\s*t\s+("(?:[^"\\]|\\.)*")`)
+
+// Extract returns the messages of the templates matching the pattern and the messages registered with Mark, sorted.
+func Extract(fsys fs.FS, pattern string) ([]string, error) {
+	files, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list templates")
+	}
+
+	found := make(map[string]struct{})
+	for _, file := range files {
+		raw, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read template %s", file)
+		}
+		for _, match := range templateMessage.FindAllStringSubmatch(string(raw), -1) {
+			msg, err := strconv.Unquote(match[1])
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid message %s in %s", match[1], file)
+			}
+			found[msg] = struct{}{}
+		}
+	}
+	markedMu.Lock()
+	for msg := range marked {
+		found[msg] = struct{}{}
+	}
+	markedMu.Unlock()
+
+	messages := make([]string, 0, len(found))
+	for msg := range found {
+		messages = append(messages, msg)
+	}
+	sort.Strings(messages)
+	return messages, nil
+}
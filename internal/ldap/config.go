@@ -21,6 +21,8 @@ type Config struct {
 	BindPass       string `yaml:"pass" envconfig:"LDAP_PASSWORD"`
 
 	EmailAttribute       string `yaml:"attrEmail" envconfig:"LDAP_ATTR_EMAIL"`
+	UsernameAttribute    string `yaml:"attrUsername" envconfig:"LDAP_ATTR_USERNAME"`
+	DisplayNameAttribute string `yaml:"attrDisplayName" envconfig:"LDAP_ATTR_DISPLAYNAME"` // the DN is used if the attribute is empty
 	FirstNameAttribute   string `yaml:"attrFirstname" envconfig:"LDAP_ATTR_FIRSTNAME"`
 	LastNameAttribute    string `yaml:"attrLastname" envconfig:"LDAP_ATTR_LASTNAME"`
 	PhoneAttribute       string `yaml:"attrPhone" envconfig:"LDAP_ATTR_PHONE"`
@@ -30,4 +32,9 @@ type Config struct {
 	SyncFilter     string `yaml:"syncFilter" envconfig:"LDAP_SYNC_FILTER"`
 	AdminLdapGroup string `yaml:"adminGroup" envconfig:"LDAP_ADMIN_GROUP"` // Members of this group receive admin rights in WG-Portal
 	AdminLdapGroup_ *gldap.DN `yaml:"-"`
+
+	// Peers of the users that the synchronization creates, disabled by default
+	SyncCreatePeer   bool   `yaml:"syncCreatePeer" envconfig:"LDAP_SYNC_CREATE_PEER"`
+	SyncPeerDevice   string `yaml:"syncPeerDevice" envconfig:"LDAP_SYNC_PEER_DEVICE"` // WG_DEFAULT_DEVICE if empty
+	SyncSendPeerMail bool   `yaml:"syncSendPeerMail" envconfig:"LDAP_SYNC_SEND_PEER_MAIL"`
 }
@@ -50,8 +50,7 @@ func FindAllUsers(cfg *Config) ([]RawLdapData, error) {
 	defer Close(client)
 
 	// Search all users
-	attrs := []string{"dn", cfg.EmailAttribute, cfg.EmailAttribute, cfg.FirstNameAttribute, cfg.LastNameAttribute,
-		cfg.PhoneAttribute, cfg.GroupMemberAttribute}
+	attrs := cfg.UserAttributeNames()
 	searchRequest := ldap.NewSearchRequest(
 		cfg.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
@@ -66,18 +65,7 @@ func FindAllUsers(cfg *Config) ([]RawLdapData, error) {
 	tmpData := make([]RawLdapData, 0, len(sr.Entries))
 
 	for _, entry := range sr.Entries {
-		tmp := RawLdapData{
-			DN:            entry.DN,
-			Attributes:    make(map[string]string, len(attrs)),
-			RawAttributes: make(map[string][][]byte, len(attrs)),
-		}
-
-		for _, field := range attrs {
-			tmp.Attributes[field] = entry.GetAttributeValue(field)
-			tmp.RawAttributes[field] = entry.GetRawAttributeValues(field)
-		}
-
-		tmpData = append(tmpData, tmp)
+		tmpData = append(tmpData, NewRawLdapData(entry, attrs))
 	}
 
 	return tmpData, nil
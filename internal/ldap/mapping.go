@@ -0,0 +1,88 @@
+package ldap
+
+import (
+	"strings"
+
+	gldap "github.com/go-ldap/ldap/v3"
+)
+
+// UserAttributes contains the values of an LDAP entry that are stored in the local user, see MapUserAttributes.
+type UserAttributes struct {
+	Email       string // lowercase
+	Username    string
+	DisplayName string // falls back to the DN of the entry
+	Firstname   string
+	Lastname    string
+	Phone       string
+	IsAdmin     bool
+}
+
+// UserAttributeNames returns the attributes that have to be requested for MapUserAttributes.
+func (c *Config) UserAttributeNames() []string {
+	attrs := []string{"dn"}
+	for _, attr := range []string{c.EmailAttribute, c.UsernameAttribute, c.DisplayNameAttribute, c.FirstNameAttribute,
+		c.LastNameAttribute, c.PhoneAttribute, c.GroupMemberAttribute} {
+		if attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+// NewRawLdapData copies the given attributes of an LDAP entry. Attributes contains the first value of each attribute.
+func NewRawLdapData(entry *gldap.Entry, attrs []string) RawLdapData {
+	data := RawLdapData{
+		DN:            entry.DN,
+		Attributes:    make(map[string]string, len(attrs)),
+		RawAttributes: make(map[string][][]byte, len(attrs)),
+	}
+	for _, field := range attrs {
+		data.Attributes[field] = entry.GetAttributeValue(field)
+		data.RawAttributes[field] = entry.GetRawAttributeValues(field)
+	}
+	return data
+}
+
+// MapUserAttributes maps the attributes of an LDAP entry to the fields of the local user. For multi-valued attributes
+// the first non-empty value is used, the admin flag is set if any of the group values matches the admin group.
+func MapUserAttributes(cfg *Config, data *RawLdapData) UserAttributes {
+	attrs := UserAttributes{
+		Email:       strings.ToLower(firstValue(data, cfg.EmailAttribute)),
+		Username:    firstValue(data, cfg.UsernameAttribute),
+		DisplayName: firstValue(data, cfg.DisplayNameAttribute),
+		Firstname:   firstValue(data, cfg.FirstNameAttribute),
+		Lastname:    firstValue(data, cfg.LastNameAttribute),
+		Phone:       firstValue(data, cfg.PhoneAttribute),
+		IsAdmin:     IsAdminGroupMember(cfg, data.RawAttributes[cfg.GroupMemberAttribute]),
+	}
+	if attrs.DisplayName == "" {
+		attrs.DisplayName = data.DN
+	}
+	return attrs
+}
+
+// IsAdminGroupMember checks if one of the given group DNs is the configured admin group.
+func IsAdminGroupMember(cfg *Config, groups [][]byte) bool {
+	if cfg.AdminLdapGroup_ == nil {
+		return false
+	}
+	for _, group := range groups {
+		dn, err := gldap.ParseDN(string(group))
+		if err == nil && cfg.AdminLdapGroup_.Equal(dn) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstValue(data *RawLdapData, attr string) string {
+	if attr == "" {
+		return ""
+	}
+	for _, value := range data.RawAttributes[attr] {
+		if v := strings.TrimSpace(string(value)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
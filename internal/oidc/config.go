@@ -0,0 +1,80 @@
+package oidc
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Roles of service identities
+const (
+	RoleAdmin = "admin" // access to all API endpoints, like an administrator
+	RoleUser  = "user"  // access to the deployment endpoints, like a regular user
+)
+
+// Config configures the OpenID Connect providers whose access tokens are accepted by the REST API.
+type Config struct {
+	Providers    []ProviderConfig `yaml:"providers" ignored:"true"`                     // only configurable in the yaml file
+	ClockSkew    time.Duration    `yaml:"clockSkew" envconfig:"OIDC_CLOCK_SKEW"`        // tolerance for the exp, nbf and iat claims
+	JwksCacheTTL time.Duration    `yaml:"jwksCacheTTL" envconfig:"OIDC_JWKS_CACHE_TTL"` // the signing keys are fetched again after this duration
+}
+
+// ProviderConfig is an identity provider that issues access tokens for the portal.
+type ProviderConfig struct {
+	Issuer   string   `yaml:"issuer"`   // must match the iss claim
+	JwksUrl  string   `yaml:"jwksUrl"`  // optional, discovered from the issuer if empty
+	Audience []string `yaml:"audience"` // the aud claim must contain one of them
+
+	UserClaim         string            `yaml:"userClaim"`    // claim with the email address of the portal user, default: email
+	ServiceClaim      string            `yaml:"serviceClaim"` // claim that is matched against the service identities, default: sub
+	ServiceIdentities []ServiceIdentity `yaml:"serviceIdentities"`
+}
+
+// ServiceIdentity maps the tokens of a machine client to a synthetic identity that is not stored as a user.
+type ServiceIdentity struct {
+	Value string `yaml:"value"` // value of the service claim, e.g. the client id
+	Name  string `yaml:"name"`  // shown as actor in the audit log, e.g. service:provisioning
+	Role  string `yaml:"role"`  // admin or user
+}
+
+// Validate checks the provider configurations, the defaults of the claims are applied.
+func (c *Config) Validate() error {
+	for i := range c.Providers {
+		provider := &c.Providers[i]
+		if provider.Issuer == "" {
+			return errors.Errorf("oidc provider %d: the issuer is required", i+1)
+		}
+		if len(provider.Audience) == 0 {
+			return errors.Errorf("oidc provider %s: at least one audience is required", provider.Issuer)
+		}
+		if provider.UserClaim == "" {
+			provider.UserClaim = "email"
+		}
+		if provider.ServiceClaim == "" {
+			provider.ServiceClaim = "sub"
+		}
+		for _, identity := range provider.ServiceIdentities {
+			if identity.Value == "" || identity.Name == "" {
+				return errors.Errorf("oidc provider %s: service identities need a value and a name", provider.Issuer)
+			}
+			if identity.Role != RoleAdmin && identity.Role != RoleUser {
+				return errors.Errorf("oidc provider %s: invalid role %q of service identity %s, use admin or user",
+					provider.Issuer, identity.Role, identity.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// ServiceIdentity returns the service identity for the value of the service claim, or nil.
+func (p ProviderConfig) ServiceIdentity(value string) *ServiceIdentity {
+	if value == "" {
+		return nil
+	}
+	for i := range p.ServiceIdentities {
+		if p.ServiceIdentities[i].Value == value {
+			return &p.ServiceIdentities[i]
+		}
+	}
+	return nil
+}
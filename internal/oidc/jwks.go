@@ -0,0 +1,185 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	httpTimeout       = 10 * time.Second
+	jwksRefreshPeriod = time.Minute // the keys are fetched at most once per period, e.g. for tokens with unknown key ids
+)
+
+// jsonWebKey is a public key of the JWKS of a provider, see RFC 7517.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the signing keys of a provider. The keys are fetched again after the cache TTL, or if a token is
+// signed with an unknown key, so key rotations are picked up.
+type keySet struct {
+	mux       sync.Mutex
+	provider  ProviderConfig
+	ttl       time.Duration
+	client    *http.Client
+	jwksUrl   string
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	err       error // error of the last refresh
+}
+
+func newKeySet(provider ProviderConfig, ttl time.Duration) *keySet {
+	return &keySet{
+		provider: provider,
+		ttl:      ttl,
+		client:   &http.Client{Timeout: httpTimeout},
+		jwksUrl:  provider.JwksUrl,
+	}
+}
+
+// get returns the key with the given id. Tokens without key id are checked against all keys of the provider.
+func (k *keySet) get(kid string) ([]crypto.PublicKey, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	expired := k.keys == nil || (k.ttl > 0 && time.Since(k.fetchedAt) > k.ttl)
+	_, known := k.keys[kid]
+	if (expired || (kid != "" && !known)) && time.Since(k.fetchedAt) > jwksRefreshPeriod {
+		k.err = k.refresh()
+	}
+	if k.keys == nil {
+		return nil, k.err // the keys of the last successful refresh are used while the provider is unreachable
+	}
+
+	if kid != "" {
+		if key, ok := k.keys[kid]; ok {
+			return []crypto.PublicKey{key}, nil
+		}
+		return nil, nil
+	}
+	keys := make([]crypto.PublicKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (k *keySet) refresh() error {
+	k.fetchedAt = time.Now() // failures are not retried before the refresh period either
+	if k.jwksUrl == "" {
+		var discovery struct {
+			JwksUri string `json:"jwks_uri"`
+		}
+		if err := k.fetchJSON(strings.TrimRight(k.provider.Issuer, "/")+"/.well-known/openid-configuration",
+			&discovery); err != nil {
+			return errors.WithMessage(err, "failed to discover the provider configuration")
+		}
+		if discovery.JwksUri == "" {
+			return errors.New("the provider configuration has no jwks_uri")
+		}
+		k.jwksUrl = discovery.JwksUri
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := k.fetchJSON(k.jwksUrl, &jwks); err != nil {
+		return errors.WithMessage(err, "failed to fetch the signing keys")
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue // unsupported key types are skipped
+		}
+		keys[jwk.Kid] = key
+	}
+	k.keys = keys
+
+	return nil
+}
+
+func (k *keySet) fetchJSON(url string, v interface{}) error {
+	resp, err := k.client.Get(url)
+	if err != nil {
+		return errors.Wrapf(err, "failed to request %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status %d of %s", resp.StatusCode, url)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrapf(err, "invalid response of %s", url)
+	}
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,213 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Reasons of TokenError, they are returned to the API clients
+const (
+	ReasonMalformed        = "malformed token"
+	ReasonUnknownIssuer    = "unknown issuer"
+	ReasonInvalidSignature = "invalid signature"
+	ReasonExpired          = "token expired"
+	ReasonNoExpiry         = "token without expiry"
+	ReasonNotYetValid      = "token not yet valid"
+	ReasonInvalidAudience  = "invalid audience"
+)
+
+// TokenError is returned if an access token is rejected.
+type TokenError struct {
+	Reason string
+}
+
+func (e *TokenError) Error() string {
+	return e.Reason
+}
+
+// Token is a verified access token.
+type Token struct {
+	Provider ProviderConfig
+	Claims   map[string]interface{}
+}
+
+// StringClaim returns the value of a string claim, or an empty string.
+func (t *Token) StringClaim(name string) string {
+	value, _ := t.Claims[name].(string)
+	return value
+}
+
+// Verifier validates JWT access tokens of the configured providers.
+type Verifier struct {
+	cfg  Config
+	keys map[string]*keySet // by issuer
+}
+
+// NewVerifier returns a verifier for the providers of the validated configuration. The signing keys are fetched when
+// the first token of a provider is verified, so the portal starts while a provider is unreachable.
+func NewVerifier(cfg Config) *Verifier {
+	v := &Verifier{cfg: cfg, keys: make(map[string]*keySet, len(cfg.Providers))}
+	for _, provider := range cfg.Providers {
+		v.keys[provider.Issuer] = newKeySet(provider, cfg.JwksCacheTTL)
+	}
+	return v
+}
+
+// IsJWT reports whether the token has the structure of a JWT, other tokens are not verified.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature, the issuer, the audience and the validity period of the token. A *TokenError is
+// returned if the token is rejected, other errors are returned if the signing keys cannot be fetched.
+func (v *Verifier) Verify(rawToken string) (*Token, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, &TokenError{Reason: ReasonMalformed}
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, &TokenError{Reason: ReasonMalformed}
+	}
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, &TokenError{Reason: ReasonMalformed}
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, &TokenError{Reason: ReasonMalformed}
+	}
+
+	// the issuer selects the keys, it is only trusted after the signature has been checked
+	issuer, _ := claims["iss"].(string)
+	keys, ok := v.keys[issuer]
+	if !ok {
+		return nil, &TokenError{Reason: ReasonUnknownIssuer}
+	}
+	candidates, err := keys.get(header.Kid)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "failed to load the signing keys of %s", issuer)
+	}
+	if !verifySignature(header.Alg, parts[0]+"."+parts[1], signature, candidates) {
+		return nil, &TokenError{Reason: ReasonInvalidSignature}
+	}
+
+	token := &Token{Provider: keys.provider, Claims: claims}
+	if err := v.checkClaims(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (v *Verifier) checkClaims(token *Token) error {
+	now := time.Now()
+	expiresAt, ok := numericClaim(token.Claims, "exp")
+	if !ok {
+		return &TokenError{Reason: ReasonNoExpiry}
+	}
+	if now.After(expiresAt.Add(v.cfg.ClockSkew)) {
+		return &TokenError{Reason: ReasonExpired}
+	}
+	if notBefore, ok := numericClaim(token.Claims, "nbf"); ok && now.Add(v.cfg.ClockSkew).Before(notBefore) {
+		return &TokenError{Reason: ReasonNotYetValid}
+	}
+	if issuedAt, ok := numericClaim(token.Claims, "iat"); ok && now.Add(v.cfg.ClockSkew).Before(issuedAt) {
+		return &TokenError{Reason: ReasonNotYetValid}
+	}
+
+	var audiences []string
+	switch aud := token.Claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, value := range aud {
+			if s, ok := value.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	for _, audience := range audiences {
+		for _, accepted := range token.Provider.Audience {
+			if audience == accepted {
+				return nil
+			}
+		}
+	}
+	return &TokenError{Reason: ReasonInvalidAudience}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// verifySignature checks the signature with the given keys. Only asymmetric algorithms are supported, so tokens with
+// "none" or HMAC signatures are always rejected.
+func verifySignature(alg, signed string, signature []byte, keys []crypto.PublicKey) bool {
+	var hashFunc crypto.Hash
+	var h hash.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hashFunc, h = crypto.SHA256, sha256.New()
+	case "RS384", "PS384", "ES384":
+		hashFunc, h = crypto.SHA384, sha512.New384()
+	case "RS512", "PS512", "ES512":
+		hashFunc, h = crypto.SHA512, sha512.New()
+	default:
+		return false
+	}
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			switch alg[:2] {
+			case "RS":
+				if rsa.VerifyPKCS1v15(key, hashFunc, digest, signature) == nil {
+					return true
+				}
+			case "PS":
+				if rsa.VerifyPSS(key, hashFunc, digest, signature, nil) == nil {
+					return true
+				}
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if alg[:2] != "ES" || len(signature) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import "syscall"
+
+func checkDirectoryAccess(directory string) error {
+	return syscall.Access(directory, syscall.O_RDWR)
+}
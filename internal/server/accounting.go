@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+)
+
+// Periods of the traffic accounting export
+const (
+	TrafficPeriodMonth = "month" // traffic per user and month
+	TrafficPeriodDay   = "day"   // traffic per peer and day
+)
+
+// TrafficRange is an inclusive range of days of the traffic accounting.
+type TrafficRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// parseTrafficRange parses the first and the last day of the range, as month (YYYY-MM) or as day (YYYY-MM-DD). A month
+// starts with its first day and ends with its last day. By default, the range contains the current and the two
+// previous months.
+func parseTrafficRange(from, to string, now time.Time) (TrafficRange, error) {
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	r := TrafficRange{From: currentMonth.AddDate(0, -2, 0), To: currentMonth.AddDate(0, 1, -1)}
+
+	if from != "" {
+		day, _, err := parseTrafficDate(from)
+		if err != nil {
+			return r, errors.WithMessage(err, "invalid start of range")
+		}
+		r.From = day
+	}
+	if to != "" {
+		day, isMonth, err := parseTrafficDate(to)
+		if err != nil {
+			return r, errors.WithMessage(err, "invalid end of range")
+		}
+		if isMonth {
+			day = day.AddDate(0, 1, -1)
+		}
+		r.To = day
+	}
+	if r.To.Before(r.From) {
+		return r, errors.New("the end of the range is before its start")
+	}
+	return r, nil
+}
+
+func parseTrafficDate(value string) (time.Time, bool, error) {
+	if day, err := time.ParseInLocation(wireguard.TrafficDayFormat, value, time.Local); err == nil {
+		return day, false, nil
+	}
+	month, err := time.ParseInLocation(wireguard.TrafficMonthFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, false, errors.Errorf("%s is neither a month (YYYY-MM) nor a day (YYYY-MM-DD)", value)
+	}
+	return month, true, nil
+}
+
+// GetMonthlyTraffic returns the traffic of the users in the months of the range.
+func (s *Server) GetMonthlyTraffic(r TrafficRange) []wireguard.UserTrafficMonth {
+	return s.stats.GetMonthlyTraffic(r.From.Format(wireguard.TrafficMonthFormat), r.To.Format(wireguard.TrafficMonthFormat))
+}
+
+// GetDailyTraffic returns the traffic of the peers on the days of the range. Days older than WG_TRAFFIC_DAILY_RETENTION
+// are not available anymore.
+func (s *Server) GetDailyTraffic(r TrafficRange) []wireguard.PeerTrafficDay {
+	return s.stats.GetDailyTraffic(r.From.Format(wireguard.TrafficDayFormat), r.To.Format(wireguard.TrafficDayFormat))
+}
+
+// writeTrafficCSV writes the monthly traffic, or the daily traffic if a period of days is requested.
+func writeTrafficCSV(w io.Writer, months []wireguard.UserTrafficMonth, days []wireguard.PeerTrafficDay) error {
+	out := csv.NewWriter(w)
+	if days != nil {
+		_ = out.Write([]string{"day", "email", "interface", "peer", "public_key", "received_bytes", "transmitted_bytes"})
+		for _, day := range days {
+			_ = out.Write([]string{day.Day, day.Email, day.DeviceName, day.Identifier, day.PublicKey,
+				strconv.FormatInt(day.ReceiveBytes, 10), strconv.FormatInt(day.TransmitBytes, 10)})
+		}
+	} else {
+		_ = out.Write([]string{"month", "email", "received_bytes", "transmitted_bytes"})
+		for _, month := range months {
+			_ = out.Write([]string{month.Month, month.Email, strconv.FormatInt(month.ReceiveBytes, 10),
+				strconv.FormatInt(month.TransmitBytes, 10)})
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -4,8 +4,11 @@ package server
 // run: swag init --parseDependency --parseInternal --generalInfo api.go
 // in the internal/server folder
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +17,7 @@ import (
 	"github.com/h44z/wg-portal/internal/common"
 	"github.com/h44z/wg-portal/internal/users"
 	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
 )
 
 // @title WireGuard Portal API
@@ -36,6 +40,11 @@ import (
 // @name Authorization
 // @scope.user User access required
 
+// @securityDefinitions.apikey ApiTokenAuth
+// @in header
+// @name Authorization
+// @description An API token of the user profile, sent as "Bearer <token>"
+
 // @BasePath /api/v1
 
 // ApiServer is a simple wrapper struct so that we can have fresh member function names.
@@ -52,15 +61,31 @@ type ApiError struct {
 // @Summary Retrieves all users
 // @ID GetUsers
 // @Produce json
+// @Param Search query string false "Only users whose email, name, phone or peer public key contain the search"
+// @Param Sort query string false "Sort key: email, firstname, lastname, phone, source or admin"
+// @Param SortDirection query string false "asc or desc"
+// @Param Page query int false "Page number, starting at 1"
+// @Param PageSize query int false "Number of users per page, all users if unset"
 // @Success 200 {object} []users.User
+// @Header 200 {integer} X-Total-Count "Number of users matching the search"
+// @Failure 400 {object} ApiError
 // @Failure 401 {object} ApiError
 // @Failure 403 {object} ApiError
 // @Failure 404 {object} ApiError
 // @Router /backend/users [get]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetUsers(c *gin.Context) {
-	allUsers := s.s.users.GetUsersUnscoped()
+	page, pageSize, err := getApiPagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Message: err.Error()})
+		return
+	}
+
+	allUsers, total := s.s.users.GetUsersPage(c.Query("Sort"), c.Query("SortDirection"), c.Query("Search"), page,
+		pageSize)
 
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
 	c.JSON(http.StatusOK, allUsers)
 }
 
@@ -77,6 +102,7 @@ func (s *ApiServer) GetUsers(c *gin.Context) {
 // @Failure 404 {object} ApiError
 // @Router /backend/user [get]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetUser(c *gin.Context) {
 	email := strings.ToLower(strings.TrimSpace(c.Query("Email")))
 	if email == "" {
@@ -107,6 +133,7 @@ func (s *ApiServer) GetUser(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/users [post]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PostUser(c *gin.Context) {
 	newUser := users.User{}
 	if err := c.ShouldBindJSON(&newUser); err != nil {
@@ -119,7 +146,7 @@ func (s *ApiServer) PostUser(c *gin.Context) {
 		return
 	}
 
-	if err := s.s.CreateUser(newUser, s.s.wg.Cfg.GetDefaultDeviceName()); err != nil {
+	if err := s.s.CreateUser(newUser, s.s.wg.Cfg.GetDefaultDeviceName(), c.GetString(apiUserContextKey)); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
 	}
@@ -148,6 +175,7 @@ func (s *ApiServer) PostUser(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/user [put]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PutUser(c *gin.Context) {
 	email := strings.ToLower(strings.TrimSpace(c.Query("Email")))
 	if email == "" {
@@ -172,7 +200,7 @@ func (s *ApiServer) PutUser(c *gin.Context) {
 		return
 	}
 
-	if err := s.s.UpdateUser(updateUser); err != nil {
+	if err := s.s.UpdateUser(updateUser, c.GetString(apiUserContextKey)); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
 	}
@@ -201,6 +229,7 @@ func (s *ApiServer) PutUser(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/user [patch]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PatchUser(c *gin.Context) {
 	email := strings.ToLower(strings.TrimSpace(c.Query("Email")))
 	if email == "" {
@@ -239,7 +268,7 @@ func (s *ApiServer) PatchUser(c *gin.Context) {
 		return
 	}
 
-	if err := s.s.UpdateUser(mergedUser); err != nil {
+	if err := s.s.UpdateUser(mergedUser, c.GetString(apiUserContextKey)); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
 	}
@@ -266,6 +295,7 @@ func (s *ApiServer) PatchUser(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/user [delete]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) DeleteUser(c *gin.Context) {
 	email := strings.ToLower(strings.TrimSpace(c.Query("Email")))
 	if email == "" {
@@ -279,7 +309,7 @@ func (s *ApiServer) DeleteUser(c *gin.Context) {
 		return
 	}
 
-	if err := s.s.DeleteUser(*user); err != nil {
+	if err := s.s.DeleteUser(*user, c.GetString(apiUserContextKey)); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
 	}
@@ -293,12 +323,22 @@ func (s *ApiServer) DeleteUser(c *gin.Context) {
 // @ID GetPeers
 // @Produce json
 // @Param DeviceName query string true "Device Name"
+// @Param Tag query []string false "Only peers with all of these tags, repeated or comma separated"
+// @Param Search query string false "Only peers whose identifier, description, public key, ip addresses or email contain the search"
+// @Param Filter query string false "enabled, disabled, neverconnected or guest"
+// @Param Sort query string false "Sort key: id, pubKey, mail, ip, endpoint or handshake"
+// @Param SortDirection query string false "asc or desc"
+// @Param Page query int false "Page number, starting at 1"
+// @Param PageSize query int false "Number of peers per page, all peers if unset"
 // @Success 200 {object} []wireguard.Peer
+// @Header 200 {integer} X-Total-Count "Number of peers matching the filters"
+// @Failure 400 {object} ApiError
 // @Failure 401 {object} ApiError
 // @Failure 403 {object} ApiError
 // @Failure 404 {object} ApiError
 // @Router /backend/peers [get]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetPeers(c *gin.Context) {
 	deviceName := strings.ToLower(strings.TrimSpace(c.Query("DeviceName")))
 	if deviceName == "" {
@@ -312,7 +352,30 @@ func (s *ApiServer) GetPeers(c *gin.Context) {
 		return
 	}
 
-	peers := s.s.peers.GetAllPeers(deviceName)
+	page, pageSize, err := getApiPagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Message: err.Error()})
+		return
+	}
+	filter := wireguard.PeerFilter(c.Query("Filter"))
+	switch filter {
+	case wireguard.PeerFilterAll, wireguard.PeerFilterEnabled, wireguard.PeerFilterDisabled,
+		wireguard.PeerFilterNeverConnected, wireguard.PeerFilterGuest:
+	default:
+		c.JSON(http.StatusBadRequest, ApiError{Message: "unknown Filter " + string(filter)})
+		return
+	}
+
+	peers, total := s.s.peers.GetPeersPage(deviceName, wireguard.PeerListOptions{
+		Search:        c.Query("Search"),
+		Filter:        filter,
+		Tags:          getTagsQuery(c, "Tag"),
+		SortKey:       c.Query("Sort"),
+		SortDirection: c.Query("SortDirection"),
+		Page:          page,
+		PageSize:      pageSize,
+	})
+	c.Header("X-Total-Count", strconv.FormatInt(total, 10))
 	c.JSON(http.StatusOK, peers)
 }
 
@@ -328,6 +391,7 @@ func (s *ApiServer) GetPeers(c *gin.Context) {
 // @Failure 404 {object} ApiError
 // @Router /backend/peer [get]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetPeer(c *gin.Context) {
 	pkey := c.Query("PublicKey")
 	if pkey == "" {
@@ -346,11 +410,13 @@ func (s *ApiServer) GetPeer(c *gin.Context) {
 // PostPeer godoc
 // @Tags Peers
 // @Summary Creates a new peer based on the given peer model
+// @Description Without PrivateKey, the peer is a public key only peer: the key pair was generated on the client and the portal never generates or stores a private key for it. Its configuration contains a placeholder for the private key.
 // @ID PostPeer
 // @Accept  json
 // @Produce json
 // @Param DeviceName query string true "Device Name"
 // @Param Peer body wireguard.Peer true "Peer Model"
+// @Param IgnoreQuota query bool false "Create the peer even if a peer limit has been reached"
 // @Success 200 {object} wireguard.Peer
 // @Failure 400 {object} ApiError
 // @Failure 401 {object} ApiError
@@ -359,6 +425,7 @@ func (s *ApiServer) GetPeer(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/peers [post]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PostPeer(c *gin.Context) {
 	deviceName := strings.ToLower(strings.TrimSpace(c.Query("DeviceName")))
 	if deviceName == "" {
@@ -382,8 +449,27 @@ func (s *ApiServer) PostPeer(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, ApiError{Message: "peer already exists"})
 		return
 	}
+	if newPeer.PrivateKey == "" { // public key only peer
+		if _, err := wireguard.ParsePublicKey(newPeer.PublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, ApiError{Message: err.Error()})
+			return
+		}
+	}
+	newPeer.CreatedBy = c.GetString(apiUserContextKey)
+	newPeer.UpdatedBy = c.GetString(apiUserContextKey)
 
-	if err := s.s.CreatePeer(deviceName, newPeer); err != nil {
+	var err error
+	if c.Query("IgnoreQuota") == "true" {
+		err = s.s.CreatePeerIgnoringQuota(deviceName, newPeer)
+	} else {
+		err = s.s.CreatePeer(deviceName, newPeer)
+	}
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		c.JSON(http.StatusForbidden, ApiError{Message: quotaErr.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
 	}
@@ -412,6 +498,7 @@ func (s *ApiServer) PostPeer(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/peer [put]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PutPeer(c *gin.Context) {
 	updatePeer := wireguard.Peer{}
 	if err := c.ShouldBindJSON(&updatePeer); err != nil {
@@ -440,6 +527,7 @@ func (s *ApiServer) PutPeer(c *gin.Context) {
 	if updatePeer.DeactivatedAt != nil {
 		updatePeer.DeactivatedAt = &now
 	}
+	updatePeer.UpdatedBy = c.GetString(apiUserContextKey)
 	if err := s.s.UpdatePeer(updatePeer, now); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
@@ -469,6 +557,7 @@ func (s *ApiServer) PutPeer(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/peer [patch]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PatchPeer(c *gin.Context) {
 	patch, err := c.GetRawData()
 	if err != nil {
@@ -517,6 +606,7 @@ func (s *ApiServer) PatchPeer(c *gin.Context) {
 	if mergedPeer.DeactivatedAt != nil {
 		mergedPeer.DeactivatedAt = &now
 	}
+	mergedPeer.UpdatedBy = c.GetString(apiUserContextKey)
 	if err := s.s.UpdatePeer(mergedPeer, now); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
@@ -544,6 +634,7 @@ func (s *ApiServer) PatchPeer(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/peer [delete]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) DeletePeer(c *gin.Context) {
 	pkey := c.Query("PublicKey")
 	if pkey == "" {
@@ -557,6 +648,7 @@ func (s *ApiServer) DeletePeer(c *gin.Context) {
 		return
 	}
 
+	peer.UpdatedBy = c.GetString(apiUserContextKey)
 	if err := s.s.DeletePeer(peer); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
@@ -577,6 +669,7 @@ func (s *ApiServer) DeletePeer(c *gin.Context) {
 // @Failure 404 {object} ApiError
 // @Router /backend/devices [get]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetDevices(c *gin.Context) {
 	var devices []wireguard.Device
 	for _, deviceName := range s.s.config.WG.DeviceNames {
@@ -603,6 +696,7 @@ func (s *ApiServer) GetDevices(c *gin.Context) {
 // @Failure 404 {object} ApiError
 // @Router /backend/device [get]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetDevice(c *gin.Context) {
 	deviceName := strings.ToLower(strings.TrimSpace(c.Query("DeviceName")))
 	if deviceName == "" {
@@ -641,6 +735,7 @@ func (s *ApiServer) GetDevice(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/device [put]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PutDevice(c *gin.Context) {
 	updateDevice := wireguard.Device{}
 	if err := c.ShouldBindJSON(&updateDevice); err != nil {
@@ -693,6 +788,7 @@ func (s *ApiServer) PutDevice(c *gin.Context) {
 // @Failure 500 {object} ApiError
 // @Router /backend/device [patch]
 // @Security ApiBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PatchDevice(c *gin.Context) {
 	patch, err := c.GetRawData()
 	if err != nil {
@@ -748,6 +844,203 @@ func (s *ApiServer) PatchDevice(c *gin.Context) {
 	c.JSON(http.StatusNotImplemented, device)
 }
 
+// DeleteDevice godoc
+// @Tags Interface
+// @Summary Deletes the given device and all its peers
+// @Description Peers is the number of peers that will be deleted, the request fails if the device has a different number of peers.
+// @ID DeleteDevice
+// @Produce json
+// @Param DeviceName query string true "Device Name"
+// @Param Peers query int true "Number of peers of the device"
+// @Success 204 "No Content"
+// @Failure 400 {object} ApiError
+// @Failure 401 {object} ApiError
+// @Failure 403 {object} ApiError
+// @Failure 404 {object} ApiError
+// @Failure 409 {object} ApiError
+// @Failure 500 {object} ApiError
+// @Router /backend/device [delete]
+// @Security ApiBasicAuth
+// @Security ApiTokenAuth
+func (s *ApiServer) DeleteDevice(c *gin.Context) {
+	deviceName := strings.ToLower(strings.TrimSpace(c.Query("DeviceName")))
+	if deviceName == "" {
+		c.JSON(http.StatusBadRequest, ApiError{Message: "DeviceName parameter must be specified"})
+		return
+	}
+	confirmedPeers, err := strconv.ParseInt(c.Query("Peers"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Message: "Peers parameter must be specified"})
+		return
+	}
+
+	// validate device name
+	if !common.ListContains(s.s.config.WG.DeviceNames, deviceName) {
+		c.JSON(http.StatusNotFound, ApiError{Message: "unknown device"})
+		return
+	}
+	if peerCount := s.s.peers.CountPeers(deviceName); peerCount != confirmedPeers {
+		c.JSON(http.StatusConflict, ApiError{Message: fmt.Sprintf("the device has %d peers", peerCount)})
+		return
+	}
+
+	if err := s.s.DeleteDevice(deviceName, deviceName, confirmedPeers, c.GetString(apiUserContextKey)); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetDeviceExport godoc
+// @Tags Interface
+// @Summary Exports the given device and all its peers as versioned JSON document
+// @ID GetDeviceExport
+// @Produce json
+// @Param DeviceName query string true "Device Name"
+// @Param Redact query bool false "Leave out the private and preshared keys"
+// @Success 200 {object} wireguard.InterfaceExport
+// @Failure 400 {object} ApiError
+// @Failure 401 {object} ApiError
+// @Failure 403 {object} ApiError
+// @Failure 404 {object} ApiError
+// @Failure 500 {object} ApiError
+// @Router /backend/device/export [get]
+// @Security ApiBasicAuth
+// @Security ApiTokenAuth
+func (s *ApiServer) GetDeviceExport(c *gin.Context) {
+	deviceName := strings.ToLower(strings.TrimSpace(c.Query("DeviceName")))
+	if deviceName == "" {
+		c.JSON(http.StatusBadRequest, ApiError{Message: "DeviceName parameter must be specified"})
+		return
+	}
+
+	// validate device name
+	if !common.ListContains(s.s.config.WG.DeviceNames, deviceName) {
+		c.JSON(http.StatusNotFound, ApiError{Message: "unknown device"})
+		return
+	}
+
+	doc, err := s.s.ExportInterface(deviceName, c.Query("Redact") == "true", c.GetString(apiUserContextKey))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, doc)
+}
+
+// PostDeviceImport godoc
+// @Tags Interface
+// @Summary Creates a device and all its peers from an exported JSON document
+// @Description The device gets the next free name if its name is in use, peer addresses are only reallocated if they are in use. Either the whole document is imported or nothing.
+// @ID PostDeviceImport
+// @Accept  json
+// @Produce json
+// @Param DryRun query bool false "Only report what would be created"
+// @Param Document body wireguard.InterfaceExport true "Exported device"
+// @Success 200 {object} wireguard.InterfaceImportResult
+// @Success 201 {object} wireguard.InterfaceImportResult
+// @Failure 400 {object} ApiError
+// @Failure 401 {object} ApiError
+// @Failure 403 {object} ApiError
+// @Failure 422 {object} ApiError
+// @Router /backend/device/import [post]
+// @Security ApiBasicAuth
+// @Security ApiTokenAuth
+func (s *ApiServer) PostDeviceImport(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxInterfaceExportSize)
+	doc := wireguard.InterfaceExport{} // not bound, the keys of redacted documents are missing
+	if err := json.NewDecoder(c.Request.Body).Decode(&doc); err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Message: err.Error()})
+		return
+	}
+
+	dryRun := c.Query("DryRun") == "true"
+	result, err := s.s.ImportInterface(doc, c.GetString(apiUserContextKey), dryRun)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ApiError{Message: err.Error()})
+		return
+	}
+
+	if dryRun {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+	c.JSON(http.StatusCreated, result)
+}
+
+// GetBackup godoc
+// @Tags Backup
+// @Summary Creates a backup of the users, devices and peers and returns the archive
+// @Description The archive is a gzip compressed JSON document. Keys are only included if a master key is configured, encrypted with it.
+// @ID GetBackup
+// @Produce application/gzip
+// @Param Keys query bool false "Include the private and preshared keys"
+// @Success 200 {file} file "Backup archive"
+// @Failure 401 {object} ApiError
+// @Failure 403 {object} ApiError
+// @Failure 422 {object} ApiError
+// @Failure 500 {object} ApiError
+// @Router /backend/backup [get]
+// @Security ApiBasicAuth
+// @Security ApiTokenAuth
+func (s *ApiServer) GetBackup(c *gin.Context) {
+	backup, err := s.s.CreateBackup(c.Query("Keys") == "true", c.GetString(apiUserContextKey))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ApiError{Message: err.Error()})
+		return
+	}
+	var archive bytes.Buffer
+	if err := WriteBackupArchive(&archive, backup); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+backupFileName(backup.CreatedAt))
+	c.Data(http.StatusOK, "application/gzip", archive.Bytes())
+}
+
+// PostBackupRestore godoc
+// @Tags Backup
+// @Summary Restores a backup archive
+// @Description The backup is restored in a single transaction and the restored devices are applied afterwards. Existing entries are kept unless Overwrite is set, the result lists all conflicts. Unless it is a dry run, Confirm must be "restore".
+// @ID PostBackupRestore
+// @Accept application/gzip
+// @Produce json
+// @Param DryRun query bool false "Only report what would be restored"
+// @Param Overwrite query bool false "Replace existing entries with the entries of the backup"
+// @Param Confirm query string false "Must be restore, unless it is a dry run"
+// @Param Archive body string true "Backup archive"
+// @Success 200 {object} BackupRestoreResult
+// @Failure 400 {object} ApiError
+// @Failure 401 {object} ApiError
+// @Failure 403 {object} ApiError
+// @Failure 422 {object} ApiError
+// @Router /backend/backup/restore [post]
+// @Security ApiBasicAuth
+// @Security ApiTokenAuth
+func (s *ApiServer) PostBackupRestore(c *gin.Context) {
+	dryRun := c.Query("DryRun") == "true"
+	if !dryRun && c.Query("Confirm") != backupConfirmation {
+		c.JSON(http.StatusBadRequest, ApiError{Message: "Confirm parameter must be " + backupConfirmation})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBackupSize)
+	backup, err := ReadBackupArchive(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Message: err.Error()})
+		return
+	}
+
+	result, err := s.s.RestoreBackup(backup, c.Query("Overwrite") == "true", dryRun, c.GetString(apiUserContextKey))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, ApiError{Message: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 type PeerDeploymentInformation struct {
 	PublicKey        string
 	Identifier       string
@@ -767,6 +1060,7 @@ type PeerDeploymentInformation struct {
 // @Failure 404 {object} ApiError
 // @Router /provisioning/peers [get]
 // @Security GeneralBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetPeerDeploymentInformation(c *gin.Context) {
 	email := c.Query("Email")
 	if email == "" {
@@ -775,8 +1069,7 @@ func (s *ApiServer) GetPeerDeploymentInformation(c *gin.Context) {
 	}
 
 	// Get authenticated user to check permissions
-	username, _, _ := c.Request.BasicAuth()
-	user := s.s.users.GetUser(username)
+	user := apiIdentity(c)
 
 	if !user.IsAdmin && user.Email != email {
 		c.JSON(http.StatusForbidden, ApiError{Message: "not enough permissions to access this resource"})
@@ -818,6 +1111,7 @@ func (s *ApiServer) GetPeerDeploymentInformation(c *gin.Context) {
 // @Failure 404 {object} ApiError
 // @Router /provisioning/peer [get]
 // @Security GeneralBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) GetPeerDeploymentConfig(c *gin.Context) {
 	pkey := c.Query("PublicKey")
 	if pkey == "" {
@@ -832,8 +1126,7 @@ func (s *ApiServer) GetPeerDeploymentConfig(c *gin.Context) {
 	}
 
 	// Get authenticated user to check permissions
-	username, _, _ := c.Request.BasicAuth()
-	user := s.s.users.GetUser(username)
+	user := apiIdentity(c)
 
 	if !user.IsAdmin && user.Email != peer.Email {
 		c.JSON(http.StatusForbidden, ApiError{Message: "not enough permissions to access this resource"})
@@ -850,6 +1143,64 @@ func (s *ApiServer) GetPeerDeploymentConfig(c *gin.Context) {
 	c.Data(http.StatusOK, "text/plain", config)
 }
 
+// DeletePeerDeployment godoc
+// @Tags Provisioning
+// @Summary Deletes the peer for the given public key
+// @ID DeletePeerDeployment
+// @Produce json
+// @Param PublicKey query string true "Public Key (Base 64)"
+// @Success 204 "No Content"
+// @Failure 400 {object} ApiError
+// @Failure 401 {object} ApiError
+// @Failure 403 {object} ApiError
+// @Failure 404 {object} ApiError
+// @Failure 500 {object} ApiError
+// @Router /provisioning/peer [delete]
+// @Security GeneralBasicAuth
+// @Security ApiTokenAuth
+func (s *ApiServer) DeletePeerDeployment(c *gin.Context) {
+	pkey := c.Query("PublicKey")
+	if pkey == "" {
+		c.JSON(http.StatusBadRequest, ApiError{Message: "PublicKey parameter must be specified"})
+		return
+	}
+
+	peer := s.s.peers.GetPeerByKey(pkey)
+	if !peer.IsValid() {
+		c.JSON(http.StatusNotFound, ApiError{Message: "peer does not exist"})
+		return
+	}
+
+	// Get authenticated user to check permissions, the same rules as in the user portal apply to peer owners
+	user := apiIdentity(c)
+	if !user.IsAdmin && user.Email != peer.Email {
+		c.JSON(http.StatusForbidden, ApiError{Message: "not enough permissions to access this resource"})
+		return
+	}
+
+	var err error
+	if user.IsAdmin {
+		peer.UpdatedBy = user.Email
+		err = s.s.DeletePeer(peer)
+	} else {
+		if !s.s.config.Core.SelfProvisioningAllowed {
+			c.JSON(http.StatusForbidden, ApiError{Message: "peer provisioning service disabled"})
+			return
+		}
+		if peer.Managed {
+			c.JSON(http.StatusForbidden, ApiError{Message: "the peer is managed by an administrator"})
+			return
+		}
+		err = s.s.DeleteUserPeer(peer, user.Email)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
 type ProvisioningRequest struct {
 	// DeviceName is optional, if not specified, the configured default device will be used.
 	DeviceName string `json:",omitempty"`
@@ -859,9 +1210,9 @@ type ProvisioningRequest struct {
 	// Client specific and optional settings
 
 	AllowedIPsStr       string `binding:"cidrlist" json:",omitempty"`
-	PersistentKeepalive int    `binding:"gte=0" json:",omitempty"`
-	DNSStr              string `binding:"iplist" json:",omitempty"`
-	Mtu                 int    `binding:"gte=0,lte=1500" json:",omitempty"`
+	PersistentKeepalive *int   `binding:"omitempty,gte=0,lte=65535" json:",omitempty"` // 0 disables the keepalive, if unset the default is used
+	DNSStr              string `binding:"dnslist" json:",omitempty"`
+	Mtu                 int    `binding:"omitempty,gte=1280,lte=1500" json:",omitempty"`
 }
 
 // PostPeerDeploymentConfig godoc
@@ -877,6 +1228,7 @@ type ProvisioningRequest struct {
 // @Failure 404 {object} ApiError
 // @Router /provisioning/peers [post]
 // @Security GeneralBasicAuth
+// @Security ApiTokenAuth
 func (s *ApiServer) PostPeerDeploymentConfig(c *gin.Context) {
 	req := ProvisioningRequest{}
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -885,8 +1237,7 @@ func (s *ApiServer) PostPeerDeploymentConfig(c *gin.Context) {
 	}
 
 	// Get authenticated user to check permissions
-	username, _, _ := c.Request.BasicAuth()
-	user := s.s.users.GetUser(username)
+	user := apiIdentity(c)
 
 	if !user.IsAdmin && !s.s.config.Core.SelfProvisioningAllowed {
 		c.JSON(http.StatusForbidden, ApiError{Message: "peer provisioning service disabled"})
@@ -920,17 +1271,29 @@ func (s *ApiServer) PostPeerDeploymentConfig(c *gin.Context) {
 	if req.AllowedIPsStr != "" {
 		peer.AllowedIPsStr = req.AllowedIPsStr
 	}
-	if req.PersistentKeepalive != 0 {
-		peer.PersistentKeepalive = req.PersistentKeepalive
+	if req.PersistentKeepalive != nil {
+		peer.PersistentKeepalive = *req.PersistentKeepalive
+		peer.OverrideKeepalive = true
+	} else if peer.PersistentKeepalive == 0 && peer.RoutesAllTraffic() {
+		peer.PersistentKeepalive = wireguard.DefaultRoamingKeepalive
+		peer.OverrideKeepalive = true
 	}
 	if req.DNSStr != "" {
 		peer.DNSStr = req.DNSStr
+		peer.OverrideDNS = true
 	}
 	if req.Mtu != 0 {
 		peer.Mtu = req.Mtu
+		peer.OverrideMtu = true
 	}
 
-	if err := s.s.CreatePeer(deviceName, peer); err != nil {
+	err = s.s.CreatePeer(deviceName, peer)
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		c.JSON(http.StatusForbidden, ApiError{Message: quotaErr.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
 		return
 	}
@@ -943,3 +1306,88 @@ func (s *ApiServer) PostPeerDeploymentConfig(c *gin.Context) {
 
 	c.Data(http.StatusOK, "text/plain", config)
 }
+
+type EnrollmentRequest struct {
+	Email string `binding:"required,email"`
+	// DeviceName is optional, if not specified, the configured default device will be used.
+	DeviceName string `json:",omitempty"`
+	// ClientDevice names the device of the user, e.g. its hostname. Together with the email and the interface it
+	// identifies the peer, so that repeated requests return the same peer.
+	ClientDevice string `binding:"required,max=64"`
+}
+
+type EnrollmentResponse struct {
+	Created    bool // false if the peer already existed
+	PublicKey  string
+	Identifier string
+	Device     string
+	IPs        []string
+	Disabled   bool   // the peer exists but has been disabled, the configuration does not work until it is enabled
+	Config     string // the WireGuard configuration file
+}
+
+// PostPeerEnrollment godoc
+// @Tags Provisioning
+// @Summary Returns the peer config of the client device of a user, the peer is created if it does not exist yet
+// @Description Requires an API token with the provisioning scope. Repeated requests for the same user, interface and client device return the same peer.
+// @ID PostPeerEnrollment
+// @Accept  json
+// @Produce json
+// @Param EnrollmentRequest body EnrollmentRequest true "Enrollment Request Model"
+// @Success 200 {object} EnrollmentResponse "The existing peer"
+// @Success 201 {object} EnrollmentResponse "The created peer"
+// @Failure 400 {object} ApiError
+// @Failure 401 {object} ApiError
+// @Failure 403 {object} ApiError
+// @Failure 404 {object} ApiError
+// @Failure 500 {object} ApiError
+// @Router /provisioning/enroll [post]
+// @Security ApiTokenAuth
+func (s *ApiServer) PostPeerEnrollment(c *gin.Context) {
+	req := EnrollmentRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiError{Message: err.Error()})
+		return
+	}
+	if req.DeviceName == "" {
+		req.DeviceName = s.s.config.WG.GetDefaultDeviceName()
+	}
+
+	peer, created, err := s.s.EnrollPeer(req.Email, req.DeviceName, req.ClientDevice, c.GetString(apiUserContextKey))
+	var quotaErr *QuotaExceededError
+	var enrollmentErr *EnrollmentError
+	switch {
+	case errors.As(err, &quotaErr):
+		c.JSON(http.StatusForbidden, ApiError{Message: quotaErr.Error()})
+		return
+	case errors.Is(err, errEnrollmentUserNotFound):
+		c.JSON(http.StatusNotFound, ApiError{Message: err.Error()})
+		return
+	case errors.As(err, &enrollmentErr):
+		c.JSON(http.StatusBadRequest, ApiError{Message: err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
+		return
+	}
+
+	config, err := peer.GetConfigFile(s.s.peers.GetDevice(peer.DeviceName))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
+		return
+	}
+
+	statusCode := http.StatusOK
+	if created {
+		statusCode = http.StatusCreated
+	}
+	c.JSON(statusCode, EnrollmentResponse{
+		Created:    created,
+		PublicKey:  peer.PublicKey,
+		Identifier: peer.Identifier,
+		Device:     peer.DeviceName,
+		IPs:        peer.GetIPAddresses(),
+		Disabled:   peer.DeactivatedAt != nil,
+		Config:     string(config),
+	})
+}
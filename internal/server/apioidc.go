@@ -0,0 +1,42 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/h44z/wg-portal/internal/oidc"
+	"github.com/h44z/wg-portal/internal/users"
+)
+
+// authenticateOidcToken validates an access token of a configured OIDC provider. The service claim is matched against
+// the service identities of the provider first, otherwise the user claim must contain the email address of an active
+// portal user. Service identities are not stored, they only exist for the request.
+func (s *Server) authenticateOidcToken(rawToken string) (*users.User, error) {
+	token, err := s.oidc.Verify(rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if identity := token.Provider.ServiceIdentity(token.StringClaim(token.Provider.ServiceClaim)); identity != nil {
+		return &users.User{
+			Email:   identity.Name,
+			Source:  users.UserSourceOIDC,
+			IsAdmin: identity.Role == oidc.RoleAdmin,
+			State:   users.UserStateActive,
+		}, nil
+	}
+
+	user := s.users.GetUser(strings.ToLower(strings.TrimSpace(token.StringClaim(token.Provider.UserClaim))))
+	if user == nil || !user.IsActive() {
+		return nil, errUserNotActive
+	}
+	return user, nil
+}
+
+// apiIdentity returns the user that authenticated the current API request, see RequireApiAuthentication.
+func apiIdentity(c *gin.Context) *users.User {
+	if user, ok := c.Get(apiIdentityContextKey); ok {
+		return user.(*users.User)
+	}
+	return &users.User{} // not authenticated, no permissions
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/users"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiTokenPrefix     = "wgp_" // makes leaked tokens easy to find, e.g. by secret scanners
+	maxApiTokensByUser = 10
+)
+
+// Scopes of API tokens
+const (
+	ApiTokenScopeUser         = ""             // the permissions of the user that created the token
+	ApiTokenScopeProvisioning = "provisioning" // only the enrollment endpoint, tokens of administrators
+)
+
+var errApiTokenInvalid = errors.New("the API token is invalid")
+
+// ApiToken authenticates requests to the REST API as the user that created it, an alternative to basic
+// authentication for automated clients. Only a keyed hash of the token is stored, the token itself is shown once
+// when it is created. Tokens with the provisioning scope are only accepted by the enrollment endpoint, so enrollment
+// systems do not get full administrator access.
+type ApiToken struct {
+	ID         uint   `gorm:"primaryKey"`
+	TokenHash  string `gorm:"uniqueIndex;size:64"`
+	Email      string `gorm:"index"`
+	Name       string
+	Scope      string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+// CreateApiToken creates a new API token with the given scope for the user. The returned token is only available
+// here.
+func (s *Server) CreateApiToken(email, name, scope string) (string, ApiToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return "", ApiToken{}, errors.New("the token name must have between 1 and 64 characters")
+	}
+	switch scope {
+	case ApiTokenScopeUser:
+	case ApiTokenScopeProvisioning:
+		if user := s.users.GetUser(email); user == nil || !user.IsAdmin {
+			return "", ApiToken{}, errors.New("only administrators can create provisioning tokens")
+		}
+	default:
+		return "", ApiToken{}, errors.Errorf("invalid token scope %s", scope)
+	}
+	var count int64
+	if err := s.db.Model(&ApiToken{}).Where("email = ?", email).Count(&count).Error; err != nil {
+		return "", ApiToken{}, errors.Wrap(err, "failed to count API tokens")
+	}
+	if count >= maxApiTokensByUser {
+		return "", ApiToken{}, errors.Errorf("a user can have at most %d API tokens", maxApiTokensByUser)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", ApiToken{}, errors.Wrap(err, "failed to generate token")
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	apiToken := ApiToken{
+		TokenHash: s.hashDownloadLinkToken(token), // same keyed hash as download links
+		Email:     email,
+		Name:      name,
+		Scope:     scope,
+	}
+	if err := s.db.Create(&apiToken).Error; err != nil {
+		return "", ApiToken{}, errors.Wrap(err, "failed to store API token")
+	}
+	details := fmt.Sprintf("API token %d (%s)", apiToken.ID, apiToken.Name)
+	if scope != ApiTokenScopeUser {
+		details += ", scope " + scope
+	}
+	s.audit.Record(common.AuditEntry{Actor: email, Action: "token.created", Target: email, Details: details})
+
+	return token, apiToken, nil
+}
+
+// GetApiTokens returns the API tokens of the given user.
+func (s *Server) GetApiTokens(email string) []ApiToken {
+	tokens := make([]ApiToken, 0)
+	s.db.Where("email = ?", email).Order("created_at").Find(&tokens)
+
+	return tokens
+}
+
+// DeleteApiToken revokes an API token of the given user.
+func (s *Server) DeleteApiToken(email string, id uint) error {
+	res := s.db.Where("id = ? AND email = ?", id, email).Delete(&ApiToken{})
+	if res.Error != nil {
+		return errors.Wrap(res.Error, "failed to delete API token")
+	}
+	if res.RowsAffected == 0 {
+		return errApiTokenInvalid
+	}
+	s.audit.Record(common.AuditEntry{Actor: email, Action: "token.deleted", Target: email,
+		Details: fmt.Sprintf("API token %d", id)})
+
+	return nil
+}
+
+// authenticateApiToken returns the active user and the scope of the given API token.
+func (s *Server) authenticateApiToken(token string) (*users.User, string, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, "", errApiTokenInvalid
+	}
+
+	var apiToken ApiToken
+	res := s.db.Where("token_hash = ?", s.hashDownloadLinkToken(token)).Limit(1).Find(&apiToken)
+	switch {
+	case res.Error != nil:
+		return nil, "", errors.Wrap(res.Error, "failed to load API token")
+	case res.RowsAffected == 0:
+		return nil, "", errApiTokenInvalid
+	}
+
+	user := s.users.GetUser(apiToken.Email)
+	if user == nil || !user.IsActive() { // tokens of deactivated users are kept until they are deleted
+		return nil, "", errUserNotActive
+	}
+
+	now := time.Now()
+	s.db.Model(&ApiToken{}).Where("id = ?", apiToken.ID).Update("last_used_at", now)
+
+	return user, apiToken.Scope, nil
+}
@@ -0,0 +1,705 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/users"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// BackupVersion is the version of the Backup format. Archives of other versions are rejected.
+const BackupVersion = 1
+
+const (
+	backupActor        = "backup" // actor of the audit entries of the scheduled backups
+	backupFilePrefix   = "wg-portal-backup-"
+	backupFileSuffix   = ".json.gz"
+	backupTimeFormat   = "20060102-150405" // UTC, the file names sort by creation time
+	backupRetryDelay   = 15 * time.Minute  // a failed scheduled backup is retried after this delay
+	maxBackupSize      = 256 << 20         // limit of uploaded and of decompressed archives
+	backupConfirmation = "restore"         // must be entered to restore an uploaded archive
+)
+
+// Kinds of the entries of a backup, see BackupConflict
+const (
+	BackupKindUser        = "user"
+	BackupKindInterface   = "interface"
+	BackupKindPeer        = "peer"
+	BackupKindPreset      = "preset"
+	BackupKindReservation = "reservation"
+)
+
+// Resolutions of a BackupConflict
+const (
+	BackupResolutionKept     = "kept"     // the stored entry was kept, the entry of the backup was not restored
+	BackupResolutionReplaced = "replaced" // the stored entry was replaced with the entry of the backup
+	BackupResolutionSkipped  = "skipped"  // the entry of the backup cannot be restored
+)
+
+// Backup contains the users, the interfaces and the peers with the allowed IPs presets and the address reservations
+// of the interfaces. A backup archive is the gzip compressed JSON document. Statistics, traffic, the audit log, API
+// tokens and download links are not part of a backup.
+type Backup struct {
+	Version       int
+	SchemaVersion int // the database schema version of the portal that created the backup
+	CreatedAt     time.Time
+	IncludesKeys  bool   // the private and preshared keys are included, encrypted with the master key
+	MasterKey     string `json:",omitempty"` // id of the master key of the included keys
+	Users         []BackupUser
+	Interfaces    []wireguard.Device
+	Peers         []wireguard.Peer
+	Presets       []wireguard.AllowedIPsPreset
+	Reservations  []wireguard.IPReservation
+}
+
+// BackupUser is a user together with the password hash, which is left out of all other JSON documents.
+type BackupUser struct {
+	users.User
+	PasswordHash string `json:",omitempty"`
+}
+
+// BackupConflict is an entry of a backup that already exists in the database or that cannot be restored.
+type BackupConflict struct {
+	Kind       string // one of the BackupKind constants
+	Key        string // the email, interface name or public key, interface/name of presets and reservations
+	Reason     string
+	Resolution string // one of the BackupResolution constants
+}
+
+// BackupRestoreResult is the conflict report of a restore.
+type BackupRestoreResult struct {
+	DryRun        bool           // nothing was stored
+	Overwrite     bool           // existing entries were replaced with the entries of the backup
+	Restored      map[string]int // created or replaced entries by kind
+	Conflicts     []BackupConflict
+	GeneratedKeys []string          `json:",omitempty"` // interfaces of a backup without keys that got a new key pair
+	Reapplied     []string          `json:",omitempty"` // interfaces that were applied after the restore
+	ReapplyErrors map[string]string `json:",omitempty"` // interfaces that could not be applied, by name
+}
+
+func (r *BackupRestoreResult) conflict(kind, key, reason, resolution string) {
+	r.Conflicts = append(r.Conflicts, BackupConflict{Kind: kind, Key: key, Reason: reason, Resolution: resolution})
+}
+
+// existingConflict records an entry that is already stored and reports whether it is replaced.
+func (r *BackupRestoreResult) existingConflict(kind, key string) bool {
+	if r.Overwrite {
+		r.conflict(kind, key, "the "+kind+" exists", BackupResolutionReplaced)
+	} else {
+		r.conflict(kind, key, "the "+kind+" exists", BackupResolutionKept)
+	}
+	return r.Overwrite
+}
+
+var errBackupDryRun = errors.New("dry run")
+
+// CreateBackup reads the users, interfaces and peers in a single transaction, so the backup is consistent. With
+// includeKeys, the private and preshared keys are encrypted with the master key and included, without master key
+// they can only be left out.
+func (s *Server) CreateBackup(includeKeys bool, actor string) (Backup, error) {
+	backup := Backup{Version: BackupVersion, CreatedAt: time.Now(), IncludesKeys: includeKeys}
+	if includeKeys {
+		if s.keyCipher == nil {
+			return backup, errors.New("keys can only be included with a master key, set WG_KEY_ENCRYPTION_KEY or " +
+				"WG_KEY_ENCRYPTION_KEY_FILE")
+		}
+		backup.MasterKey = s.keyCipher.ID()
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if backup.SchemaVersion, err = common.SchemaVersion(tx); err != nil {
+			return err
+		}
+		var storedUsers []users.User
+		if err := tx.Unscoped().Order("email").Find(&storedUsers).Error; err != nil {
+			return errors.Wrap(err, "failed to load users")
+		}
+		for _, user := range storedUsers {
+			backup.Users = append(backup.Users, BackupUser{User: user, PasswordHash: string(user.Password)})
+		}
+		if err := tx.Order("device_name").Find(&backup.Interfaces).Error; err != nil {
+			return errors.Wrap(err, "failed to load interfaces")
+		}
+		if err := tx.Order("device_name, public_key").Find(&backup.Peers).Error; err != nil {
+			return errors.Wrap(err, "failed to load peers")
+		}
+		if err := tx.Order("device_name, name").Find(&backup.Presets).Error; err != nil {
+			return errors.Wrap(err, "failed to load allowed IPs presets")
+		}
+		if err := tx.Order("device_name, network").Find(&backup.Reservations).Error; err != nil {
+			return errors.Wrap(err, "failed to load address reservations")
+		}
+		return nil
+	})
+	if err != nil {
+		return backup, err
+	}
+
+	for i := range backup.Interfaces {
+		if err := backup.protectKeys(s.keyCipher, &backup.Interfaces[i].PrivateKey); err != nil {
+			return backup, err
+		}
+	}
+	for i := range backup.Peers {
+		peer := &backup.Peers[i]
+		if err := backup.protectKeys(s.keyCipher, &peer.PrivateKey, &peer.PresharedKey); err != nil {
+			return backup, err
+		}
+	}
+
+	details := fmt.Sprintf("%d users, %d interfaces, %d peers", len(backup.Users), len(backup.Interfaces),
+		len(backup.Peers))
+	if includeKeys {
+		details += ", keys encrypted with master key " + backup.MasterKey
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "backup.created", Details: details})
+
+	return backup, nil
+}
+
+// protectKeys encrypts the keys if the backup includes keys, otherwise they are removed.
+func (b Backup) protectKeys(keyCipher *wireguard.KeyCipher, keys ...*string) error {
+	for _, key := range keys {
+		if !b.IncludesKeys {
+			*key = ""
+			continue
+		}
+		encrypted, err := keyCipher.Encrypt(*key)
+		if err != nil {
+			return errors.WithMessage(err, "failed to encrypt key")
+		}
+		*key = encrypted
+	}
+	return nil
+}
+
+// revealKeys decrypts the keys of the backup with the current or a previous master key.
+func (b *Backup) revealKeys(keyCipher *wireguard.KeyCipher) error {
+	if !b.IncludesKeys {
+		return nil
+	}
+	if keyCipher == nil {
+		return errors.Errorf("the keys of the backup are encrypted with the master key %s, configure it with "+
+			"WG_KEY_ENCRYPTION_KEY or WG_KEY_ENCRYPTION_KEY_FILE", b.MasterKey)
+	}
+	keys := make([]*string, 0, len(b.Interfaces)+2*len(b.Peers))
+	for i := range b.Interfaces {
+		keys = append(keys, &b.Interfaces[i].PrivateKey)
+	}
+	for i := range b.Peers {
+		keys = append(keys, &b.Peers[i].PrivateKey, &b.Peers[i].PresharedKey)
+	}
+	for _, key := range keys {
+		decrypted, err := keyCipher.Decrypt(*key)
+		if err != nil {
+			return errors.WithMessage(err, "failed to decrypt the keys of the backup")
+		}
+		*key = decrypted
+	}
+	return nil
+}
+
+// validate checks that the backup can be restored by this binary.
+func (b Backup) validate() error {
+	if b.Version != BackupVersion {
+		return errors.Errorf("unsupported backup version %d, expected %d", b.Version, BackupVersion)
+	}
+	if latest := common.LatestSchemaVersion(); b.SchemaVersion > latest {
+		return errors.Errorf("the backup was created with the database schema version %d, this binary supports up "+
+			"to version %d, upgrade wg-portal to restore it", b.SchemaVersion, latest)
+	}
+	return nil
+}
+
+// WriteBackupArchive writes the backup as gzip compressed JSON document.
+func WriteBackupArchive(w io.Writer, backup Backup) error {
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(backup); err != nil {
+		return errors.Wrap(err, "failed to encode backup")
+	}
+	return errors.Wrap(gz.Close(), "failed to compress backup")
+}
+
+// ReadBackupArchive reads a backup archive, uncompressed JSON documents are accepted as well. The version is checked
+// by the restore.
+func ReadBackupArchive(r io.Reader) (Backup, error) {
+	backup := Backup{}
+	buffered := bufio.NewReader(io.LimitReader(r, maxBackupSize))
+	var content io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return backup, errors.Wrap(err, "invalid backup archive")
+		}
+		defer gz.Close()
+		content = gz
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(content, maxBackupSize+1))
+	if err != nil {
+		return backup, errors.Wrap(err, "failed to read backup archive")
+	}
+	if len(data) > maxBackupSize {
+		return backup, errors.New("the backup archive is too large")
+	}
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return backup, errors.Wrap(err, "invalid backup archive")
+	}
+	return backup, nil
+}
+
+// backupFileName returns the name of the archive of a scheduled backup.
+func backupFileName(createdAt time.Time) string {
+	return backupFilePrefix + createdAt.UTC().Format(backupTimeFormat) + backupFileSuffix
+}
+
+// WriteBackup writes a backup archive to the file. Without file, the archive is written to the backup directory and
+// the oldest archives beyond the retention are removed. It returns the path of the archive.
+func (s *Server) WriteBackup(file string, includeKeys bool, actor string) (string, Backup, error) {
+	backup, err := s.CreateBackup(includeKeys, actor)
+	if err != nil {
+		return "", backup, err
+	}
+	var archive bytes.Buffer
+	if err := WriteBackupArchive(&archive, backup); err != nil {
+		return "", backup, err
+	}
+	rotate := file == ""
+	if rotate {
+		file = filepath.Join(s.config.Core.BackupDirectory, backupFileName(backup.CreatedAt))
+	}
+	if err := writeFileAtomic(file, archive.Bytes(), 0600); err != nil {
+		return "", backup, errors.WithMessage(err, "failed to write backup archive")
+	}
+
+	if rotate {
+		s.rotateBackups()
+	}
+	return file, backup, nil
+}
+
+// StoredBackups returns the names of the archives in the backup directory, oldest first.
+func (s *Server) StoredBackups() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.config.Core.BackupDirectory)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read backup directory")
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasPrefix(entry.Name(), backupFilePrefix) &&
+			strings.HasSuffix(entry.Name(), backupFileSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// rotateBackups removes the oldest archives of the backup directory, so that the configured number remains.
+func (s *Server) rotateBackups() {
+	if s.config.Core.BackupRetention <= 0 {
+		return
+	}
+	names, err := s.StoredBackups()
+	if err != nil {
+		logrus.Errorf("failed to rotate backups: %v", err)
+		return
+	}
+	for len(names) > s.config.Core.BackupRetention {
+		if err := os.Remove(filepath.Join(s.config.Core.BackupDirectory, names[0])); err != nil {
+			logrus.Errorf("failed to remove backup %s: %v", names[0], err)
+		}
+		names = names[1:]
+	}
+}
+
+// checkBackupConfig creates the backup directory and makes sure that other users cannot read the archives, they
+// contain the password hashes and optionally the keys.
+func (s *Server) checkBackupConfig() error {
+	dir := s.config.Core.BackupDirectory
+	if dir == "" {
+		return nil
+	}
+	if s.config.Core.BackupIncludeKeys && s.keyCipher == nil {
+		return errors.New("BACKUP_INCLUDE_KEYS requires a master key, set WG_KEY_ENCRYPTION_KEY or " +
+			"WG_KEY_ENCRYPTION_KEY_FILE")
+	}
+	if s.config.Core.BackupInterval <= 0 {
+		return errors.New("BACKUP_INTERVAL must be positive")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create backup directory")
+	}
+	if err := checkDirectoryAccess(dir); err != nil {
+		return errors.Wrap(err, "failed to check backup directory access rights")
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to check backup directory")
+	}
+	if info.Mode().Perm()&0006 != 0 {
+		return errors.Errorf("refusing to write backups to %s, it is accessible by other users (mode %s), "+
+			"restrict the permissions, e.g. chmod 700", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// RunScheduledBackups writes a backup every backup interval. The first backup is due one interval after the newest
+// archive of the backup directory, so restarts of the portal do not create additional backups.
+func (s *Server) RunScheduledBackups(ctx context.Context) {
+	next := time.Now()
+	if names, err := s.StoredBackups(); err == nil && len(names) > 0 {
+		if info, err := os.Stat(filepath.Join(s.config.Core.BackupDirectory, names[len(names)-1])); err == nil {
+			next = info.ModTime().Add(s.config.Core.BackupInterval)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+
+		file, _, err := s.WriteBackup("", s.config.Core.BackupIncludeKeys, backupActor)
+		if err != nil {
+			logrus.Errorf("scheduled backup failed: %v", err)
+			next = time.Now().Add(backupRetryDelay)
+			if s.config.Core.BackupInterval < backupRetryDelay {
+				next = time.Now().Add(s.config.Core.BackupInterval)
+			}
+			continue
+		}
+		logrus.Infof("wrote backup %s", file)
+		next = time.Now().Add(s.config.Core.BackupInterval)
+	}
+}
+
+// RestoreBackup restores the backup, see restoreBackup, and applies the restored interfaces afterwards like the
+// startup restore does, so the physical interfaces match the database again.
+func (s *Server) RestoreBackup(backup Backup, overwrite, dryRun bool, actor string) (BackupRestoreResult, error) {
+	result, err := s.restoreBackup(backup, overwrite, dryRun)
+	if err != nil || dryRun {
+		return result, err
+	}
+	s.userValidity.InvalidateAll() // the users were written directly
+
+	restored := make(map[string]bool)
+	for _, device := range backup.Interfaces {
+		restored[device.DeviceName] = true
+	}
+	for _, peer := range backup.Peers {
+		restored[peer.DeviceName] = true
+	}
+	for _, device := range s.config.WG.DeviceNames {
+		if !restored[device] || s.wg.IsExternalDevice(device) {
+			continue
+		}
+		err := s.reapplyInterface(device, "the backup was restored")
+		if err == nil {
+			err = s.WriteWireGuardConfigFile(device)
+		}
+		if err != nil {
+			if result.ReapplyErrors == nil {
+				result.ReapplyErrors = make(map[string]string)
+			}
+			result.ReapplyErrors[device] = err.Error()
+			continue
+		}
+		result.Reapplied = append(result.Reapplied, device)
+	}
+
+	s.recordBackupRestore(result, actor)
+	return result, nil
+}
+
+func (s *Server) recordBackupRestore(result BackupRestoreResult, actor string) {
+	details := fmt.Sprintf("%d users, %d interfaces, %d peers restored, %d conflicts",
+		result.Restored[BackupKindUser], result.Restored[BackupKindInterface], result.Restored[BackupKindPeer],
+		len(result.Conflicts))
+	if result.Overwrite {
+		details += ", existing entries replaced"
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "backup.restored", Details: details})
+}
+
+// restoreBackup stores the entries of the backup in a single transaction, either all of them are restored or none.
+// Entries that do not exist are created. Existing entries are kept unless overwrite is set, both is listed in the
+// conflict report. Peers whose interface does not exist or whose addresses are used by other peers are skipped. For
+// backups without keys, replaced interfaces and peers keep their stored keys, new interfaces get a new key pair and
+// new peers are skipped.
+// With dryRun, the result reports the changes but nothing is stored. The physical interfaces are not changed.
+func (s *Server) restoreBackup(backup Backup, overwrite, dryRun bool) (BackupRestoreResult, error) {
+	result := BackupRestoreResult{DryRun: dryRun, Overwrite: overwrite, Restored: make(map[string]int),
+		Conflicts: make([]BackupConflict, 0)}
+	if err := backup.validate(); err != nil {
+		return result, err
+	}
+	if err := backup.revealKeys(s.keyCipher); err != nil {
+		return result, err
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := restoreBackupUsers(tx, backup, &result); err != nil {
+			return err
+		}
+		presetIDs, err := restoreBackupPresets(tx, backup, &result)
+		if err != nil {
+			return err
+		}
+		if err := restoreBackupInterfaces(tx, backup, presetIDs, &result); err != nil {
+			return err
+		}
+		if err := restoreBackupPeers(tx, backup, presetIDs, &result); err != nil {
+			return err
+		}
+		if err := restoreBackupReservations(tx, backup, &result); err != nil {
+			return err
+		}
+
+		if dryRun {
+			return errBackupDryRun // roll back
+		}
+		return nil
+	})
+	if err != nil && err != errBackupDryRun {
+		return result, errors.WithMessage(err, "nothing was restored")
+	}
+
+	return result, nil
+}
+
+func restoreBackupUsers(tx *gorm.DB, backup Backup, result *BackupRestoreResult) error {
+	for _, backupUser := range backup.Users {
+		user := backupUser.User
+		user.Email = strings.ToLower(user.Email)
+		user.Password = users.PrivateString(backupUser.PasswordHash)
+
+		res := tx.Unscoped().Where("email = ?", user.Email).Limit(1).Find(&users.User{})
+		if res.Error != nil {
+			return errors.Wrapf(res.Error, "failed to load user %s", user.Email)
+		}
+		if res.RowsAffected > 0 {
+			if !result.existingConflict(BackupKindUser, user.Email) {
+				continue
+			}
+			if err := tx.Unscoped().Save(&user).Error; err != nil {
+				return errors.Wrapf(err, "failed to replace user %s", user.Email)
+			}
+		} else if err := tx.Create(&user).Error; err != nil {
+			return errors.Wrapf(err, "failed to create user %s", user.Email)
+		}
+		result.Restored[BackupKindUser]++
+	}
+	return nil
+}
+
+// restoreBackupPresets restores the presets by interface and name. The returned map translates the preset ids of the
+// backup to the ids of the database.
+func restoreBackupPresets(tx *gorm.DB, backup Backup, result *BackupRestoreResult) (map[uint]uint, error) {
+	presetIDs := make(map[uint]uint, len(backup.Presets))
+	for _, preset := range backup.Presets {
+		key := preset.DeviceName + "/" + preset.Name
+		var existing wireguard.AllowedIPsPreset
+		res := tx.Where("device_name = ? AND name = ?", preset.DeviceName, preset.Name).Limit(1).Find(&existing)
+		if res.Error != nil {
+			return nil, errors.Wrapf(res.Error, "failed to load preset %s", key)
+		}
+		if res.RowsAffected > 0 {
+			presetIDs[preset.ID] = existing.ID
+			if !result.existingConflict(BackupKindPreset, key) {
+				continue
+			}
+			existing.AllowedIPsStr = preset.AllowedIPsStr
+			if err := tx.Save(&existing).Error; err != nil {
+				return nil, errors.Wrapf(err, "failed to replace preset %s", key)
+			}
+		} else {
+			backupID := preset.ID
+			preset.ID = 0
+			if err := tx.Create(&preset).Error; err != nil {
+				return nil, errors.Wrapf(err, "failed to create preset %s", key)
+			}
+			presetIDs[backupID] = preset.ID
+		}
+		result.Restored[BackupKindPreset]++
+	}
+	return presetIDs, nil
+}
+
+func restoreBackupInterfaces(tx *gorm.DB, backup Backup, presetIDs map[uint]uint,
+	result *BackupRestoreResult) error {
+	for _, device := range backup.Interfaces {
+		if !wireguard.IsValidInterfaceName(device.DeviceName) {
+			result.conflict(BackupKindInterface, device.DeviceName, "invalid interface name", BackupResolutionSkipped)
+			continue
+		}
+		device.DefaultAllowedIPsPresetID = presetIDs[device.DefaultAllowedIPsPresetID]
+
+		var existing wireguard.Device
+		res := tx.Where("device_name = ?", device.DeviceName).Limit(1).Find(&existing)
+		if res.Error != nil {
+			return errors.Wrapf(res.Error, "failed to load interface %s", device.DeviceName)
+		}
+		found := res.RowsAffected > 0
+		if found && !result.existingConflict(BackupKindInterface, device.DeviceName) {
+			continue
+		}
+
+		switch {
+		case backup.IncludesKeys:
+		case found:
+			device.PrivateKey, device.PublicKey = existing.PrivateKey, existing.PublicKey
+		default:
+			key, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return errors.Wrap(err, "failed to generate private key")
+			}
+			device.PrivateKey, device.PublicKey = key.String(), key.PublicKey().String()
+			result.GeneratedKeys = append(result.GeneratedKeys, device.DeviceName)
+		}
+
+		if found {
+			if err := tx.Save(&device).Error; err != nil {
+				return errors.Wrapf(err, "failed to replace interface %s", device.DeviceName)
+			}
+		} else if err := tx.Create(&device).Error; err != nil {
+			return errors.Wrapf(err, "failed to create interface %s", device.DeviceName)
+		}
+		result.Restored[BackupKindInterface]++
+	}
+	return nil
+}
+
+func restoreBackupPeers(tx *gorm.DB, backup Backup, presetIDs map[uint]uint, result *BackupRestoreResult) error {
+	var stored []wireguard.Peer
+	if err := tx.Find(&stored).Error; err != nil {
+		return errors.Wrap(err, "failed to load peers")
+	}
+	addressOwners := make(map[string]string) // address -> public key of the stored peer
+	for _, peer := range stored {
+		for _, ip := range peerAddresses(peer) {
+			addressOwners[ip] = peer.PublicKey
+		}
+	}
+	var deviceNames []string
+	if err := tx.Model(&wireguard.Device{}).Pluck("device_name", &deviceNames).Error; err != nil {
+		return errors.Wrap(err, "failed to load interfaces")
+	}
+
+	for _, peer := range backup.Peers {
+		if !common.ListContains(deviceNames, peer.DeviceName) {
+			result.conflict(BackupKindPeer, peer.PublicKey, "the interface "+peer.DeviceName+" does not exist",
+				BackupResolutionSkipped)
+			continue
+		}
+		peer.AllowedIPsPresetID = presetIDs[peer.AllowedIPsPresetID]
+
+		var existing wireguard.Peer
+		res := tx.Where("public_key = ?", peer.PublicKey).Limit(1).Find(&existing)
+		if res.Error != nil {
+			return errors.Wrapf(res.Error, "failed to load peer %s", peer.PublicKey)
+		}
+		found := res.RowsAffected > 0
+		if !found && !backup.IncludesKeys {
+			// the keys cannot be generated, the public key identifies the peer on the client
+			result.conflict(BackupKindPeer, peer.PublicKey, "the backup contains no keys and the peer does not exist",
+				BackupResolutionSkipped)
+			continue
+		}
+		if conflict := addressConflict(peer, addressOwners); conflict != "" {
+			result.conflict(BackupKindPeer, peer.PublicKey, conflict, BackupResolutionSkipped)
+			continue
+		}
+		if found && !result.existingConflict(BackupKindPeer, peer.PublicKey) {
+			continue
+		}
+
+		if found {
+			if !backup.IncludesKeys {
+				peer.PrivateKey, peer.PresharedKey = existing.PrivateKey, existing.PresharedKey
+			}
+			if err := tx.Save(&peer).Error; err != nil {
+				return errors.Wrapf(err, "failed to replace peer %s", peer.PublicKey)
+			}
+			for _, ip := range peerAddresses(existing) {
+				delete(addressOwners, ip)
+			}
+		} else if err := tx.Create(&peer).Error; err != nil {
+			return errors.Wrapf(err, "failed to create peer %s", peer.PublicKey)
+		}
+		for _, ip := range peerAddresses(peer) {
+			addressOwners[ip] = peer.PublicKey
+		}
+		result.Restored[BackupKindPeer]++
+	}
+	return nil
+}
+
+// peerAddresses returns the addresses of the peer without prefix length.
+func peerAddresses(peer wireguard.Peer) []string {
+	addresses := make([]string, 0)
+	for _, cidr := range peer.GetIPAddresses() {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil {
+			addresses = append(addresses, ip.String())
+		}
+	}
+	return addresses
+}
+
+// addressConflict describes the first address of the peer that is used by another peer.
+func addressConflict(peer wireguard.Peer, addressOwners map[string]string) string {
+	for _, ip := range peerAddresses(peer) {
+		if owner, ok := addressOwners[ip]; ok && owner != peer.PublicKey {
+			return fmt.Sprintf("the address %s is used by peer %s", ip, owner)
+		}
+	}
+	return ""
+}
+
+func restoreBackupReservations(tx *gorm.DB, backup Backup, result *BackupRestoreResult) error {
+	for _, reservation := range backup.Reservations {
+		key := reservation.DeviceName + "/" + reservation.Network
+		var existing wireguard.IPReservation
+		res := tx.Where("device_name = ? AND network = ?", reservation.DeviceName, reservation.Network).Limit(1).
+			Find(&existing)
+		if res.Error != nil {
+			return errors.Wrapf(res.Error, "failed to load reservation %s", key)
+		}
+		if res.RowsAffected > 0 {
+			if !result.existingConflict(BackupKindReservation, key) {
+				continue
+			}
+			reservation.ID = existing.ID
+			if err := tx.Save(&reservation).Error; err != nil {
+				return errors.Wrapf(err, "failed to replace reservation %s", key)
+			}
+		} else {
+			reservation.ID = 0
+			if err := tx.Create(&reservation).Error; err != nil {
+				return errors.Wrapf(err, "failed to create reservation %s", key)
+			}
+		}
+		result.Restored[BackupKindReservation]++
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func createTestPeer(t *testing.T, s *Server, address string) wireguard.Peer {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := wireguard.Peer{PublicKey: key.PublicKey().String(), PrivateKey: key.String(),
+		PresharedKey: psk.String(), DeviceName: "wg0", Identifier: address, Email: "user@example.org",
+		IPsStr: address + "/32"}
+	if err := s.peers.CreatePeer(peer); err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+func TestRestoreBackupWithoutKeysSkipsNewPeers(t *testing.T) {
+	s := newTestServer(t, nil)
+	if err := s.peers.UpdateDevice(wireguard.Device{DeviceName: "wg0", Type: wireguard.DeviceTypeServer,
+		IPsStr: "10.0.0.1/24"}); err != nil {
+		t.Fatal(err)
+	}
+	kept := createTestPeer(t, s, "10.0.0.2")
+	deleted := createTestPeer(t, s, "10.0.0.3")
+
+	backup, err := s.CreateBackup(false, "admin@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.peers.DeletePeer(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.restoreBackup(backup, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Restored[BackupKindPeer] != 1 {
+		t.Errorf("%d peers restored, want 1", result.Restored[BackupKindPeer])
+	}
+	skipped := false
+	for _, conflict := range result.Conflicts {
+		if conflict.Key == deleted.PublicKey {
+			skipped = conflict.Resolution == BackupResolutionSkipped
+		}
+	}
+	if !skipped {
+		t.Errorf("the deleted peer is not reported as skipped: %+v", result.Conflicts)
+	}
+
+	if peer := s.peers.GetPeerByKey(deleted.PublicKey); peer.PublicKey != "" {
+		t.Error("the peer was created without keys")
+	}
+	peer := s.peers.GetPeerByKey(kept.PublicKey)
+	if peer.PrivateKey != kept.PrivateKey || peer.PresharedKey != kept.PresharedKey {
+		t.Error("the replaced peer lost its stored keys")
+	}
+}
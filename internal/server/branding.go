@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"image"
+	_ "image/gif" // registers the decoders that validate uploaded logos
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	maxBrandingLogoSize   = 512 << 10
+	maxBrandingLogoPixels = 2048 // maximum width and height of uploaded logos
+	maxBrandingCSSSize    = 16 << 10
+)
+
+var (
+	brandingColorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+	// brandingLogoTypes are the accepted logo formats, SVG is not accepted as it may contain scripts.
+	brandingLogoTypes = map[string]string{"image/png": "png", "image/jpeg": "jpeg", "image/gif": "gif"}
+)
+
+// Branding is the branding that admins configure in the web interface. It overrides LOGO_URL and is applied to all
+// pages. There is at most one entry.
+type Branding struct {
+	ID           uint `gorm:"primaryKey"`
+	Logo         []byte
+	LogoType     string // the content type of the uploaded logo
+	PrimaryColor string // color of buttons and links, e.g. #0d6efd
+	CustomCSS    string // appended to the stylesheets of every page
+	UpdatedBy    string
+	UpdatedAt    time.Time
+}
+
+// brandingCache holds the stored branding, so pages are rendered without a database query.
+type brandingCache struct {
+	mux      sync.RWMutex
+	branding Branding
+}
+
+func (c *brandingCache) get() Branding {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.branding
+}
+
+func (c *brandingCache) set(branding Branding) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.branding = branding
+}
+
+// loadBranding caches the stored branding.
+func (s *Server) loadBranding() error {
+	branding := Branding{}
+	if err := s.db.Limit(1).Find(&branding).Error; err != nil {
+		return errors.Wrap(err, "failed to load branding")
+	}
+	s.branding = &brandingCache{branding: branding}
+	return nil
+}
+
+// SaveBranding validates and stores the primary color and the custom CSS. If logo is not empty, it replaces the
+// uploaded logo.
+func (s *Server) SaveBranding(primaryColor, customCSS string, logo []byte, actor string) error {
+	branding := s.branding.get()
+	primaryColor = strings.TrimSpace(primaryColor)
+	if primaryColor != "" && !brandingColorRegex.MatchString(primaryColor) {
+		return errors.Errorf("invalid color %s, use the #rrggbb notation", primaryColor)
+	}
+	if err := validateBrandingCSS(customCSS); err != nil {
+		return err
+	}
+	if len(logo) > 0 {
+		logoType, err := validateBrandingLogo(logo)
+		if err != nil {
+			return err
+		}
+		branding.Logo, branding.LogoType = logo, logoType
+	}
+	branding.PrimaryColor = primaryColor
+	branding.CustomCSS = strings.TrimSpace(customCSS)
+	branding.UpdatedBy = actor
+
+	if err := s.db.Save(&branding).Error; err != nil {
+		return errors.Wrap(err, "failed to save branding")
+	}
+	s.branding.set(branding)
+	return nil
+}
+
+// ResetBranding removes the uploaded logo, the color and the custom CSS, the configured defaults are used again.
+func (s *Server) ResetBranding() error {
+	if err := s.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&Branding{}).Error; err != nil {
+		return errors.Wrap(err, "failed to reset branding")
+	}
+	s.branding.set(Branding{})
+	return nil
+}
+
+// validateBrandingLogo checks the size, the format and the dimensions of an uploaded logo and returns its content
+// type. The image is decoded, so files with a spoofed type are rejected.
+func validateBrandingLogo(logo []byte) (string, error) {
+	if len(logo) > maxBrandingLogoSize {
+		return "", errors.Errorf("the logo is larger than %d KiB", maxBrandingLogoSize>>10)
+	}
+	contentType := http.DetectContentType(logo)
+	format, ok := brandingLogoTypes[contentType]
+	if !ok {
+		return "", errors.Errorf("unsupported logo type %s, use PNG, JPEG or GIF", contentType)
+	}
+	cfg, decodedFormat, err := image.DecodeConfig(bytes.NewReader(logo))
+	if err != nil || decodedFormat != format {
+		return "", errors.New("the logo is not a valid image")
+	}
+	if cfg.Width > maxBrandingLogoPixels || cfg.Height > maxBrandingLogoPixels {
+		return "", errors.Errorf("the logo must not be larger than %dx%d pixels", maxBrandingLogoPixels,
+			maxBrandingLogoPixels)
+	}
+	return contentType, nil
+}
+
+// validateBrandingCSS rejects CSS that could end the style element and inject markup into the pages.
+func validateBrandingCSS(css string) error {
+	if len(css) > maxBrandingCSSSize {
+		return errors.Errorf("the custom CSS is larger than %d KiB", maxBrandingCSSSize>>10)
+	}
+	if strings.Contains(css, "<") {
+		return errors.New("the custom CSS must not contain <")
+	}
+	return nil
+}
+
+// brandingLogoUrl returns the url of the uploaded logo, the version parameter makes browsers load a replaced logo.
+func (s *Server) brandingLogoUrl(branding Branding) string {
+	return s.urlPath("/branding/logo?v=" + strconv.FormatInt(branding.UpdatedAt.Unix(), 10))
+}
+
+// brandingCSS returns the style rules of the primary color and the custom CSS.
+func brandingCSS(branding Branding) template.CSS {
+	var css strings.Builder
+	if branding.PrimaryColor != "" {
+		css.WriteString(".btn-primary, .btn-primary:hover, .badge-primary, .bg-primary, .page-item.active .page-link { " +
+			"background-color: " + branding.PrimaryColor + " !important; border-color: " + branding.PrimaryColor +
+			" !important; }\n")
+		css.WriteString(".container a:not(.btn):not(.dropdown-item):not(.nav-link), .text-primary, .page-link { " +
+			"color: " + branding.PrimaryColor + "; }\n")
+		css.WriteString(".btn-outline-primary { color: " + branding.PrimaryColor + "; border-color: " +
+			branding.PrimaryColor + "; }\n")
+	}
+	css.WriteString(branding.CustomCSS)
+	return template.CSS(css.String()) // validated on save, see validateBrandingCSS
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	BulkPeerActionEnable  = "enable"
+	BulkPeerActionDisable = "disable"
+	BulkPeerActionDelete  = "delete"
+)
+
+// bulkPeerAuditActions maps the bulk actions to the actions of their audit entries.
+var bulkPeerAuditActions = map[string]string{
+	BulkPeerActionEnable:  "peer.bulk_enabled",
+	BulkPeerActionDisable: "peer.bulk_disabled",
+	BulkPeerActionDelete:  "peer.bulk_deleted",
+}
+
+// BulkPeerActionResult summarizes a bulk action on the selected peers of an interface.
+type BulkPeerActionResult struct {
+	Action    string
+	Succeeded []string          // public keys of the changed peers
+	Skipped   []string          // public keys of peers that were already enabled or disabled
+	Failed    map[string]string // public key -> failure reason
+}
+
+// FailedSummary lists the failed peers and their failure reasons in a stable order.
+func (r BulkPeerActionResult) FailedSummary() string {
+	keys := make([]string, 0, len(r.Failed))
+	for key := range r.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	failures := make([]string, len(keys))
+	for i, key := range keys {
+		failures[i] = key + ": " + r.Failed[key]
+	}
+	return strings.Join(failures, "; ")
+}
+
+// ApplyBulkPeerAction enables, disables or deletes the peers of the interface with the given public keys. All changes
+// are stored and applied to the physical interface in a single unit, see wireguard.PeerManager.ApplyPeerChanges. If
+// that fails, the peers are applied one by one, so that only the failing peers are skipped. The database and the
+// interface are never changed for a peer that is reported as failed. One audit entry summarizes the action.
+func (s *Server) ApplyBulkPeerAction(device, action string, publicKeys []string, actor string) (
+	BulkPeerActionResult, error) {
+	result := BulkPeerActionResult{
+		Action:    action,
+		Succeeded: make([]string, 0),
+		Skipped:   make([]string, 0),
+		Failed:    make(map[string]string),
+	}
+	auditAction, ok := bulkPeerAuditActions[action]
+	if !ok {
+		return result, errors.Errorf("invalid bulk action %s", action)
+	}
+	if len(publicKeys) == 0 {
+		return result, errors.New("no peers selected")
+	}
+
+	dev := s.peers.GetDevice(device)
+	now := time.Now()
+	changes := make([]wireguard.PeerChange, 0, len(publicKeys))
+	selected := make(map[string]bool, len(publicKeys))
+	for _, key := range publicKeys {
+		if selected[key] {
+			continue
+		}
+		selected[key] = true
+
+		peer := s.peers.GetPeerByKey(key)
+		wgKey, err := wgtypes.ParseKey(key)
+		if peer.PublicKey == "" || peer.DeviceName != device || err != nil {
+			result.Failed[key] = "peer not found"
+			continue
+		}
+
+		cfg := wgtypes.PeerConfig{PublicKey: wgKey, Remove: true}
+		switch {
+		case action == BulkPeerActionEnable && peer.DeactivatedAt == nil,
+			action == BulkPeerActionDisable && peer.DeactivatedAt != nil:
+			result.Skipped = append(result.Skipped, key)
+			continue
+		case action == BulkPeerActionEnable:
+			peer.DeactivatedAt = nil
+			peer.DeactivationReason = wireguard.DeactivationReasonManual
+			peer.ReactivatedAt = &now
+			cfg = peer.GetConfig(&dev)
+		case action == BulkPeerActionDisable:
+			peer.DeactivatedAt = &now
+			peer.DeactivationReason = wireguard.DeactivationReasonManual
+		}
+		peer.UpdatedBy = actor
+		changes = append(changes, wireguard.PeerChange{Peer: peer, Delete: action == BulkPeerActionDelete,
+			Config: cfg})
+	}
+
+	eventType := common.WebhookEventPeerUpdated
+	if action == BulkPeerActionDelete {
+		eventType = common.WebhookEventPeerDeleted
+	}
+	for _, peer := range s.applyBulkPeerChanges(device, action, changes, result.Failed) {
+		result.Succeeded = append(result.Succeeded, peer.PublicKey)
+		s.webhooks.Dispatch(common.WebhookEvent{Type: eventType, Interface: device, PeerKey: peer.PublicKey,
+			Actor: actor})
+	}
+
+	details := fmt.Sprintf("%d succeeded, %d skipped, %d failed", len(result.Succeeded), len(result.Skipped),
+		len(result.Failed))
+	if len(result.Failed) > 0 {
+		details += ": " + result.FailedSummary()
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: auditAction, Interface: device,
+		Details: details})
+
+	if len(result.Succeeded) == 0 {
+		return result, nil
+	}
+	s.syncDeviceRoutes(device)
+
+	return result, s.WriteWireGuardConfigFile(device)
+}
+
+// applyBulkPeerChanges stores and applies the changes and returns the peers that were changed. The failure reasons of
+// the other peers are added to failed.
+func (s *Server) applyBulkPeerChanges(device, action string, changes []wireguard.PeerChange,
+	failed map[string]string) []wireguard.Peer {
+	applied := make([]wireguard.Peer, 0, len(changes))
+	if len(changes) == 0 {
+		return applied
+	}
+	err := s.peers.ApplyPeerChanges(device, changes)
+	if err == nil {
+		for _, change := range changes {
+			applied = append(applied, change.Peer)
+		}
+		return applied
+	}
+	logrus.Warnf("bulk %s of %d peers of %s failed, applying them one by one: %v", action, len(changes), device, err)
+
+	// the failed call was rolled back, so every peer is applied again on its own
+	for i, change := range changes {
+		if err := s.peers.ApplyPeerChanges(device, changes[i:i+1]); err != nil {
+			logrus.Errorf("bulk %s of peer %s failed: %v", action, change.Peer.PublicKey, err)
+			failed[change.Peer.PublicKey] = err.Error()
+			continue
+		}
+		applied = append(applied, change.Peer)
+	}
+	return applied
+}
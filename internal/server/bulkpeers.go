@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// BulkPeerResult summarizes a bulk peer creation run for one interface.
+type BulkPeerResult struct {
+	Device     string
+	Running    bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Created    []string          // email addresses of users that received a new peer
+	Skipped    []string          // email addresses of users that already own a peer on the interface
+	Failed     map[string]string // email address -> failure reason
+	Error      string            // set if the whole run failed
+}
+
+type bulkPeerJobs struct {
+	mux     sync.RWMutex
+	results map[string]*BulkPeerResult
+}
+
+// StartBulkPeerCreation creates a peer for every active user that does not own a peer on the given interface yet.
+// The peers are created in the background, use GetBulkPeerResult to retrieve the progress.
+func (s *Server) StartBulkPeerCreation(device, identifierSuffix, actor string) error {
+	if dev := s.peers.GetDevice(device); dev.Type != wireguard.DeviceTypeServer {
+		return errors.New("peers can only be created in bulk for server mode interfaces")
+	}
+
+	s.bulkJobs.mux.Lock()
+	defer s.bulkJobs.mux.Unlock()
+
+	if result, ok := s.bulkJobs.results[device]; ok && result.Running {
+		return errors.Errorf("bulk peer creation for %s is already running", device)
+	}
+
+	result := &BulkPeerResult{
+		Device:    device,
+		Running:   true,
+		StartedAt: time.Now(),
+		Created:   make([]string, 0),
+		Skipped:   make([]string, 0),
+		Failed:    make(map[string]string),
+	}
+	s.bulkJobs.results[device] = result
+
+	go s.runBulkPeerCreation(device, identifierSuffix, actor)
+
+	return nil
+}
+
+// GetBulkPeerResult returns a copy of the last bulk peer creation result for the given interface, or nil.
+func (s *Server) GetBulkPeerResult(device string) *BulkPeerResult {
+	s.bulkJobs.mux.RLock()
+	defer s.bulkJobs.mux.RUnlock()
+
+	result, ok := s.bulkJobs.results[device]
+	if !ok {
+		return nil
+	}
+
+	resultCopy := *result
+	resultCopy.Created = append([]string{}, result.Created...)
+	resultCopy.Skipped = append([]string{}, result.Skipped...)
+	resultCopy.Failed = make(map[string]string, len(result.Failed))
+	for k, v := range result.Failed {
+		resultCopy.Failed[k] = v
+	}
+	return &resultCopy
+}
+
+func (s *Server) updateBulkPeerResult(device string, update func(result *BulkPeerResult)) {
+	s.bulkJobs.mux.Lock()
+	defer s.bulkJobs.mux.Unlock()
+
+	update(s.bulkJobs.results[device])
+}
+
+func (s *Server) runBulkPeerCreation(device, identifierSuffix, actor string) {
+	logrus.Infof("starting bulk peer creation for %s", device)
+
+	dev := s.peers.GetDevice(device)
+	existingPeers := make(map[string]bool)
+	for _, peer := range s.peers.GetAllPeers(device) {
+		existingPeers[peer.Email] = true
+	}
+
+	// Create all missing peers in the database first, the physical interface is updated at once afterwards
+	createdPeers := make([]wireguard.Peer, 0)
+	cfgs := make([]wgtypes.PeerConfig, 0)
+	for _, user := range s.users.GetUsers() {
+		if !user.IsActive() {
+			continue // pending or rejected registrations get no peers
+		}
+		if existingPeers[user.Email] {
+			s.updateBulkPeerResult(device, func(result *BulkPeerResult) {
+				result.Skipped = append(result.Skipped, user.Email)
+			})
+			continue
+		}
+
+		// the same checks as for a single peer, only the physical interface is updated later
+		peer, err := s.PrepareNewPeer(device)
+		if err == nil {
+			peer.Email = user.Email
+			peer.Identifier = fmt.Sprintf("%s %s (%s)", user.Firstname, user.Lastname, identifierSuffix)
+			peer.CreatedBy = actor
+			peer.UpdatedBy = actor
+			err = s.prepareNewPeerCreation(dev, &peer, false)
+		}
+		if err == nil {
+			err = s.peers.CreatePeer(peer)
+		}
+		if err != nil {
+			logrus.Warnf("bulk peer creation for %s failed for %s: %v", device, user.Email, err)
+			s.updateBulkPeerResult(device, func(result *BulkPeerResult) {
+				result.Failed[user.Email] = err.Error()
+			})
+			continue
+		}
+
+		createdPeers = append(createdPeers, peer)
+		cfgs = append(cfgs, peer.GetConfig(&dev))
+	}
+
+	var runErr error
+	if len(cfgs) > 0 {
+		if err := s.wg.ConfigurePeersOrRestore(device, cfgs); err != nil {
+			// roll back, the next run will retry all failed users
+			runErr = errors.WithMessage(err, "failed to apply peers to WireGuard interface")
+			if err := s.peers.DeletePeers(createdPeers); err != nil {
+				logrus.Errorf("failed to roll back the created peers of %s: %v", device, err)
+			}
+		} else {
+			for _, peer := range createdPeers {
+				s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerCreated, Interface: device,
+					PeerKey: peer.PublicKey, Actor: actor})
+			}
+			s.syncDeviceRoutes(device)
+			if err := s.WriteWireGuardConfigFile(device); err != nil {
+				logrus.Errorf("failed to write WireGuard config file for %s: %v", device, err)
+			}
+		}
+	}
+
+	s.updateBulkPeerResult(device, func(result *BulkPeerResult) {
+		for _, peer := range createdPeers {
+			if runErr != nil {
+				result.Failed[peer.Email] = runErr.Error()
+			} else {
+				result.Created = append(result.Created, peer.Email)
+			}
+		}
+		if runErr != nil {
+			result.Error = runErr.Error()
+		}
+		result.Running = false
+		result.FinishedAt = time.Now()
+
+		logrus.Infof("finished bulk peer creation for %s: %d created, %d skipped, %d failed", device,
+			len(result.Created), len(result.Skipped), len(result.Failed))
+	})
+}
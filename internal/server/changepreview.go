@@ -0,0 +1,310 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Kinds of pending changes, see PendingChange
+const (
+	PendingChangeInterface = "interface"
+	PendingChangePeer      = "peer"
+)
+
+// PendingChange is an edit of an interface or peer that was previewed but not confirmed yet. The submitted form is
+// kept in the FormData of the session. The edit is refused if the stored entry was changed after the preview.
+type PendingChange struct {
+	Kind      string    // PendingChangeInterface or PendingChangePeer
+	Key       string    // the interface name or the public key of the peer
+	UpdatedAt time.Time // of the stored entry when the preview was shown
+
+	RegenerateKey bool // interface: generate a new key pair
+	ApplyToPeers  bool // interface: apply the peer defaults to the peers afterwards
+	Disabled      bool // peer: the peer is disabled
+}
+
+// ChangePreview is the difference between the stored state of an interface or peer and a submitted edit, see
+// PreviewDeviceChange and PreviewPeerChange. Secrets are not shown, only whether they are set.
+type ChangePreview struct {
+	Settings []SettingChange // the stored settings
+	Config   []SettingChange // the WireGuard configuration that is applied to the interface
+	Notes    []string        // effects that the settings do not show
+}
+
+// IsEmpty reports whether the edit changes nothing.
+func (p ChangePreview) IsEmpty() bool {
+	return len(p.Settings) == 0 && len(p.Config) == 0
+}
+
+// PreviewDeviceChange validates the submitted settings of the interface and compares them with the stored settings,
+// like UpdateDeviceSettings would store and apply them. Nothing is changed.
+func (s *Server) PreviewDeviceChange(updated wireguard.Device, regenerateKey bool) (ChangePreview, error) {
+	preview := ChangePreview{}
+	currentDevice := s.peers.GetDevice(updated.DeviceName)
+	if !currentDevice.IsValid() {
+		return preview, &DeviceUpdateError{Step: "device", Err: errors.Errorf("unknown interface %s", updated.DeviceName)}
+	}
+	updated, _, err := s.prepareDeviceSettings(currentDevice, updated)
+	if err != nil {
+		return preview, err
+	}
+	external := s.wg.IsExternalDevice(updated.DeviceName)
+	regenerateKey = regenerateKey && !external
+
+	presetNames := map[uint]string{0: "none"}
+	for _, preset := range s.peers.GetAllowedIPsPresets(updated.DeviceName) {
+		presetNames[preset.ID] = preset.Name
+	}
+
+	settings := &preview.Settings
+	addChange(settings, "Type", string(currentDevice.Type), string(updated.Type))
+	addChange(settings, "Display name", currentDevice.DisplayName, updated.DisplayName)
+	if regenerateKey {
+		addChange(settings, "Public key", currentDevice.PublicKey, "new key pair")
+	} else {
+		addChange(settings, "Public key", currentDevice.PublicKey, updated.PublicKey)
+		addSecretChange(settings, "Private key", currentDevice.PrivateKey, updated.PrivateKey)
+	}
+	addChange(settings, "Listen port", formatListenPort(currentDevice.ListenPort), formatListenPort(updated.ListenPort))
+	addChange(settings, "Firewall mark", formatInt(int(currentDevice.FirewallMark)), formatInt(int(updated.FirewallMark)))
+	addChange(settings, "MTU", formatInt(currentDevice.Mtu), formatInt(updated.Mtu))
+	addChange(settings, "IP addresses", currentDevice.IPsStr, updated.IPsStr)
+	addChange(settings, "DNS servers", currentDevice.DNSStr, updated.DNSStr)
+	addChange(settings, "Routing table", currentDevice.RoutingTable, updated.RoutingTable)
+	addChange(settings, "Pre up", currentDevice.PreUp, updated.PreUp)
+	addChange(settings, "Post up", currentDevice.PostUp, updated.PostUp)
+	addChange(settings, "Pre down", currentDevice.PreDown, updated.PreDown)
+	addChange(settings, "Post down", currentDevice.PostDown, updated.PostDown)
+	addChange(settings, "Save config", formatBool(currentDevice.SaveConfig), formatBool(updated.SaveConfig))
+	addChange(settings, "Endpoint", currentDevice.DefaultEndpoint, updated.DefaultEndpoint)
+	addChange(settings, "Endpoint candidates", currentDevice.EndpointCandidatesStr, updated.EndpointCandidatesStr)
+	addChange(settings, "Default allowed IPs", currentDevice.DefaultAllowedIPsStr, updated.DefaultAllowedIPsStr)
+	addChange(settings, "Default allowed IPs preset", presetNames[currentDevice.DefaultAllowedIPsPresetID],
+		presetNames[updated.DefaultAllowedIPsPresetID])
+	addChange(settings, "Default keepalive", formatInt(currentDevice.DefaultPersistentKeepalive),
+		formatInt(updated.DefaultPersistentKeepalive))
+	addChange(settings, "Guest peer days", formatInt(currentDevice.DefaultGuestDays), formatInt(updated.DefaultGuestDays))
+	addChange(settings, "Tunnel mode", formatTunnelMode(currentDevice.TunnelMode), formatTunnelMode(updated.TunnelMode))
+	addChange(settings, "Inherit DNS", formatBool(currentDevice.InheritDNS), formatBool(updated.InheritDNS))
+	addChange(settings, "Inherit allowed IPs", formatBool(currentDevice.InheritAllowedIPs),
+		formatBool(updated.InheritAllowedIPs))
+	addChange(settings, "Inherit keepalive", formatBool(currentDevice.InheritKeepalive),
+		formatBool(updated.InheritKeepalive))
+	addChange(settings, "Upstream interface", currentDevice.UpstreamInterface, updated.UpstreamInterface)
+	addChange(settings, "Namespace", currentDevice.Namespace, updated.Namespace)
+	addChange(settings, "Inactivity days", formatInt(currentDevice.InactivityDisableDays),
+		formatInt(updated.InactivityDisableDays))
+	addChange(settings, "Maximum peers", formatInt(currentDevice.MaxPeers), formatInt(updated.MaxPeers))
+	addChange(settings, "Generate preshared keys", formatBool(currentDevice.GeneratePresharedKeys),
+		formatBool(updated.GeneratePresharedKeys))
+	addChange(settings, "Self service", formatBool(currentDevice.SelfService), formatBool(updated.SelfService))
+	addChange(settings, "Write config file", formatBool(!currentDevice.DisableConfigFile),
+		formatBool(!updated.DisableConfigFile))
+
+	// The portal only configures the peers of an external server on the server itself
+	if !external {
+		currentConfig, updatedConfig := currentDevice.GetConfig(), updated.GetConfig()
+		if regenerateKey {
+			addChange(&preview.Config, "Private key", "set", "new key pair")
+		} else {
+			addSecretChange(&preview.Config, "Private key", formatKey(currentConfig.PrivateKey),
+				formatKey(updatedConfig.PrivateKey))
+		}
+		addChange(&preview.Config, "Listen port", formatListenPort(*currentConfig.ListenPort),
+			formatListenPort(*updatedConfig.ListenPort))
+		addChange(&preview.Config, "Firewall mark", formatInt(*currentConfig.FirewallMark),
+			formatInt(*updatedConfig.FirewallMark))
+
+		changedPeers := 0
+		for _, peer := range s.peers.GetActivePeers(updated.DeviceName) {
+			if formatPeerConfig(peer.GetConfig(&currentDevice)) != formatPeerConfig(peer.GetConfig(&updated)) {
+				changedPeers++
+			}
+		}
+		switch {
+		case changedPeers == 1:
+			preview.Notes = append(preview.Notes, "The WireGuard configuration of 1 peer changes.")
+		case changedPeers > 1:
+			preview.Notes = append(preview.Notes, fmt.Sprintf("The WireGuard configuration of %d peers changes.",
+				changedPeers))
+		}
+	}
+
+	if regenerateKey {
+		preview.Notes = append(preview.Notes, "A new key pair is generated, all peers need an updated configuration.")
+	}
+	if updated.Namespace != currentDevice.Namespace {
+		preview.Notes = append(preview.Notes, "The link is moved into the new network namespace.")
+	}
+	return preview, nil
+}
+
+// PreviewPeerChange validates the submitted peer and compares it with the stored peer, like UpdatePeer would store
+// and apply it. Nothing is changed.
+func (s *Server) PreviewPeerChange(currentPeer, updated wireguard.Peer) (ChangePreview, error) {
+	preview := ChangePreview{}
+	dev := s.peers.GetDevice(updated.DeviceName)
+	if err := s.preparePeerUpdate(currentPeer, dev, &updated); err != nil {
+		return preview, err
+	}
+
+	presetNames := map[uint]string{0: "none"}
+	for _, preset := range s.peers.GetAllowedIPsPresets(updated.DeviceName) {
+		presetNames[preset.ID] = preset.Name
+	}
+
+	settings := &preview.Settings
+	addChange(settings, "Identifier", currentPeer.Identifier, updated.Identifier)
+	addChange(settings, "Email", currentPeer.Email, updated.Email)
+	addChange(settings, "Description", currentPeer.Description, updated.Description)
+	addChange(settings, "Tags", currentPeer.TagsStr, updated.TagsStr)
+	addChange(settings, "Notes", currentPeer.Notes, updated.Notes)
+	addChange(settings, "State", formatPeerState(currentPeer), formatPeerState(updated))
+	addChange(settings, "Ignore global settings", formatBool(currentPeer.IgnoreGlobalSettings),
+		formatBool(updated.IgnoreGlobalSettings))
+	addChange(settings, "Public key", currentPeer.PublicKey, updated.PublicKey)
+	addSecretChange(settings, "Private key", currentPeer.PrivateKey, updated.PrivateKey)
+	addSecretChange(settings, "Preshared key", currentPeer.PresharedKey, updated.PresharedKey)
+	addChange(settings, "IP addresses", currentPeer.IPsStr, updated.IPsStr)
+	addChange(settings, "Allowed IPs preset", presetNames[currentPeer.AllowedIPsPresetID],
+		presetNames[updated.AllowedIPsPresetID])
+	addChange(settings, "Allowed IPs", currentPeer.AllowedIPsStr, updated.AllowedIPsStr)
+	addChange(settings, "Server side allowed IPs", currentPeer.AllowedIPsSrvStr, updated.AllowedIPsSrvStr)
+	addChange(settings, "Endpoint", currentPeer.Endpoint, updated.Endpoint)
+	addChange(settings, "Persistent keepalive", formatInt(currentPeer.PersistentKeepalive),
+		formatInt(updated.PersistentKeepalive))
+	addChange(settings, "DNS servers", currentPeer.DNSStr, updated.DNSStr)
+	addChange(settings, "MTU", formatInt(currentPeer.Mtu), formatInt(updated.Mtu))
+	addChange(settings, "Override DNS", formatBool(currentPeer.OverrideDNS), formatBool(updated.OverrideDNS))
+	addChange(settings, "Override MTU", formatBool(currentPeer.OverrideMtu), formatBool(updated.OverrideMtu))
+	addChange(settings, "Override keepalive", formatBool(currentPeer.OverrideKeepalive),
+		formatBool(updated.OverrideKeepalive))
+	addChange(settings, "Override endpoint", formatBool(currentPeer.OverrideEndpoint),
+		formatBool(updated.OverrideEndpoint))
+	addChange(settings, "Managed", formatBool(currentPeer.Managed), formatBool(updated.Managed))
+
+	configured, willBeConfigured := currentPeer.DeactivatedAt == nil, updated.DeactivatedAt == nil
+	switch {
+	case configured && !willBeConfigured:
+		addChange(&preview.Config, "Peer", "configured", "removed from the interface")
+	case !configured && willBeConfigured:
+		addChange(&preview.Config, "Peer", "not configured", "added to the interface")
+	case !configured:
+		preview.Notes = append(preview.Notes, "The peer is disabled, it is not configured on the interface.")
+	}
+	if willBeConfigured {
+		currentConfig, updatedConfig := currentPeer.GetConfig(&dev), updated.GetConfig(&dev)
+		addChange(&preview.Config, "Public key", currentConfig.PublicKey.String(), updatedConfig.PublicKey.String())
+		addSecretChange(&preview.Config, "Preshared key", formatKey(currentConfig.PresharedKey),
+			formatKey(updatedConfig.PresharedKey))
+		addChange(&preview.Config, "Allowed IPs", formatAllowedIPs(currentConfig), formatAllowedIPs(updatedConfig))
+		addChange(&preview.Config, "Endpoint", formatEndpoint(currentConfig), formatEndpoint(updatedConfig))
+		addChange(&preview.Config, "Persistent keepalive", formatKeepalive(currentConfig),
+			formatKeepalive(updatedConfig))
+	}
+	if updated.PublicKey != currentPeer.PublicKey || updated.PresharedKey != currentPeer.PresharedKey ||
+		updated.IPsStr != currentPeer.IPsStr {
+		preview.Notes = append(preview.Notes, "The client needs an updated configuration.")
+	}
+	return preview, nil
+}
+
+// addChange appends the setting if the value changes.
+func addChange(changes *[]SettingChange, setting, current, updated string) {
+	if current != updated {
+		*changes = append(*changes, SettingChange{Setting: setting, Current: current, New: updated})
+	}
+}
+
+// addSecretChange appends the setting if the secret changes, only whether it is set is shown.
+func addSecretChange(changes *[]SettingChange, setting, current, updated string) {
+	if current == updated {
+		return
+	}
+	formatted := func(secret string) string {
+		if secret == "" {
+			return "none"
+		}
+		return "set"
+	}
+	updatedValue := formatted(updated)
+	if current != "" && updated != "" {
+		updatedValue = "changed"
+	}
+	*changes = append(*changes, SettingChange{Setting: setting, Current: formatted(current), New: updatedValue})
+}
+
+func formatBool(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatInt(value int) string {
+	return strconv.Itoa(value)
+}
+
+func formatListenPort(port int) string {
+	if port == 0 {
+		return "random"
+	}
+	return strconv.Itoa(port)
+}
+
+func formatTunnelMode(mode wireguard.TunnelMode) string {
+	if mode == wireguard.TunnelModeCustom {
+		return "custom"
+	}
+	return string(mode)
+}
+
+func formatPeerState(peer wireguard.Peer) string {
+	if peer.DeactivatedAt != nil {
+		return "disabled"
+	}
+	return "enabled"
+}
+
+// formatKey returns the key, an all-zero key is the same as no key.
+func formatKey(key *wgtypes.Key) string {
+	if key == nil || *key == (wgtypes.Key{}) {
+		return ""
+	}
+	return key.String()
+}
+
+func formatAllowedIPs(cfg wgtypes.PeerConfig) string {
+	networks := make([]string, len(cfg.AllowedIPs))
+	for i := range cfg.AllowedIPs {
+		networks[i] = cfg.AllowedIPs[i].String()
+	}
+	return common.ListToString(networks)
+}
+
+func formatEndpoint(cfg wgtypes.PeerConfig) string {
+	if cfg.Endpoint == nil {
+		return "none"
+	}
+	return cfg.Endpoint.String()
+}
+
+func formatKeepalive(cfg wgtypes.PeerConfig) string {
+	if cfg.PersistentKeepaliveInterval == nil {
+		return "off"
+	}
+	return cfg.PersistentKeepaliveInterval.String()
+}
+
+// formatPeerConfig returns the settings of the peer configuration, for comparisons.
+func formatPeerConfig(cfg wgtypes.PeerConfig) string {
+	return strings.Join([]string{cfg.PublicKey.String(), formatKey(cfg.PresharedKey), formatAllowedIPs(cfg),
+		formatEndpoint(cfg), formatKeepalive(cfg)}, "|")
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.1", "172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: trusted}
+
+	for _, tc := range []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"}, // not a proxy, the header is forged
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"}, // the client wrote the first entry
+		{"10.0.0.1:1234", "198.51.100.7, 172.16.3.4", "198.51.100.7"},  // chain of trusted proxies
+		{"10.0.0.1:1234", "forged, 172.16.3.4", "172.16.3.4"},
+		{"[2001:db8::1]:1234", "198.51.100.7", "2001:db8::1"},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			c.Request.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := s.clientIP(c); got != tc.want {
+			t.Errorf("%s with X-Forwarded-For %q: got %s, want %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"proxy.example.org"}); err == nil {
+		t.Error("a host name was accepted as trusted proxy")
+	}
+}
+
+// postLoginWithForwardedFor submits a failed login with the X-Forwarded-For header and returns the redirect.
+func postLoginWithForwardedFor(t *testing.T, baseUrl, username, forwarded string) string {
+	t.Helper()
+
+	client := newTestClient(t)
+	_, body := getPage(t, client, baseUrl+"/auth/login")
+	token := csrfInputPattern.FindStringSubmatch(body)
+	if token == nil {
+		t.Fatal("the login form has no CSRF token")
+	}
+	form := url.Values{csrfFormField: {token[1]}, "username": {username}, "password": {"wrong"}}
+	req, _ := http.NewRequest(http.MethodPost, baseUrl+"/auth/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", forwarded)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Location")
+}
+
+func TestLoginLockoutIgnoresForgedForwardedFor(t *testing.T) {
+	s := newTestServer(t, map[string]string{"LOGIN_LOCKOUT_ATTEMPTS": "3"})
+	baseUrl := startTestServer(t, s).URL
+
+	// every attempt uses another username and another forged address, only the ip counter can lock
+	for i := 0; i < 3; i++ {
+		location := postLoginWithForwardedFor(t, baseUrl, fmt.Sprintf("user%d@example.org", i),
+			fmt.Sprintf("198.51.100.%d", i+1))
+		if !strings.HasSuffix(location, "err=authfail") {
+			t.Fatalf("attempt %d: redirected to %q", i+1, location)
+		}
+	}
+	if location := postLoginWithForwardedFor(t, baseUrl, "user9@example.org", "198.51.100.99"); !strings.HasSuffix(
+		location, "err=locked") {
+		t.Errorf("a new forged address reset the lockout, redirected to %q", location)
+	}
+
+	for _, failure := range s.loginGuard.Failures() {
+		if failure.ClientIP != "127.0.0.1" {
+			t.Errorf("the forged address %s was recorded", failure.ClientIP)
+		}
+	}
+}
+
+func TestLoginLockoutBehindTrustedProxy(t *testing.T) {
+	s := newTestServer(t, map[string]string{"LOGIN_LOCKOUT_ATTEMPTS": "3", "TRUSTED_PROXIES": "127.0.0.1"})
+	baseUrl := startTestServer(t, s).URL
+
+	for i := 0; i < 3; i++ {
+		// the client prepends another address, the proxy appends the real one
+		postLoginWithForwardedFor(t, baseUrl, fmt.Sprintf("user%d@example.org", i),
+			fmt.Sprintf("203.0.113.%d, 198.51.100.1", i+1))
+	}
+	if location := postLoginWithForwardedFor(t, baseUrl, "user9@example.org", "198.51.100.1"); !strings.HasSuffix(
+		location, "err=locked") {
+		t.Errorf("the client address of the proxy is not locked, redirected to %q", location)
+	}
+	if location := postLoginWithForwardedFor(t, baseUrl, "user9@example.org", "198.51.100.2"); !strings.HasSuffix(
+		location, "err=authfail") {
+		t.Errorf("another client of the proxy is locked, redirected to %q", location)
+	}
+}
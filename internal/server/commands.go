@@ -0,0 +1,993 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gin-gonic/gin/binding"
+	wgportal "github.com/h44z/wg-portal"
+	ldapprovider "github.com/h44z/wg-portal/internal/authentication/providers/ldap"
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/i18n"
+	"github.com/h44z/wg-portal/internal/users"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+const (
+	commandActor          = "cli" // actor of the audit entries of the maintenance commands
+	commandPasswordLength = 16    // length of generated passwords, longer if the policy requires it
+	commandPasswordChars  = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789!#$%&*+-=?"
+)
+
+var errCommandFailed = errors.New("command failed") // the result has been printed and explains the failure
+
+// command is a maintenance subcommand of the wg-portal binary. setup registers the flags of the command and returns
+// the function that runs it with the positional arguments.
+type command struct {
+	name        string
+	args        []string // names of the positional arguments
+	optional    bool     // the positional arguments may be omitted
+	description string
+	database    bool // the command needs the database, see setupCommand
+	setup       func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error)
+}
+
+// commandResult is printed as JSON with --json, or as text otherwise.
+type commandResult interface {
+	writeText(w io.Writer)
+}
+
+var commands = []command{
+	{
+		name:     "create-admin",
+		args:     []string{"email"},
+		optional: true,
+		description: "Creates a database administrator, or makes an existing user an active administrator with a new " +
+			"password. Without email, ADMIN_USER is used and the password defaults to ADMIN_PASS. The command " +
+			"refuses to run if an active administrator exists, unless --force is given.",
+		database: true,
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			password := fs.String("password", "", "the password, ADMIN_PASS or a random password if empty")
+			firstname := fs.String("firstname", "WireGuard", "the first name of a new user")
+			lastname := fs.String("lastname", "Administrator", "the last name of a new user")
+			force := fs.Bool("force", false, "run even if an active administrator exists")
+			return func(s *Server, args []string) (commandResult, error) {
+				email, adminPassword := s.config.Core.AdminUser, *password
+				if len(args) > 0 {
+					email = args[0]
+				} else if adminPassword == "" && s.config.Core.AdminPassword != defaultAdminPassword {
+					adminPassword = s.config.Core.AdminPassword
+				}
+				return s.commandCreateAdmin(email, adminPassword, *firstname, *lastname, *force)
+			}
+		},
+	},
+	{
+		name:        "reset-password",
+		args:        []string{"email"},
+		description: "Sets a new database password for a user.",
+		database:    true,
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			password := fs.String("password", "", "the new password, a random password is generated if empty")
+			return func(s *Server, args []string) (commandResult, error) {
+				return s.commandResetPassword(args[0], *password)
+			}
+		},
+	},
+	{
+		name:        "list-interfaces",
+		description: "Lists the managed interfaces that are stored in the database.",
+		database:    true,
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			return func(s *Server, _ []string) (commandResult, error) {
+				return s.commandListInterfaces(), nil
+			}
+		},
+	},
+	{
+		name: "export-peers",
+		args: []string{"interface"},
+		description: "Exports the interface and its peers. With --json, the output is the export document of the " +
+			"REST API, which can be imported again.",
+		database: true,
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			redact := fs.Bool("redact", false, "remove the private and preshared keys")
+			return func(s *Server, args []string) (commandResult, error) {
+				doc, err := s.ExportInterface(args[0], *redact, commandActor)
+				if err != nil {
+					return nil, err
+				}
+				return commandInterfaceExport(doc), nil
+			}
+		},
+	},
+	{
+		name: "migrate",
+		description: "Applies the pending database migrations and exits, like \"wg-portal --migrate-only\". The " +
+			"server applies them on startup as well.",
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			return func(s *Server, _ []string) (commandResult, error) {
+				return s.commandMigrate()
+			}
+		},
+	},
+	{
+		name: "encrypt-keys",
+		description: "Encrypts the stored private and preshared keys with the master key of WG_KEY_ENCRYPTION_KEY or " +
+			"WG_KEY_ENCRYPTION_KEY_FILE. With --previous-key-file, the keys of the previous master key are encrypted " +
+			"again, which rotates the master key. Stop the portal before the rotation.",
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			previousKeyFile := fs.String("previous-key-file", "", "file that contains the previous master key")
+			return func(s *Server, _ []string) (commandResult, error) {
+				return s.commandEncryptKeys(*previousKeyFile)
+			}
+		},
+	},
+	{
+		name: "backup",
+		description: "Writes a backup archive of the users, interfaces and peers to the backup directory " +
+			"(BACKUP_DIRECTORY) or to the file of --output. With --keys, the private and preshared keys are included, " +
+			"encrypted with the master key.",
+		database: true,
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			output := fs.String("output", "", "the archive file, defaults to a new file in BACKUP_DIRECTORY")
+			keys := fs.Bool("keys", false, "include the private and preshared keys, requires a master key")
+			return func(s *Server, _ []string) (commandResult, error) {
+				return s.commandBackup(*output, *keys)
+			}
+		},
+	},
+	{
+		name: "restore",
+		args: []string{"archive"},
+		description: "Restores a backup archive in a single transaction and prints the conflict report. Existing " +
+			"entries are kept unless --overwrite is given. Stop the portal before the restore, it applies the " +
+			"restored interfaces on startup.",
+		database: true,
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			overwrite := fs.Bool("overwrite", false, "replace existing entries with the entries of the backup")
+			dryRun := fs.Bool("dry-run", false, "only report what would be restored")
+			return func(s *Server, args []string) (commandResult, error) {
+				return s.commandRestore(args[0], *overwrite, *dryRun)
+			}
+		},
+	},
+	{
+		name: "check-config",
+		description: "Validates the configuration file and the environment and checks that the database and the " +
+			"authentication providers are reachable. Exits with 1 if a check fails.",
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			return func(s *Server, _ []string) (commandResult, error) {
+				result := s.commandCheckConfig()
+				if !result.Valid {
+					return result, errCommandFailed
+				}
+				return result, nil
+			}
+		},
+	},
+	{
+		name: "extract-messages",
+		args: []string{"language"},
+		description: "Creates or updates the translation catalog <language>.json with the messages of the web " +
+			"interface. Existing translations are kept, new messages are added with an empty translation.",
+		setup: func(fs *flag.FlagSet) func(s *Server, args []string) (commandResult, error) {
+			dir := fs.String("dir", "", "the directory of the catalog, defaults to TRANSLATIONS_PATH or the current directory")
+			return func(s *Server, args []string) (commandResult, error) {
+				return s.commandExtractMessages(args[0], *dir)
+			}
+		},
+	},
+}
+
+// RunCommand runs a maintenance subcommand, e.g. "wg-portal reset-password admin@example.com", and returns the exit
+// code: 0 on success, 1 if the command failed and 2 for invalid usage. The commands use the configuration of the
+// server and work on its database directly, the web server is not started and the WireGuard interfaces are not
+// changed. So they also work while the portal is running, or if it cannot start.
+func RunCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printCommandUsage(stderr)
+		return 2
+	}
+	if args[0] == "--migrate-only" {
+		args = append([]string{"migrate"}, args[1:]...) // flag of the server, e.g. for an init container
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "unknown command %s\n\n", args[0])
+		printCommandUsage(stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	jsonOutput := fs.Bool("json", false, "print machine-readable JSON")
+	run := cmd.setup(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: wg-portal %s [flags]", cmd.name)
+		for _, arg := range cmd.args {
+			if cmd.optional {
+				fmt.Fprintf(stderr, " [<%s>]", arg)
+			} else {
+				fmt.Fprintf(stderr, " <%s>", arg)
+			}
+		}
+		fmt.Fprintf(stderr, "\n\n%s\n\nflags:\n", cmd.description)
+		fs.PrintDefaults()
+	}
+
+	// flags are also accepted after the positional arguments
+	positional := make([]string, 0, len(cmd.args))
+	remaining := args[1:]
+	for {
+		if err := fs.Parse(remaining); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		remaining = fs.Args()[1:]
+	}
+	if len(positional) != len(cmd.args) && !(cmd.optional && len(positional) == 0) {
+		fs.Usage()
+		return 2
+	}
+
+	s := &Server{}
+	var result commandResult
+	var err error
+	if cmd.database {
+		err = s.setupCommand()
+	}
+	if err == nil {
+		result, err = run(s, positional)
+	}
+
+	if result != nil {
+		if *jsonOutput {
+			encoder := json.NewEncoder(stdout)
+			encoder.SetIndent("", "  ")
+			_ = encoder.Encode(result)
+		} else {
+			result.writeText(stdout)
+		}
+	}
+	if err != nil {
+		if err != errCommandFailed {
+			if *jsonOutput {
+				_ = json.NewEncoder(stdout).Encode(ApiError{Message: err.Error()})
+			} else {
+				fmt.Fprintf(stderr, "error: %v\n", err)
+			}
+		}
+		return 1
+	}
+	return 0
+}
+
+func printCommandUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: wg-portal [command]\n\nWithout command, the server is started. Commands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.description)
+	}
+	_ = tw.Flush()
+	fmt.Fprintf(w, "\nRun \"wg-portal <command> -h\" for the flags of a command.\n")
+}
+
+// setupCommand opens the database like Setup does, but the WireGuard interfaces are never accessed, see
+// wireguard.NewOfflineManager.
+func (s *Server) setupCommand() error {
+	var err error
+	s.config = NewConfig()
+	s.ctx = context.Background()
+
+	if s.db, err = common.GetDatabaseForConfig(&s.config.Database); err != nil {
+		return errors.WithMessage(err, "database setup failed")
+	}
+	if _, err = common.MigrateDatabase(s.db); err != nil {
+		return errors.WithMessage(err, "database migration failed")
+	}
+	if err = s.setupKeyEncryption(); err != nil {
+		return errors.WithMessage(err, "key encryption setup failed")
+	}
+	if s.users, err = users.NewManager(s.db); err != nil {
+		return errors.WithMessage(err, "user-manager initialization failed")
+	}
+	s.wg = wireguard.NewOfflineManager(&s.config.WG)
+	if s.peers, err = wireguard.NewOfflinePeerManager(s.db, s.wg); err != nil {
+		return errors.WithMessage(err, "unable to setup peer manager")
+	}
+	if s.audit, err = common.NewAuditLog(s.db); err != nil {
+		return errors.WithMessage(err, "unable to setup audit log")
+	}
+
+	return nil
+}
+
+// commandUser is the result of create-admin and reset-password. The password is only returned if it was generated.
+type commandUser struct {
+	Email             string
+	IsAdmin           bool
+	Created           bool
+	GeneratedPassword string `json:",omitempty"`
+}
+
+func (r commandUser) writeText(w io.Writer) {
+	switch {
+	case r.Created:
+		fmt.Fprintf(w, "created administrator %s\n", r.Email)
+	case r.IsAdmin:
+		fmt.Fprintf(w, "updated administrator %s\n", r.Email)
+	default:
+		fmt.Fprintf(w, "updated user %s\n", r.Email)
+	}
+	if r.GeneratedPassword != "" {
+		fmt.Fprintf(w, "password: %s\n", r.GeneratedPassword)
+	}
+}
+
+func (s *Server) commandCreateAdmin(email, password, firstname, lastname string, force bool) (commandResult,
+	error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !force {
+		for _, user := range s.users.GetUsers() {
+			if user.IsAdmin && user.IsActive() {
+				return nil, errors.Errorf("the administrator %s already exists, use --force to create another "+
+					"administrator", user.Email)
+			}
+		}
+	}
+	result := commandUser{Email: email, IsAdmin: true}
+	if password == "" {
+		password = s.generateCommandPassword()
+		result.GeneratedPassword = password
+	}
+	hashedPassword, err := s.hashUserPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := users.User{Email: email, Firstname: firstname, Lastname: lastname, Source: users.UserSourceDatabase}
+	if existingUser := s.users.GetUserUnscoped(email); existingUser != nil {
+		user = *existingUser
+	}
+	user.IsAdmin = true
+	user.State = users.UserStateActive
+	user.DeletedAt = gorm.DeletedAt{} // the peers of a disabled user stay deactivated
+	if err := binding.Validator.ValidateStruct(user); err != nil {
+		return nil, err
+	}
+	user.Password = hashedPassword
+
+	if user.CreatedAt.IsZero() {
+		result.Created = true
+		err = s.users.CreateUser(&user)
+	} else {
+		err = s.users.UpdateUser(&user)
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to store administrator")
+	}
+	s.audit.Record(common.AuditEntry{Actor: commandActor, Action: "user.admin_created", Target: email})
+
+	return result, nil
+}
+
+func (s *Server) commandResetPassword(email, password string) (commandResult, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	user := s.users.GetUserUnscoped(email)
+	if user == nil {
+		return nil, errors.Errorf("user %s does not exist", email)
+	}
+	result := commandUser{Email: email, IsAdmin: user.IsAdmin}
+	if password == "" {
+		password = s.generateCommandPassword()
+		result.GeneratedPassword = password
+	}
+	hashedPassword, err := s.hashUserPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Unscoped().Model(&users.User{}).Where("email = ?", email).
+		UpdateColumn("password", hashedPassword).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to store password")
+	}
+	s.audit.Record(common.AuditEntry{Actor: commandActor, Action: "user.password_reset", Target: email})
+
+	return result, nil
+}
+
+// generateCommandPassword returns a random password that satisfies the password policy.
+func (s *Server) generateCommandPassword() string {
+	length := commandPasswordLength
+	if s.config.Password.MinLength > length {
+		length = s.config.Password.MinLength
+	}
+	for {
+		password := make([]byte, length)
+		for i := range password {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(commandPasswordChars))))
+			if err != nil {
+				panic(err) // the system random number generator is broken
+			}
+			password[i] = commandPasswordChars[n.Int64()]
+		}
+		if s.config.Password.Validate(string(password)) == nil {
+			return string(password)
+		}
+	}
+}
+
+// commandInterface is an entry of list-interfaces.
+type commandInterface struct {
+	DeviceName  string
+	DisplayName string
+	Type        wireguard.DeviceType
+	Addresses   []string
+	ListenPort  int
+	PublicKey   string
+	Peers       int64
+	Disabled    bool
+	External    bool
+	Stored      bool // false if the interface is configured but not stored in the database yet
+}
+
+type commandInterfaces []commandInterface
+
+func (r commandInterfaces) writeText(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tTYPE\tADDRESSES\tPORT\tPEERS\tSTATE\tPUBLIC KEY")
+	for _, dev := range r {
+		state := "enabled"
+		switch {
+		case !dev.Stored:
+			state = "not stored"
+		case dev.Disabled:
+			state = "disabled"
+		case dev.External:
+			state = "external"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n", dev.DeviceName, dev.Type, strings.Join(dev.Addresses, ","),
+			dev.ListenPort, dev.Peers, state, dev.PublicKey)
+	}
+	_ = tw.Flush()
+}
+
+func (s *Server) commandListInterfaces() commandInterfaces {
+	result := make(commandInterfaces, 0, len(s.config.WG.DeviceNames))
+	for _, deviceName := range s.config.WG.DeviceNames {
+		dev := s.peers.GetDevice(deviceName)
+		result = append(result, commandInterface{
+			DeviceName:  deviceName,
+			DisplayName: dev.DisplayName,
+			Type:        dev.Type,
+			Addresses:   dev.GetIPAddresses(),
+			ListenPort:  dev.ListenPort,
+			PublicKey:   dev.PublicKey,
+			Peers:       s.peers.CountPeers(deviceName),
+			Disabled:    dev.DisabledAt != nil,
+			External:    s.wg.IsExternalDevice(deviceName),
+			Stored:      dev.DeviceName != "",
+		})
+	}
+	return result
+}
+
+type commandInterfaceExport wireguard.InterfaceExport
+
+func (r commandInterfaceExport) writeText(w io.Writer) {
+	fmt.Fprintf(w, "interface %s (%s), %d peers\n\n", r.Device.DeviceName, r.Device.Type, len(r.Peers))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "IDENTIFIER\tEMAIL\tADDRESSES\tSTATE\tPUBLIC KEY")
+	for _, peer := range r.Peers {
+		state := "enabled"
+		if peer.DeactivatedAt != nil {
+			state = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", peer.Identifier, peer.Email, peer.IPsStr, state, peer.PublicKey)
+	}
+	_ = tw.Flush()
+}
+
+// MarshalJSON keeps the format of wireguard.InterfaceExport, so the output can be imported.
+func (r commandInterfaceExport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(wireguard.InterfaceExport(r))
+}
+
+// commandMigration is the result of migrate.
+type commandMigration common.MigrationResult
+
+func (r commandMigration) writeText(w io.Writer) {
+	for _, migration := range r.Applied {
+		fmt.Fprintf(w, "applied migration %d: %s\n", migration.Version, migration.Name)
+	}
+	if len(r.Applied) == 0 {
+		fmt.Fprintf(w, "database schema version %d is up to date\n", r.ToVersion)
+	} else {
+		fmt.Fprintf(w, "migrated database schema from version %d to %d\n", r.FromVersion, r.ToVersion)
+	}
+}
+
+func (s *Server) commandMigrate() (commandResult, error) {
+	var err error
+	s.config = NewConfig()
+	if s.db, err = common.GetDatabaseForConfig(&s.config.Database); err != nil {
+		return nil, errors.WithMessage(err, "database setup failed")
+	}
+	result, err := common.MigrateDatabase(s.db)
+	if err != nil {
+		return nil, errors.WithMessage(err, "database migration failed")
+	}
+	return commandMigration(result), nil
+}
+
+// commandKeyEncryption is the result of encrypt-keys.
+type commandKeyEncryption struct {
+	wireguard.KeyEncryptionResult
+	MasterKey string // id of the master key
+}
+
+func (r commandKeyEncryption) writeText(w io.Writer) {
+	fmt.Fprintf(w, "encrypted %d plaintext keys and %d keys of the previous master key with the master key %s, "+
+		"%d keys were already encrypted with it\n", r.Encrypted, r.Reencrypted, r.MasterKey, r.Unchanged)
+}
+
+func (s *Server) commandEncryptKeys(previousKeyFile string) (commandResult, error) {
+	var err error
+	s.config = NewConfig()
+	keyCipher, err := wireguard.LoadKeyCipher(s.config.WG)
+	if err != nil {
+		return nil, err
+	}
+	if keyCipher == nil {
+		return nil, errors.New("no master key is configured, set WG_KEY_ENCRYPTION_KEY or WG_KEY_ENCRYPTION_KEY_FILE")
+	}
+	if previousKeyFile != "" {
+		raw, err := os.ReadFile(previousKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the previous master key")
+		}
+		previousKey, err := wireguard.ParseMasterKey(string(raw))
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid previous master key")
+		}
+		if err := keyCipher.AddPreviousKey(previousKey); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.db, err = common.GetDatabaseForConfig(&s.config.Database); err != nil {
+		return nil, errors.WithMessage(err, "database setup failed")
+	}
+	if _, err = common.MigrateDatabase(s.db); err != nil {
+		return nil, errors.WithMessage(err, "database migration failed")
+	}
+	if s.audit, err = common.NewAuditLog(s.db); err != nil {
+		return nil, errors.WithMessage(err, "unable to setup audit log")
+	}
+
+	result, err := wireguard.EncryptStoredKeys(s.db, keyCipher)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to encrypt the keys, no key was changed")
+	}
+	s.audit.Record(common.AuditEntry{Actor: commandActor, Action: "keys.encrypted", Details: fmt.Sprintf(
+		"master key %s, %d encrypted, %d encrypted again", keyCipher.ID(), result.Encrypted, result.Reencrypted)})
+	return commandKeyEncryption{KeyEncryptionResult: result, MasterKey: keyCipher.ID()}, nil
+}
+
+// commandBackupFile is the result of backup.
+type commandBackupFile struct {
+	File         string
+	Users        int
+	Interfaces   int
+	Peers        int
+	IncludesKeys bool
+}
+
+func (r commandBackupFile) writeText(w io.Writer) {
+	keys := "without keys"
+	if r.IncludesKeys {
+		keys = "with encrypted keys"
+	}
+	fmt.Fprintf(w, "wrote backup of %d users, %d interfaces and %d peers %s to %s\n", r.Users, r.Interfaces,
+		r.Peers, keys, r.File)
+}
+
+func (s *Server) commandBackup(output string, includeKeys bool) (commandResult, error) {
+	if output == "" {
+		if s.config.Core.BackupDirectory == "" {
+			return nil, errors.New("no backup directory is configured, set BACKUP_DIRECTORY or use --output")
+		}
+		if err := s.checkBackupConfig(); err != nil {
+			return nil, err
+		}
+	}
+	file, backup, err := s.WriteBackup(output, includeKeys, commandActor)
+	if err != nil {
+		return nil, err
+	}
+	return commandBackupFile{File: file, Users: len(backup.Users), Interfaces: len(backup.Interfaces),
+		Peers: len(backup.Peers), IncludesKeys: backup.IncludesKeys}, nil
+}
+
+// commandBackupRestore is the result of restore.
+type commandBackupRestore BackupRestoreResult
+
+func (r commandBackupRestore) writeText(w io.Writer) {
+	if len(r.Conflicts) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tENTRY\tCONFLICT\tRESOLUTION")
+		for _, conflict := range r.Conflicts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", conflict.Kind, conflict.Key, conflict.Reason, conflict.Resolution)
+		}
+		_ = tw.Flush()
+		fmt.Fprintln(w)
+	}
+	restored := fmt.Sprintf("%d users, %d interfaces, %d peers, %d presets and %d address reservations",
+		r.Restored[BackupKindUser], r.Restored[BackupKindInterface], r.Restored[BackupKindPeer],
+		r.Restored[BackupKindPreset], r.Restored[BackupKindReservation])
+	if r.DryRun {
+		fmt.Fprintf(w, "dry run, nothing was stored: %s would be restored, %d conflicts\n", restored,
+			len(r.Conflicts))
+		return
+	}
+	fmt.Fprintf(w, "restored %s, %d conflicts\n", restored, len(r.Conflicts))
+	if len(r.GeneratedKeys) > 0 {
+		fmt.Fprintf(w, "the backup contains no keys, new key pairs were generated for %s\n",
+			strings.Join(r.GeneratedKeys, ", "))
+	}
+	fmt.Fprintln(w, "start the portal to apply the restored interfaces")
+}
+
+func (s *Server) commandRestore(file string, overwrite, dryRun bool) (commandResult, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open backup archive")
+	}
+	backup, err := ReadBackupArchive(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.restoreBackup(backup, overwrite, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		s.recordBackupRestore(result, commandActor)
+	}
+	return commandBackupRestore(result), nil
+}
+
+// ConfigCheck is the result of a single check of check-config.
+type ConfigCheck struct {
+	Name    string
+	Status  string // ok, warning or error
+	Message string `json:",omitempty"`
+}
+
+type configCheckResult struct {
+	Valid  bool // no check failed, warnings are allowed
+	Checks []ConfigCheck
+}
+
+func (r *configCheckResult) add(name, status, message string) {
+	r.Checks = append(r.Checks, ConfigCheck{Name: name, Status: status, Message: message})
+	if status == "error" {
+		r.Valid = false
+	}
+}
+
+// check adds the result of a check that fails with err.
+func (r *configCheckResult) check(name string, err error) {
+	if err != nil {
+		r.add(name, "error", err.Error())
+	} else {
+		r.add(name, "ok", "")
+	}
+}
+
+// addSchemaCheck compares the schema version of the database with the migrations of the binary.
+func (r *configCheckResult) addSchemaCheck(db *gorm.DB) {
+	version, err := common.SchemaVersion(db)
+	latest := common.LatestSchemaVersion()
+	switch {
+	case err != nil:
+		r.add("database schema", "error", err.Error())
+	case version > latest:
+		r.add("database schema", "error", fmt.Sprintf("version %d is newer than the version %d of this binary",
+			version, latest))
+	case version < latest:
+		r.add("database schema", "warning", fmt.Sprintf("version %d, migrations up to version %d are applied on "+
+			"startup", version, latest))
+	default:
+		r.add("database schema", "ok", "")
+	}
+}
+
+// addKeyEncryptionCheck checks that the stored keys can be decrypted with the configured master key.
+func (r *configCheckResult) addKeyEncryptionCheck(db *gorm.DB, cfg wireguard.Config) {
+	keyCipher, err := wireguard.LoadKeyCipher(cfg)
+	if err != nil || !db.Migrator().HasTable(&wireguard.Peer{}) {
+		return // reported by the interface check, or first start
+	}
+	stored, err := wireguard.CountStoredKeys(db, keyCipher)
+	if err == nil {
+		err = stored.Check()
+	}
+	switch {
+	case err != nil:
+		r.add("key encryption", "error", err.Error())
+	case keyCipher != nil && stored.Plaintext > 0:
+		r.add("key encryption", "warning", fmt.Sprintf("%d keys are stored in plaintext, run wg-portal encrypt-keys",
+			stored.Plaintext))
+	case keyCipher != nil:
+		r.add("key encryption", "ok", "")
+	}
+}
+
+func (r configCheckResult) writeText(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range r.Checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Name, strings.ToUpper(c.Status), c.Message)
+	}
+	_ = tw.Flush()
+	if r.Valid {
+		fmt.Fprintln(w, "\nconfiguration is valid")
+	} else {
+		fmt.Fprintln(w, "\nconfiguration is invalid")
+	}
+}
+
+func (s *Server) commandCheckConfig() configCheckResult {
+	result := configCheckResult{Valid: true}
+
+	cfgFile, ok := os.LookupEnv("CONFIG_FILE")
+	if !ok {
+		cfgFile = "config.yml"
+	}
+	if _, err := os.Stat(cfgFile); os.IsNotExist(err) {
+		result.add("config file", "warning", cfgFile+" does not exist, only the environment is used")
+	} else {
+		result.check("config file", checkConfigFile(cfgFile))
+	}
+	result.check("environment", loadConfigEnv(&Config{}))
+
+	s.config = NewConfig()
+	s.ctx = context.Background()
+	cfg := s.config
+
+	externalUrl, err := url.Parse(cfg.Core.ExternalUrl)
+	switch {
+	case err != nil:
+		result.add("external url", "error", err.Error())
+	case externalUrl.Scheme != "http" && externalUrl.Scheme != "https" || externalUrl.Host == "":
+		result.add("external url", "error", "EXTERNAL_URL must be an absolute http or https url")
+	default:
+		s.basePath = strings.TrimRight(externalUrl.Path, "/")
+		result.add("external url", "ok", "")
+	}
+
+	if _, err = s.newSessionStore(); err == nil && cfg.Core.SessionSecret == "secret" {
+		result.add("session", "warning", "the default SESSION_SECRET is used")
+	} else {
+		result.check("session", err)
+	}
+
+	if s.db, err = common.GetDatabaseForConfig(&cfg.Database); err == nil {
+		if sqlDB, dbErr := s.db.DB(); dbErr != nil {
+			err = dbErr
+		} else {
+			err = sqlDB.Ping()
+			if err == nil {
+				result.addSchemaCheck(s.db)
+				result.addKeyEncryptionCheck(s.db, cfg.WG)
+			}
+			_ = sqlDB.Close()
+		}
+	}
+	result.check("database", err)
+
+	result.check("interfaces", checkInterfaceConfig(cfg.WG))
+
+	if cfg.Core.BackupDirectory != "" {
+		s.keyCipher, _ = wireguard.LoadKeyCipher(cfg.WG) // an invalid master key is reported by the interface check
+		result.check("backups", s.checkBackupConfig())
+	}
+
+	if cfg.Core.LdapEnabled {
+		if cfg.LDAP.AdminLdapGroup_ == nil {
+			result.add("ldap", "error", "LDAP_ADMIN_GROUP is not a valid DN")
+		} else {
+			_, err := ldapprovider.New(&cfg.LDAP)
+			result.check("ldap", err)
+		}
+		if cfg.LDAP.SyncCreatePeer && cfg.LDAP.SyncPeerDevice != "" &&
+			!common.ListContains(cfg.WG.DeviceNames, cfg.LDAP.SyncPeerDevice) {
+			result.add("ldap", "error", "LDAP_SYNC_PEER_DEVICE "+cfg.LDAP.SyncPeerDevice+" is not a managed interface")
+		}
+	}
+
+	if len(cfg.OIDC.Providers) > 0 {
+		result.check("oidc", cfg.OIDC.Validate())
+	}
+
+	if cfg.Core.GrpcTlsCertificate != "" {
+		_, err := s.grpcTlsConfig()
+		result.check("grpc", err)
+	} else if cfg.Core.GrpcClientCA != "" {
+		result.add("grpc", "error", "GRPC_CLIENT_CA requires GRPC_TLS_CERT and GRPC_TLS_KEY")
+	}
+
+	if s.translations, err = s.loadTranslations(); err != nil {
+		result.check("translations", err)
+	} else if !s.translations.Has(cfg.Core.DefaultLanguage) {
+		result.add("translations", "warning", "DEFAULT_LANGUAGE "+cfg.Core.DefaultLanguage+" is not available, "+
+			i18n.SourceLanguage+" is used")
+	} else {
+		result.add("translations", "ok", "")
+	}
+
+	return result
+}
+
+// commandMessages is the result of extract-messages.
+type commandMessages struct {
+	Language   string
+	File       string
+	Messages   int // messages of the templates and the code
+	Translated int
+	Added      int
+	Unused     int // entries of the catalog that are no longer used, they are kept
+}
+
+func (r commandMessages) writeText(w io.Writer) {
+	fmt.Fprintf(w, "updated %s: %d messages, %d translated, %d added, %d unused\n", r.File, r.Messages,
+		r.Translated, r.Added, r.Unused)
+}
+
+// commandExtractMessages writes the messages of the templates, and the messages of the code marked with i18n.Mark,
+// to the catalog of the language. Translations of the bundled catalog are copied into a new catalog, so that they
+// can be customized with TRANSLATIONS_PATH.
+func (s *Server) commandExtractMessages(language, dir string) (commandResult, error) {
+	s.config = NewConfig()
+	if dir == "" {
+		dir = s.config.Core.TranslationsPath
+	}
+	language = i18n.NormalizeTag(language)
+	result := commandMessages{Language: language, File: filepath.Join(dir, language+".json")}
+
+	messages, err := i18n.Extract(wgportal.Templates, "assets/tpl/*.html")
+	if err != nil {
+		return nil, err
+	}
+	bundled := i18n.NewCatalog()
+	if err := bundled.Load(wgportal.Translations, "assets/i18n"); err != nil {
+		return nil, err
+	}
+
+	catalog := map[string]string{i18n.NameKey: language}
+	if raw, err := os.ReadFile(result.File); err == nil {
+		if err := json.Unmarshal(raw, &catalog); err != nil {
+			return nil, errors.Wrapf(err, "invalid catalog %s", result.File)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read catalog %s", result.File)
+	} else if bundled.Has(language) {
+		catalog[i18n.NameKey] = bundled.Translate(language, i18n.NameKey)
+	}
+
+	used := map[string]bool{i18n.NameKey: true}
+	for _, msg := range messages {
+		used[msg] = true
+		if _, ok := catalog[msg]; !ok {
+			result.Added++
+			catalog[msg] = ""
+			if translation := bundled.Translate(language, msg); translation != msg {
+				catalog[msg] = translation
+			}
+		}
+		if catalog[msg] != "" {
+			result.Translated++
+		}
+	}
+	for msg := range catalog {
+		if !used[msg] {
+			result.Unused++
+		}
+	}
+	result.Messages = len(messages)
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(catalog) // the keys are sorted
+	if err := os.WriteFile(result.File, out.Bytes(), 0644); err != nil {
+		return nil, errors.Wrapf(err, "failed to write catalog %s", result.File)
+	}
+	return result, nil
+}
+
+// checkConfigFile parses the config file strictly, unknown keys are reported as errors.
+func checkConfigFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open config file %s", filename)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&Config{})
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// the messages contain the whole config struct, only the part before it is useful
+		lines := make([]string, len(typeErr.Errors))
+		for i, line := range typeErr.Errors {
+			if idx := strings.Index(line, " in type "); idx > 0 {
+				line = line[:idx]
+			}
+			lines[i] = line
+		}
+		return errors.Errorf("invalid config file %s: %s", filename, strings.Join(lines, "; "))
+	}
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "failed to decode config file %s", filename)
+	}
+	return nil
+}
+
+func checkInterfaceConfig(cfg wireguard.Config) error {
+	if len(cfg.DeviceNames) == 0 {
+		return errors.New("WG_DEVICES must contain at least one interface")
+	}
+	if cfg.DefaultDeviceName != "" && !common.ListContains(cfg.DeviceNames, cfg.DefaultDeviceName) {
+		return errors.Errorf("WG_DEFAULT_DEVICE %s is not a managed interface", cfg.DefaultDeviceName)
+	}
+	backends := []wireguard.Backend{cfg.Backend}
+	for _, backend := range cfg.DeviceBackends {
+		backends = append(backends, backend)
+	}
+	for _, backend := range backends {
+		switch backend {
+		case wireguard.BackendKernel, wireguard.BackendUserspace, wireguard.BackendAuto, "":
+		default:
+			return errors.Errorf("unknown WireGuard backend %s, use kernel, userspace or auto", backend)
+		}
+	}
+	if _, err := wireguard.LoadKeyCipher(cfg); err != nil {
+		return err
+	}
+	if cfg.OnlineHandshakeAge <= 0 {
+		return errors.New("WG_ONLINE_HANDSHAKE_AGE must be positive, otherwise no peer is online")
+	}
+	for device, age := range cfg.DeviceOnlineHandshakeAges {
+		if age <= 0 {
+			return errors.Errorf("the online handshake age of %s must be positive, otherwise no peer is online", device)
+		}
+	}
+	return nil
+}
@@ -4,18 +4,25 @@ import (
 	"os"
 	"reflect"
 	"runtime"
+	"time"
 
 	"github.com/h44z/wg-portal/internal/common"
 	"github.com/h44z/wg-portal/internal/ldap"
+	"github.com/h44z/wg-portal/internal/oidc"
+	"github.com/h44z/wg-portal/internal/users"
 	"github.com/h44z/wg-portal/internal/wireguard"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v3"
 
 	gldap "github.com/go-ldap/ldap/v3"
 )
 
+// defaultAdminPassword is never used, a random password is generated for the admin instead
+const defaultAdminPassword = "wgportal"
+
 var ErrInvalidSpecification = errors.New("specification must be a struct pointer")
 
 // loadConfigFile parses yaml files. It uses yaml annotation to store the data in a struct.
@@ -57,25 +64,63 @@ func loadConfigEnv(cfg interface{}) error {
 
 type Config struct {
 	Core struct {
-		ListeningAddress        string `yaml:"listeningAddress" envconfig:"LISTENING_ADDRESS"`
-		ExternalUrl             string `yaml:"externalUrl" envconfig:"EXTERNAL_URL"`
-		Title                   string `yaml:"title" envconfig:"WEBSITE_TITLE"`
-		CompanyName             string `yaml:"company" envconfig:"COMPANY_NAME"`
-		MailFrom                string `yaml:"mailFrom" envconfig:"MAIL_FROM"`
-		AdminUser               string `yaml:"adminUser" envconfig:"ADMIN_USER"` // must be an email address
-		AdminPassword           string `yaml:"adminPass" envconfig:"ADMIN_PASS"`
-		EditableKeys            bool   `yaml:"editableKeys" envconfig:"EDITABLE_KEYS"`
-		CreateDefaultPeer       bool   `yaml:"createDefaultPeer" envconfig:"CREATE_DEFAULT_PEER"`
-		SelfProvisioningAllowed bool   `yaml:"selfProvisioning" envconfig:"SELF_PROVISIONING"`
-		WGExoprterFriendlyNames bool   `yaml:"wgExporterFriendlyNames" envconfig:"WG_EXPORTER_FRIENDLY_NAMES"`
-		LdapEnabled             bool   `yaml:"ldapEnabled" envconfig:"LDAP_ENABLED"`
-		SessionSecret           string `yaml:"sessionSecret" envconfig:"SESSION_SECRET"`
-		LogoUrl                 string `yaml:"logoUrl" envconfig:"LOGO_URL"`
+		ListeningAddress        string        `yaml:"listeningAddress" envconfig:"LISTENING_ADDRESS"`
+		GrpcListeningAddress    string        `yaml:"grpcListeningAddress" envconfig:"GRPC_LISTENING_ADDRESS"` // optional, the gRPC API is disabled if empty
+		GrpcToken               string        `yaml:"grpcToken" envconfig:"GRPC_TOKEN"`                        // optional, static token with administrator access to the gRPC API
+		GrpcTlsCertificate      string        `yaml:"grpcTlsCert" envconfig:"GRPC_TLS_CERT"`
+		GrpcTlsKey              string        `yaml:"grpcTlsKey" envconfig:"GRPC_TLS_KEY"`
+		GrpcClientCA            string        `yaml:"grpcClientCa" envconfig:"GRPC_CLIENT_CA"` // optional, enables client certificate authentication
+		ExternalUrl             string        `yaml:"externalUrl" envconfig:"EXTERNAL_URL"`
+		TrustedProxies          []string      `yaml:"trustedProxies" envconfig:"TRUSTED_PROXIES"` // addresses or networks of reverse proxies whose X-Forwarded-For header is used
+		Title                   string        `yaml:"title" envconfig:"WEBSITE_TITLE"`
+		CompanyName             string        `yaml:"company" envconfig:"COMPANY_NAME"`
+		MailFrom                string        `yaml:"mailFrom" envconfig:"MAIL_FROM"`
+		AdminUser               string        `yaml:"adminUser" envconfig:"ADMIN_USER"` // must be an email address
+		AdminPassword           string        `yaml:"adminPass" envconfig:"ADMIN_PASS"`
+		EditableKeys            bool          `yaml:"editableKeys" envconfig:"EDITABLE_KEYS"`
+		CreateDefaultPeer       bool          `yaml:"createDefaultPeer" envconfig:"CREATE_DEFAULT_PEER"`
+		SelfProvisioningAllowed bool          `yaml:"selfProvisioning" envconfig:"SELF_PROVISIONING"`
+		WGExoprterFriendlyNames bool          `yaml:"wgExporterFriendlyNames" envconfig:"WG_EXPORTER_FRIENDLY_NAMES"`
+		LdapEnabled             bool          `yaml:"ldapEnabled" envconfig:"LDAP_ENABLED"`
+		SessionSecret           string        `yaml:"sessionSecret" envconfig:"SESSION_SECRET"`
+		SessionStore            string        `yaml:"sessionStore" envconfig:"SESSION_STORE"`                  // memory, cookie or redis
+		SessionRedisAddress     string        `yaml:"sessionRedisAddress" envconfig:"SESSION_REDIS_ADDRESS"`   // host:port of the redis server
+		SessionRedisPassword    string        `yaml:"sessionRedisPassword" envconfig:"SESSION_REDIS_PASSWORD"` // optional
+		SessionRedisDB          int           `yaml:"sessionRedisDb" envconfig:"SESSION_REDIS_DB"`
+		CsrfTokenLifetime       time.Duration `yaml:"csrfTokenLifetime" envconfig:"CSRF_TOKEN_LIFETIME"` // CSRF tokens are rotated after half of the lifetime, 0 = valid as long as the session
+		LogoUrl                 string        `yaml:"logoUrl" envconfig:"LOGO_URL"`
+		MailTemplateHtml        string        `yaml:"mailTemplateHtml" envconfig:"MAIL_TEMPLATE_HTML"`               // optional, path to a custom HTML mail template
+		MailTemplateText        string        `yaml:"mailTemplateText" envconfig:"MAIL_TEMPLATE_TEXT"`               // optional, path to a custom plain text mail template
+		PageSize                int           `yaml:"pageSize" envconfig:"PAGE_SIZE"`                                // default number of entries per list page
+		MaxPeersPerUser         int           `yaml:"maxPeersPerUser" envconfig:"MAX_PEERS_PER_USER"`                // maximum number of peers per email address, 0 = unlimited
+		LogoutRedirectUrl       string        `yaml:"logoutRedirectUrl" envconfig:"LOGOUT_REDIRECT_URL"`             // optional, users are redirected to this url after logout
+		ShutdownTimeout         time.Duration `yaml:"shutdownTimeout" envconfig:"SHUTDOWN_TIMEOUT"`                  // time to wait for in-flight requests and background workers on shutdown
+		TeardownOnShutdown      bool          `yaml:"teardownOnShutdown" envconfig:"TEARDOWN_ON_SHUTDOWN"`           // bring down the managed interfaces on shutdown
+		DownloadLinkValidity    time.Duration `yaml:"downloadLinkValidity" envconfig:"DOWNLOAD_LINK_VALIDITY"`       // default validity of single-use download links
+		SelfRegistration        bool          `yaml:"selfRegistration" envconfig:"SELF_REGISTRATION"`                // allow users to request an account, admins have to approve the requests
+		RegistrationDefaultPeer bool          `yaml:"registrationDefaultPeer" envconfig:"REGISTRATION_DEFAULT_PEER"` // create a default peer for approved registrations
+		DisableUserPeers        bool          `yaml:"disableUserPeers" envconfig:"DISABLE_USER_PEERS"`               // disable the peers of deactivated users, they are enabled again with the user
+		RequestLogLevel         string        `yaml:"requestLogLevel" envconfig:"REQUEST_LOG_LEVEL"`                 // level of the request log entries, off disables the request log
+		RequestLogSkipPaths     []string      `yaml:"requestLogSkipPaths" envconfig:"REQUEST_LOG_SKIP_PATHS"`        // requests below these path prefixes are not logged, relative to the external url
+		DefaultLanguage         string        `yaml:"defaultLanguage" envconfig:"DEFAULT_LANGUAGE"`                  // language if the browser accepts none of the available languages
+		TranslationsPath        string        `yaml:"translationsPath" envconfig:"TRANSLATIONS_PATH"`                // optional, directory with additional catalogs (<language>.json)
+		LoginLockoutAttempts    int           `yaml:"loginLockoutAttempts" envconfig:"LOGIN_LOCKOUT_ATTEMPTS"`       // failed logins of a username or ip address until it is locked, 0 = no lockout
+		LoginLockoutDuration    time.Duration `yaml:"loginLockoutDuration" envconfig:"LOGIN_LOCKOUT_DURATION"`       // failures within this duration are counted, locked logins are rejected for this duration
+		LoginFailureHistory     int           `yaml:"loginFailureHistory" envconfig:"LOGIN_FAILURE_HISTORY"`         // number of failed logins that are kept for the administrators
+		BackupDirectory         string        `yaml:"backupDirectory" envconfig:"BACKUP_DIRECTORY"`                  // optional, scheduled backups are written to this directory
+		BackupInterval          time.Duration `yaml:"backupInterval" envconfig:"BACKUP_INTERVAL"`                    // time between two scheduled backups
+		BackupRetention         int           `yaml:"backupRetention" envconfig:"BACKUP_RETENTION"`                  // number of scheduled backups that are kept, 0 = all
+		BackupIncludeKeys       bool          `yaml:"backupIncludeKeys" envconfig:"BACKUP_INCLUDE_KEYS"`             // include the keys in scheduled backups, encrypted with the master key
+		UserCacheTTL            time.Duration `yaml:"userCacheTTL" envconfig:"USER_CACHE_TTL"`                       // the validity of the session users is cached for this duration, 0 disables the cache
 	} `yaml:"core"`
-	Database common.DatabaseConfig `yaml:"database"`
-	Email    common.MailConfig     `yaml:"email"`
-	LDAP     ldap.Config           `yaml:"ldap"`
-	WG       wireguard.Config      `yaml:"wg"`
+	Database common.DatabaseConfig  `yaml:"database"`
+	Password users.PasswordPolicy   `yaml:"password"`
+	Email    common.MailConfig      `yaml:"email"`
+	LDAP     ldap.Config            `yaml:"ldap"`
+	OIDC     oidc.Config            `yaml:"oidc"`
+	WG       wireguard.Config       `yaml:"wg"`
+	Webhook  common.WebhookConfig   `yaml:"webhook"`
+	Influx   wireguard.InfluxConfig `yaml:"influx"`
 }
 
 func NewConfig() *Config {
@@ -86,17 +131,41 @@ func NewConfig() *Config {
 	cfg.Core.Title = "WireGuard VPN"
 	cfg.Core.CompanyName = "WireGuard Portal"
 	cfg.Core.LogoUrl = "/img/header-logo.png"
+	cfg.Core.DefaultLanguage = "en"
 	cfg.Core.ExternalUrl = "http://localhost:8123"
 	cfg.Core.MailFrom = "WireGuard VPN <noreply@company.com>"
 	cfg.Core.AdminUser = "admin@wgportal.local"
-	cfg.Core.AdminPassword = "wgportal"
+	cfg.Core.AdminPassword = defaultAdminPassword
 	cfg.Core.LdapEnabled = false
 	cfg.Core.EditableKeys = true
 	cfg.Core.WGExoprterFriendlyNames = false
 	cfg.Core.SessionSecret = "secret"
+	cfg.Core.SessionStore = SessionStoreMemory
+	cfg.Core.CsrfTokenLifetime = 2 * time.Hour
+	cfg.Core.PageSize = 50
+	cfg.Core.ShutdownTimeout = 10 * time.Second
+	cfg.Core.DownloadLinkValidity = 24 * time.Hour
+	cfg.Core.LoginLockoutAttempts = 10
+	cfg.Core.LoginLockoutDuration = 15 * time.Minute
+	cfg.Core.LoginFailureHistory = 200
+	cfg.Core.UserCacheTTL = 30 * time.Second
+	cfg.Core.BackupInterval = 24 * time.Hour
+	cfg.Core.BackupRetention = 7
+	cfg.Core.DisableUserPeers = true
+	cfg.Core.RequestLogLevel = "debug"
+	cfg.Core.RequestLogSkipPaths = []string{"/healthz", "/readyz", "/css/", "/js/", "/img/", "/fonts/"}
+
+	cfg.OIDC.ClockSkew = time.Minute
+	cfg.OIDC.JwksCacheTTL = time.Hour
 
 	cfg.Database.Typ = "sqlite"
 	cfg.Database.Database = "data/wg_portal.db"
+	cfg.Database.MaxOpenConns = 10
+	cfg.Database.MaxIdleConns = 2
+	cfg.Database.ConnMaxLifetime = 5 * time.Minute
+
+	cfg.Password.MinLength = 8
+	cfg.Password.HashCost = 12
 
 	cfg.LDAP.URL = "ldap://srv-ad01.company.local:389"
 	cfg.LDAP.BaseDN = "DC=COMPANY,DC=LOCAL"
@@ -104,6 +173,8 @@ func NewConfig() *Config {
 	cfg.LDAP.BindUser = "company\\\\ldap_wireguard"
 	cfg.LDAP.BindPass = "SuperSecret"
 	cfg.LDAP.EmailAttribute = "mail"
+	cfg.LDAP.UsernameAttribute = "sAMAccountName"
+	cfg.LDAP.DisplayNameAttribute = "displayName"
 	cfg.LDAP.FirstNameAttribute = "givenName"
 	cfg.LDAP.LastNameAttribute = "sn"
 	cfg.LDAP.PhoneAttribute = "telephoneNumber"
@@ -116,11 +187,32 @@ func NewConfig() *Config {
 	cfg.WG.DefaultDeviceName = "wg0"
 	cfg.WG.ConfigDirectoryPath = "/etc/wireguard"
 	cfg.WG.ManageIPAddresses = true
+	cfg.WG.RestoreOnStartup = true
+	cfg.WG.Backend = wireguard.BackendKernel
+	cfg.WG.UserspaceBinary = "wireguard-go"
+	cfg.WG.HookTimeout = 30 * time.Second
+	cfg.WG.DeviceCacheTTL = 2 * time.Second
+	cfg.WG.EndpointCheckInterval = 5 * time.Minute
+	cfg.WG.OnlineHandshakeAge = 3 * time.Minute
+	cfg.WG.IdleHandshakeAge = 15 * time.Minute
+	cfg.WG.StatisticsInterval = time.Minute
+	cfg.WG.StatisticsRetention = 30 * 24 * time.Hour
+	cfg.WG.ConnectionHistoryRetention = 90 * 24 * time.Hour
+	cfg.WG.TrafficDailyRetention = 90 * 24 * time.Hour
+	cfg.WG.PeerDefaults.PersistentKeepalive = 16
 	cfg.Email.Host = "127.0.0.1"
 	cfg.Email.Port = 25
 	cfg.Email.Encryption = common.MailEncryptionNone
 	cfg.Email.AuthType = common.MailAuthPlain
 
+	cfg.Webhook.Timeout = 10 * time.Second
+	cfg.Webhook.MaxRetries = 5
+
+	cfg.Influx.Interval = time.Minute
+	cfg.Influx.Timeout = 10 * time.Second
+	cfg.Influx.BatchSize = 5000
+	cfg.Influx.QueueSize = 50000
+
 	// Load config from file and environment
 	cfgFile, ok := os.LookupEnv("CONFIG_FILE")
 	if !ok {
@@ -139,10 +231,26 @@ func NewConfig() *Config {
 		logrus.Warnf("Parsing AdminLDAPGroup failed: %v", err)
 	}
 
+	if cfg.WG.DefaultEndpointHost == "" {
+		cfg.WG.DefaultEndpointHost = common.HostFromUrl(cfg.Core.ExternalUrl)
+	}
+
+	cfg.WG.PeerDefaults.DNSStr = common.ListToString(common.ParseStringList(cfg.WG.PeerDefaults.DNSStr))
+	cfg.WG.PeerDefaults.AllowedIPsStr = common.ListToString(common.ParseStringList(cfg.WG.PeerDefaults.AllowedIPsStr))
+
+	if cfg.Password.HashCost < bcrypt.MinCost || cfg.Password.HashCost > bcrypt.MaxCost {
+		logrus.Warnf("invalid password hash cost %d, using %d", cfg.Password.HashCost, bcrypt.DefaultCost)
+		cfg.Password.HashCost = bcrypt.DefaultCost
+	}
+
 	if cfg.WG.ManageIPAddresses && runtime.GOOS != "linux" {
 		logrus.Warnf("managing IP addresses only works on linux, feature disabled...")
 		cfg.WG.ManageIPAddresses = false
 	}
+	if cfg.WG.ManageRoutes && runtime.GOOS != "linux" {
+		logrus.Warnf("managing routes only works on linux, feature disabled...")
+		cfg.WG.ManageRoutes = false
+	}
 
 	return cfg
 }
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	csrfFormField         = "_csrf"
+	csrfHeader            = "X-CSRF-TOKEN"
+	csrfSaltKey           = "csrfSalt"
+	csrfIssuedAtKey       = "csrfIssuedAt"
+	csrfPreviousSaltKey   = "csrfPreviousSalt"
+	csrfPreviousIssuedKey = "csrfPreviousIssuedAt"
+	csrfTokenContextKey   = "csrfToken"
+)
+
+// csrfMiddleware checks the CSRF token of all requests that change data. Tokens are derived from a random salt that
+// is stored in the session, so a token is only valid in the session it was issued for. The salt is replaced after
+// half of CSRF_TOKEN_LIFETIME, the tokens of the previous salt stay valid until the lifetime has passed, so forms
+// that are open in other tabs keep working.
+func (s *Server) csrfMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		if !s.csrfTokenValid(sessions.Default(c), csrfRequestToken(c)) {
+			logrus.Debugf("CSRF token check failed for %s %s", c.Request.Method, c.Request.URL.Path)
+			c.Abort()
+			s.GetHandleError(c, http.StatusForbidden, "Form expired",
+				"The form is no longer valid, e.g. because your session has ended. Reload the page and submit it again.")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// csrfToken returns the CSRF token of the current session, it has to be sent with all forms that change data, see
+// the csrfField template function. A new salt is created if the current one is due for rotation.
+func (s *Server) csrfToken(c *gin.Context) string {
+	if token, ok := c.Get(csrfTokenContextKey); ok {
+		return token.(string)
+	}
+
+	session := sessions.Default(c)
+	salt, issuedAt := csrfSessionSalt(session, csrfSaltKey, csrfIssuedAtKey)
+	if salt == "" || s.config.Core.CsrfTokenLifetime > 0 && time.Since(issuedAt) > s.config.Core.CsrfTokenLifetime/2 {
+		salt = s.rotateCsrfSalt(session, salt != "")
+		if err := session.Save(); err != nil {
+			logrus.Errorf("failed to store session: %v", err)
+		}
+	}
+
+	token := s.csrfTokenForSalt(salt)
+	c.Set(csrfTokenContextKey, token)
+
+	return token
+}
+
+// rotateCsrfSalt replaces the salt of the session, the caller has to save the session. If keepPrevious is false, all
+// tokens that were issued before are invalid immediately, e.g. after a login.
+func (s *Server) rotateCsrfSalt(session sessions.Session, keepPrevious bool) string {
+	if keepPrevious {
+		session.Set(csrfPreviousSaltKey, session.Get(csrfSaltKey))
+		session.Set(csrfPreviousIssuedKey, session.Get(csrfIssuedAtKey))
+	} else {
+		session.Delete(csrfPreviousSaltKey)
+		session.Delete(csrfPreviousIssuedKey)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		logrus.Errorf("failed to generate CSRF salt: %v", err)
+	}
+	salt := base64.RawURLEncoding.EncodeToString(raw)
+	session.Set(csrfSaltKey, salt)
+	session.Set(csrfIssuedAtKey, time.Now().Unix())
+
+	return salt
+}
+
+// csrfTokenValid checks the token against the current and the previous salt of the session.
+func (s *Server) csrfTokenValid(session sessions.Session, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	for _, keys := range [][2]string{{csrfSaltKey, csrfIssuedAtKey}, {csrfPreviousSaltKey, csrfPreviousIssuedKey}} {
+		salt, issuedAt := csrfSessionSalt(session, keys[0], keys[1])
+		if salt == "" {
+			continue
+		}
+		if s.config.Core.CsrfTokenLifetime > 0 && time.Since(issuedAt) > s.config.Core.CsrfTokenLifetime {
+			continue // expired
+		}
+		if hmac.Equal([]byte(s.csrfTokenForSalt(salt)), []byte(token)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) csrfTokenForSalt(salt string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.Core.SessionSecret))
+	mac.Write([]byte("csrf-" + salt))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func csrfSessionSalt(session sessions.Session, saltKey, issuedAtKey string) (string, time.Time) {
+	salt, _ := session.Get(saltKey).(string)
+	issuedAt, _ := session.Get(issuedAtKey).(int64)
+
+	return salt, time.Unix(issuedAt, 0)
+}
+
+// csrfRequestToken reads the token from the form or from the header for requests that are sent by scripts. Tokens in
+// the query string are not accepted, urls end up in logs.
+func csrfRequestToken(c *gin.Context) string {
+	if token := c.Request.PostFormValue(csrfFormField); token != "" {
+		return token
+	}
+	return c.GetHeader(csrfHeader)
+}
+
+// csrfField renders the hidden input with the CSRF token, all forms that use POST have to contain it.
+func csrfField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` +
+		template.HTMLEscapeString(token) + `">`)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+)
+
+// csrfTestServer adds routes to issue tokens, to submit forms and to age the salts of the session.
+func csrfTestServer(t *testing.T) (*Server, string) {
+	s := newTestServer(t, map[string]string{"CSRF_TOKEN_LIFETIME": "2h"})
+
+	test := s.server.Group("/test")
+	test.Use(s.csrfMiddleware())
+	test.GET("/token", func(c *gin.Context) {
+		c.String(http.StatusOK, s.csrfToken(c))
+	})
+	test.POST("/submit", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	test.GET("/age", func(c *gin.Context) {
+		age, _ := time.ParseDuration(c.Query("by"))
+		session := sessions.Default(c)
+		session.Set(c.Query("key"), time.Now().Add(-age).Unix())
+		_ = session.Save()
+	})
+	test.GET("/login", func(c *gin.Context) {
+		session := sessions.Default(c)
+		s.rotateCsrfSalt(session, false)
+		_ = session.Save()
+	})
+
+	return s, startTestServer(t, s).URL
+}
+
+func getCsrfToken(t *testing.T, client *http.Client, baseUrl string) string {
+	t.Helper()
+
+	resp, err := client.Get(baseUrl + "/test/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	token, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || len(token) == 0 {
+		t.Fatalf("no token issued: %d", resp.StatusCode)
+	}
+	return string(token)
+}
+
+func visit(t *testing.T, client *http.Client, target string) {
+	t.Helper()
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %d", target, resp.StatusCode)
+	}
+}
+
+func submitWithCsrfToken(t *testing.T, client *http.Client, target, token string) int {
+	t.Helper()
+
+	form := url.Values{}
+	if token != "" {
+		form.Set(csrfFormField, token)
+	}
+	resp, err := client.Post(target, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestCsrfMiddlewareRejectsMissingAndForeignTokens(t *testing.T) {
+	_, baseUrl := csrfTestServer(t)
+	client := newTestClient(t)
+	token := getCsrfToken(t, client, baseUrl)
+
+	if code := submitWithCsrfToken(t, client, baseUrl+"/test/submit", ""); code != http.StatusForbidden {
+		t.Errorf("form without token: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := submitWithCsrfToken(t, client, baseUrl+"/test/submit", token); code != http.StatusOK {
+		t.Errorf("form with token: got %d, want %d", code, http.StatusOK)
+	}
+
+	// the token is bound to the session it was issued for
+	other := newTestClient(t)
+	getCsrfToken(t, other, baseUrl)
+	if code := submitWithCsrfToken(t, other, baseUrl+"/test/submit", token); code != http.StatusForbidden {
+		t.Errorf("token of another session: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	// the token in the query string is not accepted
+	if code := submitWithCsrfToken(t, client, baseUrl+"/test/submit?"+csrfFormField+"="+url.QueryEscape(token),
+		""); code != http.StatusForbidden {
+		t.Errorf("token in the query string: got %d, want %d", code, http.StatusForbidden)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, baseUrl+"/test/submit", nil)
+	req.Header.Set(csrfHeader, token)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("token in the header: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestCsrfTokenRotation(t *testing.T) {
+	_, baseUrl := csrfTestServer(t)
+	client := newTestClient(t)
+	submit := baseUrl + "/test/submit"
+
+	oldToken := getCsrfToken(t, client, baseUrl)
+	if token := getCsrfToken(t, client, baseUrl); token != oldToken {
+		t.Fatal("token rotated before half of the lifetime")
+	}
+
+	// after half of the lifetime a new salt is issued, forms with the previous token keep working
+	visit(t, client, baseUrl+"/test/age?key="+csrfIssuedAtKey+"&by=61m")
+	newToken := getCsrfToken(t, client, baseUrl)
+	if newToken == oldToken {
+		t.Fatal("token not rotated after half of the lifetime")
+	}
+	if code := submitWithCsrfToken(t, client, submit, oldToken); code != http.StatusOK {
+		t.Errorf("previous token within the lifetime: got %d, want %d", code, http.StatusOK)
+	}
+	if code := submitWithCsrfToken(t, client, submit, newToken); code != http.StatusOK {
+		t.Errorf("current token: got %d, want %d", code, http.StatusOK)
+	}
+
+	// the previous salt expires after the full lifetime
+	visit(t, client, baseUrl+"/test/age?key="+csrfPreviousIssuedKey+"&by=121m")
+	if code := submitWithCsrfToken(t, client, submit, oldToken); code != http.StatusForbidden {
+		t.Errorf("expired previous token: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := submitWithCsrfToken(t, client, submit, newToken); code != http.StatusOK {
+		t.Errorf("current token after the previous expired: got %d, want %d", code, http.StatusOK)
+	}
+
+	// a login replaces the salt without keeping the previous one
+	visit(t, client, baseUrl+"/test/login")
+	if code := submitWithCsrfToken(t, client, submit, newToken); code != http.StatusForbidden {
+		t.Errorf("token issued before the login: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := submitWithCsrfToken(t, client, submit, getCsrfToken(t, client, baseUrl)); code != http.StatusOK {
+		t.Errorf("token issued after the login: got %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestCsrfProtectsPortalForms(t *testing.T) {
+	s, baseUrl := csrfTestServer(t)
+	client := newTestClient(t)
+	token := getCsrfToken(t, client, baseUrl)
+
+	for _, path := range []string{"/auth/logout", "/user/theme", "/user/impersonate/stop", "/admin/peer/delete"} {
+		if code := submitWithCsrfToken(t, client, baseUrl+s.urlPath(path), ""); code != http.StatusForbidden {
+			t.Errorf("%s without token: got %d, want %d", path, code, http.StatusForbidden)
+		}
+	}
+	// with a valid token the request reaches the handler, logout redirects sessions that are not logged in
+	if code := submitWithCsrfToken(t, client, baseUrl+s.urlPath("/auth/logout"), token); code != http.StatusSeeOther {
+		t.Errorf("/auth/logout with token: got %d, want %d", code, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,237 @@
+//go:build integration
+// +build integration
+
+package server
+
+// The integration tests run the managers against MySQL and PostgreSQL. They are only built with the integration tag
+// and use the databases of WG_PORTAL_TEST_MYSQL_DSN and WG_PORTAL_TEST_POSTGRES_DSN, a database without DSN is
+// skipped. For example:
+//
+//	docker run -d --rm -p 3306:3306 -e MYSQL_ROOT_PASSWORD=secret -e MYSQL_DATABASE=wgportal mysql:8
+//	docker run -d --rm -p 5432:5432 -e POSTGRES_PASSWORD=secret -e POSTGRES_DB=wgportal postgres:14
+//	WG_PORTAL_TEST_MYSQL_DSN="root:secret@tcp(localhost:3306)/wgportal?charset=utf8mb4&parseTime=True&clientFoundRows=true" \
+//	WG_PORTAL_TEST_POSTGRES_DSN="host=localhost user=postgres password=secret dbname=wgportal sslmode=disable" \
+//	go test -tags integration -run Database ./internal/server/
+//
+// All tables of the databases are dropped before and after the tests, never use a database that is in use.
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/users"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+var integrationDatabases = map[common.SupportedDatabase]string{
+	common.SupportedDatabaseMySQL:    "WG_PORTAL_TEST_MYSQL_DSN",
+	common.SupportedDatabasePostgres: "WG_PORTAL_TEST_POSTGRES_DSN",
+}
+
+// forEachIntegrationDatabase runs the test with a server for every configured database, the database is empty at
+// the start of the test.
+func forEachIntegrationDatabase(t *testing.T, test func(t *testing.T, s *Server)) {
+	for typ, variable := range integrationDatabases {
+		typ, dsn := typ, os.Getenv(variable)
+		t.Run(string(typ), func(t *testing.T) {
+			if dsn == "" {
+				t.Skipf("%s is not set", variable)
+			}
+			cfg := &common.DatabaseConfig{Typ: typ, DSN: dsn}
+			db, err := common.GetDatabaseForConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dropAllTables(t, db, typ)
+			t.Cleanup(func() {
+				dropAllTables(t, db, typ)
+				if sqlDB, err := db.DB(); err == nil {
+					_ = sqlDB.Close()
+				}
+			})
+
+			test(t, newTestServer(t, map[string]string{"DATABASE_TYPE": string(typ), "DATABASE_DSN": dsn}))
+		})
+	}
+}
+
+func dropAllTables(t *testing.T, db *gorm.DB, typ common.SupportedDatabase) {
+	t.Helper()
+
+	query := "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE()"
+	if typ == common.SupportedDatabasePostgres {
+		query = "SELECT tablename FROM pg_tables WHERE schemaname = current_schema()"
+	}
+	var tables []string
+	if err := db.Raw(query).Scan(&tables).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if err := db.Migrator().DropTable(table); err != nil {
+			t.Fatalf("failed to drop %s: %v", table, err)
+		}
+	}
+}
+
+func TestDatabaseMigrations(t *testing.T) {
+	forEachIntegrationDatabase(t, func(t *testing.T, s *Server) {
+		version, err := common.SchemaVersion(s.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != common.LatestSchemaVersion() {
+			t.Errorf("schema version %d, want %d", version, common.LatestSchemaVersion())
+		}
+		result, err := common.MigrateDatabase(s.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Applied) != 0 {
+			t.Errorf("second run applied %d migrations", len(result.Applied))
+		}
+	})
+}
+
+func TestDatabaseUserManager(t *testing.T) {
+	forEachIntegrationDatabase(t, func(t *testing.T, s *Server) {
+		for i := 0; i < 5; i++ {
+			user := &users.User{Email: fmt.Sprintf("User%d@Example.org", i), Firstname: "Same", Lastname: "Name"}
+			if err := s.users.CreateUser(user); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if user := s.users.GetUser("user3@example.org"); user == nil || user.Email != "user3@example.org" {
+			t.Fatalf("user not found by its lower case email: %+v", user)
+		}
+
+		// equal sort values need a tie breaker, otherwise pages overlap
+		seen := make(map[string]bool)
+		for page := 1; page <= 3; page++ {
+			pageUsers, total := s.users.GetUsersPage("firstname", "asc", "", page, 2)
+			if total != 5 {
+				t.Fatalf("total %d, want 5", total)
+			}
+			for _, user := range pageUsers {
+				if seen[user.Email] {
+					t.Errorf("%s is listed on more than one page", user.Email)
+				}
+				seen[user.Email] = true
+			}
+		}
+		if len(seen) != 5 {
+			t.Errorf("%d users listed, want 5", len(seen))
+		}
+
+		if found, _ := s.users.GetUsersPage("email", "asc", "USER1", 1, 10); len(found) != 1 {
+			t.Errorf("search found %d users, want 1", len(found))
+		}
+		if found, _ := s.users.GetUsersPage("email", "asc", "50%", 1, 10); len(found) != 0 {
+			t.Errorf("search with wildcard characters found %d users, want 0", len(found))
+		}
+	})
+}
+
+func TestDatabasePeerManager(t *testing.T) {
+	forEachIntegrationDatabase(t, func(t *testing.T, s *Server) {
+		if err := s.peers.UpdateDevice(wireguard.Device{DeviceName: "wg0", Type: wireguard.DeviceTypeServer,
+			IPsStr: "10.0.0.1/24"}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5; i++ {
+			key, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			peer := wireguard.Peer{PublicKey: key.PublicKey().String(), DeviceName: "wg0", Identifier: "Laptop",
+				Email: fmt.Sprintf("user%d@example.org", i%2), IPsStr: fmt.Sprintf("10.0.0.%d/32", i+2)}
+			if err := s.peers.CreatePeer(peer); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !s.peers.IdentifierExistsForMail("wg0", "user0@example.org", "laptop", "") {
+			t.Error("the identifier is not found case-insensitive")
+		}
+		if duplicates := s.peers.GetDuplicateIdentifiers("wg0"); !duplicates["laptop"] {
+			t.Errorf("duplicate identifiers not found: %v", duplicates)
+		}
+
+		seen := make(map[string]bool)
+		for page := 1; page <= 3; page++ {
+			peers, total := s.peers.GetPeersPage("wg0", wireguard.PeerListOptions{SortKey: "id", Page: page,
+				PageSize: 2})
+			if total != 5 {
+				t.Fatalf("total %d, want 5", total)
+			}
+			for _, peer := range peers {
+				if seen[peer.PublicKey] {
+					t.Errorf("%s is listed on more than one page", peer.PublicKey)
+				}
+				seen[peer.PublicKey] = true
+			}
+		}
+		if len(seen) != 5 {
+			t.Errorf("%d peers listed, want 5", len(seen))
+		}
+	})
+}
+
+func TestDatabaseUpdatesReportMatchedRows(t *testing.T) {
+	forEachIntegrationDatabase(t, func(t *testing.T, s *Server) {
+		user := &users.User{Email: "user@example.org", Firstname: "Unchanged"}
+		if err := s.users.CreateUser(user); err != nil {
+			t.Fatal(err)
+		}
+
+		// the traffic buckets and the single-use links rely on the matched rows of updates
+		res := s.db.Model(&users.User{}).Where("email = ?", user.Email).Update("firstname", "Unchanged")
+		if res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		if res.RowsAffected != 1 {
+			t.Errorf("an update without changes reported %d rows, want 1", res.RowsAffected)
+		}
+	})
+}
+
+func TestDatabaseDownloadLinksAndApiTokens(t *testing.T) {
+	forEachIntegrationDatabase(t, func(t *testing.T, s *Server) {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := wireguard.Peer{PublicKey: key.PublicKey().String(), DeviceName: "wg0", Identifier: "phone",
+			Email: "user@example.org", PrivateKey: key.String()}
+		if err := s.peers.CreatePeer(peer); err != nil {
+			t.Fatal(err)
+		}
+
+		token, _, err := s.CreateDownloadLink(peer, time.Hour, "admin@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RedeemDownloadLink(token, "192.0.2.1"); err != nil {
+			t.Fatalf("first download failed: %v", err)
+		}
+		if _, err := s.RedeemDownloadLink(token, "192.0.2.1"); !errors.Is(err, errDownloadLinkUsed) {
+			t.Errorf("second download: got %v, want %v", err, errDownloadLinkUsed)
+		}
+
+		if err := s.users.CreateUser(&users.User{Email: "user@example.org", Firstname: "User"}); err != nil {
+			t.Fatal(err)
+		}
+		apiToken, _, err := s.CreateApiToken("user@example.org", "integration", ApiTokenScopeUser)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user, _, err := s.authenticateApiToken(apiToken); err != nil || user.Email != "user@example.org" {
+			t.Errorf("token not accepted: %v", err)
+		}
+	})
+}
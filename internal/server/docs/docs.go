@@ -30,11 +30,160 @@ var doc = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/backend/backup": {
+            "get": {
+                "security": [
+                    {
+                        "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
+                    }
+                ],
+                "description": "The archive is a gzip compressed JSON document. Keys are only included if a master key is configured, encrypted with it.",
+                "produces": [
+                    "application/gzip"
+                ],
+                "tags": [
+                    "Backup"
+                ],
+                "summary": "Creates a backup of the users, devices and peers and returns the archive",
+                "operationId": "GetBackup",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Include the private and preshared keys",
+                        "name": "Keys",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Backup archive",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    }
+                }
+            }
+        },
+        "/backend/backup/restore": {
+            "post": {
+                "security": [
+                    {
+                        "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
+                    }
+                ],
+                "description": "The backup is restored in a single transaction and the restored devices are applied afterwards. Existing entries are kept unless Overwrite is set, the result lists all conflicts. Unless it is a dry run, Confirm must be \"restore\".",
+                "consumes": [
+                    "application/gzip"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Backup"
+                ],
+                "summary": "Restores a backup archive",
+                "operationId": "PostBackupRestore",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "Only report what would be restored",
+                        "name": "DryRun",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Replace existing entries with the entries of the backup",
+                        "name": "Overwrite",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Must be restore, unless it is a dry run",
+                        "name": "Confirm",
+                        "in": "query"
+                    },
+                    {
+                        "description": "Backup archive",
+                        "name": "Archive",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/server.BackupRestoreResult"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "422": {
+                        "description": "Unprocessable Entity",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    }
+                }
+            }
+        },
         "/backend/device": {
             "get": {
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -91,6 +240,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -165,6 +317,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -234,6 +389,82 @@ var doc = `{
                         }
                     }
                 }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
+                    }
+                ],
+                "description": "Peers is the number of peers that will be deleted, the request fails if the device has a different number of peers.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Interface"
+                ],
+                "summary": "Deletes the given device and all its peers",
+                "operationId": "DeleteDevice",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Device Name",
+                        "name": "DeviceName",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of peers of the device",
+                        "name": "Peers",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    }
+                }
             }
         },
         "/backend/devices": {
@@ -241,6 +472,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -293,6 +527,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -343,6 +580,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -417,6 +657,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -476,6 +719,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -552,6 +798,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -569,6 +818,52 @@ var doc = `{
                         "name": "DeviceName",
                         "in": "query",
                         "required": true
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "csv",
+                        "description": "Only peers with all of these tags, repeated or comma separated",
+                        "name": "Tag",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only peers whose identifier, description, public key, ip addresses or email contain the search",
+                        "name": "Search",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "enabled, disabled, neverconnected or guest",
+                        "name": "Filter",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sort key: id, pubKey, mail, ip, endpoint or handshake",
+                        "name": "Sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "asc or desc",
+                        "name": "SortDirection",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page number, starting at 1",
+                        "name": "Page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of peers per page, all peers if unset",
+                        "name": "PageSize",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -579,6 +874,18 @@ var doc = `{
                             "items": {
                                 "$ref": "#/definitions/wireguard.Peer"
                             }
+                        },
+                        "headers": {
+                            "X-Total-Count": {
+                                "type": "integer",
+                                "description": "Number of peers matching the filters"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
                         }
                     },
                     "401": {
@@ -605,8 +912,12 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
+                "description": "Without PrivateKey, the peer is a public key only peer: the key pair was generated on the client and the portal never generates or stores a private key for it. Its configuration contains a placeholder for the private key.",
                 "consumes": [
                     "application/json"
                 ],
@@ -681,6 +992,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -737,6 +1051,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -811,6 +1128,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -870,6 +1190,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -946,6 +1269,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -956,6 +1282,38 @@ var doc = `{
                 ],
                 "summary": "Retrieves all users",
                 "operationId": "GetUsers",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Only users whose email, name, phone or peer public key contain the search",
+                        "name": "Search",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Sort key: email, firstname, lastname, phone, source or admin",
+                        "name": "Sort",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "asc or desc",
+                        "name": "SortDirection",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Page number, starting at 1",
+                        "name": "Page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Number of users per page, all users if unset",
+                        "name": "PageSize",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
@@ -964,6 +1322,18 @@ var doc = `{
                             "items": {
                                 "$ref": "#/definitions/users.User"
                             }
+                        },
+                        "headers": {
+                            "X-Total-Count": {
+                                "type": "integer",
+                                "description": "Number of users matching the search"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
                         }
                     },
                     "401": {
@@ -990,6 +1360,9 @@ var doc = `{
                 "security": [
                     {
                         "ApiBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -1054,11 +1427,90 @@ var doc = `{
                 }
             }
         },
+        "/provisioning/enroll": {
+            "post": {
+                "security": [
+                    {
+                        "ApiTokenAuth": []
+                    }
+                ],
+                "description": "Requires an API token with the provisioning scope. Repeated requests for the same user, interface and client device return the same peer.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Provisioning"
+                ],
+                "summary": "Returns the peer config of the client device of a user, the peer is created if it does not exist yet",
+                "operationId": "PostPeerEnrollment",
+                "parameters": [
+                    {
+                        "description": "Enrollment Request Model",
+                        "name": "EnrollmentRequest",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/server.EnrollmentRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "The existing peer",
+                        "schema": {
+                            "$ref": "#/definitions/server.EnrollmentResponse"
+                        }
+                    },
+                    "201": {
+                        "description": "The created peer",
+                        "schema": {
+                            "$ref": "#/definitions/server.EnrollmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    }
+                }
+            }
+        },
         "/provisioning/peer": {
             "get": {
                 "security": [
                     {
                         "GeneralBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -1104,6 +1556,68 @@ var doc = `{
                         }
                     }
                 }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "GeneralBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
+                    }
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Provisioning"
+                ],
+                "summary": "Deletes the peer for the given public key",
+                "operationId": "DeletePeerDeployment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Public Key (Base 64)",
+                        "name": "PublicKey",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "No Content"
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/server.ApiError"
+                        }
+                    }
+                }
             }
         },
         "/provisioning/peers": {
@@ -1111,6 +1625,9 @@ var doc = `{
                 "security": [
                     {
                         "GeneralBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "produces": [
@@ -1164,6 +1681,9 @@ var doc = `{
                 "security": [
                     {
                         "GeneralBasicAuth": []
+                    },
+                    {
+                        "ApiTokenAuth": []
                     }
                 ],
                 "consumes": [
@@ -1226,6 +1746,116 @@ var doc = `{
                 }
             }
         },
+        "server.BackupConflict": {
+            "type": "object",
+            "properties": {
+                "Key": {
+                    "type": "string"
+                },
+                "Kind": {
+                    "type": "string"
+                },
+                "Reason": {
+                    "type": "string"
+                },
+                "Resolution": {
+                    "type": "string"
+                }
+            }
+        },
+        "server.BackupRestoreResult": {
+            "type": "object",
+            "properties": {
+                "Conflicts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/server.BackupConflict"
+                    }
+                },
+                "DryRun": {
+                    "type": "boolean"
+                },
+                "GeneratedKeys": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "Overwrite": {
+                    "type": "boolean"
+                },
+                "Reapplied": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "ReapplyErrors": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "Restored": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "server.EnrollmentRequest": {
+            "type": "object",
+            "required": [
+                "ClientDevice",
+                "Email"
+            ],
+            "properties": {
+                "ClientDevice": {
+                    "description": "ClientDevice names the device of the user, e.g. its hostname. Together with the email and the interface it\nidentifies the peer, so that repeated requests return the same peer.",
+                    "type": "string"
+                },
+                "DeviceName": {
+                    "description": "DeviceName is optional, if not specified, the configured default device will be used.",
+                    "type": "string"
+                },
+                "Email": {
+                    "type": "string"
+                }
+            }
+        },
+        "server.EnrollmentResponse": {
+            "type": "object",
+            "properties": {
+                "Config": {
+                    "description": "the WireGuard configuration file",
+                    "type": "string"
+                },
+                "Created": {
+                    "description": "false if the peer already existed",
+                    "type": "boolean"
+                },
+                "Device": {
+                    "type": "string"
+                },
+                "Disabled": {
+                    "description": "the peer exists but has been disabled, the configuration does not work until it is enabled",
+                    "type": "boolean"
+                },
+                "IPs": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "Identifier": {
+                    "type": "string"
+                },
+                "PublicKey": {
+                    "type": "string"
+                }
+            }
+        },
         "server.PeerDeploymentInformation": {
             "type": "object",
             "properties": {
@@ -1425,6 +2055,10 @@ var doc = `{
                     "description": "a comma separated list of IPs that are used in the client config file",
                     "type": "string"
                 },
+                "ConnectionState": {
+                    "description": "online, idle or offline, only set with the live data of the interface",
+                    "type": "string"
+                },
                 "CreatedAt": {
                     "type": "string"
                 },
@@ -1498,6 +2132,12 @@ var doc = `{
         },
         "GeneralBasicAuth": {
             "type": "basic"
+        },
+        "ApiTokenAuth": {
+            "description": "An API token of the user profile, sent as \"Bearer <token>\"",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	downloadLinkRateLimit  = 10 // requests per source ip address and window
+	downloadLinkRateWindow = 15 * time.Minute
+	minDownloadLinkTTL     = time.Hour
+	maxDownloadLinkTTL     = 30 * 24 * time.Hour
+	downloadLinkSeparator  = "|" // separates the fields of the token payload, it is not part of base64 keys
+)
+
+var (
+	errDownloadLinkInvalid = errors.New("the link is invalid")
+	errDownloadLinkExpired = errors.New("the link has expired")
+	errDownloadLinkUsed    = errors.New("the link has already been used")
+	errDownloadLinkRevoked = errors.New("the link has been revoked")
+)
+
+// DownloadLink is a single-use link to the configuration of a peer. The token of the link contains the peer and the
+// expiry date and is signed with the session secret. Only a keyed hash of the token is stored, the token itself is
+// shown once when the link is created.
+type DownloadLink struct {
+	ID        uint   `gorm:"primaryKey"`
+	TokenHash string `gorm:"uniqueIndex;size:64"`
+	PeerKey   string `gorm:"index"`
+	CreatedAt time.Time
+	CreatedBy string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	UsedFrom  string // source ip address of the request that redeemed the link
+	RevokedAt *time.Time
+	RevokedBy string
+}
+
+// downloadLinkClaims are the signed contents of a download link token.
+type downloadLinkClaims struct {
+	PeerKey   string
+	ExpiresAt time.Time
+}
+
+// newDownloadLinkToken creates a token that contains the peer and the expiry date, signed with the session secret. A
+// random nonce makes each token unique, even for links of the same peer with the same expiry date.
+func (s *Server) newDownloadLinkToken(claims downloadLinkClaims) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate token")
+	}
+	payload := strings.Join([]string{claims.PeerKey, strconv.FormatInt(claims.ExpiresAt.Unix(), 10),
+		base64.RawURLEncoding.EncodeToString(nonce)}, downloadLinkSeparator)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + s.signDownloadLinkPayload(payload), nil
+}
+
+// parseDownloadLinkToken verifies the signature of the token and returns its contents.
+func (s *Server) parseDownloadLinkToken(token string) (downloadLinkClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return downloadLinkClaims{}, errDownloadLinkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return downloadLinkClaims{}, errDownloadLinkInvalid
+	}
+	if !hmac.Equal([]byte(s.signDownloadLinkPayload(string(payload))), []byte(parts[1])) {
+		return downloadLinkClaims{}, errDownloadLinkInvalid
+	}
+
+	fields := strings.Split(string(payload), downloadLinkSeparator)
+	if len(fields) != 3 {
+		return downloadLinkClaims{}, errDownloadLinkInvalid
+	}
+	expiresAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return downloadLinkClaims{}, errDownloadLinkInvalid
+	}
+
+	return downloadLinkClaims{PeerKey: fields[0], ExpiresAt: time.Unix(expiresAt, 0)}, nil
+}
+
+func (s *Server) signDownloadLinkPayload(payload string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.Core.SessionSecret))
+	mac.Write([]byte("download-link-" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hashDownloadLinkToken signs the token with the session secret, a leaked database alone does not allow to forge or
+// redeem links.
+func (s *Server) hashDownloadLinkToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.Core.SessionSecret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CreateDownloadLink creates a new single-use link for the given peer. The returned token is only available here.
+func (s *Server) CreateDownloadLink(peer wireguard.Peer, validity time.Duration, actor string) (string, DownloadLink, error) {
+	if validity < minDownloadLinkTTL || validity > maxDownloadLinkTTL {
+		return "", DownloadLink{}, errors.Errorf("the validity must be between 1 hour and %d days",
+			int(maxDownloadLinkTTL.Hours()/24))
+	}
+	if s.peers.GetDevice(peer.DeviceName).Type != wireguard.DeviceTypeServer {
+		return "", DownloadLink{}, errors.New("download links are only available for peers of server mode interfaces")
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(validity).Truncate(time.Second) // the token contains the expiry date in seconds
+	token, err := s.newDownloadLinkToken(downloadLinkClaims{PeerKey: peer.PublicKey, ExpiresAt: expiresAt})
+	if err != nil {
+		return "", DownloadLink{}, err
+	}
+
+	link := DownloadLink{
+		TokenHash: s.hashDownloadLinkToken(token),
+		PeerKey:   peer.PublicKey,
+		CreatedAt: now,
+		CreatedBy: actor,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.db.Create(&link).Error; err != nil {
+		return "", DownloadLink{}, errors.Wrap(err, "failed to store download link")
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "link.created", Interface: peer.DeviceName,
+		Target: peer.PublicKey, Details: fmt.Sprintf("download link %d for %s, valid until %s", link.ID,
+			peer.Identifier, link.ExpiresAt.Format(time.RFC3339))})
+
+	return token, link, nil
+}
+
+// GetDownloadLinks returns the links of the given peer that can still be redeemed.
+func (s *Server) GetDownloadLinks(peerKey string) []DownloadLink {
+	links := make([]DownloadLink, 0)
+	s.db.Where("peer_key = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", peerKey, time.Now()).
+		Order("created_at").Find(&links)
+
+	return links
+}
+
+// RevokeDownloadLink invalidates an unused link.
+func (s *Server) RevokeDownloadLink(id uint, actor string) (DownloadLink, error) {
+	var link DownloadLink
+	if err := s.db.First(&link, id).Error; err != nil {
+		return link, errDownloadLinkInvalid
+	}
+
+	now := time.Now()
+	res := s.db.Model(&DownloadLink{}).Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", id).
+		Updates(map[string]interface{}{"revoked_at": now, "revoked_by": actor})
+	if res.Error != nil {
+		return link, errors.Wrap(res.Error, "failed to revoke download link")
+	}
+	if res.RowsAffected == 0 {
+		return link, errors.New("the link was already used or revoked")
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "link.revoked", Target: link.PeerKey,
+		Details: fmt.Sprintf("download link %d", link.ID)})
+
+	return link, nil
+}
+
+// RedeemDownloadLink marks the link of the token as used and returns its peer. Forged and expired tokens are rejected
+// before the database is queried, the stored link decides whether the token was already used or revoked. The update
+// is conditional, so that concurrent requests with the same token cannot both succeed. Tokens without signature were
+// created by older versions, they are only checked against the database.
+func (s *Server) RedeemDownloadLink(token, sourceIP string) (wireguard.Peer, error) {
+	var claims *downloadLinkClaims
+	if strings.Contains(token, ".") {
+		parsed, err := s.parseDownloadLinkToken(token)
+		if err != nil {
+			return wireguard.Peer{}, err
+		}
+		if !time.Now().Before(parsed.ExpiresAt) {
+			return wireguard.Peer{}, errDownloadLinkExpired
+		}
+		claims = &parsed
+	}
+
+	var link DownloadLink
+	err := s.db.Where("token_hash = ?", s.hashDownloadLinkToken(token)).First(&link).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return wireguard.Peer{}, errDownloadLinkInvalid
+	case err != nil:
+		return wireguard.Peer{}, errors.Wrap(err, "failed to load download link")
+	case claims != nil && claims.PeerKey != link.PeerKey:
+		return wireguard.Peer{}, errDownloadLinkInvalid
+	case link.RevokedAt != nil:
+		return wireguard.Peer{}, errDownloadLinkRevoked
+	case link.UsedAt != nil:
+		return wireguard.Peer{}, errDownloadLinkUsed
+	case !time.Now().Before(link.ExpiresAt):
+		return wireguard.Peer{}, errDownloadLinkExpired
+	}
+
+	peer := s.peers.GetPeerByKey(link.PeerKey)
+	if !peer.IsValid() {
+		return wireguard.Peer{}, errDownloadLinkInvalid
+	}
+
+	now := time.Now()
+	res := s.db.Model(&DownloadLink{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", link.ID, now).
+		Updates(map[string]interface{}{"used_at": now, "used_from": sourceIP})
+	if res.Error != nil {
+		return wireguard.Peer{}, errors.Wrap(res.Error, "failed to redeem download link")
+	}
+	if res.RowsAffected == 0 {
+		return wireguard.Peer{}, errDownloadLinkUsed
+	}
+	s.audit.Record(common.AuditEntry{Actor: "download-link", Action: "link.used", Interface: peer.DeviceName,
+		Target: peer.PublicKey, Details: fmt.Sprintf("download link %d of %s redeemed from %s", link.ID,
+			peer.Identifier, sourceIP)})
+
+	return peer, nil
+}
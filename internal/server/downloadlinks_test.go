@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/wireguard"
+)
+
+func TestCreateDownloadLinkValidity(t *testing.T) {
+	s := newTestServer(t, nil)
+	if err := s.peers.UpdateDevice(wireguard.Device{DeviceName: "wg0", Type: wireguard.DeviceTypeServer,
+		IPsStr: "10.0.0.1/24"}); err != nil {
+		t.Fatal(err)
+	}
+	peer := createTestPeer(t, s, "10.0.0.2")
+
+	for validity, valid := range map[time.Duration]bool{
+		0:                   false,
+		30 * time.Minute:    false,
+		time.Hour:           true,
+		30 * 24 * time.Hour: true,
+		31 * 24 * time.Hour: false,
+	} {
+		_, _, err := s.CreateDownloadLink(peer, validity, "admin@example.org")
+		if valid && err != nil {
+			t.Errorf("validity %s: %v", validity, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("validity %s was accepted", validity)
+		}
+	}
+}
+
+// getWithForwardedFor requests the page with the X-Forwarded-For header and returns the status code.
+func getWithForwardedFor(t *testing.T, target, forwarded string) int {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("X-Forwarded-For", forwarded)
+	resp, err := newTestClient(t).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDownloadLinkRateLimitIgnoresForgedForwardedFor(t *testing.T) {
+	s := newTestServer(t, nil)
+	baseUrl := startTestServer(t, s).URL
+
+	for i := 0; i < downloadLinkRateLimit; i++ {
+		code := getWithForwardedFor(t, baseUrl+"/p/guessed", fmt.Sprintf("198.51.100.%d", i+1))
+		if code != http.StatusNotFound {
+			t.Fatalf("request %d: got %d, want %d", i+1, code, http.StatusNotFound)
+		}
+	}
+	if code := getWithForwardedFor(t, baseUrl+"/p/guessed", "198.51.100.99"); code != http.StatusTooManyRequests {
+		t.Errorf("a new forged address reset the limit: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestDownloadLinkStoresConnectionAddress(t *testing.T) {
+	s := newTestServer(t, nil)
+	baseUrl := startTestServer(t, s).URL
+	if err := s.peers.UpdateDevice(wireguard.Device{DeviceName: "wg0", Type: wireguard.DeviceTypeServer,
+		IPsStr: "10.0.0.1/24"}); err != nil {
+		t.Fatal(err)
+	}
+	peer := createTestPeer(t, s, "10.0.0.2")
+
+	token, link, err := s.CreateDownloadLink(peer, time.Hour, "admin@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := getWithForwardedFor(t, baseUrl+"/p/"+token, "198.51.100.7"); code != http.StatusOK {
+		t.Fatalf("redeem: got %d, want %d", code, http.StatusOK)
+	}
+	if err := s.db.First(&link, link.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if link.UsedFrom != "127.0.0.1" {
+		t.Errorf("the link was redeemed from %q, want the address of the connection", link.UsedFrom)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// EndpointCheckResult is the result of the DNS resolution of a host name endpoint.
+type EndpointCheckResult struct {
+	Endpoint  string
+	Addresses []string `json:",omitempty"`
+	Error     string   `json:",omitempty"`
+	CheckedAt time.Time
+}
+
+// endpointCheckCache holds the results of the last run of CheckEndpoints.
+type endpointCheckCache struct {
+	mux     sync.RWMutex
+	results map[string]EndpointCheckResult // by endpoint
+	devices map[string][]string            // host name endpoints by interface name
+}
+
+// GetEndpointFailures returns the host name endpoints of the interface that could not be resolved by the last check.
+// No DNS lookups are done, the results are cached until the next run of the periodic check.
+func (s *Server) GetEndpointFailures(device string) []EndpointCheckResult {
+	if s.endpointChecks == nil {
+		return nil
+	}
+	s.endpointChecks.mux.RLock()
+	defer s.endpointChecks.mux.RUnlock()
+
+	var failures []EndpointCheckResult
+	for _, endpoint := range s.endpointChecks.devices[device] {
+		if result := s.endpointChecks.results[endpoint]; result.Error != "" {
+			failures = append(failures, result)
+		}
+	}
+	return failures
+}
+
+// RunEndpointChecks periodically resolves the host name endpoints of all interfaces until the given context is
+// cancelled.
+func (s *Server) RunEndpointChecks(ctx context.Context) {
+	ticker := time.NewTicker(s.config.WG.EndpointCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.CheckEndpoints()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckEndpoints resolves the host name endpoints of all enabled interfaces, each host name is resolved once per run.
+// If WG_RESOLVE_PEER_ENDPOINTS is set, peers whose host name resolves to a new address are updated on the interfaces.
+func (s *Server) CheckEndpoints() {
+	s.endpointChecks.mux.RLock()
+	previous := s.endpointChecks.results
+	s.endpointChecks.mux.RUnlock()
+
+	results := make(map[string]EndpointCheckResult)
+	devices := make(map[string][]string)
+	for _, deviceName := range s.config.WG.DeviceNames {
+		dev := s.peers.GetDevice(deviceName)
+		if dev.DisabledAt != nil {
+			continue
+		}
+
+		peers := s.peers.GetActivePeers(deviceName)
+		endpoints := hostnameEndpoints(dev, peers)
+		for _, endpoint := range endpoints {
+			if _, ok := results[endpoint]; ok {
+				continue
+			}
+			result := resolveEndpoint(endpoint)
+			if result.Error != "" && previous[endpoint].Error == "" {
+				logrus.Warnf("endpoint %s of interface %s cannot be resolved: %s", endpoint, deviceName, result.Error)
+			}
+			results[endpoint] = result
+		}
+		devices[deviceName] = endpoints
+
+		if s.config.WG.ResolvePeerEndpoints && !s.wg.IsExternalDevice(deviceName) {
+			s.updatePeerEndpoints(dev, peers, results)
+		}
+	}
+
+	s.endpointChecks.mux.Lock()
+	s.endpointChecks.results = results
+	s.endpointChecks.devices = devices
+	s.endpointChecks.mux.Unlock()
+}
+
+// hostnameEndpoints returns the endpoints with a host name that the interface depends on: the public endpoint of a
+// server mode interface and the endpoints of the peers that are configured on the interface.
+func hostnameEndpoints(dev wireguard.Device, peers []wireguard.Peer) []string {
+	var candidates []string
+	if dev.Type == wireguard.DeviceTypeServer {
+		candidates = append(candidates, dev.ResolvedEndpoint)
+	}
+	for _, peer := range peers {
+		candidates = append(candidates, interfaceEndpoint(dev, peer))
+	}
+
+	endpoints := make([]string, 0)
+	for _, endpoint := range candidates {
+		if common.EndpointHostname(endpoint) != "" && !common.ListContains(endpoints, endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
+
+// interfaceEndpoint returns the endpoint of the peer that is configured on the interface, see Peer.GetConfig.
+func interfaceEndpoint(dev wireguard.Device, peer wireguard.Peer) string {
+	if peer.SiteEndpoint != "" {
+		return peer.SiteEndpoint
+	}
+	if dev.Type == wireguard.DeviceTypeClient {
+		return peer.Endpoint
+	}
+	return ""
+}
+
+func resolveEndpoint(endpoint string) EndpointCheckResult {
+	result := EndpointCheckResult{Endpoint: endpoint, CheckedAt: time.Now()}
+	ips, err := common.ResolveHost(common.EndpointHostname(endpoint))
+	if err == nil && len(ips) == 0 {
+		result.Error = "no addresses found"
+	} else if err != nil {
+		result.Error = err.Error()
+	}
+	for _, ip := range ips {
+		result.Addresses = append(result.Addresses, ip.String())
+	}
+	return result
+}
+
+// updatePeerEndpoints sets the endpoints of the peers on the interface to the current address of their host name.
+// Peers whose running endpoint is one of the resolved addresses are left alone, so hosts with several addresses do not
+// flap. If the host name cannot be resolved, the last address is kept.
+func (s *Server) updatePeerEndpoints(dev wireguard.Device, peers []wireguard.Peer,
+	results map[string]EndpointCheckResult) {
+	wgDevice, err := s.wg.GetDeviceInfo(dev.DeviceName)
+	if err != nil {
+		logrus.Debugf("endpoint check: failed to read interface %s: %v", dev.DeviceName, err)
+		return
+	}
+	running := make(map[string]*net.UDPAddr, len(wgDevice.Peers))
+	for _, peer := range wgDevice.Peers {
+		running[peer.PublicKey.String()] = peer.Endpoint
+	}
+
+	for _, peer := range peers {
+		endpoint := interfaceEndpoint(dev, peer)
+		result, ok := results[endpoint]
+		if !ok || result.Error != "" {
+			continue
+		}
+		current, configured := running[peer.PublicKey]
+		if !configured || (current != nil && common.ListContains(result.Addresses, current.IP.String())) {
+			continue
+		}
+
+		_, portStr, _ := net.SplitHostPort(endpoint)
+		port, _ := strconv.Atoi(portStr)
+		publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+		if err != nil {
+			continue
+		}
+		addr := &net.UDPAddr{IP: preferredAddress(result.Addresses), Port: port}
+		if err := s.wg.UpdatePeer(dev.DeviceName, wgtypes.PeerConfig{PublicKey: publicKey, Endpoint: addr}); err != nil {
+			logrus.Errorf("failed to update endpoint of peer %s on %s: %v", peer.PublicKey, dev.DeviceName, err)
+			continue
+		}
+		logrus.Infof("endpoint %s of peer %s (%s) on %s resolves to %s now", endpoint, peer.Identifier,
+			peer.PublicKey, dev.DeviceName, addr)
+	}
+}
+
+// preferredAddress returns the first IPv4 address like net.ResolveUDPAddr, or the first address if there is none.
+func preferredAddress(addresses []string) net.IP {
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip.To4() != nil {
+			return ip
+		}
+	}
+	return net.ParseIP(addresses[0])
+}
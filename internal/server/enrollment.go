@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+)
+
+const maxEnrollmentDeviceLength = 64
+
+var errEnrollmentUserNotFound = errors.New("the user does not exist or is not active")
+
+// EnrollmentError is returned if a peer cannot be enrolled with the given parameters, e.g. on an unknown interface.
+type EnrollmentError struct {
+	Reason string
+}
+
+func (e *EnrollmentError) Error() string {
+	return e.Reason
+}
+
+// EnrollPeer returns the peer of the user for the client device on the given interface. If there is no such peer, it
+// is created with the defaults of the interface, like peers that administrators create. Retries with the same user,
+// interface and client device return the existing peer, enrollments are serialized so that concurrent retries do not
+// create duplicates either. The peer limits of the interface and the user apply. The returned boolean is true if the
+// peer has been created.
+func (s *Server) EnrollPeer(email, device, enrollmentDevice, actor string) (wireguard.Peer, bool, error) {
+	enrollmentDevice = strings.TrimSpace(enrollmentDevice)
+	if enrollmentDevice == "" || len(enrollmentDevice) > maxEnrollmentDeviceLength {
+		return wireguard.Peer{}, false, &EnrollmentError{Reason: fmt.Sprintf(
+			"the device name must have between 1 and %d characters", maxEnrollmentDeviceLength)}
+	}
+	user := s.users.GetUser(strings.ToLower(strings.TrimSpace(email)))
+	if user == nil || !user.IsActive() {
+		return wireguard.Peer{}, false, errEnrollmentUserNotFound
+	}
+	if !common.ListContains(s.config.WG.DeviceNames, device) {
+		return wireguard.Peer{}, false, &EnrollmentError{Reason: "no such interface " + device}
+	}
+	if dev := s.peers.GetDevice(device); dev.Type != wireguard.DeviceTypeServer || dev.DisabledAt != nil {
+		return wireguard.Peer{}, false, &EnrollmentError{Reason: "peers cannot be enrolled on interface " + device}
+	}
+
+	s.enrollmentMux.Lock()
+	defer s.enrollmentMux.Unlock()
+
+	if peer := s.peers.GetPeerByEnrollment(user.Email, device, enrollmentDevice); peer.IsValid() {
+		return peer, false, nil
+	}
+
+	peer, err := s.PrepareNewPeer(device)
+	if err != nil {
+		return wireguard.Peer{}, false, errors.WithMessage(err, "failed to prepare new peer")
+	}
+	peer.Email = user.Email
+	peer.EnrollmentDevice = enrollmentDevice
+	peer.Identifier = enrollmentDevice
+	if s.peers.IdentifierExistsForMail(device, user.Email, peer.Identifier, peer.PublicKey) {
+		peer.Identifier = fmt.Sprintf("%s (%s)", enrollmentDevice, peer.ShortKey()) // a manually created peer uses the name
+	}
+	peer.CreatedBy = actor
+	peer.UpdatedBy = actor
+	if err := s.CreatePeer(device, peer); err != nil {
+		return wireguard.Peer{}, false, err
+	}
+
+	peer = s.peers.GetPeerByKey(peer.PublicKey)
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "peer.enrolled", Interface: device,
+		Target: peer.PublicKey, Details: fmt.Sprintf("%s for %s, device %s", peer.Identifier, peer.Email,
+			enrollmentDevice)})
+
+	return peer, true, nil
+}
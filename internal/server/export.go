@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxInterfaceExportSize limits the size of uploaded interface documents.
+const maxInterfaceExportSize = 16 << 20
+
+var trailingNumberRegex = regexp.MustCompile(`[0-9]+$`)
+
+// ExportInterface returns the interface and all its peers as versioned JSON document, see wireguard.InterfaceExport.
+func (s *Server) ExportInterface(device string, redact bool, actor string) (wireguard.InterfaceExport, error) {
+	if !common.ListContains(s.config.WG.DeviceNames, device) {
+		return wireguard.InterfaceExport{}, errors.Errorf("no such interface %s", device)
+	}
+	doc, err := s.peers.ExportDevice(device, redact)
+	if err != nil {
+		return doc, err
+	}
+
+	details := fmt.Sprintf("%d peers", len(doc.Peers))
+	if redact {
+		details += ", keys redacted"
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "interface.exported", Interface: device,
+		Details: details})
+
+	return doc, nil
+}
+
+// ImportInterface creates the interface and the peers of an exported document. If the interface name is already in
+// use, the interface is created with the next free name, e.g. wg1 instead of wg0. Peer addresses are only reallocated
+// if they are in use. The interface is created and brought up like interfaces of wg-quick imports. If the interface
+// cannot be applied, the stored interface and peers are removed again, so the document applies as a whole or not at
+// all. With dryRun, the result reports what would be created.
+func (s *Server) ImportInterface(doc wireguard.InterfaceExport, actor string, dryRun bool) (
+	wireguard.InterfaceImportResult, error) {
+	device, err := s.freeInterfaceName(doc.Device.DeviceName)
+	if err != nil {
+		return wireguard.InterfaceImportResult{}, err
+	}
+	if !s.config.WG.ManageInterfaces {
+		if _, err := s.wg.IsLinkUp(device); err != nil {
+			return wireguard.InterfaceImportResult{}, errors.Errorf(
+				"interface %s does not exist, enable MANAGE_INTERFACES to create it", device)
+		}
+	}
+	imported := doc.Device
+	imported.DeviceName = device
+	if err := wireguard.ValidateInterfaceParameters(device, imported.Mtu, imported.GetIPAddresses()); err != nil {
+		return wireguard.InterfaceImportResult{}, err
+	}
+	if err := s.validateDeviceNamespace(imported); err != nil {
+		return wireguard.InterfaceImportResult{}, err
+	}
+	if err := s.validateDeviceListenPort(imported); err != nil {
+		return wireguard.InterfaceImportResult{}, err
+	}
+
+	result, err := s.peers.ImportDevice(doc, device, actor, dryRun)
+	if err != nil || dryRun {
+		return result, err
+	}
+
+	if err := s.applyImportedInterface(device); err != nil {
+		s.rollbackImportedInterface(device)
+		return result, errors.WithMessage(err, "the interface could not be applied, nothing was imported")
+	}
+	logrus.Infof("imported interface %s with %d peers", device, len(result.Peers))
+	logrus.Warnf("imported interface %s, add it to the configured devices to keep it managed after a restart", device)
+
+	details := fmt.Sprintf("%d peers, %d addresses reallocated", len(result.Peers), len(result.ReallocatedIPs))
+	if result.Renamed {
+		details += ", renamed from " + doc.Device.DeviceName
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "interface.imported", Interface: device,
+		Details: details})
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventInterfaceCreated, Interface: device,
+		Actor: actor})
+	for _, publicKey := range result.Peers {
+		s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerCreated, Interface: device,
+			PeerKey: publicKey, Actor: actor})
+	}
+
+	return result, nil
+}
+
+// freeInterfaceName returns the name if no managed or stored interface uses it, otherwise the name with the next free
+// number. Names of existing links are only available if wg-portal does not create interfaces itself.
+func (s *Server) freeInterfaceName(name string) (string, error) {
+	if !wireguard.IsValidInterfaceName(name) {
+		return "", errors.Errorf("invalid interface name %s", name)
+	}
+
+	base := trailingNumberRegex.ReplaceAllString(name, "")
+	candidate := name
+	for i := 0; i < 1000; i++ {
+		if i > 0 {
+			candidate = base + strconv.Itoa(i-1)
+		}
+		if !wireguard.IsValidInterfaceName(candidate) || common.ListContains(s.config.WG.DeviceNames, candidate) ||
+			s.peers.GetDevice(candidate).DeviceName != "" {
+			continue
+		}
+		if _, err := s.wg.IsLinkUp(candidate); err == nil && s.config.WG.ManageInterfaces {
+			continue // the link belongs to something else
+		}
+		return candidate, nil
+	}
+
+	return "", errors.Errorf("no free interface name for %s", name)
+}
+
+// applyImportedInterface adds the imported interface to the managed interfaces and applies it.
+func (s *Server) applyImportedInterface(device string) error {
+	if err := s.wg.SetDeviceNamespace(device, s.peers.GetDevice(device).Namespace); err != nil {
+		return err
+	}
+	if s.config.WG.ManageInterfaces {
+		if _, err := s.wg.CreateDevice(device); err != nil {
+			return err
+		}
+	}
+	s.config.WG.DeviceNames = append(s.config.WG.DeviceNames, device)
+
+	dev := s.peers.GetDevice(device)
+	if !s.config.WG.ManageInterfaces {
+		if err := s.ApplyDeviceChanges(dev, dev); err != nil {
+			return err
+		}
+	}
+	if err := s.RestoreWireGuardInterface(device); err != nil {
+		return err
+	}
+	if err := s.linkUp(dev); err != nil {
+		return err
+	}
+	if err := s.applyFirewallRules(dev); err != nil {
+		logrus.Errorf("failed to apply firewall rules of interface %s: %v", device, err)
+	}
+
+	return s.WriteWireGuardConfigFile(device)
+}
+
+// rollbackImportedInterface removes an imported interface that could not be applied.
+func (s *Server) rollbackImportedInterface(device string) {
+	deviceNames := make([]string, 0, len(s.config.WG.DeviceNames))
+	for _, deviceName := range s.config.WG.DeviceNames {
+		if deviceName != device {
+			deviceNames = append(deviceNames, deviceName)
+		}
+	}
+	s.config.WG.DeviceNames = deviceNames
+
+	if s.config.WG.ManageFirewall {
+		if err := s.wg.RemoveMasqueradeRules(device); err != nil {
+			logrus.Errorf("failed to remove firewall rules of interface %s: %v", device, err)
+		}
+	}
+	s.removeDeviceRoutes(device)
+	if s.config.WG.ManageInterfaces {
+		if err := s.wg.DeleteDevice(device); err != nil {
+			logrus.Errorf("failed to remove interface %s of a failed import: %v", device, err)
+		}
+	}
+	if err := s.peers.DeleteDevice(device); err != nil {
+		logrus.Errorf("failed to remove interface %s of a failed import from the database: %v", device, err)
+	}
+}
@@ -0,0 +1,889 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/grpcapi"
+	"github.com/h44z/wg-portal/internal/users"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	grpcTokenActor           = "grpc" // actor of the changes that are made with GRPC_TOKEN
+	grpcDefaultStatsInterval = 10 * time.Second
+	grpcMinimumStatsInterval = time.Second
+)
+
+// grpcUserContextKey holds the email of the authenticated user in the context of gRPC calls.
+type grpcUserContextKey struct{}
+
+// grpcInterfaceService, grpcPeerService and grpcUserService implement the gRPC management API, see
+// internal/grpcapi/wgportal.proto. Like the REST API they are thin wrappers of the Server methods, so changes are
+// validated and applied to the kernel exactly like the changes of the web interface.
+type grpcInterfaceService struct {
+	grpcapi.UnimplementedInterfaceServiceServer
+	s *Server
+}
+
+type grpcPeerService struct {
+	grpcapi.UnimplementedPeerServiceServer
+	s *Server
+}
+
+type grpcUserService struct {
+	grpcapi.UnimplementedUserServiceServer
+	s *Server
+}
+
+// grpcAuthenticatedStream carries the authenticated user in the context of streaming calls.
+type grpcAuthenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (g *grpcAuthenticatedStream) Context() context.Context {
+	return g.ctx
+}
+
+// runGrpcServer serves the gRPC management API on GRPC_LISTENING_ADDRESS. The returned server is nil if the API is
+// disabled.
+func (s *Server) runGrpcServer() (*grpc.Server, error) {
+	if s.config.Core.GrpcListeningAddress == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", s.config.Core.GrpcListeningAddress)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s", s.config.Core.GrpcListeningAddress)
+	}
+
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.grpcAuthenticate),
+		grpc.StreamInterceptor(s.grpcAuthenticateStream),
+	}
+	if s.config.Core.GrpcTlsCertificate != "" {
+		tlsConfig, err := s.grpcTlsConfig()
+		if err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if s.config.Core.GrpcClientCA != "" {
+		_ = listener.Close()
+		return nil, errors.New("GRPC_CLIENT_CA requires GRPC_TLS_CERT and GRPC_TLS_KEY")
+	}
+
+	srv := grpc.NewServer(options...)
+	grpcapi.RegisterInterfaceServiceServer(srv, &grpcInterfaceService{s: s})
+	grpcapi.RegisterPeerServiceServer(srv, &grpcPeerService{s: s})
+	grpcapi.RegisterUserServiceServer(srv, &grpcUserService{s: s})
+
+	logrus.Infof("starting gRPC service on %s", s.config.Core.GrpcListeningAddress)
+	go func() {
+		if err := srv.Serve(listener); err != nil {
+			logrus.Debugf("gRPC service on %s exited: %v", s.config.Core.GrpcListeningAddress, err)
+		}
+	}()
+
+	return srv, nil
+}
+
+// grpcTlsConfig loads the server certificate. If GRPC_CLIENT_CA is set, clients may authenticate with a certificate
+// that is signed by it, clients without certificate have to send a token.
+func (s *Server) grpcTlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(s.config.Core.GrpcTlsCertificate, s.config.Core.GrpcTlsKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load gRPC certificate")
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.config.Core.GrpcClientCA != "" {
+		caPem, err := ioutil.ReadFile(s.config.Core.GrpcClientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read gRPC client CA")
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPem) {
+			return nil, errors.Errorf("no certificates found in %s", s.config.Core.GrpcClientCA)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// stopGrpcServer waits for the running calls until the timeout expires, remaining calls are aborted.
+func stopGrpcServer(srv *grpc.Server, timeout time.Duration) {
+	if srv == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		srv.Stop()
+	}
+}
+
+func (s *Server) grpcAuthenticate(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	actor, err := s.grpcAuthorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(context.WithValue(ctx, grpcUserContextKey{}, actor), req)
+}
+
+func (s *Server) grpcAuthenticateStream(srv interface{}, stream grpc.ServerStream, _ *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	actor, err := s.grpcAuthorize(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &grpcAuthenticatedStream{
+		ServerStream: stream,
+		ctx:          context.WithValue(stream.Context(), grpcUserContextKey{}, actor),
+	})
+}
+
+// grpcAuthorize returns the actor of a call. Clients authenticate with a client certificate that is signed by
+// GRPC_CLIENT_CA, or with "authorization: Bearer <token>" metadata that contains GRPC_TOKEN or the API token of a
+// user. The email address of a client certificate (or its common name) must belong to a user. All services need
+// the admin scope of the REST API.
+func (s *Server) grpcAuthorize(ctx context.Context) (string, error) {
+	var user *users.User
+	var err error
+	if email := grpcClientCertificateEmail(ctx); email != "" {
+		if user = s.users.GetUser(email); user == nil || !user.IsActive() {
+			err = errUserNotActive
+		}
+	} else {
+		md, _ := metadata.FromIncomingContext(ctx)
+		authorization := md.Get("authorization")
+		if len(authorization) == 0 || !strings.HasPrefix(authorization[0], "Bearer ") {
+			return "", status.Error(codes.Unauthenticated, "unauthorized")
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(authorization[0], "Bearer "))
+		if s.config.Core.GrpcToken != "" &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Core.GrpcToken)) == 1 {
+			return grpcTokenActor, nil
+		}
+		var tokenScope string
+		user, tokenScope, err = s.authenticateApiToken(token)
+		if err == nil && tokenScope != ApiTokenScopeUser {
+			return "", status.Error(codes.PermissionDenied, "the token cannot be used for the gRPC API")
+		}
+	}
+
+	switch {
+	case err == errApiTokenInvalid || err == errUserNotActive || (err == nil && user == nil):
+		return "", status.Error(codes.Unauthenticated, "unauthorized")
+	case err != nil:
+		return "", status.Error(codes.Internal, "login error")
+	case !userHasScope(user, "admin"):
+		return "", status.Error(codes.PermissionDenied, "unauthorized")
+	}
+
+	return user.Email, nil
+}
+
+// grpcClientCertificateEmail returns the identity of a verified client certificate, or an empty string if the client
+// did not send a certificate.
+func grpcClientCertificateEmail(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	certificate := tlsInfo.State.VerifiedChains[0][0]
+	if len(certificate.EmailAddresses) > 0 {
+		return strings.ToLower(certificate.EmailAddresses[0])
+	}
+	return strings.ToLower(certificate.Subject.CommonName)
+}
+
+func grpcActor(ctx context.Context) string {
+	email, _ := ctx.Value(grpcUserContextKey{}).(string)
+	return email
+}
+
+// grpcDevice returns the managed interface with the given name.
+func (s *Server) grpcDevice(name string) (wireguard.Device, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return wireguard.Device{}, status.Error(codes.InvalidArgument, "the interface name must be specified")
+	}
+	if !common.ListContains(s.config.WG.DeviceNames, name) {
+		return wireguard.Device{}, status.Error(codes.NotFound, "unknown interface")
+	}
+	dev := s.peers.GetDevice(name)
+	if !dev.IsValid() {
+		return wireguard.Device{}, status.Error(codes.NotFound, "interface not found")
+	}
+	return dev, nil
+}
+
+func (g *grpcInterfaceService) ListInterfaces(_ context.Context, _ *grpcapi.ListInterfacesRequest) (
+	*grpcapi.ListInterfacesResponse, error) {
+	response := &grpcapi.ListInterfacesResponse{}
+	for _, deviceName := range g.s.config.WG.DeviceNames {
+		dev := g.s.peers.GetDevice(deviceName)
+		if !dev.IsValid() {
+			continue
+		}
+		response.Interfaces = append(response.Interfaces, deviceToProto(dev))
+	}
+	return response, nil
+}
+
+func (g *grpcInterfaceService) GetInterface(_ context.Context, req *grpcapi.GetInterfaceRequest) (
+	*grpcapi.Interface, error) {
+	dev, err := g.s.grpcDevice(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	return deviceToProto(dev), nil
+}
+
+func (g *grpcInterfaceService) UpdateInterface(ctx context.Context, req *grpcapi.UpdateInterfaceRequest) (
+	*grpcapi.UpdateInterfaceResponse, error) {
+	dev, err := g.s.grpcDevice(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetInterface() == nil {
+		return nil, status.Error(codes.InvalidArgument, "the interface must be specified")
+	}
+
+	merged := deviceToProto(dev)
+	if err := mergeProtoFields(merged, req.GetInterface(), req.GetUpdateMask()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	updated := dev
+	applyDeviceProto(&updated, merged)
+	if err := binding.Validator.ValidateStruct(updated); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	warnings, err := g.s.UpdateDeviceSettings(updated, req.GetRegenerateKey(), grpcActor(ctx))
+	var updateErr *DeviceUpdateError
+	switch {
+	case errors.As(err, &updateErr) && updateErr.Step != "wg" && updateErr.Step != "update":
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &grpcapi.UpdateInterfaceResponse{
+		Interface: deviceToProto(g.s.peers.GetDevice(dev.DeviceName)),
+		Warnings:  warnings,
+	}, nil
+}
+
+func (g *grpcInterfaceService) DeleteInterface(ctx context.Context, req *grpcapi.DeleteInterfaceRequest) (
+	*grpcapi.DeleteInterfaceResponse, error) {
+	dev, err := g.s.grpcDevice(req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if peerCount := g.s.peers.CountPeers(dev.DeviceName); peerCount != req.GetPeers() {
+		return nil, status.Errorf(codes.FailedPrecondition, "the interface has %d peers", peerCount)
+	}
+
+	if err := g.s.DeleteDevice(dev.DeviceName, dev.DeviceName, req.GetPeers(), grpcActor(ctx)); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &grpcapi.DeleteInterfaceResponse{}, nil
+}
+
+func (g *grpcPeerService) ListPeers(_ context.Context, req *grpcapi.ListPeersRequest) (*grpcapi.ListPeersResponse,
+	error) {
+	dev, err := g.s.grpcDevice(req.GetInterface())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetPage() < 0 || req.GetPageSize() < 0 || req.GetPageSize() > MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "page must be positive and page_size between 1 and %d",
+			MaxPageSize)
+	}
+	filter := wireguard.PeerFilter(req.GetFilter())
+	switch filter {
+	case wireguard.PeerFilterAll, wireguard.PeerFilterEnabled, wireguard.PeerFilterDisabled,
+		wireguard.PeerFilterNeverConnected, wireguard.PeerFilterGuest:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown filter %s", filter)
+	}
+	page := int(req.GetPage())
+	if page == 0 {
+		page = 1
+	}
+
+	peers, total := g.s.peers.GetPeersPage(dev.DeviceName, wireguard.PeerListOptions{
+		Search:        req.GetSearch(),
+		Filter:        filter,
+		Tags:          req.GetTags(),
+		SortKey:       req.GetSort(),
+		SortDirection: req.GetSortDirection(),
+		Page:          page,
+		PageSize:      int(req.GetPageSize()),
+	})
+	response := &grpcapi.ListPeersResponse{Total: total}
+	for _, peer := range peers {
+		response.Peers = append(response.Peers, peerToProto(peer))
+	}
+	return response, nil
+}
+
+func (g *grpcPeerService) GetPeer(_ context.Context, req *grpcapi.GetPeerRequest) (*grpcapi.Peer, error) {
+	peer := g.s.peers.GetPeerByKey(req.GetPublicKey())
+	if !peer.IsValid() {
+		return nil, status.Error(codes.NotFound, "peer does not exist")
+	}
+	return peerToProto(peer), nil
+}
+
+func (g *grpcPeerService) CreatePeer(ctx context.Context, req *grpcapi.CreatePeerRequest) (*grpcapi.Peer, error) {
+	dev, err := g.s.grpcDevice(req.GetInterface())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetPeer() == nil {
+		return nil, status.Error(codes.InvalidArgument, "the peer must be specified")
+	}
+
+	// The peer gets the defaults of the interface like peers that are created in the web interface
+	peer, err := g.s.PrepareNewPeer(dev.DeviceName)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	merged := peerToProto(peer)
+	if err := mergeProtoFields(merged, req.GetPeer(), req.GetCreateMask()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if merged.PublicKey != peer.PublicKey && merged.PrivateKey == peer.PrivateKey {
+		merged.PrivateKey = "" // the generated private key does not belong to the given public key
+	}
+	if g.s.peers.GetPeerByKey(merged.PublicKey).IsValid() {
+		return nil, status.Error(codes.AlreadyExists, "peer already exists")
+	}
+
+	now := time.Now()
+	applyPeerProto(&peer, merged)
+	peer.PublicKey, peer.PrivateKey = merged.PublicKey, merged.PrivateKey
+	peer.DeviceType = dev.Type
+	peer.DeactivatedAt = nil
+	if merged.Disabled {
+		peer.DeactivatedAt = &now
+	}
+	if peer.ExpiresAt != nil && peer.ExpiresAt.Before(now) {
+		return nil, status.Error(codes.InvalidArgument, "expires_at must be in the future")
+	}
+	peer.CreatedBy = grpcActor(ctx)
+	peer.UpdatedBy = grpcActor(ctx)
+	if err := binding.Validator.ValidateStruct(peer); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if peer.PrivateKey == "" { // public key only peer
+		if _, err := wireguard.ParsePublicKey(peer.PublicKey); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	if req.GetIgnoreQuota() {
+		err = g.s.CreatePeerIgnoringQuota(dev.DeviceName, peer)
+	} else {
+		err = g.s.CreatePeer(dev.DeviceName, peer)
+	}
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		return nil, status.Error(codes.ResourceExhausted, quotaErr.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return peerToProto(g.s.peers.GetPeerByKey(peer.PublicKey)), nil
+}
+
+func (g *grpcPeerService) UpdatePeer(ctx context.Context, req *grpcapi.UpdatePeerRequest) (*grpcapi.Peer, error) {
+	if req.GetPeer() == nil {
+		return nil, status.Error(codes.InvalidArgument, "the peer must be specified")
+	}
+	currentPeer := g.s.peers.GetPeerByKey(req.GetPeer().GetPublicKey())
+	if !currentPeer.IsValid() {
+		return nil, status.Error(codes.NotFound, "peer does not exist")
+	}
+
+	merged := peerToProto(currentPeer)
+	if err := mergeProtoFields(merged, req.GetPeer(), req.GetUpdateMask()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if merged.PublicKey != currentPeer.PublicKey {
+		return nil, status.Error(codes.InvalidArgument, "the public key cannot be changed")
+	}
+
+	now := time.Now()
+	peer := currentPeer
+	applyPeerProto(&peer, merged)
+	if merged.Disabled && currentPeer.DeactivatedAt == nil {
+		peer.DeactivatedAt = &now
+	} else if !merged.Disabled {
+		peer.DeactivatedAt = nil
+	}
+	peer.DeviceType = g.s.peers.GetDevice(peer.DeviceName).Type
+	peer.UpdatedBy = grpcActor(ctx)
+	if err := binding.Validator.ValidateStruct(peer); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := g.s.UpdatePeer(peer, now); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return peerToProto(g.s.peers.GetPeerByKey(peer.PublicKey)), nil
+}
+
+func (g *grpcPeerService) DeletePeer(ctx context.Context, req *grpcapi.DeletePeerRequest) (
+	*grpcapi.DeletePeerResponse, error) {
+	peer := g.s.peers.GetPeerByKey(req.GetPublicKey())
+	if !peer.IsValid() {
+		return nil, status.Error(codes.NotFound, "peer does not exist")
+	}
+
+	peer.UpdatedBy = grpcActor(ctx)
+	if err := g.s.DeletePeer(peer); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &grpcapi.DeletePeerResponse{}, nil
+}
+
+func (g *grpcPeerService) WatchPeerStats(req *grpcapi.WatchPeerStatsRequest,
+	stream grpcapi.PeerService_WatchPeerStatsServer) error {
+	dev, err := g.s.grpcDevice(req.GetInterface())
+	if err != nil {
+		return err
+	}
+	interval := grpcDefaultStatsInterval
+	if req.GetIntervalSeconds() != 0 {
+		interval = time.Duration(req.GetIntervalSeconds()) * time.Second
+	}
+	if interval < grpcMinimumStatsInterval {
+		return status.Errorf(codes.InvalidArgument, "interval_seconds must be at least %d",
+			int(grpcMinimumStatsInterval.Seconds()))
+	}
+	publicKeys := make(map[string]bool, len(req.GetPublicKeys()))
+	for _, publicKey := range req.GetPublicKeys() {
+		publicKeys[publicKey] = true
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		wgPeers, err := g.s.wg.GetPeerList(dev.DeviceName)
+		if err != nil {
+			logrus.Debugf("failed to read peers of %s for gRPC stats: %v", dev.DeviceName, err)
+			return status.Error(codes.Unavailable, "failed to read the peers of the interface")
+		}
+
+		now := time.Now()
+		for _, wgPeer := range wgPeers {
+			publicKey := wgPeer.PublicKey.String()
+			if len(publicKeys) > 0 && !publicKeys[publicKey] {
+				continue
+			}
+			stats := &grpcapi.PeerStats{
+				PublicKey:       publicKey,
+				Interface:       dev.DeviceName,
+				LatestHandshake: grpcTimestamp(&wgPeer.LastHandshakeTime),
+				ReceiveBytes:    wgPeer.ReceiveBytes,
+				TransmitBytes:   wgPeer.TransmitBytes,
+				Connected: g.s.config.WG.ConnectionState(dev.DeviceName, wgPeer.LastHandshakeTime, now) ==
+					wireguard.ConnectionStateOnline,
+				CollectedAt: timestamppb.New(now),
+			}
+			if wgPeer.Endpoint != nil {
+				stats.Endpoint = wgPeer.Endpoint.String()
+			}
+			if err := stream.Send(stats); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-g.s.ctx.Done():
+			return status.Error(codes.Unavailable, "the portal is shutting down")
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *grpcUserService) ListUsers(_ context.Context, req *grpcapi.ListUsersRequest) (*grpcapi.ListUsersResponse,
+	error) {
+	if req.GetPage() < 0 || req.GetPageSize() < 0 || req.GetPageSize() > MaxPageSize {
+		return nil, status.Errorf(codes.InvalidArgument, "page must be positive and page_size between 1 and %d",
+			MaxPageSize)
+	}
+	page := int(req.GetPage())
+	if page == 0 {
+		page = 1
+	}
+
+	allUsers, total := g.s.users.GetUsersPage(req.GetSort(), req.GetSortDirection(), req.GetSearch(), page,
+		int(req.GetPageSize()))
+	response := &grpcapi.ListUsersResponse{Total: total}
+	for _, user := range allUsers {
+		response.Users = append(response.Users, userToProto(user))
+	}
+	return response, nil
+}
+
+func (g *grpcUserService) GetUser(_ context.Context, req *grpcapi.GetUserRequest) (*grpcapi.User, error) {
+	user := g.s.users.GetUserUnscoped(strings.ToLower(strings.TrimSpace(req.GetEmail())))
+	if user == nil {
+		return nil, status.Error(codes.NotFound, "user does not exist")
+	}
+	return userToProto(*user), nil
+}
+
+func (g *grpcUserService) CreateUser(ctx context.Context, req *grpcapi.CreateUserRequest) (*grpcapi.User, error) {
+	if req.GetUser() == nil {
+		return nil, status.Error(codes.InvalidArgument, "the user must be specified")
+	}
+	device := g.s.wg.Cfg.GetDefaultDeviceName()
+	if req.GetInterface() != "" {
+		dev, err := g.s.grpcDevice(req.GetInterface())
+		if err != nil {
+			return nil, err
+		}
+		device = dev.DeviceName
+	}
+
+	user := users.User{
+		Email:  strings.ToLower(strings.TrimSpace(req.GetUser().GetEmail())),
+		Source: users.UserSourceDatabase,
+	}
+	applyUserProto(&user, req.GetUser())
+	if err := g.s.validateGrpcUser(user); err != nil {
+		return nil, err
+	}
+	if g.s.users.GetUserUnscoped(user.Email) != nil {
+		return nil, status.Error(codes.AlreadyExists, "user already exists")
+	}
+
+	if err := g.s.CreateUser(user, device, grpcActor(ctx)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	created := g.s.users.GetUserUnscoped(user.Email)
+	if created == nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return userToProto(*created), nil
+}
+
+func (g *grpcUserService) UpdateUser(ctx context.Context, req *grpcapi.UpdateUserRequest) (*grpcapi.User, error) {
+	if req.GetUser() == nil {
+		return nil, status.Error(codes.InvalidArgument, "the user must be specified")
+	}
+	email := strings.ToLower(strings.TrimSpace(req.GetUser().GetEmail()))
+	currentUser := g.s.users.GetUserUnscoped(email)
+	if currentUser == nil {
+		return nil, status.Error(codes.NotFound, "user does not exist")
+	}
+
+	merged := userToProto(*currentUser)
+	if err := mergeProtoFields(merged, req.GetUser(), req.GetUpdateMask()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if strings.ToLower(strings.TrimSpace(merged.Email)) != currentUser.Email {
+		return nil, status.Error(codes.InvalidArgument, "the email address cannot be changed")
+	}
+
+	user := *currentUser
+	applyUserProto(&user, merged)
+	if err := g.s.validateGrpcUser(user); err != nil {
+		return nil, err
+	}
+
+	if err := g.s.UpdateUser(user, grpcActor(ctx)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	updated := g.s.users.GetUserUnscoped(email)
+	if updated == nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+	return userToProto(*updated), nil
+}
+
+func (g *grpcUserService) DeleteUser(ctx context.Context, req *grpcapi.DeleteUserRequest) (*grpcapi.DeleteUserResponse,
+	error) {
+	user := g.s.users.GetUserUnscoped(strings.ToLower(strings.TrimSpace(req.GetEmail())))
+	if user == nil {
+		return nil, status.Error(codes.NotFound, "user does not exist")
+	}
+
+	if err := g.s.DeleteUser(*user, grpcActor(ctx)); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &grpcapi.DeleteUserResponse{}, nil
+}
+
+// validateGrpcUser checks the binding rules of the user model and the password policy before the user is stored, so
+// invalid input is reported as invalid argument.
+func (s *Server) validateGrpcUser(user users.User) error {
+	if err := binding.Validator.ValidateStruct(user); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if user.Password != "" {
+		if err := s.config.Password.Validate(string(user.Password)); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return nil
+}
+
+// mergeProtoFields copies the fields of the mask from src to dst. Without mask, the fields that are set in src are
+// copied, fields with zero values are kept.
+func mergeProtoFields(dst, src proto.Message, mask *fieldmaskpb.FieldMask) error {
+	dstMessage, srcMessage := dst.ProtoReflect(), src.ProtoReflect()
+	fields := dstMessage.Descriptor().Fields()
+
+	if len(mask.GetPaths()) == 0 {
+		srcMessage.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+			dstMessage.Set(field, value)
+			return true
+		})
+		return nil
+	}
+
+	for _, path := range mask.GetPaths() {
+		field := fields.ByName(protoreflect.Name(path))
+		if field == nil {
+			return errors.Errorf("unknown field %s in mask", path)
+		}
+		if srcMessage.Has(field) {
+			dstMessage.Set(field, srcMessage.Get(field))
+		} else {
+			dstMessage.Clear(field)
+		}
+	}
+	return nil
+}
+
+// grpcList converts a repeated field to the comma separated lists of the models.
+func grpcList(values []string) string {
+	return common.ListToString(common.ParseStringList(strings.Join(values, ",")))
+}
+
+func grpcTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func deviceToProto(dev wireguard.Device) *grpcapi.Interface {
+	return &grpcapi.Interface{
+		Name:                       dev.DeviceName,
+		DisplayName:                dev.DisplayName,
+		Type:                       string(dev.Type),
+		PublicKey:                  dev.PublicKey,
+		ListenPort:                 int32(dev.ListenPort),
+		FirewallMark:               dev.FirewallMark,
+		Mtu:                        int32(dev.Mtu),
+		Addresses:                  dev.GetIPAddresses(),
+		Dns:                        dev.GetDNSServers(),
+		RoutingTable:               dev.RoutingTable,
+		PreUp:                      dev.PreUp,
+		PostUp:                     dev.PostUp,
+		PreDown:                    dev.PreDown,
+		PostDown:                   dev.PostDown,
+		SaveConfig:                 dev.SaveConfig,
+		DefaultEndpoint:            dev.DefaultEndpoint,
+		EndpointCandidates:         common.ParseStringList(dev.EndpointCandidatesStr),
+		DefaultAllowedIps:          dev.GetDefaultAllowedIPs(),
+		DefaultPersistentKeepalive: int32(dev.DefaultPersistentKeepalive),
+		DefaultAllowedIpsPresetId:  uint32(dev.DefaultAllowedIPsPresetID),
+		DefaultGuestDays:           int32(dev.DefaultGuestDays),
+		TunnelMode:                 string(dev.TunnelMode),
+		InheritDns:                 dev.InheritDNS,
+		InheritAllowedIps:          dev.InheritAllowedIPs,
+		InheritKeepalive:           dev.InheritKeepalive,
+		UpstreamInterface:          dev.UpstreamInterface,
+		InactivityDisableDays:      int32(dev.InactivityDisableDays),
+		MaxPeers:                   int32(dev.MaxPeers),
+		GeneratePresharedKeys:      dev.GeneratePresharedKeys,
+		SelfService:                dev.SelfService,
+		WriteConfigFile:            !dev.DisableConfigFile,
+		Disabled:                   dev.DisabledAt != nil,
+		CreatedAt:                  grpcTimestamp(&dev.CreatedAt),
+		UpdatedAt:                  grpcTimestamp(&dev.UpdatedAt),
+	}
+}
+
+// applyDeviceProto copies the settings of the message to the interface, output only fields are ignored.
+func applyDeviceProto(dev *wireguard.Device, pb *grpcapi.Interface) {
+	dev.DisplayName = pb.DisplayName
+	dev.Type = wireguard.DeviceType(pb.Type)
+	dev.ListenPort = int(pb.ListenPort)
+	dev.FirewallMark = pb.FirewallMark
+	dev.Mtu = int(pb.Mtu)
+	dev.IPsStr = grpcList(pb.Addresses)
+	dev.DNSStr = grpcList(pb.Dns)
+	dev.RoutingTable = pb.RoutingTable
+	dev.PreUp = pb.PreUp
+	dev.PostUp = pb.PostUp
+	dev.PreDown = pb.PreDown
+	dev.PostDown = pb.PostDown
+	dev.SaveConfig = pb.SaveConfig
+	dev.DefaultEndpoint = pb.DefaultEndpoint
+	dev.EndpointCandidatesStr = grpcList(pb.EndpointCandidates)
+	dev.DefaultAllowedIPsStr = grpcList(pb.DefaultAllowedIps)
+	dev.DefaultPersistentKeepalive = int(pb.DefaultPersistentKeepalive)
+	dev.DefaultAllowedIPsPresetID = uint(pb.DefaultAllowedIpsPresetId)
+	dev.DefaultGuestDays = int(pb.DefaultGuestDays)
+	dev.TunnelMode = wireguard.TunnelMode(pb.TunnelMode)
+	dev.InheritDNS = pb.InheritDns
+	dev.InheritAllowedIPs = pb.InheritAllowedIps
+	dev.InheritKeepalive = pb.InheritKeepalive
+	dev.UpstreamInterface = pb.UpstreamInterface
+	dev.InactivityDisableDays = int(pb.InactivityDisableDays)
+	dev.MaxPeers = int(pb.MaxPeers)
+	dev.GeneratePresharedKeys = pb.GeneratePresharedKeys
+	dev.SelfService = pb.SelfService
+	dev.DisableConfigFile = !pb.WriteConfigFile
+}
+
+func peerToProto(peer wireguard.Peer) *grpcapi.Peer {
+	return &grpcapi.Peer{
+		PublicKey:            peer.PublicKey,
+		Interface:            peer.DeviceName,
+		Identifier:           peer.Identifier,
+		Email:                peer.Email,
+		Description:          peer.Description,
+		Tags:                 peer.GetTags(),
+		Notes:                peer.Notes,
+		AllowedIps:           common.ParseStringList(peer.AllowedIPsStr),
+		AllowedIpsPresetId:   uint32(peer.AllowedIPsPresetID),
+		ServerAllowedIps:     common.ParseStringList(peer.AllowedIPsSrvStr),
+		Endpoint:             peer.Endpoint,
+		PersistentKeepalive:  int32(peer.PersistentKeepalive),
+		Addresses:            peer.GetIPAddresses(),
+		Dns:                  common.ParseStringList(peer.DNSStr),
+		Mtu:                  int32(peer.Mtu),
+		OverrideDns:          peer.OverrideDNS,
+		OverrideMtu:          peer.OverrideMtu,
+		OverrideKeepalive:    peer.OverrideKeepalive,
+		OverrideEndpoint:     peer.OverrideEndpoint,
+		IgnoreGlobalSettings: peer.IgnoreGlobalSettings,
+		Managed:              peer.Managed,
+		Disabled:             peer.DeactivatedAt != nil,
+		PrivateKey:           peer.PrivateKey,
+		PresharedKey:         peer.PresharedKey,
+		ExpiresAt:            grpcTimestamp(peer.ExpiresAt),
+		CreatedBy:            peer.CreatedBy,
+		UpdatedBy:            peer.UpdatedBy,
+		CreatedAt:            grpcTimestamp(&peer.CreatedAt),
+		UpdatedAt:            grpcTimestamp(&peer.UpdatedAt),
+	}
+}
+
+func userToProto(user users.User) *grpcapi.User {
+	return &grpcapi.User{
+		Email:       user.Email,
+		Source:      string(user.Source),
+		IsAdmin:     user.IsAdmin,
+		Firstname:   user.Firstname,
+		Lastname:    user.Lastname,
+		Phone:       user.Phone,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		State:       string(user.State),
+		Disabled:    user.DeletedAt.Valid,
+		CreatedAt:   grpcTimestamp(&user.CreatedAt),
+		UpdatedAt:   grpcTimestamp(&user.UpdatedAt),
+	}
+}
+
+// applyUserProto copies the settings of the message to the user. The password is only changed if it is set, the
+// email address and the output only fields are handled by the callers.
+func applyUserProto(user *users.User, pb *grpcapi.User) {
+	user.IsAdmin = pb.IsAdmin
+	user.Firstname = pb.Firstname
+	user.Lastname = pb.Lastname
+	user.Phone = pb.Phone
+	user.Password = users.PrivateString(pb.Password)
+	if !pb.Disabled {
+		user.DeletedAt = gorm.DeletedAt{}
+	} else if !user.DeletedAt.Valid {
+		user.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	}
+}
+
+// applyPeerProto copies the settings of the message to the peer. The keys, the state and the output only fields are
+// handled by the callers.
+func applyPeerProto(peer *wireguard.Peer, pb *grpcapi.Peer) {
+	peer.Identifier = pb.Identifier
+	peer.Email = pb.Email
+	peer.Description = pb.Description
+	peer.SetTags(pb.Tags...)
+	peer.Notes = pb.Notes
+	peer.AllowedIPsStr = grpcList(pb.AllowedIps)
+	peer.AllowedIPsPresetID = uint(pb.AllowedIpsPresetId)
+	peer.AllowedIPsSrvStr = grpcList(pb.ServerAllowedIps)
+	peer.Endpoint = pb.Endpoint
+	peer.PersistentKeepalive = int(pb.PersistentKeepalive)
+	peer.IPsStr = grpcList(pb.Addresses)
+	peer.DNSStr = grpcList(pb.Dns)
+	peer.Mtu = int(pb.Mtu)
+	peer.OverrideDNS = pb.OverrideDns
+	peer.OverrideMtu = pb.OverrideMtu
+	peer.OverrideKeepalive = pb.OverrideKeepalive
+	peer.OverrideEndpoint = pb.OverrideEndpoint && pb.Endpoint != "" // like the web interface
+	peer.IgnoreGlobalSettings = pb.IgnoreGlobalSettings
+	peer.Managed = pb.Managed
+	peer.PresharedKey = pb.PresharedKey
+	peer.ExpiresAt = nil
+	if pb.ExpiresAt != nil {
+		expiresAt := pb.ExpiresAt.AsTime()
+		peer.ExpiresAt = &expiresAt
+	}
+}
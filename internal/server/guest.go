@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const guestCleanupInterval = time.Minute
+
+// maxGuestTTL limits the lifetime of guest peers, longer access should use a permanent peer.
+const maxGuestTTL = 365 * 24 * time.Hour
+
+// parseGuestTTL converts a lifetime in the given unit (hours or days) to a duration. An empty value returns 0.
+func parseGuestTTL(value, unit string) (time.Duration, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	amount, err := strconv.Atoi(value)
+	if err != nil || amount < 0 {
+		return 0, errors.Errorf("invalid guest lifetime %s", value)
+	}
+
+	ttl := time.Duration(amount) * time.Hour
+	if unit == "days" {
+		ttl *= 24
+	}
+	if ttl > maxGuestTTL {
+		return 0, errors.Errorf("guest peers can live at most %d days", int(maxGuestTTL.Hours()/24))
+	}
+
+	return ttl, nil
+}
+
+// ExtendGuestPeer moves the expiry date of a guest peer. Expired peers cannot be extended, they are deleted by the
+// next cleanup run.
+func (s *Server) ExtendGuestPeer(peer wireguard.Peer, ttl time.Duration, actor string) error {
+	if !peer.IsGuest() {
+		return errors.New("the peer is not a guest peer")
+	}
+	now := time.Now()
+	if peer.ExpiresAt.Before(now) {
+		return errors.New("the peer has already expired")
+	}
+
+	expiresAt := peer.ExpiresAt.Add(ttl)
+	if expiresAt.Sub(now) > maxGuestTTL {
+		return errors.Errorf("guest peers can live at most %d days", int(maxGuestTTL.Hours()/24))
+	}
+	peer.ExpiresAt = &expiresAt
+	peer.UpdatedBy = actor
+	if err := s.UpdatePeer(peer, now); err != nil {
+		return errors.WithMessage(err, "failed to update guest peer")
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "peer.guest_extended", Interface: peer.DeviceName,
+		Target: peer.PublicKey, Details: fmt.Sprintf("%s expires at %s", peer.Identifier, expiresAt.Format(time.RFC3339))})
+
+	return nil
+}
+
+// MakeGuestPeerPermanent removes the expiry date of a guest peer that has not expired yet.
+func (s *Server) MakeGuestPeerPermanent(peer wireguard.Peer, actor string) error {
+	if !peer.IsGuest() {
+		return errors.New("the peer is not a guest peer")
+	}
+	now := time.Now()
+	if peer.ExpiresAt.Before(now) {
+		return errors.New("the peer has already expired")
+	}
+
+	peer.ExpiresAt = nil
+	peer.UpdatedBy = actor
+	if err := s.UpdatePeer(peer, now); err != nil {
+		return errors.WithMessage(err, "failed to update guest peer")
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "peer.guest_converted", Interface: peer.DeviceName,
+		Target: peer.PublicKey, Details: peer.Identifier + " is now a permanent peer"})
+
+	return nil
+}
+
+// DeleteExpiredPeers deletes all expired guest peers from the interfaces and the database. The ip addresses of the
+// deleted peers are free for new peers afterwards. The number of deleted peers is returned.
+func (s *Server) DeleteExpiredPeers() (int, error) {
+	deleted := 0
+	var lastErr error
+	for _, peer := range s.peers.GetExpiredPeers(time.Now()) {
+		peer.UpdatedBy = "guest-cleanup"
+		if err := s.DeletePeer(peer); err != nil {
+			lastErr = errors.WithMessagef(err, "failed to delete expired peer %s", peer.PublicKey)
+			logrus.Errorf("%v", lastErr)
+			continue
+		}
+		deleted++
+
+		// the peer record is gone, so the audit entry keeps everything that is needed to trace the access
+		s.audit.Record(common.AuditEntry{Actor: peer.UpdatedBy, Action: "peer.guest_expired", Interface: peer.DeviceName,
+			Target: peer.PublicKey, Details: fmt.Sprintf("deleted guest peer %s of %s (ips: %s), created by %s at %s, "+
+				"expired at %s", peer.Identifier, peer.Email, peer.IPsStr, peer.CreatedBy,
+				peer.CreatedAt.Format(time.RFC3339), peer.ExpiresAt.Format(time.RFC3339))})
+		s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerExpired, Interface: peer.DeviceName,
+			PeerKey: peer.PublicKey, Actor: peer.UpdatedBy})
+	}
+
+	return deleted, lastErr
+}
+
+// RunGuestPeerCleanup periodically deletes expired guest peers until the given context is cancelled.
+func (s *Server) RunGuestPeerCleanup(ctx context.Context) {
+	ticker := time.NewTicker(guestCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		if count, err := s.DeleteExpiredPeers(); err != nil {
+			logrus.Errorf("guest peer cleanup failed: %v", err)
+		} else if count > 0 {
+			logrus.Infof("guest peer cleanup deleted %d expired peers", count)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -6,35 +6,44 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/h44z/wg-portal/internal/authentication"
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/i18n"
 	"github.com/h44z/wg-portal/internal/users"
 	"github.com/sirupsen/logrus"
-	csrf "github.com/utrack/gin-csrf"
 )
 
+// loginErrorMessages are the messages of the err query parameter of the login page, they are translated by the template.
+var loginErrorMessages = map[string]string{
+	"":            i18n.Mark("Unknown error occurred, try again!"),
+	"missingdata": i18n.Mark("Invalid login data retrieved, please fill out all fields and try again!"),
+	"authfail":    i18n.Mark("Authentication failed!"),
+	"loginreq":    i18n.Mark("Login required!"),
+	"notactive":   i18n.Mark("Your account has not been approved by an administrator!"),
+	"locked":      i18n.Mark("Too many failed login attempts, please try again later!"),
+}
+
 func (s *Server) GetLogin(c *gin.Context) {
 	currentSession := GetSessionData(c)
 	if currentSession.LoggedIn {
-		c.Redirect(http.StatusSeeOther, "/") // already logged in
+		c.Redirect(http.StatusSeeOther, s.urlPath("/")) // already logged in
 	}
 
 	authError := c.DefaultQuery("err", "")
-	errMsg := "Unknown error occurred, try again!"
-	switch authError {
-	case "missingdata":
-		errMsg = "Invalid login data retrieved, please fill out all fields and try again!"
-	case "authfail":
-		errMsg = "Authentication failed!"
-	case "loginreq":
-		errMsg = "Login required!"
+	errMsg, ok := loginErrorMessages[authError]
+	if !ok {
+		errMsg = loginErrorMessages[""]
 	}
 
 	c.HTML(http.StatusOK, "login.html", gin.H{
-		"error":   authError != "",
-		"message": errMsg,
-		"static":  s.getStaticData(),
-		"Csrf":    csrf.GetToken(c),
+		"error":        authError != "",
+		"message":      errMsg,
+		"static":       s.getStaticData(),
+		"Alerts":       GetFlashes(c),
+		"Registration": s.config.Core.SelfRegistration,
+		"Csrf":         s.csrfToken(c),
 	})
 }
 
@@ -42,7 +51,7 @@ func (s *Server) PostLogin(c *gin.Context) {
 	currentSession := GetSessionData(c)
 	if currentSession.LoggedIn {
 		// already logged in
-		c.Redirect(http.StatusSeeOther, "/")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/"))
 		return
 	}
 
@@ -51,12 +60,21 @@ func (s *Server) PostLogin(c *gin.Context) {
 
 	// Validate form input
 	if strings.Trim(username, " ") == "" || strings.Trim(password, " ") == "" {
-		c.Redirect(http.StatusSeeOther, "/auth/login?err=missingdata")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/auth/login?err=missingdata"))
+		return
+	}
+
+	if s.loginGuard.Locked(username, s.clientIP(c), "web") {
+		c.Redirect(http.StatusSeeOther, s.urlPath("/auth/login?err=locked"))
 		return
 	}
 
 	// Check all available auth backends
 	user, err := s.checkAuthentication(username, password)
+	if err == errUserNotActive {
+		c.Redirect(http.StatusSeeOther, s.urlPath("/auth/login?err=notactive"))
+		return
+	}
 	if err != nil {
 		s.GetHandleError(c, http.StatusInternalServerError, "login error", err.Error())
 		return
@@ -64,9 +82,12 @@ func (s *Server) PostLogin(c *gin.Context) {
 
 	// Check if user is authenticated
 	if user == nil {
-		c.Redirect(http.StatusSeeOther, "/auth/login?err=authfail")
+		s.loginGuard.Failed(LoginFailure{Username: username, ClientIP: s.clientIP(c),
+			Provider: s.passwordProviderNames(), Channel: "web"})
+		c.Redirect(http.StatusSeeOther, s.urlPath("/auth/login?err=authfail"))
 		return
 	}
+	s.loginGuard.Succeeded(username)
 
 	// Set authenticated session
 	sessionData := GetSessionData(c)
@@ -75,26 +96,84 @@ func (s *Server) PostLogin(c *gin.Context) {
 	sessionData.Email = user.Email
 	sessionData.Firstname = user.Firstname
 	sessionData.Lastname = user.Lastname
+	sessionData.Theme = user.Theme
 	sessionData.DeviceName = s.wg.Cfg.DeviceNames[0]
 
 	// Check if user already has a peer setup, if not create one
 	if err := s.CreateUserDefaultPeer(user.Email, s.wg.Cfg.GetDefaultDeviceName()); err != nil {
 		// Not a fatal error, just log it...
-		logrus.Errorf("failed to automatically create vpn peer for %s: %v", sessionData.Email, err)
+		common.ContextLogger(c.Request.Context()).Errorf("failed to automatically create vpn peer for %s: %v",
+			sessionData.Email, err)
 	}
 
+	s.rotateCsrfSalt(sessions.Default(c), false) // tokens of the anonymous session are not valid after the login
 	if err := UpdateSessionData(c, sessionData); err != nil {
 		s.GetHandleError(c, http.StatusInternalServerError, "login error", "failed to save session")
 		return
 	}
-	c.Redirect(http.StatusSeeOther, "/")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/"))
 }
 
-func (s *Server) GetLogout(c *gin.Context) {
+func (s *Server) GetRegister(c *gin.Context) {
+	if !s.config.Core.SelfRegistration {
+		s.GetHandleError(c, http.StatusNotFound, "Registration disabled", "Self-registration is not enabled!")
+		return
+	}
+	currentSession := GetSessionData(c)
+	if currentSession.LoggedIn {
+		c.Redirect(http.StatusSeeOther, s.urlPath("/")) // already logged in
+		return
+	}
+
+	form, _ := currentSession.FormData.(RegistrationForm)
+	form.Password, form.PasswordConfirm = "", ""
+
+	c.HTML(http.StatusOK, "register.html", gin.H{
+		"static": s.getStaticData(),
+		"Alerts": GetFlashes(c),
+		"Form":   form,
+		"Policy": s.config.Password,
+		"Csrf":   s.csrfToken(c),
+	})
+}
+
+func (s *Server) PostRegister(c *gin.Context) {
+	if !s.config.Core.SelfRegistration {
+		s.GetHandleError(c, http.StatusNotFound, "Registration disabled", "Self-registration is not enabled!")
+		return
+	}
+	if GetSessionData(c).LoggedIn {
+		c.Redirect(http.StatusSeeOther, s.urlPath("/")) // already logged in
+		return
+	}
+
+	var form RegistrationForm
+	if err := c.ShouldBind(&form); err != nil {
+		form.Password, form.PasswordConfirm = "", ""
+		_ = s.updateFormInSession(c, form)
+		SetFlashMessage(c, "invalid registration data: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/auth/register"))
+		return
+	}
+
+	if err := s.RegisterUser(form); err != nil {
+		form.Password, form.PasswordConfirm = "", ""
+		_ = s.updateFormInSession(c, form)
+		SetFlashMessage(c, "registration failed: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/auth/register"))
+		return
+	}
+
+	_ = s.updateFormInSession(c, nil)
+	SetFlashMessage(c, "registration received, you can log in as soon as an administrator approved your request", "success")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/auth/login"))
+}
+
+func (s *Server) PostLogout(c *gin.Context) {
 	currentSession := GetSessionData(c)
 
 	if !currentSession.LoggedIn { // Not logged in
-		c.Redirect(http.StatusSeeOther, "/")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/"))
 		return
 	}
 
@@ -102,7 +181,86 @@ func (s *Server) GetLogout(c *gin.Context) {
 		s.GetHandleError(c, http.StatusInternalServerError, "logout error", "failed to destroy session")
 		return
 	}
-	c.Redirect(http.StatusSeeOther, "/")
+
+	if s.config.Core.LogoutRedirectUrl != "" {
+		c.Redirect(http.StatusSeeOther, s.config.Core.LogoutRedirectUrl)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/"))
+}
+
+// PostAdminImpersonateUser replaces the session of the administrator by a session of the given user, so the
+// administrator sees the portal like the user does. The impersonated session never has admin scope.
+func (s *Server) PostAdminImpersonateUser(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	user := s.users.GetUser(c.PostForm("email"))
+	switch {
+	case user == nil:
+		SetFlashMessage(c, "invalid user", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
+		return
+	case user.Email == currentSession.Email:
+		SetFlashMessage(c, "you cannot impersonate yourself", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
+		return
+	case !user.IsActive():
+		SetFlashMessage(c, "only active users can be impersonated", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
+		return
+	}
+
+	sessionData := currentSession
+	sessionData.IsAdmin = false
+	sessionData.Email = user.Email
+	sessionData.Firstname = user.Firstname
+	sessionData.Lastname = user.Lastname
+	sessionData.Theme = user.Theme
+	sessionData.ImpersonatedBy = currentSession.Email
+	sessionData.FormData = nil
+	if err := UpdateSessionData(c, sessionData); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "session error", "failed to save session")
+		return
+	}
+	logrus.Infof("%s started impersonating %s", currentSession.Email, user.Email)
+	s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "user.impersonation_started",
+		Target: user.Email})
+
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+}
+
+// PostStopImpersonation returns to the session of the administrator that started the impersonation. If the
+// administrator is no longer valid, the session ends.
+func (s *Server) PostStopImpersonation(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	if currentSession.ImpersonatedBy == "" {
+		c.Redirect(http.StatusSeeOther, s.urlPath("/"))
+		return
+	}
+
+	admin := s.users.GetUser(currentSession.ImpersonatedBy)
+	if admin == nil || !admin.IsActive() || !admin.IsAdmin {
+		_ = DestroySessionData(c)
+		c.Redirect(http.StatusSeeOther, s.urlPath("/auth/login?err=loginreq"))
+		return
+	}
+
+	sessionData := currentSession
+	sessionData.IsAdmin = true
+	sessionData.Email = admin.Email
+	sessionData.Firstname = admin.Firstname
+	sessionData.Lastname = admin.Lastname
+	sessionData.Theme = admin.Theme
+	sessionData.ImpersonatedBy = ""
+	sessionData.FormData = nil
+	if err := UpdateSessionData(c, sessionData); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "session error", "failed to save session")
+		return
+	}
+	logrus.Infof("%s stopped impersonating %s", admin.Email, currentSession.Email)
+	s.audit.Record(common.AuditEntry{Actor: admin.Email, Action: "user.impersonation_stopped",
+		Target: currentSession.Email})
+
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
 }
 
 func (s *Server) checkAuthentication(username, password string) (*users.User, error) {
@@ -121,7 +279,8 @@ func (s *Server) checkAuthentication(username, password string) (*users.User, er
 
 		// Login succeeded
 		user = s.users.GetUser(authEmail)
-		if user != nil {
+		directoryUser := users.UserSource(provider.GetName()) == users.UserSourceLdap
+		if user != nil && (!directoryUser || user.Source != users.UserSourceLdap) {
 			break // user exists, nothing more to do...
 		}
 
@@ -132,14 +291,29 @@ func (s *Server) checkAuthentication(username, password string) (*users.User, er
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to get user model")
 		}
+		if user != nil {
+			// refresh the attributes of directory users
+			user.IsAdmin = userData.IsAdmin
+			user.Username = userData.Username
+			user.DisplayName = userData.DisplayName
+			user.Firstname = userData.Firstname
+			user.Lastname = userData.Lastname
+			user.Phone = userData.Phone
+			if err := s.users.UpdateUser(user); err != nil {
+				return nil, errors.Wrap(err, "failed to update user data")
+			}
+			break
+		}
 		if err := s.CreateUser(users.User{
-			Email:     userData.Email,
-			Source:    users.UserSource(provider.GetName()),
-			IsAdmin:   userData.IsAdmin,
-			Firstname: userData.Firstname,
-			Lastname:  userData.Lastname,
-			Phone:     userData.Phone,
-		}, s.wg.Cfg.GetDefaultDeviceName()); err != nil {
+			Email:       userData.Email,
+			Source:      users.UserSource(provider.GetName()),
+			IsAdmin:     userData.IsAdmin,
+			Username:    userData.Username,
+			DisplayName: userData.DisplayName,
+			Firstname:   userData.Firstname,
+			Lastname:    userData.Lastname,
+			Phone:       userData.Phone,
+		}, s.wg.Cfg.GetDefaultDeviceName(), userData.Email); err != nil {
 			return nil, errors.Wrap(err, "failed to update user data")
 		}
 
@@ -147,5 +321,46 @@ func (s *Server) checkAuthentication(username, password string) (*users.User, er
 		break
 	}
 
+	if user != nil && !user.IsActive() {
+		return nil, errUserNotActive
+	}
+
 	return user, nil
 }
+
+// GetAdminLoginFailures shows the current lockouts and the recent failed logins.
+func (s *Server) GetAdminLoginFailures(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	c.HTML(http.StatusOK, "admin_logins.html", gin.H{
+		"Route":           c.Request.URL.Path,
+		"Alerts":          GetFlashes(c),
+		"Session":         currentSession,
+		"Static":          s.getStaticData(),
+		"Device":          s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames":     s.GetDeviceNames(),
+		"Lockouts":        s.loginGuard.Lockouts(),
+		"Failures":        s.loginGuard.Failures(),
+		"LockoutAttempts": s.config.Core.LoginLockoutAttempts,
+		"LockoutDuration": s.config.Core.LoginLockoutDuration,
+		"Csrf":            s.csrfToken(c),
+	})
+}
+
+// PostAdminClearLockout removes the failure counter of a username or ip address, e.g. for a legitimate user that
+// locked themselves out.
+func (s *Server) PostAdminClearLockout(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	kind, key := c.PostForm("kind"), c.PostForm("key")
+	if (kind != LockoutKindUser && kind != LockoutKindIP) || !s.loginGuard.Clear(kind, key) {
+		SetFlashMessage(c, "the lockout does not exist anymore", "warning")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/logins"))
+		return
+	}
+
+	logrus.Infof("%s cleared the login lockout of %s %s", currentSession.Email, kind, key)
+	s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "login.lockout_cleared",
+		Target: kind + " " + key})
+	SetFlashMessage(c, "lockout of "+key+" cleared", "success")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/logins"))
+}
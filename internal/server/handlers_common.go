@@ -1,27 +1,42 @@
 package server
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/h44z/wg-portal/internal/common"
 	"github.com/h44z/wg-portal/internal/users"
+	"github.com/h44z/wg-portal/internal/wireguard"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func (s *Server) GetHandleError(c *gin.Context, code int, message, details string) {
 	currentSession := GetSessionData(c)
 
+	logger := common.ContextLogger(c.Request.Context()).WithField("status", code)
+	if code >= http.StatusInternalServerError {
+		logger.Errorf("%s: %s", message, details)
+	} else {
+		logger.Debugf("%s: %s", message, details)
+	}
+
 	c.HTML(code, "error.html", gin.H{
 		"Data": gin.H{
-			"Code":    strconv.Itoa(code),
-			"Message": message,
-			"Details": details,
+			"Code":      strconv.Itoa(code),
+			"Message":   message,
+			"Details":   details,
+			"RequestId": getRequestID(c),
 		},
 		"Route":       c.Request.URL.Path,
 		"Session":     GetSessionData(c),
 		"Static":      s.getStaticData(),
+		"Csrf":        s.csrfToken(c),
 		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
 	})
@@ -35,6 +50,7 @@ func (s *Server) GetIndex(c *gin.Context) {
 		"Alerts":      GetFlashes(c),
 		"Session":     currentSession,
 		"Static":      s.getStaticData(),
+		"Csrf":        s.csrfToken(c),
 		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
 	})
@@ -43,71 +59,181 @@ func (s *Server) GetIndex(c *gin.Context) {
 func (s *Server) GetAdminIndex(c *gin.Context) {
 	currentSession := GetSessionData(c)
 
-	sort := c.Query("sort")
-	if sort != "" {
-		if currentSession.SortedBy["peers"] != sort {
-			currentSession.SortedBy["peers"] = sort
-			currentSession.SortDirection["peers"] = "asc"
-		} else {
-			if currentSession.SortDirection["peers"] == "asc" {
-				currentSession.SortDirection["peers"] = "desc"
-			} else {
-				currentSession.SortDirection["peers"] = "asc"
-			}
+	deviceName := c.Query("device")
+	if deviceName != "" {
+		if !common.ListContains(s.wg.Cfg.DeviceNames, deviceName) {
+			s.GetHandleError(c, http.StatusInternalServerError, "device selection error", "no such device")
+			return
 		}
+		currentSession.DeviceName = deviceName
 
 		if err := UpdateSessionData(c, currentSession); err != nil {
-			s.GetHandleError(c, http.StatusInternalServerError, "sort error", "failed to save session")
+			s.GetHandleError(c, http.StatusInternalServerError, "device selection error", "failed to save session")
 			return
 		}
-		c.Redirect(http.StatusSeeOther, "/admin/")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
 		return
 	}
 
-	search, searching := c.GetQuery("search")
-	if searching {
-		currentSession.Search["peers"] = search
-
+	query := getPeerListQuery(c, currentSession)
+	if query.SortKey != currentSession.SortedBy["peers"] || query.SortDirection != currentSession.SortDirection["peers"] ||
+		query.Search != currentSession.Search["peers"] {
+		currentSession.SortedBy["peers"] = query.SortKey
+		currentSession.SortDirection["peers"] = query.SortDirection
+		currentSession.Search["peers"] = query.Search
 		if err := UpdateSessionData(c, currentSession); err != nil {
-			s.GetHandleError(c, http.StatusInternalServerError, "search error", "failed to save session")
+			s.GetHandleError(c, http.StatusInternalServerError, "sort error", "failed to save session")
 			return
 		}
-		c.Redirect(http.StatusSeeOther, "/admin/")
-		return
 	}
 
-	deviceName := c.Query("device")
-	if deviceName != "" {
-		if !common.ListContains(s.wg.Cfg.DeviceNames, deviceName) {
-			s.GetHandleError(c, http.StatusInternalServerError, "device selection error", "no such device")
-			return
+	if interfaceSort, ok := c.GetQuery("interfacesort"); ok && interfaceSort != currentSession.SortedBy["interfaces"] {
+		switch interfaceSort {
+		case HostSummarySortTraffic, HostSummarySortReceive, HostSummarySortTransmit:
+			currentSession.SortDirection["interfaces"] = "desc"
+		default:
+			interfaceSort = "" // configured order
+			currentSession.SortDirection["interfaces"] = "asc"
 		}
-		currentSession.DeviceName = deviceName
-
+		currentSession.SortedBy["interfaces"] = interfaceSort
 		if err := UpdateSessionData(c, currentSession); err != nil {
-			s.GetHandleError(c, http.StatusInternalServerError, "device selection error", "failed to save session")
+			s.GetHandleError(c, http.StatusInternalServerError, "sort error", "failed to save session")
 			return
 		}
-		c.Redirect(http.StatusSeeOther, "/admin/")
-		return
 	}
 
 	device := s.peers.GetDevice(currentSession.DeviceName)
-	users := s.peers.GetFilteredAndSortedPeers(currentSession.DeviceName, currentSession.SortedBy["peers"], currentSession.SortDirection["peers"], currentSession.Search["peers"])
+	pagination := s.getPagination(c, query.Values())
+	users, total := s.peers.GetPeersPage(currentSession.DeviceName, query.ListOptions(pagination))
+	pagination.Total = total
+
+	var drift *DriftReport // only set if the interface was changed outside the portal
+	if report, err := s.GetDriftReport(device.DeviceName); err == nil && report.HasDrift() {
+		drift = &report
+	}
 
 	c.HTML(http.StatusOK, "admin_index.html", gin.H{
+		"Route":         c.Request.URL.Path,
+		"Alerts":        GetFlashes(c),
+		"Session":       currentSession,
+		"Static":        s.getStaticData(),
+		"Peers":         users,
+		"PeerQuery":     query,
+		"Tags":          s.peers.GetAllTags(currentSession.DeviceName),
+		"Duplicates":    s.peers.GetDuplicateIdentifiers(currentSession.DeviceName),
+		"Pagination":    pagination,
+		"TotalPeers":    len(s.peers.GetAllPeers(currentSession.DeviceName)),
+		"Users":         s.users.GetUsers(),
+		"Device":        device,
+		"DeviceNames":   s.GetDeviceNames(),
+		"MailFailures":  s.mailer.GetFailures(),
+		"LoginFailures": s.loginGuard.Summary(time.Now().Add(-24 * time.Hour)),
+		"BulkResult":    s.GetBulkPeerResult(currentSession.DeviceName),
+		"HostSummary":   s.GetHostSummary(currentSession.SortedBy["interfaces"]),
+		"Hosts":         s.wg.GetHostStatuses(),
+		"Drift":         drift,
+		"Csrf":          s.csrfToken(c),
+	})
+}
+
+// GetAdminAuditLog shows the most recent audit entries.
+func (s *Server) GetAdminAuditLog(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	c.HTML(http.StatusOK, "admin_audit.html", gin.H{
 		"Route":       c.Request.URL.Path,
 		"Alerts":      GetFlashes(c),
 		"Session":     currentSession,
 		"Static":      s.getStaticData(),
-		"Peers":       users,
-		"TotalPeers":  len(s.peers.GetAllPeers(currentSession.DeviceName)),
-		"Users":       s.users.GetUsers(),
-		"Device":      device,
+		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
+		"Entries":     s.audit.GetEntries(500),
+		"Csrf":        s.csrfToken(c),
 	})
 }
 
+// GetAdminTraffic shows the monthly traffic of the users in the range of the from and to parameters.
+func (s *Server) GetAdminTraffic(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	trafficRange, err := parseTrafficRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		s.GetHandleError(c, http.StatusBadRequest, "invalid date range", err.Error())
+		return
+	}
+
+	months := s.GetMonthlyTraffic(trafficRange)
+	var total wireguard.UserTrafficMonth
+	for _, month := range months {
+		total.ReceiveBytes += month.ReceiveBytes
+		total.TransmitBytes += month.TransmitBytes
+	}
+
+	c.HTML(http.StatusOK, "admin_traffic.html", gin.H{
+		"Route":          c.Request.URL.Path,
+		"Alerts":         GetFlashes(c),
+		"Session":        currentSession,
+		"Static":         s.getStaticData(),
+		"Device":         s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames":    s.GetDeviceNames(),
+		"Range":          trafficRange,
+		"Months":         months,
+		"Total":          total,
+		"Collecting":     s.config.WG.StatisticsInterval > 0,
+		"DailyRetention": int(s.config.WG.TrafficDailyRetention.Hours() / 24), // in days, 0 keeps all days
+		"Csrf":           s.csrfToken(c),
+	})
+}
+
+// GetAdminTrafficExport downloads the traffic in the range of the from and to parameters as CSV file, or as JSON
+// document with format=json. With period=day, the traffic of the peers per day is exported instead of the monthly
+// traffic of the users.
+func (s *Server) GetAdminTrafficExport(c *gin.Context) {
+	trafficRange, err := parseTrafficRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		s.GetHandleError(c, http.StatusBadRequest, "invalid date range", err.Error())
+		return
+	}
+	period := c.DefaultQuery("period", TrafficPeriodMonth)
+	if period != TrafficPeriodMonth && period != TrafficPeriodDay {
+		s.GetHandleError(c, http.StatusBadRequest, "invalid period", "use month or day")
+		return
+	}
+
+	var months []wireguard.UserTrafficMonth
+	var days []wireguard.PeerTrafficDay
+	if period == TrafficPeriodDay {
+		days = s.GetDailyTraffic(trafficRange)
+	} else {
+		months = s.GetMonthlyTraffic(trafficRange)
+	}
+
+	filename := fmt.Sprintf("traffic-%s-%s-%s", period, trafficRange.From.Format(wireguard.TrafficDayFormat),
+		trafficRange.To.Format(wireguard.TrafficDayFormat))
+	switch c.DefaultQuery("format", "csv") {
+	case "json":
+		c.Header("Content-Disposition", "attachment; filename="+filename+".json")
+		entries := interface{}(months)
+		if days != nil {
+			entries = days
+		}
+		c.IndentedJSON(http.StatusOK, gin.H{
+			"From":    trafficRange.From.Format(wireguard.TrafficDayFormat),
+			"To":      trafficRange.To.Format(wireguard.TrafficDayFormat),
+			"Period":  period,
+			"Entries": entries,
+		})
+	case "csv":
+		c.Header("Content-Disposition", "attachment; filename="+filename+".csv")
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := writeTrafficCSV(c.Writer, months, days); err != nil {
+			common.ContextLogger(c.Request.Context()).Errorf("failed to write traffic export: %v", err)
+		}
+	default:
+		s.GetHandleError(c, http.StatusBadRequest, "invalid format", "use csv or json")
+	}
+}
+
 func (s *Server) GetUserIndex(c *gin.Context) {
 	currentSession := GetSessionData(c)
 
@@ -128,7 +254,7 @@ func (s *Server) GetUserIndex(c *gin.Context) {
 			s.GetHandleError(c, http.StatusInternalServerError, "sort error", "failed to save session")
 			return
 		}
-		c.Redirect(http.StatusSeeOther, "/admin")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
 		return
 	}
 
@@ -144,9 +270,48 @@ func (s *Server) GetUserIndex(c *gin.Context) {
 		"Users":       []users.User{*s.users.GetUser(currentSession.Email)},
 		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
+		"SelfService": s.config.Core.SelfProvisioningAllowed,
+		"Csrf":        s.csrfToken(c),
+
+		"SelfServiceDevices": s.GetSelfServiceDevices(),
+		"ApiTokens":          s.GetApiTokens(currentSession.Email),
 	})
 }
 
+// PostUserCreateApiToken creates an API token for the logged in user. The token is only shown once.
+func (s *Server) PostUserCreateApiToken(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	if currentSession.ImpersonatedBy != "" {
+		SetFlashMessage(c, "API tokens cannot be created while impersonating a user", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+		return
+	}
+
+	token, _, err := s.CreateApiToken(currentSession.Email, c.PostForm("name"), c.PostForm("scope"))
+	if err != nil {
+		SetFlashMessage(c, "failed to create API token: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, "API token (it will not be shown again): "+token, "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+}
+
+// PostUserDeleteApiToken revokes an API token of the logged in user.
+func (s *Server) PostUserDeleteApiToken(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	id, err := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	if err == nil {
+		err = s.DeleteApiToken(currentSession.Email, uint(id))
+	}
+	if err != nil {
+		SetFlashMessage(c, "failed to delete API token: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, "API token deleted", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+}
+
 func (s *Server) updateFormInSession(c *gin.Context, formData interface{}) error {
 	currentSession := GetSessionData(c)
 	currentSession.FormData = formData
@@ -184,6 +349,7 @@ func (s *Server) setFormInSession(c *gin.Context, formData interface{}) (Session
 	// If url contains a formerr parameter reset the form
 	if currentSession.FormData == nil || c.Query("formerr") == "" {
 		currentSession.FormData = formData
+		currentSession.PendingChange = nil
 	}
 
 	if err := UpdateSessionData(c, currentSession); err != nil {
@@ -193,9 +359,218 @@ func (s *Server) setFormInSession(c *gin.Context, formData interface{}) (Session
 	return currentSession, nil
 }
 
+// isUserStillValid reports whether the user of a session still exists and is active, see userValidityCache.
 func (s *Server) isUserStillValid(email string) bool {
-	if s.users.GetUser(email) == nil {
-		return false
+	active, _ := s.userValidity.Get(email)
+	return active
+}
+
+func (s *Server) isAdminStillValid(email string) bool {
+	active, admin := s.userValidity.Get(email)
+	return active && admin
+}
+
+func (s *Server) GetAdminBranding(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	c.HTML(http.StatusOK, "admin_branding.html", gin.H{
+		"Route":       c.Request.URL.Path,
+		"Alerts":      GetFlashes(c),
+		"Session":     currentSession,
+		"Static":      s.getStaticData(),
+		"Device":      s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames": s.GetDeviceNames(),
+		"Branding":    s.branding.get(),
+		"MaxLogoKiB":  maxBrandingLogoSize >> 10,
+		"Csrf":        s.csrfToken(c),
+	})
+}
+
+// PostAdminBranding stores the primary color and the custom CSS, and the logo if one was uploaded.
+func (s *Server) PostAdminBranding(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	var logo []byte
+	if file, err := c.FormFile("logo"); err == nil {
+		if file.Size > maxBrandingLogoSize {
+			SetFlashMessage(c, "the logo is too large", "danger")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/branding"))
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			s.GetHandleError(c, http.StatusInternalServerError, "Upload error", err.Error())
+			return
+		}
+		logo, err = ioutil.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			s.GetHandleError(c, http.StatusInternalServerError, "Upload error", err.Error())
+			return
+		}
+	}
+
+	if err := s.SaveBranding(c.PostForm("primarycolor"), c.PostForm("customcss"), logo, currentSession.Email); err != nil {
+		SetFlashMessage(c, err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/branding"))
+		return
 	}
-	return true
+	s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "branding.updated"})
+
+	SetFlashMessage(c, "Branding saved", "success")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/branding"))
+}
+
+// PostAdminResetBranding removes the uploaded logo, the color and the custom CSS.
+func (s *Server) PostAdminResetBranding(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	if err := s.ResetBranding(); err != nil {
+		SetFlashMessage(c, err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/branding"))
+		return
+	}
+	s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "branding.reset"})
+
+	SetFlashMessage(c, "Branding reset to the defaults", "success")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/branding"))
+}
+
+// GetBrandingLogo serves the uploaded logo, no login is required.
+func (s *Server) GetBrandingLogo(c *gin.Context) {
+	branding := s.branding.get()
+	if branding.LogoType == "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=86400") // the url changes with every upload
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, branding.LogoType, branding.Logo)
+}
+
+// GetAdminBackup shows the settings of the scheduled backups and the download and restore forms.
+func (s *Server) GetAdminBackup(c *gin.Context) {
+	s.renderBackup(c, nil)
+}
+
+func (s *Server) renderBackup(c *gin.Context, result *BackupRestoreResult) {
+	currentSession := GetSessionData(c)
+
+	stored, newest := []string{}, ""
+	if s.config.Core.BackupDirectory != "" {
+		var err error
+		if stored, err = s.StoredBackups(); err != nil {
+			logrus.Errorf("failed to list backups: %v", err)
+		}
+	}
+	if len(stored) > 0 {
+		newest = stored[len(stored)-1]
+	}
+
+	c.HTML(http.StatusOK, "admin_backup.html", gin.H{
+		"Route":         c.Request.URL.Path,
+		"Alerts":        GetFlashes(c),
+		"Session":       currentSession,
+		"Static":        s.getStaticData(),
+		"Device":        s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames":   s.GetDeviceNames(),
+		"Backup":        s.config.Core,
+		"StoredBackups": stored,
+		"NewestBackup":  newest,
+		"KeysAvailable": s.keyCipher != nil,
+		"Confirmation":  backupConfirmation,
+		"Result":        result,
+		"Csrf":          s.csrfToken(c),
+	})
+}
+
+// GetAdminBackupDownload creates a backup and downloads the archive, with keys=true the encrypted keys are included.
+func (s *Server) GetAdminBackupDownload(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	backup, err := s.CreateBackup(c.Query("keys") == "true", currentSession.Email)
+	if err != nil {
+		SetFlashMessage(c, "failed to create backup: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/backup"))
+		return
+	}
+	var archive bytes.Buffer
+	if err := WriteBackupArchive(&archive, backup); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Backup error", err.Error())
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+backupFileName(backup.CreatedAt))
+	c.Data(http.StatusOK, "application/gzip", archive.Bytes())
+}
+
+// PostAdminBackupRestore restores an uploaded backup archive and shows the conflict report. Unless it is a dry run,
+// the restore has to be confirmed by entering the confirmation word.
+func (s *Server) PostAdminBackupRestore(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	dryRun := c.PostForm("dryrun") != ""
+	overwrite := c.PostForm("overwrite") != ""
+
+	if !dryRun && c.PostForm("confirmation") != backupConfirmation {
+		SetFlashMessage(c, "enter "+backupConfirmation+" to confirm the restore", "warning")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/backup"))
+		return
+	}
+	file, err := c.FormFile("archive")
+	if err != nil {
+		SetFlashMessage(c, "no backup archive uploaded", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/backup"))
+		return
+	}
+	if file.Size > maxBackupSize {
+		SetFlashMessage(c, "backup archive is too large", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/backup"))
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Upload error", err.Error())
+		return
+	}
+	backup, err := ReadBackupArchive(f)
+	_ = f.Close()
+	if err != nil {
+		SetFlashMessage(c, err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/backup"))
+		return
+	}
+
+	result, err := s.RestoreBackup(backup, overwrite, dryRun, currentSession.Email)
+	if err != nil {
+		SetFlashMessage(c, "failed to restore backup: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/backup"))
+		return
+	}
+	if !dryRun {
+		logrus.Infof("%s restored a backup of %s", currentSession.Email, backup.CreatedAt.Format(time.RFC3339))
+	}
+	s.renderBackup(c, &result)
+}
+
+// changePreviewView is the confirmation page of an edit, see ChangePreview.
+type changePreviewView struct {
+	Title   string
+	Preview ChangePreview
+	Confirm string // the form action that applies the change
+	Back    string // the edit form with the submitted values
+}
+
+func (s *Server) renderChangePreview(c *gin.Context, view changePreviewView) {
+	currentSession := GetSessionData(c)
+
+	c.HTML(http.StatusOK, "admin_change_preview.html", gin.H{
+		"Route":       c.Request.URL.Path,
+		"Alerts":      GetFlashes(c),
+		"Session":     currentSession,
+		"Static":      s.getStaticData(),
+		"Device":      s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames": s.GetDeviceNames(),
+		"View":        view,
+		"Csrf":        s.csrfToken(c),
+	})
 }
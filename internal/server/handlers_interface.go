@@ -1,14 +1,20 @@
 package server
 
 import (
+	"archive/zip"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/h44z/wg-portal/internal/common"
 	"github.com/h44z/wg-portal/internal/wireguard"
-	csrf "github.com/utrack/gin-csrf"
+	"github.com/pkg/errors"
 )
 
 func (s *Server) GetAdminEditInterface(c *gin.Context) {
@@ -21,17 +27,30 @@ func (s *Server) GetAdminEditInterface(c *gin.Context) {
 	}
 
 	c.HTML(http.StatusOK, "admin_edit_interface.html", gin.H{
-		"Route":        c.Request.URL.Path,
-		"Alerts":       GetFlashes(c),
-		"Session":      currentSession,
-		"Static":       s.getStaticData(),
-		"Device":       currentSession.FormData.(wireguard.Device),
-		"EditableKeys": s.config.Core.EditableKeys,
-		"DeviceNames":  s.GetDeviceNames(),
-		"Csrf":         csrf.GetToken(c),
+		"Route":           c.Request.URL.Path,
+		"Alerts":          GetFlashes(c),
+		"Session":         currentSession,
+		"Static":          s.getStaticData(),
+		"Device":          currentSession.FormData.(wireguard.Device),
+		"EditableKeys":    s.config.Core.EditableKeys,
+		"External":        s.wg.IsExternalDevice(device.DeviceName),
+		"DeviceNames":     s.GetDeviceNames(),
+		"Presets":         s.peers.GetAllowedIPsPresets(device.DeviceName),
+		"Reservations":    s.peers.GetIPReservations(device.DeviceName),
+		"PeerCount":       s.peers.CountPeers(device.DeviceName),
+		"CanDelete":       s.config.WG.ManageInterfaces && len(s.config.WG.DeviceNames) > 1,
+		"ManageFirewall":  s.config.WG.ManageFirewall,
+		"PeerDefaults":    s.config.WG.PeerDefaults,
+		"ConfigDirectory": s.config.WG.ConfigDirectoryPath,
+		"ExecuteHooks":    s.config.WG.ExecuteHooks,
+		"ManageRoutes":    s.config.WG.ManageRoutes,
+		"RouteWarnings":   s.GetRouteWarnings(device.DeviceName),
+		"Csrf":            s.csrfToken(c),
 	})
 }
 
+// PostAdminEditInterface shows the changes of the submitted interface settings, they are applied once they are
+// confirmed, see PostAdminConfirmEditInterface.
 func (s *Server) PostAdminEditInterface(c *gin.Context) {
 	currentSession := GetSessionData(c)
 	var formDevice wireguard.Device
@@ -39,73 +58,160 @@ func (s *Server) PostAdminEditInterface(c *gin.Context) {
 		formDevice = currentSession.FormData.(wireguard.Device)
 	}
 	if err := c.ShouldBind(&formDevice); err != nil {
+		if addressErr := validateDeviceAddresses(c.PostForm("ip")); addressErr != nil {
+			err = addressErr // more helpful than the generic validation error
+		}
 		_ = s.updateFormInSession(c, formDevice)
 		SetFlashMessage(c, err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/device/edit?formerr=bind")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit?formerr=bind"))
 		return
 	}
-	// Clean list input
-	formDevice.IPsStr = common.ListToString(common.ParseStringList(formDevice.IPsStr))
-	formDevice.DefaultAllowedIPsStr = common.ListToString(common.ParseStringList(formDevice.DefaultAllowedIPsStr))
-	formDevice.DNSStr = common.ListToString(common.ParseStringList(formDevice.DNSStr))
+	formDevice.GeneratePresharedKeys = c.PostForm("generatepsk") != ""
+	formDevice.SelfService = c.PostForm("selfservice") != ""
+	formDevice.InheritDNS = c.PostForm("inheritdns") != ""
+	formDevice.InheritAllowedIPs = c.PostForm("inheritallowedip") != ""
+	formDevice.InheritKeepalive = c.PostForm("inheritkeepalive") != ""
+	formDevice.DisableConfigFile = c.PostForm("writeconfigfile") == ""
 
-	// Clean interface parameters based on interface type
-	switch formDevice.Type {
-	case wireguard.DeviceTypeClient:
-		formDevice.ListenPort = 0
-		formDevice.DefaultEndpoint = ""
-		formDevice.DefaultAllowedIPsStr = ""
-		formDevice.DefaultPersistentKeepalive = 0
-		formDevice.SaveConfig = false
-	case wireguard.DeviceTypeServer:
+	regenerateKey := c.PostForm("regeneratekey") != ""
+	preview, err := s.PreviewDeviceChange(formDevice, regenerateKey)
+	if err != nil {
+		s.redirectInterfaceEditError(c, formDevice, err)
+		return
 	}
 
-	// Update WireGuard device
-	err := s.wg.UpdateDevice(formDevice.DeviceName, formDevice.GetConfig())
-	if err != nil {
-		_ = s.updateFormInSession(c, formDevice)
-		SetFlashMessage(c, "Failed to update device in WireGuard: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/device/edit?formerr=wg")
+	currentSession.FormData = formDevice
+	currentSession.PendingChange = &PendingChange{
+		Kind:          PendingChangeInterface,
+		Key:           formDevice.DeviceName,
+		UpdatedAt:     s.peers.GetDevice(formDevice.DeviceName).UpdatedAt,
+		RegenerateKey: regenerateKey,
+		ApplyToPeers:  c.PostForm("applytopeers") != "",
+	}
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Session error", err.Error())
 		return
 	}
 
-	// Update in database
-	err = s.peers.UpdateDevice(formDevice)
-	if err != nil {
-		_ = s.updateFormInSession(c, formDevice)
-		SetFlashMessage(c, "Failed to update device in database: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/device/edit?formerr=update")
+	s.renderChangePreview(c, changePreviewView{
+		Title:   "Interface " + formDevice.DeviceName,
+		Preview: preview,
+		Confirm: "/admin/device/edit/confirm",
+		Back:    "/admin/device/edit?formerr=preview",
+	})
+}
+
+// PostAdminConfirmEditInterface applies the interface settings that were shown by PostAdminEditInterface.
+func (s *Server) PostAdminConfirmEditInterface(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	formDevice, ok := currentSession.FormData.(wireguard.Device)
+	pending := currentSession.PendingChange
+	if !ok || pending == nil || pending.Kind != PendingChangeInterface || pending.Key != formDevice.DeviceName {
+		SetFlashMessage(c, "There are no interface changes to confirm.", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+	currentDevice := s.peers.GetDevice(formDevice.DeviceName)
+	if !currentDevice.UpdatedAt.Equal(pending.UpdatedAt) {
+		SetFlashMessage(c, "The interface was changed after the preview, review the changes again.", "warning")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit?formerr=preview"))
+		return
+	}
+	currentSession.PendingChange = nil
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Session error", err.Error())
 		return
 	}
 
-	// Update WireGuard config file
-	err = s.WriteWireGuardConfigFile(currentSession.DeviceName)
+	warnings, err := s.UpdateDeviceSettings(formDevice, pending.RegenerateKey, currentSession.Email)
 	if err != nil {
-		_ = s.updateFormInSession(c, formDevice)
-		SetFlashMessage(c, "Failed to update WireGuard config-file: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/device/edit?formerr=update")
+		s.redirectInterfaceEditError(c, formDevice, err)
 		return
 	}
 
-	// Update interface IP address
-	if s.config.WG.ManageIPAddresses {
-		if err := s.wg.SetIPAddress(currentSession.DeviceName, formDevice.GetIPAddresses()); err != nil {
-			_ = s.updateFormInSession(c, formDevice)
-			SetFlashMessage(c, "Failed to update ip address: "+err.Error(), "danger")
-			c.Redirect(http.StatusSeeOther, "/admin/device/edit?formerr=update")
-		}
-		if err := s.wg.SetMTU(currentSession.DeviceName, formDevice.Mtu); err != nil {
-			_ = s.updateFormInSession(c, formDevice)
-			SetFlashMessage(c, "Failed to update MTU: "+err.Error(), "danger")
-			c.Redirect(http.StatusSeeOther, "/admin/device/edit?formerr=update")
-		}
+	SetFlashMessage(c, "Changes applied successfully!", "success")
+	for _, warning := range warnings {
+		SetFlashMessage(c, warning, "warning")
+	}
+	if formDevice.TunnelMode != currentDevice.TunnelMode && !pending.ApplyToPeers {
+		SetFlashMessage(c, "The tunnel mode only applies to new peers, apply the peer defaults to update the "+
+			"existing peers.", "info")
 	}
+	if formDevice.Type == wireguard.DeviceTypeServer && pending.ApplyToPeers {
+		// Review the changes of the existing peers before the peer defaults are applied
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/applyglobals"))
+		return
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+}
 
-	SetFlashMessage(c, "Changes applied successfully!", "success")
-	if !s.config.WG.ManageIPAddresses {
-		SetFlashMessage(c, "WireGuard must be restarted to apply ip changes.", "warning")
+// redirectInterfaceEditError returns to the interface form, the step of a DeviceUpdateError selects the field.
+func (s *Server) redirectInterfaceEditError(c *gin.Context, formDevice wireguard.Device, err error) {
+	step := "update"
+	var updateErr *DeviceUpdateError
+	if errors.As(err, &updateErr) {
+		step = updateErr.Step
+	}
+	_ = s.updateFormInSession(c, formDevice)
+	SetFlashMessage(c, err.Error(), "danger")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit?formerr="+step))
+}
+
+// GetAdminInterfaceSummary returns the summaries of all managed interfaces as JSON.
+func (s *Server) GetAdminInterfaceSummary(c *gin.Context) {
+	c.JSON(http.StatusOK, s.GetInterfaceSummaries())
+}
+
+// PostAdminInterfaceState disables, enables or restarts the current interface.
+func (s *Server) PostAdminInterfaceState(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	var err error
+	var message string
+	switch c.PostForm("action") {
+	case "disable":
+		err = s.SetDeviceDisabled(currentSession.DeviceName, true, currentSession.Email)
+		message = "Interface disabled, the settings and peers are kept."
+	case "enable":
+		err = s.SetDeviceDisabled(currentSession.DeviceName, false, currentSession.Email)
+		message = "Interface enabled."
+	case "restart":
+		err = s.RestartDevice(currentSession.DeviceName, currentSession.Email)
+		message = "Interface restarted."
+	default:
+		err = errors.New("unknown action")
+	}
+	if err != nil {
+		SetFlashMessage(c, "Failed to change the interface state: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, message, "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+}
+
+// PostAdminDeleteInterface deletes the current interface with all of its peers. The form contains the typed interface
+// name and the number of peers that was shown in the confirmation.
+func (s *Server) PostAdminDeleteInterface(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	deviceName := currentSession.DeviceName
+	confirmedPeers, _ := strconv.ParseInt(c.PostForm("peers"), 10, 64)
+
+	err := s.DeleteDevice(deviceName, strings.TrimSpace(c.PostForm("confirm")), confirmedPeers, currentSession.Email)
+	if err != nil {
+		SetFlashMessage(c, "Failed to delete interface: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+
+	currentSession.DeviceName = s.wg.Cfg.GetDefaultDeviceName()
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Session error", err.Error())
+		return
 	}
-	c.Redirect(http.StatusSeeOther, "/admin/device/edit")
+	SetFlashMessage(c, fmt.Sprintf("Interface %s and its %d peers deleted.", deviceName, confirmedPeers), "success")
+	SetFlashMessage(c, "Remove the interface from the configured devices, otherwise it is created again on the next start.",
+		"warning")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
 }
 
 func (s *Server) GetInterfaceConfig(c *gin.Context) {
@@ -125,53 +231,697 @@ func (s *Server) GetInterfaceConfig(c *gin.Context) {
 	return
 }
 
-func (s *Server) GetSaveConfig(c *gin.Context) {
+// GetAdminInterfacePeerConfigs streams a zip archive with the configuration files of all peers of the interface. With
+// qrcodes=true the archive also contains the QR codes. The archive is written directly to the response because
+// interfaces can have a lot of peers.
+func (s *Server) GetAdminInterfacePeerConfigs(c *gin.Context) {
+	deviceName := c.Param("id")
+	if !common.ListContains(s.config.WG.DeviceNames, deviceName) {
+		s.GetHandleError(c, http.StatusNotFound, "Interface not found", "The requested interface does not exist!")
+		return
+	}
+	device := s.peers.GetDevice(deviceName)
+	peers := s.peers.GetAllPeers(deviceName)
+	withQRCodes := c.Query("qrcodes") == "true"
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", "attachment; filename=\""+strings.ToLower(deviceName)+"-configs.zip\"")
+	c.Status(http.StatusOK)
+
+	logger := common.ContextLogger(c.Request.Context())
+	archive := zip.NewWriter(c.Writer)
+	usedNames := make(map[string]int, len(peers))
+	for _, peer := range peers {
+		cfg, err := peer.GetConfigFile(device)
+		if err != nil {
+			logger.Errorf("failed to create configuration of peer %s: %v", peer.PublicKey, err)
+			continue
+		}
+
+		name := archiveFileName(peer)
+		if usedNames[name]++; usedNames[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, usedNames[name])
+		}
+
+		if err := writeZipFile(archive, name+".conf", cfg); err != nil {
+			logger.Errorf("failed to stream peer configurations of %s: %v", deviceName, err)
+			return // the client is gone, the archive can not be completed
+		}
+		if !withQRCodes {
+			continue
+		}
+		peer.Config = string(cfg)
+		png, err := peer.GetQRCode()
+		if err != nil {
+			continue // the configuration is part of the archive anyway
+		}
+		if err := writeZipFile(archive, name+".png", png); err != nil {
+			logger.Errorf("failed to stream peer configurations of %s: %v", deviceName, err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		logger.Errorf("failed to stream peer configurations of %s: %v", deviceName, err)
+	}
+}
+
+var archiveNameRegex = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+// archiveFileName returns <user>_<peer> for a peer, the user part is the local part of the email address.
+func archiveFileName(peer wireguard.Peer) string {
+	user := peer.Email
+	if idx := strings.Index(user, "@"); idx >= 0 {
+		user = user[:idx]
+	}
+	user = archiveNameRegex.ReplaceAllString(user, "")
+	if user == "" {
+		user = "nouser"
+	}
+	return user + "_" + strings.TrimSuffix(peer.GetConfigFileName(), ".conf")
+}
+
+func writeZipFile(archive *zip.Writer, name string, data []byte) error {
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (s *Server) PostSaveConfig(c *gin.Context) {
 	currentSession := GetSessionData(c)
 
 	err := s.WriteWireGuardConfigFile(currentSession.DeviceName)
 	if err != nil {
 		SetFlashMessage(c, "Failed to save WireGuard config-file: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
 		return
 	}
 
 	SetFlashMessage(c, "Updated WireGuard config-file", "success")
-	c.Redirect(http.StatusSeeOther, "/admin/")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
 	return
 }
 
+// GetApplyGlobalConfig shows the peers that change if the peer defaults of the interface are applied.
 func (s *Server) GetApplyGlobalConfig(c *gin.Context) {
 	currentSession := GetSessionData(c)
 	device := s.peers.GetDevice(currentSession.DeviceName)
-	peers := s.peers.GetAllPeers(device.DeviceName)
 
 	if device.Type == wireguard.DeviceTypeClient {
 		SetFlashMessage(c, "Cannot apply global configuration while interface is in client mode.", "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/device/edit")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
 		return
 	}
 
-	updateCounter := 0
-	for _, peer := range peers {
-		if peer.IgnoreGlobalSettings {
+	c.HTML(http.StatusOK, "admin_apply_defaults.html", gin.H{
+		"Route":       c.Request.URL.Path,
+		"Alerts":      GetFlashes(c),
+		"Session":     currentSession,
+		"Static":      s.getStaticData(),
+		"Device":      device,
+		"Changes":     s.PreviewDeviceDefaults(device.DeviceName),
+		"DeviceNames": s.GetDeviceNames(),
+		"Csrf":        s.csrfToken(c),
+	})
+}
+
+// PostApplyGlobalConfig applies the peer defaults of the interface to its peers.
+func (s *Server) PostApplyGlobalConfig(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	device := s.peers.GetDevice(currentSession.DeviceName)
+
+	if device.Type == wireguard.DeviceTypeClient {
+		SetFlashMessage(c, "Cannot apply global configuration while interface is in client mode.", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+
+	updateCounter, err := s.ApplyDeviceDefaultsToPeers(device.DeviceName)
+	if updateCounter > 0 {
+		s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "interface.defaults_applied",
+			Interface: device.DeviceName, Details: fmt.Sprintf("%d peers", updateCounter)})
+	}
+	if err != nil {
+		SetFlashMessage(c, fmt.Sprintf("Peer defaults applied to %d clients, then failed: %v", updateCounter, err), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+	if err := s.WriteWireGuardConfigFile(device.DeviceName); err != nil {
+		SetFlashMessage(c, "Failed to update WireGuard config-file: "+err.Error(), "danger")
+	}
+
+	SetFlashMessage(c, fmt.Sprintf("Global configuration updated for %d clients.", updateCounter), "success")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+}
+
+// GetAdminInactivePeers lists the peers that would be disabled by the inactivity check (dry-run).
+func (s *Server) GetAdminInactivePeers(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	device := s.peers.GetDevice(currentSession.DeviceName)
+
+	c.HTML(http.StatusOK, "admin_inactive_peers.html", gin.H{
+		"Route":         c.Request.URL.Path,
+		"Alerts":        GetFlashes(c),
+		"Session":       currentSession,
+		"Static":        s.getStaticData(),
+		"Csrf":          s.csrfToken(c),
+		"Device":        device,
+		"DeviceNames":   s.GetDeviceNames(),
+		"InactivePeers": s.GetInactivePeers(device.DeviceName),
+		"Duplicates":    s.peers.GetDuplicateIdentifiers(device.DeviceName),
+		"ExemptAdmins":  s.config.WG.InactivityExemptAdmins,
+	})
+}
+
+// PostAdminDisableInactivePeers runs the inactivity check for the current interface immediately.
+func (s *Server) PostAdminDisableInactivePeers(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	count, err := s.DisableInactivePeers(currentSession.DeviceName)
+	if err != nil {
+		SetFlashMessage(c, fmt.Sprintf("Disabled %d inactive peers, some peers could not be disabled: %v", count, err), "danger")
+	} else {
+		SetFlashMessage(c, fmt.Sprintf("Disabled %d inactive peers", count), "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/inactive"))
+}
+
+// PostAdminAllowedIPsPreset creates or updates an allowed IPs preset of the current interface.
+func (s *Server) PostAdminAllowedIPsPreset(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	var preset wireguard.AllowedIPsPreset
+	if err := c.ShouldBind(&preset); err != nil {
+		SetFlashMessage(c, "invalid preset: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+	if preset.ID != 0 {
+		currentPreset, err := s.peers.GetAllowedIPsPreset(preset.ID)
+		if err != nil || currentPreset.DeviceName != currentSession.DeviceName {
+			SetFlashMessage(c, "preset not found", "danger")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+			return
+		}
+		preset.CreatedAt = currentPreset.CreatedAt
+	}
+	preset.DeviceName = currentSession.DeviceName
+
+	updated, err := s.SaveAllowedIPsPreset(preset, c.PostForm("applytopeers") != "", currentSession.Email)
+	switch {
+	case err != nil:
+		SetFlashMessage(c, "failed to save preset: "+err.Error(), "danger")
+	case updated > 0:
+		SetFlashMessage(c, fmt.Sprintf("preset %s saved, updated %d clients", preset.Name, updated), "success")
+	default:
+		SetFlashMessage(c, "preset "+preset.Name+" saved", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+}
+
+// PostAdminDeleteAllowedIPsPreset deletes an allowed IPs preset, clients that used it keep their current allowed IPs.
+func (s *Server) PostAdminDeleteAllowedIPsPreset(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	id, _ := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	preset, err := s.peers.GetAllowedIPsPreset(uint(id))
+	if err != nil || preset.DeviceName != currentSession.DeviceName {
+		SetFlashMessage(c, "preset not found", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+
+	if err := s.peers.DeleteAllowedIPsPreset(preset.ID); err != nil {
+		SetFlashMessage(c, "failed to delete preset: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, "preset "+preset.Name+" deleted", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+}
+
+// PostAdminIPReservation creates or updates an ip reservation of the current interface. Existing peers keep their
+// addresses, the reservation applies to peers that are created afterwards.
+func (s *Server) PostAdminIPReservation(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	var reservation wireguard.IPReservation
+	if err := c.ShouldBind(&reservation); err != nil {
+		SetFlashMessage(c, "invalid reservation: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+	reservation.CreatedBy = currentSession.Email
+	if reservation.ID != 0 {
+		currentReservation, err := s.peers.GetIPReservation(reservation.ID)
+		if err != nil || currentReservation.DeviceName != currentSession.DeviceName {
+			SetFlashMessage(c, "reservation not found", "danger")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+			return
+		}
+		reservation.CreatedBy = currentReservation.CreatedBy
+		reservation.CreatedAt = currentReservation.CreatedAt
+	}
+	reservation.DeviceName = currentSession.DeviceName
+
+	if err := s.peers.SaveIPReservation(&reservation); err != nil {
+		SetFlashMessage(c, "failed to save reservation: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+	s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "reservation.saved",
+		Interface: reservation.DeviceName, Target: reservation.Network, Details: reservation.Owner()})
+
+	SetFlashMessage(c, "reservation "+reservation.Network+" saved", "success")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+}
+
+// PostAdminDeleteIPReservation deletes an ip reservation, peers that use the reserved addresses keep them.
+func (s *Server) PostAdminDeleteIPReservation(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	id, _ := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	reservation, err := s.peers.GetIPReservation(uint(id))
+	if err != nil || reservation.DeviceName != currentSession.DeviceName {
+		SetFlashMessage(c, "reservation not found", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+		return
+	}
+
+	if err := s.peers.DeleteIPReservation(reservation.ID); err != nil {
+		SetFlashMessage(c, "failed to delete reservation: "+err.Error(), "danger")
+	} else {
+		s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "reservation.deleted",
+			Interface: reservation.DeviceName, Target: reservation.Network, Details: reservation.Owner()})
+		SetFlashMessage(c, "reservation "+reservation.Network+" deleted", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/edit"))
+}
+
+// GetAdminOrphanedPeers lists the peers of the physical interface that are not stored in the database.
+func (s *Server) GetAdminOrphanedPeers(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	device := s.peers.GetDevice(currentSession.DeviceName)
+
+	report, err := s.GetDriftReport(device.DeviceName)
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "WireGuard error", err.Error())
+		return
+	}
+
+	c.HTML(http.StatusOK, "admin_orphaned_peers.html", gin.H{
+		"Route":       c.Request.URL.Path,
+		"Alerts":      GetFlashes(c),
+		"Session":     currentSession,
+		"Static":      s.getStaticData(),
+		"Device":      device,
+		"DeviceNames": s.GetDeviceNames(),
+		"Report":      report,
+		"Users":       s.users.GetUsers(),
+		"Csrf":        s.csrfToken(c),
+	})
+}
+
+// orphanedPeerKeys returns the submitted public key, or all orphaned peers of the interface if no key was submitted.
+func (s *Server) orphanedPeerKeys(c *gin.Context, device string) ([]string, error) {
+	if publicKey := c.PostForm("pkey"); publicKey != "" {
+		return []string{publicKey}, nil
+	}
+
+	orphans, err := s.peers.GetOrphanedPeers(device)
+	if err != nil {
+		return nil, err
+	}
+	publicKeys := make([]string, len(orphans))
+	for i := range orphans {
+		publicKeys[i] = orphans[i].PublicKey.String()
+	}
+	return publicKeys, nil
+}
+
+// PostAdminAdoptOrphanedPeers creates database entries for one (pkey) or all orphaned peers of the current interface.
+func (s *Server) PostAdminAdoptOrphanedPeers(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	publicKeys, err := s.orphanedPeerKeys(c, currentSession.DeviceName)
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "WireGuard error", err.Error())
+		return
+	}
+
+	adopted := 0
+	var errs []string
+	for _, publicKey := range publicKeys {
+		_, err := s.AdoptOrphanedPeer(currentSession.DeviceName, publicKey, c.PostForm("heuristic"),
+			c.PostForm("email"), currentSession.Email)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		adopted++
+	}
+
+	if len(errs) > 0 {
+		SetFlashMessage(c, fmt.Sprintf("Adopted %d peers, failed: %s", adopted, strings.Join(errs, "; ")), "danger")
+	} else {
+		SetFlashMessage(c, fmt.Sprintf("Adopted %d peers", adopted), "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/orphans"))
+}
+
+// PostAdminRemoveOrphanedPeers removes one (pkey) or all orphaned peers from the current physical interface.
+func (s *Server) PostAdminRemoveOrphanedPeers(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	publicKeys, err := s.orphanedPeerKeys(c, currentSession.DeviceName)
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "WireGuard error", err.Error())
+		return
+	}
+
+	removed := 0
+	var errs []string
+	for _, publicKey := range publicKeys {
+		if err := s.RemoveOrphanedPeer(currentSession.DeviceName, publicKey); err != nil {
+			errs = append(errs, err.Error())
 			continue
 		}
+		removed++
+	}
 
-		peer.AllowedIPsStr = device.DefaultAllowedIPsStr
-		peer.Endpoint = device.DefaultEndpoint
-		peer.PersistentKeepalive = device.DefaultPersistentKeepalive
-		peer.DNSStr = device.DNSStr
-		peer.Mtu = device.Mtu
+	if len(errs) > 0 {
+		SetFlashMessage(c, fmt.Sprintf("Removed %d peers, failed: %s", removed, strings.Join(errs, "; ")), "danger")
+	} else {
+		SetFlashMessage(c, fmt.Sprintf("Removed %d peers from the interface", removed), "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/orphans"))
+}
 
-		if err := s.peers.UpdatePeer(peer); err != nil {
+// GetAdminDriftReport returns the differences between the physical interface and the database as JSON.
+func (s *Server) GetAdminDriftReport(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	device := c.DefaultQuery("device", currentSession.DeviceName)
+	if !common.ListContains(s.config.WG.DeviceNames, device) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown interface"})
+		return
+	}
+
+	report, err := s.GetDriftReport(device)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// PostAdminReapplyInterface pushes the stored state of the current interface to the physical interface again.
+func (s *Server) PostAdminReapplyInterface(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	if err := s.ReapplyInterface(currentSession.DeviceName, currentSession.Email); err != nil {
+		SetFlashMessage(c, "failed to re-apply the configuration: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, "Re-applied the stored configuration of "+currentSession.DeviceName, "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
+}
+
+// maxImportConfigSize limits the size of uploaded wg-quick configuration files.
+const maxImportConfigSize = 1 << 20
+
+// importView is the state of the import page.
+type importView struct {
+	Config      string
+	DeviceName  string // the interface that the configuration is imported into
+	DeviceType  wireguard.DeviceType
+	Assign      string // importAssignComments or importAssignNone
+	ParseErrors wireguard.ConfigParseErrors
+	Imported    *wireguard.ImportedConfig
+	Result      *wireguard.ImportResult // the changes of the import, shown for review
+}
+
+func (s *Server) GetAdminImportInterface(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	s.renderImportInterface(c, importView{DeviceName: currentSession.DeviceName, Assign: importAssignComments})
+}
+
+// PostAdminImportInterface parses a pasted or uploaded wg-quick configuration file or a file of the WireGuard config
+// directory (source). The parsed interface and peers are shown for review first, they are only stored and applied if
+// the review is confirmed (action=import).
+func (s *Server) PostAdminImportInterface(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	view := importView{
+		Config:     c.PostForm("config"),
+		DeviceName: strings.TrimSpace(c.DefaultPostForm("device", currentSession.DeviceName)),
+		DeviceType: wireguard.DeviceType(c.PostForm("devicetype")),
+		Assign:     c.DefaultPostForm("assign", importAssignComments),
+	}
+	if view.DeviceType != wireguard.DeviceTypeServer && view.DeviceType != wireguard.DeviceTypeClient {
+		view.DeviceType = ""
+	}
+	if view.Assign != importAssignNone {
+		view.Assign = importAssignComments
+	}
+
+	if source := c.PostForm("source"); source != "" {
+		config, device, err := s.ReadImportableConfigFile(source)
+		if err != nil {
 			SetFlashMessage(c, err.Error(), "danger")
-			c.Redirect(http.StatusSeeOther, "/admin/device/edit")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/import"))
+			return
+		}
+		view.Config, view.DeviceName = config, device
+	} else if file, err := c.FormFile("file"); err == nil {
+		if file.Size > maxImportConfigSize {
+			SetFlashMessage(c, "configuration file is too large", "danger")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/import"))
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			s.GetHandleError(c, http.StatusInternalServerError, "Upload error", err.Error())
 			return
 		}
-		updateCounter++
+		content, err := ioutil.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			s.GetHandleError(c, http.StatusInternalServerError, "Upload error", err.Error())
+			return
+		}
+		view.Config = string(content)
+	}
+	if !wireguard.IsValidInterfaceName(view.DeviceName) {
+		view.ParseErrors = wireguard.ConfigParseErrors{{Message: "invalid interface name " + view.DeviceName}}
+		s.renderImportInterface(c, view)
+		return
+	}
+
+	imported, err := wireguard.ParseWgQuickConfig(view.DeviceName, view.DeviceType, view.Config)
+	if err != nil {
+		parseErrors, ok := err.(wireguard.ConfigParseErrors)
+		if !ok {
+			parseErrors = wireguard.ConfigParseErrors{{Message: err.Error()}}
+		}
+		view.ParseErrors = parseErrors
+		s.renderImportInterface(c, view)
+		return
 	}
+	s.AssignImportedPeers(&imported, view.Assign)
+	view.Imported = &imported
 
-	SetFlashMessage(c, fmt.Sprintf("Global configuration updated for %d clients.", updateCounter), "success")
-	c.Redirect(http.StatusSeeOther, "/admin/device/edit")
-	return
+	if c.PostForm("action") != "import" {
+		result, err := s.PreviewWireGuardImport(imported)
+		if err != nil {
+			SetFlashMessage(c, "the configuration cannot be imported: "+err.Error(), "danger")
+		} else {
+			view.Result = &result
+		}
+		s.renderImportInterface(c, view)
+		return
+	}
+
+	newDevice := !common.ListContains(s.config.WG.DeviceNames, view.DeviceName)
+	result, err := s.ImportWireGuardConfig(imported, currentSession.Email)
+	if err != nil {
+		SetFlashMessage(c, "failed to import configuration: "+err.Error(), "danger")
+		s.renderImportInterface(c, view)
+		return
+	}
+
+	if result.AlreadyImported() {
+		SetFlashMessage(c, fmt.Sprintf("Interface %s was already imported, nothing changed", view.DeviceName), "info")
+	} else {
+		SetFlashMessage(c, fmt.Sprintf("Imported interface %s: %d peers created, %d updated, %d already imported",
+			view.DeviceName, result.Created, result.Updated, result.Unchanged), "success")
+	}
+	if newDevice {
+		SetFlashMessage(c, "Add "+view.DeviceName+" to the configured devices to keep it managed after a restart.",
+			"warning")
+	}
+	currentSession.DeviceName = view.DeviceName
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Session error", err.Error())
+		return
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
+}
+
+// GetAdminExportInterface downloads the current interface and all its peers as JSON document. With redact=true, the
+// private and preshared keys are left out.
+func (s *Server) GetAdminExportInterface(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	doc, err := s.ExportInterface(currentSession.DeviceName, c.Query("redact") == "true", currentSession.Email)
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Export error", err.Error())
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+strings.ToLower(currentSession.DeviceName)+".json")
+	c.IndentedJSON(http.StatusOK, doc)
+}
+
+// PostAdminImportInterfaceDocument creates an interface from an uploaded JSON document of GetAdminExportInterface.
+// With dryrun, nothing is stored and the changes are only reported.
+func (s *Server) PostAdminImportInterfaceDocument(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	dryRun := c.PostForm("dryrun") != ""
+
+	file, err := c.FormFile("document")
+	if err != nil {
+		SetFlashMessage(c, "no document uploaded", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/import"))
+		return
+	}
+	if file.Size > maxInterfaceExportSize {
+		SetFlashMessage(c, "document is too large", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/import"))
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Upload error", err.Error())
+		return
+	}
+	var doc wireguard.InterfaceExport
+	err = json.NewDecoder(f).Decode(&doc)
+	_ = f.Close()
+	if err != nil {
+		SetFlashMessage(c, "invalid document: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/import"))
+		return
+	}
+
+	result, err := s.ImportInterface(doc, currentSession.Email, dryRun)
+	if err != nil {
+		SetFlashMessage(c, "failed to import interface: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/import"))
+		return
+	}
+
+	summary := fmt.Sprintf("interface %s with %d peers", result.DeviceName, len(result.Peers))
+	if result.Renamed {
+		summary += fmt.Sprintf(" (renamed from %s)", doc.Device.DeviceName)
+	}
+	if len(result.ReallocatedIPs) > 0 {
+		summary += fmt.Sprintf(", new addresses for %d peers", len(result.ReallocatedIPs))
+	}
+	if result.GeneratedKeys {
+		summary += ", new interface keys"
+	}
+	if dryRun {
+		SetFlashMessage(c, "Dry run, nothing was stored: the import would create "+summary, "info")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/device/import"))
+		return
+	}
+
+	SetFlashMessage(c, "Imported "+summary, "success")
+	if result.GeneratedKeys {
+		SetFlashMessage(c, "The document did not contain the interface keys, the peers need new configurations.",
+			"warning")
+	}
+	SetFlashMessage(c, "Add "+result.DeviceName+" to the configured devices to keep it managed after a restart.",
+		"warning")
+	currentSession.DeviceName = result.DeviceName
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Session error", err.Error())
+		return
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
+}
+
+// GetAdminSiteLink shows the form of the site-to-site link helper for the current interface.
+func (s *Server) GetAdminSiteLink(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	s.renderSiteLink(c, SiteLinkRequest{DeviceA: currentSession.DeviceName, Keepalive: DefaultSiteLinkKeepalive}, nil)
+}
+
+// PostAdminSiteLink shows the mutual peers of a site-to-site link for review. The peers are only created and applied
+// to both interfaces if the review is confirmed (action=apply).
+func (s *Server) PostAdminSiteLink(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	keepalive, err := strconv.Atoi(c.DefaultPostForm("keepalive", strconv.Itoa(DefaultSiteLinkKeepalive)))
+	if err != nil {
+		keepalive = -1 // rejected by the validation
+	}
+	req := SiteLinkRequest{
+		DeviceA:   c.PostForm("devicea"),
+		DeviceB:   c.PostForm("deviceb"),
+		NetworksA: c.PostForm("networksa"),
+		NetworksB: c.PostForm("networksb"),
+		EndpointA: c.PostForm("endpointa"),
+		EndpointB: c.PostForm("endpointb"),
+		Keepalive: keepalive,
+	}
+
+	if c.PostForm("action") == "apply" {
+		if _, err := s.ApplySiteLink(req, currentSession.Email); err != nil {
+			SetFlashMessage(c, "failed to create the site-to-site link: "+err.Error(), "danger")
+			s.renderSiteLink(c, req, nil)
+			return
+		}
+		SetFlashMessage(c, fmt.Sprintf("site-to-site link between %s and %s created", req.DeviceA, req.DeviceB),
+			"success")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/"))
+		return
+	}
+
+	plan, err := s.PlanSiteLink(req, currentSession.Email)
+	if err != nil {
+		SetFlashMessage(c, "the site-to-site link cannot be created: "+err.Error(), "danger")
+		s.renderSiteLink(c, req, nil)
+		return
+	}
+	s.renderSiteLink(c, plan.Request, &plan)
+}
+
+func (s *Server) renderSiteLink(c *gin.Context, req SiteLinkRequest, plan *SiteLinkPlan) {
+	currentSession := GetSessionData(c)
+	var sitePeers []wireguard.Peer
+	if plan != nil {
+		sitePeers = []wireguard.Peer{plan.PeerOnA, plan.PeerOnB}
+	}
+	c.HTML(http.StatusOK, "admin_site_link.html", gin.H{
+		"Route":       c.Request.URL.Path,
+		"Alerts":      GetFlashes(c),
+		"Session":     currentSession,
+		"Static":      s.getStaticData(),
+		"Device":      s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames": s.GetDeviceNames(),
+		"Request":     req,
+		"Plan":        plan,
+		"SitePeers":   sitePeers,
+		"Csrf":        s.csrfToken(c),
+	})
+}
+
+func (s *Server) renderImportInterface(c *gin.Context, view importView) {
+	currentSession := GetSessionData(c)
+	c.HTML(http.StatusOK, "admin_import_interface.html", gin.H{
+		"Route":           c.Request.URL.Path,
+		"Alerts":          GetFlashes(c),
+		"Session":         currentSession,
+		"Static":          s.getStaticData(),
+		"Device":          s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames":     s.GetDeviceNames(),
+		"PeerCount":       s.peers.CountPeers(view.DeviceName),
+		"Import":          view,
+		"Files":           s.GetImportableConfigFiles(),
+		"UnassignedEmail": wireguard.AutodetectedPeerEmail,
+		"Csrf":            s.csrfToken(c),
+	})
 }
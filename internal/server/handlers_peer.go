@@ -2,9 +2,13 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,9 +19,10 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/tatsushid/go-fastping"
-	csrf "github.com/utrack/gin-csrf"
 )
 
+const connectionHistoryLimit = 20 // connections shown on the peer page
+
 type LdapCreateForm struct {
 	Emails     string `form:"email" binding:"required"`
 	Identifier string `form:"identifier" binding:"required,lte=20"`
@@ -40,12 +45,20 @@ func (s *Server) GetAdminEditPeer(c *gin.Context) {
 		"Peer":         currentSession.FormData.(wireguard.Peer),
 		"EditableKeys": s.config.Core.EditableKeys,
 		"Device":       s.peers.GetDevice(currentSession.DeviceName),
+		"Presets":      s.peers.GetAllowedIPsPresets(currentSession.DeviceName),
+		"Tags":         s.peers.GetAllTags(currentSession.DeviceName),
 		"DeviceNames":  s.GetDeviceNames(),
 		"AdminEmail":   s.config.Core.AdminUser,
-		"Csrf":         csrf.GetToken(c),
+		"Csrf":         s.csrfToken(c),
+
+		"DownloadLinks":     s.GetDownloadLinks(peer.PublicKey),
+		"DownloadLinkHours": int(s.config.Core.DownloadLinkValidity.Hours()),
+		"Connections":       s.stats.GetConnectionHistory(peer.PublicKey, connectionHistoryLimit),
 	})
 }
 
+// PostAdminEditPeer shows the changes of the submitted peer, they are applied once they are confirmed, see
+// PostAdminConfirmEditPeer.
 func (s *Server) PostAdminEditPeer(c *gin.Context) {
 	currentPeer := s.peers.GetPeerByKey(c.Query("pkey"))
 	urlEncodedKey := url.QueryEscape(c.Query("pkey"))
@@ -58,7 +71,7 @@ func (s *Server) PostAdminEditPeer(c *gin.Context) {
 	if err := c.ShouldBind(&formPeer); err != nil {
 		_ = s.updateFormInSession(c, formPeer)
 		SetFlashMessage(c, "failed to bind form data: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/peer/edit?pkey="+urlEncodedKey+"&formerr=bind")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/edit?pkey="+urlEncodedKey+"&formerr=bind"))
 		return
 	}
 
@@ -67,24 +80,93 @@ func (s *Server) PostAdminEditPeer(c *gin.Context) {
 	formPeer.AllowedIPsStr = common.ListToString(common.ParseStringList(formPeer.AllowedIPsStr))
 	formPeer.AllowedIPsSrvStr = common.ListToString(common.ParseStringList(formPeer.AllowedIPsSrvStr))
 
+	formPeer.DNSStr = common.ListToString(common.ParseStringList(formPeer.DNSStr))
+	formPeer.SetTags(formPeer.GetTags()...)
+	setPeerOverridesFromForm(c, &formPeer)
+	formPeer.OverrideEndpoint = c.PostForm("overrideendpoint") != "" && formPeer.Endpoint != "" // not part of the user settings form
+	formPeer.Managed = c.PostForm("managed") != ""
+
 	disabled := c.PostForm("isdisabled") != ""
-	now := time.Now()
-	if disabled && currentPeer.DeactivatedAt == nil {
-		formPeer.DeactivatedAt = &now
-	} else if !disabled {
-		formPeer.DeactivatedAt = nil
+	formPeer.UpdatedBy = currentSession.Email
+	setPeerDeactivation(&formPeer, currentPeer, disabled, time.Now())
+
+	preview, err := s.PreviewPeerChange(currentPeer, formPeer)
+	if err != nil {
+		_ = s.updateFormInSession(c, formPeer)
+		SetFlashMessage(c, "failed to update user: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/edit?pkey="+urlEncodedKey+"&formerr=update"))
+		return
+	}
+
+	currentSession.FormData = formPeer
+	currentSession.PendingChange = &PendingChange{
+		Kind:      PendingChangePeer,
+		Key:       currentPeer.PublicKey,
+		UpdatedAt: currentPeer.UpdatedAt,
+		Disabled:  disabled,
+	}
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Session error", err.Error())
+		return
+	}
+
+	s.renderChangePreview(c, changePreviewView{
+		Title:   "Client " + currentPeer.Identifier,
+		Preview: preview,
+		Confirm: "/admin/peer/edit/confirm?pkey=" + urlEncodedKey,
+		Back:    "/admin/peer/edit?pkey=" + urlEncodedKey + "&formerr=preview",
+	})
+}
+
+// PostAdminConfirmEditPeer stores and applies the peer that was shown by PostAdminEditPeer.
+func (s *Server) PostAdminConfirmEditPeer(c *gin.Context) {
+	currentPeer := s.peers.GetPeerByKey(c.Query("pkey"))
+	urlEncodedKey := url.QueryEscape(c.Query("pkey"))
+
+	currentSession := GetSessionData(c)
+	formPeer, ok := currentSession.FormData.(wireguard.Peer)
+	pending := currentSession.PendingChange
+	if !ok || pending == nil || pending.Kind != PendingChangePeer || pending.Key != currentPeer.PublicKey {
+		SetFlashMessage(c, "There are no changes of the client to confirm.", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/edit?pkey="+urlEncodedKey))
+		return
+	}
+	if !currentPeer.UpdatedAt.Equal(pending.UpdatedAt) {
+		SetFlashMessage(c, "The client was changed after the preview, review the changes again.", "warning")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/edit?pkey="+urlEncodedKey+"&formerr=preview"))
+		return
+	}
+	currentSession.PendingChange = nil
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Session error", err.Error())
+		return
 	}
 
 	// Update in database
+	now := time.Now()
+	setPeerDeactivation(&formPeer, currentPeer, pending.Disabled, now)
 	if err := s.UpdatePeer(formPeer, now); err != nil {
 		_ = s.updateFormInSession(c, formPeer)
 		SetFlashMessage(c, "failed to update user: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/peer/edit?pkey="+urlEncodedKey+"&formerr=update")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/edit?pkey="+urlEncodedKey+"&formerr=update"))
 		return
 	}
 
 	SetFlashMessage(c, "changes applied successfully", "success")
-	c.Redirect(http.StatusSeeOther, "/admin/peer/edit?pkey="+urlEncodedKey)
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/edit?pkey="+urlEncodedKey))
+}
+
+// setPeerDeactivation disables the peer at the given time or enables it again. A peer that stays disabled keeps the
+// time it was disabled at.
+func setPeerDeactivation(peer *wireguard.Peer, currentPeer wireguard.Peer, disabled bool, now time.Time) {
+	switch {
+	case disabled && currentPeer.DeactivatedAt == nil:
+		peer.DeactivatedAt = &now
+	case disabled:
+		peer.DeactivatedAt = currentPeer.DeactivatedAt
+	default:
+		peer.DeactivatedAt = nil
+	}
 }
 
 func (s *Server) GetAdminCreatePeer(c *gin.Context) {
@@ -101,9 +183,11 @@ func (s *Server) GetAdminCreatePeer(c *gin.Context) {
 		"Peer":         currentSession.FormData.(wireguard.Peer),
 		"EditableKeys": s.config.Core.EditableKeys,
 		"Device":       s.peers.GetDevice(currentSession.DeviceName),
+		"Presets":      s.peers.GetAllowedIPsPresets(currentSession.DeviceName),
+		"Tags":         s.peers.GetAllTags(currentSession.DeviceName),
 		"DeviceNames":  s.GetDeviceNames(),
 		"AdminEmail":   s.config.Core.AdminUser,
-		"Csrf":         csrf.GetToken(c),
+		"Csrf":         s.csrfToken(c),
 	})
 }
 
@@ -116,7 +200,7 @@ func (s *Server) PostAdminCreatePeer(c *gin.Context) {
 	if err := c.ShouldBind(&formPeer); err != nil {
 		_ = s.updateFormInSession(c, formPeer)
 		SetFlashMessage(c, "failed to bind form data: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/peer/create?formerr=bind")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/create?formerr=bind"))
 		return
 	}
 
@@ -125,21 +209,87 @@ func (s *Server) PostAdminCreatePeer(c *gin.Context) {
 	formPeer.AllowedIPsStr = common.ListToString(common.ParseStringList(formPeer.AllowedIPsStr))
 	formPeer.AllowedIPsSrvStr = common.ListToString(common.ParseStringList(formPeer.AllowedIPsSrvStr))
 
+	formPeer.DNSStr = common.ListToString(common.ParseStringList(formPeer.DNSStr))
+	formPeer.SetTags(formPeer.GetTags()...)
+	setPeerOverridesFromForm(c, &formPeer)
+	formPeer.OverrideEndpoint = c.PostForm("overrideendpoint") != "" && formPeer.Endpoint != "" // not part of the user settings form
+	formPeer.Managed = c.PostForm("managed") != ""
+
 	disabled := c.PostForm("isdisabled") != ""
 	now := time.Now()
 	if disabled {
 		formPeer.DeactivatedAt = &now
 	}
+	formPeer.CreatedBy = currentSession.Email
+	formPeer.UpdatedBy = currentSession.Email
+	if clientKey := strings.TrimSpace(c.PostForm("clientpubkey")); clientKey != "" {
+		if err := s.setClientPublicKey(&formPeer, clientKey); err != nil {
+			_ = s.updateFormInSession(c, formPeer)
+			SetFlashMessage(c, err.Error(), "danger")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/create?formerr=pubkey"))
+			return
+		}
+	}
 
-	if err := s.CreatePeer(currentSession.DeviceName, formPeer); err != nil {
+	formPeer.ExpiresAt = nil
+	if c.PostForm("isguest") != "" {
+		ttl, err := parseGuestTTL(c.PostForm("guestttl"), c.PostForm("guestunit"))
+		if err == nil && ttl == 0 {
+			err = errors.New("guest peers need a lifetime")
+		}
+		if err != nil {
+			_ = s.updateFormInSession(c, formPeer)
+			SetFlashMessage(c, err.Error(), "danger")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/create?formerr=guest"))
+			return
+		}
+		expiresAt := now.Add(ttl)
+		formPeer.ExpiresAt = &expiresAt
+	}
+
+	var err error
+	if c.PostForm("ignorequota") != "" {
+		err = s.CreatePeerIgnoringQuota(currentSession.DeviceName, formPeer)
+	} else {
+		err = s.CreatePeer(currentSession.DeviceName, formPeer)
+	}
+	var quotaErr *QuotaExceededError
+	if errors.As(err, &quotaErr) {
+		_ = s.updateFormInSession(c, formPeer)
+		SetFlashMessage(c, "peer limit reached: "+quotaErr.Error()+". Enable the quota override to create the peer anyway.", "warning")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/create?formerr=quota"))
+		return
+	}
+	if err != nil {
 		_ = s.updateFormInSession(c, formPeer)
 		SetFlashMessage(c, "failed to add user: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/peer/create?formerr=create")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/create?formerr=create"))
+		return
+	}
+	if formPeer.IsGuest() {
+		s.audit.Record(common.AuditEntry{Actor: currentSession.Email, Action: "peer.guest_created",
+			Interface: currentSession.DeviceName, Target: formPeer.PublicKey,
+			Details: formPeer.Identifier + " expires at " + formPeer.ExpiresAt.Format(time.RFC3339)})
+	}
+
+	if c.PostForm("sendmail") != "" {
+		if !formPeer.HasEmail() {
+			SetFlashMessage(c, "client created successfully, but it has no email address to send the configuration to", "warning")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+			return
+		}
+		if err := s.mailer.QueuePeerConfigMail(formPeer); err != nil {
+			SetFlashMessage(c, "client created successfully, but the configuration mail could not be queued: "+err.Error(), "warning")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+			return
+		}
+		SetFlashMessage(c, "client created successfully, configuration mail queued for delivery", "success")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
 		return
 	}
 
 	SetFlashMessage(c, "client created successfully", "success")
-	c.Redirect(http.StatusSeeOther, "/admin")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
 }
 
 func (s *Server) GetAdminCreateLdapPeers(c *gin.Context) {
@@ -158,7 +308,7 @@ func (s *Server) GetAdminCreateLdapPeers(c *gin.Context) {
 		"FormData":    currentSession.FormData.(LdapCreateForm),
 		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
-		"Csrf":        csrf.GetToken(c),
+		"Csrf":        s.csrfToken(c),
 	})
 }
 
@@ -171,7 +321,7 @@ func (s *Server) PostAdminCreateLdapPeers(c *gin.Context) {
 	if err := c.ShouldBind(&formData); err != nil {
 		_ = s.updateFormInSession(c, formData)
 		SetFlashMessage(c, "failed to bind form data: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/peer/createldap?formerr=bind")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/createldap?formerr=bind"))
 		return
 	}
 
@@ -181,7 +331,7 @@ func (s *Server) PostAdminCreateLdapPeers(c *gin.Context) {
 		if !strings.ContainsRune(emails[i], '@') {
 			_ = s.updateFormInSession(c, formData)
 			SetFlashMessage(c, "invalid email address: "+emails[i], "danger")
-			c.Redirect(http.StatusSeeOther, "/admin/peer/createldap?formerr=mail")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/createldap?formerr=mail"))
 			return
 		}
 	}
@@ -192,23 +342,269 @@ func (s *Server) PostAdminCreateLdapPeers(c *gin.Context) {
 		if err := s.CreatePeerByEmail(currentSession.DeviceName, emails[i], formData.Identifier, false); err != nil {
 			_ = s.updateFormInSession(c, formData)
 			SetFlashMessage(c, "failed to add user: "+err.Error(), "danger")
-			c.Redirect(http.StatusSeeOther, "/admin/peer/createldap?formerr=create")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/createldap?formerr=create"))
 			return
 		}
 	}
 
 	SetFlashMessage(c, "client(s) created successfully", "success")
-	c.Redirect(http.StatusSeeOther, "/admin/peer/createldap")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/createldap"))
 }
 
-func (s *Server) GetAdminDeletePeer(c *gin.Context) {
+func (s *Server) PostAdminCreateAllPeers(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	if err := s.StartBulkPeerCreation(currentSession.DeviceName, "Default", currentSession.Email); err != nil {
+		SetFlashMessage(c, "failed to start peer creation: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+		return
+	}
+
+	SetFlashMessage(c, "peer creation for all users started in the background", "success")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+}
+
+func (s *Server) PostAdminDeletePeer(c *gin.Context) {
 	currentPeer := s.peers.GetPeerByKey(c.Query("pkey"))
+	currentPeer.UpdatedBy = GetSessionData(c).Email
 	if err := s.DeletePeer(currentPeer); err != nil {
 		s.GetHandleError(c, http.StatusInternalServerError, "Deletion error", err.Error())
 		return
 	}
 	SetFlashMessage(c, "peer deleted successfully", "success")
-	c.Redirect(http.StatusSeeOther, "/admin")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+}
+
+// PostAdminBulkPeerAction enables, disables or deletes all selected peers of the current interface at once.
+func (s *Server) PostAdminBulkPeerAction(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	action := c.PostForm("action")
+	result, err := s.ApplyBulkPeerAction(currentSession.DeviceName, action, c.PostFormArray("pkey"),
+		currentSession.Email)
+	switch {
+	case err != nil && len(result.Succeeded) == 0:
+		SetFlashMessage(c, "bulk "+action+" failed: "+err.Error(), "danger")
+	case err != nil:
+		SetFlashMessage(c, fmt.Sprintf("%s %d peers, but the configuration file could not be written: %v",
+			action+"d", len(result.Succeeded), err), "warning")
+	case len(result.Failed) > 0:
+		SetFlashMessage(c, fmt.Sprintf("%s %d peers, %d peers failed: %s", action+"d", len(result.Succeeded),
+			len(result.Failed), result.FailedSummary()), "warning")
+	default:
+		SetFlashMessage(c, fmt.Sprintf("%s %d peers", action+"d", len(result.Succeeded)+len(result.Skipped)),
+			"success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+}
+
+// PostAdminPeerPresharedKey regenerates (action=generate) or removes (action=clear) the preshared key of a peer.
+func (s *Server) PostAdminPeerPresharedKey(c *gin.Context) {
+	currentPeer := s.peers.GetPeerByKey(c.Query("pkey"))
+	if !currentPeer.IsValid() {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+	urlEncodedKey := url.QueryEscape(currentPeer.PublicKey)
+
+	currentPeer.UpdatedBy = GetSessionData(c).Email
+	generate := c.PostForm("action") == "generate"
+	if err := s.SetPeerPresharedKey(currentPeer, generate); err != nil {
+		SetFlashMessage(c, "failed to update preshared key: "+err.Error(), "danger")
+	} else if generate {
+		SetFlashMessage(c, "new preshared key generated, the peer needs the updated configuration", "success")
+	} else {
+		SetFlashMessage(c, "preshared key removed, the peer needs the updated configuration", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/peer/edit?pkey="+urlEncodedKey))
+}
+
+// PostAdminRotatePeerKeys generates a new keypair for a peer and shows the new configuration.
+func (s *Server) PostAdminRotatePeerKeys(c *gin.Context) {
+	currentPeer := s.peers.GetPeerByKey(c.Query("pkey"))
+	if !currentPeer.IsValid() {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+
+	currentPeer.UpdatedBy = GetSessionData(c).Email
+	s.rotatePeerKeys(c, currentPeer, s.urlPath("/admin/peer/edit?pkey=")+url.QueryEscape(currentPeer.PublicKey))
+}
+
+// PostUserRotatePeerKeys generates a new keypair for a peer of the logged in user and shows the new configuration.
+func (s *Server) PostUserRotatePeerKeys(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	peer, err := s.GetUserPeer(currentSession.Email, c.Query("pkey"))
+	if err != nil {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+
+	peer.UpdatedBy = currentSession.Email
+	s.rotatePeerKeys(c, peer, s.urlPath("/user/profile"))
+}
+
+func (s *Server) rotatePeerKeys(c *gin.Context, peer wireguard.Peer, errorRedirect string) {
+	rotated, err := s.RotatePeerKeys(peer)
+	if err != nil && rotated.PublicKey == "" {
+		SetFlashMessage(c, "failed to rotate keys: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, errorRedirect)
+		return
+	}
+	if err != nil {
+		SetFlashMessage(c, "keys rotated, but the configuration file could not be written: "+err.Error(), "warning")
+	} else {
+		SetFlashMessage(c, "keys of "+rotated.Identifier+" rotated, the old configuration no longer works", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/peer/rotated?pkey="+url.QueryEscape(rotated.PublicKey)))
+}
+
+// GetRotatedPeer shows the configuration of a peer after its keys were rotated.
+func (s *Server) GetRotatedPeer(c *gin.Context) {
+	peer := s.peers.GetPeerByKey(c.Query("pkey"))
+	currentSession := GetSessionData(c)
+	if !peer.IsValid() || (!currentSession.IsAdmin && peer.Email != currentSession.Email) {
+		s.GetHandleError(c, http.StatusUnauthorized, "No permissions", "You don't have permissions to view this resource!")
+		return
+	}
+
+	c.HTML(http.StatusOK, "peer_rotated.html", gin.H{
+		"Route":       c.Request.URL.Path,
+		"Alerts":      GetFlashes(c),
+		"Session":     currentSession,
+		"Static":      s.getStaticData(),
+		"Csrf":        s.csrfToken(c),
+		"Peer":        peer,
+		"Device":      s.peers.GetDevice(peer.DeviceName),
+		"DeviceNames": s.GetDeviceNames(),
+	})
+}
+
+// PostAdminGuestPeer extends the lifetime of a guest peer (action=extend) or converts it to a permanent peer
+// (action=permanent).
+func (s *Server) PostAdminGuestPeer(c *gin.Context) {
+	peer := s.peers.GetPeerByKey(c.Query("pkey"))
+	if !peer.IsValid() {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+	currentSession := GetSessionData(c)
+	redirect := s.urlPath("/admin/peer/edit?pkey=") + url.QueryEscape(peer.PublicKey)
+
+	var err error
+	switch c.PostForm("action") {
+	case "permanent":
+		if err = s.MakeGuestPeerPermanent(peer, currentSession.Email); err == nil {
+			SetFlashMessage(c, peer.Identifier+" is now a permanent peer", "success")
+		}
+	default:
+		var ttl time.Duration
+		if ttl, err = parseGuestTTL(c.PostForm("guestttl"), c.PostForm("guestunit")); err == nil {
+			if err = s.ExtendGuestPeer(peer, ttl, currentSession.Email); err == nil {
+				SetFlashMessage(c, "lifetime of "+peer.Identifier+" extended", "success")
+			}
+		}
+	}
+	if err != nil {
+		SetFlashMessage(c, err.Error(), "danger")
+	}
+	c.Redirect(http.StatusSeeOther, redirect)
+}
+
+// PostAdminCreateDownloadLink creates a single-use download link for a peer. The link is only shown once.
+func (s *Server) PostAdminCreateDownloadLink(c *gin.Context) {
+	peer := s.peers.GetPeerByKey(c.Query("pkey"))
+	if !peer.IsValid() {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+	redirect := s.urlPath("/admin/peer/edit?pkey=") + url.QueryEscape(peer.PublicKey)
+
+	validity := s.config.Core.DownloadLinkValidity
+	if hours := c.PostForm("validity"); hours != "" {
+		h, err := strconv.Atoi(hours)
+		if err != nil {
+			SetFlashMessage(c, "invalid validity "+hours, "danger")
+			c.Redirect(http.StatusSeeOther, redirect)
+			return
+		}
+		validity = time.Duration(h) * time.Hour
+	}
+
+	token, link, err := s.CreateDownloadLink(peer, validity, GetSessionData(c).Email)
+	if err != nil {
+		SetFlashMessage(c, "failed to create download link: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, redirect)
+		return
+	}
+
+	SetFlashMessage(c, "one-time download link, valid until "+link.ExpiresAt.Format("2006-01-02 15:04")+
+		" (it will not be shown again): "+strings.TrimSuffix(s.config.Core.ExternalUrl, "/")+"/p/"+token, "success")
+	c.Redirect(http.StatusSeeOther, redirect)
+}
+
+func (s *Server) PostAdminRevokeDownloadLink(c *gin.Context) {
+	redirect := s.urlPath("/admin/peer/edit?pkey=") + url.QueryEscape(c.Query("pkey"))
+
+	id, err := strconv.ParseUint(c.PostForm("id"), 10, 32)
+	if err == nil {
+		_, err = s.RevokeDownloadLink(uint(id), GetSessionData(c).Email)
+	}
+	if err != nil {
+		SetFlashMessage(c, "failed to revoke download link: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, "download link revoked", "success")
+	}
+	c.Redirect(http.StatusSeeOther, redirect)
+}
+
+// GetDownloadLink redeems a single-use download link. It does not require a login, the page embeds the
+// configuration and the QR code, as the link cannot be used for further requests.
+func (s *Server) GetDownloadLink(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+
+	peer, err := s.RedeemDownloadLink(c.Param("token"), s.clientIP(c))
+	switch err {
+	case nil:
+	case errDownloadLinkInvalid:
+		s.GetHandleError(c, http.StatusNotFound, "Invalid link",
+			"This download link does not exist. Please ask your administrator for a new link.")
+		return
+	case errDownloadLinkExpired, errDownloadLinkUsed, errDownloadLinkRevoked:
+		s.GetHandleError(c, http.StatusGone, "Link no longer valid",
+			"This download link can no longer be used, "+err.Error()+". Please ask your administrator for a new link.")
+		return
+	default:
+		common.ContextLogger(c.Request.Context()).Errorf("failed to redeem download link: %v", err)
+		s.GetHandleError(c, http.StatusInternalServerError, "Download link error",
+			"The link could not be processed, please try again later.")
+		return
+	}
+
+	cfg, err := peer.GetConfigFile(s.peers.GetDevice(peer.DeviceName))
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "ConfigFile error", err.Error())
+		return
+	}
+	png, err := peer.GetQRCode()
+	if err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "QRCode error", err.Error())
+		return
+	}
+
+	c.HTML(http.StatusOK, "peer_link.html", gin.H{
+		"Route":          c.Request.URL.Path,
+		"Session":        GetSessionData(c),
+		"Static":         s.getStaticData(),
+		"Csrf":           s.csrfToken(c),
+		"Peer":           peer,
+		"Config":         string(cfg),
+		"ConfigFileName": peer.GetConfigFileName(),
+		"ConfigData":     template.URL("data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(cfg)),
+		"QRCode":         template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		"Device":         s.peers.GetDevice(GetSessionData(c).DeviceName),
+		"DeviceNames":    s.GetDeviceNames(),
+	})
 }
 
 func (s *Server) GetPeerQRCode(c *gin.Context) {
@@ -229,12 +625,21 @@ func (s *Server) GetPeerQRCode(c *gin.Context) {
 }
 
 func (s *Server) GetPeerConfig(c *gin.Context) {
-	peer := s.peers.GetPeerByKey(c.Query("pkey"))
+	var peer wireguard.Peer
+	if uid := c.Param("id"); uid != "" {
+		peer = s.peers.GetPeerByUID(uid)
+	} else {
+		peer = s.peers.GetPeerByKey(c.Query("pkey"))
+	}
 	currentSession := GetSessionData(c)
 	if !currentSession.IsAdmin && peer.Email != currentSession.Email {
 		s.GetHandleError(c, http.StatusUnauthorized, "No permissions", "You don't have permissions to view this resource!")
 		return
 	}
+	if !peer.IsValid() {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
 
 	cfg, err := peer.GetConfigFile(s.peers.GetDevice(peer.DeviceName))
 	if err != nil {
@@ -242,12 +647,12 @@ func (s *Server) GetPeerConfig(c *gin.Context) {
 		return
 	}
 
-	c.Header("Content-Disposition", "attachment; filename="+peer.GetConfigFileName())
+	c.Header("Content-Disposition", "attachment; filename=\""+peer.GetConfigFileName()+"\"")
 	c.Data(http.StatusOK, "application/config", cfg)
 	return
 }
 
-func (s *Server) GetPeerConfigMail(c *gin.Context) {
+func (s *Server) PostPeerConfigMail(c *gin.Context) {
 	peer := s.peers.GetPeerByKey(c.Query("pkey"))
 	currentSession := GetSessionData(c)
 	if !currentSession.IsAdmin && peer.Email != currentSession.Email {
@@ -255,17 +660,166 @@ func (s *Server) GetPeerConfigMail(c *gin.Context) {
 		return
 	}
 
-	if err := s.sendPeerConfigMail(peer); err != nil {
+	if !peer.HasEmail() {
+		SetFlashMessage(c, "peer "+peer.Identifier+" has no email address, no mail was sent", "warning")
+	} else if err := s.mailer.QueuePeerConfigMail(peer); err != nil {
 		s.GetHandleError(c, http.StatusInternalServerError, "Email error", err.Error())
 		return
+	} else {
+		SetFlashMessage(c, "mail queued for delivery to "+peer.Email, "success")
+	}
+
+	if strings.HasPrefix(c.Request.URL.Path, s.urlPath("/user")) {
+		c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+	} else {
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+	}
+}
+
+// setPeerOverridesFromForm reads the override switches, unchecked checkboxes are not part of the submitted form.
+func setPeerOverridesFromForm(c *gin.Context, peer *wireguard.Peer) {
+	peer.OverrideDNS = c.PostForm("overridedns") != ""
+	peer.OverrideMtu = c.PostForm("overridemtu") != ""
+	peer.OverrideKeepalive = c.PostForm("overridekeepalive") != ""
+}
+
+// PeerOverrideForm contains the client settings that users can override for their own peers.
+type PeerOverrideForm struct {
+	DNSStr              string `form:"dns" binding:"dnslist"`
+	Mtu                 int    `form:"mtu" binding:"omitempty,gte=1280,lte=1500"`
+	PersistentKeepalive int    `form:"keepalive" binding:"gte=0,lte=65535"`
+}
+
+// PostUserPeerSettings updates the DNS, MTU and keepalive overrides of a peer of the logged in user.
+func (s *Server) PostUserPeerSettings(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	peer, err := s.GetUserPeer(currentSession.Email, c.Query("pkey"))
+	if err != nil {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+
+	var form PeerOverrideForm
+	if err := c.ShouldBind(&form); err != nil {
+		SetFlashMessage(c, "invalid peer settings: "+err.Error(), "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+		return
+	}
+
+	setPeerOverridesFromForm(c, &peer)
+	if peer.OverrideDNS {
+		peer.DNSStr = common.ListToString(common.ParseStringList(form.DNSStr))
+	}
+	if peer.OverrideMtu {
+		peer.Mtu = form.Mtu
+	}
+	if peer.OverrideKeepalive {
+		peer.PersistentKeepalive = form.PersistentKeepalive
+	}
+	peer.UpdatedBy = currentSession.Email
+	if err := s.UpdatePeer(peer, time.Now()); err != nil {
+		SetFlashMessage(c, "failed to update peer settings: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, "settings of "+peer.Identifier+" updated, download the new configuration to apply them", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+}
+
+// PostUserCreatePeer creates a new peer for the logged in user on one of the self-service interfaces. The interface
+// defaults to the default interface, an optional public key replaces the generated key pair.
+func (s *Server) PostUserCreatePeer(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	if !s.config.Core.SelfProvisioningAllowed {
+		s.GetHandleError(c, http.StatusForbidden, "No permissions", "Self-service peer creation is disabled!")
+		return
+	}
+
+	identifier := strings.TrimSpace(c.PostForm("identifier"))
+	if identifier == "" || len(identifier) > 64 {
+		SetFlashMessage(c, "the peer name must contain between 1 and 64 characters", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+		return
+	}
+
+	device := c.DefaultPostForm("device", s.config.WG.GetDefaultDeviceName())
+	_, err := s.CreateUserPeer(currentSession.Email, device, identifier, c.PostForm("publickey"))
+	var quotaErr *QuotaExceededError
+	switch {
+	case errors.As(err, &quotaErr):
+		SetFlashMessage(c, "you cannot create more peers: "+quotaErr.Error(), "warning")
+	case err != nil:
+		SetFlashMessage(c, "failed to create peer: "+err.Error(), "danger")
+	default:
+		SetFlashMessage(c, "peer "+identifier+" created successfully", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+}
+
+// PostUserRenamePeer changes the identifier of a peer of the logged in user.
+func (s *Server) PostUserRenamePeer(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	peer, err := s.GetUserPeer(currentSession.Email, c.Query("pkey"))
+	if err != nil {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+
+	identifier := strings.TrimSpace(c.PostForm("identifier"))
+	if identifier == "" || len(identifier) > 64 {
+		SetFlashMessage(c, "the peer name must contain between 1 and 64 characters", "danger")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+		return
 	}
 
-	SetFlashMessage(c, "mail sent successfully", "success")
-	if strings.HasPrefix(c.Request.URL.Path, "/user") {
-		c.Redirect(http.StatusSeeOther, "/user/profile")
+	peer.Identifier = identifier
+	peer.UpdatedBy = currentSession.Email
+	if err := s.UpdatePeer(peer, time.Now()); err != nil {
+		SetFlashMessage(c, "failed to rename peer: "+err.Error(), "danger")
 	} else {
-		c.Redirect(http.StatusSeeOther, "/admin")
+		SetFlashMessage(c, "peer renamed to "+identifier, "success")
 	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+}
+
+// PostUserDeletePeer deletes a peer of the logged in user.
+func (s *Server) PostUserDeletePeer(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	peer, err := s.GetUserPeer(currentSession.Email, c.Query("pkey"))
+	if err != nil {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+	if !s.config.Core.SelfProvisioningAllowed {
+		s.GetHandleError(c, http.StatusForbidden, "No permissions", "Self-service peer deletion is disabled!")
+		return
+	}
+
+	if err := s.DeleteUserPeer(peer, currentSession.Email); err != nil {
+		SetFlashMessage(c, "failed to delete peer: "+err.Error(), "danger")
+	} else {
+		SetFlashMessage(c, "peer "+peer.Identifier+" deleted", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
+}
+
+// PostUserDisablePeer disables (disabled=true) or enables a peer of the logged in user.
+func (s *Server) PostUserDisablePeer(c *gin.Context) {
+	currentSession := GetSessionData(c)
+	peer, err := s.GetUserPeer(currentSession.Email, c.Query("pkey"))
+	if err != nil {
+		s.GetHandleError(c, http.StatusNotFound, "Peer not found", "The requested peer does not exist!")
+		return
+	}
+
+	disabled := c.PostForm("disabled") == "true"
+	if err := s.SetUserPeerDisabled(peer, disabled, currentSession.Email); err != nil {
+		SetFlashMessage(c, "failed to update peer: "+err.Error(), "danger")
+	} else if disabled {
+		SetFlashMessage(c, "peer "+peer.Identifier+" disabled", "success")
+	} else {
+		SetFlashMessage(c, "peer "+peer.Identifier+" enabled", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/user/profile"))
 }
 
 func (s *Server) GetPeerStatus(c *gin.Context) {
@@ -317,7 +871,7 @@ func (s *Server) GetPeerStatus(c *gin.Context) {
 	return
 }
 
-func (s *Server) GetAdminSendEmails(c *gin.Context) {
+func (s *Server) PostAdminSendEmails(c *gin.Context) {
 	currentSession := GetSessionData(c)
 	if !currentSession.IsAdmin {
 		s.GetHandleError(c, http.StatusUnauthorized, "No permissions", "You don't have permissions to view this resource!")
@@ -325,15 +879,29 @@ func (s *Server) GetAdminSendEmails(c *gin.Context) {
 	}
 
 	peers := s.peers.GetActivePeers(currentSession.DeviceName)
+	skipped := make([]string, 0)
 	for _, peer := range peers {
-		if err := s.sendPeerConfigMail(peer); err != nil {
+		if !peer.HasEmail() {
+			skipped = append(skipped, peer.Identifier)
+			continue
+		}
+		if err := s.mailer.QueuePeerConfigMail(peer); err != nil {
 			s.GetHandleError(c, http.StatusInternalServerError, "Email error", err.Error())
 			return
 		}
 	}
 
-	SetFlashMessage(c, "emails sent successfully", "success")
-	c.Redirect(http.StatusSeeOther, "/admin")
+	if len(skipped) > 0 {
+		SetFlashMessage(c, "emails queued for delivery, peers without email address were skipped: "+strings.Join(skipped, ", "), "warning")
+	} else {
+		SetFlashMessage(c, "emails queued for delivery", "success")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
+}
+
+func (s *Server) PostAdminClearMailFailures(c *gin.Context) {
+	s.mailer.ClearFailures()
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin"))
 }
 
 func (s *Server) sendPeerConfigMail(peer wireguard.Peer) error {
@@ -347,10 +915,9 @@ func (s *Server) sendPeerConfigMail(peer wireguard.Peer) error {
 	if err != nil {
 		return errors.Wrap(err, "failed to get qr-code")
 	}
-	// Apply mail template
+	// Apply mail templates
 	qrcodeFileName := "wireguard-qrcode.png"
-	var tplBuff bytes.Buffer
-	if err := s.mailTpl.Execute(&tplBuff, struct {
+	tplData := struct {
 		Peer          wireguard.Peer
 		User          *users.User
 		QrcodePngName string
@@ -360,9 +927,15 @@ func (s *Server) sendPeerConfigMail(peer wireguard.Peer) error {
 		User:          user,
 		QrcodePngName: qrcodeFileName,
 		PortalUrl:     s.config.Core.ExternalUrl,
-	}); err != nil {
+	}
+	var tplBuff bytes.Buffer
+	if err := s.mailTpl.Execute(&tplBuff, tplData); err != nil {
 		return errors.Wrap(err, "failed to execute mail template")
 	}
+	var txtBuff bytes.Buffer
+	if err := s.mailTxtTpl.Execute(&txtBuff, tplData); err != nil {
+		return errors.Wrap(err, "failed to execute plain text mail template")
+	}
 
 	// Send mail
 	attachments := []common.MailAttachment{
@@ -385,7 +958,7 @@ func (s *Server) sendPeerConfigMail(peer wireguard.Peer) error {
 	}
 
 	if err := common.SendEmailWithAttachments(s.config.Email, s.config.Core.MailFrom, "", "WireGuard VPN Configuration",
-		"Your mail client does not support HTML. Please find the configuration attached to this mail.", tplBuff.String(),
+		txtBuff.String(), tplBuff.String(),
 		[]string{peer.Email}, attachments); err != nil {
 		return errors.Wrap(err, "failed to send email")
 	}
@@ -7,7 +7,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/h44z/wg-portal/internal/users"
-	csrf "github.com/utrack/gin-csrf"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
 )
 
@@ -31,7 +31,7 @@ func (s *Server) GetAdminUsersIndex(c *gin.Context) {
 			s.GetHandleError(c, http.StatusInternalServerError, "sort error", "failed to save session")
 			return
 		}
-		c.Redirect(http.StatusSeeOther, "/admin/users/")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
 		return
 	}
 
@@ -43,11 +43,13 @@ func (s *Server) GetAdminUsersIndex(c *gin.Context) {
 			s.GetHandleError(c, http.StatusInternalServerError, "search error", "failed to save session")
 			return
 		}
-		c.Redirect(http.StatusSeeOther, "/admin/users/")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
 		return
 	}
 
-	dbUsers := s.users.GetFilteredAndSortedUsersUnscoped(currentSession.SortedBy["users"], currentSession.SortDirection["users"], currentSession.Search["users"])
+	pagination := s.getPagination(c, nil)
+	dbUsers, total := s.users.GetUsersPage(currentSession.SortedBy["users"], currentSession.SortDirection["users"], currentSession.Search["users"], pagination.Page, pagination.PageSize)
+	pagination.Total = total
 
 	c.HTML(http.StatusOK, "admin_user_index.html", gin.H{
 		"Route":       c.Request.URL.Path,
@@ -56,8 +58,11 @@ func (s *Server) GetAdminUsersIndex(c *gin.Context) {
 		"Static":      s.getStaticData(),
 		"Users":       dbUsers,
 		"TotalUsers":  len(s.users.GetUsers()),
+		"Pending":     len(s.users.GetUsersByState(users.UserStatePending)),
+		"Pagination":  pagination,
 		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
+		"Csrf":        s.csrfToken(c),
 	})
 }
 
@@ -79,7 +84,9 @@ func (s *Server) GetAdminUsersEdit(c *gin.Context) {
 		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
 		"Epoch":       time.Time{},
-		"Csrf":        csrf.GetToken(c),
+		"Csrf":        s.csrfToken(c),
+
+		"PasswordPolicy": s.config.Password,
 	})
 }
 
@@ -87,7 +94,7 @@ func (s *Server) PostAdminUsersEdit(c *gin.Context) {
 	currentUser := s.users.GetUserUnscoped(c.Query("pkey"))
 	if currentUser == nil {
 		SetFlashMessage(c, "invalid user", "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/users/")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
 		return
 	}
 	urlEncodedKey := url.QueryEscape(c.Query("pkey"))
@@ -100,7 +107,7 @@ func (s *Server) PostAdminUsersEdit(c *gin.Context) {
 	if err := c.ShouldBind(&formUser); err != nil {
 		_ = s.updateFormInSession(c, formUser)
 		SetFlashMessage(c, "failed to bind form data: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/users/edit?pkey="+urlEncodedKey+"&formerr=bind")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/edit?pkey="+urlEncodedKey+"&formerr=bind"))
 		return
 	}
 
@@ -115,15 +122,15 @@ func (s *Server) PostAdminUsersEdit(c *gin.Context) {
 	}
 	formUser.IsAdmin = c.PostForm("isadmin") == "true"
 
-	if err := s.UpdateUser(formUser); err != nil {
+	if err := s.UpdateUser(formUser, currentSession.Email); err != nil {
 		_ = s.updateFormInSession(c, formUser)
 		SetFlashMessage(c, "failed to update user: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/users/edit?pkey="+urlEncodedKey+"&formerr=update")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/edit?pkey="+urlEncodedKey+"&formerr=update"))
 		return
 	}
 
 	SetFlashMessage(c, "changes applied successfully", "success")
-	c.Redirect(http.StatusSeeOther, "/admin/users/edit?pkey="+urlEncodedKey)
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/edit?pkey="+urlEncodedKey))
 }
 
 func (s *Server) GetAdminUsersCreate(c *gin.Context) {
@@ -144,7 +151,9 @@ func (s *Server) GetAdminUsersCreate(c *gin.Context) {
 		"Device":      s.peers.GetDevice(currentSession.DeviceName),
 		"DeviceNames": s.GetDeviceNames(),
 		"Epoch":       time.Time{},
-		"Csrf":        csrf.GetToken(c),
+		"Csrf":        s.csrfToken(c),
+
+		"PasswordPolicy": s.config.Password,
 	})
 }
 
@@ -157,14 +166,14 @@ func (s *Server) PostAdminUsersCreate(c *gin.Context) {
 	if err := c.ShouldBind(&formUser); err != nil {
 		_ = s.updateFormInSession(c, formUser)
 		SetFlashMessage(c, "failed to bind form data: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/users/create?formerr=bind")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/create?formerr=bind"))
 		return
 	}
 
 	if formUser.Password == "" {
 		_ = s.updateFormInSession(c, formUser)
 		SetFlashMessage(c, "invalid password", "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/users/create?formerr=create")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/create?formerr=create"))
 		return
 	}
 
@@ -180,13 +189,89 @@ func (s *Server) PostAdminUsersCreate(c *gin.Context) {
 	formUser.IsAdmin = c.PostForm("isadmin") == "true"
 	formUser.Source = users.UserSourceDatabase
 
-	if err := s.CreateUser(formUser, currentSession.DeviceName); err != nil {
+	if err := s.CreateUser(formUser, currentSession.DeviceName, currentSession.Email); err != nil {
 		_ = s.updateFormInSession(c, formUser)
 		SetFlashMessage(c, "failed to add user: "+err.Error(), "danger")
-		c.Redirect(http.StatusSeeOther, "/admin/users/create?formerr=create")
+		c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/create?formerr=create"))
 		return
 	}
 
 	SetFlashMessage(c, "user created successfully", "success")
-	c.Redirect(http.StatusSeeOther, "/admin/users/")
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/"))
+}
+
+// PostUserTheme stores the selected color theme of the current user and redirects back to the previous page.
+func (s *Server) PostUserTheme(c *gin.Context) {
+	theme := users.Theme(c.PostForm("theme"))
+	if !theme.IsValid() {
+		s.GetHandleError(c, http.StatusBadRequest, "Invalid theme", "The selected theme is not supported!")
+		return
+	}
+
+	currentSession := GetSessionData(c)
+	if user := s.users.GetUser(currentSession.Email); user != nil {
+		user.Theme = theme
+		if err := s.users.UpdateUser(user); err != nil {
+			s.GetHandleError(c, http.StatusInternalServerError, "Theme error", err.Error())
+			return
+		}
+	}
+
+	currentSession.Theme = theme
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Theme error", "failed to save session")
+		return
+	}
+
+	s.redirectBack(c)
+}
+
+// redirectBack redirects to the previous page, or to the start page if the previous page is not a page of the portal.
+func (s *Server) redirectBack(c *gin.Context) {
+	redirect := s.urlPath("/")
+	if referer, err := url.Parse(c.Request.Referer()); err == nil && referer.Host == c.Request.Host && referer.Path != "" {
+		redirect = referer.RequestURI()
+	}
+	c.Redirect(http.StatusSeeOther, redirect)
+}
+
+func (s *Server) GetAdminRegistrations(c *gin.Context) {
+	currentSession := GetSessionData(c)
+
+	c.HTML(http.StatusOK, "admin_registrations.html", gin.H{
+		"Route":       c.Request.URL.Path,
+		"Alerts":      GetFlashes(c),
+		"Session":     currentSession,
+		"Static":      s.getStaticData(),
+		"Pending":     s.users.GetUsersByState(users.UserStatePending),
+		"Rejected":    s.users.GetUsersByState(users.UserStateRejected),
+		"Enabled":     s.config.Core.SelfRegistration,
+		"Device":      s.peers.GetDevice(currentSession.DeviceName),
+		"DeviceNames": s.GetDeviceNames(),
+		"Csrf":        s.csrfToken(c),
+	})
+}
+
+// PostAdminRegistration approves (action=approve) or rejects (action=reject) a pending registration.
+func (s *Server) PostAdminRegistration(c *gin.Context) {
+	email := c.PostForm("email")
+	currentSession := GetSessionData(c)
+
+	var err error
+	switch c.PostForm("action") {
+	case "approve":
+		if err = s.ApproveRegistration(email, currentSession.Email); err == nil {
+			SetFlashMessage(c, "registration of "+email+" approved", "success")
+		}
+	case "reject":
+		if err = s.RejectRegistration(email, c.PostForm("reason"), currentSession.Email); err == nil {
+			SetFlashMessage(c, "registration of "+email+" rejected", "success")
+		}
+	default:
+		err = errors.New("unknown action")
+	}
+	if err != nil {
+		SetFlashMessage(c, err.Error(), "danger")
+	}
+	c.Redirect(http.StatusSeeOther, s.urlPath("/admin/users/registrations"))
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	healthDatabaseTimeout  = 2 * time.Second
+	healthDeviceCheckCache = 5 * time.Second // probes run every few seconds, the interfaces are checked less often
+)
+
+// HealthStatus is the response of the health and readiness endpoints. The errors of failing components are generic,
+// the details are logged, so no addresses or credentials are exposed.
+type HealthStatus struct {
+	Status  string               // ok or unavailable
+	Failing []HealthCheckFailure `json:",omitempty"`
+}
+
+// HealthCheckFailure names a failing component of the readiness check, e.g. "database" or "interface wg0".
+type HealthCheckFailure struct {
+	Component string
+	Error     string
+}
+
+// deviceHealthCache holds the result of the last interface check.
+type deviceHealthCache struct {
+	mux       sync.Mutex
+	checkedAt time.Time
+	failures  []HealthCheckFailure
+}
+
+// setupHealthRoutes registers /healthz and /readyz. They must be registered before the session middleware, so probes
+// neither need nor create sessions, and they are not part of a group with CSRF protection. If the external url has a
+// path, the endpoints are available below it as well.
+func (s *Server) setupHealthRoutes() {
+	s.deviceHealth = &deviceHealthCache{}
+	s.server.GET("/healthz", s.GetHealthz)
+	s.server.GET("/readyz", s.GetReadyz)
+	if s.basePath != "" {
+		s.server.GET(s.basePath+"/healthz", s.GetHealthz)
+		s.server.GET(s.basePath+"/readyz", s.GetReadyz)
+	}
+}
+
+// GetHealthz reports that the process is alive.
+func (s *Server) GetHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// GetReadyz reports whether the portal can serve requests: the database responds, all enabled interfaces exist and
+// the authentication providers are set up.
+func (s *Server) GetReadyz(c *gin.Context) {
+	failures := make([]HealthCheckFailure, 0)
+
+	if s.db == nil {
+		failures = append(failures, HealthCheckFailure{Component: "database", Error: "not connected"})
+	} else if sqlDB, err := s.db.DB(); err != nil {
+		failures = append(failures, HealthCheckFailure{Component: "database", Error: "not connected"})
+	} else {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), healthDatabaseTimeout)
+		err := sqlDB.PingContext(ctx)
+		cancel()
+		if err != nil {
+			logrus.Debugf("readiness check: database ping failed: %v", err)
+			failures = append(failures, HealthCheckFailure{Component: "database", Error: "ping failed"})
+		}
+	}
+
+	failures = append(failures, s.checkDeviceHealth()...)
+
+	if s.auth == nil || len(s.auth.GetProviders()) == 0 {
+		failures = append(failures, HealthCheckFailure{Component: "authentication", Error: "setup not completed"})
+	}
+
+	if len(failures) > 0 {
+		c.JSON(http.StatusServiceUnavailable, HealthStatus{Status: "unavailable", Failing: failures})
+		return
+	}
+	c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// checkDeviceHealth reads all enabled interfaces from the WireGuard implementation. The result is cached for
+// healthDeviceCheckCache.
+func (s *Server) checkDeviceHealth() []HealthCheckFailure {
+	if s.wg == nil || s.peers == nil {
+		return []HealthCheckFailure{{Component: "interfaces", Error: "setup not completed"}}
+	}
+
+	s.deviceHealth.mux.Lock()
+	defer s.deviceHealth.mux.Unlock()
+	if time.Since(s.deviceHealth.checkedAt) < healthDeviceCheckCache {
+		return s.deviceHealth.failures
+	}
+
+	failures := make([]HealthCheckFailure, 0)
+	for _, deviceName := range s.config.WG.DeviceNames {
+		if s.wg.IsExternalDevice(deviceName) || s.peers.GetDevice(deviceName).DisabledAt != nil {
+			continue // external servers and disabled interfaces have no link
+		}
+		if _, err := s.wg.GetDeviceInfo(deviceName); err != nil {
+			logrus.Debugf("readiness check: interface %s: %v", deviceName, err)
+			failures = append(failures, HealthCheckFailure{Component: "interface " + deviceName, Error: "not found"})
+		}
+	}
+	s.deviceHealth.checkedAt = time.Now()
+	s.deviceHealth.failures = failures
+
+	return failures
+}
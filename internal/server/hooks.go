@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const maxCommandOutput = 500 // characters of the command output that are included in error messages
+
+// runCommand runs the shell command with the given timeout and returns its combined stdout and stderr. The shell
+// exits on the first failing command of a list. %i is replaced by the interface name.
+func (s *Server) runCommand(command, device string, timeout time.Duration) (string, error) {
+	command = strings.ReplaceAll(command, "%i", device)
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "/bin/sh", "-e", "-c", command).CombinedOutput()
+	trimmedOutput := strings.TrimSpace(string(output))
+	if ctx.Err() == context.DeadlineExceeded {
+		return trimmedOutput, errors.Errorf("command timed out after %s", timeout)
+	}
+	if err != nil && trimmedOutput == "" {
+		return trimmedOutput, errors.Wrap(err, "command failed")
+	}
+	if err != nil {
+		if len(trimmedOutput) > maxCommandOutput {
+			trimmedOutput = trimmedOutput[:maxCommandOutput] + "..."
+		}
+		return trimmedOutput, errors.Wrapf(err, "command failed: %s", trimmedOutput)
+	}
+
+	return trimmedOutput, nil
+}
+
+// runHook runs one of the PreUp, PostUp, PreDown or PostDown hooks of the interface. Nothing is run if the hook is
+// empty or WG_EXECUTE_HOOKS is disabled. The hooks of interfaces on a remote host run on that host, the hooks of
+// external interfaces never run.
+func (s *Server) runHook(dev wireguard.Device, name, command string) error {
+	if command == "" || !s.config.WG.ExecuteHooks || s.wg.IsExternalDevice(dev.DeviceName) {
+		return nil
+	}
+
+	var output string
+	var err error
+	if s.wg.IsRemoteDevice(dev.DeviceName) {
+		output, err = s.wg.RunHostCommand(dev.DeviceName, strings.ReplaceAll(command, "%i", dev.DeviceName),
+			s.config.WG.HookTimeout)
+	} else {
+		output, err = s.runCommand(command, dev.DeviceName, s.config.WG.HookTimeout)
+	}
+	if err != nil {
+		logrus.Errorf("%s hook of interface %s failed: %v", name, dev.DeviceName, err)
+		return errors.WithMessagef(err, "%s hook failed", name)
+	}
+	logrus.Debugf("%s hook of interface %s succeeded: %s", name, dev.DeviceName, output)
+
+	return nil
+}
+
+// linkUp brings the link of the interface up and installs the routes of the peers. The PreUp and PostUp hooks only
+// run if the link was down. If the PostUp hook fails, the link is brought down again.
+func (s *Server) linkUp(dev wireguard.Device) error {
+	if up, err := s.wg.IsLinkUp(dev.DeviceName); err == nil && up {
+		return nil
+	}
+
+	if err := s.runHook(dev, "PreUp", dev.PreUp); err != nil {
+		return err
+	}
+	if err := s.wg.SetLinkUp(dev.DeviceName); err != nil {
+		return errors.WithMessage(err, "failed to bring up interface")
+	}
+	if err := s.runHook(dev, "PostUp", dev.PostUp); err != nil {
+		if downErr := s.wg.SetLinkDown(dev.DeviceName); downErr != nil {
+			logrus.Errorf("failed to bring down interface %s after the PostUp hook failed: %v", dev.DeviceName, downErr)
+		}
+		return errors.WithMessage(err, "interface was brought down again")
+	}
+	s.syncDeviceRoutes(dev.DeviceName) // the kernel removed the routes of the peers when the link went down
+
+	return nil
+}
+
+// linkDown brings the link of the interface down and removes its policy routing rules. The PreDown and PostDown hooks
+// only run if the link was up. A failing hook does not keep the link up, the error is returned once the link is down.
+func (s *Server) linkDown(dev wireguard.Device) error {
+	if up, err := s.wg.IsLinkUp(dev.DeviceName); err == nil && !up {
+		return nil
+	}
+
+	hookErr := s.runHook(dev, "PreDown", dev.PreDown)
+	if err := s.wg.SetLinkDown(dev.DeviceName); err != nil {
+		return errors.WithMessage(err, "failed to bring down interface")
+	}
+	s.syncRoutingRules("") // the kernel removed the routes, the rules of the interface are removed as well
+	if err := s.runHook(dev, "PostDown", dev.PostDown); err != nil && hookErr == nil {
+		hookErr = err
+	}
+	if hookErr != nil {
+		return errors.WithMessage(hookErr, "interface was brought down")
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	importAssignComments = "comments" // peers are assigned to the existing users that are named in the comments
+	importAssignNone     = "none"     // all new peers stay unassigned
+)
+
+// importFile is a wg-quick configuration file in the WireGuard config directory.
+type importFile struct {
+	Name    string // file name
+	Device  string // interface name, the file name without .conf
+	Managed bool   // the interface is one of the managed devices
+}
+
+// GetImportableConfigFiles lists the wg-quick configuration files in the WireGuard config directory.
+func (s *Server) GetImportableConfigFiles() []importFile {
+	files := make([]importFile, 0)
+	if s.config.WG.ConfigDirectoryPath == "" {
+		return files
+	}
+
+	matches, err := filepath.Glob(path.Join(s.config.WG.ConfigDirectoryPath, "*.conf"))
+	if err != nil {
+		return files
+	}
+	sort.Strings(matches)
+	for _, match := range matches {
+		name := filepath.Base(match)
+		device := strings.TrimSuffix(name, ".conf")
+		if !wireguard.IsValidInterfaceName(device) {
+			continue
+		}
+		files = append(files, importFile{Name: name, Device: device,
+			Managed: common.ListContains(s.config.WG.DeviceNames, device)})
+	}
+
+	return files
+}
+
+// ReadImportableConfigFile reads a wg-quick configuration file of the WireGuard config directory and returns its
+// content and the interface name.
+func (s *Server) ReadImportableConfigFile(name string) (string, string, error) {
+	for _, file := range s.GetImportableConfigFiles() {
+		if file.Name != name {
+			continue
+		}
+
+		filePath := path.Join(s.config.WG.ConfigDirectoryPath, file.Name)
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return "", "", errors.Wrap(err, "failed to read configuration file")
+		}
+		if info.Size() > maxImportConfigSize {
+			return "", "", errors.New("configuration file is too large")
+		}
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return "", "", errors.Wrap(err, "failed to read configuration file")
+		}
+		return string(content), file.Device, nil
+	}
+
+	return "", "", errors.Errorf("no configuration file %s in %s", name, s.config.WG.ConfigDirectoryPath)
+}
+
+// AssignImportedPeers sets the owners of the imported peers. With importAssignComments, peers are assigned to the
+// existing users that are named in their comments (-WGP- Peer email, Email = or User = notation). All other peers are
+// left unassigned.
+func (s *Server) AssignImportedPeers(cfg *wireguard.ImportedConfig, assign string) {
+	for i := range cfg.Peers {
+		peer := &cfg.Peers[i]
+		if assign != importAssignComments || s.users.GetUser(peer.Email) == nil {
+			peer.Email = wireguard.AutodetectedPeerEmail
+		}
+	}
+}
+
+// PreviewWireGuardImport returns the changes that ImportWireGuardConfig would make.
+func (s *Server) PreviewWireGuardImport(cfg wireguard.ImportedConfig) (wireguard.ImportResult, error) {
+	if err := s.validateWireGuardImport(cfg); err != nil {
+		return wireguard.ImportResult{}, err
+	}
+
+	return s.peers.PreviewImport(cfg)
+}
+
+// ImportWireGuardConfig stores the interface and peers of a parsed wg-quick configuration file and applies them to
+// the physical interface. Interfaces that are not managed yet are added to the managed devices, the physical
+// interface is created if MANAGE_INTERFACES is enabled and brought up if it is down. Peers that already exist are
+// updated, new peers must not use addresses of other peers of the interface. If the configuration was already
+// imported, nothing is changed.
+func (s *Server) ImportWireGuardConfig(cfg wireguard.ImportedConfig, actor string) (wireguard.ImportResult, error) {
+	device := cfg.Device.DeviceName
+	if err := s.validateWireGuardImport(cfg); err != nil {
+		return wireguard.ImportResult{}, err
+	}
+
+	newDevice := !common.ListContains(s.config.WG.DeviceNames, device)
+	if newDevice && s.config.WG.ManageInterfaces {
+		created, err := s.wg.CreateDevice(device)
+		if err != nil {
+			return wireguard.ImportResult{}, err
+		}
+		if created {
+			logrus.Infof("created WireGuard interface %s for the import", device)
+		}
+	}
+
+	result, err := s.peers.ImportConfig(cfg, actor)
+	if err != nil {
+		return result, errors.WithMessage(err, "failed to store imported configuration")
+	}
+	if result.AlreadyImported() && !newDevice {
+		return result, nil
+	}
+	logrus.Infof("imported configuration of %s: %d peers created, %d updated, %d unchanged", device, result.Created,
+		result.Updated, result.Unchanged)
+
+	if newDevice {
+		s.config.WG.DeviceNames = append(s.config.WG.DeviceNames, device)
+		logrus.Warnf("imported interface %s, add it to the configured devices to keep it managed after a restart",
+			device)
+		s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventInterfaceCreated, Interface: device,
+			Actor: actor})
+	} else if result.DeviceChanged {
+		s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventInterfaceUpdated, Interface: device,
+			Actor: actor})
+	}
+	for _, peer := range cfg.Peers {
+		var eventType common.WebhookEventType
+		switch result.Peers[peer.PublicKey] {
+		case wireguard.ImportStatusCreated:
+			eventType = common.WebhookEventPeerCreated
+		case wireguard.ImportStatusUpdated:
+			eventType = common.WebhookEventPeerUpdated
+		default:
+			continue
+		}
+		s.webhooks.Dispatch(common.WebhookEvent{Type: eventType, Interface: device, PeerKey: peer.PublicKey,
+			Actor: actor})
+	}
+
+	// RestoreWireGuardInterface only updates the interface itself if wg-portal manages the interfaces
+	dev := s.peers.GetDevice(device)
+	if !s.config.WG.ManageInterfaces {
+		if err := s.wg.UpdateDevice(device, dev.GetConfig()); err != nil {
+			return result, errors.WithMessage(err, "configuration was stored but could not be applied")
+		}
+	}
+	if err := s.RestoreWireGuardInterface(device); err != nil {
+		return result, errors.WithMessage(err, "configuration was stored but could not be applied")
+	}
+	if dev.DisabledAt == nil {
+		if err := s.linkUp(dev); err != nil {
+			return result, errors.WithMessage(err, "configuration was stored but the interface could not be brought up")
+		}
+	}
+
+	return result, s.WriteWireGuardConfigFile(device)
+}
+
+// validateWireGuardImport checks that the imported interface can be managed and that new peers do not use addresses
+// of other peers of the interface.
+func (s *Server) validateWireGuardImport(cfg wireguard.ImportedConfig) error {
+	device := cfg.Device.DeviceName
+	if err := wireguard.ValidateInterfaceParameters(device, cfg.Device.Mtu, cfg.Device.GetIPAddresses()); err != nil {
+		return err
+	}
+	if !common.ListContains(s.config.WG.DeviceNames, device) && !s.config.WG.ManageInterfaces {
+		if _, err := s.wg.IsLinkUp(device); err != nil {
+			return errors.Errorf("interface %s does not exist, enable MANAGE_INTERFACES to create it", device)
+		}
+	}
+
+	if err := s.validateDeviceListenPort(cfg.Device); err != nil {
+		return err
+	}
+
+	reservedIps, err := s.peers.GetAllReservedIps(device)
+	if err != nil {
+		return errors.WithMessage(err, "failed to load reserved ip addresses")
+	}
+	for _, peer := range cfg.Peers {
+		if existing := s.peers.GetPeerByKey(peer.PublicKey); existing.PublicKey != "" {
+			continue
+		}
+		for _, cidr := range peer.GetIPAddresses() {
+			ip, _, _ := net.ParseCIDR(cidr)
+			if common.ListContains(reservedIps, ip.String()) {
+				return errors.Errorf("ip address %s of peer %s is already in use", ip, peer.Identifier)
+			}
+		}
+	}
+
+	return nil
+}
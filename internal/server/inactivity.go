@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const inactivityCheckInterval = time.Hour
+
+// InactivePeer is a peer that exceeds the inactivity threshold of its interface.
+type InactivePeer struct {
+	Peer           wireguard.Peer
+	LastActivity   time.Time // last handshake, or creation/reactivation date if the peer never connected since then
+	NeverConnected bool
+}
+
+// GetInactivePeers returns all active peers of the interface that would be disabled by the inactivity check. Nothing
+// is changed, so this can be used as a dry-run. The handshakes of external interfaces are unknown, their peers are
+// never inactive.
+func (s *Server) GetInactivePeers(device string) []InactivePeer {
+	dev := s.peers.GetDevice(device)
+	if dev.InactivityDisableDays <= 0 || s.wg.IsExternalDevice(device) {
+		return nil
+	}
+	threshold := time.Now().AddDate(0, 0, -dev.InactivityDisableDays)
+
+	inactivePeers := make([]InactivePeer, 0)
+	for _, peer := range s.peers.GetActivePeers(device) {
+		if s.isInactivityExempt(peer) {
+			continue
+		}
+
+		lastActivity, neverConnected := peerLastActivity(peer)
+		if lastActivity.Before(threshold) {
+			inactivePeers = append(inactivePeers, InactivePeer{
+				Peer:           peer,
+				LastActivity:   lastActivity,
+				NeverConnected: neverConnected,
+			})
+		}
+	}
+
+	return inactivePeers
+}
+
+func (s *Server) isInactivityExempt(peer wireguard.Peer) bool {
+	if !s.config.WG.InactivityExemptAdmins {
+		return false
+	}
+	if peer.Email == s.config.Core.AdminUser {
+		return true
+	}
+	user := s.users.GetUser(peer.Email)
+	return user != nil && user.IsAdmin
+}
+
+// peerLastActivity returns the most recent of the known handshake times, the creation date and the reactivation date.
+func peerLastActivity(peer wireguard.Peer) (time.Time, bool) {
+	var handshake time.Time
+	if peer.Peer != nil && !peer.Peer.LastHandshakeTime.IsZero() {
+		handshake = peer.Peer.LastHandshakeTime
+	}
+	if peer.Statistic != nil && peer.Statistic.LastHandshake != nil && peer.Statistic.LastHandshake.After(handshake) {
+		handshake = *peer.Statistic.LastHandshake
+	}
+
+	lastActivity := peer.CreatedAt
+	if handshake.After(lastActivity) {
+		lastActivity = handshake
+	}
+	if peer.ReactivatedAt != nil && peer.ReactivatedAt.After(lastActivity) {
+		lastActivity = *peer.ReactivatedAt
+	}
+
+	return lastActivity, handshake.IsZero()
+}
+
+// DisableInactivePeers disables all peers returned by GetInactivePeers and returns the number of disabled peers.
+func (s *Server) DisableInactivePeers(device string) (int, error) {
+	disabled := 0
+	var lastErr error
+	for _, inactivePeer := range s.GetInactivePeers(device) {
+		peer := inactivePeer.Peer
+		now := time.Now()
+		peer.DeactivatedAt = &now
+		peer.DeactivationReason = wireguard.DeactivationReasonInactivity
+		peer.UpdatedBy = "inactivity-check"
+		if err := s.UpdatePeer(peer, now); err != nil {
+			lastErr = errors.WithMessagef(err, "failed to disable inactive peer %s", peer.PublicKey)
+			logrus.Errorf("%v", lastErr)
+			continue
+		}
+		disabled++
+		logrus.Infof("disabled peer %s (%s) of %s, inactive since %s", peer.Identifier, peer.PublicKey, device,
+			inactivePeer.LastActivity.Format(time.RFC3339))
+
+		if s.config.WG.InactivityNotifyOwner && peer.HasEmail() {
+			if err := s.sendInactivityMail(peer, inactivePeer.LastActivity); err != nil {
+				logrus.Warnf("failed to notify owner of inactive peer %s: %v", peer.PublicKey, err)
+			}
+		}
+	}
+
+	return disabled, lastErr
+}
+
+func (s *Server) sendInactivityMail(peer wireguard.Peer, lastActivity time.Time) error {
+	body := fmt.Sprintf("Your WireGuard VPN peer \"%s\" has been disabled because it was not used since %s.\n"+
+		"Please contact your administrator if you still need access.", peer.Identifier, lastActivity.Format("2006-01-02"))
+	htmlBody := "<p>" + html.EscapeString(body) + "</p>"
+
+	return common.SendEmailWithAttachments(s.config.Email, s.config.Core.MailFrom, "", "WireGuard VPN peer disabled",
+		body, htmlBody, []string{peer.Email}, nil)
+}
+
+// RunInactivityCheck periodically disables inactive peers of all interfaces until the given context is cancelled.
+func (s *Server) RunInactivityCheck(ctx context.Context) {
+	ticker := time.NewTicker(inactivityCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, device := range s.wg.Cfg.DeviceNames {
+			if count, err := s.DisableInactivePeers(device); err != nil {
+				logrus.Errorf("inactivity check for %s failed: %v", device, err)
+			} else if count > 0 {
+				logrus.Infof("inactivity check disabled %d peers of %s", count, device)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,758 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ApplyDeviceChanges applies the updated settings to the physical interface. The link settings (MTU and addresses)
+// are changed first and the WireGuard configuration last. If the kernel rejects the WireGuard configuration, e.g.
+// because the new listen port is in use, the link settings of the current device are restored. The link is never
+// recreated, so connected peers are not affected by a changed listen port.
+func (s *Server) ApplyDeviceChanges(current, updated wireguard.Device) error {
+	if s.config.WG.ManageIPAddresses {
+		if err := s.applyDeviceLink(updated); err != nil {
+			s.rollbackDeviceLink(current)
+			return err
+		}
+	}
+
+	if err := s.wg.UpdateDevice(updated.DeviceName, updated.GetConfig()); err != nil {
+		if s.config.WG.ManageIPAddresses {
+			s.rollbackDeviceLink(current)
+		}
+		return errors.Wrap(err, "the interface rejected the WireGuard configuration")
+	}
+
+	return nil
+}
+
+func (s *Server) applyDeviceLink(dev wireguard.Device) error {
+	if err := s.wg.SetMTU(dev.DeviceName, dev.Mtu); err != nil {
+		return errors.WithMessage(err, "failed to update MTU")
+	}
+	if err := s.wg.SetIPAddress(dev.DeviceName, dev.GetIPAddresses()); err != nil {
+		return errors.WithMessage(err, "failed to update ip addresses")
+	}
+
+	return nil
+}
+
+func (s *Server) rollbackDeviceLink(dev wireguard.Device) {
+	if err := s.applyDeviceLink(dev); err != nil {
+		logrus.Errorf("failed to restore link settings of interface %s: %v", dev.DeviceName, err)
+	}
+}
+
+// validateDeviceNamespace checks the network namespace of an interface. Interfaces of remote hosts are moved into a
+// namespace on their host, which the portal does not manage.
+func (s *Server) validateDeviceNamespace(dev wireguard.Device) error {
+	if dev.Namespace != "" && s.wg.IsRemoteDevice(dev.DeviceName) {
+		return errors.Errorf("interface %s is managed by its host agent, it cannot be moved into a network namespace",
+			dev.DeviceName)
+	}
+	if err := wireguard.ValidateNamespaceName(dev.Namespace); err != nil {
+		return errors.Errorf("invalid network namespace %s", dev.Namespace)
+	}
+
+	return nil
+}
+
+// moveDevice moves the link of the interface into the network namespace. The firewall rules and routes of the portal
+// are removed from the previous namespace first, they are applied in the new namespace once the link is up again.
+func (s *Server) moveDevice(dev wireguard.Device, namespace string) error {
+	if s.config.WG.ManageFirewall {
+		if err := s.wg.RemoveMasqueradeRules(dev.DeviceName); err != nil {
+			logrus.Errorf("failed to remove firewall rules of interface %s: %v", dev.DeviceName, err)
+		}
+	}
+	s.removeDeviceRoutes(dev.DeviceName)
+
+	if err := s.wg.SetDeviceNamespace(dev.DeviceName, namespace); err != nil {
+		s.restoreDeviceNamespace(dev)
+		return errors.WithMessage(err, "failed to move the interface into its network namespace")
+	}
+
+	return nil
+}
+
+// restoreDeviceNamespace moves the interface back into its previous network namespace after a failed update and
+// applies its link settings, link state and firewall rules again.
+func (s *Server) restoreDeviceNamespace(dev wireguard.Device) {
+	if err := s.wg.SetDeviceNamespace(dev.DeviceName, dev.Namespace); err != nil {
+		logrus.Errorf("failed to move interface %s back into its network namespace: %v", dev.DeviceName, err)
+		return
+	}
+	if s.config.WG.ManageIPAddresses {
+		s.rollbackDeviceLink(dev)
+	}
+	if dev.DisabledAt == nil {
+		if err := s.linkUp(dev); err != nil {
+			logrus.Errorf("failed to bring up interface %s in its network namespace: %v", dev.DeviceName, err)
+		}
+		if err := s.applyFirewallRules(dev); err != nil {
+			logrus.Errorf("failed to restore firewall rules of interface %s: %v", dev.DeviceName, err)
+		}
+	}
+}
+
+// DeviceUpdateError is returned by UpdateDeviceSettings if the updated settings are invalid or cannot be applied. Step
+// names the failed step, e.g. "port", the web interface passes it on as form error.
+type DeviceUpdateError struct {
+	Step string
+	Err  error
+}
+
+func (e *DeviceUpdateError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeviceUpdateError) Unwrap() error {
+	return e.Err
+}
+
+// UpdateDeviceSettings validates the updated settings of an interface and applies them to the link, the WireGuard
+// device, the database, the configuration file, the firewall and the routes. The web interface and the gRPC API both
+// update interfaces here, so their changes are validated and applied identically. The returned warnings do not
+// prevent the update.
+func (s *Server) UpdateDeviceSettings(updated wireguard.Device, regenerateKey bool, actor string) ([]string, error) {
+	currentDevice := s.peers.GetDevice(updated.DeviceName)
+	if !currentDevice.IsValid() {
+		return nil, &DeviceUpdateError{Step: "device", Err: errors.Errorf("unknown interface %s", updated.DeviceName)}
+	}
+
+	updated, endpointWarning, err := s.prepareDeviceSettings(currentDevice, updated)
+	if err != nil {
+		return nil, err
+	}
+	external := s.wg.IsExternalDevice(updated.DeviceName)
+	randomPort := !external && updated.Type == wireguard.DeviceTypeServer && updated.ListenPort == 0
+
+	// A new key pair invalidates the configurations of all peers
+	regenerateKey = regenerateKey && !external
+	if regenerateKey {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return nil, &DeviceUpdateError{Step: "key", Err: errors.Wrap(err, "failed to generate private key")}
+		}
+		updated.PrivateKey = key.String()
+		updated.PublicKey = key.PublicKey().String()
+	}
+
+	// Move the link into the new network namespace, the addresses and the link state are applied again below
+	namespaceChanged := updated.Namespace != currentDevice.Namespace
+	if namespaceChanged {
+		if err := s.moveDevice(currentDevice, updated.Namespace); err != nil {
+			return nil, &DeviceUpdateError{Step: "namespace", Err: err}
+		}
+	}
+
+	// Update the link and the WireGuard device
+	updated.DisabledAt = currentDevice.DisabledAt // changed by the state actions only
+	if err := s.ApplyDeviceChanges(currentDevice, updated); err != nil {
+		if namespaceChanged {
+			s.restoreDeviceNamespace(currentDevice)
+		}
+		return nil, &DeviceUpdateError{Step: "wg",
+			Err: errors.WithMessage(err, "failed to update device, the previous settings were restored")}
+	}
+	if namespaceChanged && updated.DisabledAt == nil {
+		if err := s.linkUp(updated); err != nil {
+			s.restoreDeviceNamespace(currentDevice)
+			return nil, &DeviceUpdateError{Step: "namespace", Err: errors.WithMessage(err,
+				"failed to bring up the interface in its network namespace, the previous namespace was restored")}
+		}
+	}
+
+	// Store the port that the kernel has chosen, so that it stays the same on restarts
+	if randomPort {
+		wgDevice, err := s.wg.RefreshDeviceInfo(updated.DeviceName)
+		if err != nil {
+			return nil, &DeviceUpdateError{Step: "wg",
+				Err: errors.WithMessage(err, "failed to read the listen port of the device")}
+		}
+		updated.ListenPort = wgDevice.ListenPort
+		updated.ResolvedEndpoint = updated.ResolveEndpoint(s.wg.DefaultEndpointHost(updated.DeviceName))
+		if endpointWarning, err = s.validateDeviceEndpoint(updated); err != nil {
+			endpointWarning = err.Error()
+		}
+	}
+
+	// Update in database
+	if err := s.peers.UpdateDevice(updated); err != nil {
+		return nil, &DeviceUpdateError{Step: "update", Err: errors.WithMessage(err, "failed to update device in database")}
+	}
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventInterfaceUpdated, Interface: updated.DeviceName,
+		Actor: actor})
+
+	// Update WireGuard config file
+	if err := s.WriteWireGuardConfigFile(updated.DeviceName); err != nil {
+		return nil, &DeviceUpdateError{Step: "update",
+			Err: errors.WithMessage(err, "failed to update WireGuard config-file")}
+	}
+
+	warnings := make([]string, 0)
+	if updated.DisabledAt == nil {
+		if err := s.applyFirewallRules(updated); err != nil {
+			warnings = append(warnings, "Failed to update firewall rules: "+err.Error())
+		}
+		s.syncDeviceRoutes(updated.DeviceName)
+	}
+	if endpointWarning != "" {
+		warnings = append(warnings, "Warning: "+endpointWarning)
+	}
+	if updated.TunnelMode == wireguard.TunnelModeGateway && len(updated.GetDNSServers()) == 0 {
+		warnings = append(warnings, "Warning: the interface is a full tunnel gateway without DNS servers, peers "+
+			"keep using their local DNS servers.")
+	}
+	if regenerateKey {
+		warnings = append(warnings, "A new key pair was generated, all peers need an updated configuration.")
+	}
+	if !s.config.WG.ManageIPAddresses {
+		warnings = append(warnings, "WireGuard must be restarted to apply ip changes.")
+	}
+
+	return warnings, nil
+}
+
+// prepareDeviceSettings cleans and validates the submitted settings of the interface, see UpdateDeviceSettings. It
+// returns the settings as they are stored and the warning of the endpoint check, nothing is changed.
+func (s *Server) prepareDeviceSettings(currentDevice, updated wireguard.Device) (wireguard.Device, string, error) {
+	// Clean list input
+	updated.IPsStr = common.ListToString(common.ParseStringList(updated.IPsStr))
+	updated.DefaultAllowedIPsStr = common.ListToString(common.ParseStringList(updated.DefaultAllowedIPsStr))
+	updated.DNSStr = common.ListToString(common.ParseStringList(updated.DNSStr))
+	updated.EndpointCandidatesStr = common.ListToString(common.ParseStringList(updated.EndpointCandidatesStr))
+
+	// The portal only knows the public key and the endpoint of an external server
+	external := s.wg.IsExternalDevice(updated.DeviceName)
+	if external {
+		updated.Type = wireguard.DeviceTypeServer
+		updated.ListenPort = 0
+		updated.UpstreamInterface = ""
+		updated.Namespace = ""
+		updated.SaveConfig = false
+		if err := validateExternalServer(updated); err != nil {
+			return updated, "", &DeviceUpdateError{Step: "external", Err: err}
+		}
+	}
+
+	// Clean interface parameters based on interface type
+	switch updated.Type {
+	case wireguard.DeviceTypeClient:
+		updated.ListenPort = 0
+		updated.DefaultEndpoint = ""
+		updated.EndpointCandidatesStr = ""
+		updated.UpstreamInterface = ""
+		updated.DefaultAllowedIPsStr = ""
+		updated.DefaultPersistentKeepalive = 0
+		updated.SaveConfig = false
+		updated.InactivityDisableDays = 0
+		updated.DefaultAllowedIPsPresetID = 0
+		updated.DefaultGuestDays = 0
+		updated.InheritDNS = false
+		updated.InheritAllowedIPs = false
+		updated.InheritKeepalive = false
+		updated.TunnelMode = wireguard.TunnelModeCustom
+	case wireguard.DeviceTypeServer:
+		if updated.TunnelMode != wireguard.TunnelModeCustom {
+			// The tunnel mode drives the allowed IPs of new peers, existing peers keep their allowed IPs until the
+			// peer defaults are applied to them
+			updated.InheritAllowedIPs = false
+			updated.DefaultAllowedIPsStr = updated.TunnelModeAllowedIPs()
+		}
+	}
+
+	updated.UpstreamInterface = strings.TrimSpace(updated.UpstreamInterface)
+	if updated.UpstreamInterface != "" && !wireguard.IsValidInterfaceName(updated.UpstreamInterface) {
+		return updated, "", &DeviceUpdateError{Step: "upstream",
+			Err: errors.Errorf("invalid upstream interface name %s", updated.UpstreamInterface)}
+	}
+	updated.Namespace = strings.TrimSpace(updated.Namespace)
+	if err := s.validateDeviceNamespace(updated); err != nil {
+		return updated, "", &DeviceUpdateError{Step: "namespace", Err: err}
+	}
+	if updated.DefaultAllowedIPsPresetID != 0 {
+		if _, ok := s.defaultAllowedIPsPreset(updated); !ok {
+			return updated, "", &DeviceUpdateError{Step: "preset",
+				Err: errors.New("the allowed IPs preset of new peers does not exist")}
+		}
+	}
+	if err := s.validateDeviceListenPort(updated); err != nil {
+		return updated, "", &DeviceUpdateError{Step: "port", Err: err}
+	}
+	if err := validateDeviceAddresses(updated.IPsStr); err != nil {
+		return updated, "", &DeviceUpdateError{Step: "ip", Err: err}
+	}
+	if err := s.validateRemovedDeviceNetworks(currentDevice, updated); err != nil {
+		return updated, "", &DeviceUpdateError{Step: "ip", Err: err}
+	}
+	if err := validateDeviceRouting(updated); err != nil && s.config.WG.ManageRoutes {
+		return updated, "", &DeviceUpdateError{Step: "table", Err: err}
+	}
+	randomPort := !external && updated.Type == wireguard.DeviceTypeServer && updated.ListenPort == 0
+
+	// Validate the endpoint that is used in the peer configurations, with a random port the endpoint is only known
+	// once the interface was updated
+	var endpointWarning string
+	var err error
+	if !randomPort || updated.DefaultEndpoint != "" {
+		updated.ResolvedEndpoint = updated.ResolveEndpoint(s.wg.DefaultEndpointHost(updated.DeviceName))
+		endpointWarning, err = s.validateDeviceEndpoint(updated)
+		if err != nil {
+			return updated, "", &DeviceUpdateError{Step: "endpoint", Err: err}
+		}
+	}
+
+	return updated, endpointWarning, nil
+}
+
+// SettingChange is a setting of an interface or peer that changes, e.g. when the peer defaults of the interface are
+// applied.
+type SettingChange struct {
+	Setting string
+	Current string
+	New     string
+}
+
+// PeerDefaultsChange lists the changed settings of a peer, see PreviewDeviceDefaults.
+type PeerDefaultsChange struct {
+	Peer    wireguard.Peer
+	Changes []SettingChange
+}
+
+// PreviewDeviceDefaults returns the peers whose configuration changes if the peer defaults of the interface are
+// applied, see ApplyDeviceDefaultsToPeers. Nothing is stored. DNS, MTU, keepalive and endpoint are not listed, peers
+// that do not override them use the values of the interface anyway.
+func (s *Server) PreviewDeviceDefaults(device string) []PeerDefaultsChange {
+	dev := s.peers.GetDevice(device)
+	presetNames := map[uint]string{0: "none"}
+	for _, preset := range s.peers.GetAllowedIPsPresets(device) {
+		presetNames[preset.ID] = preset.Name
+	}
+
+	changes := make([]PeerDefaultsChange, 0)
+	for _, peer := range s.peers.GetAllPeers(device) {
+		if peer.IgnoreGlobalSettings {
+			continue
+		}
+		current := peer.WithEffectiveSettings(&dev)
+		updated := s.peerWithDeviceDefaults(dev, peer)
+
+		change := PeerDefaultsChange{Peer: peer}
+		change.add("Allowed IPs preset", presetNames[current.AllowedIPsPresetID], presetNames[updated.AllowedIPsPresetID])
+		change.add("Allowed IPs", current.AllowedIPsStr, updated.AllowedIPsStr)
+		if len(change.Changes) > 0 {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+func (c *PeerDefaultsChange) add(setting, current, updated string) {
+	addChange(&c.Changes, setting, current, updated)
+}
+
+// ApplyDeviceDefaultsToPeers copies the peer defaults of the interface to its peers. Peers that ignore the global
+// settings, use an allowed IPs preset or override single settings keep their own values.
+func (s *Server) ApplyDeviceDefaultsToPeers(device string) (int, error) {
+	dev := s.peers.GetDevice(device)
+	peers := s.peers.GetAllPeers(device)
+
+	updateCounter := 0
+	for _, peer := range peers {
+		if peer.IgnoreGlobalSettings {
+			continue
+		}
+
+		if err := s.peers.UpdatePeer(s.peerWithDeviceDefaults(dev, peer)); err != nil {
+			return updateCounter, err
+		}
+		updateCounter++
+	}
+
+	return updateCounter, nil
+}
+
+// peerWithDeviceDefaults returns the peer with the peer defaults of the interface. Peers without an allowed IPs preset
+// get the default preset of the interface, or the default allowed IPs if there is none.
+func (s *Server) peerWithDeviceDefaults(dev wireguard.Device, peer wireguard.Peer) wireguard.Peer {
+	if peer.AllowedIPsPresetID == 0 {
+		peer.AllowedIPsStr = dev.DefaultAllowedIPsStr
+		if preset, ok := s.defaultAllowedIPsPreset(dev); ok {
+			peer.AllowedIPsPresetID = preset.ID
+			peer.AllowedIPsStr = preset.AllowedIPsStr
+		}
+	}
+	if !peer.OverrideEndpoint {
+		peer.Endpoint = dev.ResolvedEndpoint
+	}
+	return peer.WithEffectiveSettings(&dev) // per-peer overrides are kept
+}
+
+// defaultAllowedIPsPreset returns the allowed IPs preset of new peers of the interface, if one is set.
+func (s *Server) defaultAllowedIPsPreset(dev wireguard.Device) (wireguard.AllowedIPsPreset, bool) {
+	if dev.DefaultAllowedIPsPresetID == 0 {
+		return wireguard.AllowedIPsPreset{}, false
+	}
+	preset, err := s.peers.GetAllowedIPsPreset(dev.DefaultAllowedIPsPresetID)
+	if err != nil || preset.DeviceName != dev.DeviceName {
+		return wireguard.AllowedIPsPreset{}, false
+	}
+	return preset, true
+}
+
+// SetDeviceDisabled brings the link of the interface down or up again. The settings and peers of a disabled interface
+// are kept, it also stays down on restarts of the portal.
+func (s *Server) SetDeviceDisabled(device string, disabled bool, actor string) error {
+	dev := s.peers.GetDevice(device)
+	if disabled == (dev.DisabledAt != nil) {
+		return nil
+	}
+
+	action := "interface.enabled"
+	if disabled {
+		if err := s.linkDown(dev); err != nil {
+			return err
+		}
+		if s.config.WG.ManageFirewall {
+			if err := s.wg.RemoveMasqueradeRules(device); err != nil {
+				logrus.Errorf("failed to remove firewall rules of interface %s: %v", device, err)
+			}
+		}
+		now := time.Now()
+		dev.DisabledAt = &now
+		action = "interface.disabled"
+	} else {
+		if err := s.linkUp(dev); err != nil {
+			return err
+		}
+		if err := s.applyFirewallRules(dev); err != nil {
+			logrus.Errorf("failed to apply firewall rules of interface %s: %v", device, err)
+		}
+		dev.DisabledAt = nil
+	}
+
+	if err := s.peers.UpdateDevice(dev); err != nil {
+		return errors.WithMessage(err, "failed to update device in database")
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: action, Interface: device})
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventInterfaceUpdated, Interface: device, Actor: actor})
+
+	return nil
+}
+
+// RestartDevice brings the link of the interface down and restores the interface and its peers from the database.
+func (s *Server) RestartDevice(device string, actor string) error {
+	dev := s.peers.GetDevice(device)
+	if dev.DisabledAt != nil {
+		return errors.New("the interface is disabled")
+	}
+
+	if err := s.linkDown(dev); err != nil {
+		return err
+	}
+	if err := s.RestoreWireGuardInterface(device); err != nil {
+		return err
+	}
+	if !s.config.WG.ManageInterfaces { // otherwise the link was brought up by the restore
+		if err := s.linkUp(dev); err != nil {
+			return err
+		}
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "interface.restarted", Interface: device})
+
+	return nil
+}
+
+// Results of the startup restore of an interface
+const (
+	RestoreStateRestored = "restored"        // the interface was missing and has been created again
+	RestoreStatePresent  = "already present" // the interface existed, the stored state has been applied
+	RestoreStateFailed   = "failed"
+)
+
+// InterfaceRestoreResult is the result of the startup restore of an interface.
+type InterfaceRestoreResult struct {
+	State string
+	Error string `json:",omitempty"`
+}
+
+// createMissingInterfaces creates the managed interfaces that do not exist, e.g. after a reboot of the host. It runs
+// before the peer manager imports the existing interfaces. Interfaces that cannot be created are marked as failed, the
+// other interfaces are still created.
+func (s *Server) createMissingInterfaces() {
+	for _, deviceName := range s.config.WG.DeviceNames {
+		if s.wg.IsExternalDevice(deviceName) {
+			continue
+		}
+		if err := s.setStoredNamespace(deviceName); err != nil {
+			s.setRestoreFailed(deviceName, err)
+			continue
+		}
+		if !s.config.WG.ManageInterfaces {
+			_, err := s.wg.IsLinkUp(deviceName)
+			switch {
+			case err == nil || s.wg.IsHostUnreachable(deviceName):
+			case wireguard.IsNamespaceNotFound(err):
+				s.setRestoreFailed(deviceName, err)
+			default:
+				s.setRestoreFailed(deviceName, errors.New("the interface does not exist, enable MANAGE_INTERFACES "+
+					"to create it"))
+			}
+			continue
+		}
+
+		if err := s.wg.CheckDeviceBackend(deviceName); err != nil {
+			s.setRestoreFailed(deviceName, err)
+			continue
+		}
+		if err := s.validateStoredInterface(deviceName); err != nil {
+			s.setRestoreFailed(deviceName, err)
+			continue
+		}
+		created, err := s.wg.CreateDevice(deviceName)
+		if err != nil && s.wg.IsHostUnreachable(deviceName) {
+			logrus.Warnf("unable to create WireGuard interface %s, its host is unreachable: %v", deviceName, err)
+			continue
+		}
+		if err != nil {
+			s.setRestoreFailed(deviceName, errors.WithMessage(err, "unable to create WireGuard interface"))
+			continue
+		}
+		if created {
+			logrus.Infof("created missing WireGuard interface %s", deviceName)
+			s.startupRestore[deviceName] = InterfaceRestoreResult{State: RestoreStateRestored}
+		}
+	}
+}
+
+// restoreInterfaces applies the stored settings and peers to all managed interfaces that could be created. Failures
+// only affect the failing interface. Interfaces on unreachable remote hosts are restored once they are reachable.
+// External interfaces have no state to restore.
+func (s *Server) restoreInterfaces() {
+	for _, deviceName := range s.config.WG.DeviceNames {
+		if s.wg.IsExternalDevice(deviceName) {
+			continue
+		}
+		result, ok := s.startupRestore[deviceName]
+		if ok && result.State == RestoreStateFailed {
+			continue
+		}
+		unreachable := s.wg.IsHostUnreachable(deviceName)
+		if s.peers.GetDevice(deviceName).DeviceName == "" {
+			if !unreachable {
+				s.setRestoreFailed(deviceName, errors.New("the interface could not be read"))
+			}
+			continue // interfaces of unreachable hosts are added once the host is reachable
+		}
+
+		err := s.RestoreWireGuardInterface(deviceName)
+		if err != nil && s.wg.IsHostUnreachable(deviceName) {
+			logrus.Warnf("the host of interface %s is unreachable, the interface is restored once it is reachable: %v",
+				deviceName, err)
+			continue
+		}
+		if err != nil {
+			s.setRestoreFailed(deviceName, errors.WithMessage(err, "unable to restore WireGuard state"))
+			continue
+		}
+		if !ok {
+			result.State = RestoreStatePresent
+		}
+		s.startupRestore[deviceName] = result
+		logrus.Infof("startup restore of interface %s: %s", deviceName, result.State)
+	}
+}
+
+// validateStoredInterface checks the parameters of an interface that is about to be created. The peer manager is not
+// set up yet when the missing interfaces are created, so the stored interface is read from the database directly.
+func (s *Server) validateStoredInterface(device string) error {
+	dev, err := s.storedDevice(device)
+	if err != nil {
+		return err
+	}
+	if dev.DeviceName == "" {
+		return wireguard.ValidateInterfaceName(device) // first start, the interface is imported from the link after its creation
+	}
+
+	return wireguard.ValidateInterfaceParameters(device, dev.Mtu, dev.GetIPAddresses())
+}
+
+// setStoredNamespace sets the network namespace of the stored interface before the interface is created or read, so
+// that its link is found in the namespace.
+func (s *Server) setStoredNamespace(device string) error {
+	dev, err := s.storedDevice(device)
+	if err != nil {
+		return err
+	}
+
+	return s.wg.SetDeviceNamespace(device, dev.Namespace)
+}
+
+// storedDevice reads the stored interface from the database. The returned device is empty if the interface is not
+// stored yet.
+func (s *Server) storedDevice(device string) (wireguard.Device, error) {
+	dev := wireguard.Device{}
+	if !s.db.Migrator().HasTable(&dev) {
+		return dev, nil // first start
+	}
+	if err := s.db.Where("device_name = ?", device).Limit(1).Find(&dev).Error; err != nil {
+		return dev, errors.WithMessage(err, "failed to read the stored interface")
+	}
+
+	return dev, nil
+}
+
+func (s *Server) setRestoreFailed(device string, err error) {
+	logrus.Errorf("startup restore of interface %s failed: %v", device, err)
+	s.startupRestore[device] = InterfaceRestoreResult{State: RestoreStateFailed, Error: err.Error()}
+}
+
+// restoreRestartedInterface configures the interface of a restarted wireguard-go process again. The new process lost
+// the whole configuration of the interface, including its addresses and peers.
+func (s *Server) restoreRestartedInterface(device string) {
+	_ = s.reapplyInterface(device, "its wireguard-go process was restarted")
+}
+
+// restoreReconnectedInterface applies the stored state to an interface of a remote host that is reachable again, so
+// that all changes that were queued while the host was unreachable take effect.
+func (s *Server) restoreReconnectedInterface(device string) {
+	_ = s.reapplyInterface(device, "its host is reachable again")
+}
+
+// reapplyInterface applies the stored settings, peers and link state to the interface. Interfaces that were not
+// reachable at startup are added to the database first. Failures are logged and returned.
+func (s *Server) reapplyInterface(device, reason string) error {
+	if s.peers == nil || !common.ListContains(s.config.WG.DeviceNames, device) {
+		return nil // still starting up, or the interface is no longer managed
+	}
+	fail := func(err error, action string) error {
+		err = errors.WithMessagef(err, "failed to %s interface %s after %s", action, device, reason)
+		logrus.Error(err)
+		return err
+	}
+	if s.peers.GetDevice(device).DeviceName == "" {
+		if err := s.peers.InitDeviceFromPhysicalInterface(device); err != nil {
+			return fail(err, "set up")
+		}
+	}
+
+	dev := s.peers.GetDevice(device)
+	if !s.config.WG.ManageInterfaces { // otherwise the settings and the link state are applied by the restore
+		if err := s.ApplyDeviceChanges(dev, dev); err != nil {
+			return fail(err, "apply the settings of")
+		}
+	}
+	if err := s.RestoreWireGuardInterface(device); err != nil {
+		return fail(err, "restore")
+	}
+	if !s.config.WG.ManageInterfaces {
+		linkState := s.linkUp
+		if dev.DisabledAt != nil {
+			linkState = s.linkDown
+		}
+		if err := linkState(dev); err != nil {
+			return fail(err, "restore the link state of")
+		}
+	}
+	logrus.Infof("restored interface %s after %s", device, reason)
+	return nil
+}
+
+// DeleteDevice removes the interface and all of its peers. The confirmation must be the interface name and the number
+// of peers that the administrator confirmed must match the current number of peers, so that peers created in the
+// meantime are not removed unnoticed.
+//
+// The interface is torn down in order: the link is brought down, the peers are removed from the interface, the routes,
+// routing rules and firewall rules of the portal are removed and the link is deleted. Afterwards the peers and the
+// interface are deleted from the database in one transaction. If the link is already gone, e.g. because a previous
+// deletion failed half-way, the link steps are skipped and the cleanup is resumed.
+func (s *Server) DeleteDevice(device, confirmation string, confirmedPeers int64, actor string) error {
+	if !s.config.WG.ManageInterfaces {
+		return errors.New("interfaces can only be deleted if MANAGE_INTERFACES is enabled")
+	}
+	if !common.ListContains(s.config.WG.DeviceNames, device) {
+		return errors.Errorf("no such interface %s", device)
+	}
+	if len(s.config.WG.DeviceNames) == 1 {
+		return errors.New("the last interface cannot be deleted")
+	}
+	if confirmation != device {
+		return errors.Errorf("type the interface name %s to confirm the deletion", device)
+	}
+	peerCount := s.peers.CountPeers(device)
+	if peerCount != confirmedPeers {
+		return errors.Errorf("the interface has %d peers now, please confirm the deletion again", peerCount)
+	}
+
+	removed := make([]string, 0)
+	dev := s.peers.GetDevice(device)
+	if _, err := s.wg.IsLinkUp(device); err == nil {
+		if err := s.linkDown(dev); err != nil {
+			logrus.Errorf("failed to bring down interface %s before deleting it: %v", device, err)
+		}
+		if wgDevice, err := s.wg.GetDeviceInfo(device); err == nil && len(wgDevice.Peers) > 0 {
+			if err := s.wg.UpdateDevice(device, wgtypes.Config{ReplacePeers: true}); err != nil {
+				logrus.Errorf("failed to remove the peers of interface %s before deleting it: %v", device, err)
+			} else {
+				removed = append(removed, fmt.Sprintf("%d peers of the link", len(wgDevice.Peers)))
+			}
+		}
+		if routes := s.removeDeviceRoutes(device); routes > 0 {
+			removed = append(removed, fmt.Sprintf("%d routes", routes))
+		}
+	} else {
+		s.syncRoutingRules(device) // the routes are gone with the link, the rules are not
+		removed = append(removed, "link was already gone")
+	}
+	if s.config.WG.ManageFirewall {
+		if err := s.wg.RemoveMasqueradeRules(device); err != nil {
+			logrus.Errorf("failed to remove firewall rules of interface %s: %v", device, err)
+		} else {
+			removed = append(removed, "firewall rules")
+		}
+	}
+	if err := s.wg.DeleteDevice(device); err != nil {
+		return err // nothing was deleted from the database, the deletion can be retried
+	}
+	removed = append(removed, "link")
+
+	if err := s.peers.DeleteDevice(device); err != nil {
+		return errors.WithMessage(err, "the link was deleted, but the interface could not be deleted in the database")
+	}
+	removed = append(removed, fmt.Sprintf("%d peers, presets and reservations", peerCount))
+	if s.config.WG.ConfigDirectoryPath != "" {
+		filePath := path.Join(s.config.WG.ConfigDirectoryPath, device+".conf")
+		if err := os.Remove(filePath); err == nil {
+			removed = append(removed, "config file "+filePath)
+		} else if !os.IsNotExist(err) {
+			logrus.Errorf("failed to remove WireGuard config file %s: %v", filePath, err)
+		}
+	}
+
+	deviceNames := make([]string, 0, len(s.config.WG.DeviceNames)-1)
+	for _, deviceName := range s.config.WG.DeviceNames {
+		if deviceName != device {
+			deviceNames = append(deviceNames, deviceName)
+		}
+	}
+	s.config.WG.DeviceNames = deviceNames
+	logrus.Warnf("deleted interface %s, remove it from the configured devices or it is created again on the next start",
+		device)
+
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "interface.deleted", Interface: device,
+		Details: "removed " + strings.Join(removed, ", ")})
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventInterfaceDeleted, Interface: device, Actor: actor})
+
+	return nil
+}
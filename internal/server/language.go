@@ -0,0 +1,136 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+	wgportal "github.com/h44z/wg-portal"
+	"github.com/h44z/wg-portal/internal/i18n"
+	"github.com/pkg/errors"
+)
+
+const (
+	languageCookieName   = "language"
+	languageCookieMaxAge = 365 * 86400 // the selected language is remembered for a year, also after logout
+)
+
+// loadTranslations loads the bundled catalogs and the catalogs of TRANSLATIONS_PATH, which may add languages or
+// override bundled translations.
+func (s *Server) loadTranslations() (*i18n.Catalog, error) {
+	catalog := i18n.NewCatalog()
+	if err := catalog.Load(wgportal.Translations, "assets/i18n"); err != nil {
+		return nil, errors.WithMessage(err, "failed to load bundled translations")
+	}
+	if s.config.Core.TranslationsPath != "" {
+		if err := catalog.LoadDir(s.config.Core.TranslationsPath); err != nil {
+			return nil, errors.WithMessagef(err, "failed to load translations of %s", s.config.Core.TranslationsPath)
+		}
+	}
+	return catalog, nil
+}
+
+// defaultLanguage returns DEFAULT_LANGUAGE, or the source language if it is not available.
+func (s *Server) defaultLanguage() string {
+	if lang := i18n.NormalizeTag(s.config.Core.DefaultLanguage); s.translations.Has(lang) {
+		return lang
+	}
+	return i18n.SourceLanguage
+}
+
+// languageMiddleware selects the language of the request: the language selected in the session or stored in the
+// language cookie, then the best match of the Accept-Language header and finally DEFAULT_LANGUAGE. The language is
+// sent as Content-Language header, the HTML templates are rendered in this language.
+func (s *Server) languageMiddleware(c *gin.Context) {
+	lang := ""
+	// the session is not created here, so that static files and API requests do not start sessions
+	sessionData, _ := sessions.Default(c).Get(SessionIdentifier).(SessionData)
+	if sessionData.Language != "" && s.translations.Has(sessionData.Language) {
+		lang = i18n.NormalizeTag(sessionData.Language)
+	} else if cookie, err := c.Cookie(languageCookieName); err == nil && s.translations.Has(cookie) {
+		lang = i18n.NormalizeTag(cookie)
+	} else {
+		lang = s.translations.Negotiate(c.GetHeader("Accept-Language"))
+	}
+	if lang == "" {
+		lang = s.defaultLanguage()
+	}
+
+	c.Header("Content-Language", lang)
+	c.Next()
+}
+
+// GetLanguage stores the selected language in the session and in the language cookie and redirects back to the
+// previous page. It is available without login, e.g. for the login page.
+func (s *Server) GetLanguage(c *gin.Context) {
+	lang := i18n.NormalizeTag(c.Query("lang"))
+	if !s.translations.Has(lang) {
+		s.GetHandleError(c, http.StatusBadRequest, "Invalid language", "The selected language is not available!")
+		return
+	}
+
+	currentSession := GetSessionData(c)
+	currentSession.Language = lang
+	if err := UpdateSessionData(c, currentSession); err != nil {
+		s.GetHandleError(c, http.StatusInternalServerError, "Language error", "failed to save session")
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(languageCookieName, lang, languageCookieMaxAge, s.urlPath("/"), "", sessionOptions.Secure, true)
+
+	s.redirectBack(c)
+}
+
+// localizedHTMLRender renders the HTML templates in the language of the request. Each language has its own copy of
+// the templates with the matching t function, so that the handlers do not need to pass the language.
+type localizedHTMLRender struct {
+	templates map[string]*template.Template
+	fallback  *template.Template
+}
+
+func (s *Server) newLocalizedHTMLRender(templates *template.Template) (localizedHTMLRender, error) {
+	r := localizedHTMLRender{templates: make(map[string]*template.Template)}
+	for _, language := range s.translations.Languages() {
+		lang := language.Tag
+		clone, err := templates.Clone()
+		if err != nil {
+			return r, errors.Wrapf(err, "failed to copy the templates for %s", lang)
+		}
+		r.templates[lang] = clone.Funcs(template.FuncMap{
+			"t": func(msg string, args ...interface{}) string {
+				return s.translations.Translate(lang, msg, args...)
+			},
+			"language": func() string {
+				return lang
+			},
+		})
+	}
+	r.fallback = r.templates[s.defaultLanguage()]
+	return r, nil
+}
+
+func (r localizedHTMLRender) Instance(name string, data interface{}) render.Render {
+	return localizedHTML{render: r, name: name, data: data}
+}
+
+// localizedHTML picks the templates when it is rendered, the language is taken from the Content-Language header that
+// languageMiddleware has set.
+type localizedHTML struct {
+	render localizedHTMLRender
+	name   string
+	data   interface{}
+}
+
+func (h localizedHTML) Render(w http.ResponseWriter) error {
+	templates, ok := h.render.templates[w.Header().Get("Content-Language")]
+	if !ok {
+		templates = h.render.fallback
+	}
+	return render.HTML{Template: templates, Name: h.name, Data: h.data}.Render(w)
+}
+
+func (h localizedHTML) WriteContentType(w http.ResponseWriter) {
+	render.HTML{}.WriteContentType(w)
+}
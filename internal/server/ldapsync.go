@@ -1,17 +1,18 @@
 package server
 
 import (
-	"strings"
 	"time"
 
+	"github.com/h44z/wg-portal/internal/common"
 	"github.com/h44z/wg-portal/internal/ldap"
 	"github.com/h44z/wg-portal/internal/users"
+	"github.com/h44z/wg-portal/internal/wireguard"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
-
-	gldap "github.com/go-ldap/ldap/v3"
 )
 
+const ldapSyncActor = "ldap-sync"
+
 func (s *Server) SyncLdapWithUserDatabase() {
 	logrus.Info("starting ldap user synchronization...")
 	running := true
@@ -44,30 +45,20 @@ func (s *Server) SyncLdapWithUserDatabase() {
 	logrus.Info("ldap user synchronization stopped")
 }
 
-func (s Server)userIsInAdminGroup(ldapData *ldap.RawLdapData) bool {
-	if s.config.LDAP.AdminLdapGroup_ == nil {
-			return false
-	}
-	for _, group := range ldapData.RawAttributes[s.config.LDAP.GroupMemberAttribute] {
-		var dn,_ = gldap.ParseDN(string(group))
-		if s.config.LDAP.AdminLdapGroup_.Equal(dn) {
-            return true
-		}
+func (s Server) userChangedInLdap(user *users.User, ldapUser ldap.UserAttributes) bool {
+	if user.Firstname != ldapUser.Firstname {
+		return true
 	}
-	return false
-}
-
-func (s Server) userChangedInLdap(user *users.User, ldapData *ldap.RawLdapData) bool {
-	if user.Firstname != ldapData.Attributes[s.config.LDAP.FirstNameAttribute] {
+	if user.Lastname != ldapUser.Lastname {
 		return true
 	}
-	if user.Lastname != ldapData.Attributes[s.config.LDAP.LastNameAttribute] {
+	if user.Email != ldapUser.Email {
 		return true
 	}
-	if user.Email != strings.ToLower(ldapData.Attributes[s.config.LDAP.EmailAttribute]) {
+	if user.Phone != ldapUser.Phone {
 		return true
 	}
-	if user.Phone != ldapData.Attributes[s.config.LDAP.PhoneAttribute] {
+	if user.Username != ldapUser.Username || user.DisplayName != ldapUser.DisplayName {
 		return true
 	}
 	if user.Source != users.UserSourceLdap {
@@ -78,7 +69,7 @@ func (s Server) userChangedInLdap(user *users.User, ldapData *ldap.RawLdapData)
 		return true
 	}
 
-	if user.IsAdmin != s.userIsInAdminGroup(ldapData) {
+	if user.IsAdmin != ldapUser.IsAdmin {
 		return true
 	}
 
@@ -95,7 +86,7 @@ func (s *Server) disableMissingLdapUsers(ldapUsers []ldap.RawLdapData) {
 
 		existsInLDAP := false
 		for j := range ldapUsers {
-			if activeUsers[i].Email == strings.ToLower(ldapUsers[j].Attributes[s.config.LDAP.EmailAttribute]) {
+			if activeUsers[i].Email == ldap.MapUserAttributes(&s.config.LDAP, &ldapUsers[j]).Email {
 				existsInLDAP = true
 				break
 			}
@@ -106,13 +97,7 @@ func (s *Server) disableMissingLdapUsers(ldapUsers []ldap.RawLdapData) {
 		}
 
 		// disable all peers for the given user
-		for _, peer := range s.peers.GetPeersByMail(activeUsers[i].Email) {
-			now := time.Now()
-			peer.DeactivatedAt = &now
-			if err := s.UpdatePeer(peer, now); err != nil {
-				logrus.Errorf("failed to update deactivated peer %s: %v", peer.PublicKey, err)
-			}
-		}
+		s.disableUserPeers(activeUsers[i].Email, ldapSyncActor)
 
 		if err := s.users.DeleteUser(&activeUsers[i]); err != nil {
 			logrus.Errorf("failed to delete deactivated user %s in database: %v", activeUsers[i].Email, err)
@@ -122,36 +107,35 @@ func (s *Server) disableMissingLdapUsers(ldapUsers []ldap.RawLdapData) {
 
 func (s *Server) updateLdapUsers(ldapUsers []ldap.RawLdapData) {
 	for i := range ldapUsers {
-		if ldapUsers[i].Attributes[s.config.LDAP.EmailAttribute] == "" {
+		ldapUser := ldap.MapUserAttributes(&s.config.LDAP, &ldapUsers[i])
+		if ldapUser.Email == "" {
 			logrus.Tracef("skipping sync of %s, empty email attribute", ldapUsers[i].DN)
 			continue
 		}
 
-		user, err := s.users.GetOrCreateUserUnscoped(ldapUsers[i].Attributes[s.config.LDAP.EmailAttribute])
+		newUser := s.users.GetUserUnscoped(ldapUser.Email) == nil
+		user, err := s.users.GetOrCreateUserUnscoped(ldapUser.Email)
 		if err != nil {
-			logrus.Errorf("failed to get/create user %s in database: %v", ldapUsers[i].Attributes[s.config.LDAP.EmailAttribute], err)
+			logrus.Errorf("failed to get/create user %s in database: %v", ldapUser.Email, err)
+			continue
 		}
 
 		// re-enable LDAP user if the user was disabled
 		if user.DeletedAt.Valid {
-			// enable all peers for the given user
-			for _, peer := range s.peers.GetPeersByMail(user.Email) {
-				now := time.Now()
-				peer.DeactivatedAt = nil
-				if err = s.UpdatePeer(peer, now); err != nil {
-					logrus.Errorf("failed to update activated peer %s: %v", peer.PublicKey, err)
-				}
-			}
+			// enable the peers that were disabled with the user
+			s.enableUserPeers(user.Email, ldapSyncActor)
 		}
 
 		// Sync attributes from ldap
-		if s.userChangedInLdap(user, &ldapUsers[i]) {
+		if s.userChangedInLdap(user, ldapUser) {
 			logrus.Debugf("updating ldap user %s", user.Email)
-			user.Firstname = ldapUsers[i].Attributes[s.config.LDAP.FirstNameAttribute]
-			user.Lastname = ldapUsers[i].Attributes[s.config.LDAP.LastNameAttribute]
-			user.Email = ldapUsers[i].Attributes[s.config.LDAP.EmailAttribute]
-			user.Phone = ldapUsers[i].Attributes[s.config.LDAP.PhoneAttribute]
-			user.IsAdmin = s.userIsInAdminGroup(&ldapUsers[i])
+			user.Firstname = ldapUser.Firstname
+			user.Lastname = ldapUser.Lastname
+			user.Email = ldapUser.Email
+			user.Phone = ldapUser.Phone
+			user.Username = ldapUser.Username
+			user.DisplayName = ldapUser.DisplayName
+			user.IsAdmin = ldapUser.IsAdmin
 			user.Source = users.UserSourceLdap
 			user.DeletedAt = gorm.DeletedAt{} // Not deleted
 
@@ -160,5 +144,44 @@ func (s *Server) updateLdapUsers(ldapUsers []ldap.RawLdapData) {
 				continue
 			}
 		}
+
+		if newUser && s.config.LDAP.SyncCreatePeer {
+			s.createLdapUserPeer(user.Email)
+		}
+	}
+}
+
+// createLdapUserPeer creates a peer with the defaults of LDAP_SYNC_PEER_DEVICE for a user that was created by the
+// synchronization. Users that already have peers, e.g. imported peers with their email address, get no further peer.
+// The peer is disabled and enabled again with the user like all other peers of the user.
+func (s *Server) createLdapUserPeer(email string) {
+	device := s.config.LDAP.SyncPeerDevice
+	if device == "" {
+		device = s.wg.Cfg.GetDefaultDeviceName()
+	}
+	if !common.ListContains(s.wg.Cfg.DeviceNames, device) || s.peers.GetDevice(device).Type != wireguard.DeviceTypeServer {
+		logrus.Errorf("failed to create peer for ldap user %s: %s is not a server mode interface", email, device)
+		return
+	}
+	if len(s.peers.GetPeersByMail(email)) != 0 {
+		return
+	}
+
+	if err := s.createDefaultPeer(email, device); err != nil {
+		logrus.Errorf("failed to create peer for ldap user %s: %v", email, err)
+		return
+	}
+	peers := s.peers.GetPeersByMail(email)
+	if len(peers) == 0 {
+		return // the user is not active
+	}
+	logrus.Infof("created peer %s for ldap user %s", peers[0].PublicKey, email)
+	s.audit.Record(common.AuditEntry{Actor: ldapSyncActor, Action: "peer.created", Interface: device,
+		Target: peers[0].PublicKey, Details: "peer of new ldap user " + email})
+
+	if s.config.LDAP.SyncSendPeerMail {
+		if err := s.mailer.QueuePeerConfigMail(peers[0]); err != nil {
+			logrus.Errorf("failed to send configuration of peer %s to %s: %v", peers[0].PublicKey, email, err)
+		}
 	}
 }
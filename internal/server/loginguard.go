@@ -0,0 +1,218 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/authentication"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of login lockouts, failed logins are counted per username and per client ip address
+const (
+	LockoutKindUser = "user"
+	LockoutKindIP   = "ip"
+)
+
+// LoginFailure is a failed password login of the web interface or the REST API.
+type LoginFailure struct {
+	Username string
+	ClientIP string
+	Provider string // the authentication providers that rejected the credentials, e.g. "db, ldap"
+	Channel  string // web or api
+	FailedAt time.Time
+	Locked   bool // the attempt was rejected because of a lockout, the credentials were not checked
+}
+
+// LoginLockout is the failure counter of a username or client ip address.
+type LoginLockout struct {
+	Kind        string // LockoutKindUser or LockoutKindIP
+	Key         string // the username or ip address
+	Failures    int
+	FirstAt     time.Time
+	LockedUntil time.Time // zero if the limit has not been reached
+}
+
+// IsLocked reports whether logins are currently rejected.
+func (l LoginLockout) IsLocked() bool {
+	return time.Now().Before(l.LockedUntil)
+}
+
+// LoginFailureSummary summarizes the failed logins for the admin index.
+type LoginFailureSummary struct {
+	RecentFailures int // failures of the last 24 hours that are still in the history
+	Locked         int // usernames and ip addresses that are currently locked
+}
+
+// loginGuard counts the failed logins per username and per client ip address. Once a counter reaches the limit
+// within the lockout duration, further logins of the username or ip address are rejected for the lockout duration.
+// The recent failures are kept for the administrators, the history is capped. The state is kept in memory, a
+// restart clears all lockouts.
+type loginGuard struct {
+	attempts    int // 0 = lockout disabled, the failures are still recorded
+	duration    time.Duration
+	historySize int
+
+	mux      sync.Mutex
+	counters map[string]*LoginLockout // by kind and key
+	history  []LoginFailure           // oldest first
+}
+
+func newLoginGuard(attempts int, duration time.Duration, historySize int) *loginGuard {
+	return &loginGuard{
+		attempts:    attempts,
+		duration:    duration,
+		historySize: historySize,
+		counters:    make(map[string]*LoginLockout),
+	}
+}
+
+func lockoutKey(kind, key string) string {
+	return kind + ":" + key
+}
+
+// Locked reports whether logins of the username or the ip address are rejected. Rejected attempts are added to the
+// history, they do not extend the lockout.
+func (g *loginGuard) Locked(username, ip, channel string) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.expire(time.Now())
+	locked := false
+	for _, key := range []string{lockoutKey(LockoutKindUser, username), lockoutKey(LockoutKindIP, ip)} {
+		if counter, ok := g.counters[key]; ok && counter.IsLocked() {
+			locked = true
+		}
+	}
+	if locked {
+		g.record(LoginFailure{Username: username, ClientIP: ip, Channel: channel, FailedAt: time.Now(), Locked: true})
+	}
+	return locked
+}
+
+// Failed counts a failed login of the username from the ip address.
+func (g *loginGuard) Failed(failure LoginFailure) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	now := time.Now()
+	failure.FailedAt = now
+	g.expire(now)
+	g.record(failure)
+	for kind, key := range map[string]string{LockoutKindUser: failure.Username, LockoutKindIP: failure.ClientIP} {
+		counter, ok := g.counters[lockoutKey(kind, key)]
+		if !ok {
+			counter = &LoginLockout{Kind: kind, Key: key, FirstAt: now}
+			g.counters[lockoutKey(kind, key)] = counter
+		}
+		counter.Failures++
+		if g.attempts > 0 && counter.Failures >= g.attempts && !counter.IsLocked() {
+			counter.LockedUntil = now.Add(g.duration)
+			logrus.Warnf("logins of %s %s are locked until %s after %d failed attempts", kind, key,
+				counter.LockedUntil.Format(time.RFC3339), counter.Failures)
+		}
+	}
+}
+
+// Succeeded resets the counter of the username. The counter of the ip address is kept, otherwise an attacker with
+// one valid account could reset it.
+func (g *loginGuard) Succeeded(username string) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	delete(g.counters, lockoutKey(LockoutKindUser, username))
+}
+
+// Clear removes the counter of the username or ip address and reports whether it existed.
+func (g *loginGuard) Clear(kind, key string) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	_, ok := g.counters[lockoutKey(kind, key)]
+	delete(g.counters, lockoutKey(kind, key))
+	return ok
+}
+
+// Lockouts returns the current counters, locked counters first.
+func (g *loginGuard) Lockouts() []LoginLockout {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	g.expire(time.Now())
+	lockouts := make([]LoginLockout, 0, len(g.counters))
+	for _, counter := range g.counters {
+		lockouts = append(lockouts, *counter)
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].IsLocked() != lockouts[j].IsLocked() {
+			return lockouts[i].IsLocked()
+		}
+		if lockouts[i].Failures != lockouts[j].Failures {
+			return lockouts[i].Failures > lockouts[j].Failures
+		}
+		return lockouts[i].Kind+lockouts[i].Key < lockouts[j].Kind+lockouts[j].Key
+	})
+	return lockouts
+}
+
+// Failures returns the recorded failures, newest first.
+func (g *loginGuard) Failures() []LoginFailure {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	failures := make([]LoginFailure, len(g.history))
+	for i, failure := range g.history {
+		failures[len(g.history)-1-i] = failure
+	}
+	return failures
+}
+
+// Summary counts the failures since the given time and the current lockouts.
+func (g *loginGuard) Summary(since time.Time) LoginFailureSummary {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	summary := LoginFailureSummary{}
+	for _, failure := range g.history {
+		if failure.FailedAt.After(since) {
+			summary.RecentFailures++
+		}
+	}
+	for _, counter := range g.counters {
+		if counter.IsLocked() {
+			summary.Locked++
+		}
+	}
+	return summary
+}
+
+func (g *loginGuard) record(failure LoginFailure) {
+	if g.historySize <= 0 {
+		return
+	}
+	g.history = append(g.history, failure)
+	if len(g.history) > g.historySize {
+		g.history = append(g.history[:0], g.history[len(g.history)-g.historySize:]...)
+	}
+}
+
+// expire removes the counters whose failures are older than the lockout duration and whose lockout has ended.
+func (g *loginGuard) expire(now time.Time) {
+	for key, counter := range g.counters {
+		if now.After(counter.FirstAt.Add(g.duration)) && !now.Before(counter.LockedUntil) {
+			delete(g.counters, key)
+		}
+	}
+}
+
+// passwordProviderNames returns the names of the password authentication providers, they are recorded with the
+// failed logins.
+func (s *Server) passwordProviderNames() string {
+	names := make([]string, 0)
+	for _, provider := range s.auth.GetProvidersForType(authentication.AuthProviderTypePassword) {
+		names = append(names, provider.GetName())
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	mailQueueSize   = 500
+	mailMaxAttempts = 5
+	mailRetryDelay  = 30 * time.Second // multiplied with the number of failed attempts
+	mailMaxFailures = 25               // number of failed deliveries that are remembered for the admin page
+)
+
+type mailJob struct {
+	PublicKey string
+	Attempts  int
+}
+
+// MailFailure describes a peer configuration mail that could not be delivered.
+type MailFailure struct {
+	PublicKey  string
+	Identifier string
+	Email      string
+	Error      string
+	FailedAt   time.Time
+}
+
+// Mailer sends peer configuration mails in the background, so that the HTTP request does not have to wait for the
+// SMTP server. Failed deliveries are retried with an increasing delay.
+type Mailer struct {
+	s     *Server
+	queue chan mailJob
+
+	mux      sync.RWMutex
+	failures []MailFailure
+}
+
+func NewMailer(s *Server) *Mailer {
+	return &Mailer{
+		s:        s,
+		queue:    make(chan mailJob, mailQueueSize),
+		failures: make([]MailFailure, 0),
+	}
+}
+
+// QueuePeerConfigMail queues the configuration mail for the given peer.
+func (m *Mailer) QueuePeerConfigMail(peer wireguard.Peer) error {
+	if !peer.HasEmail() {
+		return errors.Errorf("peer %s has no email address", peer.Identifier)
+	}
+
+	return m.enqueue(mailJob{PublicKey: peer.PublicKey})
+}
+
+func (m *Mailer) enqueue(job mailJob) error {
+	select {
+	case m.queue <- job:
+		return nil
+	default:
+		return errors.New("mail queue is full")
+	}
+}
+
+// Run processes queued mails until the given context is cancelled.
+func (m *Mailer) Run(ctx context.Context) {
+	logrus.Debug("starting mail queue worker")
+
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debug("mail queue worker stopped")
+			return
+		case job := <-m.queue:
+			m.process(ctx, job)
+		}
+	}
+}
+
+func (m *Mailer) process(ctx context.Context, job mailJob) {
+	peer := m.s.peers.GetPeerByKey(job.PublicKey)
+	if !peer.IsValid() {
+		return // peer has been deleted in the meantime
+	}
+
+	err := m.s.sendPeerConfigMail(peer)
+	if err == nil {
+		logrus.Debugf("sent configuration mail for peer %s to %s", peer.Identifier, peer.Email)
+		return
+	}
+
+	job.Attempts++
+	if job.Attempts >= mailMaxAttempts {
+		logrus.Errorf("failed to send configuration mail for peer %s after %d attempts: %v", peer.Identifier, job.Attempts, err)
+		m.addFailure(MailFailure{
+			PublicKey:  peer.PublicKey,
+			Identifier: peer.Identifier,
+			Email:      peer.Email,
+			Error:      err.Error(),
+			FailedAt:   time.Now(),
+		})
+		return
+	}
+
+	delay := time.Duration(job.Attempts) * mailRetryDelay
+	logrus.Warnf("failed to send configuration mail for peer %s, retrying in %s: %v", peer.Identifier, delay, err)
+	time.AfterFunc(delay, func() {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := m.enqueue(job); err != nil {
+			logrus.Errorf("failed to requeue configuration mail for peer %s: %v", peer.Identifier, err)
+		}
+	})
+}
+
+func (m *Mailer) addFailure(failure MailFailure) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.failures = append(m.failures, failure)
+	if len(m.failures) > mailMaxFailures {
+		m.failures = m.failures[len(m.failures)-mailMaxFailures:]
+	}
+}
+
+// GetFailures returns the most recent failed deliveries.
+func (m *Mailer) GetFailures() []MailFailure {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	failures := make([]MailFailure, len(m.failures))
+	copy(failures, m.failures)
+	return failures
+}
+
+func (m *Mailer) ClearFailures() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.failures = make([]MailFailure, 0)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/swaggo/swag"
+)
+
+// schemaKeys are the fields of Swagger 2.0 parameters that describe the value, they form the schema of OpenAPI 3.
+var schemaKeys = []string{"type", "format", "items", "enum", "default", "minimum", "maximum"}
+
+// GetOpenApiDocument serves the API documentation as OpenAPI 3 document. It is converted from the Swagger 2.0
+// document that swag generates from the annotations of the handlers, see docs/docs.go.
+func (s *ApiServer) GetOpenApiDocument(c *gin.Context) {
+	doc, err := s.s.openApiDocument()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiError{Message: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, doc)
+}
+
+func (s *Server) openApiDocument() (map[string]interface{}, error) {
+	raw, err := swag.ReadDoc()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read swagger document")
+	}
+	// references to definitions are moved to the components of the document
+	raw = strings.ReplaceAll(raw, `"#/definitions/`, `"#/components/schemas/`)
+
+	var swagger map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &swagger); err != nil {
+		return nil, errors.Wrap(err, "failed to parse swagger document")
+	}
+
+	securitySchemes := map[string]interface{}{}
+	for name, definition := range jsonObject(swagger["securityDefinitions"]) {
+		securitySchemes[name] = openApiSecurityScheme(jsonObject(definition))
+	}
+
+	paths := map[string]interface{}{}
+	for path, item := range jsonObject(swagger["paths"]) {
+		operations := map[string]interface{}{}
+		for method, operation := range jsonObject(item) {
+			operations[method] = openApiOperation(jsonObject(operation))
+		}
+		paths[path] = operations
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    swagger["info"],
+		"servers": []interface{}{map[string]interface{}{"url": s.urlPath("/api/v1")}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas":         swagger["definitions"],
+			"securitySchemes": securitySchemes,
+		},
+	}, nil
+}
+
+func openApiSecurityScheme(definition map[string]interface{}) map[string]interface{} {
+	scheme := map[string]interface{}{}
+	switch {
+	case definition["type"] == "basic":
+		scheme["type"], scheme["scheme"] = "http", "basic"
+	case definition["type"] == "apiKey" && definition["in"] == "header" && definition["name"] == "Authorization":
+		scheme["type"], scheme["scheme"] = "http", "bearer" // API tokens are sent as bearer tokens
+	default:
+		scheme["type"], scheme["in"], scheme["name"] = definition["type"], definition["in"], definition["name"]
+	}
+	if description, ok := definition["description"]; ok {
+		scheme["description"] = description
+	}
+	return scheme
+}
+
+// openApiOperation converts a Swagger 2.0 operation. Body parameters become the request body, the produced content
+// types the content of the responses.
+func openApiOperation(operation map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, key := range []string{"tags", "summary", "description", "operationId", "security"} {
+		if value, ok := operation[key]; ok {
+			result[key] = value
+		}
+	}
+	consumes := jsonStrings(operation["consumes"], "application/json")
+	produces := jsonStrings(operation["produces"], "application/json")
+
+	parameters := make([]interface{}, 0)
+	for _, p := range jsonArray(operation["parameters"]) {
+		parameter := jsonObject(p)
+		if parameter["in"] == "body" {
+			content := map[string]interface{}{}
+			for _, contentType := range consumes {
+				content[contentType] = map[string]interface{}{"schema": parameter["schema"]}
+			}
+			result["requestBody"] = map[string]interface{}{
+				"description": parameter["description"],
+				"required":    parameter["required"] == true,
+				"content":     content,
+			}
+			continue
+		}
+
+		schema := map[string]interface{}{}
+		for _, key := range schemaKeys {
+			if value, ok := parameter[key]; ok {
+				schema[key] = value
+			}
+		}
+		converted := map[string]interface{}{
+			"name":     parameter["name"],
+			"in":       parameter["in"],
+			"required": parameter["required"] == true,
+			"schema":   schema,
+		}
+		if description, ok := parameter["description"]; ok {
+			converted["description"] = description
+		}
+		if parameter["collectionFormat"] == "multi" {
+			converted["style"], converted["explode"] = "form", true
+		}
+		parameters = append(parameters, converted)
+	}
+	if len(parameters) > 0 {
+		result["parameters"] = parameters
+	}
+
+	responses := map[string]interface{}{}
+	for code, r := range jsonObject(operation["responses"]) {
+		response := jsonObject(r)
+		converted := map[string]interface{}{"description": response["description"]}
+		if converted["description"] == nil {
+			converted["description"] = ""
+		}
+		if schema, ok := response["schema"]; ok {
+			content := map[string]interface{}{}
+			for _, contentType := range produces {
+				content[contentType] = map[string]interface{}{"schema": schema}
+			}
+			converted["content"] = content
+		}
+		if headers := jsonObject(response["headers"]); len(headers) > 0 {
+			convertedHeaders := map[string]interface{}{}
+			for name, h := range headers {
+				header := jsonObject(h)
+				convertedHeaders[name] = map[string]interface{}{
+					"description": header["description"],
+					"schema":      map[string]interface{}{"type": header["type"]},
+				}
+			}
+			converted["headers"] = convertedHeaders
+		}
+		responses[code] = converted
+	}
+	result["responses"] = responses
+
+	return result
+}
+
+func jsonObject(value interface{}) map[string]interface{} {
+	object, _ := value.(map[string]interface{})
+	return object
+}
+
+func jsonArray(value interface{}) []interface{} {
+	array, _ := value.([]interface{})
+	return array
+}
+
+// jsonStrings returns the content types of a Swagger 2.0 operation, or the fallback if there are none.
+func jsonStrings(value interface{}, fallback string) []string {
+	result := make([]string, 0)
+	for _, v := range jsonArray(value) {
+		if str, ok := v.(string); ok {
+			result = append(result, str)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, fallback)
+	}
+	return result
+}
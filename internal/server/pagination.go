@@ -0,0 +1,220 @@
+package server
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+)
+
+const MaxPageSize = 500
+
+// Pagination holds the data needed to render the pagination controls of a list page.
+type Pagination struct {
+	Page      int
+	PageSize  int
+	Total     int64
+	BaseQuery string // encoded query parameters that must be kept when switching pages, without page and size
+}
+
+// getPagination reads the page and size query parameters. The page size falls back to the configured default and is
+// capped at MaxPageSize.
+func (s *Server) getPagination(c *gin.Context, baseQuery url.Values) Pagination {
+	p := Pagination{Page: 1, PageSize: s.config.Core.PageSize}
+
+	if page, err := strconv.Atoi(c.Query("page")); err == nil && page > 0 {
+		p.Page = page
+	}
+	if size, err := strconv.Atoi(c.Query("size")); err == nil && size > 0 {
+		p.PageSize = size
+	}
+	if p.PageSize <= 0 {
+		p.PageSize = 50
+	}
+	if p.PageSize > MaxPageSize {
+		p.PageSize = MaxPageSize
+	}
+
+	if baseQuery != nil {
+		p.BaseQuery = baseQuery.Encode()
+	}
+
+	return p
+}
+
+// getApiPagination reads the Page and PageSize query parameters of API listings. Without page size, all entries are
+// returned as before pagination was supported.
+func getApiPagination(c *gin.Context) (page, pageSize int, err error) {
+	page, pageSize = 1, 0
+	if value := c.Query("Page"); value != "" {
+		if page, err = strconv.Atoi(value); err != nil || page < 1 {
+			return 0, 0, errors.New("Page must be a positive number")
+		}
+	}
+	if value := c.Query("PageSize"); value != "" {
+		if pageSize, err = strconv.Atoi(value); err != nil || pageSize < 1 || pageSize > MaxPageSize {
+			return 0, 0, errors.Errorf("PageSize must be between 1 and %d", MaxPageSize)
+		}
+	}
+	return page, pageSize, nil
+}
+
+func (p Pagination) Pages() int {
+	pages := int((p.Total + int64(p.PageSize) - 1) / int64(p.PageSize))
+	if pages == 0 {
+		return 1
+	}
+	return pages
+}
+
+func (p Pagination) HasPrevious() bool {
+	return p.Page > 1
+}
+
+func (p Pagination) HasNext() bool {
+	return p.Page < p.Pages()
+}
+
+// PageLink returns the query string for the given page.
+func (p Pagination) PageLink(page int) string {
+	query := "?"
+	if p.BaseQuery != "" {
+		query += p.BaseQuery + "&"
+	}
+	return query + "page=" + strconv.Itoa(page) + "&size=" + strconv.Itoa(p.PageSize)
+}
+
+// PeerListQuery holds the filter and sort state of a peer listing. The state is passed as query parameters, so that
+// the listing can be bookmarked.
+type PeerListQuery struct {
+	Search        string
+	Filter        string
+	Tags          []string
+	SortKey       string
+	SortDirection string
+}
+
+// getPeerListQuery reads the peer list state from the query parameters. If no sort order is given, the last sort
+// order of the session is used.
+func getPeerListQuery(c *gin.Context, currentSession SessionData) PeerListQuery {
+	q := PeerListQuery{
+		Search:        c.Query("search"),
+		Filter:        c.Query("filter"),
+		Tags:          getTagsQuery(c, "tag"),
+		SortKey:       currentSession.SortedBy["peers"],
+		SortDirection: currentSession.SortDirection["peers"],
+	}
+
+	if sortKey := c.Query("sort"); sortKey != "" {
+		direction := c.Query("dir")
+		if direction != "asc" && direction != "desc" { // toggle the direction if none was given
+			direction = "asc"
+			if sortKey == q.SortKey && q.SortDirection == "asc" {
+				direction = "desc"
+			}
+		}
+		q.SortKey = sortKey
+		q.SortDirection = direction
+	}
+
+	return q
+}
+
+func (q PeerListQuery) ListOptions(p Pagination) wireguard.PeerListOptions {
+	return wireguard.PeerListOptions{
+		Search:        q.Search,
+		Filter:        wireguard.PeerFilter(q.Filter),
+		Tags:          q.Tags,
+		SortKey:       q.SortKey,
+		SortDirection: q.SortDirection,
+		Page:          p.Page,
+		PageSize:      p.PageSize,
+	}
+}
+
+func (q PeerListQuery) Values() url.Values {
+	values := url.Values{}
+	if q.Search != "" {
+		values.Set("search", q.Search)
+	}
+	if q.Filter != "" {
+		values.Set("filter", q.Filter)
+	}
+	for _, tag := range q.Tags {
+		values.Add("tag", tag)
+	}
+	if q.SortKey != "" {
+		values.Set("sort", q.SortKey)
+		values.Set("dir", q.SortDirection)
+	}
+	return values
+}
+
+// SortLink returns the query string that sorts the listing by the given key, the direction is toggled if the listing
+// is already sorted by this key.
+func (q PeerListQuery) SortLink(key string) string {
+	direction := "asc"
+	if q.SortKey == key && q.SortDirection == "asc" {
+		direction = "desc"
+	}
+	q.SortKey = key
+	q.SortDirection = direction
+	return "?" + q.Values().Encode()
+}
+
+func (q PeerListQuery) SortIcon(key string) string {
+	if q.SortKey != key {
+		return "fa-sort"
+	}
+	if q.SortDirection == "asc" {
+		return "fa-sort-alpha-down"
+	}
+	return "fa-sort-alpha-up"
+}
+
+func (q PeerListQuery) FilterLink(filter string) string {
+	q.Filter = filter
+	return "?" + q.Values().Encode()
+}
+
+func (q PeerListQuery) HasTag(tag string) bool {
+	return common.ListContains(q.Tags, tag)
+}
+
+// TagLink returns the query string that adds the given tag to the tag filter, or removes it if it is already part of
+// the filter.
+func (q PeerListQuery) TagLink(tag string) string {
+	tags := make([]string, 0, len(q.Tags)+1)
+	for _, t := range q.Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	if !q.HasTag(tag) {
+		tags = append(tags, tag)
+	}
+	q.Tags = tags
+	return "?" + q.Values().Encode()
+}
+
+// ClearTagsLink returns the query string without tag filter.
+func (q PeerListQuery) ClearTagsLink() string {
+	q.Tags = nil
+	return "?" + q.Values().Encode()
+}
+
+// getTagsQuery reads a tag filter that is given as repeated and/or comma separated query parameter.
+func getTagsQuery(c *gin.Context, key string) []string {
+	var tags []string
+	for _, value := range c.QueryArray(key) {
+		for _, tag := range common.ParseStringList(value) {
+			if tag = wireguard.NormalizeTag(tag); tag != "" && !common.ListContains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
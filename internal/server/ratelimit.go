@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipRateLimiter allows a fixed number of requests per source ip address in a time window.
+type ipRateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mux     sync.Mutex
+	clients map[string]*rateWindow
+}
+
+type rateWindow struct {
+	count   int
+	resetAt time.Time
+}
+
+func newIPRateLimiter(limit int, window time.Duration) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:   limit,
+		window:  window,
+		clients: make(map[string]*rateWindow),
+	}
+}
+
+// Allow counts a request of the given ip address and reports whether it is within the limit.
+func (l *ipRateLimiter) Allow(ip string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := time.Now()
+	for client, w := range l.clients {
+		if now.After(w.resetAt) {
+			delete(l.clients, client)
+		}
+	}
+
+	w, ok := l.clients[ip]
+	if !ok {
+		w = &rateWindow{resetAt: now.Add(l.window)}
+		l.clients[ip] = w
+	}
+	w.count++
+
+	return w.count <= l.limit
+}
+
+// Middleware aborts requests of clients that exceeded the limit with 429 Too Many Requests.
+func (l *ipRateLimiter) Middleware(s *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.Allow(s.clientIP(c)) {
+			c.Abort()
+			s.GetHandleError(c, http.StatusTooManyRequests, "Too many requests",
+				"Too many requests from your address, please try again later.")
+			return
+		}
+
+		c.Next()
+	}
+}
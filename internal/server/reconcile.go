@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Heuristics that select the owner of adopted peers.
+const (
+	AdoptOwnerNone       = "none"       // use the placeholder address of autodetected peers
+	AdoptOwnerConfigFile = "configfile" // use the owner recorded in the last written interface config file
+	AdoptOwnerUser       = "user"       // use the selected user
+)
+
+// PeerOwner is the owner of a peer as recorded in the interface config file.
+type PeerOwner struct {
+	Identifier string
+	Email      string
+}
+
+// OrphanedPeer is a peer of the physical WireGuard interface that is not stored in the database.
+type OrphanedPeer struct {
+	PublicKey     string
+	AllowedIPs    []string
+	Endpoint      string     `json:",omitempty"`
+	LastHandshake *time.Time `json:",omitempty"` // nil if the peer never connected
+	ConfigOwner   *PeerOwner `json:",omitempty"` // owner found in the interface config file, if any
+}
+
+// SettingDrift is a setting of the physical interface that differs from the database.
+type SettingDrift struct {
+	Setting string
+	Stored  string
+	Running string
+}
+
+// DriftReport lists the differences between the physical WireGuard interface and the database.
+type DriftReport struct {
+	Device        string
+	Settings      []SettingDrift // interface settings that were changed outside the portal
+	OrphanedPeers []OrphanedPeer // peers that only exist on the physical interface
+	MissingPeers  []string       // public keys of active peers that are missing on the physical interface
+}
+
+// HasDrift is true if the settings or the peers of the physical interface differ from the database.
+func (r DriftReport) HasDrift() bool {
+	return len(r.Settings) > 0 || len(r.OrphanedPeers) > 0 || len(r.MissingPeers) > 0
+}
+
+// GetDriftReport compares the settings and peers of the physical WireGuard interface with the database. Nothing is
+// changed. External interfaces cannot be read, their report is always empty.
+func (s *Server) GetDriftReport(device string) (DriftReport, error) {
+	report := DriftReport{Device: device, Settings: make([]SettingDrift, 0), OrphanedPeers: make([]OrphanedPeer, 0),
+		MissingPeers: make([]string, 0)}
+	if s.wg.IsExternalDevice(device) {
+		return report, nil
+	}
+
+	settings, err := s.getSettingDrift(s.peers.GetDevice(device))
+	if err != nil {
+		return report, err
+	}
+	report.Settings = settings
+
+	wgOrphans, err := s.peers.GetOrphanedPeers(device)
+	if err != nil {
+		return report, errors.WithMessage(err, "failed to load orphaned peers")
+	}
+	owners := s.readConfigFileOwners(device)
+	for _, wgPeer := range wgOrphans {
+		orphan := OrphanedPeer{
+			PublicKey:  wgPeer.PublicKey.String(),
+			AllowedIPs: make([]string, len(wgPeer.AllowedIPs)),
+		}
+		for i := range wgPeer.AllowedIPs {
+			orphan.AllowedIPs[i] = wgPeer.AllowedIPs[i].String()
+		}
+		if wgPeer.Endpoint != nil {
+			orphan.Endpoint = wgPeer.Endpoint.String()
+		}
+		if !wgPeer.LastHandshakeTime.IsZero() {
+			handshake := wgPeer.LastHandshakeTime
+			orphan.LastHandshake = &handshake
+		}
+		if owner, ok := owners[orphan.PublicKey]; ok {
+			orphan.ConfigOwner = &owner
+		}
+		report.OrphanedPeers = append(report.OrphanedPeers, orphan)
+	}
+
+	for _, peer := range s.peers.GetActivePeers(device) {
+		if peer.Peer == nil {
+			report.MissingPeers = append(report.MissingPeers, peer.PublicKey)
+		}
+	}
+
+	return report, nil
+}
+
+// getSettingDrift compares the listen port, and if MANAGE_IP_ADDRESSES is enabled the MTU and addresses, of the
+// physical interface with the stored interface. Without MANAGE_IP_ADDRESSES, the portal does not apply the MTU and
+// addresses, so they cannot drift.
+func (s *Server) getSettingDrift(dev wireguard.Device) ([]SettingDrift, error) {
+	drift := make([]SettingDrift, 0)
+	wgDevice, err := s.wg.GetDeviceInfo(dev.DeviceName)
+	if err != nil {
+		return drift, errors.WithMessage(err, "failed to read WireGuard interface")
+	}
+	if dev.ListenPort != 0 && wgDevice.ListenPort != dev.ListenPort { // a random port is chosen for port 0
+		drift = append(drift, SettingDrift{Setting: "Listen Port", Stored: strconv.Itoa(dev.ListenPort),
+			Running: strconv.Itoa(wgDevice.ListenPort)})
+	}
+	if !s.config.WG.ManageIPAddresses {
+		return drift, nil
+	}
+
+	mtu, err := s.wg.GetMTU(dev.DeviceName)
+	if err != nil {
+		return drift, errors.WithMessage(err, "failed to read MTU")
+	}
+	storedMtu := dev.Mtu
+	if storedMtu == 0 {
+		storedMtu = wireguard.DefaultMTU
+	}
+	if mtu != storedMtu {
+		drift = append(drift, SettingDrift{Setting: "MTU", Stored: strconv.Itoa(storedMtu),
+			Running: strconv.Itoa(mtu)})
+	}
+
+	ips, err := s.wg.GetIPAddress(dev.DeviceName)
+	if err != nil {
+		return drift, errors.WithMessage(err, "failed to read ip addresses")
+	}
+	stored := append([]string{}, dev.GetIPAddresses()...)
+	running := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		if !common.IsLinkLocal(ip) || common.ListContains(stored, ip) {
+			running = append(running, ip)
+		}
+	}
+	sort.Strings(stored)
+	sort.Strings(running)
+	if common.ListToString(stored) != common.ListToString(running) {
+		drift = append(drift, SettingDrift{Setting: "Addresses", Stored: common.ListToString(stored),
+			Running: common.ListToString(running)})
+	}
+
+	return drift, nil
+}
+
+// ReapplyInterface pushes the stored settings and peers of the interface to the physical interface again, reverting
+// all changes that were made outside the portal.
+func (s *Server) ReapplyInterface(device, actor string) error {
+	dev := s.peers.GetDevice(device)
+	if err := s.ApplyDeviceChanges(dev, dev); err != nil {
+		return err
+	}
+	if err := s.RestoreWireGuardInterface(device); err != nil {
+		return err
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "interface.reapplied", Interface: device})
+
+	return nil
+}
+
+// AdoptOrphanedPeer creates a database entry for a peer that only exists on the physical interface. The owner is taken
+// from the given heuristic, email is only used for AdoptOwnerUser.
+func (s *Server) AdoptOrphanedPeer(device, publicKey, heuristic, email, actor string) (wireguard.Peer, error) {
+	wgPeer, err := s.getOrphanedPeer(device, publicKey)
+	if err != nil {
+		return wireguard.Peer{}, err
+	}
+
+	var identifier string
+	switch heuristic {
+	case AdoptOwnerNone:
+		email = ""
+	case AdoptOwnerConfigFile:
+		owner, ok := s.readConfigFileOwners(device)[publicKey]
+		if !ok {
+			return wireguard.Peer{}, errors.Errorf("no owner of peer %s found in the config file", publicKey)
+		}
+		identifier, email = owner.Identifier, owner.Email
+	case AdoptOwnerUser:
+		if s.users.GetUser(email) == nil {
+			return wireguard.Peer{}, errors.Errorf("user %s does not exist", email)
+		}
+	default:
+		return wireguard.Peer{}, errors.Errorf("unknown owner heuristic %s", heuristic)
+	}
+
+	// fall back to the autodetected name if the user already has a peer with this name
+	if identifier == "" || s.peers.IdentifierExistsForMail(device, email, identifier, publicKey) {
+		identifier = ""
+	}
+
+	peer, err := s.peers.AdoptPeer(device, wgPeer, identifier, email, actor)
+	if err != nil {
+		return wireguard.Peer{}, err
+	}
+
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerCreated, Interface: device,
+		PeerKey: peer.PublicKey, Actor: actor})
+	s.syncDeviceRoutes(device)
+
+	return peer, s.WriteWireGuardConfigFile(device)
+}
+
+// RemoveOrphanedPeer removes a peer that is not stored in the database from the physical interface.
+func (s *Server) RemoveOrphanedPeer(device, publicKey string) error {
+	if _, err := s.getOrphanedPeer(device, publicKey); err != nil {
+		return err
+	}
+	if err := s.wg.RemovePeer(device, publicKey); err != nil {
+		return errors.WithMessage(err, "failed to remove WireGuard peer")
+	}
+	return nil
+}
+
+func (s *Server) getOrphanedPeer(device, publicKey string) (wgtypes.Peer, error) {
+	orphans, err := s.peers.GetOrphanedPeers(device)
+	if err != nil {
+		return wgtypes.Peer{}, errors.WithMessage(err, "failed to load orphaned peers")
+	}
+	for _, orphan := range orphans {
+		if orphan.PublicKey.String() == publicKey {
+			return orphan, nil
+		}
+	}
+	return wgtypes.Peer{}, errors.Errorf("peer %s is not an orphaned peer of %s", publicKey, device)
+}
+
+// readConfigFileOwners parses the peer comments of the last written interface config file and returns the owners by
+// public key. Missing or unreadable files result in an empty map.
+func (s *Server) readConfigFileOwners(device string) map[string]PeerOwner {
+	owners := make(map[string]PeerOwner)
+	if s.config.WG.ConfigDirectoryPath == "" {
+		return owners
+	}
+
+	file, err := os.Open(path.Join(s.config.WG.ConfigDirectoryPath, device+".conf"))
+	if err != nil {
+		return owners
+	}
+	defer file.Close()
+
+	var current PeerOwner
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "# -WGP- Peer email:"):
+			current.Email = strings.TrimSpace(strings.TrimPrefix(line, "# -WGP- Peer email:"))
+		case strings.HasPrefix(line, "# -WGP- Peer:"):
+			identifier := strings.TrimPrefix(line, "# -WGP- Peer:")
+			if idx := strings.Index(identifier, " / Updated:"); idx >= 0 {
+				identifier = identifier[:idx]
+			}
+			current = PeerOwner{Identifier: strings.TrimSpace(identifier)}
+		case strings.HasPrefix(line, "PublicKey") && strings.Contains(line, "="):
+			publicKey := strings.TrimSpace(line[strings.Index(line, "=")+1:])
+			if current.Email != "" && current.Email != wireguard.AutodetectedPeerEmail {
+				owners[publicKey] = current
+			}
+			current = PeerOwner{}
+		}
+	}
+
+	return owners
+}
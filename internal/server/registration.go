@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/users"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	registrationRateLimit  = 5 // registration requests per source ip address and window
+	registrationRateWindow = time.Hour
+)
+
+var errUserNotActive = errors.New("user has not been approved")
+
+// RegistrationForm is the public form of users that request access to the portal.
+type RegistrationForm struct {
+	Email           string `form:"email" binding:"required,email"`
+	Firstname       string `form:"firstname" binding:"required,max=64"`
+	Lastname        string `form:"lastname" binding:"required,max=64"`
+	Phone           string `form:"phone" binding:"omitempty,max=32"`
+	Password        string `form:"password" binding:"required"` // validated against the password policy
+	PasswordConfirm string `form:"password_confirm" binding:"required,eqfield=Password"`
+}
+
+// RegisterUser creates a pending database user. The user cannot log in before an administrator approved the request.
+func (s *Server) RegisterUser(form RegistrationForm) error {
+	email := strings.ToLower(strings.TrimSpace(form.Email))
+	if s.users.GetUserUnscoped(email) != nil {
+		return errors.New("this email address is already registered")
+	}
+	if err := s.config.Password.Validate(form.Password); err != nil {
+		return err
+	}
+
+	user := users.User{
+		Email:     email,
+		Source:    users.UserSourceDatabase,
+		Firstname: strings.TrimSpace(form.Firstname),
+		Lastname:  strings.TrimSpace(form.Lastname),
+		Phone:     strings.TrimSpace(form.Phone),
+		Password:  users.PrivateString(form.Password),
+		State:     users.UserStatePending,
+	}
+	if err := s.CreateUser(user, s.wg.Cfg.GetDefaultDeviceName(), email); err != nil {
+		return errors.WithMessage(err, "failed to create user")
+	}
+	s.audit.Record(common.AuditEntry{Actor: email, Action: "user.registered", Target: email,
+		Details: fmt.Sprintf("%s %s requested access", user.Firstname, user.Lastname)})
+
+	return nil
+}
+
+// ApproveRegistration activates a pending user. If REGISTRATION_DEFAULT_PEER is set, a default peer is created.
+func (s *Server) ApproveRegistration(email, actor string) error {
+	user := s.users.GetUser(email)
+	if user == nil || user.State != users.UserStatePending {
+		return errors.Errorf("no pending registration for %s", email)
+	}
+
+	user.State = users.UserStateActive
+	user.StateReason = ""
+	if err := s.users.UpdateUser(user); err != nil {
+		return errors.WithMessage(err, "failed to activate user")
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "user.approved", Target: user.Email,
+		Details: "registration approved"})
+
+	if s.config.Core.RegistrationDefaultPeer {
+		if err := s.createDefaultPeer(user.Email, s.wg.Cfg.GetDefaultDeviceName()); err != nil {
+			logrus.Errorf("failed to create default peer for approved user %s: %v", user.Email, err)
+		}
+	}
+
+	s.notifyRegistrant(*user, "WireGuard VPN access approved", fmt.Sprintf("Your request for WireGuard VPN access has "+
+		"been approved. You can now log in at %s.", s.config.Core.ExternalUrl))
+
+	return nil
+}
+
+// RejectRegistration rejects a pending user. The user is kept with the rejected state, so that the request stays on
+// record and the email address cannot register again until an administrator deletes the user.
+func (s *Server) RejectRegistration(email, reason, actor string) error {
+	user := s.users.GetUser(email)
+	if user == nil || user.State != users.UserStatePending {
+		return errors.Errorf("no pending registration for %s", email)
+	}
+
+	user.State = users.UserStateRejected
+	user.StateReason = strings.TrimSpace(reason)
+	if err := s.users.UpdateUser(user); err != nil {
+		return errors.WithMessage(err, "failed to reject user")
+	}
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "user.rejected", Target: user.Email,
+		Details: "registration rejected: " + user.StateReason})
+
+	body := "Your request for WireGuard VPN access has been rejected."
+	if user.StateReason != "" {
+		body += "\nReason: " + user.StateReason
+	}
+	s.notifyRegistrant(*user, "WireGuard VPN access rejected", body)
+
+	return nil
+}
+
+// notifyRegistrant informs the user about the decision on the registration, if a mail server is configured.
+func (s *Server) notifyRegistrant(user users.User, subject, body string) {
+	if s.config.Email.Host == "" {
+		return
+	}
+
+	htmlBody := "<p>" + strings.ReplaceAll(html.EscapeString(body), "\n", "<br>") + "</p>"
+	if err := common.SendEmailWithAttachments(s.config.Email, s.config.Core.MailFrom, "", subject, body, htmlBody,
+		[]string{user.Email}, nil); err != nil {
+		logrus.Errorf("failed to notify %s about the registration: %v", user.Email, err)
+	}
+}
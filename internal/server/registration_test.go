@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/h44z/wg-portal/internal/users"
+)
+
+// postRegistrationWithForwardedFor submits a registration with the X-Forwarded-For header and returns the status code.
+func postRegistrationWithForwardedFor(t *testing.T, baseUrl, email, forwarded string) int {
+	t.Helper()
+
+	client := newTestClient(t)
+	_, body := getPage(t, client, baseUrl+"/auth/register")
+	token := csrfInputPattern.FindStringSubmatch(body)
+	if token == nil {
+		t.Fatal("the registration form has no CSRF token")
+	}
+	form := url.Values{csrfFormField: {token[1]}, "email": {email}, "firstname": {"Flood"}, "lastname": {"Test"},
+		"password": {"Secret-Passw0rd!"}, "password_confirm": {"Secret-Passw0rd!"}}
+	req, _ := http.NewRequest(http.MethodPost, baseUrl+"/auth/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Forwarded-For", forwarded)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRegistrationRateLimitIgnoresForgedForwardedFor(t *testing.T) {
+	s := newTestServer(t, map[string]string{"SELF_REGISTRATION": "true"})
+	baseUrl := startTestServer(t, s).URL
+
+	for i := 0; i < registrationRateLimit; i++ {
+		code := postRegistrationWithForwardedFor(t, baseUrl, fmt.Sprintf("user%d@example.org", i),
+			fmt.Sprintf("198.51.100.%d", i+1))
+		if code != http.StatusSeeOther {
+			t.Fatalf("registration %d: got %d, want %d", i+1, code, http.StatusSeeOther)
+		}
+	}
+	code := postRegistrationWithForwardedFor(t, baseUrl, "flood@example.org", "198.51.100.99")
+	if code != http.StatusTooManyRequests {
+		t.Errorf("a new forged address reset the limit: got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if pending := s.users.GetUsersByState(users.UserStatePending); len(pending) != registrationRateLimit {
+		t.Errorf("%d registrations are waiting for approval, want %d", len(pending), registrationRateLimit)
+	}
+}
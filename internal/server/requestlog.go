@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	requestIDHeader     = "X-Request-Id"
+	requestIDContextKey = "requestId"
+	maxRequestIDLength  = 128
+	requestLogLevelOff  = "off"
+)
+
+// incoming request IDs are only accepted if they cannot break the log format
+var requestIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._:-]+$`)
+
+// requestLogger assigns an ID to every request and logs the finished requests. The ID of an incoming X-Request-Id
+// header is kept, e.g. if a reverse proxy assigns IDs. It is returned in the response header and added to the context
+// of the request, see common.ContextLogger. The log entries are structured, LOG_JSON selects the output format.
+func (s *Server) requestLogger() (gin.HandlerFunc, error) {
+	var level logrus.Level
+	enabled := s.config.Core.RequestLogLevel != requestLogLevelOff
+	if enabled {
+		var err error
+		if level, err = logrus.ParseLevel(s.config.Core.RequestLogLevel); err != nil {
+			return nil, errors.Wrap(err, "invalid request log level")
+		}
+	}
+
+	return func(c *gin.Context) {
+		startedAt := time.Now()
+		requestID := c.GetHeader(requestIDHeader)
+		if len(requestID) > maxRequestIDLength || !requestIDRegex.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		c.Set(requestIDContextKey, requestID)
+		c.Header(requestIDHeader, requestID)
+		c.Request = c.Request.WithContext(common.WithRequestID(c.Request.Context(), requestID))
+
+		c.Next()
+
+		if !enabled || s.isRequestLogSkipped(c.Request.URL.Path) {
+			return
+		}
+		entryLevel := level
+		if c.Writer.Status() >= 500 && entryLevel > logrus.WarnLevel {
+			entryLevel = logrus.WarnLevel // server errors are always visible
+		}
+		logrus.WithFields(logrus.Fields{
+			"request_id": requestID,
+			"method":     c.Request.Method,
+			"path":       redactedRequestPath(c),
+			"status":     c.Writer.Status(),
+			"latency":    time.Since(startedAt).String(),
+			"user":       requestUser(c),
+			"ip":         s.clientIP(c), // the client address, X-Forwarded-For is only used for trusted proxies
+			"remote_ip":  remoteIP(c),   // the address of the connection, the client or the nearest proxy
+		}).Log(entryLevel, "request")
+	}, nil
+}
+
+func (s *Server) isRequestLogSkipped(path string) bool {
+	path = strings.TrimPrefix(path, s.basePath)
+	for _, prefix := range s.config.Core.RequestLogSkipPaths {
+		if prefix != "" && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactedRequestPath returns the path of the request without the path parameters that grant access, like the token
+// of a download link.
+func redactedRequestPath(c *gin.Context) string {
+	path := c.Request.URL.Path
+	if token := c.Param("token"); token != "" {
+		path = strings.Replace(path, token, "[redacted]", 1)
+	}
+	return path
+}
+
+// requestUser returns the email of the user that is authenticated by the API credentials or the session, or an empty
+// string for anonymous requests.
+func requestUser(c *gin.Context) string {
+	if email := c.GetString(apiUserContextKey); email != "" {
+		return email
+	}
+	if _, ok := c.Get(sessions.DefaultKey); !ok {
+		return "" // the session middleware did not run, e.g. for health checks
+	}
+	if sessionData, ok := sessions.Default(c).Get(SessionIdentifier).(SessionData); ok && sessionData.LoggedIn {
+		return sessionData.Email
+	}
+	return ""
+}
+
+// getRequestID returns the ID of the current request, see requestLogger.
+func getRequestID(c *gin.Context) string {
+	return c.GetString(requestIDContextKey)
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
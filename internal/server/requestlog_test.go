@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRequestLogIgnoresForgedForwardedFor(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(hook.Reset)
+
+	for proxies, want := range map[string]string{"": "127.0.0.1", "127.0.0.1": "198.51.100.7"} {
+		s := newTestServer(t, map[string]string{"REQUEST_LOG_LEVEL": "info", "TRUSTED_PROXIES": proxies})
+		baseUrl := startTestServer(t, s).URL
+		hook.Reset()
+
+		getWithForwardedFor(t, baseUrl+"/auth/login", "198.51.100.7")
+
+		found := false
+		for _, entry := range hook.AllEntries() {
+			if entry.Message != "request" {
+				continue
+			}
+			found = true
+			if entry.Data["ip"] != want || entry.Data["remote_ip"] != "127.0.0.1" {
+				t.Errorf("trusted proxies %q: logged ip %v and remote_ip %v, want %s and 127.0.0.1", proxies,
+					entry.Data["ip"], entry.Data["remote_ip"], want)
+			}
+		}
+		if !found {
+			t.Errorf("trusted proxies %q: the request was not logged", proxies)
+		}
+	}
+}
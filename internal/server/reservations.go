@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+)
+
+// applyIPReservations assigns the reserved addresses of the matching reservations to a new peer, the reserved address
+// replaces the address of the same family. Afterwards, the addresses of the peer are checked with checkIPReservations.
+func (s *Server) applyIPReservations(dev wireguard.Device, peer *wireguard.Peer) error {
+	if dev.Type != wireguard.DeviceTypeServer {
+		return nil
+	}
+
+	addresses := peer.GetIPAddresses()
+	for _, reservation := range s.peers.GetIPReservations(dev.DeviceName) {
+		if !reservation.Matches(*peer) {
+			continue
+		}
+		address, err := s.reservedAddress(dev.DeviceName, reservation, peer.PublicKey)
+		if err != nil {
+			return err
+		}
+
+		replaced := false
+		for i := range addresses {
+			if common.IsIPv6(addresses[i]) == common.IsIPv6(address) {
+				addresses[i] = address
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			addresses = append(addresses, address)
+		}
+	}
+	peer.SetIPAddresses(addresses...)
+
+	return s.checkIPReservations(dev, *peer)
+}
+
+// reservedAddress returns the address of the reservation for the peer. For ranges, this is the first address that is
+// not used by another peer.
+func (s *Server) reservedAddress(device string, reservation wireguard.IPReservation, publicKey string) (string, error) {
+	ip, ipNet, err := net.ParseCIDR(reservation.Network)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid reservation %s", reservation.Network)
+	}
+	bits := "/32"
+	if common.IsIPv6(ip.String()) {
+		bits = "/128"
+	}
+
+	if !reservation.IsRange() {
+		if other := s.peers.GetPeerByIP(device, ip); other.PublicKey != "" && other.PublicKey != publicKey {
+			return "", errors.Errorf("the address %s is reserved for %s, but already used by peer %s", ip,
+				reservation.Owner(), other.Identifier)
+		}
+		return ip.String() + bits, nil
+	}
+
+	for ip := ip.Mask(ipNet.Mask); ipNet.Contains(ip); common.IncreaseIP(ip) {
+		if other := s.peers.GetPeerByIP(device, ip); other.PublicKey == "" || other.PublicKey == publicKey {
+			return ip.String() + bits, nil
+		}
+	}
+	return "", errors.Errorf("all addresses of the reservation %s for %s are in use", reservation.Network,
+		reservation.Owner())
+}
+
+// checkIPReservations rejects addresses of the peer that are reserved for other peers. Addresses of reservations
+// without owner may be assigned manually.
+func (s *Server) checkIPReservations(dev wireguard.Device, peer wireguard.Peer) error {
+	if dev.Type != wireguard.DeviceTypeServer {
+		return nil
+	}
+
+	reservations := s.peers.GetIPReservations(dev.DeviceName)
+	for _, cidr := range peer.GetIPAddresses() {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue // validated with the networks of the peer
+		}
+		for _, reservation := range reservations {
+			if reservation.Contains(ip) && !reservation.IsManual() && !reservation.Matches(peer) {
+				return errors.Errorf("the address %s is reserved for %s", ip, reservation.Owner())
+			}
+		}
+	}
+	return nil
+}
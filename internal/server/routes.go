@@ -1,29 +1,39 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	wgportal "github.com/h44z/wg-portal"
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/oidc"
 	_ "github.com/h44z/wg-portal/internal/server/docs" // docs is generated by Swag CLI, you have to import it.
+	"github.com/h44z/wg-portal/internal/users"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"github.com/swaggo/gin-swagger/swaggerFiles"
-	csrf "github.com/utrack/gin-csrf"
+)
+
+const (
+	apiUserContextKey     = "apiUser"     // the email address of the user that authenticated the current API request
+	apiIdentityContextKey = "apiIdentity" // the authenticated user, a service identity of an OIDC provider is not stored
 )
 
 func SetupRoutes(s *Server) {
-	csrfMiddleware := csrf.Middleware(csrf.Options{
-		Secret: s.config.Core.SessionSecret,
-		ErrorFunc: func(c *gin.Context) {
-			c.String(400, "CSRF token mismatch")
-			c.Abort()
-		},
-	})
+	csrfMiddleware := s.csrfMiddleware()
+
+	// All routes are below the path of the external url
+	root := s.server.Group(s.basePath)
+	if s.basePath != "" {
+		s.server.GET("/", func(c *gin.Context) {
+			c.Redirect(http.StatusSeeOther, s.urlPath("/"))
+		})
+	}
 
 	// Startpage
-	s.server.GET("/", s.GetIndex)
-	s.server.GET("/favicon.ico", func(c *gin.Context) {
+	root.GET("/", s.GetIndex)
+	root.GET("/favicon.ico", func(c *gin.Context) {
 		file, _ := wgportal.Statics.ReadFile("assets/img/favicon.ico")
 		c.Data(
 			http.StatusOK,
@@ -32,56 +42,126 @@ func SetupRoutes(s *Server) {
 		)
 	})
 
+	// The uploaded logo is shown on the login page as well
+	root.GET("/branding/logo", s.GetBrandingLogo)
+
+	// The language can be selected before login
+	root.GET("/language", s.GetLanguage)
+
+	// Single-use download links, no login required
+	root.GET("/p/:token", s.downloadLinkLimiter.Middleware(s), s.GetDownloadLink)
+
 	// Auth routes
-	auth := s.server.Group("/auth")
+	auth := root.Group("/auth")
 	auth.Use(csrfMiddleware)
 	auth.GET("/login", s.GetLogin)
 	auth.POST("/login", s.PostLogin)
-	auth.GET("/logout", s.GetLogout)
+	auth.POST("/logout", s.PostLogout)
+	auth.GET("/register", s.GetRegister)
+	auth.POST("/register", s.registrationLimiter.Middleware(s), s.PostRegister)
 
 	// Admin routes
-	admin := s.server.Group("/admin")
+	admin := root.Group("/admin")
 	admin.Use(csrfMiddleware)
 	admin.Use(s.RequireAuthentication("admin"))
 	admin.GET("/", s.GetAdminIndex)
 	admin.GET("/device/edit", s.GetAdminEditInterface)
 	admin.POST("/device/edit", s.PostAdminEditInterface)
+	admin.POST("/device/edit/confirm", s.PostAdminConfirmEditInterface)
+	admin.POST("/device/state", s.PostAdminInterfaceState)
+	admin.GET("/device/summary", s.GetAdminInterfaceSummary)
+	admin.POST("/device/delete", s.PostAdminDeleteInterface)
 	admin.GET("/device/download", s.GetInterfaceConfig)
-	admin.GET("/device/write", s.GetSaveConfig)
+	admin.GET("/interface/:id/configs.zip", s.GetAdminInterfacePeerConfigs)
+	admin.POST("/device/write", s.PostSaveConfig)
 	admin.GET("/device/applyglobals", s.GetApplyGlobalConfig)
+	admin.POST("/device/applyglobals", s.PostApplyGlobalConfig)
+	admin.GET("/device/inactive", s.GetAdminInactivePeers)
+	admin.POST("/device/inactive/disable", s.PostAdminDisableInactivePeers)
+	admin.GET("/device/orphans", s.GetAdminOrphanedPeers)
+	admin.POST("/device/orphans/adopt", s.PostAdminAdoptOrphanedPeers)
+	admin.POST("/device/orphans/remove", s.PostAdminRemoveOrphanedPeers)
+	admin.GET("/device/drift", s.GetAdminDriftReport)
+	admin.POST("/device/reapply", s.PostAdminReapplyInterface)
+	admin.GET("/device/import", s.GetAdminImportInterface)
+	admin.POST("/device/import", s.PostAdminImportInterface)
+	admin.POST("/device/import/document", s.PostAdminImportInterfaceDocument)
+	admin.GET("/device/sitelink", s.GetAdminSiteLink)
+	admin.POST("/device/sitelink", s.PostAdminSiteLink)
+	admin.GET("/device/export", s.GetAdminExportInterface)
+	admin.POST("/device/presets", s.PostAdminAllowedIPsPreset)
+	admin.POST("/device/presets/delete", s.PostAdminDeleteAllowedIPsPreset)
+	admin.POST("/device/reservations", s.PostAdminIPReservation)
+	admin.POST("/device/reservations/delete", s.PostAdminDeleteIPReservation)
 	admin.GET("/peer/edit", s.GetAdminEditPeer)
 	admin.POST("/peer/edit", s.PostAdminEditPeer)
+	admin.POST("/peer/edit/confirm", s.PostAdminConfirmEditPeer)
 	admin.GET("/peer/create", s.GetAdminCreatePeer)
 	admin.POST("/peer/create", s.PostAdminCreatePeer)
 	admin.GET("/peer/createldap", s.GetAdminCreateLdapPeers)
 	admin.POST("/peer/createldap", s.PostAdminCreateLdapPeers)
-	admin.GET("/peer/delete", s.GetAdminDeletePeer)
+	admin.POST("/peer/createall", s.PostAdminCreateAllPeers)
+	admin.POST("/peer/delete", s.PostAdminDeletePeer)
+	admin.POST("/peer/bulk", s.PostAdminBulkPeerAction)
+	admin.POST("/peer/psk", s.PostAdminPeerPresharedKey)
+	admin.POST("/peer/rotate", s.PostAdminRotatePeerKeys)
+	admin.POST("/peer/guest", s.PostAdminGuestPeer)
+	admin.POST("/peer/link", s.PostAdminCreateDownloadLink)
+	admin.POST("/peer/link/revoke", s.PostAdminRevokeDownloadLink)
 	admin.GET("/peer/download", s.GetPeerConfig)
-	admin.GET("/peer/email", s.GetPeerConfigMail)
-	admin.GET("/peer/emailall", s.GetAdminSendEmails)
+	admin.POST("/peer/email", s.PostPeerConfigMail)
+	admin.POST("/peer/emailall", s.PostAdminSendEmails)
+	admin.POST("/mail/clear", s.PostAdminClearMailFailures)
+	admin.GET("/audit", s.GetAdminAuditLog)
+	admin.GET("/logins", s.GetAdminLoginFailures)
+	admin.POST("/logins/clear", s.PostAdminClearLockout)
+	admin.GET("/traffic", s.GetAdminTraffic)
+	admin.GET("/traffic/export", s.GetAdminTrafficExport)
+	admin.GET("/branding", s.GetAdminBranding)
+	admin.POST("/branding", s.PostAdminBranding)
+	admin.POST("/branding/reset", s.PostAdminResetBranding)
+	admin.GET("/backup", s.GetAdminBackup)
+	admin.GET("/backup/download", s.GetAdminBackupDownload)
+	admin.POST("/backup/restore", s.PostAdminBackupRestore)
 
 	admin.GET("/users/", s.GetAdminUsersIndex)
 	admin.GET("/users/create", s.GetAdminUsersCreate)
 	admin.POST("/users/create", s.PostAdminUsersCreate)
 	admin.GET("/users/edit", s.GetAdminUsersEdit)
 	admin.POST("/users/edit", s.PostAdminUsersEdit)
+	admin.GET("/users/registrations", s.GetAdminRegistrations)
+	admin.POST("/users/registrations", s.PostAdminRegistration)
+	admin.POST("/users/impersonate", s.PostAdminImpersonateUser)
 
 	// User routes
-	user := s.server.Group("/user")
+	user := root.Group("/user")
 	user.Use(csrfMiddleware)
 	user.Use(s.RequireAuthentication("")) // empty scope = all logged in users
 	user.GET("/qrcode", s.GetPeerQRCode)
 	user.GET("/profile", s.GetUserIndex)
 	user.GET("/download", s.GetPeerConfig)
-	user.GET("/email", s.GetPeerConfigMail)
+	user.GET("/peer/:id/config", s.GetPeerConfig)
+	user.POST("/peer/create", s.PostUserCreatePeer)
+	user.POST("/peer/rename", s.PostUserRenamePeer)
+	user.POST("/peer/settings", s.PostUserPeerSettings)
+	user.POST("/peer/delete", s.PostUserDeletePeer)
+	user.POST("/peer/disable", s.PostUserDisablePeer)
+	user.POST("/peer/rotate", s.PostUserRotatePeerKeys)
+	user.GET("/peer/rotated", s.GetRotatedPeer)
+	user.POST("/theme", s.PostUserTheme)
+	user.POST("/apitoken", s.PostUserCreateApiToken)
+	user.POST("/apitoken/delete", s.PostUserDeleteApiToken)
+	user.POST("/email", s.PostPeerConfigMail)
 	user.GET("/status", s.GetPeerStatus)
+	user.POST("/impersonate/stop", s.PostStopImpersonation)
 }
 
 func SetupApiRoutes(s *Server) {
 	api := ApiServer{s: s}
+	root := s.server.Group(s.basePath)
 
 	// Admin authenticated routes
-	apiV1Backend := s.server.Group("/api/v1/backend")
+	apiV1Backend := root.Group("/api/v1/backend")
 	apiV1Backend.Use(s.RequireApiAuthentication("admin"))
 
 	apiV1Backend.GET("/users", api.GetUsers)
@@ -102,17 +182,29 @@ func SetupApiRoutes(s *Server) {
 	apiV1Backend.GET("/device", api.GetDevice)
 	apiV1Backend.PUT("/device", api.PutDevice)
 	apiV1Backend.PATCH("/device", api.PatchDevice)
+	apiV1Backend.DELETE("/device", api.DeleteDevice)
+	apiV1Backend.GET("/device/export", api.GetDeviceExport)
+	apiV1Backend.POST("/device/import", api.PostDeviceImport)
+
+	apiV1Backend.GET("/backup", api.GetBackup)
+	apiV1Backend.POST("/backup/restore", api.PostBackupRestore)
 
 	// Simple authenticated routes
-	apiV1Deployment := s.server.Group("/api/v1/provisioning")
+	apiV1Deployment := root.Group("/api/v1/provisioning")
 	apiV1Deployment.Use(s.RequireApiAuthentication(""))
 
 	apiV1Deployment.GET("/peers", api.GetPeerDeploymentInformation)
 	apiV1Deployment.GET("/peer", api.GetPeerDeploymentConfig)
 	apiV1Deployment.POST("/peers", api.PostPeerDeploymentConfig)
+	apiV1Deployment.DELETE("/peer", api.DeletePeerDeployment)
+
+	// Enrollment systems, only accessible with provisioning tokens
+	root.POST("/api/v1/provisioning/enroll", s.RequireApiAuthentication(ApiTokenScopeProvisioning),
+		api.PostPeerEnrollment)
 
 	// Swagger doc/ui
-	s.server.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	root.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	root.GET("/api/v1/openapi.json", api.GetOpenApiDocument)
 }
 
 func (s *Server) RequireAuthentication(scope string) gin.HandlerFunc {
@@ -122,7 +214,7 @@ func (s *Server) RequireAuthentication(scope string) gin.HandlerFunc {
 		if !session.LoggedIn {
 			// Abort the request with the appropriate error code
 			c.Abort()
-			c.Redirect(http.StatusSeeOther, "/auth/login?err=loginreq")
+			c.Redirect(http.StatusSeeOther, s.urlPath("/auth/login?err=loginreq"))
 			return
 		}
 
@@ -141,14 +233,25 @@ func (s *Server) RequireAuthentication(scope string) gin.HandlerFunc {
 			return
 		}
 
-		// Check if logged-in user is still valid
-		if !s.isUserStillValid(session.Email) {
+		// Check if logged-in user and the impersonating administrator are still valid
+		impersonationValid := session.ImpersonatedBy == "" || s.isAdminStillValid(session.ImpersonatedBy)
+		if !s.isUserStillValid(session.Email) || !impersonationValid {
 			_ = DestroySessionData(c)
 			c.Abort()
 			s.GetHandleError(c, http.StatusUnauthorized, "unauthorized", "session no longer available")
 			return
 		}
 
+		// The selected interface may have been deleted in the meantime
+		if session.DeviceName != "" && !common.ListContains(s.wg.Cfg.DeviceNames, session.DeviceName) {
+			session.DeviceName = s.wg.Cfg.GetDefaultDeviceName()
+			if err := UpdateSessionData(c, session); err != nil {
+				c.Abort()
+				s.GetHandleError(c, http.StatusInternalServerError, "session error", "failed to save session")
+				return
+			}
+		}
+
 		// Continue down the chain to handler etc
 		c.Next()
 	}
@@ -156,23 +259,64 @@ func (s *Server) RequireAuthentication(scope string) gin.HandlerFunc {
 
 func (s *Server) RequireApiAuthentication(scope string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		username, password, hasAuth := c.Request.BasicAuth()
-		if !hasAuth {
-			c.Abort()
-			c.JSON(http.StatusUnauthorized, ApiError{Message: "unauthorized"})
-			return
-		}
+		var user *users.User
+		var err error
+		tokenScope := ApiTokenScopeUser
+		if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+			// API tokens of the user profile, then access tokens of the OIDC providers
+			token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+			user, tokenScope, err = s.authenticateApiToken(token)
+			if err == errApiTokenInvalid && s.oidc != nil && oidc.IsJWT(token) {
+				user, err = s.authenticateOidcToken(token)
+			}
+			if tokenErr, ok := err.(*oidc.TokenError); ok {
+				c.Abort()
+				c.Header("WWW-Authenticate", fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q",
+					tokenErr.Reason))
+				c.JSON(http.StatusUnauthorized, ApiError{Message: tokenErr.Reason})
+				return
+			}
+			if err == errApiTokenInvalid {
+				err = errUserNotActive
+			}
+		} else {
+			username, password, hasAuth := c.Request.BasicAuth()
+			if !hasAuth {
+				c.Abort()
+				c.JSON(http.StatusUnauthorized, ApiError{Message: "unauthorized"})
+				return
+			}
+
+			// Validate form input
+			if strings.Trim(username, " ") == "" || strings.Trim(password, " ") == "" {
+				c.Abort()
+				c.JSON(http.StatusUnauthorized, ApiError{Message: "unauthorized"})
+				return
+			}
 
-		// Validate form input
-		if strings.Trim(username, " ") == "" || strings.Trim(password, " ") == "" {
+			guardName := strings.ToLower(username)
+			if s.loginGuard.Locked(guardName, s.clientIP(c), "api") {
+				c.Abort()
+				c.JSON(http.StatusTooManyRequests, ApiError{Message: "too many failed login attempts"})
+				return
+			}
+
+			// Check all available auth backends
+			user, err = s.checkAuthentication(username, password)
+			if err == nil && user == nil {
+				s.loginGuard.Failed(LoginFailure{Username: guardName, ClientIP: s.clientIP(c),
+					Provider: s.passwordProviderNames(), Channel: "api"})
+			} else if err == nil {
+				s.loginGuard.Succeeded(guardName)
+			}
+		}
+		if err == errUserNotActive {
 			c.Abort()
 			c.JSON(http.StatusUnauthorized, ApiError{Message: "unauthorized"})
 			return
 		}
-
-		// Check all available auth backends
-		user, err := s.checkAuthentication(username, password)
 		if err != nil {
+			common.ContextLogger(c.Request.Context()).Errorf("api authentication failed: %v", err)
 			c.Abort()
 			c.JSON(http.StatusInternalServerError, ApiError{Message: "login error"})
 			return
@@ -185,19 +329,21 @@ func (s *Server) RequireApiAuthentication(scope string) gin.HandlerFunc {
 			return
 		}
 
+		c.Set(apiUserContextKey, user.Email)
+		c.Set(apiIdentityContextKey, user)
+
 		// Check admin scope
-		if scope == "admin" && !user.IsAdmin {
+		if !userHasScope(user, scope) {
 			// Abort the request with the appropriate error code
 			c.Abort()
 			c.JSON(http.StatusForbidden, ApiError{Message: "unauthorized"})
 			return
 		}
 
-		// default case if some random scope was set...
-		if scope != "" && !user.IsAdmin {
-			// Abort the request with the appropriate error code
+		// Provisioning tokens are only accepted by the enrollment endpoint, and it only accepts provisioning tokens
+		if (tokenScope == ApiTokenScopeProvisioning) != (scope == ApiTokenScopeProvisioning) {
 			c.Abort()
-			c.JSON(http.StatusForbidden, ApiError{Message: "unauthorized"})
+			c.JSON(http.StatusForbidden, ApiError{Message: "the credentials cannot be used for this endpoint"})
 			return
 		}
 
@@ -205,3 +351,9 @@ func (s *Server) RequireApiAuthentication(scope string) gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// userHasScope checks the scope of the API routes, it is shared by the REST and the gRPC API. Any scope other than
+// the empty one requires an administrator.
+func userHasScope(user *users.User, scope string) bool {
+	return scope == "" || user.IsAdmin
+}
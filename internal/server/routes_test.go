@@ -0,0 +1,154 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/h44z/wg-portal/internal/users"
+)
+
+const testBasePath = "/vpn"
+
+var (
+	localLinkPattern = regexp.MustCompile(`(?:href|src|action|formaction)="(/[^/"][^"]*|/)"`)
+	csrfInputPattern = regexp.MustCompile(`name="` + csrfFormField + `" value="([^"]+)"`)
+)
+
+// newBasePathTestServer returns a server below the path of testBasePath and a client that is logged in as
+// administrator.
+func newBasePathTestServer(t *testing.T) (*Server, string, *http.Client) {
+	s := newTestServer(t, map[string]string{"EXTERNAL_URL": "http://localhost:8123" + testBasePath})
+	baseUrl := startTestServer(t, s).URL
+	if s.urlPath("/") != testBasePath+"/" {
+		t.Fatalf("base path %q, want %q", s.basePath, testBasePath)
+	}
+
+	client := loginTestAdmin(t, s, baseUrl+testBasePath)
+
+	return s, baseUrl, client
+}
+
+// loginTestAdmin creates the administrator admin@example.org and returns a client that is logged in as this user.
+// The baseUrl contains the base path of the server.
+func loginTestAdmin(t *testing.T, s *Server, baseUrl string) *http.Client {
+	t.Helper()
+
+	password, err := users.PasswordPolicy{HashCost: 4}.Hash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.users.CreateUser(&users.User{Email: "admin@example.org", IsAdmin: true, Password: password}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t)
+	_, body := getPage(t, client, baseUrl+"/auth/login")
+	token := csrfInputPattern.FindStringSubmatch(body)
+	if token == nil {
+		t.Fatal("the login form has no CSRF token")
+	}
+	resp, err := client.PostForm(baseUrl+"/auth/login", url.Values{csrfFormField: {token[1]},
+		"username": {"admin@example.org"}, "password": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || location != s.urlPath("/") {
+		t.Fatalf("login: got %d to %q, want %d to %q", resp.StatusCode, location, http.StatusSeeOther, s.urlPath("/"))
+	}
+
+	return client
+}
+
+func getPage(t *testing.T, client *http.Client, target string) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestRoutesBelowBasePath(t *testing.T) {
+	_, baseUrl, client := newBasePathTestServer(t)
+
+	for path, want := range map[string]int{
+		testBasePath + "/css/bootstrap.min.css": http.StatusOK,
+		testBasePath + "/js/custom.js":          http.StatusOK,
+		testBasePath + "/favicon.ico":           http.StatusOK,
+		testBasePath + "/admin/":                http.StatusOK,
+		testBasePath + "/admin/users/":          http.StatusOK,
+		testBasePath + "/user/profile":          http.StatusOK,
+		"/css/bootstrap.min.css":                http.StatusNotFound,
+		"/admin/":                               http.StatusNotFound,
+		"/auth/login":                           http.StatusNotFound,
+	} {
+		if resp, _ := getPage(t, client, baseUrl+path); resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestRedirectsBelowBasePath(t *testing.T) {
+	_, baseUrl, client := newBasePathTestServer(t)
+	anonymous := newTestClient(t)
+
+	for _, tc := range []struct {
+		client   *http.Client
+		path     string
+		location string
+	}{
+		{anonymous, "/", testBasePath + "/"},
+		{anonymous, testBasePath + "/admin/", testBasePath + "/auth/login?err=loginreq"},
+		{anonymous, testBasePath + "/user/profile", testBasePath + "/auth/login?err=loginreq"},
+		{client, testBasePath + "/auth/login", testBasePath + "/"},
+		{client, testBasePath + "/admin/?device=wg0", testBasePath + "/admin/"},
+	} {
+		resp, _ := getPage(t, tc.client, baseUrl+tc.path)
+		if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || location != tc.location {
+			t.Errorf("GET %s: got %d to %q, want %d to %q", tc.path, resp.StatusCode, location,
+				http.StatusSeeOther, tc.location)
+		}
+	}
+}
+
+func TestPagesLinkBelowBasePath(t *testing.T) {
+	_, baseUrl, client := newBasePathTestServer(t)
+
+	for _, path := range []string{"/auth/login", "/", "/admin/", "/admin/users/", "/admin/device/edit", "/user/profile"} {
+		pageClient := client
+		if path == "/auth/login" {
+			pageClient = newTestClient(t)
+		}
+		resp, body := getPage(t, pageClient, baseUrl+testBasePath+path)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %d", path, resp.StatusCode)
+			continue
+		}
+		links := localLinkPattern.FindAllStringSubmatch(body, -1)
+		if len(links) == 0 {
+			t.Errorf("%s has no local links", path)
+		}
+		for _, link := range links {
+			if !strings.HasPrefix(link[1], testBasePath+"/") {
+				t.Errorf("%s links to %s outside of the base path", path, link[1])
+			}
+		}
+	}
+
+	// the cookies are limited to the base path
+	for _, cookie := range client.Jar.Cookies(&url.URL{Scheme: "http", Host: strings.TrimPrefix(baseUrl, "http://"),
+		Path: "/"}) {
+		t.Errorf("cookie %s is sent outside of the base path", cookie.Name)
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// validateDeviceRouting checks the routing table of the interface. Routes into a separate table need the firewall
+// mark of the interface, the policy routing rule must not match the encrypted packets of the interface itself.
+func validateDeviceRouting(dev wireguard.Device) error {
+	table, enabled, err := wireguard.ParseRoutingTable(dev.RoutingTable)
+	if err != nil {
+		return err
+	}
+	if enabled && table != wireguard.RouteTableMain && dev.FirewallMark == 0 {
+		return errors.Errorf("routing table %d requires a firewall mark", table)
+	}
+	return nil
+}
+
+// deviceRules returns the policy routing rules of the interface, which send all packets without the firewall mark of
+// the interface to its routing table. Interfaces that use the main table do not need rules.
+func deviceRules(dev wireguard.Device) []wireguard.Rule {
+	table, enabled, err := wireguard.ParseRoutingTable(dev.RoutingTable)
+	if err != nil || !enabled || table == wireguard.RouteTableMain || dev.FirewallMark == 0 ||
+		dev.Type != wireguard.DeviceTypeServer {
+		return nil
+	}
+
+	rules := make([]wireguard.Rule, 0, 2)
+	for _, family := range []int{syscall.AF_INET, syscall.AF_INET6} {
+		rules = append(rules, wireguard.Rule{Family: family, Table: table, Mark: uint32(dev.FirewallMark)})
+	}
+	return rules
+}
+
+// deviceRoutes returns the routes of the server side allowed IPs of all active peers of a server mode interface.
+// Networks that are already covered by an address of the interface are routed by the kernel. Networks that overlap
+// a network of another peer are not routed, WireGuard would only send their traffic to one of the peers, the
+// returned warnings name the conflicting peers.
+func (s *Server) deviceRoutes(dev wireguard.Device) ([]wireguard.Route, []string) {
+	routes := make([]wireguard.Route, 0)
+	warnings := make([]string, 0)
+	if dev.Type != wireguard.DeviceTypeServer {
+		return routes, warnings
+	}
+	table, enabled, err := wireguard.ParseRoutingTable(dev.RoutingTable)
+	if err != nil {
+		return routes, append(warnings, err.Error())
+	}
+	if !enabled {
+		return routes, warnings
+	}
+	if err := validateDeviceRouting(dev); err != nil {
+		warnings = append(warnings, err.Error()+", no policy routing rule installed")
+	}
+
+	deviceNets := parseNetworks(dev.GetIPAddresses())
+	type owned struct {
+		network *net.IPNet
+		peer    wireguard.Peer
+	}
+	installed := make([]owned, 0)
+	seen := make(map[string]bool)
+	for _, peer := range s.peers.GetActivePeers(dev.DeviceName) {
+		for _, network := range parseNetworks(peer.GetServerAllowedIPs()) {
+			if seen[peer.PublicKey+network.String()] || containedIn(network, deviceNets) {
+				continue
+			}
+			seen[peer.PublicKey+network.String()] = true
+
+			if ones, _ := network.Mask.Size(); ones == 0 && table == wireguard.RouteTableMain {
+				warnings = append(warnings, fmt.Sprintf("no route installed for %s of peer %s, default routes are "+
+					"only installed into a separate routing table", network, peer.Identifier))
+				continue
+			}
+			conflict := false
+			for _, other := range installed {
+				if other.peer.PublicKey != peer.PublicKey && networksOverlap(network, other.network) {
+					warnings = append(warnings, fmt.Sprintf("no route installed for %s of peer %s, it overlaps %s "+
+						"of peer %s", network, peer.Identifier, other.network, other.peer.Identifier))
+					conflict = true
+					break
+				}
+			}
+			if conflict {
+				continue
+			}
+
+			installed = append(installed, owned{network: network, peer: peer})
+			routes = append(routes, wireguard.Route{Destination: *network, Table: table})
+		}
+	}
+
+	return routes, warnings
+}
+
+// GetRouteWarnings returns the networks of the interface that are not routed due to conflicts. Nothing is returned
+// if MANAGE_ROUTES is disabled.
+func (s *Server) GetRouteWarnings(device string) []string {
+	if !s.config.WG.ManageRoutes {
+		return nil
+	}
+	_, warnings := s.deviceRoutes(s.peers.GetDevice(device))
+	return warnings
+}
+
+// syncDeviceRoutes installs the routes of the peers of the interface and removes the routes of the portal that are
+// no longer needed, e.g. after a peer was removed or the routing table was changed. Routes of other programs are
+// never touched. Nothing is changed if MANAGE_ROUTES is disabled or the link is down, the kernel removes the routes
+// of links that are brought down. Routes are only managed for local interfaces.
+func (s *Server) syncDeviceRoutes(device string) {
+	if !s.config.WG.ManageRoutes || s.wg.IsRemoteDevice(device) || s.wg.IsExternalDevice(device) {
+		return
+	}
+	if up, err := s.wg.IsLinkUp(device); err != nil || !up {
+		return
+	}
+
+	desired, warnings := s.deviceRoutes(s.peers.GetDevice(device))
+	for _, warning := range warnings {
+		logrus.Warnf("interface %s: %s", device, warning)
+	}
+
+	current, err := s.wg.RouteList(device)
+	if err != nil {
+		logrus.Errorf("failed to update routes of interface %s: %v", device, err)
+		return
+	}
+	existing := make(map[string]bool, len(current))
+	for _, route := range current {
+		existing[route.String()] = true
+	}
+	wanted := make(map[string]bool, len(desired))
+	var added, removed int
+	for _, route := range desired {
+		wanted[route.String()] = true
+		if existing[route.String()] {
+			continue
+		}
+		if err := s.wg.RouteReplace(device, route); err != nil {
+			logrus.Errorf("failed to update routes of interface %s: %v", device, err)
+			continue
+		}
+		added++
+	}
+	for _, route := range current {
+		if wanted[route.String()] {
+			continue
+		}
+		if err := s.wg.RouteDel(device, route); err != nil {
+			logrus.Errorf("failed to update routes of interface %s: %v", device, err)
+			continue
+		}
+		removed++
+	}
+
+	if added > 0 || removed > 0 {
+		logrus.Infof("updated routes of interface %s: %d added, %d removed", device, added, removed)
+	}
+
+	s.syncRoutingRules("")
+}
+
+// syncRoutingRules installs the policy routing rules of all managed interfaces with a link that is up, except the
+// given interface and the interfaces of other network namespaces, and removes the other rules of the portal. Rules of
+// other programs are never touched.
+func (s *Server) syncRoutingRules(except string) {
+	if !s.config.WG.ManageRoutes {
+		return
+	}
+
+	wanted := make(map[string]bool)
+	desired := make([]wireguard.Rule, 0)
+	for _, device := range s.config.WG.DeviceNames {
+		if device == except || s.wg.IsRemoteDevice(device) || s.wg.IsExternalDevice(device) ||
+			s.wg.DeviceNamespace(device) != "" {
+			continue // the routing rules are only managed in the network namespace of the portal
+		}
+		if up, err := s.wg.IsLinkUp(device); err != nil || !up {
+			continue
+		}
+		for _, rule := range deviceRules(s.peers.GetDevice(device)) {
+			if !wanted[rule.String()] {
+				wanted[rule.String()] = true
+				desired = append(desired, rule)
+			}
+		}
+	}
+
+	current, err := s.wg.RuleList()
+	if err != nil {
+		logrus.Errorf("failed to update routing rules: %v", err)
+		return
+	}
+	existing := make(map[string]bool, len(current))
+	for _, rule := range current {
+		if wanted[rule.String()] && !existing[rule.String()] {
+			existing[rule.String()] = true
+			continue
+		}
+		if err := s.wg.RuleDel(rule); err != nil { // stale or duplicate rule
+			logrus.Errorf("failed to update routing rules: %v", err)
+		}
+	}
+	for _, rule := range desired {
+		if existing[rule.String()] {
+			continue
+		}
+		if err := s.wg.RuleAdd(rule); err != nil {
+			logrus.Errorf("failed to update routing rules: %v", err)
+		}
+	}
+}
+
+// removeDeviceRoutes removes all routes of the portal through the interface and its policy routing rules. The number
+// of removed routes is returned.
+func (s *Server) removeDeviceRoutes(device string) int {
+	if !s.config.WG.ManageRoutes || s.wg.IsRemoteDevice(device) || s.wg.IsExternalDevice(device) {
+		return 0
+	}
+
+	routes, err := s.wg.RouteList(device)
+	if err != nil {
+		logrus.Errorf("failed to remove routes of interface %s: %v", device, err)
+		routes = nil
+	}
+	removed := 0
+	for _, route := range routes {
+		if err := s.wg.RouteDel(device, route); err != nil {
+			logrus.Errorf("failed to remove routes of interface %s: %v", device, err)
+			continue
+		}
+		removed++
+	}
+	s.syncRoutingRules(device)
+	return removed
+}
+
+// validatePeerNetworks checks the addresses and server side allowed IPs of a peer of a server mode interface. The
+// addresses must be part of the networks of the interface, and no network may overlap a network of another peer of
+// the interface, WireGuard would only send the traffic of the overlapping part to one of the peers. The addresses are
+// routed as host routes, server side allowed IPs that widen them must not cover the addresses of the interface, like
+// the whole network of the interface.
+func (s *Server) validatePeerNetworks(dev wireguard.Device, peer wireguard.Peer) error {
+	if dev.Type != wireguard.DeviceTypeServer {
+		return nil
+	}
+
+	deviceNets := parseNetworks(dev.GetIPAddresses())
+	for _, cidr := range peer.GetIPAddresses() {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.Errorf("invalid ip address %s", cidr)
+		}
+		if !containedIn(hostNetwork(ip), deviceNets) {
+			return errors.Errorf("ip address %s is outside of the networks of interface %s (%s)", cidr,
+				dev.DeviceName, common.ListToString(dev.GetIPAddresses()))
+		}
+	}
+	for _, network := range parseNetworks(peer.GetAllowedIPsSrv()) {
+		if ones, _ := network.Mask.Size(); ones == 0 {
+			continue // default routes make the peer a gateway, they cannot be narrowed
+		}
+		for _, deviceNet := range deviceNets {
+			if containedIn(deviceNet, []*net.IPNet{network}) {
+				return errors.Errorf("server side allowed IP %s covers the network %s of interface %s, use "+
+					"the addresses of the peer or smaller networks", network, deviceNet, dev.DeviceName)
+			}
+		}
+	}
+
+	networks := parseNetworks(peer.GetServerAllowedIPs())
+	for _, other := range s.peers.GetAllPeers(dev.DeviceName) {
+		if other.PublicKey == peer.PublicKey {
+			continue
+		}
+		for _, otherNetwork := range parseNetworks(other.GetServerAllowedIPs()) {
+			for _, network := range networks {
+				if networksOverlap(network, otherNetwork) {
+					return errors.Errorf("%s overlaps %s of peer %s (%s)", network, otherNetwork, other.Identifier,
+						other.PublicKey)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeCoveredNetworks removes the server side allowed IPs of the peer that are already covered by the host route of a
+// peer address or another server side network of the peer.
+func removeCoveredNetworks(peer *wireguard.Peer) {
+	covering := parseNetworks(peer.GetHostRoutes())
+	allowed := parseNetworks(peer.GetAllowedIPsSrv())
+	kept := make([]string, 0, len(allowed))
+	for i, network := range allowed {
+		others := append(append([]*net.IPNet{}, covering...), allowed[:i]...)
+		for _, later := range allowed[i+1:] {
+			if later.String() != network.String() { // of equal networks, the first one is kept
+				others = append(others, later)
+			}
+		}
+		if !containedIn(network, others) {
+			kept = append(kept, network.String())
+		}
+	}
+	peer.AllowedIPsSrvStr = common.ListToString(kept)
+}
+
+func parseNetworks(cidrs []string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// containedIn reports whether the network is a subnet of one of the given networks.
+func containedIn(network *net.IPNet, networks []*net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	for _, other := range networks {
+		otherOnes, otherBits := other.Mask.Size()
+		if bits == otherBits && otherOnes <= ones && other.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostNetwork returns the host route (/32 or /128) of the address.
+func hostNetwork(ip net.IP) *net.IPNet {
+	if v4 := ip.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func networksOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
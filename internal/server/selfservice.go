@@ -0,0 +1,100 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+)
+
+var errPeerNotFound = errors.New("peer not found")
+
+// GetUserPeer returns the peer with the given public key if it belongs to the user. Peers of other users are
+// reported as missing, so that users cannot probe for foreign public keys.
+func (s *Server) GetUserPeer(email, publicKey string) (wireguard.Peer, error) {
+	peer := s.peers.GetPeerByKey(publicKey)
+	if !peer.IsValid() || !strings.EqualFold(peer.Email, email) {
+		return wireguard.Peer{}, errPeerNotFound
+	}
+
+	return peer, nil
+}
+
+// GetSelfServiceDevices returns the server mode interfaces on which users can create their own peers: the default
+// interface and all interfaces with self-service enabled.
+func (s *Server) GetSelfServiceDevices() []string {
+	devices := make([]string, 0, len(s.wg.Cfg.DeviceNames))
+	for _, deviceName := range s.wg.Cfg.DeviceNames {
+		dev := s.peers.GetDevice(deviceName)
+		if dev.Type != wireguard.DeviceTypeServer {
+			continue
+		}
+		if dev.SelfService || deviceName == s.wg.Cfg.GetDefaultDeviceName() {
+			devices = append(devices, deviceName)
+		}
+	}
+
+	return devices
+}
+
+// CreateUserPeer creates a peer for the user on a self-service interface. The ip addresses are allocated
+// automatically. If a public key is given, the user generated the key pair on the device and the portal does not
+// know the private key.
+func (s *Server) CreateUserPeer(email, device, identifier, publicKey string) (wireguard.Peer, error) {
+	if !common.ListContains(s.GetSelfServiceDevices(), device) {
+		return wireguard.Peer{}, errors.Errorf("peers cannot be created on interface %s", device)
+	}
+
+	peer, err := s.PrepareNewPeer(device)
+	if err != nil {
+		return wireguard.Peer{}, errors.WithMessage(err, "failed to prepare new peer")
+	}
+	if strings.TrimSpace(publicKey) != "" {
+		if err := s.setClientPublicKey(&peer, publicKey); err != nil {
+			return wireguard.Peer{}, err
+		}
+	}
+	peer.Email = email
+	peer.Identifier = identifier
+	peer.CreatedBy = email
+	peer.UpdatedBy = email
+
+	if err := s.CreatePeer(device, peer); err != nil {
+		return wireguard.Peer{}, err
+	}
+
+	return s.peers.GetPeerByKey(peer.PublicKey), nil
+}
+
+// SetUserPeerDisabled disables or enables a peer of the user. Users can only enable peers that they disabled
+// themselves, peers disabled by an administrator or the inactivity check stay disabled.
+func (s *Server) SetUserPeerDisabled(peer wireguard.Peer, disabled bool, actor string) error {
+	now := time.Now()
+	switch {
+	case disabled && peer.DeactivatedAt == nil:
+		peer.DeactivatedAt = &now
+		peer.DeactivationReason = wireguard.DeactivationReasonUser
+	case !disabled && peer.DeactivatedAt != nil:
+		if peer.DeactivationReason != wireguard.DeactivationReasonUser {
+			return errors.New("the peer was disabled by an administrator")
+		}
+		peer.DeactivatedAt = nil
+	default:
+		return nil
+	}
+
+	peer.UpdatedBy = actor
+	return s.UpdatePeer(peer, now)
+}
+
+// DeleteUserPeer deletes a peer of the user. Managed peers can only be deleted by administrators.
+func (s *Server) DeleteUserPeer(peer wireguard.Peer, actor string) error {
+	if peer.Managed {
+		return errors.New("the peer is managed by an administrator and cannot be deleted")
+	}
+
+	peer.UpdatedBy = actor
+	return s.DeletePeer(peer)
+}
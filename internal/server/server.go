@@ -3,29 +3,34 @@ package server
 import (
 	"context"
 	"encoding/gob"
+	"fmt"
 	"html/template"
 	"io/fs"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/memstore"
 	"github.com/gin-gonic/gin"
 	wgportal "github.com/h44z/wg-portal"
 	ldapprovider "github.com/h44z/wg-portal/internal/authentication/providers/ldap"
 	passwordprovider "github.com/h44z/wg-portal/internal/authentication/providers/password"
 	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/i18n"
+	"github.com/h44z/wg-portal/internal/oidc"
 	"github.com/h44z/wg-portal/internal/users"
 	"github.com/h44z/wg-portal/internal/wireguard"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	ginlogrus "github.com/toorop/gin-logrus"
+	"google.golang.org/grpc"
 	"gorm.io/gorm"
 )
 
@@ -37,6 +42,7 @@ func init() {
 	gob.Register(wireguard.Peer{})
 	gob.Register(wireguard.Device{})
 	gob.Register(LdapCreateForm{})
+	gob.Register(RegistrationForm{})
 	gob.Register(users.User{})
 }
 
@@ -47,14 +53,19 @@ type SessionData struct {
 	Lastname   string
 	Email      string
 	DeviceName string
+	Theme      users.Theme
+	Language   string // selected language, empty if the language is negotiated
+
+	ImpersonatedBy string // email of the administrator that impersonates the user, empty for regular sessions
 
 	SortedBy      map[string]string
 	SortDirection map[string]string
 	Search        map[string]string
 
-	AlertData string
-	AlertType string
-	FormData  interface{}
+	AlertData     string
+	AlertType     string
+	FormData      interface{}
+	PendingChange *PendingChange // the previewed edit of FormData that waits for confirmation
 }
 
 type FlashData struct {
@@ -69,19 +80,44 @@ type StaticData struct {
 	CompanyName  string
 	Year         int
 	Version      string
+	CustomCSS    template.CSS // the primary color and the custom CSS of the branding
 }
 
 type Server struct {
-	ctx     context.Context
-	config  *Config
-	server  *gin.Engine
-	mailTpl *template.Template
-	auth    *AuthManager
-
-	db    *gorm.DB
-	users *users.Manager
-	wg    *wireguard.Manager
-	peers *wireguard.PeerManager
+	ctx            context.Context
+	config         *Config
+	server         *gin.Engine
+	basePath       string       // path of the external url, all routes are registered below it
+	trustedProxies []*net.IPNet // reverse proxies whose X-Forwarded-For header is used for the client address
+	mailTpl        *template.Template
+	mailTxtTpl     *texttemplate.Template
+	mailer         *Mailer
+	webhooks       *common.WebhookDispatcher
+	audit          *common.AuditLog
+	translations   *i18n.Catalog
+	auth           *AuthManager
+	oidc           *oidc.Verifier // nil if no OIDC providers are configured for the API
+
+	db           *gorm.DB
+	keyCipher    *wireguard.KeyCipher // nil if the keys are not encrypted
+	users        *users.Manager
+	userValidity *userValidityCache // whether the users of the sessions are still valid
+	wg           *wireguard.Manager
+	peers        *wireguard.PeerManager
+	stats        *wireguard.StatisticsCollector
+
+	branding *brandingCache
+
+	deviceHealth   *deviceHealthCache  // result of the interface check of the readiness endpoint
+	endpointChecks *endpointCheckCache // results of the DNS check of host name endpoints
+
+	startupRestore map[string]InterfaceRestoreResult // results of the startup restore by interface name
+
+	bulkJobs            *bulkPeerJobs
+	downloadLinkLimiter *ipRateLimiter
+	registrationLimiter *ipRateLimiter
+	loginGuard          *loginGuard
+	enrollmentMux       *sync.Mutex // serializes enrollments, so retries cannot create duplicate peers
 }
 
 func (s *Server) Setup(ctx context.Context) error {
@@ -97,72 +133,50 @@ func (s *Server) Setup(ctx context.Context) error {
 
 	s.config = NewConfig()
 	s.ctx = ctx
+	if externalUrl, err := url.Parse(s.config.Core.ExternalUrl); err == nil {
+		s.basePath = strings.TrimRight(externalUrl.Path, "/")
+	}
+	s.bulkJobs = &bulkPeerJobs{results: make(map[string]*BulkPeerResult)}
+	s.enrollmentMux = &sync.Mutex{}
+	s.endpointChecks = &endpointCheckCache{results: make(map[string]EndpointCheckResult)}
+	s.downloadLinkLimiter = newIPRateLimiter(downloadLinkRateLimit, downloadLinkRateWindow)
+	s.registrationLimiter = newIPRateLimiter(registrationRateLimit, registrationRateWindow)
+	s.loginGuard = newLoginGuard(s.config.Core.LoginLockoutAttempts, s.config.Core.LoginLockoutDuration,
+		s.config.Core.LoginFailureHistory)
+	s.webhooks = common.NewWebhookDispatcher(ctx, s.config.Webhook)
 
 	// Setup database connection
 	s.db, err = common.GetDatabaseForConfig(&s.config.Database)
 	if err != nil {
 		return errors.WithMessage(err, "database setup failed")
 	}
-	err = common.MigrateDatabase(s.db, DatabaseVersion)
+	_, err = common.MigrateDatabase(s.db)
 	if err != nil {
 		return errors.WithMessage(err, "database migration failed")
 	}
+	if err = s.setupKeyEncryption(); err != nil {
+		return errors.WithMessage(err, "key encryption setup failed")
+	}
+	if err = s.checkBackupConfig(); err != nil {
+		return errors.WithMessage(err, "invalid backup configuration")
+	}
 
 	// Setup http server
-	gin.SetMode(gin.DebugMode)
-	gin.DefaultWriter = ioutil.Discard
-	s.server = gin.New()
-	if logrus.GetLevel() == logrus.TraceLevel {
-		s.server.Use(ginlogrus.Logger(logrus.StandardLogger()))
+	if err = s.setupWebServer(); err != nil {
+		return err
 	}
-	s.server.Use(gin.Recovery())
-
-	// Authentication cookies
-	cookieStore := memstore.NewStore([]byte(s.config.Core.SessionSecret))
-	cookieStore.Options(sessions.Options{
-		Path:     "/",
-		MaxAge:   86400, // auth session is valid for 1 day
-		Secure:   strings.HasPrefix(s.config.Core.ExternalUrl, "https"),
-		HttpOnly: true,
-	})
-	s.server.Use(sessions.Sessions("authsession", cookieStore))
-	s.server.SetFuncMap(template.FuncMap{
-		"formatBytes": common.ByteCountSI,
-		"urlEncode":   url.QueryEscape,
-		"startsWith":  strings.HasPrefix,
-		"userForEmail": func(users []users.User, email string) *users.User {
-			for i := range users {
-				if users[i].Email == email {
-					return &users[i]
-				}
-			}
-			return nil
-		},
-	})
-
-	// Setup templates
-	templates := template.Must(template.New("").Funcs(s.server.FuncMap).ParseFS(wgportal.Templates, "assets/tpl/*.html"))
-	s.server.SetHTMLTemplate(templates)
-
-	// Serve static files
-	s.server.StaticFS("/css", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/css"))))
-	s.server.StaticFS("/js", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/js"))))
-	s.server.StaticFS("/img", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/img"))))
-	s.server.StaticFS("/fonts", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/fonts"))))
-
-	// Setup all routes
-	SetupRoutes(s)
-	SetupApiRoutes(s)
 
 	// Setup user database (also needed for database authentication)
 	s.users, err = users.NewManager(s.db)
 	if err != nil {
 		return errors.WithMessage(err, "user-manager initialization failed")
 	}
+	s.userValidity = newUserValidityCache(s.config.Core.UserCacheTTL, userValidityCacheSize, s.users.GetUser)
+	s.users.OnChange = s.userValidity.Invalidate
 
 	// Setup auth manager
 	s.auth = NewAuthManager(s)
-	pwProvider, err := passwordprovider.New(&s.config.Database)
+	pwProvider, err := passwordprovider.New(&s.config.Database, s.config.Password)
 	if err != nil {
 		return errors.WithMessage(err, "password provider initialization failed")
 	}
@@ -180,39 +194,255 @@ func (s *Server) Setup(ctx context.Context) error {
 		s.auth.RegisterProviderWithoutError(ldapProvider, err)
 	}
 
+	// Setup validation of OIDC access tokens for the API
+	if len(s.config.OIDC.Providers) > 0 {
+		if err := s.config.OIDC.Validate(); err != nil {
+			return errors.WithMessage(err, "invalid oidc configuration")
+		}
+		s.oidc = oidc.NewVerifier(s.config.OIDC)
+	}
+
 	// Setup WireGuard stuff
 	s.wg = &wireguard.Manager{Cfg: &s.config.WG}
 	if err = s.wg.Init(); err != nil {
 		return errors.WithMessage(err, "unable to initialize WireGuard manager")
 	}
 
+	if s.config.WG.ExecuteHooks {
+		logrus.Warnf("WG_EXECUTE_HOOKS is enabled, the PreUp, PostUp, PreDown and PostDown hooks of the interfaces " +
+			"run as shell commands with the privileges of the portal")
+	}
+	if s.config.WG.ManageInterfaces {
+		s.wg.OnUserspaceRestart = s.restoreRestartedInterface
+	}
+	// Create missing WireGuard interfaces, the peer manager imports the existing ones
+	s.startupRestore = make(map[string]InterfaceRestoreResult)
+	if s.config.WG.RestoreOnStartup {
+		s.createMissingInterfaces()
+	}
+
+	for _, deviceName := range s.wg.Cfg.DeviceNames {
+		if dev, err := s.wg.GetDeviceInfo(deviceName); err == nil {
+			logrus.Infof("WireGuard interface %s uses the %s implementation", deviceName, dev.Type)
+		}
+	}
+
 	// Setup peer manager
 	if s.peers, err = wireguard.NewPeerManager(s.db, s.wg); err != nil {
 		return errors.WithMessage(err, "unable to setup peer manager")
 	}
 
+	s.wg.OnHostReconnect = s.restoreReconnectedInterface
+	if s.config.WG.RestoreOnStartup {
+		s.restoreInterfaces()
+	}
 	for _, deviceName := range s.wg.Cfg.DeviceNames {
-		if err = s.RestoreWireGuardInterface(deviceName); err != nil {
-			return errors.WithMessagef(err, "unable to restore WireGuard state for %s", deviceName)
+		if warning, err := s.validateDeviceEndpoint(s.peers.GetDevice(deviceName)); err != nil {
+			logrus.Warnf("peer endpoint of %s: %v", deviceName, err)
+		} else if warning != "" {
+			logrus.Warnf("peer endpoint of %s: %s", deviceName, warning)
 		}
 	}
 
-	// Setup mail template
-	s.mailTpl, err = template.New("email.html").ParseFS(wgportal.Templates, "assets/tpl/email.html")
+	s.CreateConfiguredAllowedIPsPresets()
+
+	if s.stats, err = wireguard.NewStatisticsCollector(s.db, s.wg); err != nil {
+		return errors.WithMessage(err, "unable to setup statistics collector")
+	}
+	if s.audit, err = common.NewAuditLog(s.db); err != nil {
+		return errors.WithMessage(err, "unable to setup audit log")
+	}
+	if err = s.loadBranding(); err != nil {
+		return errors.WithMessage(err, "unable to setup branding")
+	}
+
+	// Setup mail templates
+	if s.config.Core.MailTemplateHtml != "" {
+		s.mailTpl, err = template.ParseFiles(s.config.Core.MailTemplateHtml)
+	} else {
+		s.mailTpl, err = template.New("email.html").ParseFS(wgportal.Templates, "assets/tpl/email.html")
+	}
 	if err != nil {
 		return errors.Wrap(err, "unable to pare mail template")
 	}
+	if s.config.Core.MailTemplateText != "" {
+		s.mailTxtTpl, err = texttemplate.ParseFiles(s.config.Core.MailTemplateText)
+	} else {
+		s.mailTxtTpl, err = texttemplate.New("email.txt").ParseFS(wgportal.Templates, "assets/tpl/email.txt")
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to parse plain text mail template")
+	}
+	s.mailer = NewMailer(s)
 
 	logrus.Infof("setup of service completed!")
 	return nil
 }
 
+// setupWebServer creates the http handler of the portal with the session store, the templates and all routes.
+func (s *Server) setupWebServer() error {
+	gin.SetMode(gin.DebugMode)
+	gin.DefaultWriter = ioutil.Discard
+	s.server = gin.New()
+	// gin trusts the X-Forwarded-For header of every client, the portal uses clientIP instead
+	s.server.ForwardedByClientIP = false
+	s.server.TrustedProxies = nil
+	trustedProxies, err := parseTrustedProxies(s.config.Core.TrustedProxies)
+	if err != nil {
+		return errors.WithMessage(err, "invalid trusted proxies")
+	}
+	s.trustedProxies = trustedProxies
+	requestLogger, err := s.requestLogger()
+	if err != nil {
+		return errors.WithMessage(err, "unable to setup request log")
+	}
+	s.server.Use(requestLogger)
+	s.server.Use(gin.Recovery())
+	s.setupHealthRoutes()
+
+	// Authentication cookies
+	sessionStore, err := s.newSessionStore()
+	if err != nil {
+		return errors.WithMessage(err, "unable to setup session store")
+	}
+	s.server.Use(sessions.Sessions(sessionCookieName, sessionStore))
+
+	// Translations, the language is selected per request
+	s.translations, err = s.loadTranslations()
+	if err != nil {
+		return errors.WithMessage(err, "unable to load translations")
+	}
+	if !s.translations.Has(s.config.Core.DefaultLanguage) {
+		logrus.Warnf("default language %s is not available, using %s", s.config.Core.DefaultLanguage, i18n.SourceLanguage)
+	}
+	s.server.Use(s.languageMiddleware)
+	s.server.SetFuncMap(template.FuncMap{
+		"formatBytes": common.ByteCountSI,
+		"urlEncode":   url.QueryEscape,
+		"startsWith":  strings.HasPrefix,
+		"lower":       strings.ToLower,
+		"csrfField":   csrfField,
+		"basePath": func() string {
+			return s.basePath
+		},
+		"add": func(a, b int) int {
+			return a + b
+		},
+		// t and language are replaced per language, see newLocalizedHTMLRender
+		"t": func(msg string, args ...interface{}) string {
+			return s.translations.Translate(i18n.SourceLanguage, msg, args...)
+		},
+		"language": func() string {
+			return i18n.SourceLanguage
+		},
+		"languages": func() []i18n.Language {
+			return s.translations.Languages()
+		},
+		"userForEmail": func(users []users.User, email string) *users.User {
+			for i := range users {
+				if users[i].Email == email {
+					return &users[i]
+				}
+			}
+			return nil
+		},
+	})
+
+	// Setup templates
+	templates := template.Must(template.New("").Funcs(s.server.FuncMap).ParseFS(wgportal.Templates, "assets/tpl/*.html"))
+	if s.server.HTMLRender, err = s.newLocalizedHTMLRender(templates); err != nil {
+		return errors.WithMessage(err, "unable to setup templates")
+	}
+
+	// Serve static files
+	root := s.server.Group(s.basePath)
+	root.StaticFS("/css", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/css"))))
+	root.StaticFS("/js", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/js"))))
+	root.StaticFS("/img", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/img"))))
+	root.StaticFS("/fonts", http.FS(fsMust(fs.Sub(wgportal.Statics, "assets/fonts"))))
+
+	// Setup all routes
+	SetupRoutes(s)
+	SetupApiRoutes(s)
+
+	return nil
+}
+
+// setupKeyEncryption wraps the database handle, so that the private and preshared keys are encrypted with the master
+// key. Stored keys that cannot be decrypted, e.g. because the master key is missing, are a fatal error.
+func (s *Server) setupKeyEncryption() error {
+	keyCipher, err := wireguard.LoadKeyCipher(s.config.WG)
+	if err != nil {
+		return err
+	}
+	stored, err := wireguard.CountStoredKeys(s.db, keyCipher)
+	if err != nil {
+		return err
+	}
+	if err = stored.Check(); err != nil {
+		return err
+	}
+	if keyCipher != nil && stored.Plaintext > 0 {
+		logrus.Warnf("%d private and preshared keys are stored in plaintext, run \"wg-portal encrypt-keys\" to "+
+			"encrypt them", stored.Plaintext)
+	}
+
+	s.keyCipher = keyCipher
+	s.db = wireguard.WithKeyCipher(s.db, keyCipher)
+	return nil
+}
+
+// Run starts the background workers and the web service. It blocks until the context of the server is cancelled and
+// the shutdown has completed, see shutdown.
 func (s *Server) Run() {
+	startedAt := time.Now()
 	logrus.Infof("starting web service on %s", s.config.Core.ListeningAddress)
 
+	var workers sync.WaitGroup
+	startWorker := func(worker func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker()
+		}()
+	}
+
 	// Start ldap sync
 	if s.config.Core.LdapEnabled {
-		go s.SyncLdapWithUserDatabase()
+		startWorker(s.SyncLdapWithUserDatabase)
+	}
+
+	// Start mail queue
+	startWorker(func() { s.mailer.Run(s.ctx) })
+
+	// Start inactivity check
+	startWorker(func() { s.RunInactivityCheck(s.ctx) })
+
+	// Start guest peer cleanup
+	startWorker(func() { s.RunGuestPeerCleanup(s.ctx) })
+
+	// Start connectivity checks of the remote hosts
+	startWorker(func() { s.wg.RunHostChecks(s.ctx) })
+
+	// Start DNS check of host name endpoints
+	if s.config.WG.EndpointCheckInterval > 0 {
+		startWorker(func() { s.RunEndpointChecks(s.ctx) })
+	}
+
+	// Start statistics collector
+	if s.config.WG.StatisticsInterval > 0 {
+		startWorker(func() { s.stats.Run(s.ctx) })
+	}
+
+	// Start scheduled backups
+	if s.config.Core.BackupDirectory != "" {
+		startWorker(func() { s.RunScheduledBackups(s.ctx) })
+	}
+
+	// Start InfluxDB exporter
+	if s.config.Influx.Url != "" {
+		exporter := wireguard.NewInfluxExporter(s.config.Influx, s.wg)
+		startWorker(func() { exporter.Run(s.ctx) })
 	}
 
 	// Run web service
@@ -227,14 +457,70 @@ func (s *Server) Run() {
 		}
 	}()
 
+	// Run gRPC service
+	grpcSrv, err := s.runGrpcServer()
+	if err != nil {
+		logrus.Errorf("failed to start gRPC service: %v", err)
+	}
+
 	<-s.ctx.Done()
 
+	s.shutdown(srv, grpcSrv, &workers, startedAt)
+}
+
+// shutdown stops accepting new connections and waits for in-flight requests, so all session changes of these
+// requests are saved. Afterwards the background workers are awaited and the database is closed. Managed interfaces
+// are only brought down if Core.TeardownOnShutdown is set, otherwise the tunnels keep working without the portal.
+func (s *Server) shutdown(srv *http.Server, grpcSrv *grpc.Server, workers *sync.WaitGroup, startedAt time.Time) {
 	logrus.Debug("web service shutting down...")
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.Core.ShutdownTimeout)
 	defer cancel()
-	_ = srv.Shutdown(shutdownCtx)
+	requests := "all in-flight requests completed"
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		requests = fmt.Sprintf("in-flight requests aborted after %s", s.config.Core.ShutdownTimeout)
+		_ = srv.Close()
+	}
+	stopGrpcServer(grpcSrv, s.config.Core.ShutdownTimeout)
 
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	backgroundWorkers := "background workers stopped"
+	select {
+	case <-workersDone:
+	case <-time.After(s.config.Core.ShutdownTimeout):
+		backgroundWorkers = "background workers still running"
+	}
+
+	interfaces := "interfaces kept up"
+	if s.config.Core.TeardownOnShutdown {
+		down := 0
+		for _, deviceName := range s.wg.Cfg.DeviceNames {
+			if err := s.linkDown(s.peers.GetDevice(deviceName)); err != nil {
+				logrus.Errorf("failed to bring down interface %s: %v", deviceName, err)
+				continue
+			}
+			if s.config.WG.ManageFirewall {
+				if err := s.wg.RemoveMasqueradeRules(deviceName); err != nil {
+					logrus.Errorf("failed to remove firewall rules of interface %s: %v", deviceName, err)
+				}
+			}
+			down++
+		}
+		interfaces = fmt.Sprintf("%d of %d interfaces brought down", down, len(s.wg.Cfg.DeviceNames))
+	}
+
+	if sqlDB, err := s.db.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			logrus.Errorf("failed to close database: %v", err)
+		}
+	}
+
+	logrus.Infof("web service stopped after %s: %s, %s, %s", time.Since(startedAt).Round(time.Second), requests,
+		backgroundWorkers, interfaces)
 }
 
 func (s *Server) getExecutableDirectory() string {
@@ -250,13 +536,29 @@ func (s *Server) getExecutableDirectory() string {
 	return dir
 }
 
+// urlPath returns the path of the given portal page below the path of the external url, e.g. /vpn/admin for /admin
+// if the portal is hosted at https://host/vpn.
+func (s *Server) urlPath(page string) string {
+	return s.basePath + page
+}
+
 func (s *Server) getStaticData() StaticData {
+	logoUrl := s.config.Core.LogoUrl
+	if strings.HasPrefix(logoUrl, "/") && !strings.HasPrefix(logoUrl, "//") { // served by the portal
+		logoUrl = s.urlPath(logoUrl)
+	}
+	branding := s.branding.get()
+	if branding.LogoType != "" {
+		logoUrl = s.brandingLogoUrl(branding)
+	}
+
 	return StaticData{
 		WebsiteTitle: s.config.Core.Title,
-		WebsiteLogo:  s.config.Core.LogoUrl,
+		WebsiteLogo:  logoUrl,
 		CompanyName:  s.config.Core.CompanyName,
 		Year:         time.Now().Year(),
 		Version:      Version,
+		CustomCSS:    brandingCSS(branding),
 	}
 }
 
@@ -315,6 +617,17 @@ func UpdateSessionData(c *gin.Context, data SessionData) error {
 
 func DestroySessionData(c *gin.Context) error {
 	session := sessions.Default(c)
+	session.Clear()
+	session.Delete(SessionIdentifier) // marks the session as changed, also if it was empty
+	// overwrite the server-side entry first, the memory store does not remove it when the cookie expires
+	if err := session.Save(); err != nil {
+		logrus.Errorf("failed to destroy session: %v", err)
+		return errors.Wrap(err, "failed to destroy session")
+	}
+	// expire the cookie, the redis store also removes its entry
+	options := sessionOptions
+	options.MaxAge = -1
+	session.Options(options)
 	session.Delete(SessionIdentifier)
 	if err := session.Save(); err != nil {
 		logrus.Errorf("failed to destroy session: %v", err)
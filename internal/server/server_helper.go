@@ -4,20 +4,26 @@ import (
 	"crypto/md5"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"os"
 	"path"
-	"syscall"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/h44z/wg-portal/internal/common"
 	"github.com/h44z/wg-portal/internal/users"
 	"github.com/h44z/wg-portal/internal/wireguard"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"gorm.io/gorm"
 )
 
-// PrepareNewPeer initiates a new peer for the given WireGuard device.
+const configPostWriteTimeout = 30 * time.Second // timeout of WG_CONFIG_POST_WRITE_CMD
+
+// PrepareNewPeer initiates a new peer for the given WireGuard device. In server mode, the peer gets the defaults of the
+// interface, including the allowed IPs preset and the guest lifetime of new peers.
 func (s *Server) PrepareNewPeer(device string) (wireguard.Peer, error) {
 	dev := s.peers.GetDevice(device)
 	deviceIPs := dev.GetIPAddresses()
@@ -36,22 +42,36 @@ func (s *Server) PrepareNewPeer(device string) (wireguard.Peer, error) {
 			peerIPs[i] = freeIP
 		}
 		peer.SetIPAddresses(peerIPs...)
-		psk, err := wgtypes.GenerateKey()
-		if err != nil {
-			return wireguard.Peer{}, errors.Wrap(err, "failed to generate key")
+		if dev.GeneratePresharedKeys {
+			psk, err := wgtypes.GenerateKey()
+			if err != nil {
+				return wireguard.Peer{}, errors.Wrap(err, "failed to generate key")
+			}
+			peer.PresharedKey = psk.String()
 		}
 		key, err := wgtypes.GeneratePrivateKey()
 		if err != nil {
 			return wireguard.Peer{}, errors.Wrap(err, "failed to generate private key")
 		}
-		peer.PresharedKey = psk.String()
 		peer.PrivateKey = key.String()
 		peer.PublicKey = key.PublicKey().String()
 		peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(peer.PublicKey)))
-		peer.Endpoint = dev.DefaultEndpoint
+		peer.Endpoint = dev.ResolvedEndpoint
 		peer.DNSStr = dev.DNSStr
 		peer.PersistentKeepalive = dev.DefaultPersistentKeepalive
 		peer.AllowedIPsStr = dev.DefaultAllowedIPsStr
+		if preset, ok := s.defaultAllowedIPsPreset(dev); ok {
+			peer.AllowedIPsPresetID = preset.ID
+			peer.AllowedIPsStr = preset.AllowedIPsStr
+		}
+		if dev.DefaultGuestDays > 0 {
+			expiresAt := time.Now().AddDate(0, 0, dev.DefaultGuestDays)
+			peer.ExpiresAt = &expiresAt
+		}
+		if peer.PersistentKeepalive == 0 && peer.RoutesAllTraffic() {
+			peer.PersistentKeepalive = wireguard.DefaultRoamingKeepalive // keep the NAT mapping of roaming clients alive
+			peer.OverrideKeepalive = true
+		}
 		peer.Mtu = dev.Mtu
 		peer.DeviceName = device
 	case wireguard.DeviceTypeClient:
@@ -83,19 +103,96 @@ func (s *Server) CreatePeerByEmail(device, email, identifierSuffix string, disab
 	return s.CreatePeer(device, peer)
 }
 
+// QuotaExceededError is returned if a peer cannot be created because a peer limit has been reached.
+type QuotaExceededError struct {
+	Scope string // interface or user
+	Name  string // the interface name or the email address of the user
+	Limit int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("the %s %s already has the maximum number of %d peers", e.Scope, e.Name, e.Limit)
+}
+
+// checkPeerQuota returns a QuotaExceededError if no further peer can be created on the device for the given email.
+func (s *Server) checkPeerQuota(dev wireguard.Device, email string) error {
+	if dev.MaxPeers > 0 && s.peers.CountPeers(dev.DeviceName) >= int64(dev.MaxPeers) {
+		return &QuotaExceededError{Scope: "interface", Name: dev.DeviceName, Limit: dev.MaxPeers}
+	}
+
+	maxUserPeers := s.config.Core.MaxPeersPerUser
+	if maxUserPeers > 0 && email != "" && email != wireguard.AutodetectedPeerEmail &&
+		s.peers.CountPeersByMail(email) >= int64(maxUserPeers) {
+		return &QuotaExceededError{Scope: "user", Name: email, Limit: maxUserPeers}
+	}
+
+	return nil
+}
+
 // CreatePeer creates the new peer in the database. If the peer has no assigned ip addresses, a new one will be assigned
 // automatically. Also, if the private key is empty, a new key-pair will be generated.
 // This function also configures the new peer on the physical WireGuard interface if the peer is not deactivated.
+// A QuotaExceededError is returned if the peer limit of the interface or the user has been reached.
 func (s *Server) CreatePeer(device string, peer wireguard.Peer) error {
+	return s.createPeer(device, peer, false)
+}
+
+// CreatePeerIgnoringQuota works like CreatePeer, but does not enforce the peer limits. Only use it for actions that
+// were explicitly requested by an administrator.
+func (s *Server) CreatePeerIgnoringQuota(device string, peer wireguard.Peer) error {
+	return s.createPeer(device, peer, true)
+}
+
+func (s *Server) createPeer(device string, peer wireguard.Peer, ignoreQuota bool) error {
 	dev := s.peers.GetDevice(device)
+	if err := s.prepareNewPeerCreation(dev, &peer, ignoreQuota); err != nil {
+		return err
+	}
+
+	// Create WireGuard interface
+	if peer.DeactivatedAt == nil {
+		if err := s.wg.AddPeer(device, peer.GetConfig(&dev)); err != nil {
+			return errors.WithMessage(err, "failed to add WireGuard peer")
+		}
+	}
+
+	// Create in database
+	if err := s.peers.CreatePeer(peer); err != nil {
+		return errors.WithMessage(err, "failed to create peer")
+	}
+
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerCreated, Interface: device,
+		PeerKey: peer.PublicKey, Actor: peer.CreatedBy})
+	s.syncDeviceRoutes(device)
+
+	return s.WriteWireGuardConfigFile(device)
+}
+
+// prepareNewPeerCreation validates a new peer of the device and fills in the addresses, allowed IPs and keys that
+// are still missing. Neither the database nor the physical interface are changed.
+func (s *Server) prepareNewPeerCreation(dev wireguard.Device, peer *wireguard.Peer, ignoreQuota bool) error {
+	if err := s.checkPeerIdentifier(*peer); err != nil {
+		return err
+	}
+	if !ignoreQuota {
+		if err := s.checkPeerQuota(dev, peer.Email); err != nil {
+			return err
+		}
+	}
 	deviceIPs := dev.GetIPAddresses()
 	peerIPs := peer.GetIPAddresses()
 
-	peer.AllowedIPsStr = dev.DefaultAllowedIPsStr
+	if peer.AllowedIPsStr == "" {
+		peer.AllowedIPsStr = dev.DefaultAllowedIPsStr
+	}
+	peer.DeviceName = dev.DeviceName
+	if err := s.prepareAllowedIPs(peer); err != nil {
+		return err
+	}
 	if len(peerIPs) == 0 && dev.Type == wireguard.DeviceTypeServer {
 		peerIPs = make([]string, len(deviceIPs))
 		for i := range deviceIPs {
-			freeIP, err := s.peers.GetAvailableIp(device, deviceIPs[i])
+			freeIP, err := s.peers.GetAvailableIp(dev.DeviceName, deviceIPs[i])
 			if err != nil {
 				return errors.WithMessage(err, "failed to get available IP addresses")
 			}
@@ -103,7 +200,13 @@ func (s *Server) CreatePeer(device string, peer wireguard.Peer) error {
 		}
 		peer.SetIPAddresses(peerIPs...)
 	}
-	if peer.PresharedKey == "" && dev.Type == wireguard.DeviceTypeServer { // if preshared key is empty create a new one
+	if err := s.applyIPReservations(dev, peer); err != nil {
+		return err
+	}
+	if err := s.validatePeerNetworks(dev, *peer); err != nil {
+		return err
+	}
+	if peer.PresharedKey == "" && dev.Type == wireguard.DeviceTypeServer && dev.GeneratePresharedKeys { // if preshared key is empty create a new one
 
 		psk, err := wgtypes.GenerateKey()
 		if err != nil {
@@ -112,7 +215,7 @@ func (s *Server) CreatePeer(device string, peer wireguard.Peer) error {
 		peer.PresharedKey = psk.String()
 	}
 
-	if peer.PrivateKey == "" &&  peer.PublicKey == "" && dev.Type == wireguard.DeviceTypeServer { // if private key is empty create a new one
+	if peer.PrivateKey == "" && peer.PublicKey == "" && dev.Type == wireguard.DeviceTypeServer { // if private key is empty create a new one
 
 		key, err := wgtypes.GeneratePrivateKey()
 		if err != nil {
@@ -121,28 +224,105 @@ func (s *Server) CreatePeer(device string, peer wireguard.Peer) error {
 		peer.PrivateKey = key.String()
 		peer.PublicKey = key.PublicKey().String()
 	}
-	peer.DeviceName = dev.DeviceName
+	if peer.PrivateKey == "" { // public key only peer, the private key was generated on the client
+		key, err := wireguard.ParsePublicKey(peer.PublicKey)
+		if err != nil {
+			return err
+		}
+		peer.PublicKey = key.String()
+	}
 	peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(peer.PublicKey)))
 
-	// Create WireGuard interface
-	if peer.DeactivatedAt == nil {
-		if err := s.wg.AddPeer(device, peer.GetConfig(&dev)); err != nil {
-			return errors.WithMessage(err, "failed to add WireGuard peer")
+	return nil
+}
+
+// setClientPublicKey replaces the key pair of a new peer with the public key that was generated on the client. The
+// peer becomes a public key only peer, the portal never learns its private key.
+func (s *Server) setClientPublicKey(peer *wireguard.Peer, publicKey string) error {
+	key, err := wireguard.ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if s.peers.GetPeerByKey(key.String()).IsValid() {
+		return errors.New("the public key is already in use")
+	}
+	peer.PublicKey = key.String()
+	peer.PrivateKey = ""
+
+	return nil
+}
+
+// checkPeerIdentifier ensures that the identifier of the peer is unique among the peers of the same user on the
+// same interface.
+func (s *Server) checkPeerIdentifier(peer wireguard.Peer) error {
+	if !peer.HasEmail() {
+		return nil // imported peers share the same placeholder address
+	}
+	if s.peers.IdentifierExistsForMail(peer.DeviceName, peer.Email, peer.Identifier, peer.PublicKey) {
+		return errors.Errorf("a peer named %s already exists for %s", peer.Identifier, peer.Email)
+	}
+	return nil
+}
+
+// prepareAllowedIPs copies the allowed IPs of the referenced preset to the peer, or normalizes the custom networks.
+// The server side allowed IPs are always derived from the peer addresses and are not affected by presets, networks
+// that are already covered by the peer addresses are removed.
+func (s *Server) prepareAllowedIPs(peer *wireguard.Peer) error {
+	var err error
+	if peer.AllowedIPsSrvStr, err = common.NormalizeCIDRList(peer.AllowedIPsSrvStr); err != nil {
+		return errors.WithMessage(err, "invalid server side allowed IPs")
+	}
+	removeCoveredNetworks(peer)
+
+	if peer.AllowedIPsPresetID == 0 {
+		if peer.AllowedIPsStr, err = common.NormalizeCIDRList(peer.AllowedIPsStr); err != nil {
+			return errors.WithMessage(err, "invalid allowed IPs")
 		}
+		return nil
 	}
 
-	// Create in database
-	if err := s.peers.CreatePeer(peer); err != nil {
-		return errors.WithMessage(err, "failed to create peer")
+	preset, err := s.peers.GetAllowedIPsPreset(peer.AllowedIPsPresetID)
+	if err != nil {
+		return err
+	}
+	if preset.DeviceName != peer.DeviceName {
+		return errors.Errorf("allowed IPs preset %s does not belong to interface %s", preset.Name, peer.DeviceName)
 	}
+	peer.AllowedIPsStr = preset.AllowedIPsStr
+	return nil
+}
 
-	return s.WriteWireGuardConfigFile(device)
+// preparePeerUpdate validates the updated peer and takes its allowed IPs from the preset, see UpdatePeer.
+func (s *Server) preparePeerUpdate(currentPeer wireguard.Peer, dev wireguard.Device, peer *wireguard.Peer) error {
+	if peer.Identifier != currentPeer.Identifier || peer.Email != currentPeer.Email {
+		if err := s.checkPeerIdentifier(*peer); err != nil {
+			return err
+		}
+	}
+	if err := s.prepareAllowedIPs(peer); err != nil {
+		return err
+	}
+	if peer.IPsStr != currentPeer.IPsStr || peer.AllowedIPsSrvStr != currentPeer.AllowedIPsSrvStr {
+		// unchanged networks are not checked again, peers created before the validation keep working
+		if err := s.validatePeerNetworks(dev, *peer); err != nil {
+			return err
+		}
+	}
+	if peer.IPsStr != currentPeer.IPsStr || peer.Identifier != currentPeer.Identifier || peer.Email != currentPeer.Email {
+		if err := s.checkIPReservations(dev, *peer); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // UpdatePeer updates the physical WireGuard interface and the database.
 func (s *Server) UpdatePeer(peer wireguard.Peer, updateTime time.Time) error {
 	currentPeer := s.peers.GetPeerByKey(peer.PublicKey)
 	dev := s.peers.GetDevice(peer.DeviceName)
+	if err := s.preparePeerUpdate(currentPeer, dev, &peer); err != nil {
+		return err
+	}
 
 	// Update WireGuard device
 	var err error
@@ -159,16 +339,125 @@ func (s *Server) UpdatePeer(peer wireguard.Peer, updateTime time.Time) error {
 	}
 
 	peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(peer.PublicKey)))
+	if peer.DeactivatedAt == nil {
+		peer.DeactivationReason = wireguard.DeactivationReasonManual
+		if currentPeer.DeactivatedAt != nil {
+			peer.ReactivatedAt = &updateTime
+		}
+	}
 
 	// Update in database
 	if err := s.peers.UpdatePeer(peer); err != nil {
 		return errors.WithMessage(err, "failed to update peer")
 	}
 
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerUpdated, Interface: peer.DeviceName,
+		PeerKey: peer.PublicKey, Actor: peer.UpdatedBy})
+	s.syncDeviceRoutes(peer.DeviceName)
+
+	return s.WriteWireGuardConfigFile(peer.DeviceName)
+}
+
+// SetPeerPresharedKey generates a new preshared key for the peer, or removes the preshared key if generate is false.
+// The physical WireGuard interface is updated first, if the database update fails, the old key is restored.
+func (s *Server) SetPeerPresharedKey(peer wireguard.Peer, generate bool) error {
+	dev := s.peers.GetDevice(peer.DeviceName)
+	oldPresharedKey := peer.PresharedKey
+
+	peer.PresharedKey = ""
+	if generate {
+		psk, err := wgtypes.GenerateKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate key")
+		}
+		peer.PresharedKey = psk.String()
+	}
+
+	active := peer.DeactivatedAt == nil
+	if active {
+		if err := s.wg.UpdatePeer(peer.DeviceName, peer.GetConfig(&dev)); err != nil {
+			return errors.WithMessage(err, "failed to update WireGuard peer")
+		}
+	}
+
+	if err := s.peers.UpdatePeer(peer); err != nil {
+		if active {
+			peer.PresharedKey = oldPresharedKey
+			if rollbackErr := s.wg.UpdatePeer(peer.DeviceName, peer.GetConfig(&dev)); rollbackErr != nil {
+				logrus.Errorf("failed to restore preshared key of peer %s: %v", peer.PublicKey, rollbackErr)
+			}
+		}
+		return errors.WithMessage(err, "failed to update peer")
+	}
+
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerUpdated, Interface: peer.DeviceName,
+		PeerKey: peer.PublicKey, Actor: peer.UpdatedBy})
+
 	return s.WriteWireGuardConfigFile(peer.DeviceName)
 }
 
 // DeletePeer removes the peer from the physical WireGuard interface and the database.
+// The UpdatedBy field of the peer is used as the actor of the deletion.
+// RotatePeerKeys replaces the keypair (and the preshared key, if one is used) of a peer of a server mode interface,
+// the ip addresses and all other settings are kept. The old public key is removed from the physical interface in the
+// same step as the new one is added. If the database update fails, the physical interface is restored.
+func (s *Server) RotatePeerKeys(peer wireguard.Peer) (wireguard.Peer, error) {
+	dev := s.peers.GetDevice(peer.DeviceName)
+	if dev.Type != wireguard.DeviceTypeServer {
+		return wireguard.Peer{}, errors.New("keys can only be rotated for peers of server mode interfaces")
+	}
+
+	if peer.PrivateKey == "" {
+		return wireguard.Peer{}, errors.New("the private key of the peer was generated on the client, generate a new " +
+			"key pair there and update the public key of the peer")
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wireguard.Peer{}, errors.Wrap(err, "failed to generate private key")
+	}
+	now := time.Now()
+	rotated := peer
+	rotated.PrivateKey = key.String()
+	rotated.PublicKey = key.PublicKey().String()
+	rotated.PreviousPublicKey = peer.PublicKey
+	rotated.KeysRotatedAt = &now
+	if peer.PresharedKey != "" {
+		psk, err := wgtypes.GenerateKey()
+		if err != nil {
+			return wireguard.Peer{}, errors.Wrap(err, "failed to generate preshared key")
+		}
+		rotated.PresharedKey = psk.String()
+	}
+
+	active := peer.DeactivatedAt == nil
+	if active {
+		oldPublicKey, _ := wgtypes.ParseKey(peer.PublicKey)
+		cfgs := []wgtypes.PeerConfig{{PublicKey: oldPublicKey, Remove: true}, rotated.GetConfig(&dev)}
+		if err := s.wg.ConfigurePeers(peer.DeviceName, cfgs); err != nil {
+			return wireguard.Peer{}, errors.WithMessage(err, "failed to update WireGuard peer")
+		}
+	}
+
+	if err := s.peers.RotatePeerKeys(peer.PublicKey, rotated); err != nil {
+		if active {
+			newPublicKey, _ := wgtypes.ParseKey(rotated.PublicKey)
+			cfgs := []wgtypes.PeerConfig{{PublicKey: newPublicKey, Remove: true}, peer.GetConfig(&dev)}
+			if rollbackErr := s.wg.ConfigurePeers(peer.DeviceName, cfgs); rollbackErr != nil {
+				logrus.Errorf("failed to restore old key of peer %s: %v", peer.PublicKey, rollbackErr)
+			}
+		}
+		return wireguard.Peer{}, errors.WithMessage(err, "failed to update peer")
+	}
+
+	logrus.Infof("rotated keys of peer %s (%s): %s replaced by %s, by %s", rotated.Identifier, rotated.Email,
+		peer.PublicKey, rotated.PublicKey, rotated.UpdatedBy)
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerKeysRotated, Interface: peer.DeviceName,
+		PeerKey: rotated.PublicKey, Actor: rotated.UpdatedBy})
+
+	return s.peers.GetPeerByKey(rotated.PublicKey), s.WriteWireGuardConfigFile(peer.DeviceName)
+}
+
 func (s *Server) DeletePeer(peer wireguard.Peer) error {
 	// Delete WireGuard peer
 	if err := s.wg.RemovePeer(peer.DeviceName, peer.PublicKey); err != nil {
@@ -180,48 +469,217 @@ func (s *Server) DeletePeer(peer wireguard.Peer) error {
 		return errors.WithMessage(err, "failed to remove peer")
 	}
 
+	s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerDeleted, Interface: peer.DeviceName,
+		PeerKey: peer.PublicKey, Actor: peer.UpdatedBy})
+	s.syncDeviceRoutes(peer.DeviceName)
+
 	return s.WriteWireGuardConfigFile(peer.DeviceName)
 }
 
 // RestoreWireGuardInterface restores the state of the physical WireGuard interface from the database.
 func (s *Server) RestoreWireGuardInterface(device string) error {
-	activePeers := s.peers.GetActivePeers(device)
+	if s.wg.IsExternalDevice(device) {
+		return nil // the peers have to be added to the external server manually
+	}
+	peers := s.peers.GetAllPeers(device)
 	dev := s.peers.GetDevice(device)
 
-	for i := range activePeers {
-		if activePeers[i].Peer == nil {
-			if err := s.wg.AddPeer(device, activePeers[i].GetConfig(&dev)); err != nil {
-				return errors.WithMessage(err, "failed to add WireGuard peer")
-			}
+	if s.config.WG.ManageInterfaces {
+		if err := s.restoreWireGuardLink(dev); err != nil {
+			return errors.WithMessage(err, "failed to restore WireGuard interface")
+		}
+	}
+
+	wgDevice, err := s.wg.RefreshDeviceInfo(device)
+	if err != nil {
+		return errors.WithMessage(err, "failed to get WireGuard peers")
+	}
+	wgPeers := wgDevice.Peers
+	physicalPeers := make(map[string]bool, len(wgPeers))
+	for _, wgPeer := range wgPeers {
+		physicalPeers[wgPeer.PublicKey.String()] = true
+	}
+
+	// Build the desired peer set from the database
+	var added, updated, removed, unknown int
+	cfgs := make([]wgtypes.PeerConfig, 0, len(peers))
+	knownPeers := make(map[string]bool, len(peers))
+	for i := range peers {
+		knownPeers[peers[i].PublicKey] = true
+		cfg := peers[i].GetConfig(&dev)
+		switch {
+		case peers[i].DeactivatedAt != nil && physicalPeers[peers[i].PublicKey]:
+			cfg = wgtypes.PeerConfig{PublicKey: cfg.PublicKey, Remove: true}
+			removed++
+		case peers[i].DeactivatedAt != nil:
+			continue
+		case physicalPeers[peers[i].PublicKey]:
+			updated++
+		default:
+			added++
+		}
+		cfgs = append(cfgs, cfg)
+	}
+
+	// Peers that only exist on the physical interface
+	for _, wgPeer := range wgPeers {
+		if knownPeers[wgPeer.PublicKey.String()] {
+			continue
+		}
+		if !s.config.WG.PruneUnknownPeers {
+			unknown++
+			continue
 		}
+		cfgs = append(cfgs, wgtypes.PeerConfig{PublicKey: wgPeer.PublicKey, Remove: true})
+		removed++
 	}
 
+	if len(cfgs) > 0 {
+		if err := s.wg.ConfigurePeersOrRestore(device, cfgs); err != nil {
+			return errors.WithMessage(err, "failed to apply WireGuard peers")
+		}
+	}
+
+	logrus.Infof("reconciled WireGuard interface %s: %d peers added, %d updated, %d removed, %d unknown peers kept",
+		device, added, updated, removed, unknown)
+	s.syncDeviceRoutes(device)
+
 	return nil
 }
 
-// WriteWireGuardConfigFile writes the configuration file for the physical WireGuard interface.
+// restoreWireGuardLink applies the stored interface settings to the physical WireGuard interface and brings it up,
+// disabled interfaces are kept down.
+// Addresses are only replaced if they differ from the stored ones, so existing interfaces are not disrupted.
+func (s *Server) restoreWireGuardLink(dev wireguard.Device) error {
+	if err := s.wg.UpdateDevice(dev.DeviceName, dev.GetConfig()); err != nil {
+		return errors.WithMessage(err, "failed to update WireGuard device")
+	}
+
+	if s.config.WG.ManageIPAddresses {
+		currentIPs, err := s.wg.GetIPAddress(dev.DeviceName)
+		if err != nil {
+			return errors.WithMessage(err, "failed to get ip addresses")
+		}
+		if common.ListToString(currentIPs) != common.ListToString(dev.GetIPAddresses()) {
+			if err := s.wg.SetIPAddress(dev.DeviceName, dev.GetIPAddresses()); err != nil {
+				return errors.WithMessage(err, "failed to set ip addresses")
+			}
+		}
+		if err := s.wg.SetMTU(dev.DeviceName, dev.Mtu); err != nil {
+			return errors.WithMessage(err, "failed to set MTU")
+		}
+	}
+
+	if dev.DisabledAt != nil {
+		return s.linkDown(dev)
+	}
+	if err := s.linkUp(dev); err != nil {
+		return err
+	}
+
+	return s.applyFirewallRules(dev)
+}
+
+// applyFirewallRules creates the masquerade rules of the device if it has an upstream interface and removes them
+// otherwise. Nothing is changed if MANAGE_FIREWALL is disabled or the interface is on a remote host or external.
+func (s *Server) applyFirewallRules(dev wireguard.Device) error {
+	if !s.config.WG.ManageFirewall || s.wg.IsRemoteDevice(dev.DeviceName) || s.wg.IsExternalDevice(dev.DeviceName) {
+		return nil
+	}
+
+	if dev.Type == wireguard.DeviceTypeServer && dev.UpstreamInterface != "" {
+		return s.wg.SetMasqueradeRules(dev.DeviceName, dev.UpstreamInterface)
+	}
+	return s.wg.RemoveMasqueradeRules(dev.DeviceName)
+}
+
+// WriteWireGuardConfigFile writes the configuration file for the physical WireGuard interface, unless writing is
+// disabled for the interface. The file is rendered completely before it atomically replaces the previous file, so
+// wg-quick never reads a partially written configuration. As the file contains the private key, it is only readable
+// by the owner and the config directory must not be accessible by other users. Afterwards, the optional
+// WG_CONFIG_POST_WRITE_CMD is run.
 func (s *Server) WriteWireGuardConfigFile(device string) error {
 	if s.config.WG.ConfigDirectoryPath == "" {
 		return nil // writing disabled
 	}
-	if err := syscall.Access(s.config.WG.ConfigDirectoryPath, syscall.O_RDWR); err != nil {
-		return errors.Wrap(err, "failed to check WireGuard config access rights")
+	dev := s.peers.GetDevice(device)
+	if dev.DisableConfigFile {
+		return nil
+	}
+	if err := checkConfigDirectory(s.config.WG.ConfigDirectoryPath); err != nil {
+		return err
 	}
 
-	dev := s.peers.GetDevice(device)
 	cfg, err := dev.GetConfigFile(s.peers.GetActivePeers(device), s.config.Core.WGExoprterFriendlyNames)
 	if err != nil {
 		return errors.WithMessage(err, "failed to get config file")
 	}
 	filePath := path.Join(s.config.WG.ConfigDirectoryPath, dev.DeviceName+".conf")
-	if err := ioutil.WriteFile(filePath, cfg, 0644); err != nil {
-		return errors.Wrap(err, "failed to write WireGuard config file")
+	if err := writeFileAtomic(filePath, cfg, 0600); err != nil {
+		return errors.WithMessage(err, "failed to write WireGuard config file")
 	}
+
+	if s.config.WG.ConfigPostWriteCmd != "" {
+		if _, err := s.runCommand(s.config.WG.ConfigPostWriteCmd, dev.DeviceName, configPostWriteTimeout); err != nil {
+			return errors.WithMessage(err, "config file was written but the post-write command failed")
+		}
+	}
+
+	return nil
+}
+
+// checkConfigDirectory makes sure that the config directory is writable and cannot be read by other users.
+func checkConfigDirectory(directory string) error {
+	if err := checkDirectoryAccess(directory); err != nil {
+		return errors.Wrap(err, "failed to check WireGuard config access rights")
+	}
+	info, err := os.Stat(directory)
+	if err != nil {
+		return errors.Wrap(err, "failed to check WireGuard config directory")
+	}
+	if !info.IsDir() {
+		return errors.Errorf("WireGuard config path %s is not a directory", directory)
+	}
+	if info.Mode().Perm()&0006 != 0 {
+		return errors.Errorf("refusing to write private keys to %s, it is accessible by other users (mode %s), "+
+			"restrict the permissions, e.g. chmod 700", directory, info.Mode().Perm())
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes the data to a temporary file in the same directory and renames it to the given path.
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tmpFile.Name()) // fails once the file was renamed
+
+	if err := tmpFile.Chmod(perm); err != nil {
+		_ = tmpFile.Close()
+		return errors.Wrap(err, "failed to set file permissions")
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return errors.Wrap(err, "failed to write temporary file")
+	}
+	if err := tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return errors.Wrap(err, "failed to sync temporary file")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "failed to close temporary file")
+	}
+	if err := os.Rename(tmpFile.Name(), filePath); err != nil {
+		return errors.Wrap(err, "failed to replace file")
+	}
+
 	return nil
 }
 
 // CreateUser creates the user in the database and optionally adds a default WireGuard peer for the user.
-func (s *Server) CreateUser(user users.User, device string) error {
+func (s *Server) CreateUser(user users.User, device, actor string) error {
 	if user.Email == "" {
 		return errors.New("cannot create user with empty email address")
 	}
@@ -229,16 +687,16 @@ func (s *Server) CreateUser(user users.User, device string) error {
 	// Check if user already exists, if so re-enable
 	if existingUser := s.users.GetUserUnscoped(user.Email); existingUser != nil {
 		user.DeletedAt = gorm.DeletedAt{} // reset deleted flag to enable that user again
-		return s.UpdateUser(user)
+		return s.UpdateUser(user, actor)
 	}
 
 	// Hash user password (if set)
 	if user.Password != "" {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		hashedPassword, err := s.hashUserPassword(string(user.Password))
 		if err != nil {
-			return errors.Wrap(err, "unable to hash password")
+			return err
 		}
-		user.Password = users.PrivateString(hashedPassword)
+		user.Password = hashedPassword
 	}
 
 	// Create user in database
@@ -250,22 +708,31 @@ func (s *Server) CreateUser(user users.User, device string) error {
 	return s.CreateUserDefaultPeer(user.Email, device)
 }
 
+// hashUserPassword validates a new password against the password policy and hashes it.
+func (s *Server) hashUserPassword(password string) (users.PrivateString, error) {
+	if err := s.config.Password.Validate(password); err != nil {
+		return "", err
+	}
+
+	return s.config.Password.Hash(password)
+}
+
 // UpdateUser updates the user in the database. If the user is marked as deleted, it will get remove from the database.
-// Also, if the user is re-enabled, all it's linked WireGuard peers will be activated again.
-func (s *Server) UpdateUser(user users.User) error {
+// Also, if the user is re-enabled, the peers that were disabled with the user are activated again.
+func (s *Server) UpdateUser(user users.User, actor string) error {
 	if user.DeletedAt.Valid {
-		return s.DeleteUser(user)
+		return s.DeleteUser(user, actor)
 	}
 
 	currentUser := s.users.GetUserUnscoped(user.Email)
 
 	// Hash user password (if set)
 	if user.Password != "" {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		hashedPassword, err := s.hashUserPassword(string(user.Password))
 		if err != nil {
-			return errors.Wrap(err, "unable to hash password")
+			return err
 		}
-		user.Password = users.PrivateString(hashedPassword)
+		user.Password = hashedPassword
 	} else {
 		user.Password = currentUser.Password // keep current password
 	}
@@ -277,13 +744,7 @@ func (s *Server) UpdateUser(user users.User) error {
 
 	// If user was deleted (disabled), reactivate it's peers
 	if currentUser.DeletedAt.Valid {
-		for _, peer := range s.peers.GetPeersByMail(user.Email) {
-			now := time.Now()
-			peer.DeactivatedAt = nil
-			if err := s.UpdatePeer(peer, now); err != nil {
-				logrus.Errorf("failed to update (re)activated peer %s for %s: %v", peer.PublicKey, user.Email, err)
-			}
-		}
+		s.enableUserPeers(user.Email, actor)
 	}
 
 	return nil
@@ -291,7 +752,7 @@ func (s *Server) UpdateUser(user users.User) error {
 
 // DeleteUser removes the user from the database.
 // Also, if the user has linked WireGuard peers, they will be deactivated.
-func (s *Server) DeleteUser(user users.User) error {
+func (s *Server) DeleteUser(user users.User, actor string) error {
 	currentUser := s.users.GetUserUnscoped(user.Email)
 
 	// Update in database
@@ -301,27 +762,69 @@ func (s *Server) DeleteUser(user users.User) error {
 
 	// If user was active, disable it's peers
 	if !currentUser.DeletedAt.Valid {
-		for _, peer := range s.peers.GetPeersByMail(user.Email) {
-			now := time.Now()
-			peer.DeactivatedAt = &now
-			if err := s.UpdatePeer(peer, now); err != nil {
-				logrus.Errorf("failed to update deactivated peer %s for %s: %v", peer.PublicKey, user.Email, err)
-			}
-		}
+		s.disableUserPeers(user.Email, actor)
 	}
 
 	return nil
 }
 
+// disableUserPeers removes the active peers of a deactivated user from the interfaces, unless DISABLE_USER_PEERS is
+// turned off. The peers are marked with DeactivationReasonAccount, so enableUserPeers only restores these peers and
+// not the ones that were already disabled for another reason.
+func (s *Server) disableUserPeers(email, actor string) {
+	if !s.config.Core.DisableUserPeers {
+		return
+	}
+
+	for _, peer := range s.peers.GetPeersByMail(email) {
+		if peer.DeactivatedAt != nil {
+			continue
+		}
+		now := time.Now()
+		peer.DeactivatedAt = &now
+		peer.DeactivationReason = wireguard.DeactivationReasonAccount
+		peer.UpdatedBy = actor
+		if err := s.UpdatePeer(peer, now); err != nil {
+			logrus.Errorf("failed to update deactivated peer %s for %s: %v", peer.PublicKey, email, err)
+			continue
+		}
+		s.audit.Record(common.AuditEntry{Actor: actor, Action: "peer.disabled", Interface: peer.DeviceName,
+			Target: peer.PublicKey, Details: fmt.Sprintf("%s, the user %s has been deactivated", peer.Identifier, email)})
+	}
+}
+
+// enableUserPeers activates the peers that were disabled with the user again, see disableUserPeers.
+func (s *Server) enableUserPeers(email, actor string) {
+	for _, peer := range s.peers.GetPeersByMail(email) {
+		if peer.DeactivatedAt == nil || peer.DeactivationReason != wireguard.DeactivationReasonAccount {
+			continue
+		}
+		now := time.Now()
+		peer.DeactivatedAt = nil
+		peer.UpdatedBy = actor
+		if err := s.UpdatePeer(peer, now); err != nil {
+			logrus.Errorf("failed to update (re)activated peer %s for %s: %v", peer.PublicKey, email, err)
+			continue
+		}
+		s.audit.Record(common.AuditEntry{Actor: actor, Action: "peer.enabled", Interface: peer.DeviceName,
+			Target: peer.PublicKey, Details: fmt.Sprintf("%s, the user %s has been reactivated", peer.Identifier, email)})
+	}
+}
+
 func (s *Server) CreateUserDefaultPeer(email, device string) error {
 	// Check if automatic peer creation is enabled
 	if !s.config.Core.CreateDefaultPeer {
 		return nil
 	}
 
+	return s.createDefaultPeer(email, device)
+}
+
+// createDefaultPeer creates the default peer of an active user that has no peers yet.
+func (s *Server) createDefaultPeer(email, device string) error {
 	// Check if user is active, if not, quit
 	var existingUser *users.User
-	if existingUser = s.users.GetUser(email); existingUser == nil {
+	if existingUser = s.users.GetUser(email); existingUser == nil || !existingUser.IsActive() {
 		return nil
 	}
 
@@ -361,3 +864,181 @@ func (s *Server) GetDeviceNames() map[string]string {
 
 	return devNames
 }
+
+// validateDeviceEndpoint checks the endpoint that is announced to the peers of a server mode device. The returned
+// warning is set if the endpoint is only reachable from private networks although the portal is publicly reachable.
+func (s *Server) validateDeviceEndpoint(dev wireguard.Device) (string, error) {
+	if dev.Type != wireguard.DeviceTypeServer {
+		return "", nil
+	}
+	if dev.ResolvedEndpoint == "" {
+		return "", errors.New("no public endpoint configured and it cannot be derived from the external url")
+	}
+
+	private, err := common.ValidateEndpoint(dev.ResolvedEndpoint)
+	if err != nil {
+		return "", errors.WithMessage(err, "invalid public endpoint")
+	}
+	if private && common.IsPublicHost(common.HostFromUrl(s.config.Core.ExternalUrl)) {
+		return fmt.Sprintf("the public endpoint %s resolves to a private or loopback address, but the external url is public",
+			dev.ResolvedEndpoint), nil
+	}
+
+	return "", nil
+}
+
+// validateExternalServer checks the public key and the endpoint of the server of an external interface, both are
+// written to the peer configurations.
+func validateExternalServer(dev wireguard.Device) error {
+	if _, err := wgtypes.ParseKey(dev.PublicKey); err != nil {
+		return errors.New("invalid public key of the external server")
+	}
+	if dev.DefaultEndpoint == "" {
+		return errors.New("the endpoint of the external server is required, e.g. vpn.company.com:51820")
+	}
+	return nil
+}
+
+// validateDeviceListenPort checks that no other managed interface uses the listen port of the device and that the port
+// is not bound by another process on the host. Port 0 lets the kernel choose a random port and is always valid.
+// External interfaces do not listen on this host.
+func (s *Server) validateDeviceListenPort(dev wireguard.Device) error {
+	if dev.ListenPort == 0 || s.wg.IsExternalDevice(dev.DeviceName) {
+		return nil
+	}
+
+	for _, deviceName := range s.config.WG.DeviceNames {
+		if deviceName == dev.DeviceName || s.wg.IsExternalDevice(deviceName) {
+			continue
+		}
+		other := s.peers.GetDevice(deviceName)
+		port := other.ListenPort
+		if wgDevice, err := s.wg.GetDeviceInfo(deviceName); err == nil {
+			port = wgDevice.ListenPort
+		}
+		if port == dev.ListenPort {
+			return errors.Errorf("listen port %d is already used by interface %s", dev.ListenPort, deviceName)
+		}
+	}
+
+	// the port of the interface itself is bound by WireGuard
+	if wgDevice, err := s.wg.GetDeviceInfo(dev.DeviceName); err == nil && wgDevice.ListenPort == dev.ListenPort {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(dev.ListenPort))
+	if err != nil {
+		return errors.Errorf("listen port %d is already in use on the host", dev.ListenPort)
+	}
+	_ = conn.Close()
+
+	return nil
+}
+
+// validateDeviceAddresses checks every entry of the comma separated address list of an interface. Each entry must be
+// an address with prefix length, e.g. 10.11.12.1/24, and may only be listed once.
+func validateDeviceAddresses(addresses string) error {
+	seen := make(map[string]bool)
+	for _, cidr := range common.ParseStringList(addresses) {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.Errorf("invalid address %s, expected an address with prefix length like 10.11.12.1/24", cidr)
+		}
+		if seen[ip.String()] {
+			return errors.Errorf("address %s is listed more than once", ip)
+		}
+		seen[ip.String()] = true
+	}
+	return nil
+}
+
+// validateRemovedDeviceNetworks ensures that no network is removed from a server mode interface while peers still use
+// addresses of it, the peers would lose their connectivity.
+func (s *Server) validateRemovedDeviceNetworks(current, updated wireguard.Device) error {
+	if updated.Type != wireguard.DeviceTypeServer {
+		return nil
+	}
+
+	updatedNets := parseNetworks(updated.GetIPAddresses())
+	for _, cidr := range current.GetIPAddresses() {
+		if common.ListContains(updated.GetIPAddresses(), cidr) {
+			continue
+		}
+		_, removedNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+
+		users := make([]string, 0)
+		for _, peer := range s.peers.GetAllPeers(current.DeviceName) {
+			for _, peerCidr := range peer.GetIPAddresses() {
+				ip, peerNet, err := net.ParseCIDR(peerCidr)
+				if err != nil || !removedNet.Contains(ip) || containedIn(peerNet, updatedNets) {
+					continue
+				}
+				users = append(users, peer.Identifier+" ("+ip.String()+")")
+			}
+		}
+		if len(users) > 0 {
+			if len(users) > 3 {
+				users = append(users[:3], fmt.Sprintf("%d more", len(users)-3))
+			}
+			return errors.Errorf("address %s cannot be removed, the peers %s use addresses of its network, "+
+				"change their addresses first", cidr, strings.Join(users, ", "))
+		}
+	}
+	return nil
+}
+
+// SaveAllowedIPsPreset creates or updates an allowed IPs preset. If applyToPeers is set, all peers that use the preset
+// are updated, so that their client configurations contain the new networks. The number of updated peers is returned.
+func (s *Server) SaveAllowedIPsPreset(preset wireguard.AllowedIPsPreset, applyToPeers bool, actor string) (int, error) {
+	var err error
+	preset.Name = strings.TrimSpace(preset.Name)
+	if preset.AllowedIPsStr, err = common.NormalizeCIDRList(preset.AllowedIPsStr); err != nil {
+		return 0, errors.WithMessage(err, "invalid allowed IPs")
+	}
+	if preset.AllowedIPsStr == "" {
+		return 0, errors.New("a preset needs at least one network")
+	}
+	if s.peers.AllowedIPsPresetNameExists(preset.DeviceName, preset.Name, preset.ID) {
+		return 0, errors.Errorf("a preset named %s already exists", preset.Name)
+	}
+	if err := s.peers.SaveAllowedIPsPreset(&preset); err != nil {
+		return 0, err
+	}
+	if !applyToPeers {
+		return 0, nil
+	}
+
+	updated := 0
+	for _, peer := range s.peers.GetPeersByAllowedIPsPreset(preset.ID) {
+		peer.UpdatedBy = actor
+		if err := s.UpdatePeer(peer, time.Now()); err != nil {
+			return updated, errors.WithMessagef(err, "failed to update peer %s", peer.PublicKey)
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// CreateConfiguredAllowedIPsPresets creates the presets of the configuration file that do not exist yet.
+func (s *Server) CreateConfiguredAllowedIPsPresets() {
+	for _, presetCfg := range s.config.WG.AllowedIPsPresets {
+		if !common.ListContains(s.config.WG.DeviceNames, presetCfg.Device) {
+			logrus.Warnf("allowed IPs preset %s references unknown interface %s", presetCfg.Name, presetCfg.Device)
+			continue
+		}
+		if s.peers.AllowedIPsPresetNameExists(presetCfg.Device, strings.TrimSpace(presetCfg.Name), 0) {
+			continue
+		}
+
+		preset := wireguard.AllowedIPsPreset{
+			DeviceName:    presetCfg.Device,
+			Name:          presetCfg.Name,
+			AllowedIPsStr: common.ListToString(presetCfg.AllowedIPs),
+		}
+		if _, err := s.SaveAllowedIPsPreset(preset, false, ""); err != nil {
+			logrus.Warnf("failed to create allowed IPs preset %s for %s: %v", presetCfg.Name, presetCfg.Device, err)
+		}
+	}
+}
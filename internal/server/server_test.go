@@ -0,0 +1,119 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	texttemplate "text/template"
+
+	wgportal "github.com/h44z/wg-portal"
+	passwordprovider "github.com/h44z/wg-portal/internal/authentication/providers/password"
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+)
+
+// newTestServer sets up a server like setupCommand does, with a sqlite database in a temporary directory and a
+// WireGuard manager that never accesses the interfaces. The environment variables are applied on top of the default
+// configuration and are reset once the test has finished. Users log in with the passwords stored in the database.
+func newTestServer(t testing.TB, env map[string]string) *Server {
+	t.Helper()
+
+	vars := map[string]string{
+		"DATABASE_TYPE": "sqlite",
+		"DATABASE_NAME": filepath.Join(t.TempDir(), "wg_portal.db"),
+		"WG_DEVICES":    "wg0",
+	}
+	for key, value := range env {
+		vars[key] = value
+	}
+	for key, value := range vars {
+		previous, existed := os.LookupEnv(key)
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatal(err)
+		}
+		key := key
+		t.Cleanup(func() {
+			if existed {
+				_ = os.Setenv(key, previous)
+			} else {
+				_ = os.Unsetenv(key)
+			}
+		})
+	}
+
+	s := &Server{}
+	if err := s.setupCommand(); err != nil {
+		t.Fatalf("failed to setup server: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := s.db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	if externalUrl, err := url.Parse(s.config.Core.ExternalUrl); err == nil {
+		s.basePath = strings.TrimRight(externalUrl.Path, "/")
+	}
+	s.bulkJobs = &bulkPeerJobs{results: make(map[string]*BulkPeerResult)}
+	s.enrollmentMux = &sync.Mutex{}
+	s.endpointChecks = &endpointCheckCache{results: make(map[string]EndpointCheckResult)}
+	s.downloadLinkLimiter = newIPRateLimiter(downloadLinkRateLimit, downloadLinkRateWindow)
+	s.registrationLimiter = newIPRateLimiter(registrationRateLimit, registrationRateWindow)
+	s.loginGuard = newLoginGuard(s.config.Core.LoginLockoutAttempts, s.config.Core.LoginLockoutDuration,
+		s.config.Core.LoginFailureHistory)
+	s.webhooks = common.NewWebhookDispatcher(s.ctx, s.config.Webhook)
+	s.userValidity = newUserValidityCache(s.config.Core.UserCacheTTL, userValidityCacheSize, s.users.GetUser)
+	s.users.OnChange = s.userValidity.Invalidate
+	stats, err := wireguard.NewStatisticsCollector(s.db, s.wg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.stats = stats
+	s.mailTpl = template.Must(template.New("email.html").ParseFS(wgportal.Templates, "assets/tpl/email.html"))
+	s.mailTxtTpl = texttemplate.Must(texttemplate.New("email.txt").ParseFS(wgportal.Templates, "assets/tpl/email.txt"))
+	s.mailer = NewMailer(s)
+	if err := s.loadBranding(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setupWebServer(); err != nil {
+		t.Fatalf("failed to setup web server: %v", err)
+	}
+	s.auth = NewAuthManager(s)
+	pwProvider, err := passwordprovider.New(&s.config.Database, s.config.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.auth.RegisterProvider(pwProvider)
+
+	return s
+}
+
+// newTestClient returns a client that keeps the cookies of the server and does not follow redirects.
+func newTestClient(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func startTestServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+
+	ts := httptest.NewServer(s.server)
+	t.Cleanup(ts.Close)
+	return ts
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-contrib/sessions/memstore"
+	"github.com/gin-contrib/sessions/redis"
+	gsessions "github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SessionStoreMemory = "memory" // sessions are lost on restart and not shared between instances
+	SessionStoreCookie = "cookie" // the encrypted session is stored in the cookie of the browser
+	SessionStoreRedis  = "redis"  // sessions are stored in Redis and shared between instances
+
+	sessionCookieName     = "authsession"
+	sessionMaxAge         = 86400 // auth session is valid for 1 day
+	sessionRedisKeyPrefix = "wgportal_session_"
+	sessionRedisPoolSize  = 10 // maximum number of idle connections to Redis
+
+	sessionFormKey      = "formKey" // key of the server-side form data of a cookie session
+	sessionFormsMaxSize = 10000     // maximum number of cookie sessions with form data
+)
+
+// sessionOptions are the cookie options of the auth session, DestroySessionData needs them to expire the cookie.
+var sessionOptions sessions.Options
+
+// newSessionStore creates the session store that is selected by SESSION_STORE. All instances behind a load balancer
+// need the same SESSION_SECRET, it signs the session cookies and the CSRF tokens.
+func (s *Server) newSessionStore() (sessions.Store, error) {
+	sessionOptions = sessions.Options{
+		Path:     s.urlPath("/"),
+		MaxAge:   sessionMaxAge,
+		Secure:   strings.HasPrefix(s.config.Core.ExternalUrl, "https"),
+		HttpOnly: true,
+	}
+	authKey := []byte(s.config.Core.SessionSecret)
+
+	var store sessions.Store
+	switch s.config.Core.SessionStore {
+	case SessionStoreMemory, "":
+		store = memstore.NewStore(authKey)
+	case SessionStoreCookie:
+		// the cookie is encrypted and not only signed, it contains the CSRF salt of the session
+		encryptionKey := sha256.Sum256(authKey)
+		store = newCookieFormStore(cookie.NewStore(authKey, encryptionKey[:]), sessionMaxAge*time.Second,
+			sessionFormsMaxSize)
+	case SessionStoreRedis:
+		if s.config.Core.SessionRedisAddress == "" {
+			return nil, errors.New("SESSION_REDIS_ADDRESS is required for the redis session store")
+		}
+		redisStore, err := redis.NewStoreWithDB(sessionRedisPoolSize, "tcp", s.config.Core.SessionRedisAddress,
+			s.config.Core.SessionRedisPassword, strconv.Itoa(s.config.Core.SessionRedisDB), authKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to connect to redis %s", s.config.Core.SessionRedisAddress)
+		}
+		err, rediStore := redis.GetRedisStore(redisStore)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to setup redis session store")
+		}
+		rediStore.SetKeyPrefix(sessionRedisKeyPrefix)
+		rediStore.SetMaxLength(0) // the form data of large peers can exceed the default limit of 4 KiB
+		rediStore.SetMaxAge(sessionMaxAge)
+		store = redisStore
+		logrus.Infof("storing sessions in redis %s", s.config.Core.SessionRedisAddress)
+	default:
+		return nil, errors.Errorf("unknown session store %s, use memory, cookie or redis", s.config.Core.SessionStore)
+	}
+	store.Options(sessionOptions)
+
+	return store, nil
+}
+
+// cookieFormStore keeps the form data and the pending change of cookie sessions on the server. They contain whole
+// interfaces and peers including the private keys and exceed the size of a cookie, browsers drop cookies larger than
+// 4 KiB. The cookie only holds a random key of the form data, so the form data is not shared between instances.
+type cookieFormStore struct {
+	cookie.Store
+	ttl     time.Duration
+	maxSize int
+
+	mux   sync.Mutex
+	forms map[string]sessionForm
+}
+
+type sessionForm struct {
+	formData      interface{}
+	pendingChange *PendingChange
+	savedAt       time.Time
+}
+
+func newCookieFormStore(store cookie.Store, ttl time.Duration, maxSize int) *cookieFormStore {
+	return &cookieFormStore{
+		Store:   store,
+		ttl:     ttl,
+		maxSize: maxSize,
+		forms:   make(map[string]sessionForm),
+	}
+}
+
+// Get returns the session of the request, the session is only loaded once per request.
+func (f *cookieFormStore) Get(r *http.Request, name string) (*gsessions.Session, error) {
+	return gsessions.GetRegistry(r).Get(f, name)
+}
+
+// New loads the session from the cookie and restores the form data of the session. The session is saved through
+// this store, so that Save can take the form data out of the cookie.
+func (f *cookieFormStore) New(r *http.Request, name string) (*gsessions.Session, error) {
+	cookieSession, err := f.Store.New(r, name)
+	session := gsessions.NewSession(f, name)
+	if cookieSession != nil {
+		session.ID = cookieSession.ID
+		session.Values = cookieSession.Values
+		session.Options = cookieSession.Options
+		session.IsNew = cookieSession.IsNew
+	}
+	data, ok := session.Values[SessionIdentifier].(SessionData)
+	key, hasKey := session.Values[sessionFormKey].(string)
+	if !ok || !hasKey {
+		return session, err
+	}
+
+	f.mux.Lock()
+	form, found := f.forms[key]
+	f.mux.Unlock()
+	if found && time.Since(form.savedAt) < f.ttl {
+		data.FormData = form.formData
+		data.PendingChange = form.pendingChange
+		session.Values[SessionIdentifier] = data
+	}
+
+	return session, err
+}
+
+// Save writes the session without the form data to the cookie, the form data is stored under the key of the session.
+func (f *cookieFormStore) Save(r *http.Request, w http.ResponseWriter, session *gsessions.Session) error {
+	data, ok := session.Values[SessionIdentifier].(SessionData)
+	key, hasKey := session.Values[sessionFormKey].(string)
+	if !ok || (data.FormData == nil && data.PendingChange == nil) {
+		if hasKey {
+			f.mux.Lock()
+			delete(f.forms, key)
+			f.mux.Unlock()
+			delete(session.Values, sessionFormKey)
+		}
+		return f.Store.Save(r, w, session)
+	}
+
+	if !hasKey {
+		key = newSessionFormKey()
+	}
+	f.mux.Lock()
+	if _, exists := f.forms[key]; !exists && len(f.forms) >= f.maxSize {
+		f.evict(time.Now())
+	}
+	f.forms[key] = sessionForm{formData: data.FormData, pendingChange: data.PendingChange, savedAt: time.Now()}
+	f.mux.Unlock()
+
+	cookieData := data
+	cookieData.FormData = nil
+	cookieData.PendingChange = nil
+	session.Values[SessionIdentifier] = cookieData
+	session.Values[sessionFormKey] = key
+	err := f.Store.Save(r, w, session)
+	session.Values[SessionIdentifier] = data // later reads of the request still see the form data
+
+	return err
+}
+
+// evict drops the expired forms, or an arbitrary form if none expired. The caller must hold the lock.
+func (f *cookieFormStore) evict(now time.Time) {
+	for key, form := range f.forms {
+		if now.Sub(form.savedAt) >= f.ttl {
+			delete(f.forms, key)
+		}
+	}
+	if len(f.forms) < f.maxSize {
+		return
+	}
+	for key := range f.forms {
+		delete(f.forms, key)
+		break
+	}
+}
+
+func newSessionFormKey() string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		logrus.Errorf("failed to generate session form key: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
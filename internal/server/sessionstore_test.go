@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestCookieSessionKeepsInterfaceEdit(t *testing.T) {
+	s := newTestServer(t, map[string]string{"SESSION_STORE": "cookie"})
+	baseUrl := startTestServer(t, s).URL
+	client := loginTestAdmin(t, s, baseUrl)
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := "iptables -A FORWARD -i %i -j ACCEPT; iptables -t nat -A POSTROUTING -o eth0 -j MASQUERADE; "
+	if err := s.peers.UpdateDevice(wireguard.Device{DeviceName: "wg0", Type: wireguard.DeviceTypeServer,
+		IPsStr: "10.0.0.1/24", DefaultEndpoint: "192.0.2.1:51820", PrivateKey: privateKey.String(),
+		PublicKey: privateKey.PublicKey().String(),
+		PostUp:    strings.Repeat(hook, 10), PostDown: strings.Repeat(strings.ReplaceAll(hook, "-A", "-D"), 10),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the edit page stores the interface in the session, the preview also stores the pending change
+	resp, body := getPage(t, client, baseUrl+"/admin/device/edit")
+	token := csrfInputPattern.FindStringSubmatch(body)
+	if resp.StatusCode != http.StatusOK || token == nil {
+		t.Fatalf("edit page: got %d", resp.StatusCode)
+	}
+	resp, err = client.PostForm(baseUrl+"/admin/device/edit", url.Values{csrfFormField: {token[1]},
+		"postup": {strings.Repeat(hook, 12)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("preview: got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	for _, cookie := range resp.Cookies() {
+		if len(cookie.String()) > 4096 {
+			t.Errorf("the cookie %s has %d bytes, browsers drop it", cookie.Name, len(cookie.String()))
+		}
+	}
+
+	// the test server does not access the interfaces, a confirmed change fails once it is applied. Without the
+	// pending change of the session the confirmation is rejected before.
+	resp, err = client.PostForm(baseUrl+"/admin/device/edit/confirm", url.Values{csrfFormField: {token[1]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); location != "/admin/device/edit?formerr=wg" {
+		t.Errorf("confirm: got %d to %q, want the error of the interface", resp.StatusCode, location)
+	}
+}
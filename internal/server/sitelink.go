@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultSiteLinkKeepalive keeps the NAT mappings of site-to-site links open.
+const DefaultSiteLinkKeepalive = 25
+
+// SiteLinkRequest describes a site-to-site link between two server mode interfaces of the portal. Each side routes
+// the networks of its interface and the additional networks behind it (e.g. the LAN of the site) to the other side.
+type SiteLinkRequest struct {
+	DeviceA   string
+	DeviceB   string
+	NetworksA string // comma separated networks behind interface A
+	NetworksB string // comma separated networks behind interface B
+	EndpointA string // the endpoint of interface A that interface B connects to, the interface endpoint by default
+	EndpointB string // the endpoint of interface B that interface A connects to, the interface endpoint by default
+	Keepalive int
+}
+
+// SiteLinkPlan contains the mutual peers of a site-to-site link. PeerOnA is the peer of interface A that represents
+// interface B and vice versa.
+type SiteLinkPlan struct {
+	Request SiteLinkRequest
+	PeerOnA wireguard.Peer
+	PeerOnB wireguard.Peer
+}
+
+// PlanSiteLink validates the request and returns the peers that would be created on both interfaces. Nothing is
+// changed.
+func (s *Server) PlanSiteLink(req SiteLinkRequest, actor string) (SiteLinkPlan, error) {
+	plan := SiteLinkPlan{Request: req}
+	if req.DeviceA == req.DeviceB {
+		return plan, errors.New("a site-to-site link needs two different interfaces")
+	}
+	if req.Keepalive < 0 || req.Keepalive > wireguard.MaxPersistentKeepalive {
+		return plan, errors.Errorf("keepalive must be between 0 and %d seconds", wireguard.MaxPersistentKeepalive)
+	}
+
+	devA, err := s.siteLinkDevice(req.DeviceA)
+	if err != nil {
+		return plan, err
+	}
+	devB, err := s.siteLinkDevice(req.DeviceB)
+	if err != nil {
+		return plan, err
+	}
+	localA, err := siteNetworks(devA, req.NetworksA)
+	if err != nil {
+		return plan, err
+	}
+	localB, err := siteNetworks(devB, req.NetworksB)
+	if err != nil {
+		return plan, err
+	}
+
+	// the allowed IPs are symmetric: each side accepts exactly the networks that the other side announces
+	for _, a := range localA {
+		for _, b := range localB {
+			if networksOverlap(a, b) {
+				return plan, errors.Errorf("network %s of %s overlaps network %s of %s, the sites cannot route "+
+					"between each other", a, devA.DeviceName, b, devB.DeviceName)
+			}
+		}
+	}
+	if err := s.checkSiteNetworks(devA, localB); err != nil {
+		return plan, err
+	}
+	if err := s.checkSiteNetworks(devB, localA); err != nil {
+		return plan, err
+	}
+
+	endpointA, err := siteEndpoint(devA, req.EndpointA, s.wg.DefaultEndpointHost(devA.DeviceName))
+	if err != nil {
+		return plan, err
+	}
+	endpointB, err := siteEndpoint(devB, req.EndpointB, s.wg.DefaultEndpointHost(devB.DeviceName))
+	if err != nil {
+		return plan, err
+	}
+	plan.Request.EndpointA = endpointA
+	plan.Request.EndpointB = endpointB
+
+	plan.PeerOnA = sitePeer(devA, devB, localB, endpointB, req.Keepalive, actor)
+	plan.PeerOnB = sitePeer(devB, devA, localA, endpointA, req.Keepalive, actor)
+	return plan, nil
+}
+
+// ApplySiteLink creates the mutual peers of the site-to-site link with a shared preshared key and configures both
+// interfaces. If the second interface rejects its peer, the peer of the first interface is removed again.
+func (s *Server) ApplySiteLink(req SiteLinkRequest, actor string) (SiteLinkPlan, error) {
+	plan, err := s.PlanSiteLink(req, actor)
+	if err != nil {
+		return plan, err
+	}
+
+	psk, err := wgtypes.GenerateKey()
+	if err != nil {
+		return plan, errors.Wrap(err, "failed to generate preshared key")
+	}
+	plan.PeerOnA.PresharedKey = psk.String()
+	plan.PeerOnB.PresharedKey = psk.String()
+
+	devA := s.peers.GetDevice(plan.PeerOnA.DeviceName)
+	devB := s.peers.GetDevice(plan.PeerOnB.DeviceName)
+	if err := s.wg.ConfigurePeers(devA.DeviceName, []wgtypes.PeerConfig{plan.PeerOnA.GetConfig(&devA)}); err != nil {
+		return plan, errors.WithMessagef(err, "failed to configure %s", devA.DeviceName)
+	}
+	if err := s.wg.ConfigurePeers(devB.DeviceName, []wgtypes.PeerConfig{plan.PeerOnB.GetConfig(&devB)}); err != nil {
+		if err := s.wg.RemovePeer(devA.DeviceName, plan.PeerOnA.PublicKey); err != nil {
+			logrus.Errorf("failed to remove the site-to-site peer of %s: %v", devA.DeviceName, err)
+		}
+		return plan, errors.WithMessagef(err, "failed to configure %s, the link was not created", devB.DeviceName)
+	}
+
+	for _, peer := range []wireguard.Peer{plan.PeerOnA, plan.PeerOnB} {
+		if err := s.peers.CreatePeer(peer); err != nil {
+			return plan, errors.WithMessage(err, "failed to store the site-to-site peers")
+		}
+		s.syncDeviceRoutes(peer.DeviceName)
+		if err := s.WriteWireGuardConfigFile(peer.DeviceName); err != nil {
+			logrus.Errorf("failed to write the config file of %s: %v", peer.DeviceName, err)
+		}
+		s.webhooks.Dispatch(common.WebhookEvent{Type: common.WebhookEventPeerCreated, Interface: peer.DeviceName,
+			PeerKey: peer.PublicKey, Actor: actor})
+	}
+
+	s.audit.Record(common.AuditEntry{Actor: actor, Action: "sitelink.created", Interface: devA.DeviceName,
+		Target: devB.DeviceName, Details: fmt.Sprintf("%s routes %s, %s routes %s", devA.DeviceName,
+			plan.PeerOnA.AllowedIPsSrvStr, devB.DeviceName, plan.PeerOnB.AllowedIPsSrvStr)})
+	return plan, nil
+}
+
+func (s *Server) siteLinkDevice(device string) (wireguard.Device, error) {
+	if !common.ListContains(s.config.WG.DeviceNames, device) {
+		return wireguard.Device{}, errors.Errorf("no such interface %s", device)
+	}
+	dev := s.peers.GetDevice(device)
+	if dev.Type != wireguard.DeviceTypeServer {
+		return dev, errors.Errorf("interface %s is not in server mode", device)
+	}
+	if existing := s.peers.GetPeerByKey(dev.PublicKey); existing.PublicKey != "" {
+		return dev, errors.Errorf("interface %s is already a peer of %s", device, existing.DeviceName)
+	}
+	return dev, nil
+}
+
+// siteNetworks returns the networks of the interface and the additional networks behind it.
+func siteNetworks(dev wireguard.Device, additional string) ([]*net.IPNet, error) {
+	normalized, err := common.NormalizeCIDRList(additional)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "invalid networks behind %s", dev.DeviceName)
+	}
+	return parseNetworks(append(dev.GetIPAddresses(), common.ParseStringList(normalized)...)), nil
+}
+
+// checkSiteNetworks ensures that the networks of the other site do not overlap the networks of the interface or of
+// its existing peers.
+func (s *Server) checkSiteNetworks(dev wireguard.Device, remote []*net.IPNet) error {
+	own := parseNetworks(dev.GetIPAddresses())
+	for _, network := range remote {
+		for _, ownNetwork := range own {
+			if networksOverlap(network, ownNetwork) {
+				return errors.Errorf("network %s overlaps the network %s of %s", network, ownNetwork, dev.DeviceName)
+			}
+		}
+	}
+	for _, peer := range s.peers.GetAllPeers(dev.DeviceName) {
+		for _, peerNetwork := range parseNetworks(peer.GetServerAllowedIPs()) {
+			for _, network := range remote {
+				if networksOverlap(network, peerNetwork) {
+					return errors.Errorf("network %s overlaps %s of peer %s of %s", network, peerNetwork,
+						peer.Identifier, dev.DeviceName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// siteEndpoint returns the endpoint that the other site connects to. The host must resolve and the interface must
+// have a fixed listen port.
+func siteEndpoint(dev wireguard.Device, override, defaultHost string) (string, error) {
+	endpoint := strings.TrimSpace(override)
+	if endpoint == "" {
+		if dev.ListenPort == 0 {
+			return "", errors.Errorf("interface %s uses a random listen port, set its listen port first", dev.DeviceName)
+		}
+		endpoint = dev.ResolveEndpoint(defaultHost)
+	}
+	if _, err := common.ValidateEndpoint(endpoint); err != nil {
+		return "", errors.WithMessagef(err, "the endpoint of %s is not reachable", dev.DeviceName)
+	}
+	return endpoint, nil
+}
+
+// sitePeer returns the peer of dev that represents the remote interface. The first network is the tunnel network of
+// the remote interface, its address is the peer address and all its networks are routed to it.
+func sitePeer(dev, remote wireguard.Device, remoteNetworks []*net.IPNet, remoteEndpoint string, keepalive int,
+	actor string) wireguard.Peer {
+	addresses := make([]string, 0)
+	for _, cidr := range remote.GetIPAddresses() {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil {
+			if common.IsIPv6(ip.String()) {
+				addresses = append(addresses, ip.String()+"/128")
+			} else {
+				addresses = append(addresses, ip.String()+"/32")
+			}
+		}
+	}
+	networks := make([]string, len(remoteNetworks))
+	for i := range remoteNetworks {
+		networks[i] = remoteNetworks[i].String()
+	}
+
+	peer := wireguard.Peer{
+		DeviceName:           dev.DeviceName,
+		DeviceType:           dev.Type,
+		Identifier:           "site " + remote.DeviceName,
+		Email:                actor,
+		Description:          "site-to-site link to " + remote.DeviceName,
+		IgnoreGlobalSettings: true,
+		Managed:              true,
+		PublicKey:            remote.PublicKey,
+		AllowedIPsStr:        common.ListToString(networks),
+		SiteEndpoint:         remoteEndpoint,
+		PersistentKeepalive:  keepalive,
+		OverrideKeepalive:    true,
+		CreatedBy:            actor,
+		UpdatedBy:            actor,
+	}
+	peer.SetIPAddresses(addresses...)
+	peer.AllowedIPsSrvStr = common.ListToString(networks)
+	removeCoveredNetworks(&peer)
+	return peer
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/h44z/wg-portal/internal/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	summaryTrafficPeriod = 24 * time.Hour // period of the traffic of the statistics collector
+)
+
+// Link states of the interface summary
+const (
+	LinkStateUp          = "up"
+	LinkStateDown        = "down"
+	LinkStateMissing     = "missing"     // the interface is stored in the database but does not exist on the system
+	LinkStateUnreachable = "unreachable" // the remote host of the interface cannot be reached
+	LinkStateExternal    = "external"    // the interface belongs to an external WireGuard server, see WG_EXTERNAL_DEVICES
+	LinkStateUnmanaged   = "unmanaged"   // a WireGuard interface of the host that is not in WG_DEVICES
+)
+
+// InterfaceSummary is the current state of an interface. The traffic since boot is the sum of the counters of the
+// peers on the physical interface, the recent traffic is only available if the statistics collector is enabled.
+type InterfaceSummary struct {
+	DeviceName     string
+	DisplayName    string `json:",omitempty"`
+	Host           string `json:",omitempty"` // the remote host of the interface
+	Type           wireguard.DeviceType
+	LinkState      string
+	ListenPort     int
+	TotalPeers     int // peers stored in the database
+	ActivePeers    int // peers configured on the physical interface
+	ConnectedPeers int // online peers, see wireguard.Config.ConnectionState
+	IdlePeers      int
+	ReceiveBytes   int64
+	TransmitBytes  int64
+	Unavailable    bool `json:",omitempty"` // the interface could not be read, the peer and traffic counters are missing
+
+	RecentReceiveBytes  *int64 `json:",omitempty"`
+	RecentTransmitBytes *int64 `json:",omitempty"`
+
+	StartupRestore   *InterfaceRestoreResult `json:",omitempty"` // nil if the interface was not restored on startup
+	EndpointFailures []EndpointCheckResult   `json:",omitempty"` // host name endpoints that could not be resolved by the last check
+}
+
+// GetInterfaceSummaries returns the summaries of all managed interfaces. Interfaces that do not exist on the system
+// or cannot be read are reported as missing or down instead of failing.
+func (s *Server) GetInterfaceSummaries() []InterfaceSummary {
+	summaries := make([]InterfaceSummary, 0, len(s.config.WG.DeviceNames))
+	for _, device := range s.config.WG.DeviceNames {
+		summaries = append(summaries, s.getInterfaceSummary(device))
+	}
+	return summaries
+}
+
+func (s *Server) getInterfaceSummary(device string) InterfaceSummary {
+	dev := s.peers.GetDevice(device)
+	summary := InterfaceSummary{
+		DeviceName:  device,
+		DisplayName: dev.DisplayName,
+		Host:        s.wg.Cfg.DeviceHosts[device],
+		Type:        dev.Type,
+		LinkState:   LinkStateMissing,
+		ListenPort:  dev.ListenPort,
+		TotalPeers:  int(s.peers.CountPeers(device)),
+	}
+
+	if result, ok := s.startupRestore[device]; ok {
+		summary.StartupRestore = &result
+	}
+	summary.EndpointFailures = s.GetEndpointFailures(device)
+	if s.config.WG.StatisticsInterval > 0 {
+		rx, tx := s.stats.GetDeviceTraffic(device, time.Now().Add(-summaryTrafficPeriod))
+		summary.RecentReceiveBytes, summary.RecentTransmitBytes = &rx, &tx
+	}
+
+	if s.wg.IsExternalDevice(device) {
+		summary.LinkState = LinkStateExternal
+		return summary
+	}
+	if s.wg.IsHostUnreachable(device) {
+		summary.LinkState = LinkStateUnreachable
+		summary.Unavailable = true
+		return summary
+	}
+	up, err := s.wg.IsLinkUp(device)
+	if err != nil {
+		summary.Unavailable = true
+		return summary
+	}
+	summary.LinkState = LinkStateDown
+	if up {
+		summary.LinkState = LinkStateUp
+	}
+
+	wgDevice, err := s.wg.GetDeviceInfo(device)
+	if err != nil {
+		summary.Unavailable = true
+		return summary
+	}
+	summary.addDeviceCounters(wgDevice, &s.config.WG)
+
+	return summary
+}
+
+// addDeviceCounters sets the listen port and adds the peer and traffic counters of the physical interface.
+func (summary *InterfaceSummary) addDeviceCounters(wgDevice *wgtypes.Device, cfg *wireguard.Config) {
+	now := time.Now()
+	summary.ListenPort = wgDevice.ListenPort
+	summary.ActivePeers = len(wgDevice.Peers)
+	for _, peer := range wgDevice.Peers {
+		summary.ReceiveBytes += peer.ReceiveBytes
+		summary.TransmitBytes += peer.TransmitBytes
+		switch cfg.ConnectionState(wgDevice.Name, peer.LastHandshakeTime, now) {
+		case wireguard.ConnectionStateOnline:
+			summary.ConnectedPeers++
+		case wireguard.ConnectionStateIdle:
+			summary.IdlePeers++
+		}
+	}
+}
+
+// TotalBytes returns the received and transmitted bytes.
+func (summary InterfaceSummary) TotalBytes() int64 {
+	return summary.ReceiveBytes + summary.TransmitBytes
+}
+
+// HostSummary aggregates the managed interfaces and the unmanaged WireGuard interfaces of the host. Interfaces that
+// cannot be read are part of the breakdown, but marked as unavailable and not included in the totals.
+type HostSummary struct {
+	Interfaces     int
+	Unavailable    int
+	TotalPeers     int
+	ActivePeers    int
+	ConnectedPeers int
+	IdlePeers      int
+	ReceiveBytes   int64
+	TransmitBytes  int64
+	Error          string `json:",omitempty"` // the interfaces of the host could not be listed, only managed ones are included
+
+	Breakdown []InterfaceSummary
+}
+
+// TotalBytes returns the received and transmitted bytes of all available interfaces.
+func (host HostSummary) TotalBytes() int64 {
+	return host.ReceiveBytes + host.TransmitBytes
+}
+
+// Sort keys of the breakdown of the host summary, the managed interfaces are listed in the configured order by default
+const (
+	HostSummarySortTraffic  = "traffic" // received and transmitted bytes, descending
+	HostSummarySortReceive  = "rx"
+	HostSummarySortTransmit = "tx"
+)
+
+// GetHostSummary returns the totals of all interfaces and the per-interface breakdown, sorted by the given key.
+func (s *Server) GetHostSummary(sortKey string) HostSummary {
+	host := HostSummary{Breakdown: s.GetInterfaceSummaries()}
+
+	wgDevices, err := s.wg.GetDevices()
+	if err != nil {
+		host.Error = err.Error()
+	}
+	for _, wgDevice := range wgDevices {
+		if common.ListContains(s.config.WG.DeviceNames, wgDevice.Name) {
+			continue
+		}
+		summary := InterfaceSummary{DeviceName: wgDevice.Name, LinkState: LinkStateUnmanaged}
+		summary.addDeviceCounters(wgDevice, &s.config.WG)
+		summary.TotalPeers = summary.ActivePeers
+		host.Breakdown = append(host.Breakdown, summary)
+	}
+
+	for _, summary := range host.Breakdown {
+		host.Interfaces++
+		if summary.Unavailable {
+			host.Unavailable++
+			continue
+		}
+		host.TotalPeers += summary.TotalPeers
+		host.ActivePeers += summary.ActivePeers
+		host.ConnectedPeers += summary.ConnectedPeers
+		host.IdlePeers += summary.IdlePeers
+		host.ReceiveBytes += summary.ReceiveBytes
+		host.TransmitBytes += summary.TransmitBytes
+	}
+
+	var value func(InterfaceSummary) int64
+	switch sortKey {
+	case HostSummarySortTraffic:
+		value = InterfaceSummary.TotalBytes
+	case HostSummarySortReceive:
+		value = func(summary InterfaceSummary) int64 { return summary.ReceiveBytes }
+	case HostSummarySortTransmit:
+		value = func(summary InterfaceSummary) int64 { return summary.TransmitBytes }
+	}
+	if value != nil {
+		sort.SliceStable(host.Breakdown, func(i, j int) bool {
+			return value(host.Breakdown[i]) > value(host.Breakdown[j])
+		})
+	}
+
+	return host
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/users"
+)
+
+const userValidityCacheSize = 10000 // entries, beyond this the expired and then arbitrary entries are dropped
+
+// userValidityCache caches whether the users of authenticated sessions are still active and whether they are
+// administrators, so that not every request reads the user from the database. Changes through the user manager
+// invalidate the entry of the user immediately. Changes of other instances sharing the database or of the
+// maintenance commands are noticed once the entry expired. All methods are safe for concurrent use.
+type userValidityCache struct {
+	ttl     time.Duration // 0 = every check reads the user
+	maxSize int
+	fetch   func(email string) *users.User
+
+	mux        sync.Mutex
+	entries    map[string]userValidity
+	generation uint64 // incremented by every invalidation, results of older lookups are not stored
+}
+
+type userValidity struct {
+	active    bool
+	admin     bool
+	checkedAt time.Time
+}
+
+func newUserValidityCache(ttl time.Duration, maxSize int, fetch func(email string) *users.User) *userValidityCache {
+	return &userValidityCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		fetch:   fetch,
+		entries: make(map[string]userValidity),
+	}
+}
+
+// Get reports whether the user exists and is active and whether the user is an administrator.
+func (c *userValidityCache) Get(email string) (active, admin bool) {
+	email = strings.ToLower(email)
+
+	c.mux.Lock()
+	entry, ok := c.entries[email]
+	generation := c.generation
+	c.mux.Unlock()
+	if ok && time.Since(entry.checkedAt) < c.ttl {
+		return entry.active, entry.admin
+	}
+
+	entry = userValidity{checkedAt: time.Now()}
+	if user := c.fetch(email); user != nil && user.IsActive() {
+		entry.active = true
+		entry.admin = user.IsAdmin
+	}
+	if c.ttl <= 0 {
+		return entry.active, entry.admin
+	}
+
+	c.mux.Lock()
+	// the user may have been changed while it was read, the next request reads it again
+	if c.generation == generation {
+		if _, exists := c.entries[email]; !exists && len(c.entries) >= c.maxSize {
+			c.evict(time.Now())
+		}
+		c.entries[email] = entry
+	}
+	c.mux.Unlock()
+
+	return entry.active, entry.admin
+}
+
+// Invalidate removes the entry of the user, the next check reads the user again.
+func (c *userValidityCache) Invalidate(email string) {
+	c.mux.Lock()
+	delete(c.entries, strings.ToLower(email))
+	c.generation++
+	c.mux.Unlock()
+}
+
+// InvalidateAll removes all entries, e.g. after users were changed directly in the database.
+func (c *userValidityCache) InvalidateAll() {
+	c.mux.Lock()
+	c.entries = make(map[string]userValidity)
+	c.generation++
+	c.mux.Unlock()
+}
+
+// evict drops the expired entries, or an arbitrary entry if none expired. The caller must hold the lock.
+func (c *userValidityCache) evict(now time.Time) {
+	for email, entry := range c.entries {
+		if now.Sub(entry.checkedAt) >= c.ttl {
+			delete(c.entries, email)
+		}
+	}
+	if len(c.entries) < c.maxSize {
+		return
+	}
+	for email := range c.entries {
+		delete(c.entries, email)
+		break
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/users"
+)
+
+// newUserCacheTestServer returns a server whose user validity cache never expires during the test, only the
+// invalidations of the user manager refresh the entries.
+func newUserCacheTestServer(t testing.TB) *Server {
+	return newTestServer(t, map[string]string{"USER_CACHE_TTL": "1h"})
+}
+
+func TestUserValidityCacheInvalidatedByUserManager(t *testing.T) {
+	s := newUserCacheTestServer(t)
+	user := &users.User{Email: "Alice@Example.org", Firstname: "Alice", IsAdmin: true}
+	if err := s.users.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if active, admin := s.userValidity.Get("alice@example.org"); !active || !admin {
+		t.Fatalf("new user: active %t, admin %t", active, admin)
+	}
+	generation := s.userValidity.generation
+
+	// disabling the user takes effect with the next request, not after the cache expired
+	user.State = users.UserStateRejected
+	if err := s.users.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if s.userValidity.generation == generation {
+		t.Error("the update did not increment the generation")
+	}
+	if active, _ := s.userValidity.Get("ALICE@example.org"); active {
+		t.Error("the disabled user is still active")
+	}
+
+	user.State = users.UserStateActive
+	user.IsAdmin = false
+	if err := s.users.UpdateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if active, admin := s.userValidity.Get(user.Email); !active || admin {
+		t.Errorf("re-enabled user: active %t, admin %t", active, admin)
+	}
+
+	generation = s.userValidity.generation
+	if err := s.users.DeleteUser(user); err != nil {
+		t.Fatal(err)
+	}
+	if s.userValidity.generation == generation {
+		t.Error("the deletion did not increment the generation")
+	}
+	if active, _ := s.userValidity.Get(user.Email); active {
+		t.Error("the deleted user is still active")
+	}
+}
+
+func TestUserValidityCacheDropsLookupsOlderThanInvalidation(t *testing.T) {
+	var cache *userValidityCache
+	fetches := 0
+	cache = newUserValidityCache(time.Hour, 10, func(email string) *users.User {
+		fetches++
+		if fetches == 1 {
+			// the user is changed while the first lookup reads it
+			cache.Invalidate(email)
+		}
+		return &users.User{Email: email}
+	})
+
+	cache.Get("alice@example.org")
+	if _, ok := cache.entries["alice@example.org"]; ok {
+		t.Fatal("the result of a lookup older than the invalidation was stored")
+	}
+	cache.Get("alice@example.org")
+	cache.Get("alice@example.org")
+	if fetches != 2 {
+		t.Errorf("user read %d times, want 2", fetches)
+	}
+}
+
+func TestUserValidityCacheEvictsBeyondMaxSize(t *testing.T) {
+	cache := newUserValidityCache(time.Hour, 3, func(email string) *users.User {
+		return &users.User{Email: email}
+	})
+	for i := 0; i < 10; i++ {
+		cache.Get(fmt.Sprintf("user%d@example.org", i))
+	}
+	if len(cache.entries) > 3 {
+		t.Errorf("%d entries cached, want at most 3", len(cache.entries))
+	}
+
+	uncached := newUserValidityCache(0, 3, func(email string) *users.User {
+		return &users.User{Email: email}
+	})
+	uncached.Get("user@example.org")
+	if len(uncached.entries) != 0 {
+		t.Error("entries are cached without a ttl")
+	}
+}
+
+func BenchmarkUserValidityCache(b *testing.B) {
+	s := newUserCacheTestServer(b)
+	const userCount = 100
+	for i := 0; i < userCount; i++ {
+		if err := s.users.CreateUser(&users.User{Email: fmt.Sprintf("user%d@example.org", i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for name, cache := range map[string]*userValidityCache{
+		"Cached":   s.userValidity,
+		"Uncached": newUserValidityCache(0, userValidityCacheSize, s.users.GetUser),
+	} {
+		cache := cache
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					cache.Get(fmt.Sprintf("user%d@example.org", i%userCount))
+					i++
+				}
+			})
+		})
+	}
+}
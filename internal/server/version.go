@@ -1,4 +1,3 @@
 package server
 
 var Version = "testbuild"
-var DatabaseVersion = "1.0.8"
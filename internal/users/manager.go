@@ -6,31 +6,21 @@ import (
 	"strings"
 	"time"
 
+	"github.com/h44z/wg-portal/internal/common"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
 
 type Manager struct {
 	db *gorm.DB
+
+	// OnChange is called after a user was created, updated or deleted through the manager.
+	OnChange func(email string)
 }
 
 func NewManager(db *gorm.DB) (*Manager, error) {
 	m := &Manager{db: db}
 
-	// check if old user table exists (from version <= 1.0.2), if so rename it to peers.
-	if m.db.Migrator().HasTable("users") && !m.db.Migrator().HasTable("peers") {
-		if err := m.db.Migrator().RenameTable("users", "peers"); err != nil {
-			return nil, errors.Wrapf(err, "failed to migrate old database structure")
-		} else {
-			logrus.Infof("upgraded database format from version v1.0.2")
-		}
-	}
-
-	if err := m.db.AutoMigrate(&User{}); err != nil {
-		return nil, errors.Wrap(err, "failed to migrate user database")
-	}
-
 	return m, nil
 }
 
@@ -46,6 +36,13 @@ func (m Manager) GetUsersUnscoped() []User {
 	return users
 }
 
+// GetUsersByState returns the users in the given approval state, oldest first.
+func (m Manager) GetUsersByState(state UserState) []User {
+	users := make([]User, 0)
+	m.db.Where("state = ?", state).Order("created_at").Find(&users)
+	return users
+}
+
 func (m Manager) UserExists(email string) bool {
 	return m.GetUser(email) != nil
 }
@@ -96,6 +93,51 @@ func (m Manager) GetFilteredAndSortedUsersUnscoped(sortKey, sortDirection, searc
 	return filteredUsers
 }
 
+// GetUsersPage returns one page of users, including deactivated ones, and the total number of users matching the
+// search. Filtering, sorting and pagination are done by the database. The search matches the users email, name, phone
+// and the public keys of their peers. A page size of 0 returns all matching users.
+func (m Manager) GetUsersPage(sortKey, sortDirection, search string, page, pageSize int) ([]User, int64) {
+	query := m.db.Unscoped().Model(&User{})
+	if search != "" {
+		pattern := common.SqlLikePattern(search)
+		query = query.Where("LOWER(email) LIKE ? ESCAPE '!' OR LOWER(firstname) LIKE ? ESCAPE '!' OR "+
+			"LOWER(lastname) LIKE ? ESCAPE '!' OR LOWER(phone) LIKE ? ESCAPE '!' OR "+
+			"email IN (SELECT email FROM peers WHERE LOWER(public_key) LIKE ? ESCAPE '!')",
+			pattern, pattern, pattern, pattern, pattern)
+	}
+
+	query = query.Session(&gorm.Session{}) // allow reuse of the query for counting and fetching
+
+	var total int64
+	query.Count(&total)
+
+	sortColumns := map[string]string{
+		"email":     "email",
+		"firstname": "firstname",
+		"lastname":  "lastname",
+		"phone":     "phone",
+		"source":    "source",
+		"admin":     "is_admin",
+	}
+	order, ok := sortColumns[sortKey]
+	if !ok {
+		order = "email"
+	}
+	if sortDirection == "desc" {
+		order += " DESC"
+	}
+	order += ", email" // the databases do not guarantee an order of equal values, pages need a stable order
+
+	users := make([]User, 0, pageSize)
+	pageQuery := query.Order(order)
+	if pageSize > 0 {
+		pageQuery = pageQuery.Offset((page - 1) * pageSize).Limit(pageSize)
+	}
+	pageQuery.Find(&users)
+
+	return users, total
+}
+
 func (m Manager) GetOrCreateUser(email string) (*User, error) {
 	email = strings.ToLower(email)
 
@@ -113,6 +155,7 @@ func (m Manager) GetOrCreateUser(email string) (*User, error) {
 		if res.Error != nil {
 			return nil, errors.Wrapf(res.Error, "failed to create user %s", email)
 		}
+		m.changed(email)
 	}
 
 	return &user, nil
@@ -135,6 +178,7 @@ func (m Manager) GetOrCreateUserUnscoped(email string) (*User, error) {
 		if res.Error != nil {
 			return nil, errors.Wrapf(res.Error, "failed to create user %s", email)
 		}
+		m.changed(email)
 	}
 
 	return &user, nil
@@ -148,6 +192,8 @@ func (m Manager) CreateUser(user *User) error {
 		return errors.Wrapf(res.Error, "failed to create user %s", user.Email)
 	}
 
+	m.changed(user.Email)
+
 	return nil
 }
 
@@ -158,6 +204,8 @@ func (m Manager) UpdateUser(user *User) error {
 		return errors.Wrapf(res.Error, "failed to update user %s", user.Email)
 	}
 
+	m.changed(user.Email)
+
 	return nil
 }
 
@@ -168,9 +216,18 @@ func (m Manager) DeleteUser(user *User) error {
 		return errors.Wrapf(res.Error, "failed to update user %s", user.Email)
 	}
 
+	m.changed(user.Email)
+
 	return nil
 }
 
+// changed notifies OnChange about the change of the user.
+func (m Manager) changed(email string) {
+	if m.OnChange != nil {
+		m.OnChange(email)
+	}
+}
+
 func sortUsers(users []User, key, direction string) {
 	sort.Slice(users, func(i, j int) bool {
 		var sortValueLeft string
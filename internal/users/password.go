@@ -0,0 +1,106 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy defines the requirements for passwords of local (database) users and the bcrypt cost that is used
+// to hash them.
+type PasswordPolicy struct {
+	MinLength        int  `yaml:"minLength" envconfig:"PASSWORD_MIN_LENGTH"`
+	RequireUppercase bool `yaml:"requireUppercase" envconfig:"PASSWORD_REQUIRE_UPPERCASE"`
+	RequireLowercase bool `yaml:"requireLowercase" envconfig:"PASSWORD_REQUIRE_LOWERCASE"`
+	RequireDigit     bool `yaml:"requireDigit" envconfig:"PASSWORD_REQUIRE_DIGIT"`
+	RequireSpecial   bool `yaml:"requireSpecial" envconfig:"PASSWORD_REQUIRE_SPECIAL"` // any character that is not a letter or digit
+	HashCost         int  `yaml:"hashCost" envconfig:"PASSWORD_HASH_COST"`             // bcrypt cost, stored hashes with a lower cost are rehashed on login
+}
+
+// Validate checks the password against the policy. The error names all rules that the password violates.
+func (p PasswordPolicy) Validate(password string) error {
+	var hasUpper, hasLower, hasDigit, hasSpecial bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case !unicode.IsLetter(r):
+			hasSpecial = true
+		}
+	}
+
+	violations := make([]string, 0)
+	if len([]rune(password)) < p.MinLength {
+		violations = append(violations, fmt.Sprintf("be at least %d characters long", p.MinLength))
+	}
+	if p.RequireUppercase && !hasUpper {
+		violations = append(violations, "contain an uppercase letter")
+	}
+	if p.RequireLowercase && !hasLower {
+		violations = append(violations, "contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		violations = append(violations, "contain a digit")
+	}
+	if p.RequireSpecial && !hasSpecial {
+		violations = append(violations, "contain a special character")
+	}
+	if len(violations) > 0 {
+		return errors.New("the password must " + strings.Join(violations, ", "))
+	}
+
+	return nil
+}
+
+// Description summarizes the policy for form help texts.
+func (p PasswordPolicy) Description() string {
+	rules := []string{fmt.Sprintf("at least %d characters", p.MinLength)}
+	if p.RequireUppercase {
+		rules = append(rules, "an uppercase letter")
+	}
+	if p.RequireLowercase {
+		rules = append(rules, "a lowercase letter")
+	}
+	if p.RequireDigit {
+		rules = append(rules, "a digit")
+	}
+	if p.RequireSpecial {
+		rules = append(rules, "a special character")
+	}
+
+	return "Passwords need " + strings.Join(rules, ", ") + "."
+}
+
+func (p PasswordPolicy) hashCost() int {
+	if p.HashCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return p.HashCost
+}
+
+// Hash hashes the password with bcrypt and the configured cost.
+func (p PasswordPolicy) Hash(password string) (PrivateString, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), p.hashCost())
+	if err != nil {
+		return "", errors.Wrap(err, "unable to hash password")
+	}
+
+	return PrivateString(hash), nil
+}
+
+// NeedsRehash reports whether the stored hash was created with a lower cost than the configured one.
+func (p PasswordPolicy) NeedsRehash(hash PrivateString) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false // not a bcrypt hash, the login fails anyway
+	}
+
+	return cost < p.hashCost()
+}
@@ -10,10 +10,32 @@ type UserSource string
 
 const (
 	UserSourceLdap     UserSource = "ldap" // LDAP / ActiveDirectory
-	UserSourceDatabase UserSource = "db"   // sqlite / mysql database
+	UserSourceDatabase UserSource = "db"   // sqlite / mysql / postgres database
 	UserSourceOIDC     UserSource = "oidc" // open id connect, TODO: implement
 )
 
+// Theme is the user interface color theme.
+type Theme string
+
+const (
+	ThemeSystem Theme = "system" // follow the color scheme preference of the browser
+	ThemeLight  Theme = "light"
+	ThemeDark   Theme = "dark"
+)
+
+func (t Theme) IsValid() bool {
+	return t == ThemeSystem || t == ThemeLight || t == ThemeDark
+}
+
+// UserState is the approval state of a user. Only active users can log in.
+type UserState string
+
+const (
+	UserStateActive   UserState = "active"
+	UserStatePending  UserState = "pending"  // self-registered, waiting for the approval of an administrator
+	UserStateRejected UserState = "rejected" // self-registration was rejected, the entry is kept as a record
+)
+
 type PrivateString string
 
 func (PrivateString) MarshalJSON() ([]byte, error) {
@@ -36,6 +58,17 @@ type User struct {
 	Lastname  string `form:"lastname" binding:"required"`
 	Phone     string `form:"phone" binding:"omitempty"`
 
+	// optional, synchronized from LDAP
+	Username    string `form:"-"`
+	DisplayName string `form:"-"`
+
+	// user interface preferences
+	Theme Theme `gorm:"default:system" form:"-"`
+
+	// self registration
+	State       UserState `gorm:"default:active;index" form:"-"`
+	StateReason string    `form:"-"` // reason for the rejection of a registration
+
 	// optional, integrated password authentication
 	Password PrivateString `form:"password" binding:"omitempty"`
 
@@ -44,3 +77,8 @@ type User struct {
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index" json:",omitempty" swaggertype:"string"`
 }
+
+// IsActive reports whether the user has been approved. Users created before the approval workflow have no state.
+func (u User) IsActive() bool {
+	return u.State == "" || u.State == UserStateActive
+}
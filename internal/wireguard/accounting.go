@@ -0,0 +1,142 @@
+package wireguard
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Formats of the traffic accounting periods, in the local time of the portal. They sort like the dates they represent.
+const (
+	TrafficDayFormat   = "2006-01-02"
+	TrafficMonthFormat = "2006-01"
+)
+
+// PeerTrafficDay is the traffic of a peer on one day. The owner of the peer is stored with the traffic, so that the
+// accounting stays correct if the peer is assigned to another user or deleted later.
+type PeerTrafficDay struct {
+	ID            uint   `gorm:"primaryKey"`
+	Day           string `gorm:"index;size:10"`
+	PublicKey     string `gorm:"index"`
+	DeviceName    string
+	Identifier    string
+	Email         string `gorm:"index"` // empty for peers without user
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// UserTrafficMonth is the traffic of all peers of a user in one month.
+type UserTrafficMonth struct {
+	ID            uint   `gorm:"primaryKey"`
+	Month         string `gorm:"index;size:7"`
+	Email         string `gorm:"index"` // empty for peers without user
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// TotalBytes returns the received and transmitted bytes.
+func (m UserTrafficMonth) TotalBytes() int64 {
+	return m.ReceiveBytes + m.TransmitBytes
+}
+
+// account adds the traffic deltas of the stored samples of a device to the daily and monthly traffic.
+func (c *StatisticsCollector) account(device string, stats []PeerStatistic) error {
+	peers := make([]Peer, 0)
+	if err := c.db.Select("public_key", "identifier", "email").Where("device_name = ?", device).
+		Find(&peers).Error; err != nil {
+		return errors.WithMessage(err, "failed to load peers")
+	}
+	owners := make(map[string]Peer, len(peers))
+	for _, peer := range peers {
+		owners[peer.PublicKey] = peer
+	}
+
+	return c.db.Transaction(func(tx *gorm.DB) error {
+		for _, stat := range stats {
+			if stat.ReceiveDelta == 0 && stat.TransmitDelta == 0 {
+				continue
+			}
+			owner := owners[stat.PublicKey]
+			day := PeerTrafficDay{
+				Day:        stat.CollectedAt.Format(TrafficDayFormat),
+				PublicKey:  stat.PublicKey,
+				DeviceName: device,
+				Identifier: owner.Identifier,
+				Email:      owner.Email,
+			}
+			if err := addTraffic(tx, &day, map[string]interface{}{"day": day.Day, "public_key": day.PublicKey,
+				"device_name": day.DeviceName, "email": day.Email}, stat); err != nil {
+				return err
+			}
+			month := UserTrafficMonth{Month: stat.CollectedAt.Format(TrafficMonthFormat), Email: owner.Email}
+			if err := addTraffic(tx, &month, map[string]interface{}{"month": month.Month, "email": month.Email},
+				stat); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// addTraffic adds the deltas of the sample to the traffic bucket matching the key, the bucket is created if missing.
+func addTraffic(tx *gorm.DB, bucket interface{}, key map[string]interface{}, stat PeerStatistic) error {
+	res := tx.Model(bucket).Where(key).Updates(map[string]interface{}{
+		"receive_bytes":  gorm.Expr("receive_bytes + ?", stat.ReceiveDelta),
+		"transmit_bytes": gorm.Expr("transmit_bytes + ?", stat.TransmitDelta),
+	})
+	if res.Error != nil {
+		return errors.WithMessage(res.Error, "failed to update traffic")
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
+	switch b := bucket.(type) {
+	case *PeerTrafficDay:
+		b.ReceiveBytes, b.TransmitBytes = stat.ReceiveDelta, stat.TransmitDelta
+	case *UserTrafficMonth:
+		b.ReceiveBytes, b.TransmitBytes = stat.ReceiveDelta, stat.TransmitDelta
+	}
+	if err := tx.Create(bucket).Error; err != nil {
+		return errors.WithMessage(err, "failed to store traffic")
+	}
+	return nil
+}
+
+// GetDailyTraffic returns the traffic of the peers from the first to the last day (YYYY-MM-DD), both included.
+func (c *StatisticsCollector) GetDailyTraffic(from, to string) []PeerTrafficDay {
+	days := make([]PeerTrafficDay, 0)
+	c.db.Where("day >= ? AND day <= ?", from, to).Order("day, email, device_name, identifier").Find(&days)
+	return days
+}
+
+// GetMonthlyTraffic returns the traffic of the users from the first to the last month (YYYY-MM), both included.
+func (c *StatisticsCollector) GetMonthlyTraffic(from, to string) []UserTrafficMonth {
+	months := make([]UserTrafficMonth, 0)
+	c.db.Where("month >= ? AND month <= ?", from, to).Order("month, email").Find(&months)
+	return months
+}
+
+// pruneTraffic removes the daily and monthly traffic older than the configured retentions. A period is only removed
+// when it is completely older than the retention.
+func (c *StatisticsCollector) pruneTraffic() {
+	now := time.Now()
+	if retention := c.wg.Cfg.TrafficDailyRetention; retention > 0 {
+		res := c.db.Where("day < ?", now.Add(-retention).Format(TrafficDayFormat)).Delete(&PeerTrafficDay{})
+		if res.Error != nil {
+			logrus.Errorf("failed to prune daily peer traffic: %v", res.Error)
+		} else if res.RowsAffected > 0 {
+			logrus.Debugf("pruned %d daily peer traffic entries", res.RowsAffected)
+		}
+	}
+	if retention := c.wg.Cfg.TrafficMonthlyRetention; retention > 0 {
+		res := c.db.Where("month < ?", now.Add(-retention).Format(TrafficMonthFormat)).Delete(&UserTrafficMonth{})
+		if res.Error != nil {
+			logrus.Errorf("failed to prune monthly user traffic: %v", res.Error)
+		} else if res.RowsAffected > 0 {
+			logrus.Debugf("pruned %d monthly user traffic entries", res.RowsAffected)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package wireguard
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// deviceCache stores snapshots of WireGuard devices for a short time. Concurrent reads of the same device share a
+// single request to the kernel. All methods are safe for concurrent use.
+type deviceCache struct {
+	ttl   time.Duration
+	fetch func(device string) (*wgtypes.Device, error)
+
+	mux     sync.Mutex
+	entries map[string]*deviceCacheEntry
+}
+
+type deviceCacheEntry struct {
+	done      chan struct{} // closed once the device was fetched
+	device    *wgtypes.Device
+	err       error
+	fetchedAt time.Time
+}
+
+func newDeviceCache(ttl time.Duration, fetch func(device string) (*wgtypes.Device, error)) *deviceCache {
+	return &deviceCache{
+		ttl:     ttl,
+		fetch:   fetch,
+		entries: make(map[string]*deviceCacheEntry),
+	}
+}
+
+// Get returns a copy of the cached device, the device is fetched if the snapshot is older than the TTL.
+func (c *deviceCache) Get(device string) (*wgtypes.Device, error) {
+	c.mux.Lock()
+	entry, ok := c.entries[device]
+	if ok {
+		select {
+		case <-entry.done:
+			if entry.err != nil || time.Since(entry.fetchedAt) >= c.ttl {
+				ok = false // expired, failed requests are not cached
+			}
+		default: // another request is in progress, wait for it
+		}
+	}
+	if !ok {
+		entry = c.load(device)
+	}
+	c.mux.Unlock()
+
+	<-entry.done
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return copyDevice(entry.device), nil
+}
+
+// Refresh fetches the device, ignoring the cached snapshot. Requests that are waiting for an older snapshot are not
+// affected.
+func (c *deviceCache) Refresh(device string) (*wgtypes.Device, error) {
+	c.mux.Lock()
+	entry := c.load(device)
+	c.mux.Unlock()
+
+	<-entry.done
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	return copyDevice(entry.device), nil
+}
+
+// Invalidate removes the snapshot of the given device, the next read fetches the device again.
+func (c *deviceCache) Invalidate(device string) {
+	c.mux.Lock()
+	delete(c.entries, device)
+	c.mux.Unlock()
+}
+
+// load starts fetching the device, the caller must hold the lock.
+func (c *deviceCache) load(device string) *deviceCacheEntry {
+	entry := &deviceCacheEntry{done: make(chan struct{})}
+	c.entries[device] = entry
+
+	go func() {
+		entry.device, entry.err = c.fetch(device)
+		entry.fetchedAt = time.Now()
+		close(entry.done)
+	}()
+
+	return entry
+}
+
+// copyDevice returns a copy of the device so that callers cannot modify the cached snapshot.
+func copyDevice(dev *wgtypes.Device) *wgtypes.Device {
+	cpy := *dev
+	cpy.Peers = make([]wgtypes.Peer, len(dev.Peers))
+	for i, peer := range dev.Peers {
+		cpy.Peers[i] = peer
+		cpy.Peers[i].AllowedIPs = make([]net.IPNet, len(peer.AllowedIPs))
+		copy(cpy.Peers[i].AllowedIPs, peer.AllowedIPs)
+	}
+	return &cpy
+}
@@ -1,12 +1,62 @@
 package wireguard
 
-import "github.com/h44z/wg-portal/internal/common"
+import (
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+)
 
 type Config struct {
-	DeviceNames         []string `yaml:"devices" envconfig:"WG_DEVICES"`              // managed devices
-	DefaultDeviceName   string   `yaml:"defaultDevice" envconfig:"WG_DEFAULT_DEVICE"` // this device is used for auto-created peers, use GetDefaultDeviceName() to access this field
-	ConfigDirectoryPath string   `yaml:"configDirectory" envconfig:"WG_CONFIG_PATH"`  // optional, if set, updates will be written to this path, filename: <devicename>.conf
-	ManageIPAddresses   bool     `yaml:"manageIPAddresses" envconfig:"MANAGE_IPS"`    // handle ip-address setup of interface
+	DeviceNames         []string `yaml:"devices" envconfig:"WG_DEVICES"`                              // managed devices
+	DefaultDeviceName   string   `yaml:"defaultDevice" envconfig:"WG_DEFAULT_DEVICE"`                 // this device is used for auto-created peers, use GetDefaultDeviceName() to access this field
+	ConfigDirectoryPath string   `yaml:"configDirectory" envconfig:"WG_CONFIG_PATH"`                  // optional, if set, updates will be written to this path, filename: <devicename>.conf
+	ConfigPostWriteCmd  string   `yaml:"configPostWriteCommand" envconfig:"WG_CONFIG_POST_WRITE_CMD"` // optional shell command that is run after a config file was written, %i is replaced by the interface name
+	ManageIPAddresses   bool     `yaml:"manageIPAddresses" envconfig:"MANAGE_IPS"`                    // handle ip-address setup of interface
+	ManageInterfaces    bool     `yaml:"manageInterfaces" envconfig:"MANAGE_INTERFACES"`              // create missing interfaces on startup
+	ManageFirewall      bool     `yaml:"manageFirewall" envconfig:"MANAGE_FIREWALL"`                  // create nftables masquerade rules for interfaces with an upstream interface
+	ManageRoutes        bool     `yaml:"manageRoutes" envconfig:"MANAGE_ROUTES"`                      // install routes for the server side allowed IPs of the peers
+	PruneUnknownPeers   bool     `yaml:"pruneUnknownPeers" envconfig:"WG_PRUNE_UNKNOWN_PEERS"`        // remove peers that are not stored in the database instead of importing them
+	RestoreOnStartup    bool     `yaml:"restoreOnStartup" envconfig:"WG_RESTORE_ON_STARTUP"`          // apply the stored interfaces and peers on startup, disable it if another tool owns the interfaces
+	DefaultEndpointHost string   `yaml:"defaultEndpointHost" envconfig:"WG_DEFAULT_ENDPOINT_HOST"`    // host of the peer endpoint if an interface has no endpoint, defaults to the host of the external url
+
+	Backend         Backend `yaml:"backend" envconfig:"WG_BACKEND"`                  // backend for interfaces created by the portal: kernel, userspace or auto
+	UserspaceBinary string  `yaml:"userspaceBinary" envconfig:"WG_USERSPACE_BINARY"` // the wireguard-go binary that creates userspace interfaces
+
+	DeviceBackends map[string]Backend `yaml:"deviceBackends" envconfig:"WG_DEVICE_BACKENDS"` // backend of single interfaces, overrides the backend
+
+	KeyEncryptionKey     string `yaml:"keyEncryptionKey" envconfig:"WG_KEY_ENCRYPTION_KEY"`          // base64 encoded 32 byte master key, the private and preshared keys are stored encrypted with it
+	KeyEncryptionKeyFile string `yaml:"keyEncryptionKeyFile" envconfig:"WG_KEY_ENCRYPTION_KEY_FILE"` // file that contains the master key, alternative to WG_KEY_ENCRYPTION_KEY
+
+	Hosts       []HostConfig      `yaml:"hosts" ignored:"true"`                    // remote hosts that are managed over SSH, only configurable in the yaml file
+	DeviceHosts map[string]string `yaml:"deviceHosts" envconfig:"WG_DEVICE_HOSTS"` // interfaces that are managed on a remote host, interface name -> host name
+
+	ExternalDevices []string `yaml:"externalDevices" envconfig:"WG_EXTERNAL_DEVICES"` // interfaces of an external WireGuard server, only the peers and their configs are managed
+
+	ExecuteHooks bool          `yaml:"executeHooks" envconfig:"WG_EXECUTE_HOOKS"` // opt-in, run the PreUp, PostUp, PreDown and PostDown hooks when the portal brings an interface up or down
+	HookTimeout  time.Duration `yaml:"hookTimeout" envconfig:"WG_HOOK_TIMEOUT"`   // timeout of a single hook
+
+	DeviceCacheTTL time.Duration `yaml:"deviceCacheTTL" envconfig:"WG_DEVICE_CACHE_TTL"` // device reads are cached for this duration, 0 disables the cache
+
+	EndpointCheckInterval time.Duration `yaml:"endpointCheckInterval" envconfig:"WG_ENDPOINT_CHECK_INTERVAL"` // interval of the DNS check of host name endpoints, 0 disables the check
+	ResolvePeerEndpoints  bool          `yaml:"resolvePeerEndpoints" envconfig:"WG_RESOLVE_PEER_ENDPOINTS"`   // update the endpoints of peers on the interfaces if their host name resolves to a new address
+
+	StatisticsInterval         time.Duration `yaml:"statisticsInterval" envconfig:"WG_STATS_INTERVAL"`                       // poll interval of the peer statistics collector, 0 disables the collector
+	StatisticsRetention        time.Duration `yaml:"statisticsRetention" envconfig:"WG_STATS_RETENTION"`                     // samples older than this are removed, 0 keeps all samples
+	ConnectionHistoryRetention time.Duration `yaml:"connectionHistoryRetention" envconfig:"WG_CONNECTION_HISTORY_RETENTION"` // connections of peers older than this are removed, 0 keeps all connections
+	TrafficDailyRetention      time.Duration `yaml:"trafficDailyRetention" envconfig:"WG_TRAFFIC_DAILY_RETENTION"`           // daily traffic of the peers older than this is removed, 0 keeps all days
+	TrafficMonthlyRetention    time.Duration `yaml:"trafficMonthlyRetention" envconfig:"WG_TRAFFIC_MONTHLY_RETENTION"`       // monthly traffic of the users older than this is removed, 0 keeps all months
+
+	OnlineHandshakeAge        time.Duration            `yaml:"onlineHandshakeAge" envconfig:"WG_ONLINE_HANDSHAKE_AGE"`                // peers with a more recent handshake are online
+	IdleHandshakeAge          time.Duration            `yaml:"idleHandshakeAge" envconfig:"WG_IDLE_HANDSHAKE_AGE"`                    // peers with an older handshake are offline, in between idle
+	DeviceOnlineHandshakeAges map[string]time.Duration `yaml:"deviceOnlineHandshakeAges" envconfig:"WG_DEVICE_ONLINE_HANDSHAKE_AGES"` // online threshold of single interfaces, overrides the online threshold
+	DeviceIdleHandshakeAges   map[string]time.Duration `yaml:"deviceIdleHandshakeAges" envconfig:"WG_DEVICE_IDLE_HANDSHAKE_AGES"`     // idle threshold of single interfaces, overrides the idle threshold
+
+	InactivityExemptAdmins bool `yaml:"inactivityExemptAdmins" envconfig:"WG_INACTIVITY_EXEMPT_ADMINS"` // never disable peers of administrators due to inactivity
+	InactivityNotifyOwner  bool `yaml:"inactivityNotifyOwner" envconfig:"WG_INACTIVITY_NOTIFY_OWNER"`   // send an email to the owner of a peer that was disabled due to inactivity
+
+	PeerDefaults PeerDefaults `yaml:"peerDefaults"` // inherited by interfaces that do not override them
+
+	AllowedIPsPresets []AllowedIPsPresetConfig `yaml:"allowedIPsPresets" ignored:"true"` // presets that are created at startup, only configurable in the yaml file
 }
 
 func (c Config) GetDefaultDeviceName() string {
@@ -15,3 +65,27 @@ func (c Config) GetDefaultDeviceName() string {
 	}
 	return c.DefaultDeviceName
 }
+
+// PeerDefaults are the global defaults for new peers. Interfaces inherit each of them unless they override it, see
+// the Inherit* fields of Device.
+type PeerDefaults struct {
+	DNSStr              string `yaml:"dns" envconfig:"WG_DEFAULT_DNS"`                       // comma separated list of DNS servers and search domains
+	AllowedIPsStr       string `yaml:"allowedIPs" envconfig:"WG_DEFAULT_ALLOWED_IPS"`        // comma separated list of the allowed IPs of the client config files
+	PersistentKeepalive int    `yaml:"persistentKeepalive" envconfig:"WG_DEFAULT_KEEPALIVE"` // in seconds, 0 = off
+}
+
+// apply replaces the inherited peer defaults of the device with the global ones.
+func (d PeerDefaults) apply(device *Device) {
+	if device.Type != DeviceTypeServer {
+		return
+	}
+	if device.InheritDNS {
+		device.DNSStr = d.DNSStr
+	}
+	if device.InheritAllowedIPs {
+		device.DefaultAllowedIPsStr = d.AllowedIPsStr
+	}
+	if device.InheritKeepalive {
+		device.DefaultPersistentKeepalive = d.PersistentKeepalive
+	}
+}
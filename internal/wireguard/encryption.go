@@ -0,0 +1,348 @@
+package wireguard
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// Encrypted keys are stored as "enc:v1:<key id>:<base64 of nonce and ciphertext>". WireGuard keys are base64 encoded,
+// they never contain a colon.
+const encryptedKeyPrefix = "enc:v1:"
+
+const keyCipherSetting = "wireguard:key_cipher"
+
+// KeyCipher encrypts the private and preshared keys of the interfaces and peers with AES-256-GCM before they are
+// stored. Keys that were encrypted with a previous master key are decrypted with it, see AddPreviousKey.
+type KeyCipher struct {
+	id    string                 // identifies the master key in the encrypted values
+	aeads map[string]cipher.AEAD // by key id, the current and the previous master keys
+}
+
+// ParseMasterKey decodes a base64 encoded master key of 32 bytes.
+func ParseMasterKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("the master key must be a base64 encoded 32 byte key, e.g. from " +
+			"\"head -c 32 /dev/urandom | base64\"")
+	}
+	return key, nil
+}
+
+// NewKeyCipher creates the cipher of the master key, new values are encrypted with it.
+func NewKeyCipher(masterKey []byte) (*KeyCipher, error) {
+	c := &KeyCipher{aeads: make(map[string]cipher.AEAD)}
+	id, err := c.add(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	c.id = id
+	return c, nil
+}
+
+// LoadKeyCipher returns the cipher of the master key of WG_KEY_ENCRYPTION_KEY or WG_KEY_ENCRYPTION_KEY_FILE, nil if
+// no master key is configured.
+func LoadKeyCipher(cfg Config) (*KeyCipher, error) {
+	value := cfg.KeyEncryptionKey
+	if cfg.KeyEncryptionKeyFile != "" {
+		if value != "" {
+			return nil, errors.New("WG_KEY_ENCRYPTION_KEY and WG_KEY_ENCRYPTION_KEY_FILE are mutually exclusive")
+		}
+		raw, err := ioutil.ReadFile(cfg.KeyEncryptionKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the master key")
+		}
+		value = string(raw)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	masterKey, err := ParseMasterKey(value)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyCipher(masterKey)
+}
+
+// AddPreviousKey adds a master key that is only used for decryption, e.g. while the keys are encrypted again with a
+// new master key.
+func (c *KeyCipher) AddPreviousKey(masterKey []byte) error {
+	_, err := c.add(masterKey)
+	return err
+}
+
+func (c *KeyCipher) add(masterKey []byte) (string, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid master key")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid master key")
+	}
+	// the id is derived from the master key, so that a missing or wrong master key is reported as such
+	sum := sha256.Sum256(append([]byte("wg-portal key id:"), masterKey...))
+	id := hex.EncodeToString(sum[:4])
+	c.aeads[id] = aead
+	return id, nil
+}
+
+// ID identifies the master key in the encrypted values.
+func (c *KeyCipher) ID() string {
+	return c.id
+}
+
+// IsEncryptedKey reports whether the stored value is an encrypted key.
+func IsEncryptedKey(value string) bool {
+	return strings.HasPrefix(value, encryptedKeyPrefix)
+}
+
+// encryptedKeyID returns the id of the master key of an encrypted value.
+func encryptedKeyID(value string) string {
+	return strings.SplitN(strings.TrimPrefix(value, encryptedKeyPrefix), ":", 2)[0]
+}
+
+// Encrypt encrypts a key. Empty and already encrypted values are returned unchanged.
+func (c *KeyCipher) Encrypt(key string) (string, error) {
+	if key == "" || IsEncryptedKey(key) {
+		return key, nil
+	}
+	aead := c.aeads[c.id]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrap(err, "failed to generate nonce")
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(key), nil)
+	return encryptedKeyPrefix + c.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts an encrypted key. Plaintext values are returned unchanged.
+func (c *KeyCipher) Decrypt(value string) (string, error) {
+	if !IsEncryptedKey(value) {
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedKeyPrefix), ":", 2)
+	aead, ok := c.aeads[parts[0]]
+	if !ok || len(parts) != 2 {
+		return "", errors.Errorf("the key is encrypted with the unknown master key %s", parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("the encrypted key is corrupted")
+	}
+	key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Errorf("failed to decrypt the key with the master key %s", parts[0])
+	}
+	return string(key), nil
+}
+
+// WithKeyCipher returns a database handle that encrypts the keys of the interfaces and peers when they are saved and
+// decrypts them when they are read, see the hooks of Device and Peer. A nil cipher returns the handle unchanged.
+func WithKeyCipher(db *gorm.DB, c *KeyCipher) *gorm.DB {
+	if c == nil {
+		return db
+	}
+	return db.Set(keyCipherSetting, c).Session(&gorm.Session{})
+}
+
+func keyCipherOf(tx *gorm.DB) *KeyCipher {
+	if c, ok := tx.Get(keyCipherSetting); ok {
+		return c.(*KeyCipher)
+	}
+	return nil
+}
+
+func encryptKeys(tx *gorm.DB, keys ...*string) error {
+	c := keyCipherOf(tx)
+	if c == nil {
+		return nil
+	}
+	for _, key := range keys {
+		encrypted, err := c.Encrypt(*key)
+		if err != nil {
+			return err
+		}
+		*key = encrypted
+	}
+	return nil
+}
+
+func decryptKeys(tx *gorm.DB, keys ...*string) error {
+	c := keyCipherOf(tx)
+	for _, key := range keys {
+		if !IsEncryptedKey(*key) {
+			continue
+		}
+		if c == nil {
+			return errors.New("the key is encrypted, but no master key is configured")
+		}
+		decrypted, err := c.Decrypt(*key)
+		if err != nil {
+			return err
+		}
+		*key = decrypted
+	}
+	return nil
+}
+
+// BeforeSave encrypts the private key, AfterSave restores the plaintext for the caller.
+func (d *Device) BeforeSave(tx *gorm.DB) error { return encryptKeys(tx, &d.PrivateKey) }
+func (d *Device) AfterSave(tx *gorm.DB) error  { return decryptKeys(tx, &d.PrivateKey) }
+func (d *Device) AfterFind(tx *gorm.DB) error  { return decryptKeys(tx, &d.PrivateKey) }
+
+// BeforeSave encrypts the private and the preshared key, AfterSave restores the plaintext for the caller.
+func (p *Peer) BeforeSave(tx *gorm.DB) error { return encryptKeys(tx, &p.PrivateKey, &p.PresharedKey) }
+func (p *Peer) AfterSave(tx *gorm.DB) error  { return decryptKeys(tx, &p.PrivateKey, &p.PresharedKey) }
+func (p *Peer) AfterFind(tx *gorm.DB) error  { return decryptKeys(tx, &p.PrivateKey, &p.PresharedKey) }
+
+// StoredKeys counts the stored private and preshared keys of the interfaces and peers, empty keys are not counted.
+type StoredKeys struct {
+	Plaintext int
+	Current   int            // encrypted with the current master key
+	Previous  int            // encrypted with a previous master key of the cipher
+	Unknown   map[string]int // encrypted with master keys that are not configured, by key id
+}
+
+// Check fails if keys are encrypted with master keys that are not configured, they cannot be used.
+func (k StoredKeys) Check() error {
+	if len(k.Unknown) == 0 {
+		return nil
+	}
+	count := 0
+	ids := make([]string, 0, len(k.Unknown))
+	for id, n := range k.Unknown {
+		count += n
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return errors.Errorf("%d stored keys are encrypted with the master key %s, configure it in "+
+		"WG_KEY_ENCRYPTION_KEY or WG_KEY_ENCRYPTION_KEY_FILE", count, strings.Join(ids, ", "))
+}
+
+// CountStoredKeys reads the stored keys without decrypting them, c may be nil.
+func CountStoredKeys(db *gorm.DB, c *KeyCipher) (StoredKeys, error) {
+	counts := StoredKeys{Unknown: make(map[string]int)}
+	raw := db.Session(&gorm.Session{SkipHooks: true})
+
+	var values, peerKeys, presharedKeys []string
+	if err := raw.Model(&Device{}).Pluck("private_key", &values).Error; err != nil {
+		return counts, errors.Wrap(err, "failed to read the interface keys")
+	}
+	if err := raw.Model(&Peer{}).Pluck("private_key", &peerKeys).Error; err != nil {
+		return counts, errors.Wrap(err, "failed to read the peer keys")
+	}
+	if err := raw.Model(&Peer{}).Pluck("preshared_key", &presharedKeys).Error; err != nil {
+		return counts, errors.Wrap(err, "failed to read the preshared keys")
+	}
+	values = append(append(values, peerKeys...), presharedKeys...)
+
+	for _, value := range values {
+		switch id := encryptedKeyID(value); {
+		case value == "":
+		case !IsEncryptedKey(value):
+			counts.Plaintext++
+		case c != nil && id == c.id:
+			counts.Current++
+		case c != nil && c.aeads[id] != nil:
+			counts.Previous++
+		default:
+			counts.Unknown[id]++
+		}
+	}
+	return counts, nil
+}
+
+// KeyEncryptionResult counts the keys that were changed by EncryptStoredKeys.
+type KeyEncryptionResult struct {
+	Encrypted   int // plaintext keys that were encrypted
+	Reencrypted int // keys of a previous master key that were encrypted with the current master key
+	Unchanged   int // keys that were already encrypted with the current master key
+}
+
+func (r *KeyEncryptionResult) encrypt(c *KeyCipher, key *string) (bool, error) {
+	switch {
+	case *key == "":
+		return false, nil
+	case !IsEncryptedKey(*key):
+		r.Encrypted++
+	case encryptedKeyID(*key) == c.id:
+		r.Unchanged++
+		return false, nil
+	default:
+		plaintext, err := c.Decrypt(*key)
+		if err != nil {
+			return false, err
+		}
+		*key = plaintext
+		r.Reencrypted++
+	}
+
+	encrypted, err := c.Encrypt(*key)
+	if err != nil {
+		return false, err
+	}
+	*key = encrypted
+	return true, nil
+}
+
+// EncryptStoredKeys encrypts the plaintext keys of the interfaces and peers with the current master key of the cipher
+// and encrypts the keys of previous master keys again. All keys are changed in one transaction.
+func EncryptStoredKeys(db *gorm.DB, c *KeyCipher) (KeyEncryptionResult, error) {
+	result := KeyEncryptionResult{}
+
+	err := db.Session(&gorm.Session{SkipHooks: true}).Transaction(func(tx *gorm.DB) error {
+		devices := make([]Device, 0)
+		if err := tx.Find(&devices).Error; err != nil {
+			return errors.Wrap(err, "failed to read the interfaces")
+		}
+		for _, device := range devices {
+			changed, err := result.encrypt(c, &device.PrivateKey)
+			if err != nil {
+				return errors.WithMessagef(err, "private key of interface %s", device.DeviceName)
+			}
+			if changed {
+				if err := tx.Model(&Device{}).Where("device_name = ?", device.DeviceName).
+					UpdateColumn("private_key", device.PrivateKey).Error; err != nil {
+					return errors.Wrapf(err, "failed to store the key of interface %s", device.DeviceName)
+				}
+			}
+		}
+
+		peers := make([]Peer, 0)
+		if err := tx.Find(&peers).Error; err != nil {
+			return errors.Wrap(err, "failed to read the peers")
+		}
+		for _, peer := range peers {
+			changedPrivate, err := result.encrypt(c, &peer.PrivateKey)
+			if err != nil {
+				return errors.WithMessagef(err, "private key of peer %s", peer.PublicKey)
+			}
+			changedPreshared, err := result.encrypt(c, &peer.PresharedKey)
+			if err != nil {
+				return errors.WithMessagef(err, "preshared key of peer %s", peer.PublicKey)
+			}
+			if changedPrivate || changedPreshared {
+				if err := tx.Model(&Peer{}).Where("public_key = ?", peer.PublicKey).UpdateColumns(
+					map[string]interface{}{"private_key": peer.PrivateKey, "preshared_key": peer.PresharedKey},
+				).Error; err != nil {
+					return errors.Wrapf(err, "failed to store the keys of peer %s", peer.PublicKey)
+				}
+			}
+		}
+		return nil
+	})
+
+	return result, err
+}
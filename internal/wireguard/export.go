@@ -0,0 +1,272 @@
+package wireguard
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// InterfaceExportVersion is the version of the InterfaceExport format. Documents of other versions are rejected.
+const InterfaceExportVersion = 1
+
+// InterfaceExport is a JSON document that contains one interface and all its peers, see ExportDevice.
+type InterfaceExport struct {
+	Version    int
+	ExportedAt time.Time
+	Redacted   bool // the private and preshared keys were removed
+	Device     Device
+	Peers      []Peer
+}
+
+// InterfaceImportResult summarizes the changes of ImportDevice.
+type InterfaceImportResult struct {
+	DryRun         bool              // nothing was stored
+	DeviceName     string            // the name of the created interface
+	Renamed        bool              // the interface name of the document was already in use
+	GeneratedKeys  bool              // the document was redacted, the interface got a new key pair
+	Peers          []string          // public keys of the created peers
+	ReallocatedIPs map[string]string // public key -> new addresses of the peers whose addresses were in use
+}
+
+// ExportDevice returns the interface and all its peers as InterfaceExport document. If redact is set, the private
+// keys of the interface and the peers and the preshared keys are left out.
+func (m *PeerManager) ExportDevice(device string, redact bool) (InterfaceExport, error) {
+	doc := InterfaceExport{Version: InterfaceExportVersion, ExportedAt: time.Now(), Redacted: redact}
+	if err := m.db.Where("device_name = ?", device).First(&doc.Device).Error; err != nil {
+		return doc, errors.Wrapf(err, "failed to load interface %s", device)
+	}
+	if err := m.db.Where("device_name = ?", device).Order("public_key").Find(&doc.Peers).Error; err != nil {
+		return doc, errors.Wrapf(err, "failed to load peers of %s", device)
+	}
+
+	for i := range doc.Peers {
+		doc.Peers[i].DeviceType = doc.Device.Type
+		if redact {
+			doc.Peers[i].PrivateKey = ""
+			doc.Peers[i].PresharedKey = ""
+		}
+	}
+	if redact {
+		doc.Device.PrivateKey = ""
+	}
+
+	return doc, nil
+}
+
+// ImportDevice creates the interface and the peers of the document in a single transaction, either everything is
+// stored or nothing. The interface is stored as deviceName, it must not exist yet. Peers must not exist on any
+// interface. Addresses of peers that are already used by other interfaces or peers are replaced with free addresses of
+// the networks of the interface, all other addresses are kept. Redacted interfaces get a new key pair. With dryRun,
+// the result describes the changes but nothing is stored.
+func (m *PeerManager) ImportDevice(doc InterfaceExport, deviceName, actor string, dryRun bool) (InterfaceImportResult,
+	error) {
+	result := InterfaceImportResult{DryRun: dryRun, DeviceName: deviceName, Renamed: deviceName != doc.Device.DeviceName,
+		Peers: make([]string, 0, len(doc.Peers)), ReallocatedIPs: make(map[string]string)}
+	if doc.Version != InterfaceExportVersion {
+		return result, errors.Errorf("unsupported document version %d, expected %d", doc.Version,
+			InterfaceExportVersion)
+	}
+	if !IsValidInterfaceName(deviceName) {
+		return result, errors.Errorf("invalid interface name %s", deviceName)
+	}
+
+	device := doc.Device
+	device.DeviceName = deviceName
+	device.DisabledAt = nil
+	device.CreatedAt = time.Now()
+	device.UpdatedAt = time.Now()
+	if device.PrivateKey == "" {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return result, errors.Wrap(err, "failed to generate private key")
+		}
+		device.PrivateKey = key.String()
+		device.PublicKey = key.PublicKey().String()
+		result.GeneratedKeys = true
+	}
+	if device.Type != DeviceTypeServer && device.Type != DeviceTypeClient {
+		return result, errors.Errorf("invalid mode %s of interface %s", device.Type, doc.Device.DeviceName)
+	}
+	if _, err := wgtypes.ParseKey(device.PrivateKey); err != nil {
+		return result, errors.Errorf("invalid private key of interface %s", doc.Device.DeviceName)
+	}
+	if len(device.GetIPAddresses()) == 0 {
+		return result, errors.Errorf("interface %s has no addresses", doc.Device.DeviceName)
+	}
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&Device{}).Where("device_name = ?", deviceName).Count(&existing).Error; err != nil {
+			return errors.Wrap(err, "failed to load interfaces")
+		}
+		if existing > 0 {
+			return errors.Errorf("interface %s already exists", deviceName)
+		}
+
+		reserved, err := reservedAddresses(tx)
+		if err != nil {
+			return err
+		}
+		for _, cidr := range device.GetIPAddresses() {
+			if ip, _, err := net.ParseCIDR(cidr); err == nil {
+				reserved[ip.String()] = true
+			}
+		}
+
+		peers, err := importedPeers(doc.Peers, device, reserved, result.ReallocatedIPs)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Create(&device).Error; err != nil {
+			return errors.Wrap(err, "failed to create interface")
+		}
+		for _, peer := range peers {
+			var existing Peer
+			res := tx.Where("public_key = ?", peer.PublicKey).Limit(1).Find(&existing)
+			if res.Error != nil {
+				return errors.Wrapf(res.Error, "failed to load peer %s", peer.PublicKey)
+			}
+			if res.RowsAffected > 0 {
+				return errors.Errorf("peer %s already exists on interface %s", peer.PublicKey, existing.DeviceName)
+			}
+
+			peer.CreatedBy = actor
+			peer.UpdatedBy = actor
+			if err := tx.Create(&peer).Error; err != nil {
+				return errors.Wrapf(err, "failed to create peer %s", peer.PublicKey)
+			}
+			result.Peers = append(result.Peers, peer.PublicKey)
+		}
+
+		if dryRun {
+			return errImportDryRun // roll back
+		}
+		return nil
+	})
+	if err != nil && err != errImportDryRun {
+		return result, err
+	}
+	return result, nil
+}
+
+// importedPeers prepares the peers of the document for the interface. Addresses that are reserved are replaced and
+// recorded in reallocated, all addresses of the peers are added to reserved.
+func importedPeers(docPeers []Peer, device Device, reserved map[string]bool, reallocated map[string]string) ([]Peer,
+	error) {
+	peers := make([]Peer, len(docPeers))
+	conflicts := make([]bool, len(docPeers))
+	for i, peer := range docPeers {
+		if _, err := wgtypes.ParseKey(peer.PublicKey); err != nil {
+			return nil, errors.Errorf("invalid public key %s in the document", peer.PublicKey)
+		}
+		peer.DeviceName = device.DeviceName
+		peer.DeviceType = device.Type
+		peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(peer.PublicKey)))
+		peer.AllowedIPsPresetID = 0 // presets are not part of the document, the allowed IPs are kept
+		peer.CreatedAt = time.Now()
+		peer.UpdatedAt = time.Now()
+		peers[i] = peer
+
+		for _, cidr := range peer.GetIPAddresses() {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, errors.Errorf("invalid address %s of peer %s", cidr, peer.PublicKey)
+			}
+			conflicts[i] = conflicts[i] || reserved[ip.String()]
+		}
+	}
+
+	// the addresses of the peers without conflicts are kept, so they are reserved before any other address is assigned
+	for i := range peers {
+		if conflicts[i] {
+			continue
+		}
+		for _, cidr := range peers[i].GetIPAddresses() {
+			ip, _, _ := net.ParseCIDR(cidr)
+			reserved[ip.String()] = true
+		}
+	}
+	for i := range peers {
+		if !conflicts[i] {
+			continue
+		}
+		addresses := peers[i].GetIPAddresses()
+		for j, cidr := range addresses {
+			ip, _, _ := net.ParseCIDR(cidr)
+			if !reserved[ip.String()] {
+				reserved[ip.String()] = true
+				continue
+			}
+			address, err := freeAddress(device, common.IsIPv6(ip.String()), reserved)
+			if err != nil {
+				return nil, errors.WithMessagef(err, "address %s of peer %s is in use", ip, peers[i].PublicKey)
+			}
+			addresses[j] = address
+		}
+		peers[i].SetIPAddresses(addresses...)
+		reallocated[peers[i].PublicKey] = peers[i].IPsStr
+	}
+
+	return peers, nil
+}
+
+// reservedAddresses returns the addresses of all interfaces and peers.
+func reservedAddresses(tx *gorm.DB) (map[string]bool, error) {
+	var devices []Device
+	if err := tx.Find(&devices).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to load interfaces")
+	}
+	var peers []Peer
+	if err := tx.Find(&peers).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to load peers")
+	}
+
+	cidrs := make([]string, 0, len(devices)+len(peers))
+	for _, device := range devices {
+		cidrs = append(cidrs, device.GetIPAddresses()...)
+	}
+	for _, peer := range peers {
+		cidrs = append(cidrs, peer.GetIPAddresses()...)
+	}
+	reserved := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil {
+			reserved[ip.String()] = true
+		}
+	}
+
+	return reserved, nil
+}
+
+// freeAddress returns the first address of the networks of the interface that is not reserved and reserves it.
+func freeAddress(device Device, v6 bool, reserved map[string]bool) (string, error) {
+	for _, cidr := range device.GetIPAddresses() {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil || common.IsIPv6(ip.String()) != v6 {
+			continue
+		}
+
+		broadcastAddr := common.BroadcastAddr(ipNet).String()
+		networkAddr := ipNet.IP.String()
+		for ip := ip.Mask(ipNet.Mask); ipNet.Contains(ip); common.IncreaseIP(ip) {
+			address := ip.String()
+			if reserved[address] || address == networkAddr || address == broadcastAddr {
+				continue
+			}
+			reserved[address] = true
+			if v6 {
+				return address + "/128", nil
+			}
+			return address + "/32", nil
+		}
+	}
+
+	return "", errors.New("no free address in the networks of the interface")
+}
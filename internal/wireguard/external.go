@@ -0,0 +1,74 @@
+package wireguard
+
+import (
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ErrExternalDevice is returned for live data of an external interface, the portal cannot read the external server.
+var ErrExternalDevice = errors.New("the interface belongs to an external WireGuard server")
+
+// IsExternalDevice reports whether the interface belongs to an external WireGuard server, see WG_EXTERNAL_DEVICES.
+// The portal only manages the peers and their configurations, no WireGuard interface, link, route or firewall rule
+// is ever touched for these interfaces.
+func (m *Manager) IsExternalDevice(device string) bool {
+	return common.ListContains(m.Cfg.ExternalDevices, device)
+}
+
+func (m *Manager) initExternalDevices() {
+	for _, device := range m.Cfg.ExternalDevices {
+		if !common.ListContains(m.Cfg.DeviceNames, device) {
+			logrus.Warnf("WG_EXTERNAL_DEVICES contains %s which is not a managed interface", device)
+		}
+		if _, ok := m.Cfg.DeviceHosts[device]; ok {
+			logrus.Warnf("interface %s is external, its remote host is ignored", device)
+		}
+	}
+}
+
+// externalClient is the WireGuard client of external interfaces. Changes are accepted and dropped, so peers can be
+// managed as usual, reads fail because there is no interface to read.
+type externalClient struct{}
+
+func (externalClient) Device(string) (*wgtypes.Device, error) {
+	return nil, ErrExternalDevice
+}
+
+func (externalClient) ConfigureDevice(string, wgtypes.Config) error {
+	return nil
+}
+
+// initExternalDevice creates the database entry of an external interface. The private key is a placeholder that is
+// never used, the public key of the external server has to be set on the interface page.
+func (m *PeerManager) initExternalDevice(deviceName string) error {
+	device := Device{}
+	m.db.Where("device_name = ?", deviceName).FirstOrInit(&device)
+	if device.DeviceName != "" {
+		if device.PublicKey == "" {
+			logrus.Warnf("the public key of the external server of interface %s is not set", deviceName)
+		}
+		return nil
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return errors.Wrap(err, "could not generate private key")
+	}
+	device.Type = DeviceTypeServer
+	device.DeviceName = deviceName
+	device.PrivateKey = key.String()
+	device.InheritDNS = true
+	device.InheritAllowedIPs = true
+	device.InheritKeepalive = true
+	device.DisableConfigFile = true // the config file would contain the placeholder key
+	m.wg.Cfg.PeerDefaults.apply(&device)
+
+	if err := m.db.Create(&device).Error; err != nil {
+		return errors.Wrapf(err, "failed to create external device %s", deviceName)
+	}
+	logrus.Warnf("created external interface %s, set the public key and the endpoint of the external server",
+		deviceName)
+	return nil
+}
@@ -0,0 +1,50 @@
+package wireguard
+
+import (
+	"time"
+)
+
+// ConnectionState classifies a peer by the age of its latest handshake, see Config.ConnectionState.
+type ConnectionState string
+
+const (
+	ConnectionStateOnline  ConnectionState = "online"  // handshake within the online threshold
+	ConnectionStateIdle    ConnectionState = "idle"    // handshake within the idle threshold, the peer was connected recently
+	ConnectionStateOffline ConnectionState = "offline" // older handshake, or the peer never connected
+)
+
+// HandshakeThresholds returns the handshake ages that separate online, idle and offline peers of the device. The
+// overrides of single devices replace the global thresholds, an idle threshold below the online threshold disables
+// the idle state.
+func (c Config) HandshakeThresholds(device string) (online, idle time.Duration) {
+	online, idle = c.OnlineHandshakeAge, c.IdleHandshakeAge
+	if age, ok := c.DeviceOnlineHandshakeAges[device]; ok {
+		online = age
+	}
+	if age, ok := c.DeviceIdleHandshakeAges[device]; ok {
+		idle = age
+	}
+	if idle < online {
+		idle = online
+	}
+	return online, idle
+}
+
+// ConnectionState classifies a peer of the device by its latest handshake. WireGuard renews the handshake every two
+// minutes while packets are sent, keepalive packets included, so a reachable peer with a persistent keepalive stays
+// online as long as the online threshold is above two minutes. Peers without keepalive only handshake while they
+// send traffic and become idle and then offline when they stop.
+func (c Config) ConnectionState(device string, lastHandshake, now time.Time) ConnectionState {
+	if lastHandshake.IsZero() {
+		return ConnectionStateOffline
+	}
+	online, idle := c.HandshakeThresholds(device)
+	switch age := now.Sub(lastHandshake); {
+	case age < online:
+		return ConnectionStateOnline
+	case age < idle:
+		return ConnectionStateIdle
+	default:
+		return ConnectionStateOffline
+	}
+}
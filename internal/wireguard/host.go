@@ -0,0 +1,399 @@
+package wireguard
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	hostDialTimeout    = 10 * time.Second
+	hostCommandTimeout = 30 * time.Second
+	hostCheckInterval  = 30 * time.Second
+	maxPendingChanges  = 100 // older queued changes are only counted, the whole interface is restored anyway
+)
+
+// HostConfig is a remote host whose interfaces are managed over SSH. The SSH user needs the permissions to run wg and
+// ip, e.g. root.
+type HostConfig struct {
+	Name           string `yaml:"name"`
+	Address        string `yaml:"address"`        // host[:port] of the SSH server, the port defaults to 22
+	User           string `yaml:"user"`           // SSH user
+	KeyFile        string `yaml:"keyFile"`        // private key that is used for the authentication
+	KnownHostsFile string `yaml:"knownHostsFile"` // known_hosts file with the accepted host keys
+	EndpointHost   string `yaml:"endpointHost"`   // host of the peer endpoints, defaults to the host of the address
+}
+
+// HostStatus is the connectivity status of a remote host.
+type HostStatus struct {
+	Name           string
+	Address        string
+	Devices        []string
+	Online         bool
+	LastContact    time.Time // zero if the host was never reached
+	LastError      string
+	PendingChanges []string // changes that are applied once the host is reachable again
+	DroppedChanges int      // queued changes beyond maxPendingChanges
+}
+
+// remoteHost runs the WireGuard and link operations of its interfaces over SSH. Changes for an unreachable host are
+// queued, once the host is reachable again its interfaces are restored from the database.
+type remoteHost struct {
+	cfg       HostConfig
+	sshConfig *ssh.ClientConfig
+	devices   []string
+
+	connMux  sync.Mutex // serializes the use of the connection
+	client   *ssh.Client
+	mux      sync.Mutex // protects the fields below
+	status   HostStatus
+	lastErr  error
+	lastDial time.Time
+}
+
+// errHostUnreachable is returned by remote operations if the SSH connection failed.
+var errHostUnreachable = errors.New("host unreachable")
+
+// initHosts sets up the remote hosts and assigns the interfaces of WG_DEVICE_HOSTS to them.
+func (m *Manager) initHosts() error {
+	m.hosts = make(map[string]*remoteHost)
+	hostsByName := make(map[string]*remoteHost, len(m.Cfg.Hosts))
+	for _, cfg := range m.Cfg.Hosts {
+		if cfg.Name == "" || hostsByName[cfg.Name] != nil {
+			return errors.Errorf("remote hosts need a unique name, %q is invalid", cfg.Name)
+		}
+		host, err := newRemoteHost(cfg)
+		if err != nil {
+			return errors.WithMessagef(err, "invalid remote host %s", cfg.Name)
+		}
+		hostsByName[cfg.Name] = host
+	}
+
+	for device, hostName := range m.Cfg.DeviceHosts {
+		host, ok := hostsByName[hostName]
+		if !ok {
+			return errors.Errorf("interface %s is assigned to the unknown host %s", device, hostName)
+		}
+		host.devices = append(host.devices, device)
+		sort.Strings(host.devices)
+		host.status.Devices = host.devices
+		m.hosts[device] = host
+	}
+
+	return nil
+}
+
+func newRemoteHost(cfg HostConfig) (*remoteHost, error) {
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		cfg.Address = net.JoinHostPort(cfg.Address, "22")
+	}
+	if cfg.EndpointHost == "" {
+		cfg.EndpointHost, _, _ = net.SplitHostPort(cfg.Address)
+	}
+
+	key, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read private key")
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse private key")
+	}
+	hostKeyCallback, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read known hosts")
+	}
+
+	return &remoteHost{
+		cfg: cfg,
+		sshConfig: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         hostDialTimeout,
+		},
+		devices: make([]string, 0),
+		status:  HostStatus{Name: cfg.Name, Address: cfg.Address, Devices: []string{}},
+	}, nil
+}
+
+// remoteHost returns the host of a remote interface, or nil for local interfaces.
+func (m *Manager) remoteHost(device string) *remoteHost {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+	return m.hosts[device]
+}
+
+// client returns the WireGuard client of the interface, remote interfaces are configured over SSH. Changes of
+// external interfaces are dropped.
+func (m *Manager) client(device string) wgClient {
+	if m.IsExternalDevice(device) {
+		return externalClient{}
+	}
+	if host := m.remoteHost(device); host != nil {
+		return host
+	}
+	if namespace := m.DeviceNamespace(device); namespace != "" {
+		return m.namespaceClient(namespace)
+	}
+	return m.wg
+}
+
+// wgClient is the part of the wgctrl client that is used by the manager.
+type wgClient interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// localClient is the wgctrl client of the host, it also lists the devices that are not managed.
+type localClient interface {
+	wgClient
+	Devices() ([]*wgtypes.Device, error)
+}
+
+// IsRemoteDevice reports whether the interface is managed on a remote host.
+func (m *Manager) IsRemoteDevice(device string) bool {
+	return m.remoteHost(device) != nil
+}
+
+// IsHostUnreachable reports whether the interface is managed on a remote host that could not be reached the last
+// time it was contacted.
+func (m *Manager) IsHostUnreachable(device string) bool {
+	host := m.remoteHost(device)
+	if host == nil {
+		return false
+	}
+	host.mux.Lock()
+	defer host.mux.Unlock()
+
+	return !host.status.Online && host.status.LastError != ""
+}
+
+// DefaultEndpointHost returns the host of the peer endpoints of interfaces without an endpoint. Interfaces on a remote
+// host use the endpoint host of that host.
+func (m *Manager) DefaultEndpointHost(device string) string {
+	if host := m.remoteHost(device); host != nil {
+		return host.cfg.EndpointHost
+	}
+	return m.Cfg.DefaultEndpointHost
+}
+
+// GetHostStatuses returns the connectivity status of all remote hosts.
+func (m *Manager) GetHostStatuses() []HostStatus {
+	statuses := make([]HostStatus, 0, len(m.Cfg.Hosts))
+	for _, host := range m.uniqueHosts() {
+		host.mux.Lock()
+		status := host.status
+		status.PendingChanges = append([]string{}, host.status.PendingChanges...)
+		host.mux.Unlock()
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+func (m *Manager) uniqueHosts() []*remoteHost {
+	seen := make(map[*remoteHost]bool)
+	hosts := make([]*remoteHost, 0, len(m.hosts))
+	for _, host := range m.hosts {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// RunHostCommand runs the shell command on the remote host of the interface.
+func (m *Manager) RunHostCommand(device, command string, timeout time.Duration) (string, error) {
+	host := m.remoteHost(device)
+	if host == nil {
+		return "", errors.Errorf("interface %s is not managed on a remote host", device)
+	}
+	return host.run(command, timeout)
+}
+
+// RunHostChecks periodically contacts all remote hosts until the given context is cancelled. Once a host is reachable
+// again, its interfaces are created if MANAGE_INTERFACES is enabled and restored through OnHostReconnect.
+func (m *Manager) RunHostChecks(ctx context.Context) {
+	if len(m.hosts) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(hostCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, host := range m.uniqueHosts() {
+			if !host.reconnected() {
+				continue
+			}
+			logrus.Infof("remote host %s is reachable again, restoring its interfaces", host.cfg.Name)
+			for _, device := range host.devices {
+				m.cache.Invalidate(device)
+				if m.Cfg.ManageInterfaces {
+					if _, err := m.CreateDevice(device); err != nil {
+						logrus.Errorf("failed to create interface %s on host %s: %v", device, host.cfg.Name, err)
+						continue
+					}
+				}
+				if m.OnHostReconnect != nil {
+					m.OnHostReconnect(device)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconnected contacts the host and reports whether it is reachable again after a failure. The queued changes are
+// dropped, the caller restores the whole state of the interfaces.
+func (h *remoteHost) reconnected() bool {
+	h.mux.Lock()
+	wasUnreachable := !h.status.Online && h.status.LastError != ""
+	h.mux.Unlock()
+
+	if _, err := h.execute("true", hostDialTimeout, true); err != nil {
+		return false
+	}
+	if !wasUnreachable {
+		return false
+	}
+
+	h.mux.Lock()
+	h.status.PendingChanges = nil
+	h.status.DroppedChanges = 0
+	h.mux.Unlock()
+
+	return true
+}
+
+// queue records a change that could not be applied because the host is unreachable.
+func (h *remoteHost) queue(change string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if len(h.status.PendingChanges) >= maxPendingChanges {
+		h.status.DroppedChanges++
+		return
+	}
+	h.status.PendingChanges = append(h.status.PendingChanges, change)
+}
+
+// apply runs a change on the host. If the host is unreachable, the change is queued and no error is returned.
+func (h *remoteHost) apply(change, script string) error {
+	_, err := h.run(script, hostCommandTimeout)
+	if errors.Is(err, errHostUnreachable) {
+		logrus.Warnf("remote host %s is unreachable, queued change: %s", h.cfg.Name, change)
+		h.queue(change)
+		return nil
+	}
+	return err
+}
+
+// run executes the script with sh on the host and returns its combined output. Connection problems are returned as
+// errHostUnreachable. After a failed connection attempt, the host is only contacted again by the next check, so that
+// requests do not wait for the dial timeout over and over.
+func (h *remoteHost) run(script string, timeout time.Duration) (string, error) {
+	return h.execute(script, timeout, false)
+}
+
+func (h *remoteHost) execute(script string, timeout time.Duration, force bool) (string, error) {
+	h.connMux.Lock()
+	defer h.connMux.Unlock()
+
+	h.mux.Lock()
+	lastErr, lastDial := h.lastErr, h.lastDial
+	h.mux.Unlock()
+	if !force && h.client == nil && lastErr != nil && time.Since(lastDial) < hostCheckInterval {
+		return "", lastErr
+	}
+
+	output, err := h.runConnected(script, timeout)
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if errors.Is(err, errHostUnreachable) {
+		if h.client != nil {
+			_ = h.client.Close()
+			h.client = nil
+		}
+		h.lastErr = err
+		h.status.Online = false
+		h.status.LastError = err.Error()
+		return output, err
+	}
+
+	h.lastErr = nil
+	h.status.Online = true
+	h.status.LastContact = time.Now()
+	h.status.LastError = ""
+	return output, err
+}
+
+func (h *remoteHost) runConnected(script string, timeout time.Duration) (string, error) {
+	if h.client == nil {
+		h.mux.Lock()
+		h.lastDial = time.Now()
+		h.mux.Unlock()
+		client, err := ssh.Dial("tcp", h.cfg.Address, h.sshConfig)
+		if err != nil {
+			return "", &unreachableError{err: err}
+		}
+		h.client = client
+	}
+
+	session, err := h.client.NewSession()
+	if err != nil {
+		return "", &unreachableError{err: err}
+	}
+	defer session.Close()
+
+	timer := time.AfterFunc(timeout, func() { _ = session.Close() })
+	defer timer.Stop()
+
+	session.Stdin = newScriptReader(script)
+	output, err := session.CombinedOutput("sh -e -s")
+	trimmedOutput := trimCommandOutput(output)
+	switch err.(type) {
+	case nil:
+		return trimmedOutput, nil
+	case *ssh.ExitError:
+		return trimmedOutput, errors.Errorf("command failed on host %s: %s", h.cfg.Name, trimmedOutput)
+	default:
+		return trimmedOutput, &unreachableError{err: err}
+	}
+}
+
+// unreachableError wraps the connection error, errors.Is matches errHostUnreachable.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return errHostUnreachable.Error() + ": " + e.err.Error()
+}
+
+func (e *unreachableError) Unwrap() error {
+	return e.err
+}
+
+func (e *unreachableError) Is(target error) bool {
+	return target == errHostUnreachable
+}
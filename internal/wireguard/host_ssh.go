@@ -0,0 +1,269 @@
+package wireguard
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const maxRemoteOutput = 500 // characters of the command output that are included in error messages
+
+// The remote operations are shell scripts that only use wg, ip and shell builtins. Keys are written to a temporary
+// file with printf, so they never show up in the process list of the host.
+
+func newScriptReader(script string) io.Reader {
+	return strings.NewReader(script + "\n")
+}
+
+func trimCommandOutput(output []byte) string {
+	trimmed := strings.TrimSpace(string(output))
+	if len(trimmed) > maxRemoteOutput {
+		trimmed = trimmed[:maxRemoteOutput] + "..."
+	}
+	return trimmed
+}
+
+// shellQuote quotes the value for sh.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Device reads the interface with wg show dump.
+func (h *remoteHost) Device(name string) (*wgtypes.Device, error) {
+	output, err := h.run("wg show "+shellQuote(name)+" dump", hostCommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseWgDump(name, output)
+}
+
+// parseWgDump parses the output of wg show <interface> dump. The first line describes the interface, all other lines
+// describe one peer each.
+func parseWgDump(name, output string) (*wgtypes.Device, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	fields := strings.Split(lines[0], "\t")
+	if len(fields) != 4 {
+		return nil, errors.Errorf("unexpected output of wg show %s dump", name)
+	}
+
+	dev := &wgtypes.Device{Name: name, Type: wgtypes.Unknown, Peers: make([]wgtypes.Peer, 0, len(lines)-1)}
+	var err error
+	if dev.PrivateKey, err = parseDumpKey(fields[0]); err != nil {
+		return nil, err
+	}
+	if dev.PublicKey, err = parseDumpKey(fields[1]); err != nil {
+		return nil, err
+	}
+	dev.ListenPort, _ = strconv.Atoi(fields[2])
+	dev.FirewallMark, _ = strconv.Atoi(fields[3]) // "off" is 0
+
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 8 {
+			return nil, errors.Errorf("unexpected peer in the output of wg show %s dump", name)
+		}
+
+		peer := wgtypes.Peer{ProtocolVersion: 1, AllowedIPs: make([]net.IPNet, 0)}
+		if peer.PublicKey, err = parseDumpKey(fields[0]); err != nil {
+			return nil, err
+		}
+		if peer.PresharedKey, err = parseDumpKey(fields[1]); err != nil {
+			return nil, err
+		}
+		if fields[2] != "(none)" {
+			peer.Endpoint, _ = net.ResolveUDPAddr("udp", fields[2])
+		}
+		if fields[3] != "(none)" {
+			for _, cidr := range strings.Split(fields[3], ",") {
+				if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+					peer.AllowedIPs = append(peer.AllowedIPs, *ipNet)
+				}
+			}
+		}
+		if handshake, _ := strconv.ParseInt(fields[4], 10, 64); handshake > 0 {
+			peer.LastHandshakeTime = time.Unix(handshake, 0)
+		}
+		peer.ReceiveBytes, _ = strconv.ParseInt(fields[5], 10, 64)
+		peer.TransmitBytes, _ = strconv.ParseInt(fields[6], 10, 64)
+		if keepalive, err := strconv.Atoi(fields[7]); err == nil {
+			peer.PersistentKeepaliveInterval = time.Duration(keepalive) * time.Second
+		}
+		dev.Peers = append(dev.Peers, peer)
+	}
+
+	return dev, nil
+}
+
+func parseDumpKey(value string) (wgtypes.Key, error) {
+	if value == "(none)" {
+		return wgtypes.Key{}, nil
+	}
+	key, err := wgtypes.ParseKey(value)
+	if err != nil {
+		return wgtypes.Key{}, errors.Wrap(err, "invalid key in the output of wg show dump")
+	}
+	return key, nil
+}
+
+// ConfigureDevice applies the configuration with wg set. Unlike the kernel interface, wg set always replaces the
+// allowed IPs of a peer.
+func (h *remoteHost) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	return h.apply(fmt.Sprintf("configure %s (%d peers)", name, len(cfg.Peers)), wgSetScript(name, cfg))
+}
+
+func wgSetScript(name string, cfg wgtypes.Config) string {
+	dev := shellQuote(name)
+	var script strings.Builder
+	script.WriteString("umask 077\nk=$(mktemp)\ntrap 'rm -f \"$k\"' EXIT\n")
+
+	var deviceArgs []string
+	if cfg.PrivateKey != nil {
+		script.WriteString("printf '%s\\n' " + shellQuote(cfg.PrivateKey.String()) + " > \"$k\"\n")
+		deviceArgs = append(deviceArgs, "private-key \"$k\"")
+	}
+	if cfg.ListenPort != nil {
+		deviceArgs = append(deviceArgs, "listen-port "+strconv.Itoa(*cfg.ListenPort))
+	}
+	if cfg.FirewallMark != nil {
+		deviceArgs = append(deviceArgs, "fwmark "+strconv.Itoa(*cfg.FirewallMark))
+	}
+	if len(deviceArgs) > 0 {
+		script.WriteString("wg set " + dev + " " + strings.Join(deviceArgs, " ") + "\n")
+	}
+	if cfg.ReplacePeers {
+		script.WriteString("for p in $(wg show " + dev + " peers); do wg set " + dev + " peer \"$p\" remove; done\n")
+	}
+
+	for _, peer := range cfg.Peers {
+		args := []string{"peer", shellQuote(peer.PublicKey.String())}
+		if peer.Remove {
+			script.WriteString("wg set " + dev + " " + strings.Join(append(args, "remove"), " ") + "\n")
+			continue
+		}
+		if peer.PresharedKey != nil {
+			script.WriteString("printf '%s\\n' " + shellQuote(peer.PresharedKey.String()) + " > \"$k\"\n")
+			args = append(args, "preshared-key \"$k\"")
+		}
+		if peer.Endpoint != nil {
+			args = append(args, "endpoint "+shellQuote(peer.Endpoint.String()))
+		}
+		if peer.PersistentKeepaliveInterval != nil {
+			args = append(args, "persistent-keepalive "+strconv.Itoa(int(peer.PersistentKeepaliveInterval.Seconds())))
+		}
+		if peer.ReplaceAllowedIPs || len(peer.AllowedIPs) > 0 {
+			allowedIPs := make([]string, len(peer.AllowedIPs))
+			for i := range peer.AllowedIPs {
+				allowedIPs[i] = peer.AllowedIPs[i].String()
+			}
+			args = append(args, "allowed-ips "+shellQuote(strings.Join(allowedIPs, ",")))
+		}
+
+		command := "wg set " + dev + " " + strings.Join(args, " ")
+		if peer.UpdateOnly {
+			command = "if wg show " + dev + " peers | grep -qxF " + shellQuote(peer.PublicKey.String()) +
+				"; then " + command + "; fi"
+		}
+		script.WriteString(command + "\n")
+	}
+
+	return script.String()
+}
+
+// linkExists reports whether the interface exists on the host.
+func (h *remoteHost) linkExists(device string) (bool, error) {
+	output, err := h.run("if [ -e /sys/class/net/"+shellQuote(device)+" ]; then echo yes; fi", hostCommandTimeout)
+	if err != nil {
+		return false, err
+	}
+	return output == "yes", nil
+}
+
+// createLink creates the WireGuard interface if it does not exist yet. The returned boolean is true if the interface
+// has been created.
+func (h *remoteHost) createLink(device string) (bool, error) {
+	exists, err := h.linkExists(device)
+	if err != nil || exists {
+		return false, err
+	}
+
+	if _, err := h.run("ip link add dev "+shellQuote(device)+" type wireguard", hostCommandTimeout); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *remoteHost) deleteLink(device string) error {
+	dev := shellQuote(device)
+	return h.apply("delete "+device, "if [ -e /sys/class/net/"+dev+" ]; then ip link del dev "+dev+"; fi")
+}
+
+func (h *remoteHost) isLinkUp(device string) (bool, error) {
+	output, err := h.run("cat /sys/class/net/"+shellQuote(device)+"/flags", hostCommandTimeout)
+	if err != nil {
+		return false, errors.WithMessagef(err, "could not retrieve interface %s", device)
+	}
+
+	flags, err := strconv.ParseUint(strings.TrimPrefix(output, "0x"), 16, 32)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid flags of interface %s", device)
+	}
+	return flags&uint64(net.FlagUp) != 0, nil
+}
+
+func (h *remoteHost) setLinkState(device, state string) error {
+	return h.apply("set "+device+" "+state, "ip link set dev "+shellQuote(device)+" "+state)
+}
+
+func (h *remoteHost) getIPAddresses(device string) ([]string, error) {
+	output, err := h.run("ip -o addr show dev "+shellQuote(device), hostCommandTimeout)
+	if err != nil {
+		return nil, errors.WithMessagef(err, "could not retrieve ip addresses of %s", device)
+	}
+
+	ipAddresses := make([]string, 0)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && (fields[2] == "inet" || fields[2] == "inet6") {
+			ipAddresses = append(ipAddresses, fields[3])
+		}
+	}
+	return ipAddresses, nil
+}
+
+// setIPAddresses replaces the ip addresses of the interface, addresses that are kept and link-local addresses are not
+// touched.
+func (h *remoteHost) setIPAddresses(device string, cidrs []string) error {
+	dev := shellQuote(device)
+	var script strings.Builder
+	script.WriteString("current=$(ip -o addr show dev " + dev + " | while read -r _ _ _ a _; do echo \"$a\"; done)\n")
+	wanted := make([]string, len(cidrs))
+	for i, cidr := range cidrs {
+		wanted[i] = shellQuote(cidr)
+		script.WriteString("echo \"$current\" | grep -qxF " + wanted[i] + " || ip addr add " + wanted[i] + " dev " +
+			dev + "\n")
+	}
+	script.WriteString("for a in $current; do case \"$a\" in " + strings.Join(append(wanted, "''", "fe80:*", "169.254.*"), "|") +
+		") ;; *) ip addr del \"$a\" dev " + dev + " ;; esac; done\n")
+
+	return h.apply(fmt.Sprintf("set ip addresses of %s to %s", device, strings.Join(cidrs, ", ")), script.String())
+}
+
+func (h *remoteHost) getMTU(device string) (int, error) {
+	output, err := h.run("cat /sys/class/net/"+shellQuote(device)+"/mtu", hostCommandTimeout)
+	if err != nil {
+		return 0, errors.WithMessagef(err, "could not retrieve MTU of %s", device)
+	}
+	return strconv.Atoi(output)
+}
+
+func (h *remoteHost) setMTU(device string, mtu int) error {
+	return h.apply(fmt.Sprintf("set MTU of %s to %d", device, mtu),
+		"ip link set dev "+shellQuote(device)+" mtu "+strconv.Itoa(mtu))
+}
@@ -0,0 +1,612 @@
+package wireguard
+
+import (
+	"bufio"
+	"crypto/md5"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// ImportedConfig is the content of a wg-quick configuration file, see ParseWgQuickConfig.
+type ImportedConfig struct {
+	Device Device
+	Peers  []Peer
+}
+
+// ConfigParseError describes an invalid line of a wg-quick configuration file.
+type ConfigParseError struct {
+	Line    int    // line number, starting at 1, 0 if the error is not related to a single line
+	Content string // content of the line
+	Message string
+}
+
+func (e ConfigParseError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("line %d: %s (%s)", e.Line, e.Message, e.Content)
+}
+
+// ConfigParseErrors contains all problems that were found in a wg-quick configuration file.
+type ConfigParseErrors []ConfigParseError
+
+func (e ConfigParseErrors) Error() string {
+	messages := make([]string, len(e))
+	for i := range e {
+		messages[i] = e[i].Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+type wgQuickParser struct {
+	cfg    ImportedConfig
+	errors ConfigParseErrors
+
+	section       string
+	interfaceLine int
+	hasInterface  bool
+	peer          *Peer
+	peerLine      int
+	peerLines     []int
+	allowedIPs    []string
+	comments      map[string]string // metadata comments (-WGP- and friendly_name notation) of the next peer
+	peerComments  map[string]string
+}
+
+// ParseWgQuickConfig parses the given wg-quick configuration file for the interface with the given name. The
+// [Interface] section is stored in the device, each [Peer] section results in one peer. If the device type is empty,
+// it is guessed from the listen port: interfaces with a listen port are servers, all others are clients.
+// Peer names and email addresses are taken from the comments that wg-portal writes to the configuration files.
+func ParseWgQuickConfig(deviceName string, deviceType DeviceType, data string) (ImportedConfig, error) {
+	p := wgQuickParser{comments: make(map[string]string)}
+	p.cfg.Device.DeviceName = deviceName
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		p.parseLine(lineNumber, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return ImportedConfig{}, errors.Wrap(err, "failed to read configuration")
+	}
+	p.finishPeer()
+
+	if !p.hasInterface {
+		p.errors = append(p.errors, ConfigParseError{Message: "missing [Interface] section"})
+	} else {
+		if p.cfg.Device.PrivateKey == "" {
+			p.errorAt(p.interfaceLine, "[Interface]", "missing PrivateKey")
+		}
+		if p.cfg.Device.IPsStr == "" {
+			p.errorAt(p.interfaceLine, "[Interface]", "missing Address")
+		}
+	}
+
+	if deviceType == "" {
+		deviceType = DeviceTypeClient
+		if p.cfg.Device.ListenPort != 0 {
+			deviceType = DeviceTypeServer
+		}
+	}
+	p.cfg.Device.Type = deviceType
+
+	seenKeys := make(map[string]bool, len(p.cfg.Peers))
+	for i := range p.cfg.Peers {
+		peer := &p.cfg.Peers[i]
+		if seenKeys[peer.PublicKey] {
+			p.errorAt(p.peerLines[i], "[Peer]", "duplicate peer "+peer.PublicKey)
+		}
+		seenKeys[peer.PublicKey] = true
+		peer.fromImportedAllowedIPs(deviceType, peer.AllowedIPsStr)
+	}
+
+	if len(p.errors) > 0 {
+		return ImportedConfig{}, p.errors
+	}
+	return p.cfg, nil
+}
+
+func (p *wgQuickParser) errorAt(line int, content, message string) {
+	p.errors = append(p.errors, ConfigParseError{Line: line, Content: content, Message: message})
+}
+
+func (p *wgQuickParser) parseLine(lineNumber int, line string) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "#") {
+		p.parseComment(line)
+		return
+	}
+	if line == "" {
+		return
+	}
+
+	if strings.HasPrefix(line, "[") {
+		p.finishPeer()
+		p.section = strings.ToLower(line)
+		switch p.section {
+		case "[interface]":
+			if p.hasInterface {
+				p.errorAt(lineNumber, line, "duplicate [Interface] section")
+			}
+			p.hasInterface = true
+			p.interfaceLine = lineNumber
+		case "[peer]":
+			p.peer = &Peer{DeviceName: p.cfg.Device.DeviceName}
+			p.peerLine = lineNumber
+			p.peerComments = p.comments
+		default:
+			p.errorAt(lineNumber, line, "unknown section")
+		}
+		p.comments = make(map[string]string)
+		return
+	}
+
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		p.errorAt(lineNumber, line, "expected key = value")
+		return
+	}
+	key := strings.ToLower(strings.TrimSpace(parts[0]))
+	value := strings.TrimSpace(parts[1])
+	if idx := strings.Index(value, "#"); idx >= 0 && key != "preup" && key != "postup" && key != "predown" &&
+		key != "postdown" {
+		value = strings.TrimSpace(value[:idx]) // inline comment
+	}
+
+	var err error
+	switch p.section {
+	case "[interface]":
+		err = p.parseInterfaceValue(key, value)
+	case "[peer]":
+		err = p.parsePeerValue(key, value)
+	case "":
+		err = errors.New("value outside of a section")
+	default:
+		return // already reported as unknown section
+	}
+	if err != nil {
+		p.errorAt(lineNumber, line, err.Error())
+	}
+}
+
+// parseComment collects the peer metadata that wg-portal and other tools store in comments.
+func (p *wgQuickParser) parseComment(line string) {
+	comment := strings.TrimSpace(strings.TrimLeft(line, "#"))
+	switch {
+	case strings.HasPrefix(comment, "-WGP- Peer email:"):
+		p.comments["email"] = strings.TrimSpace(strings.TrimPrefix(comment, "-WGP- Peer email:"))
+	case strings.HasPrefix(comment, "-WGP- Peer:"):
+		name := strings.TrimSpace(strings.TrimPrefix(comment, "-WGP- Peer:"))
+		if idx := strings.Index(name, " / Updated:"); idx >= 0 {
+			name = name[:idx]
+		}
+		p.comments["name"] = name
+	case strings.HasPrefix(comment, "-WGP- PrivateKey:"):
+		p.comments["privatekey"] = strings.TrimSpace(strings.TrimPrefix(comment, "-WGP- PrivateKey:"))
+	default:
+		// friendly_name = x (prometheus_wireguard_exporter), Name = x (wg-gen-web and others) and Email = x or
+		// User = x for the owner of the peer
+		parts := strings.SplitN(comment, "=", 2)
+		if len(parts) != 2 {
+			return
+		}
+		var field string
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "friendly_name", "name":
+			field = "name"
+		case "email", "user":
+			field = "email"
+		default:
+			return
+		}
+		if p.peer != nil {
+			p.peerComments[field] = strings.TrimSpace(parts[1])
+		} else {
+			p.comments[field] = strings.TrimSpace(parts[1])
+		}
+	}
+}
+
+func (p *wgQuickParser) parseInterfaceValue(key, value string) error {
+	dev := &p.cfg.Device
+	switch key {
+	case "privatekey":
+		privateKey, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return errors.New("invalid private key")
+		}
+		dev.PrivateKey = privateKey.String()
+		dev.PublicKey = privateKey.PublicKey().String()
+	case "address":
+		addresses, err := parseAddressList(value)
+		if err != nil {
+			return err
+		}
+		dev.SetIPAddresses(append(dev.GetIPAddresses(), addresses...)...)
+	case "listenport":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port >= 65535 {
+			return errors.New("invalid listen port")
+		}
+		dev.ListenPort = port
+	case "mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil || mtu < 0 || mtu > 1500 {
+			return errors.New("invalid MTU, must be between 0 and 1500")
+		}
+		dev.Mtu = mtu
+	case "dns":
+		dns := common.ParseStringList(value)
+		for _, entry := range dns {
+			if net.ParseIP(entry) == nil && !searchDomainRegex.MatchString(entry) {
+				return errors.Errorf("invalid DNS server or search domain %s", entry)
+			}
+		}
+		dev.DNSStr = common.ListToString(append(common.ParseStringList(dev.DNSStr), dns...))
+	case "fwmark":
+		if value == "off" {
+			dev.FirewallMark = 0
+			return nil
+		}
+		fwMark, err := strconv.ParseInt(value, 0, 32)
+		if err != nil || fwMark < 0 {
+			return errors.New("invalid firewall mark")
+		}
+		dev.FirewallMark = int32(fwMark)
+	case "table":
+		dev.RoutingTable = value
+	case "preup":
+		dev.PreUp = appendHook(dev.PreUp, value)
+	case "postup":
+		dev.PostUp = appendHook(dev.PostUp, value)
+	case "predown":
+		dev.PreDown = appendHook(dev.PreDown, value)
+	case "postdown":
+		dev.PostDown = appendHook(dev.PostDown, value)
+	case "saveconfig":
+		saveConfig, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("invalid SaveConfig, must be true or false")
+		}
+		dev.SaveConfig = saveConfig
+	default:
+		return errors.Errorf("unknown interface setting %s", key)
+	}
+	return nil
+}
+
+// appendHook combines hooks that are given multiple times, wg-quick runs them in the given order.
+func appendHook(hooks, value string) string {
+	if hooks == "" {
+		return value
+	}
+	return hooks + "; " + value
+}
+
+func (p *wgQuickParser) parsePeerValue(key, value string) error {
+	peer := p.peer
+	switch key {
+	case "publickey":
+		publicKey, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return errors.New("invalid public key")
+		}
+		peer.PublicKey = publicKey.String()
+	case "presharedkey":
+		presharedKey, err := wgtypes.ParseKey(value)
+		if err != nil {
+			return errors.New("invalid preshared key")
+		}
+		peer.PresharedKey = presharedKey.String()
+	case "allowedips":
+		allowedIPs, err := parseAddressList(value)
+		if err != nil {
+			return err
+		}
+		p.allowedIPs = append(p.allowedIPs, allowedIPs...)
+	case "endpoint":
+		host, port, err := net.SplitHostPort(value)
+		if err != nil || host == "" {
+			return errors.New("invalid endpoint, expected host:port")
+		}
+		if portNumber, err := strconv.Atoi(port); err != nil || portNumber <= 0 || portNumber > 65535 {
+			return errors.New("invalid endpoint port")
+		}
+		peer.Endpoint = value
+	case "persistentkeepalive":
+		if value == "off" {
+			peer.PersistentKeepalive = 0
+			return nil
+		}
+		keepalive, err := strconv.Atoi(value)
+		if err != nil || keepalive < 0 || keepalive > MaxPersistentKeepalive {
+			return errors.Errorf("invalid keepalive, must be between 0 and %d", MaxPersistentKeepalive)
+		}
+		peer.PersistentKeepalive = keepalive
+		peer.OverrideKeepalive = true
+	default:
+		return errors.Errorf("unknown peer setting %s", key)
+	}
+	return nil
+}
+
+// finishPeer completes the current [Peer] section.
+func (p *wgQuickParser) finishPeer() {
+	if p.peer == nil {
+		return
+	}
+	peer := p.peer
+	p.peer = nil
+
+	if peer.PublicKey == "" {
+		p.errorAt(p.peerLine, "[Peer]", "missing PublicKey")
+		p.allowedIPs = nil
+		return
+	}
+
+	peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(peer.PublicKey)))
+	peer.AllowedIPsStr = common.ListToString(p.allowedIPs) // split up in ParseWgQuickConfig, once the type is known
+	peer.Identifier = p.peerComments["name"]
+	if len(peer.Identifier) > 64 {
+		peer.Identifier = peer.Identifier[:64]
+	}
+	if peer.Identifier == "" {
+		peer.Identifier = "Imported Peer (" + peer.PublicKey[0:8] + ")"
+	}
+	peer.Email = strings.ToLower(p.peerComments["email"])
+	if peer.Email == "" {
+		peer.Email = AutodetectedPeerEmail
+	}
+	if privateKey, err := wgtypes.ParseKey(p.peerComments["privatekey"]); err == nil &&
+		privateKey.PublicKey().String() == peer.PublicKey {
+		peer.PrivateKey = privateKey.String()
+	}
+
+	p.cfg.Peers = append(p.cfg.Peers, *peer)
+	p.peerLines = append(p.peerLines, p.peerLine)
+	p.allowedIPs = nil
+}
+
+// fromImportedAllowedIPs stores the allowed IPs of the configuration file in the fields of the given device type.
+// On servers, host addresses (/32 and /128) are the addresses of the peer, other networks are routed to the peer.
+func (p *Peer) fromImportedAllowedIPs(deviceType DeviceType, allowedIPs string) {
+	p.DeviceType = deviceType
+	p.AllowedIPsStr = ""
+	p.IPsStr = ""
+	p.AllowedIPsSrvStr = ""
+
+	switch deviceType {
+	case DeviceTypeClient:
+		p.AllowedIPsStr = allowedIPs
+	case DeviceTypeServer:
+		var addresses, networks []string
+		for _, cidr := range common.ParseStringList(allowedIPs) {
+			_, ipNet, _ := net.ParseCIDR(cidr)
+			if ones, bits := ipNet.Mask.Size(); ones == bits {
+				addresses = append(addresses, cidr)
+			} else {
+				networks = append(networks, cidr)
+			}
+		}
+		p.SetIPAddresses(addresses...)
+		p.AllowedIPsSrvStr = common.ListToString(networks)
+	}
+}
+
+// parseAddressList parses a comma separated list of addresses, addresses without prefix length are host addresses.
+func parseAddressList(value string) ([]string, error) {
+	entries := common.ParseStringList(value)
+	addresses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address %s", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return nil, errors.Errorf("invalid address %s", entry)
+		}
+		addresses = append(addresses, entry)
+	}
+	return addresses, nil
+}
+
+// ImportStatus describes what an import changes for a single peer.
+type ImportStatus string
+
+const (
+	ImportStatusCreated   ImportStatus = "new"
+	ImportStatusUpdated   ImportStatus = "updated"
+	ImportStatusUnchanged ImportStatus = "already imported"
+)
+
+// ImportResult summarizes the changes of an import, see ImportConfig.
+type ImportResult struct {
+	DeviceCreated bool
+	DeviceChanged bool
+	Peers         map[string]ImportStatus // by public key
+
+	Created, Updated, Unchanged int
+}
+
+// AlreadyImported is true if the import does not change anything, e.g. if the same file is imported again.
+func (r ImportResult) AlreadyImported() bool {
+	return !r.DeviceChanged && r.Created == 0 && r.Updated == 0
+}
+
+var errImportDryRun = errors.New("dry run")
+
+// ImportConfig stores the imported interface and peers in the database. Existing peers of the interface with the same
+// public key are updated, all other peers of the interface are kept. Settings of the interface that are not part of
+// wg-quick configuration files, like the peer defaults, are kept as well. Peers and interface settings that equal the
+// stored ones are not touched, importing the same file again does not change anything.
+func (m *PeerManager) ImportConfig(cfg ImportedConfig, actor string) (ImportResult, error) {
+	return m.importConfig(cfg, actor, false)
+}
+
+// PreviewImport returns the changes that ImportConfig would make, without storing anything.
+func (m *PeerManager) PreviewImport(cfg ImportedConfig) (ImportResult, error) {
+	return m.importConfig(cfg, "", true)
+}
+
+func (m *PeerManager) importConfig(cfg ImportedConfig, actor string, dryRun bool) (ImportResult, error) {
+	result := ImportResult{Peers: make(map[string]ImportStatus, len(cfg.Peers))}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		device := Device{}
+		res := tx.Where("device_name = ?", cfg.Device.DeviceName).Limit(1).Find(&device)
+		if res.Error != nil {
+			return errors.Wrap(res.Error, "failed to load interface")
+		}
+		result.DeviceCreated = res.RowsAffected == 0
+		if result.DeviceCreated { // new interfaces use the global peer defaults, unless the file sets them
+			device.InheritDNS = true
+			device.InheritAllowedIPs = true
+			device.InheritKeepalive = true
+		}
+		result.DeviceChanged = applyImportedDevice(&device, cfg.Device) || result.DeviceCreated
+		if result.DeviceChanged {
+			device.UpdatedAt = time.Now()
+			if err := tx.Save(&device).Error; err != nil {
+				return errors.Wrap(err, "failed to save interface")
+			}
+		}
+
+		for _, peer := range cfg.Peers {
+			existing := Peer{}
+			res := tx.Where("public_key = ?", peer.PublicKey).Limit(1).Find(&existing)
+			if res.Error != nil {
+				return errors.Wrapf(res.Error, "failed to load peer %s", peer.PublicKey)
+			}
+
+			peer.DeviceName = device.DeviceName
+			peer.UpdatedBy = actor
+			peer.UpdatedAt = time.Now()
+			if res.RowsAffected == 0 {
+				peer.CreatedBy = actor
+				peer.CreatedAt = time.Now()
+				if err := tx.Create(&peer).Error; err != nil {
+					return errors.Wrapf(err, "failed to create peer %s", peer.PublicKey)
+				}
+				result.Peers[peer.PublicKey] = ImportStatusCreated
+				result.Created++
+				continue
+			}
+
+			if existing.DeviceName != device.DeviceName {
+				return errors.Errorf("peer %s already belongs to interface %s", peer.PublicKey, existing.DeviceName)
+			}
+			if !applyImportedPeer(&existing, peer, &device) {
+				result.Peers[peer.PublicKey] = ImportStatusUnchanged
+				result.Unchanged++
+				continue
+			}
+			existing.UpdatedBy = actor
+			existing.UpdatedAt = time.Now()
+			if err := tx.Save(&existing).Error; err != nil {
+				return errors.Wrapf(err, "failed to update peer %s", peer.PublicKey)
+			}
+			result.Peers[peer.PublicKey] = ImportStatusUpdated
+			result.Updated++
+		}
+
+		if dryRun {
+			return errImportDryRun // roll back
+		}
+		return nil
+	})
+	if err != nil && err != errImportDryRun {
+		return ImportResult{}, err
+	}
+	return result, nil
+}
+
+// applyImportedDevice copies the settings of the configuration file to the stored interface and reports whether
+// anything changed.
+func applyImportedDevice(device *Device, imported Device) bool {
+	updated := *device
+	updated.DeviceName = imported.DeviceName
+	updated.Type = imported.Type
+	updated.PrivateKey = imported.PrivateKey
+	updated.PublicKey = imported.PublicKey
+	updated.ListenPort = imported.ListenPort
+	updated.FirewallMark = imported.FirewallMark
+	updated.Mtu = imported.Mtu
+	updated.IPsStr = imported.IPsStr
+	if imported.Type == DeviceTypeClient || imported.DNSStr != "" { // the files of servers only contain a DNS setting
+		updated.DNSStr = imported.DNSStr // that is applied to the server itself, not the one of the peers
+	}
+	updated.RoutingTable = imported.RoutingTable
+	updated.PreUp = imported.PreUp
+	updated.PostUp = imported.PostUp
+	updated.PreDown = imported.PreDown
+	updated.PostDown = imported.PostDown
+	updated.SaveConfig = imported.SaveConfig
+	if imported.DNSStr != "" {
+		updated.InheritDNS = false
+	}
+
+	changed := updated.DeviceName != device.DeviceName || updated.Type != device.Type ||
+		updated.PrivateKey != device.PrivateKey || updated.PublicKey != device.PublicKey ||
+		updated.ListenPort != device.ListenPort || updated.FirewallMark != device.FirewallMark ||
+		updated.Mtu != device.Mtu || updated.IPsStr != device.IPsStr || updated.DNSStr != device.DNSStr ||
+		updated.RoutingTable != device.RoutingTable || updated.PreUp != device.PreUp ||
+		updated.PostUp != device.PostUp || updated.PreDown != device.PreDown ||
+		updated.PostDown != device.PostDown || updated.SaveConfig != device.SaveConfig ||
+		updated.InheritDNS != device.InheritDNS
+	*device = updated
+
+	return changed
+}
+
+// applyImportedPeer copies the settings of the configuration file to the stored peer and reports whether anything
+// changed. The owner is only set for peers that have no owner yet. Only the settings that the file contains for the
+// type of the interface are copied, e.g. the files of servers do not contain the client side allowed IPs and endpoint
+// of the peers. The keepalive is only overridden if it differs from the effective keepalive of the peer, so that
+// files written by the portal import without changes.
+func applyImportedPeer(existing *Peer, peer Peer, device *Device) bool {
+	updated := *existing
+	updated.PresharedKey = peer.PresharedKey
+	switch device.Type {
+	case DeviceTypeServer:
+		updated.IPsStr = peer.IPsStr
+		updated.AllowedIPsSrvStr = peer.AllowedIPsSrvStr
+	case DeviceTypeClient:
+		updated.AllowedIPsStr = peer.AllowedIPsStr
+		updated.Endpoint = peer.Endpoint
+	}
+	if peer.PersistentKeepalive != existing.EffectivePersistentKeepalive(device) {
+		updated.PersistentKeepalive = peer.PersistentKeepalive
+		updated.OverrideKeepalive = peer.OverrideKeepalive
+	}
+	if peer.PrivateKey != "" {
+		updated.PrivateKey = peer.PrivateKey
+	}
+	if existing.Email == AutodetectedPeerEmail && peer.Email != AutodetectedPeerEmail {
+		updated.Identifier = peer.Identifier
+		updated.Email = peer.Email
+	}
+
+	changed := updated.PresharedKey != existing.PresharedKey || updated.AllowedIPsStr != existing.AllowedIPsStr ||
+		updated.IPsStr != existing.IPsStr || updated.AllowedIPsSrvStr != existing.AllowedIPsSrvStr ||
+		updated.Endpoint != existing.Endpoint || updated.PersistentKeepalive != existing.PersistentKeepalive ||
+		updated.OverrideKeepalive != existing.OverrideKeepalive || updated.PrivateKey != existing.PrivateKey ||
+		updated.Email != existing.Email || updated.Identifier != existing.Identifier
+	*existing = updated
+
+	return changed
+}
@@ -0,0 +1,229 @@
+package wireguard
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type InfluxConfig struct {
+	Url       string        `yaml:"url" envconfig:"INFLUX_URL"`              // write endpoint, e.g. http://influx:8086/api/v2/write?org=x&bucket=y, empty disables the exporter
+	Token     string        `yaml:"token" envconfig:"INFLUX_TOKEN"`          // optional, sent as "Authorization: Token <token>"
+	Interval  time.Duration `yaml:"interval" envconfig:"INFLUX_INTERVAL"`    // push interval
+	Timeout   time.Duration `yaml:"timeout" envconfig:"INFLUX_TIMEOUT"`      // timeout of a single write request
+	BatchSize int           `yaml:"batchSize" envconfig:"INFLUX_BATCH_SIZE"` // maximum number of lines per write request
+	QueueSize int           `yaml:"queueSize" envconfig:"INFLUX_QUEUE_SIZE"` // maximum number of buffered lines, the oldest lines are dropped first
+}
+
+// InfluxExporter periodically writes the interface and peer metrics in the InfluxDB line protocol to the configured
+// endpoint. Measurements are buffered and written in batches by a separate sender, so a slow or unavailable InfluxDB
+// never delays the collection. Failed batches are retried on the next interval until the buffer is full.
+type InfluxExporter struct {
+	cfg    InfluxConfig
+	wg     *Manager
+	client *http.Client
+
+	mux     sync.Mutex
+	queue   []string
+	dropped int // lines dropped since the last warning
+	trimmed int // total number of lines dropped from the front of the queue
+	notify  chan struct{}
+}
+
+func NewInfluxExporter(cfg InfluxConfig, wg *Manager) *InfluxExporter {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 5000
+	}
+	if cfg.QueueSize < cfg.BatchSize {
+		cfg.QueueSize = cfg.BatchSize
+	}
+
+	return &InfluxExporter{
+		cfg:    cfg,
+		wg:     wg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Run collects the metrics until the given context is cancelled.
+func (e *InfluxExporter) Run(ctx context.Context) {
+	logrus.Debugf("starting InfluxDB exporter, interval: %s", e.cfg.Interval)
+
+	var sender sync.WaitGroup
+	sender.Add(1)
+	go func() {
+		defer sender.Done()
+		e.send(ctx)
+	}()
+
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		e.enqueue(e.collect(time.Now()))
+
+		select {
+		case <-ctx.Done():
+			sender.Wait()
+			logrus.Debug("InfluxDB exporter stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect returns the measurements of all managed devices:
+//
+//	wireguard_interface,interface=wg0 peers=2i,rx_bytes=100i,tx_bytes=200i <timestamp>
+//	wireguard_peer,interface=wg0,peer=<public key> rx_bytes=50i,tx_bytes=100i,handshake_age=12i,state="online" <timestamp>
+//
+// The handshake age is in seconds, it is missing if the peer never completed a handshake. The state is online, idle
+// or offline, see Config.ConnectionState.
+func (e *InfluxExporter) collect(now time.Time) []string {
+	devices, err := e.wg.GetDevices()
+	if err != nil {
+		logrus.Warnf("failed to collect InfluxDB metrics: %v", err)
+		return nil
+	}
+
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	lines := make([]string, 0)
+	for _, device := range devices {
+		if !common.ListContains(e.wg.Cfg.DeviceNames, device.Name) || e.wg.IsExternalDevice(device.Name) {
+			continue // unmanaged device, or a local interface with the name of an external one
+		}
+
+		var rx, tx int64
+		for _, peer := range device.Peers {
+			rx += peer.ReceiveBytes
+			tx += peer.TransmitBytes
+
+			fields := "rx_bytes=" + strconv.FormatInt(peer.ReceiveBytes, 10) + "i,tx_bytes=" +
+				strconv.FormatInt(peer.TransmitBytes, 10) + "i"
+			if !peer.LastHandshakeTime.IsZero() {
+				fields += ",handshake_age=" + strconv.FormatInt(int64(now.Sub(peer.LastHandshakeTime).Seconds()), 10) + "i"
+			}
+			fields += ",state=\"" + string(e.wg.Cfg.ConnectionState(device.Name, peer.LastHandshakeTime, now)) + "\""
+			lines = append(lines, "wireguard_peer,interface="+escapeInfluxTag(device.Name)+",peer="+
+				escapeInfluxTag(peer.PublicKey.String())+" "+fields+" "+timestamp)
+		}
+
+		lines = append(lines, "wireguard_interface,interface="+escapeInfluxTag(device.Name)+" peers="+
+			strconv.Itoa(len(device.Peers))+"i,rx_bytes="+strconv.FormatInt(rx, 10)+"i,tx_bytes="+
+			strconv.FormatInt(tx, 10)+"i "+timestamp)
+	}
+
+	return lines
+}
+
+// enqueue adds the lines to the buffer and wakes up the sender. If the buffer is full, the oldest lines are dropped.
+func (e *InfluxExporter) enqueue(lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+
+	e.mux.Lock()
+	e.queue = append(e.queue, lines...)
+	if overflow := len(e.queue) - e.cfg.QueueSize; overflow > 0 {
+		e.queue = append([]string(nil), e.queue[overflow:]...)
+		e.dropped += overflow
+		e.trimmed += overflow
+	}
+	e.mux.Unlock()
+
+	select {
+	case e.notify <- struct{}{}:
+	default: // the sender is busy, it picks up the new lines afterwards
+	}
+}
+
+// send writes the buffered lines whenever new lines are available until the given context is cancelled.
+func (e *InfluxExporter) send(ctx context.Context) {
+	failing := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.notify:
+		}
+
+		for {
+			e.mux.Lock()
+			if e.dropped > 0 {
+				logrus.Warnf("InfluxDB exporter buffer is full, dropped %d lines", e.dropped)
+				e.dropped = 0
+			}
+			batch := e.queue
+			if len(batch) > e.cfg.BatchSize {
+				batch = batch[:e.cfg.BatchSize]
+			}
+			batch = append([]string(nil), batch...)
+			trimmed := e.trimmed
+			e.mux.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := e.write(ctx, batch); err != nil {
+				if !failing {
+					logrus.Errorf("failed to write metrics to InfluxDB, retrying on the next interval: %v", err)
+				}
+				failing = true
+				break // keep the lines, they are retried with the next measurements
+			}
+			if failing {
+				logrus.Infof("writing metrics to InfluxDB succeeded again")
+				failing = false
+			}
+
+			e.mux.Lock()
+			// some of the sent lines might have been dropped from the front of the queue in the meantime
+			if sent := len(batch) - (e.trimmed - trimmed); sent > 0 {
+				e.queue = e.queue[sent:]
+			}
+			e.mux.Unlock()
+		}
+	}
+}
+
+func (e *InfluxExporter) write(ctx context.Context, lines []string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Url, strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.cfg.Token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// escapeInfluxTag escapes commas, equal signs and spaces of tag values, e.g. the padding of the public keys.
+func escapeInfluxTag(value string) string {
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(value)
+}
@@ -0,0 +1,87 @@
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// InterfaceManager manages the network links of the local WireGuard interfaces, it is implemented per platform. The
+// WireGuard configuration of the interfaces (keys and peers) is managed with wgctrl, and the state of the links is
+// read with the net package, both work on all platforms. Interfaces of remote hosts are managed by the agent of the
+// host instead.
+type InterfaceManager interface {
+	CreateLink(device string) error // creates a kernel WireGuard interface, wireguard-go interfaces are started by the Manager
+	DeleteLink(device string) error
+	SetLinkUp(device string) error
+	SetLinkDown(device string) error
+	AddAddress(device string, ip net.IP, network *net.IPNet) error
+	DeleteAddress(device string, ip net.IP, network *net.IPNet) error
+	SetMTU(device string, mtu int) error
+	SetLinkNamespace(device string, namespace int) error // moves the link into the network namespace of the file descriptor
+}
+
+// NotSupportedError is returned by the operations that are not available, e.g. creating interfaces on other platforms
+// than Linux.
+type NotSupportedError struct {
+	Operation string
+	Reason    string // e.g. "on darwin"
+}
+
+func (e NotSupportedError) Error() string {
+	return fmt.Sprintf("%s is not supported %s", e.Operation, e.Reason)
+}
+
+// IsNotSupported reports whether the error, or the error it wraps, is a NotSupportedError.
+func IsNotSupported(err error) bool {
+	var notSupported NotSupportedError
+	return errors.As(err, &notSupported)
+}
+
+// unsupportedInterfaceManager is used on platforms without an InterfaceManager. Existing interfaces and wireguard-go
+// interfaces can still be configured, only the links cannot be changed.
+type unsupportedInterfaceManager struct {
+	reason string
+}
+
+func platformNotSupported() unsupportedInterfaceManager {
+	return unsupportedInterfaceManager{reason: "on " + runtime.GOOS}
+}
+
+func (u unsupportedInterfaceManager) err(operation string) error {
+	return NotSupportedError{Operation: operation, Reason: u.reason}
+}
+
+func (u unsupportedInterfaceManager) CreateLink(string) error {
+	return u.err("creating kernel WireGuard interfaces")
+}
+
+func (u unsupportedInterfaceManager) DeleteLink(string) error {
+	return u.err("deleting interfaces")
+}
+
+func (u unsupportedInterfaceManager) SetLinkUp(string) error {
+	return u.err("changing the link state")
+}
+
+func (u unsupportedInterfaceManager) SetLinkDown(string) error {
+	return u.err("changing the link state")
+}
+
+func (u unsupportedInterfaceManager) AddAddress(string, net.IP, *net.IPNet) error {
+	return u.err("managing ip addresses")
+}
+
+func (u unsupportedInterfaceManager) DeleteAddress(string, net.IP, *net.IPNet) error {
+	return u.err("managing ip addresses")
+}
+
+func (u unsupportedInterfaceManager) SetMTU(string, int) error {
+	return u.err("changing the MTU")
+}
+
+func (u unsupportedInterfaceManager) SetLinkNamespace(string, int) error {
+	return u.err("network namespaces")
+}
@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package wireguard
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/mdlayher/netlink"
+	"github.com/milosgajdos/tenus"
+	"github.com/pkg/errors"
+)
+
+const iflaNetNsFd = 28 // IFLA_NET_NS_FD, see linux/if_link.h
+
+// netlinkInterfaceManager manages the links of the interfaces with netlink.
+type netlinkInterfaceManager struct{}
+
+func newInterfaceManager() InterfaceManager {
+	return netlinkInterfaceManager{}
+}
+
+func (netlinkInterfaceManager) CreateLink(device string) error {
+	conn, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return errors.Wrap(err, "could not open netlink connection")
+	}
+	defer conn.Close()
+
+	return conn.Link.New(&rtnetlink.LinkMessage{
+		Family:     syscall.AF_UNSPEC,
+		Attributes: &rtnetlink.LinkAttributes{Name: device, Info: &rtnetlink.LinkInfo{Kind: "wireguard"}},
+	})
+}
+
+func (netlinkInterfaceManager) DeleteLink(device string) error {
+	return tenus.DeleteLink(device)
+}
+
+func (netlinkInterfaceManager) SetLinkUp(device string) error {
+	link, err := tenus.NewLinkFrom(device)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	}
+	return link.SetLinkUp()
+}
+
+func (netlinkInterfaceManager) SetLinkDown(device string) error {
+	link, err := tenus.NewLinkFrom(device)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	}
+	return link.SetLinkDown()
+}
+
+func (netlinkInterfaceManager) AddAddress(device string, ip net.IP, network *net.IPNet) error {
+	link, err := tenus.NewLinkFrom(device)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	}
+	return link.SetLinkIp(ip, network)
+}
+
+func (netlinkInterfaceManager) DeleteAddress(device string, ip net.IP, network *net.IPNet) error {
+	link, err := tenus.NewLinkFrom(device)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	}
+	return link.UnsetLinkIp(ip, network)
+}
+
+func (netlinkInterfaceManager) SetMTU(device string, mtu int) error {
+	link, err := tenus.NewLinkFrom(device)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	}
+	return link.SetLinkMTU(mtu)
+}
+
+func (netlinkInterfaceManager) SetLinkNamespace(device string, namespace int) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	}
+
+	conn, err := netlink.Dial(syscall.NETLINK_ROUTE, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not open netlink connection")
+	}
+	defer conn.Close()
+
+	header, err := (&rtnetlink.LinkMessage{Family: syscall.AF_UNSPEC, Index: uint32(iface.Index)}).MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "could not encode link message")
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(iflaNetNsFd, uint32(namespace))
+	attributes, err := ae.Encode()
+	if err != nil {
+		return errors.Wrap(err, "could not encode link attributes")
+	}
+
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: syscall.RTM_NEWLINK, Flags: netlink.Request | netlink.Acknowledge},
+		Data:   append(header, attributes...),
+	})
+	return err
+}
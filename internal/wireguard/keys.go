@@ -0,0 +1,25 @@
+package wireguard
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ParsePublicKey parses a public key that was generated on the client, e.g. with "wg genkey | wg pubkey". Besides the
+// encoding, the key must be a Curve25519 point of large order: a low order point, e.g. the all-zero key, results in
+// a predictable shared secret and the kernel refuses handshakes with it.
+func ParsePublicKey(publicKey string) (wgtypes.Key, error) {
+	key, err := wgtypes.ParseKey(strings.TrimSpace(publicKey))
+	if err != nil {
+		return key, errors.New("invalid public key, expected a base64 encoded 32 byte key")
+	}
+	// The product with any scalar is zero only for low order points, X25519 reports it as error
+	if _, err := curve25519.X25519(curve25519.Basepoint, key[:]); err != nil {
+		return key, errors.New("invalid public key, the key is not a valid Curve25519 public key")
+	}
+
+	return key, nil
+}
@@ -1,32 +1,74 @@
 package wireguard
 
 import (
+	"runtime"
 	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// Manager offers a synchronized management interface to the real WireGuard interface.
+// Manager offers a synchronized management interface to the real WireGuard interface. Device reads are served from
+// a short-lived cache, changes made through the manager invalidate the cached device.
 type Manager struct {
-	Cfg *Config
-	wg  *wgctrl.Client
-	mux sync.RWMutex
+	Cfg   *Config
+	wg    localClient
+	mux   sync.RWMutex
+	cache *deviceCache
+	links InterfaceManager // manages the links of the local interfaces, see newInterfaceManager
+
+	nsMux      sync.Mutex
+	namespaces map[string]string         // network namespaces of the local interfaces, see SetDeviceNamespace
+	nsClients  map[string]*wgctrl.Client // WireGuard clients of the network namespaces
+
+	autoBackend Backend // the backend that is used in auto mode on this host
+
+	// OnUserspaceRestart is called after the crashed wireguard-go process of an interface was restarted, the new
+	// interface has to be configured again.
+	OnUserspaceRestart func(device string)
+	procMux            sync.Mutex
+	processes          map[string]*userspaceProcess // supervised wireguard-go interfaces
+
+	// OnHostReconnect is called for every interface of a remote host that is reachable again, queued changes are not
+	// replayed, the interface has to be restored.
+	OnHostReconnect func(device string)
+	hosts           map[string]*remoteHost // remote hosts by interface name
 }
 
 func (m *Manager) Init() error {
-	var err error
-	m.wg, err = wgctrl.New()
+	wg, err := wgctrl.New()
 	if err != nil {
 		return errors.Wrap(err, "could not create WireGuard client")
 	}
+	m.wg = wg
+	m.cache = newDeviceCache(m.Cfg.DeviceCacheTTL, m.fetchDevice)
+	m.links = newInterfaceManager()
+	m.namespaces = make(map[string]string)
+	m.nsClients = make(map[string]*wgctrl.Client)
+	if _, ok := m.links.(unsupportedInterfaceManager); ok {
+		logrus.Warnf("interfaces cannot be created or changed on %s, only existing, userspace and external "+
+			"interfaces can be managed", runtime.GOOS)
+	}
+	if err := m.initHosts(); err != nil {
+		return err
+	}
+	m.initExternalDevices()
 
-	return nil
+	return m.initBackend()
 }
 
+func (m *Manager) fetchDevice(device string) (*wgtypes.Device, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	return m.client(device).Device(device)
+}
+
+// GetDeviceInfo returns a snapshot of the device that may be up to WG_DEVICE_CACHE_TTL old.
 func (m *Manager) GetDeviceInfo(device string) (*wgtypes.Device, error) {
-	dev, err := m.wg.Device(device)
+	dev, err := m.cache.Get(device)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get WireGuard device")
 	}
@@ -34,22 +76,47 @@ func (m *Manager) GetDeviceInfo(device string) (*wgtypes.Device, error) {
 	return dev, nil
 }
 
-func (m *Manager) GetPeerList(device string) ([]wgtypes.Peer, error) {
+// RefreshDeviceInfo reads the device from the kernel and updates the cached snapshot.
+func (m *Manager) RefreshDeviceInfo(device string) (*wgtypes.Device, error) {
+	dev, err := m.cache.Refresh(device)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get WireGuard device")
+	}
+
+	return dev, nil
+}
+
+// GetDevices returns all WireGuard devices of the host, including unmanaged ones. The devices of the network
+// namespaces of the managed interfaces are included as well.
+func (m *Manager) GetDevices() ([]*wgtypes.Device, error) {
 	m.mux.RLock()
 	defer m.mux.RUnlock()
 
-	dev, err := m.wg.Device(device)
+	if m.wg == nil {
+		return nil, errOffline
+	}
+	devices, err := m.wg.Devices()
 	if err != nil {
-		return nil, errors.Wrap(err, "could not get WireGuard device")
+		return nil, errors.Wrap(err, "could not get WireGuard devices")
+	}
+	nsDevices, err := m.namespaceDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(devices, nsDevices...), nil
+}
+
+func (m *Manager) GetPeerList(device string) ([]wgtypes.Peer, error) {
+	dev, err := m.GetDeviceInfo(device)
+	if err != nil {
+		return nil, err
 	}
 
 	return dev.Peers, nil
 }
 
 func (m *Manager) GetPeer(device string, pubKey string) (*wgtypes.Peer, error) {
-	m.mux.RLock()
-	defer m.mux.RUnlock()
-
 	publicKey, err := wgtypes.ParseKey(pubKey)
 	if err != nil {
 		return nil, errors.Wrap(err, "invalid public key")
@@ -72,8 +139,9 @@ func (m *Manager) GetPeer(device string, pubKey string) (*wgtypes.Peer, error) {
 func (m *Manager) AddPeer(device string, cfg wgtypes.PeerConfig) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	defer m.cache.Invalidate(device)
 
-	err := m.wg.ConfigureDevice(device, wgtypes.Config{Peers: []wgtypes.PeerConfig{cfg}})
+	err := m.client(device).ConfigureDevice(device, wgtypes.Config{Peers: []wgtypes.PeerConfig{cfg}})
 	if err != nil {
 		return errors.Wrap(err, "could not configure WireGuard device")
 	}
@@ -81,12 +149,109 @@ func (m *Manager) AddPeer(device string, cfg wgtypes.PeerConfig) error {
 	return nil
 }
 
+// ConfigurePeers applies all given peer configurations to the device in a single configuration call.
+func (m *Manager) ConfigurePeers(device string, cfgs []wgtypes.PeerConfig) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	defer m.cache.Invalidate(device)
+
+	err := m.client(device).ConfigureDevice(device, wgtypes.Config{Peers: cfgs})
+	if err != nil {
+		return errors.Wrap(err, "could not configure WireGuard device")
+	}
+
+	return nil
+}
+
+// PeerSnapshot is the state of the peers of a device before a configuration call, see SnapshotPeers.
+type PeerSnapshot struct {
+	device string
+	peers  []wgtypes.PeerConfig // restores the peers that existed before, removes the others
+}
+
+// SnapshotPeers records the current state of the peers that the configurations change, RestorePeers applies it
+// again. The snapshot of an external interface or of an unreachable remote host is empty: changes of external
+// interfaces are never applied and remote interfaces are restored from the database once the host is reachable.
+func (m *Manager) SnapshotPeers(device string, cfgs []wgtypes.PeerConfig) (*PeerSnapshot, error) {
+	snapshot := &PeerSnapshot{device: device}
+	if m.IsExternalDevice(device) {
+		return snapshot, nil
+	}
+	dev, err := m.RefreshDeviceInfo(device)
+	if errors.Is(err, errHostUnreachable) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[wgtypes.Key]wgtypes.Peer, len(dev.Peers))
+	for _, peer := range dev.Peers {
+		current[peer.PublicKey] = peer
+	}
+	recorded := make(map[wgtypes.Key]bool, len(cfgs))
+	for _, cfg := range cfgs {
+		if recorded[cfg.PublicKey] {
+			continue
+		}
+		recorded[cfg.PublicKey] = true
+
+		peer, ok := current[cfg.PublicKey]
+		if !ok {
+			snapshot.peers = append(snapshot.peers, wgtypes.PeerConfig{PublicKey: cfg.PublicKey, Remove: true})
+			continue
+		}
+		presharedKey, keepalive := peer.PresharedKey, peer.PersistentKeepaliveInterval
+		snapshot.peers = append(snapshot.peers, wgtypes.PeerConfig{
+			PublicKey:                   peer.PublicKey,
+			PresharedKey:                &presharedKey,
+			Endpoint:                    peer.Endpoint,
+			PersistentKeepaliveInterval: &keepalive,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  peer.AllowedIPs,
+		})
+	}
+
+	return snapshot, nil
+}
+
+// RestorePeers applies the state of the snapshot: changed and removed peers get their previous configuration, added
+// peers are removed again.
+func (m *Manager) RestorePeers(snapshot *PeerSnapshot) error {
+	if len(snapshot.peers) == 0 {
+		return nil
+	}
+	if err := m.ConfigurePeers(snapshot.device, snapshot.peers); err != nil {
+		return errors.WithMessagef(err, "failed to restore the peers of %s", snapshot.device)
+	}
+
+	return nil
+}
+
+// ConfigurePeersOrRestore applies the configurations like ConfigurePeers. A failed call may have applied a part of
+// the configurations, the changed peers are set back to their previous state then.
+func (m *Manager) ConfigurePeersOrRestore(device string, cfgs []wgtypes.PeerConfig) error {
+	snapshot, err := m.SnapshotPeers(device, cfgs)
+	if err != nil {
+		return errors.WithMessage(err, "failed to read the WireGuard peers before the change")
+	}
+	if err := m.ConfigurePeers(device, cfgs); err != nil {
+		if restoreErr := m.RestorePeers(snapshot); restoreErr != nil {
+			logrus.Errorf("%v, the interface is inconsistent until it is restored", restoreErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
 func (m *Manager) UpdatePeer(device string, cfg wgtypes.PeerConfig) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	defer m.cache.Invalidate(device)
 
 	cfg.UpdateOnly = true
-	err := m.wg.ConfigureDevice(device, wgtypes.Config{Peers: []wgtypes.PeerConfig{cfg}})
+	err := m.client(device).ConfigureDevice(device, wgtypes.Config{Peers: []wgtypes.PeerConfig{cfg}})
 	if err != nil {
 		return errors.Wrap(err, "could not configure WireGuard device")
 	}
@@ -97,6 +262,7 @@ func (m *Manager) UpdatePeer(device string, cfg wgtypes.PeerConfig) error {
 func (m *Manager) RemovePeer(device string, pubKey string) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
+	defer m.cache.Invalidate(device)
 
 	publicKey, err := wgtypes.ParseKey(pubKey)
 	if err != nil {
@@ -108,7 +274,7 @@ func (m *Manager) RemovePeer(device string, pubKey string) error {
 		Remove:    true,
 	}
 
-	err = m.wg.ConfigureDevice(device, wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}})
+	err = m.client(device).ConfigureDevice(device, wgtypes.Config{Peers: []wgtypes.PeerConfig{peer}})
 	if err != nil {
 		return errors.Wrap(err, "could not configure WireGuard device")
 	}
@@ -117,5 +283,9 @@ func (m *Manager) RemovePeer(device string, pubKey string) error {
 }
 
 func (m *Manager) UpdateDevice(device string, cfg wgtypes.Config) error {
-	return m.wg.ConfigureDevice(device, cfg)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	defer m.cache.Invalidate(device)
+
+	return m.client(device).ConfigureDevice(device, cfg)
 }
@@ -0,0 +1,245 @@
+package wireguard
+
+import (
+	"os/exec"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Backend selects the WireGuard implementation of the interfaces that are created by the portal. Existing
+// interfaces are controlled the same way regardless of their implementation.
+type Backend string
+
+const (
+	BackendKernel    Backend = "kernel"    // the WireGuard kernel module (netlink)
+	BackendUserspace Backend = "userspace" // wireguard-go
+	BackendAuto      Backend = "auto"      // the kernel module if it is available, wireguard-go otherwise
+
+	userspaceStartTimeout   = 5 * time.Second
+	userspaceWatchInterval  = 5 * time.Second // check interval of wireguard-go interfaces that the portal did not start
+	userspaceRestartDelay   = time.Second
+	userspaceMaxRestartWait = time.Minute
+)
+
+// userspaceProcess is a supervised wireguard-go interface. The process is restarted until the interface is deleted.
+type userspaceProcess struct {
+	stopped bool
+}
+
+// initBackend validates the configured backends. In auto mode the kernel module is used if it is loaded or can be
+// loaded, otherwise new interfaces are created with wireguard-go.
+func (m *Manager) initBackend() error {
+	m.processes = make(map[string]*userspaceProcess)
+	m.autoBackend = BackendKernel
+	if !kernelModuleAvailable() {
+		m.autoBackend = BackendUserspace
+	}
+
+	userspace := false
+	for _, device := range append([]string{""}, m.Cfg.DeviceNames...) {
+		switch backend := m.backendFor(device); backend {
+		case BackendKernel, BackendUserspace, BackendAuto, "":
+			userspace = userspace || m.resolveBackend(backend) == BackendUserspace
+		default:
+			return errors.Errorf("unknown WireGuard backend %s, use kernel, userspace or auto", backend)
+		}
+	}
+	for device := range m.Cfg.DeviceBackends {
+		if !common.ListContains(m.Cfg.DeviceNames, device) {
+			logrus.Warnf("WG_DEVICE_BACKENDS contains %s which is not a managed interface", device)
+		}
+	}
+
+	if userspace {
+		if _, err := exec.LookPath(m.Cfg.UserspaceBinary); err != nil {
+			logrus.Warnf("userspace backend selected but %s is not available, interfaces cannot be created: %v",
+				m.Cfg.UserspaceBinary, err)
+		}
+	}
+	logrus.Infof("using the %s WireGuard backend for new interfaces", m.resolveBackend(m.Cfg.Backend))
+
+	return nil
+}
+
+// backendFor returns the configured backend of the interface, WG_DEVICE_BACKENDS overrides WG_BACKEND. An empty
+// device name returns the default backend.
+func (m *Manager) backendFor(device string) Backend {
+	if backend, ok := m.Cfg.DeviceBackends[device]; ok && device != "" {
+		return backend
+	}
+	return m.Cfg.Backend
+}
+
+// resolveBackend returns the implementation that is used for new interfaces of the given backend.
+func (m *Manager) resolveBackend(backend Backend) Backend {
+	switch backend {
+	case BackendUserspace:
+		return BackendUserspace
+	case BackendAuto:
+		return m.autoBackend
+	default:
+		return BackendKernel
+	}
+}
+
+// CheckDeviceBackend returns an error if the interface exists but is implemented by another backend than the
+// configured one. Existing interfaces are never switched, they have to be deleted, so that they are created again
+// with the configured backend. Interfaces that do not exist and interfaces in auto mode are always accepted.
+func (m *Manager) CheckDeviceBackend(device string) error {
+	configured := m.backendFor(device)
+	if configured == BackendAuto {
+		return nil
+	}
+	dev, err := m.fetchDevice(device)
+	if err != nil {
+		return nil // the interface does not exist yet
+	}
+
+	var running Backend
+	switch dev.Type {
+	case wgtypes.LinuxKernel:
+		running = BackendKernel
+	case wgtypes.Userspace:
+		running = BackendUserspace
+	default:
+		return nil
+	}
+	if wanted := m.resolveBackend(configured); running != wanted {
+		return errors.Errorf("interface %s is implemented by the %s backend but the %s backend is configured, "+
+			"existing interfaces are not switched: delete the interface (ip link del %s) to create it again with the "+
+			"%s backend, or configure the %s backend", device, running, wanted, device, wanted, running)
+	}
+
+	return nil
+}
+
+// createUserspaceLink starts a supervised wireguard-go process for the interface.
+func (m *Manager) createUserspaceLink(device string) error {
+	exited, err := m.startUserspaceProcess(device)
+	if err != nil {
+		return err
+	}
+	m.superviseUserspace(device, exited)
+
+	return nil
+}
+
+// attachUserspaceLink supervises an existing interface of a wireguard-go process that was not started by the portal,
+// e.g. before a restart of the portal. The process is started again if the interface disappears.
+func (m *Manager) attachUserspaceLink(device string) {
+	m.procMux.Lock()
+	_, supervised := m.processes[device]
+	m.procMux.Unlock()
+	if supervised {
+		return
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		for {
+			time.Sleep(userspaceWatchInterval)
+			if _, err := m.fetchDevice(device); err != nil {
+				exited <- err
+				return
+			}
+		}
+	}()
+	m.superviseUserspace(device, exited)
+	logrus.Infof("supervising the existing userspace interface %s", device)
+}
+
+// startUserspaceProcess runs wireguard-go in the foreground and waits until the interface can be configured through
+// its control socket. The returned channel receives the result of the process once it exits. The process gets its own
+// process group, so it keeps running if the portal is stopped, like a kernel interface.
+func (m *Manager) startUserspaceProcess(device string) (<-chan error, error) {
+	cmd := exec.Command(m.Cfg.UserspaceBinary, "-f", device)
+	cmd.SysProcAttr = detachedProcessAttributes()
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "could not start %s for interface %s", m.Cfg.UserspaceBinary, device)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	deadline := time.Now().Add(userspaceStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return nil, errors.Errorf("%s exited before interface %s came up: %v", m.Cfg.UserspaceBinary, device, err)
+		default:
+		}
+		if _, err := m.fetchDevice(device); err == nil {
+			return exited, nil
+		}
+		if time.Now().After(deadline) {
+			_ = cmd.Process.Kill()
+			return nil, errors.Errorf("userspace interface %s did not come up within %s", device, userspaceStartTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// superviseUserspace restarts wireguard-go whenever the process of the interface exits, unless the interface was
+// deleted through the manager. The restarted interface has no configuration, OnUserspaceRestart restores it.
+func (m *Manager) superviseUserspace(device string, exited <-chan error) {
+	proc := &userspaceProcess{}
+	m.procMux.Lock()
+	m.processes[device] = proc
+	m.procMux.Unlock()
+
+	go func() {
+		for {
+			err := <-exited
+			delay := userspaceRestartDelay
+			for {
+				if m.userspaceStopped(proc) {
+					return
+				}
+				logrus.Errorf("wireguard-go process of interface %s exited (%v), restarting it in %s", device, err,
+					delay)
+				m.cache.Invalidate(device)
+				time.Sleep(delay)
+				if m.userspaceStopped(proc) {
+					return
+				}
+				if exited, err = m.startUserspaceProcess(device); err == nil {
+					break
+				}
+				if delay *= 2; delay > userspaceMaxRestartWait {
+					delay = userspaceMaxRestartWait
+				}
+			}
+
+			logrus.Infof("restarted wireguard-go process of interface %s", device)
+			m.cache.Invalidate(device)
+			if m.OnUserspaceRestart != nil {
+				m.OnUserspaceRestart(device)
+			}
+		}
+	}()
+}
+
+func (m *Manager) userspaceStopped(proc *userspaceProcess) bool {
+	m.procMux.Lock()
+	defer m.procMux.Unlock()
+
+	return proc.stopped
+}
+
+// stopUserspaceSupervision stops restarting the wireguard-go process of the interface, the process exits once its
+// interface is deleted.
+func (m *Manager) stopUserspaceSupervision(device string) {
+	m.procMux.Lock()
+	defer m.procMux.Unlock()
+
+	if proc, ok := m.processes[device]; ok {
+		proc.stopped = true
+		delete(m.processes, device)
+	}
+}
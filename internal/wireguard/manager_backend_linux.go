@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package wireguard
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+// kernelModuleAvailable reports whether the WireGuard kernel module is loaded, built in or installed for the running
+// kernel.
+func kernelModuleAvailable() bool {
+	if _, err := os.Stat("/sys/module/wireguard"); err == nil {
+		return true
+	}
+
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err != nil {
+		return false
+	}
+	release := make([]byte, 0, len(uname.Release))
+	for _, c := range uname.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	modules, err := ioutil.ReadFile(path.Join("/lib/modules", string(release), "modules.dep"))
+	if err != nil {
+		return false
+	}
+
+	return bytes.Contains(modules, []byte("/wireguard.ko"))
+}
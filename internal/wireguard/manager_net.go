@@ -3,28 +3,249 @@ package wireguard
 import (
 	"fmt"
 	"net"
+	"regexp"
+	"strconv"
 
-	"github.com/milosgajdos/tenus"
+	"github.com/h44z/wg-portal/internal/common"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const DefaultMTU = 1420
 
-func (m *Manager) GetIPAddress(device string) ([]string, error) {
-	wgInterface, err := tenus.NewLinkFrom(device)
+// Limits of the interface parameters, see ValidateInterfaceParameters
+const (
+	MinMTU            = 576  // the minimum MTU of IPv4
+	MinMTUIPv6        = 1280 // interfaces with IPv6 addresses need at least this MTU
+	MaxMTU            = 1500 // WireGuard packets have to fit into the MTU of the upstream link
+	maxInterfaceName  = 15   // IFNAMSIZ without the terminating null byte
+	interfaceNameHint = "only letters, digits, '_', '.' and '-' are allowed"
+)
+
+var interfaceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// InterfaceParameterError describes an invalid parameter of an interface that should be created.
+type InterfaceParameterError struct {
+	Parameter string // name, MTU or address
+	Value     string
+	Reason    string
+}
+
+func (e InterfaceParameterError) Error() string {
+	return fmt.Sprintf("invalid interface %s %q: %s", e.Parameter, e.Value, e.Reason)
+}
+
+// IsValidInterfaceName checks that the name can be used as a Linux network interface name.
+func IsValidInterfaceName(name string) bool {
+	return ValidateInterfaceName(name) == nil
+}
+
+// ValidateInterfaceName checks the rules of the kernel for interface names. Characters that the kernel accepts but
+// that break configuration files and shell commands, e.g. spaces or colons, are rejected as well.
+func ValidateInterfaceName(name string) error {
+	switch {
+	case name == "":
+		return InterfaceParameterError{Parameter: "name", Value: name, Reason: "the name must not be empty"}
+	case len(name) > maxInterfaceName:
+		return InterfaceParameterError{Parameter: "name", Value: name,
+			Reason: fmt.Sprintf("the name must not be longer than %d characters", maxInterfaceName)}
+	case name == "." || name == "..":
+		return InterfaceParameterError{Parameter: "name", Value: name, Reason: "the name is reserved"}
+	case !interfaceNameRegex.MatchString(name):
+		return InterfaceParameterError{Parameter: "name", Value: name, Reason: interfaceNameHint}
+	}
+	return nil
+}
+
+// ValidateInterfaceParameters checks the name, the MTU and the addresses of an interface before it is created, so
+// that invalid parameters are reported before the link exists instead of leaving a half configured interface behind.
+// An MTU of 0 means DefaultMTU.
+func ValidateInterfaceParameters(name string, mtu int, cidrs []string) error {
+	if err := ValidateInterfaceName(name); err != nil {
+		return err
+	}
+
+	hasIPv6 := false
+	seen := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return InterfaceParameterError{Parameter: "address", Value: cidr,
+				Reason: "the address must be an IP address with prefix length, e.g. 10.0.0.1/24"}
+		}
+		if ip.IsUnspecified() || ip.IsMulticast() || ip.IsLoopback() {
+			return InterfaceParameterError{Parameter: "address", Value: cidr,
+				Reason: "unspecified, loopback and multicast addresses cannot be assigned"}
+		}
+		if seen[ip.String()] {
+			return InterfaceParameterError{Parameter: "address", Value: cidr, Reason: "the address is listed twice"}
+		}
+		seen[ip.String()] = true
+		hasIPv6 = hasIPv6 || ip.To4() == nil
+	}
+
+	switch {
+	case mtu == 0:
+	case mtu < MinMTU || mtu > MaxMTU:
+		return InterfaceParameterError{Parameter: "MTU", Value: strconv.Itoa(mtu),
+			Reason: fmt.Sprintf("the MTU must be between %d and %d, or 0 for the default", MinMTU, MaxMTU)}
+	case hasIPv6 && mtu < MinMTUIPv6:
+		return InterfaceParameterError{Parameter: "MTU", Value: strconv.Itoa(mtu),
+			Reason: fmt.Sprintf("interfaces with IPv6 addresses need an MTU of at least %d", MinMTUIPv6)}
+	}
+
+	return nil
+}
+
+// CreateDevice creates a new WireGuard interface with the given name. If the interface already exists, it is reused
+// and left untouched. Newly created interfaces get a random private key, so they can be imported like any other
+// existing interface. The returned boolean is true if the interface has been created. In auto mode, wireguard-go is
+// used if the kernel refuses to create the interface. Existing wireguard-go interfaces are supervised as well.
+func (m *Manager) CreateDevice(device string) (bool, error) {
+	if m.IsExternalDevice(device) {
+		return false, nil
+	}
+	if err := ValidateInterfaceName(device); err != nil {
+		return false, err
+	}
+	if host := m.remoteHost(device); host != nil {
+		created, err := host.createLink(device)
+		if err != nil {
+			return false, errors.WithMessagef(err, "could not create WireGuard interface %s", device)
+		}
+		if !created {
+			return false, nil // interface already exists
+		}
+	} else {
+		if err := m.checkDeviceNamespace(device); err != nil {
+			return false, err
+		}
+		if m.inDeviceNamespace(device, func() error { return linkExists(device) }) == nil {
+			if dev, err := m.fetchDevice(device); err == nil && dev.Type == wgtypes.Userspace {
+				m.attachUserspaceLink(device)
+			}
+			return false, nil // interface already exists
+		}
+
+		if err := m.createLink(device); err != nil {
+			return false, errors.Wrapf(err, "could not create WireGuard interface %s", device)
+		}
+	}
+
+	key, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		return nil, errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+		return true, errors.Wrap(err, "could not generate private key")
+	}
+	if err := m.UpdateDevice(device, wgtypes.Config{PrivateKey: &key}); err != nil {
+		return true, errors.Wrapf(err, "could not configure WireGuard interface %s", device)
+	}
+
+	return true, nil
+}
+
+// createLink creates the link with the backend of the interface. The link of an interface with network namespace is
+// created in the namespace of the portal and moved into the namespace afterwards, see SetDeviceNamespace.
+func (m *Manager) createLink(device string) error {
+	backend := m.backendFor(device)
+	namespace := m.DeviceNamespace(device)
+	if m.resolveBackend(backend) == BackendUserspace {
+		if namespace != "" {
+			return errors.Errorf("wireguard-go interfaces cannot be moved into network namespace %s, use the kernel "+
+				"backend", namespace)
+		}
+		return m.createUserspaceLink(device)
+	}
+
+	err := m.links.CreateLink(device)
+	if err != nil && backend == BackendAuto && namespace == "" {
+		logrus.Warnf("kernel could not create WireGuard interface %s, falling back to userspace: %v", device, err)
+		return m.createUserspaceLink(device)
+	}
+	if err != nil || namespace == "" {
+		return err
+	}
+
+	if err := m.moveLink(device, "", namespace); err != nil {
+		_ = m.links.DeleteLink(device)
+		return err
+	}
+	return nil
+}
+
+// IsLinkUp reports whether the link of the interface is up.
+func (m *Manager) IsLinkUp(device string) (bool, error) {
+	if m.IsExternalDevice(device) {
+		return false, ErrExternalDevice
+	}
+	if host := m.remoteHost(device); host != nil {
+		return host.isLinkUp(device)
+	}
+
+	up := false
+	err := m.inDeviceNamespace(device, func() error {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			return errors.Wrapf(err, "could not retrieve interface %s", device)
+		}
+		up = iface.Flags&net.FlagUp != 0
+		return nil
+	})
+
+	return up, err
+}
+
+func (m *Manager) SetLinkUp(device string) error {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+	if host := m.remoteHost(device); host != nil {
+		return host.setLinkState(device, "up")
 	}
 
-	// Get golang net.interface
-	iface := wgInterface.NetInterface()
-	if iface == nil { // Not sure if this check is really necessary
-		return nil, errors.Wrap(err, "could not retrieve WireGuard net.interface")
+	if err := m.inDeviceNamespace(device, func() error { return m.links.SetLinkUp(device) }); err != nil {
+		return errors.Wrapf(err, "could not bring up interface %s", device)
 	}
 
-	addrs, err := iface.Addrs()
+	return nil
+}
+
+func (m *Manager) SetLinkDown(device string) error {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+	if host := m.remoteHost(device); host != nil {
+		return host.setLinkState(device, "down")
+	}
+
+	if err := m.inDeviceNamespace(device, func() error { return m.links.SetLinkDown(device) }); err != nil {
+		return errors.Wrapf(err, "could not bring down interface %s", device)
+	}
+
+	return nil
+}
+
+func (m *Manager) GetIPAddress(device string) ([]string, error) {
+	if m.IsExternalDevice(device) {
+		return nil, ErrExternalDevice
+	}
+	if host := m.remoteHost(device); host != nil {
+		return host.getIPAddresses(device)
+	}
+
+	var addrs []net.Addr
+	err := m.inDeviceNamespace(device, func() error {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+		}
+		if addrs, err = iface.Addrs(); err != nil {
+			return errors.Wrap(err, "could not retrieve WireGuard ip addresses")
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "could not retrieve WireGuard ip addresses")
+		return nil, err
 	}
 
 	ipAddresses := make([]string, 0, len(addrs))
@@ -51,36 +272,81 @@ func (m *Manager) GetIPAddress(device string) ([]string, error) {
 	return ipAddresses, nil
 }
 
-func (m *Manager) SetIPAddress(device string, cidrs []string) error {
-	wgInterface, err := tenus.NewLinkFrom(device)
+// DeleteDevice removes the WireGuard interface with the given name. Interfaces that do not exist are ignored. The
+// wireguard-go process of a userspace interface exits once its interface is removed. The network namespace of the
+// interface is forgotten, so a new interface with the same name is created in the namespace of the portal.
+func (m *Manager) DeleteDevice(device string) error {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+	m.stopUserspaceSupervision(device)
+	if host := m.remoteHost(device); host != nil {
+		return host.deleteLink(device)
+	}
+
+	err := m.inDeviceNamespace(device, func() error {
+		if linkExists(device) != nil {
+			return nil // interface does not exist
+		}
+		return m.links.DeleteLink(device)
+	})
 	if err != nil {
-		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+		return errors.Wrapf(err, "could not delete WireGuard interface %s", device)
+	}
+	m.forgetDeviceNamespace(device)
+
+	return nil
+}
+
+// SetIPAddress replaces the ip addresses of the interface. Addresses that are kept are not touched, so routes and
+// connections using them are not disrupted. Link-local addresses are never removed, the kernel assigns them itself.
+func (m *Manager) SetIPAddress(device string, cidrs []string) error {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+	if host := m.remoteHost(device); host != nil {
+		return host.setIPAddresses(device, cidrs)
 	}
 
-	// First remove existing IP addresses
 	existingIPs, err := m.GetIPAddress(device)
 	if err != nil {
 		return errors.Wrap(err, "could not retrieve IP addresses")
 	}
+	wanted := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		wanted[cidr] = true
+	}
+	existing := make(map[string]bool, len(existingIPs))
+
+	// First remove IP addresses that are no longer used
 	for _, cidr := range existingIPs {
+		existing[cidr] = true
+		if wanted[cidr] || common.IsLinkLocal(cidr) {
+			continue
+		}
 		wgIp, wgIpNet, err := net.ParseCIDR(cidr)
 		if err != nil {
 			return errors.Wrapf(err, "unable to parse cidr %s", cidr)
 		}
 
-		if err := wgInterface.UnsetLinkIp(wgIp, wgIpNet); err != nil {
+		err = m.inDeviceNamespace(device, func() error { return m.links.DeleteAddress(device, wgIp, wgIpNet) })
+		if err != nil {
 			return errors.Wrapf(err, "failed to unset ip %s", cidr)
 		}
 	}
 
 	// Next set new IP addresses
 	for _, cidr := range cidrs {
+		if existing[cidr] {
+			continue
+		}
 		wgIp, wgIpNet, err := net.ParseCIDR(cidr)
 		if err != nil {
 			return errors.Wrapf(err, "unable to parse cidr %s", cidr)
 		}
 
-		if err := wgInterface.SetLinkIp(wgIp, wgIpNet); err != nil {
+		err = m.inDeviceNamespace(device, func() error { return m.links.AddAddress(device, wgIp, wgIpNet) })
+		if err != nil {
 			return errors.Wrapf(err, "failed to set ip %s", cidr)
 		}
 	}
@@ -89,31 +355,38 @@ func (m *Manager) SetIPAddress(device string, cidrs []string) error {
 }
 
 func (m *Manager) GetMTU(device string) (int, error) {
-	wgInterface, err := tenus.NewLinkFrom(device)
-	if err != nil {
-		return 0, errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	if m.IsExternalDevice(device) {
+		return 0, ErrExternalDevice
 	}
-
-	// Get golang net.interface
-	iface := wgInterface.NetInterface()
-	if iface == nil { // Not sure if this check is really necessary
-		return 0, errors.Wrap(err, "could not retrieve WireGuard net.interface")
+	if host := m.remoteHost(device); host != nil {
+		return host.getMTU(device)
 	}
 
-	return iface.MTU, nil
+	mtu := 0
+	err := m.inDeviceNamespace(device, func() error {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+		}
+		mtu = iface.MTU
+		return nil
+	})
+
+	return mtu, err
 }
 
 func (m *Manager) SetMTU(device string, mtu int) error {
-	wgInterface, err := tenus.NewLinkFrom(device)
-	if err != nil {
-		return errors.Wrapf(err, "could not retrieve WireGuard interface %s", device)
+	if m.IsExternalDevice(device) {
+		return nil
 	}
-
 	if mtu == 0 {
 		mtu = DefaultMTU
 	}
+	if host := m.remoteHost(device); host != nil {
+		return host.setMTU(device, mtu)
+	}
 
-	if err := wgInterface.SetLinkMTU(mtu); err != nil {
+	if err := m.inDeviceNamespace(device, func() error { return m.links.SetMTU(device, mtu) }); err != nil {
 		return errors.Wrapf(err, "could not set MTU on interface %s", device)
 	}
 
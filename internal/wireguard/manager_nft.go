@@ -0,0 +1,80 @@
+package wireguard
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// nftTablePrefix is the prefix of the nftables tables that are managed by wg-portal, one table per interface.
+const nftTablePrefix = "wgportal_"
+
+// SetMasqueradeRules creates the nftables forward and masquerade rules that route the traffic of the WireGuard
+// interface through the upstream interface. The rules live in their own table that is replaced atomically, so calling
+// this method multiple times does not stack duplicate rules.
+func (m *Manager) SetMasqueradeRules(device, upstream string) error {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+	if !IsValidInterfaceName(device) || !IsValidInterfaceName(upstream) {
+		return errors.Errorf("invalid interface name %s or %s", device, upstream)
+	}
+
+	table := nftTablePrefix + device
+	ruleset := fmt.Sprintf(`table inet %[1]s
+delete table inet %[1]s
+table inet %[1]s {
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "%[2]s" oifname "%[3]s" accept
+		iifname "%[3]s" oifname "%[2]s" ct state established,related accept
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		iifname "%[2]s" oifname "%[3]s" masquerade
+	}
+}
+`, table, device, upstream)
+
+	if err := m.inDeviceNamespace(device, func() error { return runNft(ruleset) }); err != nil {
+		return errors.WithMessagef(err, "could not set masquerade rules for interface %s", device)
+	}
+
+	return nil
+}
+
+// RemoveMasqueradeRules removes the nftables rules of the WireGuard interface, it does nothing if there are no rules.
+func (m *Manager) RemoveMasqueradeRules(device string) error {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+	if !IsValidInterfaceName(device) {
+		return errors.Errorf("invalid interface name %s", device)
+	}
+
+	table := nftTablePrefix + device
+	ruleset := fmt.Sprintf("table inet %[1]s\ndelete table inet %[1]s\n", table)
+
+	if err := m.inDeviceNamespace(device, func() error { return runNft(ruleset) }); err != nil {
+		return errors.WithMessagef(err, "could not remove masquerade rules of interface %s", device)
+	}
+
+	return nil
+}
+
+// runNft applies the ruleset in a single nftables transaction. nft runs in the network namespace of the calling
+// thread, see inNamespace.
+func runNft(ruleset string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "nft failed: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
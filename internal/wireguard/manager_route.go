@@ -0,0 +1,54 @@
+package wireguard
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RouteProtocol marks the routes that are installed by the portal (see /etc/iproute2/rt_protos), so that routes
+	// added by the administrator or other daemons are never modified.
+	RouteProtocol = 87
+
+	// ids of the reserved routing tables of Linux
+	RouteTableMain    = 254
+	routeTableDefault = 253
+	routeTableLocal   = 255
+)
+
+// Route is a route of a network through a WireGuard interface.
+type Route struct {
+	Destination net.IPNet
+	Table       uint32
+}
+
+func (r Route) String() string {
+	if r.Table == RouteTableMain {
+		return r.Destination.String()
+	}
+	return r.Destination.String() + " table " + strconv.FormatUint(uint64(r.Table), 10)
+}
+
+// ParseRoutingTable returns the routing table of the wg-quick Table setting of an interface. Empty values and "auto"
+// select the main table, "off" disables the routes (the returned boolean is false). The ids of the reserved default,
+// main and local tables are rejected.
+func ParseRoutingTable(table string) (uint32, bool, error) {
+	switch strings.ToLower(strings.TrimSpace(table)) {
+	case "", "auto", "main":
+		return RouteTableMain, true, nil
+	case "off":
+		return 0, false, nil
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(table), 10, 32)
+	if err != nil || id == 0 {
+		return 0, false, errors.Errorf("invalid routing table %s, use off, auto, main or a table id", table)
+	}
+	if id >= routeTableDefault && id <= routeTableLocal {
+		return 0, false, errors.Errorf("routing table %d is reserved, use auto or main for the main table", id)
+	}
+	return uint32(id), true, nil
+}
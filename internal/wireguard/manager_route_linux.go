@@ -0,0 +1,141 @@
+//go:build linux
+// +build linux
+
+package wireguard
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/jsimonetti/rtnetlink"
+	"github.com/pkg/errors"
+)
+
+// RouteList returns the routes through the interface that were installed by the portal, in all routing tables.
+func (m *Manager) RouteList(device string) ([]Route, error) {
+	if m.IsExternalDevice(device) {
+		return []Route{}, nil
+	}
+
+	var iface *net.Interface
+	var msgs []rtnetlink.RouteMessage
+	err := m.inDeviceNamespace(device, func() error {
+		var err error
+		if iface, err = net.InterfaceByName(device); err != nil {
+			return errors.Wrapf(err, "could not retrieve interface %s", device)
+		}
+		conn, err := rtnetlink.Dial(nil)
+		if err != nil {
+			return errors.Wrap(err, "could not open netlink connection")
+		}
+		defer conn.Close()
+		if msgs, err = conn.Route.List(); err != nil {
+			return errors.Wrap(err, "could not list routes")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	routes := make([]Route, 0)
+	for _, msg := range msgs {
+		if msg.Protocol != RouteProtocol || msg.Attributes.OutIface != uint32(iface.Index) {
+			continue
+		}
+
+		bits := 8 * net.IPv4len
+		dst := net.IPv4zero.To4()
+		if msg.Family == syscall.AF_INET6 {
+			bits = 8 * net.IPv6len
+			dst = net.IPv6zero
+		}
+		if msg.Attributes.Dst != nil {
+			dst = msg.Attributes.Dst
+		}
+		table := msg.Attributes.Table
+		if table == 0 {
+			table = uint32(msg.Table)
+		}
+		routes = append(routes, Route{
+			Destination: net.IPNet{IP: dst, Mask: net.CIDRMask(int(msg.DstLength), bits)},
+			Table:       table,
+		})
+	}
+
+	return routes, nil
+}
+
+// RouteAdd adds the route through the interface, it fails if the route already exists.
+func (m *Manager) RouteAdd(device string, route Route) error {
+	return m.executeRoute(device, route, "add", func(conn *rtnetlink.Conn, msg *rtnetlink.RouteMessage) error {
+		return conn.Route.Add(msg)
+	})
+}
+
+// RouteReplace adds the route through the interface or replaces an existing route of the same network.
+func (m *Manager) RouteReplace(device string, route Route) error {
+	return m.executeRoute(device, route, "replace", func(conn *rtnetlink.Conn, msg *rtnetlink.RouteMessage) error {
+		return conn.Route.Replace(msg)
+	})
+}
+
+// RouteDel removes the route through the interface.
+func (m *Manager) RouteDel(device string, route Route) error {
+	return m.executeRoute(device, route, "delete", func(conn *rtnetlink.Conn, msg *rtnetlink.RouteMessage) error {
+		return conn.Route.Delete(msg)
+	})
+}
+
+func (m *Manager) executeRoute(device string, route Route, action string,
+	execute func(*rtnetlink.Conn, *rtnetlink.RouteMessage) error) error {
+	if m.IsExternalDevice(device) {
+		return nil
+	}
+
+	return m.inDeviceNamespace(device, func() error {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			return errors.Wrapf(err, "could not retrieve interface %s", device)
+		}
+		conn, err := rtnetlink.Dial(nil)
+		if err != nil {
+			return errors.Wrap(err, "could not open netlink connection")
+		}
+		defer conn.Close()
+
+		if err := execute(conn, routeMessage(iface.Index, route)); err != nil {
+			return errors.Wrapf(err, "could not %s route %s on interface %s", action, route, device)
+		}
+		return nil
+	})
+}
+
+func routeMessage(ifIndex int, route Route) *rtnetlink.RouteMessage {
+	family := uint8(syscall.AF_INET)
+	dst := route.Destination.IP.To4()
+	if dst == nil {
+		family = syscall.AF_INET6
+		dst = route.Destination.IP.To16()
+	}
+	ones, _ := route.Destination.Mask.Size()
+
+	table := uint8(syscall.RT_TABLE_UNSPEC) // ids above 255 are only passed in the attribute
+	if route.Table < 256 {
+		table = uint8(route.Table)
+	}
+
+	return &rtnetlink.RouteMessage{
+		Family:    family,
+		DstLength: uint8(ones),
+		Table:     table,
+		Protocol:  RouteProtocol,
+		Scope:     syscall.RT_SCOPE_LINK,
+		Type:      syscall.RTN_UNICAST,
+		Attributes: rtnetlink.RouteAttributes{
+			Dst:      dst,
+			OutIface: uint32(ifIndex),
+			Table:    route.Table,
+		},
+	}
+}
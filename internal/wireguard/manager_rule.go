@@ -0,0 +1,24 @@
+package wireguard
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// Rule is a policy routing rule that looks up the given routing table for all packets of the family that do not
+// carry the firewall mark (ip rule add not fwmark <mark> table <table>). The encrypted packets of an interface carry
+// its firewall mark, so they never loop back into the table of the interface.
+type Rule struct {
+	Family int // syscall.AF_INET or syscall.AF_INET6
+	Table  uint32
+	Mark   uint32
+}
+
+func (r Rule) String() string {
+	family := "ipv4"
+	if r.Family == syscall.AF_INET6 {
+		family = "ipv6"
+	}
+	return family + " not fwmark " + strconv.FormatUint(uint64(r.Mark), 10) + " table " +
+		strconv.FormatUint(uint64(r.Table), 10)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+package wireguard
+
+import (
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/pkg/errors"
+)
+
+// attributes and flags of the fib rule messages, see linux/fib_rules.h
+const (
+	fibRuleHeaderLen = 12
+	fibRuleInvert    = 0x2
+	fibRuleToTable   = 1 // FR_ACT_TO_TBL
+
+	fraFwMark   = 10
+	fraTable    = 15
+	fraFwMask   = 16
+	fraProtocol = 21
+)
+
+// RuleList returns the policy routing rules that were installed by the portal.
+func (m *Manager) RuleList() ([]Rule, error) {
+	conn, err := netlink.Dial(syscall.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open netlink connection")
+	}
+	defer conn.Close()
+
+	msgs, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: syscall.RTM_GETRULE, Flags: netlink.Request | netlink.Dump},
+		Data:   make([]byte, fibRuleHeaderLen), // AF_UNSPEC, rules of all families
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list rules")
+	}
+
+	rules := make([]Rule, 0)
+	for _, msg := range msgs {
+		if len(msg.Data) < fibRuleHeaderLen {
+			continue
+		}
+		flags := nlenc.Uint32(msg.Data[8:12])
+		if flags&fibRuleInvert == 0 || msg.Data[7] != fibRuleToTable {
+			continue
+		}
+
+		rule := Rule{Family: int(msg.Data[0]), Table: uint32(msg.Data[4])}
+		var protocol uint8
+		ad, err := netlink.NewAttributeDecoder(msg.Data[fibRuleHeaderLen:])
+		if err != nil {
+			continue
+		}
+		for ad.Next() {
+			switch ad.Type() {
+			case fraTable:
+				rule.Table = ad.Uint32()
+			case fraFwMark:
+				rule.Mark = ad.Uint32()
+			case fraProtocol:
+				protocol = ad.Uint8()
+			}
+		}
+		if ad.Err() != nil || protocol != RouteProtocol {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// RuleAdd installs the policy routing rule. Duplicate rules are not always rejected, callers have to check the
+// installed rules first.
+func (m *Manager) RuleAdd(rule Rule) error {
+	return m.executeRule(rule, "add", syscall.RTM_NEWRULE, netlink.Create|netlink.Excl)
+}
+
+// RuleDel removes the policy routing rule.
+func (m *Manager) RuleDel(rule Rule) error {
+	return m.executeRule(rule, "delete", syscall.RTM_DELRULE, 0)
+}
+
+func (m *Manager) executeRule(rule Rule, action string, msgType netlink.HeaderType, flags netlink.HeaderFlags) error {
+	data, err := ruleMessage(rule)
+	if err != nil {
+		return errors.Wrapf(err, "could not encode rule %s", rule)
+	}
+
+	conn, err := netlink.Dial(syscall.NETLINK_ROUTE, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not open netlink connection")
+	}
+	defer conn.Close()
+
+	_, err = conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: msgType, Flags: netlink.Request | netlink.Acknowledge | flags},
+		Data:   data,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "could not %s rule %s", action, rule)
+	}
+
+	return nil
+}
+
+func ruleMessage(rule Rule) ([]byte, error) {
+	header := make([]byte, fibRuleHeaderLen)
+	header[0] = uint8(rule.Family)
+	if rule.Table < 256 {
+		header[4] = uint8(rule.Table) // larger ids are only passed in the attribute
+	}
+	header[7] = fibRuleToTable
+	nlenc.PutUint32(header[8:12], fibRuleInvert)
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint32(fraTable, rule.Table)
+	ae.Uint32(fraFwMark, rule.Mark)
+	ae.Uint32(fraFwMask, 0xffffffff)
+	ae.Uint8(fraProtocol, RouteProtocol) // the kernel chooses the priority
+	attributes, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, attributes...), nil
+}
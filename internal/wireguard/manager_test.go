@@ -0,0 +1,251 @@
+package wireguard
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// fakeClient keeps the peers of WireGuard devices in memory. The next failures calls of ConfigureDevice apply only
+// the first applyBeforeFailure peers and fail then, like a kernel that rejects a peer in the middle of a batch.
+type fakeClient struct {
+	mux                sync.Mutex
+	devices            map[string]*wgtypes.Device
+	failures           int
+	applyBeforeFailure int
+}
+
+func newFakeClient(devices ...string) *fakeClient {
+	c := &fakeClient{devices: make(map[string]*wgtypes.Device)}
+	for _, name := range devices {
+		c.devices[name] = &wgtypes.Device{Name: name}
+	}
+	return c
+}
+
+func (c *fakeClient) Device(name string) (*wgtypes.Device, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	dev, ok := c.devices[name]
+	if !ok {
+		return nil, errors.Errorf("device %s does not exist", name)
+	}
+	copied := *dev
+	copied.Peers = append([]wgtypes.Peer{}, dev.Peers...)
+	return &copied, nil
+}
+
+func (c *fakeClient) Devices() ([]*wgtypes.Device, error) {
+	c.mux.Lock()
+	names := make([]string, 0, len(c.devices))
+	for name := range c.devices {
+		names = append(names, name)
+	}
+	c.mux.Unlock()
+
+	devices := make([]*wgtypes.Device, 0, len(names))
+	for _, name := range names {
+		dev, _ := c.Device(name)
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+func (c *fakeClient) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	dev, ok := c.devices[name]
+	if !ok {
+		return errors.Errorf("device %s does not exist", name)
+	}
+	peers := cfg.Peers
+	failing := c.failures > 0
+	if failing {
+		c.failures--
+		if c.applyBeforeFailure < len(peers) {
+			peers = peers[:c.applyBeforeFailure]
+		}
+	}
+	for _, peerCfg := range peers {
+		dev.Peers = applyFakePeerConfig(dev.Peers, peerCfg)
+	}
+	if failing {
+		return errors.New("configuration rejected")
+	}
+	return nil
+}
+
+func applyFakePeerConfig(peers []wgtypes.Peer, cfg wgtypes.PeerConfig) []wgtypes.Peer {
+	for i := range peers {
+		if peers[i].PublicKey != cfg.PublicKey {
+			continue
+		}
+		if cfg.Remove {
+			return append(peers[:i], peers[i+1:]...)
+		}
+		if cfg.ReplaceAllowedIPs {
+			peers[i].AllowedIPs = nil
+		}
+		peers[i].AllowedIPs = append(peers[i].AllowedIPs, cfg.AllowedIPs...)
+		if cfg.PresharedKey != nil {
+			peers[i].PresharedKey = *cfg.PresharedKey
+		}
+		return peers
+	}
+	if cfg.Remove || cfg.UpdateOnly {
+		return peers
+	}
+	peer := wgtypes.Peer{PublicKey: cfg.PublicKey, AllowedIPs: cfg.AllowedIPs}
+	if cfg.PresharedKey != nil {
+		peer.PresharedKey = *cfg.PresharedKey
+	}
+	return append(peers, peer)
+}
+
+func (c *fakeClient) peerKeys(device string) map[string]bool {
+	dev, _ := c.Device(device)
+	keys := make(map[string]bool, len(dev.Peers))
+	for _, peer := range dev.Peers {
+		keys[peer.PublicKey.String()] = true
+	}
+	return keys
+}
+
+func newTestManager(client *fakeClient) *Manager {
+	m := &Manager{Cfg: &Config{DeviceNames: []string{"wg0"}}, wg: client,
+		links: unsupportedInterfaceManager{reason: "in tests"}, namespaces: make(map[string]string)}
+	m.cache = newDeviceCache(0, m.fetchDevice)
+
+	return m
+}
+
+func newTestDatabase(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := common.GetDatabaseForConfig(&common.DatabaseConfig{Typ: common.SupportedDatabaseSQLite,
+		Database: filepath.Join(t.TempDir(), "wg_portal.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	if _, err := common.MigrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newTestKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.PublicKey()
+}
+
+func TestConfigurePeersOrRestoreRemovesPartiallyAddedPeers(t *testing.T) {
+	client := newFakeClient("wg0")
+	m := newTestManager(client)
+	existing := newTestKey(t)
+	if err := m.ConfigurePeers("wg0", []wgtypes.PeerConfig{{PublicKey: existing}}); err != nil {
+		t.Fatal(err)
+	}
+
+	added := []wgtypes.PeerConfig{{PublicKey: newTestKey(t)}, {PublicKey: newTestKey(t)},
+		{PublicKey: existing, Remove: true}}
+	client.failures, client.applyBeforeFailure = 1, 1
+	if err := m.ConfigurePeersOrRestore("wg0", added); err == nil {
+		t.Fatal("expected the configuration to fail")
+	}
+
+	keys := client.peerKeys("wg0")
+	if len(keys) != 1 || !keys[existing.String()] {
+		t.Errorf("the interface was not restored, peers: %v", keys)
+	}
+}
+
+func TestApplyPeerChangesRollsBackWhenConfigureFails(t *testing.T) {
+	client := newFakeClient("wg0")
+	m := newTestManager(client)
+	db := newTestDatabase(t)
+	pm, err := NewOfflinePeerManager(db, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enabled := Peer{PublicKey: newTestKey(t).String(), DeviceName: "wg0", Identifier: "enabled", Email: "a@example.org"}
+	if err := pm.ApplyPeerChanges("wg0", []PeerChange{{Peer: enabled,
+		Config: wgtypes.PeerConfig{PublicKey: mustParseKey(t, enabled.PublicKey)}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// disable the existing peer and add a new one, the interface rejects the change after the first peer
+	now := time.Now()
+	disabled := enabled
+	disabled.DeactivatedAt = &now
+	added := Peer{PublicKey: newTestKey(t).String(), DeviceName: "wg0", Identifier: "added", Email: "b@example.org"}
+	changes := []PeerChange{
+		{Peer: disabled, Config: wgtypes.PeerConfig{PublicKey: mustParseKey(t, disabled.PublicKey), Remove: true}},
+		{Peer: added, Config: wgtypes.PeerConfig{PublicKey: mustParseKey(t, added.PublicKey)}},
+	}
+	client.failures, client.applyBeforeFailure = 1, 1
+	if err := pm.ApplyPeerChanges("wg0", changes); err == nil {
+		t.Fatal("expected the change to fail")
+	}
+
+	var stored Peer
+	if err := db.Where("public_key = ?", enabled.PublicKey).First(&stored).Error; err != nil {
+		t.Fatalf("existing peer missing after the rollback: %v", err)
+	}
+	if stored.DeactivatedAt != nil {
+		t.Error("the disabled state of the existing peer was stored")
+	}
+	var count int64
+	db.Model(&Peer{}).Where("public_key = ?", added.PublicKey).Count(&count)
+	if count != 0 {
+		t.Error("the added peer was stored")
+	}
+	keys := client.peerKeys("wg0")
+	if len(keys) != 1 || !keys[enabled.PublicKey] {
+		t.Errorf("the interface was not restored, peers: %v", keys)
+	}
+
+	// the same change is stored once the interface accepts it
+	if err := pm.ApplyPeerChanges("wg0", changes); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Where("public_key = ?", enabled.PublicKey).First(&stored).Error; err != nil || stored.DeactivatedAt == nil {
+		t.Errorf("the disabled state was not stored: %v", err)
+	}
+	db.Model(&Peer{}).Where("public_key = ?", added.PublicKey).Count(&count)
+	if count != 1 {
+		t.Error("the added peer was not stored")
+	}
+	keys = client.peerKeys("wg0")
+	if len(keys) != 1 || !keys[added.PublicKey] {
+		t.Errorf("unexpected peers of the interface: %v", keys)
+	}
+}
+
+func mustParseKey(t *testing.T, key string) wgtypes.Key {
+	t.Helper()
+
+	parsed, err := wgtypes.ParseKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
@@ -0,0 +1,216 @@
+package wireguard
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// NamespaceNotFoundError is returned if the network namespace of an interface does not exist, the interface cannot be
+// found without it.
+type NamespaceNotFoundError struct {
+	Namespace string
+}
+
+func (e NamespaceNotFoundError) Error() string {
+	return fmt.Sprintf("network namespace %s does not exist, create it with \"ip netns add %s\"", e.Namespace,
+		e.Namespace)
+}
+
+// IsNamespaceNotFound reports whether the error, or the error it wraps, is a NamespaceNotFoundError.
+func IsNamespaceNotFound(err error) bool {
+	var notFound NamespaceNotFoundError
+	return errors.As(err, &notFound)
+}
+
+// ValidateNamespaceName checks the name of a network namespace of ip netns, an empty name selects the network
+// namespace of the portal.
+func ValidateNamespaceName(name string) error {
+	switch {
+	case name == "":
+	case len(name) > 255 || name == "." || name == ".." || !interfaceNameRegex.MatchString(name):
+		return InterfaceParameterError{Parameter: "namespace", Value: name, Reason: interfaceNameHint}
+	}
+	return nil
+}
+
+// SetDeviceNamespace sets the network namespace of a local interface, an empty namespace is the network namespace of
+// the portal. If the link already exists in the previous namespace, it is moved into the new one. Moving a link
+// removes its addresses and routes and brings it down, they have to be applied again. The WireGuard socket of a
+// kernel interface stays in the namespace that created the link, so the encrypted traffic still leaves through the
+// namespace of the portal.
+func (m *Manager) SetDeviceNamespace(device, namespace string) error {
+	if err := ValidateNamespaceName(namespace); err != nil {
+		return err
+	}
+	previous := m.DeviceNamespace(device)
+	if namespace == previous {
+		return nil
+	}
+	if namespace != "" && (m.IsExternalDevice(device) || m.IsRemoteDevice(device)) {
+		return errors.Errorf("interface %s is not a local interface, it cannot be moved into a network namespace",
+			device)
+	}
+
+	exists := inNamespace(previous, func() error { return linkExists(device) }) == nil
+	if exists {
+		if dev, err := m.fetchDevice(device); err == nil && dev.Type == wgtypes.Userspace {
+			return errors.Errorf("interface %s is a wireguard-go interface, only kernel interfaces can be moved into a "+
+				"network namespace", device)
+		}
+		if err := m.moveLink(device, previous, namespace); err != nil {
+			return err
+		}
+		logrus.Infof("moved interface %s into network namespace %q", device, namespace)
+	}
+
+	m.nsMux.Lock()
+	if namespace == "" {
+		delete(m.namespaces, device)
+	} else {
+		m.namespaces[device] = namespace
+	}
+	m.nsMux.Unlock()
+	m.releaseNamespaceClients()
+	m.cache.Invalidate(device)
+
+	return nil
+}
+
+// DeviceNamespace returns the network namespace of the interface, an empty string for the namespace of the portal.
+func (m *Manager) DeviceNamespace(device string) string {
+	m.nsMux.Lock()
+	defer m.nsMux.Unlock()
+
+	return m.namespaces[device]
+}
+
+// inDeviceNamespace runs fn in the network namespace of the interface, see inNamespace.
+func (m *Manager) inDeviceNamespace(device string, fn func() error) error {
+	return inNamespace(m.DeviceNamespace(device), fn)
+}
+
+// checkDeviceNamespace returns a NamespaceNotFoundError if the network namespace of the interface does not exist.
+func (m *Manager) checkDeviceNamespace(device string) error {
+	namespace := m.DeviceNamespace(device)
+	if namespace == "" {
+		return nil
+	}
+	f, err := openNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// forgetDeviceNamespace removes the network namespace of a deleted interface and closes the WireGuard client of the
+// namespace if no other interface uses it.
+func (m *Manager) forgetDeviceNamespace(device string) {
+	m.nsMux.Lock()
+	delete(m.namespaces, device)
+	m.nsMux.Unlock()
+	m.releaseNamespaceClients()
+}
+
+// moveLink moves the link of the interface from one network namespace into another.
+func (m *Manager) moveLink(device, from, to string) error {
+	target, err := openNamespace(to)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	return inNamespace(from, func() error {
+		if err := m.links.SetLinkNamespace(device, int(target.Fd())); err != nil {
+			return errors.Wrapf(err, "could not move interface %s into network namespace %q", device, to)
+		}
+		return nil
+	})
+}
+
+// namespacedClient is the part of the wgctrl client that is used for the interfaces of a network namespace.
+type namespacedClient interface {
+	wgClient
+	Devices() ([]*wgtypes.Device, error)
+}
+
+// namespaceClient returns the WireGuard client of the network namespace, its netlink socket is opened inside the
+// namespace. The clients are kept until no interface uses their namespace anymore.
+func (m *Manager) namespaceClient(namespace string) namespacedClient {
+	m.nsMux.Lock()
+	defer m.nsMux.Unlock()
+
+	if client, ok := m.nsClients[namespace]; ok {
+		return client
+	}
+	var client *wgctrl.Client
+	err := inNamespace(namespace, func() error {
+		var err error
+		client, err = wgctrl.New()
+		return err
+	})
+	if err != nil {
+		return failingClient{err: errors.WithMessagef(err, "could not create WireGuard client in network namespace %s",
+			namespace)}
+	}
+	m.nsClients[namespace] = client
+	return client
+}
+
+// namespaceDevices returns the WireGuard devices of all network namespaces of the interfaces.
+func (m *Manager) namespaceDevices() ([]*wgtypes.Device, error) {
+	m.nsMux.Lock()
+	namespaces := make(map[string]bool)
+	for _, namespace := range m.namespaces {
+		namespaces[namespace] = true
+	}
+	m.nsMux.Unlock()
+
+	devices := make([]*wgtypes.Device, 0)
+	for namespace := range namespaces {
+		nsDevices, err := m.namespaceClient(namespace).Devices()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not get WireGuard devices of network namespace %s", namespace)
+		}
+		devices = append(devices, nsDevices...)
+	}
+	return devices, nil
+}
+
+// releaseNamespaceClients closes the WireGuard clients of the network namespaces that no interface uses anymore.
+func (m *Manager) releaseNamespaceClients() {
+	m.nsMux.Lock()
+	defer m.nsMux.Unlock()
+
+	used := make(map[string]bool)
+	for _, namespace := range m.namespaces {
+		used[namespace] = true
+	}
+	for namespace, client := range m.nsClients {
+		if !used[namespace] {
+			_ = client.Close()
+			delete(m.nsClients, namespace)
+		}
+	}
+}
+
+// failingClient is returned if the WireGuard client of a network namespace cannot be created, e.g. because the
+// namespace does not exist.
+type failingClient struct {
+	err error
+}
+
+func (c failingClient) Device(string) (*wgtypes.Device, error) {
+	return nil, c.err
+}
+
+func (c failingClient) ConfigureDevice(string, wgtypes.Config) error {
+	return c.err
+}
+
+func (c failingClient) Devices() ([]*wgtypes.Device, error) {
+	return nil, c.err
+}
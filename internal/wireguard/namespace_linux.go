@@ -0,0 +1,78 @@
+//go:build linux
+// +build linux
+
+package wireguard
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// namespaceDir contains the named network namespaces of ip netns.
+const namespaceDir = "/var/run/netns"
+
+// openNamespace opens the named network namespace, an empty name opens the network namespace of the portal.
+func openNamespace(namespace string) (*os.File, error) {
+	path := "/proc/self/ns/net"
+	if namespace != "" {
+		path = filepath.Join(namespaceDir, namespace)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && namespace != "" {
+		return nil, NamespaceNotFoundError{Namespace: namespace}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open network namespace %q", namespace)
+	}
+	return f, nil
+}
+
+// inNamespace runs fn on an OS thread that has entered the network namespace, an empty namespace runs fn directly.
+// Netlink sockets that fn opens stay in the namespace after fn returned, goroutines started by fn do not run in the
+// namespace. If the thread cannot return to the namespace of the portal, it is terminated.
+func inNamespace(namespace string, fn func() error) error {
+	if namespace == "" {
+		return fn()
+	}
+	target, err := openNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- errors.Wrap(err, "could not open the network namespace of the portal")
+			return
+		}
+		defer origin.Close()
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			result <- errors.Wrapf(err, "could not enter network namespace %s", namespace)
+			return
+		}
+
+		err = fn()
+		if unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread() // otherwise the thread exits with the goroutine
+		}
+		result <- err
+	}()
+	return <-result
+}
+
+// linkExists returns an error if the interface does not exist in the current network namespace.
+func linkExists(device string) error {
+	_, err := net.InterfaceByName(device)
+	return err
+}
@@ -0,0 +1,30 @@
+package wireguard
+
+import (
+	"github.com/pkg/errors"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+var errOffline = errors.New("the WireGuard interfaces are not accessed in offline mode")
+
+// NewOfflineManager returns a manager that never accesses the WireGuard interfaces, all device reads fail. The
+// maintenance commands of the binary use it, they only work on the database and must not change the interfaces of a
+// running portal.
+func NewOfflineManager(cfg *Config) *Manager {
+	m := &Manager{Cfg: cfg, links: unsupportedInterfaceManager{reason: "in offline mode"},
+		namespaces: make(map[string]string)}
+	m.cache = newDeviceCache(cfg.DeviceCacheTTL, func(string) (*wgtypes.Device, error) {
+		return nil, errOffline
+	})
+
+	return m
+}
+
+// NewOfflinePeerManager returns a peer manager for an offline manager. Unlike NewPeerManager, it neither imports the
+// peers of the interfaces nor updates the stored peers, the runtime data of devices and peers stays empty.
+func NewOfflinePeerManager(db *gorm.DB, wg *Manager) (*PeerManager, error) {
+	pm := &PeerManager{db: db, wg: wg}
+
+	return pm, nil
+}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -51,10 +52,67 @@ var ipList validator.Func = func(fl validator.FieldLevel) bool {
 	return true
 }
 
+var tagRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,32}$`)
+
+// tagList accepts tags without spaces with at most 32 characters.
+var tagList validator.Func = func(fl validator.FieldLevel) bool {
+	for _, tag := range common.ParseStringList(fl.Field().String()) {
+		if !tagRegex.MatchString(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+var searchDomainRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+// dnsList accepts DNS server addresses and search domains, like the DNS setting of wg-quick.
+var dnsList validator.Func = func(fl validator.FieldLevel) bool {
+	dnsList := common.ParseStringList(fl.Field().String())
+	for i := range dnsList {
+		if net.ParseIP(dnsList[i]) == nil && !searchDomainRegex.MatchString(dnsList[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidEndpoint accepts host:port endpoints with a host name, an IPv4 address or a bracketed IPv6 address.
+func isValidEndpoint(endpoint string) bool {
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil || host == "" {
+		return false
+	}
+	if port, err := strconv.Atoi(portStr); err != nil || port <= 0 || port > 65535 {
+		return false
+	}
+	if strings.HasPrefix(endpoint, "[") { // only IPv6 literals are bracketed, SplitHostPort removes the brackets
+		return strings.Contains(host, ":") && net.ParseIP(host) != nil
+	}
+	return net.ParseIP(host) != nil || searchDomainRegex.MatchString(host)
+}
+
+var endpoint validator.Func = func(fl validator.FieldLevel) bool {
+	return isValidEndpoint(fl.Field().String())
+}
+
+var endpointList validator.Func = func(fl validator.FieldLevel) bool {
+	for _, e := range common.ParseStringList(fl.Field().String()) {
+		if !isValidEndpoint(e) {
+			return false
+		}
+	}
+	return true
+}
+
 func init() {
 	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
 		_ = v.RegisterValidation("cidrlist", cidrList)
 		_ = v.RegisterValidation("iplist", ipList)
+		_ = v.RegisterValidation("dnslist", dnsList)
+		_ = v.RegisterValidation("taglist", tagList)
+		_ = v.RegisterValidation("endpoint", endpoint)
+		_ = v.RegisterValidation("endpointlist", endpointList)
 	}
 }
 
@@ -62,6 +120,26 @@ func init() {
 //  PEER ----------------------------------------------------------------------------------------
 //
 
+// AutodetectedPeerEmail is the placeholder address used for peers that were imported from the physical interface.
+const AutodetectedPeerEmail = "autodetected@example.com"
+
+const (
+	// DefaultRoamingKeepalive is the keepalive interval (in seconds) of new peers that route all traffic through the
+	// tunnel. Such peers are usually mobile clients behind NAT.
+	DefaultRoamingKeepalive = 25
+	// MaxPersistentKeepalive is the largest keepalive interval (in seconds) that can be configured.
+	MaxPersistentKeepalive = 65535
+)
+
+type DeactivationReason string
+
+const (
+	DeactivationReasonManual     DeactivationReason = ""
+	DeactivationReasonInactivity DeactivationReason = "inactivity" // disabled by the inactivity check
+	DeactivationReasonUser       DeactivationReason = "user"       // disabled by the owner in the user portal
+	DeactivationReasonAccount    DeactivationReason = "account"    // disabled with the account of the owner
+)
+
 type Peer struct {
 	Peer   *wgtypes.Peer `gorm:"-" json:"-"` // WireGuard peer
 	Config string        `gorm:"-" json:"-"`
@@ -72,32 +150,89 @@ type Peer struct {
 	Identifier           string     `form:"identifier" binding:"required,max=64"` // Identifier AND Email make a WireGuard peer unique
 	Email                string     `gorm:"index" form:"mail" binding:"required,email"`
 	IgnoreGlobalSettings bool       `form:"ignoreglobalsettings"`
+	Description          string     `form:"description" binding:"max=512"`
+	TagsStr              string     `form:"tags" binding:"taglist"`   // comma separated list of lowercase tags
+	Notes                string     `form:"notes" binding:"max=4096"` // internal notes of the administrators, not part of any client config
 
-	IsOnline          bool   `gorm:"-" json:"-"`
-	IsNew             bool   `gorm:"-" json:"-"`
-	LastHandshake     string `gorm:"-" json:"-"`
-	LastHandshakeTime string `gorm:"-" json:"-"`
+	IsOnline          bool            `gorm:"-" json:"-"`
+	ConnectionState   ConnectionState `gorm:"-" json:",omitempty"` // online, idle or offline, only set with the live data of the interface
+	IsNew             bool            `gorm:"-" json:"-"`
+	LastHandshake     string          `gorm:"-" json:"-"`
+	LastHandshakeTime string          `gorm:"-" json:"-"`
+
+	Statistic *PeerStatistic `gorm:"-" json:"-"` // latest sample of the statistics collector
 
 	// Core WireGuard Settings
 	PublicKey           string `gorm:"primaryKey" form:"pubkey" binding:"required,base64"` // the public key of the peer itself
 	PresharedKey        string `form:"presharedkey" binding:"omitempty,base64"`
 	AllowedIPsStr       string `form:"allowedip" binding:"cidrlist"`    // a comma separated list of IPs that are used in the client config file
+	AllowedIPsPresetID  uint   `gorm:"index" form:"allowedippreset"`    // if set, AllowedIPsStr is taken from this AllowedIPsPreset
 	AllowedIPsSrvStr    string `form:"allowedipSrv" binding:"cidrlist"` // a comma separated list of IPs that are used in the server config file
-	Endpoint            string `form:"endpoint" binding:"omitempty,hostname_port"`
-	PersistentKeepalive int    `form:"keepalive" binding:"gte=0"`
+	Endpoint            string `form:"endpoint" binding:"omitempty,endpoint"`
+	PersistentKeepalive int    `form:"keepalive" binding:"gte=0,lte=65535"` // in seconds, 0 = off, at most MaxPersistentKeepalive
+	SiteEndpoint        string `form:"-" json:",omitempty"`                 // the endpoint of a site-to-site peer, configured on the interface itself
 
 	// Misc. WireGuard Settings
 	PrivateKey string `form:"privkey" binding:"omitempty,base64"`
 	IPsStr     string `form:"ip" binding:"cidrlist,required_if=DeviceType server"` // a comma separated list of IPs of the client
-	DNSStr     string `form:"dns" binding:"iplist"`                                // comma separated list of the DNS servers for the client
+	DNSStr     string `form:"dns" binding:"dnslist"`                               // comma separated list of the DNS servers and search domains for the client
 	// Global Device Settings (can be ignored, only make sense if device is in server mode)
-	Mtu int `form:"mtu" binding:"gte=0,lte=1500"`
+	Mtu int `form:"mtu" binding:"omitempty,gte=1280,lte=1500"`
+
+	// Per-peer overrides, if not set, the DNS, MTU, keepalive and endpoint defaults of the interface are used
+	OverrideDNS       bool `form:"overridedns"`
+	OverrideMtu       bool `form:"overridemtu"`
+	OverrideKeepalive bool `form:"overridekeepalive"`
+	OverrideEndpoint  bool `form:"overrideendpoint"` // use Endpoint instead of the endpoint of the interface
+
+	DeactivatedAt      *time.Time         `json:",omitempty"`
+	DeactivationReason DeactivationReason `json:",omitempty"`
+	ReactivatedAt      *time.Time         `json:",omitempty"` // the inactivity check does not disable the peer again before the threshold is reached
 
-	DeactivatedAt *time.Time `json:",omitempty"`
-	CreatedBy     string
-	UpdatedBy     string
-	CreatedAt     time.Time
-	UpdatedAt     time.Time
+	// Set by the last key rotation
+	PreviousPublicKey string     `form:"-" json:",omitempty"`
+	KeysRotatedAt     *time.Time `form:"-" json:",omitempty"`
+
+	// Guest peers are deleted once they expire, permanent peers have no expiry date
+	ExpiresAt *time.Time `gorm:"index" form:"-" json:",omitempty"`
+
+	// Managed peers are maintained by the administrators, their owners cannot delete them
+	Managed bool `form:"managed"`
+
+	// Set for peers of the enrollment endpoint, the client device that the peer was created for
+	EnrollmentDevice string `gorm:"index" form:"-" json:",omitempty"`
+
+	CreatedBy string
+	UpdatedBy string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// IsGuest returns true for temporary peers that are deleted once they expire.
+func (p Peer) IsGuest() bool {
+	return p.ExpiresAt != nil
+}
+
+// ExpiresIn returns the remaining lifetime of a guest peer, e.g. "2d 5h" or "40m".
+func (p Peer) ExpiresIn() string {
+	if p.ExpiresAt == nil {
+		return ""
+	}
+	remaining := time.Until(*p.ExpiresAt)
+	if remaining <= 0 {
+		return "expired"
+	}
+
+	minutes := int(remaining.Round(time.Minute).Minutes())
+	days, hours := minutes/(24*60), (minutes/60)%24
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes%60)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
 }
 
 func (p *Peer) SetIPAddresses(addresses ...string) {
@@ -108,6 +243,26 @@ func (p Peer) GetIPAddresses() []string {
 	return common.ParseStringList(p.IPsStr)
 }
 
+// SetTags stores the given tags in lowercase and without duplicates.
+func (p *Peer) SetTags(tags ...string) {
+	uniqueTags := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = NormalizeTag(tag); tag != "" && !common.ListContains(uniqueTags, tag) {
+			uniqueTags = append(uniqueTags, tag)
+		}
+	}
+	p.TagsStr = common.ListToString(uniqueTags)
+}
+
+// NormalizeTag returns the trimmed, lowercase form of a tag that is used for storing and filtering.
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func (p Peer) GetTags() []string {
+	return common.ParseStringList(p.TagsStr)
+}
+
 func (p *Peer) SetDNSServers(addresses ...string) {
 	p.DNSStr = common.ListToString(addresses)
 }
@@ -124,14 +279,51 @@ func (p Peer) GetAllowedIPs() []string {
 	return common.ParseStringList(p.AllowedIPsStr)
 }
 
+// RoutesAllTraffic returns true if the client configuration of the peer contains a default route.
+func (p Peer) RoutesAllTraffic() bool {
+	for _, ip := range p.GetAllowedIPs() {
+		if _, ipNet, err := net.ParseCIDR(ip); err == nil {
+			if ones, _ := ipNet.Mask.Size(); ones == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (p Peer) GetAllowedIPsSrv() []string {
 	return common.ParseStringList(p.AllowedIPsSrvStr)
 }
 
+// GetHostRoutes returns the addresses of the peer as host routes (/32 or /128), regardless of the prefix length of the
+// addresses. A peer address like 10.0.0.5/24 must not route the whole network of the interface to the peer.
+func (p Peer) GetHostRoutes() []string {
+	addresses := p.GetIPAddresses()
+	routes := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			continue
+		}
+		if ip.To4() != nil {
+			routes = append(routes, ip.String()+"/32")
+		} else {
+			routes = append(routes, ip.String()+"/128")
+		}
+	}
+	return routes
+}
+
+// GetServerAllowedIPs returns the allowed IPs of the peer on a server mode interface: the host routes of the peer
+// addresses, widened by the server side allowed IPs.
+func (p Peer) GetServerAllowedIPs() []string {
+	return append(p.GetHostRoutes(), p.GetAllowedIPsSrv()...)
+}
+
 func (p Peer) GetConfig(dev *Device) wgtypes.PeerConfig {
 	publicKey, _ := wgtypes.ParseKey(p.PublicKey)
 
-	var presharedKey *wgtypes.Key
+	presharedKey := &wgtypes.Key{} // an all-zero key removes the preshared key
 	if p.PresharedKey != "" {
 		presharedKeyTmp, _ := wgtypes.ParseKey(p.PresharedKey)
 		presharedKey = &presharedKeyTmp
@@ -144,10 +336,16 @@ func (p Peer) GetConfig(dev *Device) wgtypes.PeerConfig {
 			endpoint = addr
 		}
 	}
+	if p.SiteEndpoint != "" {
+		addr, err := net.ResolveUDPAddr("udp", p.SiteEndpoint)
+		if err == nil {
+			endpoint = addr
+		}
+	}
 
 	var keepAlive *time.Duration
-	if p.PersistentKeepalive != 0 {
-		keepAliveDuration := time.Duration(p.PersistentKeepalive) * time.Second
+	if persistentKeepalive := p.EffectivePersistentKeepalive(dev); persistentKeepalive != 0 {
+		keepAliveDuration := time.Duration(persistentKeepalive) * time.Second
 		keepAlive = &keepAliveDuration
 	}
 
@@ -157,8 +355,7 @@ func (p Peer) GetConfig(dev *Device) wgtypes.PeerConfig {
 	case DeviceTypeClient:
 		peerAllowedIPs = p.GetAllowedIPs()
 	case DeviceTypeServer:
-		peerAllowedIPs = p.GetIPAddresses()
-		peerAllowedIPs = append(peerAllowedIPs, p.GetAllowedIPsSrv()...)
+		peerAllowedIPs = p.GetServerAllowedIPs()
 	}
 	for _, ip := range peerAllowedIPs {
 		_, ipNet, err := net.ParseCIDR(ip)
@@ -181,11 +378,60 @@ func (p Peer) GetConfig(dev *Device) wgtypes.PeerConfig {
 	return cfg
 }
 
+// overrides returns true if the peer uses its own value instead of the interface default. Peers of client mode
+// interfaces are remote endpoints, they always use their own settings.
+func (p Peer) overrides(dev *Device, override bool) bool {
+	return override || p.IgnoreGlobalSettings || dev == nil || dev.Type != DeviceTypeServer
+}
+
+// EffectiveDNSStr returns the DNS servers of the peer, or the DNS servers of the interface if they are not overridden.
+func (p Peer) EffectiveDNSStr(dev *Device) string {
+	if p.overrides(dev, p.OverrideDNS) {
+		return p.DNSStr
+	}
+	return dev.DNSStr
+}
+
+// EffectiveMtu returns the MTU of the peer, or the MTU of the interface if it is not overridden.
+func (p Peer) EffectiveMtu(dev *Device) int {
+	if p.overrides(dev, p.OverrideMtu) {
+		return p.Mtu
+	}
+	return dev.Mtu
+}
+
+// EffectivePersistentKeepalive returns the keepalive of the peer, or the default keepalive of the interface if it is
+// not overridden.
+func (p Peer) EffectivePersistentKeepalive(dev *Device) int {
+	if p.overrides(dev, p.OverrideKeepalive) {
+		return p.PersistentKeepalive
+	}
+	return dev.DefaultPersistentKeepalive
+}
+
+// EffectiveEndpoint returns the endpoint of the peer, or the endpoint of the interface if it is not overridden.
+func (p Peer) EffectiveEndpoint(dev *Device) string {
+	if p.overrides(dev, p.OverrideEndpoint) || dev.ResolvedEndpoint == "" {
+		return p.Endpoint
+	}
+	return dev.ResolvedEndpoint
+}
+
+// WithEffectiveSettings returns a copy of the peer with the interface defaults applied to all settings that are not
+// overridden.
+func (p Peer) WithEffectiveSettings(dev *Device) Peer {
+	p.DNSStr = p.EffectiveDNSStr(dev)
+	p.Mtu = p.EffectiveMtu(dev)
+	p.PersistentKeepalive = p.EffectivePersistentKeepalive(dev)
+	p.Endpoint = p.EffectiveEndpoint(dev)
+	return p
+}
+
 func (p Peer) GetConfigFile(device Device) ([]byte, error) {
 	var tplBuff bytes.Buffer
 
 	err := templateCache.ExecuteTemplate(&tplBuff, "peer.tpl", gin.H{
-		"Peer":      p,
+		"Peer":      p.WithEffectiveSettings(&device),
 		"Interface": device,
 	})
 	if err != nil {
@@ -223,9 +469,26 @@ func (p Peer) IsValid() bool {
 	return true
 }
 
+// HasEmail returns true if the peer belongs to a real email address.
+func (p Peer) HasEmail() bool {
+	return p.Email != "" && p.Email != AutodetectedPeerEmail
+}
+
+// ShortKey returns the beginning of the public key, it tells peers with the same identifier apart.
+func (p Peer) ShortKey() string {
+	if len(p.PublicKey) <= 8 {
+		return p.PublicKey
+	}
+	return p.PublicKey[:8]
+}
+
 func (p Peer) GetConfigFileName() string {
 	reg := regexp.MustCompile("[^a-zA-Z0-9_-]+")
-	return reg.ReplaceAllString(strings.ReplaceAll(p.Identifier, " ", "-"), "") + ".conf"
+	name := reg.ReplaceAllString(strings.ReplaceAll(p.Identifier, " ", "-"), "")
+	if name == "" {
+		name = "wireguard"
+	}
+	return name + ".conf"
 }
 
 //
@@ -243,19 +506,21 @@ type Device struct {
 	Interface *wgtypes.Device `gorm:"-" json:"-"`
 	Peers     []Peer          `gorm:"foreignKey:DeviceName" binding:"-" json:"-"` // linked WireGuard peers
 
+	ResolvedEndpoint string `gorm:"-" form:"-" json:"-"` // the endpoint used for new peers, see ResolveEndpoint
+
 	Type        DeviceType `form:"devicetype" binding:"required,oneof=client server"`
-	DeviceName  string     `form:"device" gorm:"primaryKey" binding:"required" validator:"regexp=[0-9a-zA-Z\-]+"`
+	DeviceName  string     `form:"device" gorm:"primaryKey" binding:"required" validator:"regexp=[0-9a-zA-Z\\-]+"`
 	DisplayName string     `form:"displayname" binding:"omitempty,max=200"`
 
 	// Core WireGuard Settings (Interface section)
 	PrivateKey   string `form:"privkey" binding:"required,base64"`
-	ListenPort   int    `form:"port" binding:"required_if=Type server,omitempty,gt=0,lt=65535"`
+	ListenPort   int    `form:"port" binding:"gte=0,lte=65535"` // 0 = random port, chosen by the kernel
 	FirewallMark int32  `form:"firewallmark" binding:"gte=0"`
 	// Misc. WireGuard Settings
 	PublicKey    string `form:"pubkey" binding:"required,base64"`
 	Mtu          int    `form:"mtu" binding:"gte=0,lte=1500"`   // the interface MTU, wg-quick addition
 	IPsStr       string `form:"ip" binding:"required,cidrlist"` // comma separated list of the IPs of the client, wg-quick addition
-	DNSStr       string `form:"dns" binding:"iplist"`           // comma separated list of the DNS servers of the client, wg-quick addition
+	DNSStr       string `form:"dns" binding:"dnslist"`          // comma separated list of the DNS servers of the client, wg-quick addition
 	RoutingTable string `form:"routingtable"`                   // the routing table, wg-quick addition
 	PreUp        string `form:"preup"`                          // pre up script, wg-quick addition
 	PostUp       string `form:"postup"`                         // post up script, wg-quick addition
@@ -264,9 +529,37 @@ type Device struct {
 	SaveConfig   bool   `form:"saveconfig"`                     // if set to `true', the configuration is saved from the current state of the interface upon shutdown, wg-quick addition
 
 	// Settings that are applied to all peer by default
-	DefaultEndpoint            string `form:"endpoint" binding:"required_if=Type server,omitempty,hostname_port"`
-	DefaultAllowedIPsStr       string `form:"allowedip" binding:"cidrlist"` // comma separated list  of IPs that are used in the client config file
-	DefaultPersistentKeepalive int    `form:"keepalive" binding:"gte=0"`
+	DefaultEndpoint            string `form:"endpoint" binding:"omitempty,endpoint"`     // optional override, see ResolveEndpoint
+	EndpointCandidatesStr      string `form:"endpointcandidates" binding:"endpointlist"` // comma separated list of alternative endpoints that can be selected for peers
+	DefaultAllowedIPsStr       string `form:"allowedip" binding:"cidrlist"`              // comma separated list  of IPs that are used in the client config file
+	DefaultPersistentKeepalive int    `form:"keepalive" binding:"gte=0,lte=65535"`
+	DefaultAllowedIPsPresetID  uint   `form:"defaultpreset"`                            // preset of new peers, 0 = DefaultAllowedIPsStr
+	DefaultGuestDays           int    `form:"defaultguestdays" binding:"gte=0,lte=365"` // new peers are guest peers that expire after this number of days, 0 = permanent peers
+
+	// If set, the tunnel mode replaces the default allowed IPs when the interface is saved, see TunnelModeAllowedIPs
+	TunnelMode TunnelMode `form:"tunnelmode" binding:"omitempty,oneof=gateway split"`
+
+	// Inherited peer defaults are taken from the global peer defaults (WG_DEFAULT_*) instead of the values above,
+	// see PeerDefaults. Only used in server mode.
+	InheritDNS        bool `form:"inheritdns"`
+	InheritAllowedIPs bool `form:"inheritallowedip"`
+	InheritKeepalive  bool `form:"inheritkeepalive"`
+
+	// Traffic of the peers is masqueraded behind this interface, only used if MANAGE_FIREWALL is enabled
+	UpstreamInterface string `form:"upstreaminterface" binding:"omitempty,max=15"`
+
+	// The network namespace of the link (ip netns), empty for the namespace of the portal. Only kernel interfaces can
+	// be moved into a namespace, see Manager.SetDeviceNamespace.
+	Namespace string `form:"namespace" binding:"omitempty,max=255"`
+
+	InactivityDisableDays int  `form:"inactivitydays" binding:"gte=0"`  // disable peers without handshake for this number of days, 0 = off
+	MaxPeers              int  `form:"maxpeers" binding:"gte=0"`        // maximum number of peers of the interface, 0 = unlimited
+	GeneratePresharedKeys bool `form:"generatepsk" gorm:"default:true"` // create a preshared key for new peers
+	SelfService           bool `form:"selfservice"`                     // users can create peers on this interface, the default interface is always allowed
+
+	DisabledAt *time.Time `form:"-"` // the link of a disabled interface is kept down, all settings and peers are kept
+
+	DisableConfigFile bool `form:"-"` // do not write the wg-quick configuration file of this interface to WG_CONFIG_PATH
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
@@ -281,7 +574,7 @@ func (d Device) IsValid() bool {
 		if len(d.GetIPAddresses()) == 0 {
 			return false
 		}
-		if d.DefaultEndpoint == "" {
+		if d.DefaultEndpoint == "" && d.ResolvedEndpoint == "" {
 			return false
 		}
 	case DeviceTypeClient:
@@ -296,6 +589,38 @@ func (d Device) IsValid() bool {
 	return true
 }
 
+// GetEndpointCandidates returns the endpoints that can be selected for peers, starting with the default endpoint.
+func (d Device) GetEndpointCandidates() []string {
+	candidates := make([]string, 0)
+	if d.ResolvedEndpoint != "" {
+		candidates = append(candidates, d.ResolvedEndpoint)
+	}
+	for _, candidate := range common.ParseStringList(d.EndpointCandidatesStr) {
+		if !common.ListContains(candidates, candidate) {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates
+}
+
+// ResolveEndpoint returns the endpoint that is announced to the peers of a server mode device. If no DefaultEndpoint is
+// configured, it is built from the given host and the listen port of the interface.
+func (d Device) ResolveEndpoint(defaultHost string) string {
+	if d.DefaultEndpoint != "" {
+		return d.DefaultEndpoint
+	}
+
+	port := d.ListenPort
+	if d.Interface != nil && d.Interface.ListenPort != 0 {
+		port = d.Interface.ListenPort // the port of the running interface might differ if it was changed manually
+	}
+	if defaultHost == "" || port == 0 {
+		return ""
+	}
+
+	return net.JoinHostPort(defaultHost, strconv.Itoa(port))
+}
+
 func (d *Device) SetIPAddresses(addresses ...string) {
 	d.IPsStr = common.ListToString(addresses)
 }
@@ -341,8 +666,13 @@ func (d Device) GetConfig() wgtypes.Config {
 func (d Device) GetConfigFile(peers []Peer, friendlyNames bool) ([]byte, error) {
 	var tplBuff bytes.Buffer
 
+	effectivePeers := make([]Peer, len(peers))
+	for i := range peers {
+		effectivePeers[i] = peers[i].WithEffectiveSettings(&d)
+	}
+
 	err := templateCache.ExecuteTemplate(&tplBuff, "interface.tpl", gin.H{
-		"Peers":         peers,
+		"Peers":         effectivePeers,
 		"Interface":     d,
 		"FriendlyNames": friendlyNames,
 	})
@@ -365,27 +695,6 @@ type PeerManager struct {
 func NewPeerManager(db *gorm.DB, wg *Manager) (*PeerManager, error) {
 	pm := &PeerManager{db: db, wg: wg}
 
-	// check if old device table exists (from version <= 1.0.3), if so migrate it.
-	if db.Migrator().HasColumn(&Device{}, "endpoint") {
-		if err := db.Migrator().RenameColumn(&Device{}, "endpoint", "default_endpoint"); err != nil {
-			return nil, errors.Wrapf(err, "failed to migrate old database structure for column endpoint")
-		}
-	}
-	if db.Migrator().HasColumn(&Device{}, "allowed_ips_str") {
-		if err := db.Migrator().RenameColumn(&Device{}, "allowed_ips_str", "default_allowed_ips_str"); err != nil {
-			return nil, errors.Wrapf(err, "failed to migrate old database structure for column allowed_ips_str")
-		}
-	}
-	if db.Migrator().HasColumn(&Device{}, "persistent_keepalive") {
-		if err := db.Migrator().RenameColumn(&Device{}, "persistent_keepalive", "default_persistent_keepalive"); err != nil {
-			return nil, errors.Wrapf(err, "failed to migrate old database structure for column persistent_keepalive")
-		}
-	}
-
-	if err := pm.db.AutoMigrate(&Device{}, &Peer{}); err != nil {
-		return nil, errors.WithMessage(err, "failed to migrate peer database")
-	}
-
 	if err := pm.initFromPhysicalInterface(); err != nil {
 		return nil, errors.WithMessagef(err, "unable to initialize peer manager")
 	}
@@ -415,38 +724,63 @@ func NewPeerManager(db *gorm.DB, wg *Manager) (*PeerManager, error) {
 }
 
 // initFromPhysicalInterface read all WireGuard peers from the WireGuard interface configuration. If a peer does not
-// exist in the local database, it gets created.
+// exist in the local database, it gets created. If unknown peers should be pruned, they are not imported.
+// Interfaces on unreachable remote hosts are skipped, they are added once the host is reachable again. Interfaces that
+// cannot be read, e.g. because they do not exist, are skipped as well, so that the other interfaces are still managed.
 func (m *PeerManager) initFromPhysicalInterface() error {
 	for _, deviceName := range m.wg.Cfg.DeviceNames {
-		peers, err := m.wg.GetPeerList(deviceName)
-		if err != nil {
-			return errors.Wrapf(err, "failed to get peer list for device %s", deviceName)
+		if m.wg.IsExternalDevice(deviceName) {
+			if err := m.initExternalDevice(deviceName); err != nil {
+				logrus.Errorf("skipping interface %s: %v", deviceName, err)
+			}
+			continue
 		}
-		device, err := m.wg.GetDeviceInfo(deviceName)
-		if err != nil {
-			return errors.Wrapf(err, "failed to get device info for device %s", deviceName)
+		err := m.InitDeviceFromPhysicalInterface(deviceName)
+		if err != nil && m.wg.IsHostUnreachable(deviceName) {
+			logrus.Warnf("skipping interface %s, its host is unreachable: %v", deviceName, err)
+			continue
 		}
-		var ipAddresses []string
-		var mtu int
-		if m.wg.Cfg.ManageIPAddresses {
-			if ipAddresses, err = m.wg.GetIPAddress(deviceName); err != nil {
-				return errors.Wrapf(err, "failed to get ip address for device %s", deviceName)
-			}
-			if mtu, err = m.wg.GetMTU(deviceName); err != nil {
-				return errors.Wrapf(err, "failed to get MTU for device %s", deviceName)
-			}
+		if err != nil {
+			logrus.Errorf("skipping interface %s: %v", deviceName, err)
 		}
+	}
+
+	return nil
+}
 
-		// Check if device already exists in database, if not, create it
-		if err := m.validateOrCreateDevice(*device, ipAddresses, mtu); err != nil {
-			return errors.WithMessagef(err, "failed to validate device %s", device.Name)
+// InitDeviceFromPhysicalInterface reads the WireGuard peers of a single interface, see initFromPhysicalInterface.
+func (m *PeerManager) InitDeviceFromPhysicalInterface(deviceName string) error {
+	peers, err := m.wg.GetPeerList(deviceName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get peer list for device %s", deviceName)
+	}
+	device, err := m.wg.GetDeviceInfo(deviceName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get device info for device %s", deviceName)
+	}
+	var ipAddresses []string
+	var mtu int
+	if m.wg.Cfg.ManageIPAddresses {
+		if ipAddresses, err = m.wg.GetIPAddress(deviceName); err != nil {
+			return errors.Wrapf(err, "failed to get ip address for device %s", deviceName)
 		}
+		if mtu, err = m.wg.GetMTU(deviceName); err != nil {
+			return errors.Wrapf(err, "failed to get MTU for device %s", deviceName)
+		}
+	}
 
-		// Check if entries already exist in database, if not, create them
-		for _, peer := range peers {
-			if err := m.validateOrCreatePeer(deviceName, peer); err != nil {
-				return errors.WithMessagef(err, "failed to validate peer %s for device %s", peer.PublicKey, deviceName)
-			}
+	// Check if device already exists in database, if not, create it
+	if err := m.validateOrCreateDevice(*device, ipAddresses, mtu); err != nil {
+		return errors.WithMessagef(err, "failed to validate device %s", device.Name)
+	}
+
+	// Check if entries already exist in database, if not, create them
+	if m.wg.Cfg.PruneUnknownPeers {
+		return nil // unknown peers will be removed from the interface
+	}
+	for _, peer := range peers {
+		if err := m.validateOrCreatePeer(deviceName, peer); err != nil {
+			return errors.WithMessagef(err, "failed to validate peer %s for device %s", peer.PublicKey, deviceName)
 		}
 	}
 
@@ -459,32 +793,8 @@ func (m *PeerManager) validateOrCreatePeer(device string, wgPeer wgtypes.Peer) e
 	peer := Peer{}
 	m.db.Where("public_key = ?", wgPeer.PublicKey.String()).FirstOrInit(&peer)
 
-	dev := m.GetDevice(device)
-
 	if peer.PublicKey == "" { // peer not found, create
-		peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(wgPeer.PublicKey.String())))
-		if dev.Type == DeviceTypeServer {
-			peer.PublicKey = wgPeer.PublicKey.String()
-			peer.Identifier = "Autodetected Client (" + peer.PublicKey[0:8] + ")"
-		} else if dev.Type == DeviceTypeClient {
-			peer.PublicKey = wgPeer.PublicKey.String()
-			if wgPeer.Endpoint != nil {
-				peer.Endpoint = wgPeer.Endpoint.String()
-			}
-			peer.Identifier = "Autodetected Endpoint (" + peer.PublicKey[0:8] + ")"
-		}
-		if wgPeer.PresharedKey != (wgtypes.Key{}) {
-			peer.PresharedKey = wgPeer.PresharedKey.String()
-		}
-		peer.Email = "autodetected@example.com"
-		peer.UpdatedAt = time.Now()
-		peer.CreatedAt = time.Now()
-		IPs := make([]string, len(wgPeer.AllowedIPs)) // use allowed IP's as the peer IP's
-		for i, ip := range wgPeer.AllowedIPs {
-			IPs[i] = ip.String()
-		}
-		peer.SetIPAddresses(IPs...)
-		peer.DeviceName = device
+		peer = m.peerFromWireGuard(device, wgPeer)
 
 		res := m.db.Create(&peer)
 		if res.Error != nil {
@@ -503,6 +813,86 @@ func (m *PeerManager) validateOrCreatePeer(device string, wgPeer wgtypes.Peer) e
 	return nil
 }
 
+// peerFromWireGuard builds a new peer entry for the given WireGuard peer, it is not stored in the database.
+func (m *PeerManager) peerFromWireGuard(device string, wgPeer wgtypes.Peer) Peer {
+	dev := m.GetDevice(device)
+
+	peer := Peer{}
+	peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(wgPeer.PublicKey.String())))
+	if dev.Type == DeviceTypeServer {
+		peer.PublicKey = wgPeer.PublicKey.String()
+		peer.Identifier = "Autodetected Client (" + peer.PublicKey[0:8] + ")"
+	} else if dev.Type == DeviceTypeClient {
+		peer.PublicKey = wgPeer.PublicKey.String()
+		if wgPeer.Endpoint != nil {
+			peer.Endpoint = wgPeer.Endpoint.String()
+		}
+		peer.Identifier = "Autodetected Endpoint (" + peer.PublicKey[0:8] + ")"
+	}
+	if wgPeer.PresharedKey != (wgtypes.Key{}) {
+		peer.PresharedKey = wgPeer.PresharedKey.String()
+	}
+	peer.Email = AutodetectedPeerEmail
+	peer.UpdatedAt = time.Now()
+	peer.CreatedAt = time.Now()
+	IPs := make([]string, len(wgPeer.AllowedIPs)) // use allowed IP's as the peer IP's
+	for i, ip := range wgPeer.AllowedIPs {
+		IPs[i] = ip.String()
+	}
+	peer.SetIPAddresses(IPs...)
+	peer.DeviceName = device
+
+	return peer
+}
+
+// GetOrphanedPeers returns all peers of the physical WireGuard interface that are not stored in the database.
+func (m *PeerManager) GetOrphanedPeers(device string) ([]wgtypes.Peer, error) {
+	wgPeers, err := m.wg.GetPeerList(device)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get peer list for device %s", device)
+	}
+	if len(wgPeers) == 0 {
+		return nil, nil
+	}
+
+	publicKeys := make([]string, len(wgPeers))
+	for i := range wgPeers {
+		publicKeys[i] = wgPeers[i].PublicKey.String()
+	}
+	var knownKeys []string
+	if err := m.db.Model(&Peer{}).Where("public_key IN ?", publicKeys).Pluck("public_key", &knownKeys).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to load known peers")
+	}
+
+	orphans := make([]wgtypes.Peer, 0)
+	for i := range wgPeers {
+		if !common.ListContains(knownKeys, publicKeys[i]) {
+			orphans = append(orphans, wgPeers[i])
+		}
+	}
+	return orphans, nil
+}
+
+// AdoptPeer creates a database entry for a peer that only exists on the physical WireGuard interface. The private key
+// of adopted peers is unknown.
+func (m *PeerManager) AdoptPeer(device string, wgPeer wgtypes.Peer, identifier, email, actor string) (Peer, error) {
+	peer := m.peerFromWireGuard(device, wgPeer)
+	if identifier != "" {
+		peer.Identifier = identifier
+	}
+	if email != "" {
+		peer.Email = strings.ToLower(email)
+	}
+	peer.CreatedBy = actor
+	peer.UpdatedBy = actor
+
+	if err := m.db.Create(&peer).Error; err != nil {
+		return Peer{}, errors.Wrapf(err, "failed to create adopted peer %s", peer.PublicKey)
+	}
+	m.populatePeerData(&peer)
+	return peer, nil
+}
+
 // validateOrCreateDevice checks if the given WireGuard device already exists in the database, if not, the peer entry will be created
 func (m *PeerManager) validateOrCreateDevice(dev wgtypes.Device, ipAddresses []string, mtu int) error {
 	device := Device{}
@@ -516,7 +906,10 @@ func (m *PeerManager) validateOrCreateDevice(dev wgtypes.Device, ipAddresses []s
 		device.ListenPort = dev.ListenPort
 		device.FirewallMark = int32(dev.FirewallMark)
 		device.Mtu = 0
-		device.DefaultPersistentKeepalive = 16 // Default
+		device.InheritDNS = true // new interfaces use the global peer defaults
+		device.InheritAllowedIPs = true
+		device.InheritKeepalive = true
+		m.wg.Cfg.PeerDefaults.apply(&device)
 		device.IPsStr = strings.Join(ipAddresses, ", ")
 		if mtu == DefaultMTU {
 			mtu = 0
@@ -551,6 +944,7 @@ func (m *PeerManager) populatePeerData(peer *Peer) {
 	peer.Peer, _ = m.wg.GetPeer(peer.DeviceName, peer.PublicKey)
 	peer.LastHandshake = "never"
 	peer.LastHandshakeTime = "Never connected, or user is disabled."
+	peer.ConnectionState = ConnectionStateOffline
 	if peer.Peer != nil {
 		since := time.Since(peer.Peer.LastHandshakeTime)
 		sinceSeconds := int(since.Round(time.Second).Seconds())
@@ -565,8 +959,18 @@ func (m *PeerManager) populatePeerData(peer *Peer) {
 			peer.LastHandshake = fmt.Sprintf("%02dm %02ds", sinceMinutes, sinceSeconds)
 		}
 		peer.LastHandshakeTime = peer.Peer.LastHandshakeTime.Format(time.UnixDate)
+		peer.ConnectionState = m.wg.Cfg.ConnectionState(peer.DeviceName, peer.Peer.LastHandshakeTime, time.Now())
+	}
+	peer.IsOnline = peer.ConnectionState == ConnectionStateOnline
+
+	// set latest collected statistics
+	if m.wg.Cfg.StatisticsInterval > 0 && peer.PublicKey != "" {
+		stats := make([]PeerStatistic, 0, 1)
+		m.db.Where("public_key = ?", peer.PublicKey).Order("id DESC").Limit(1).Find(&stats)
+		if len(stats) > 0 {
+			peer.Statistic = &stats[0]
+		}
 	}
-	peer.IsOnline = false
 }
 
 // fixPeerDefaultData tries to fill all required fields for the given peer
@@ -577,7 +981,7 @@ func (m *PeerManager) fixPeerDefaultData(peer *Peer, device *Device) error {
 	switch device.Type {
 	case DeviceTypeServer:
 		if peer.Endpoint == "" {
-			peer.Endpoint = device.DefaultEndpoint
+			peer.Endpoint = device.ResolvedEndpoint
 			updatePeer = true
 		}
 	case DeviceTypeClient:
@@ -593,6 +997,8 @@ func (m *PeerManager) fixPeerDefaultData(peer *Peer, device *Device) error {
 func (m *PeerManager) populateDeviceData(device *Device) {
 	// set data from WireGuard interface
 	device.Interface, _ = m.wg.GetDeviceInfo(device.DeviceName)
+	device.ResolvedEndpoint = device.ResolveEndpoint(m.wg.DefaultEndpointHost(device.DeviceName))
+	m.wg.Cfg.PeerDefaults.apply(device)
 }
 
 func (m *PeerManager) GetAllPeers(device string) []Peer {
@@ -617,6 +1023,14 @@ func (m *PeerManager) GetActivePeers(device string) []Peer {
 	return peers
 }
 
+// GetExpiredPeers returns the guest peers of all interfaces that expired before the given time.
+func (m *PeerManager) GetExpiredPeers(before time.Time) []Peer {
+	peers := make([]Peer, 0)
+	m.db.Where("expires_at IS NOT NULL AND expires_at <= ?", before).Find(&peers)
+
+	return peers
+}
+
 func (m *PeerManager) GetFilteredAndSortedPeers(device, sortKey, sortDirection, search string) []Peer {
 	peers := make([]Peer, 0)
 	m.db.Where("device_name = ?", device).Find(&peers)
@@ -638,6 +1052,150 @@ func (m *PeerManager) GetFilteredAndSortedPeers(device, sortKey, sortDirection,
 	return filteredPeers
 }
 
+type PeerFilter string
+
+const (
+	PeerFilterAll            PeerFilter = ""
+	PeerFilterEnabled        PeerFilter = "enabled"
+	PeerFilterDisabled       PeerFilter = "disabled"
+	PeerFilterNeverConnected PeerFilter = "neverconnected"
+	PeerFilterGuest          PeerFilter = "guest"
+)
+
+// PeerListOptions describes the filtering, sorting and pagination of a peer listing.
+type PeerListOptions struct {
+	Search        string // matches the identifier, description, public key, ip addresses and email of the peer
+	Filter        PeerFilter
+	Tags          []string // only peers that have all of these tags
+	SortKey       string   // id, pubKey, mail, ip, endpoint or handshake
+	SortDirection string   // asc or desc
+	Page          int      // first page is 1
+	PageSize      int
+}
+
+// whereTag restricts the query to peers that have the given tag. Tags are stored as comma separated list, so the tag
+// can be the only, first, last or a middle element of the list.
+func whereTag(query *gorm.DB, tag string) *gorm.DB {
+	tag = NormalizeTag(tag)
+	escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(tag)
+	return query.Where("LOWER(tags_str) = ? OR LOWER(tags_str) LIKE ? ESCAPE '!' OR LOWER(tags_str) LIKE ? ESCAPE '!' OR "+
+		"LOWER(tags_str) LIKE ? ESCAPE '!'", tag, escaped+", %", "%, "+escaped, "%, "+escaped+", %")
+}
+
+// GetPeersPage returns one page of peers and the total number of peers matching the given options. Filtering and
+// pagination are done by the database, except for options that depend on live data of the WireGuard interface.
+func (m *PeerManager) GetPeersPage(device string, opts PeerListOptions) ([]Peer, int64) {
+	if opts.Page < 1 {
+		opts.Page = 1
+	}
+	if opts.SortKey == "" {
+		opts.SortKey = "id"
+	}
+
+	query := m.db.Model(&Peer{}).Where("device_name = ?", device)
+	if opts.Search != "" {
+		pattern := common.SqlLikePattern(opts.Search)
+		query = query.Where("LOWER(identifier) LIKE ? ESCAPE '!' OR LOWER(description) LIKE ? ESCAPE '!' OR "+
+			"LOWER(public_key) LIKE ? ESCAPE '!' OR LOWER(ips_str) LIKE ? ESCAPE '!' OR LOWER(email) LIKE ? ESCAPE '!'",
+			pattern, pattern, pattern, pattern, pattern)
+	}
+	for _, tag := range opts.Tags {
+		query = whereTag(query, tag)
+	}
+	switch opts.Filter {
+	case PeerFilterEnabled:
+		query = query.Where("deactivated_at IS NULL")
+	case PeerFilterDisabled:
+		query = query.Where("deactivated_at IS NOT NULL")
+	case PeerFilterGuest:
+		query = query.Where("expires_at IS NOT NULL")
+	}
+	query = query.Session(&gorm.Session{}) // allow reuse of the query for counting and fetching
+
+	peers := make([]Peer, 0, opts.PageSize)
+	var total int64
+
+	if opts.Filter == PeerFilterNeverConnected || opts.SortKey == "handshake" {
+		// these options depend on the live data of the interface, so filtering and pagination is done in memory
+		query.Find(&peers)
+		peers = m.filterAndSortByHandshake(device, peers, opts)
+		total = int64(len(peers))
+
+		start := (opts.Page - 1) * opts.PageSize
+		end := start + opts.PageSize
+		if start > len(peers) {
+			start = len(peers)
+		}
+		if end > len(peers) || opts.PageSize <= 0 {
+			end = len(peers)
+		}
+		peers = peers[start:end]
+	} else {
+		sortColumns := map[string]string{
+			"id":       "identifier",
+			"pubKey":   "public_key",
+			"mail":     "email",
+			"ip":       "ips_str",
+			"endpoint": "endpoint",
+		}
+		order, ok := sortColumns[opts.SortKey]
+		if !ok {
+			order = "identifier"
+		}
+		if opts.SortDirection == "desc" {
+			order += " DESC"
+		}
+		order += ", public_key" // the databases do not guarantee an order of equal values, pages need a stable order
+
+		query.Count(&total)
+		pageQuery := query.Order(order)
+		if opts.PageSize > 0 {
+			pageQuery = pageQuery.Offset((opts.Page - 1) * opts.PageSize).Limit(opts.PageSize)
+		}
+		pageQuery.Find(&peers)
+	}
+
+	for i := range peers {
+		m.populatePeerData(&peers[i])
+	}
+
+	return peers, total
+}
+
+// filterAndSortByHandshake applies the never connected filter and the handshake sort order using the live data of the
+// interface. The interface is queried once for all peers.
+func (m *PeerManager) filterAndSortByHandshake(device string, peers []Peer, opts PeerListOptions) []Peer {
+	handshakes := make(map[string]time.Time, len(peers))
+	if wgPeers, err := m.wg.GetPeerList(device); err == nil {
+		for _, wgPeer := range wgPeers {
+			handshakes[wgPeer.PublicKey.String()] = wgPeer.LastHandshakeTime
+		}
+	}
+
+	filteredPeers := make([]Peer, 0, len(peers))
+	for i := range peers {
+		if opts.Filter == PeerFilterNeverConnected && !handshakes[peers[i].PublicKey].IsZero() {
+			continue
+		}
+		filteredPeers = append(filteredPeers, peers[i])
+	}
+
+	if opts.SortKey == "handshake" {
+		sort.SliceStable(filteredPeers, func(i, j int) bool {
+			left := handshakes[filteredPeers[i].PublicKey]
+			right := handshakes[filteredPeers[j].PublicKey]
+			if opts.SortDirection == "desc" {
+				return left.After(right)
+			}
+			return left.Before(right)
+		})
+	} else {
+		sortPeers(opts.SortKey, opts.SortDirection, filteredPeers)
+	}
+
+	return filteredPeers
+}
+
 func (m *PeerManager) GetSortedPeersForEmail(sortKey, sortDirection, email string) []Peer {
 	email = strings.ToLower(email)
 	peers := make([]Peer, 0)
@@ -691,6 +1249,23 @@ func sortPeers(sortKey string, sortDirection string, peers []Peer) {
 	})
 }
 
+// GetAllTags returns the sorted tags of all peers of the given device.
+func (m *PeerManager) GetAllTags(device string) []string {
+	var tagLists []string
+	m.db.Model(&Peer{}).Where("device_name = ? AND tags_str <> ''", device).Distinct().Pluck("tags_str", &tagLists)
+
+	tags := make([]string, 0)
+	for _, tagList := range tagLists {
+		for _, tag := range common.ParseStringList(tagList) {
+			if tag = NormalizeTag(tag); !common.ListContains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
 func (m *PeerManager) GetDevice(device string) Device {
 	dev := Device{}
 
@@ -707,6 +1282,23 @@ func (m *PeerManager) GetPeerByKey(publicKey string) Peer {
 	return peer
 }
 
+// GetPeerByEnrollment returns the peer of the user that was enrolled for the client device on the given device.
+// Client device names are compared case-insensitive.
+func (m *PeerManager) GetPeerByEnrollment(mail, device, enrollmentDevice string) Peer {
+	peer := Peer{}
+	m.db.Where("email = ? AND device_name = ? AND LOWER(enrollment_device) = ?", strings.ToLower(mail), device,
+		strings.ToLower(enrollmentDevice)).FirstOrInit(&peer)
+	m.populatePeerData(&peer)
+	return peer
+}
+
+func (m *PeerManager) GetPeerByUID(uid string) Peer {
+	peer := Peer{}
+	m.db.Where("uid = ?", uid).FirstOrInit(&peer)
+	m.populatePeerData(&peer)
+	return peer
+}
+
 func (m *PeerManager) GetPeersByMail(mail string) []Peer {
 	mail = strings.ToLower(mail)
 	var peers []Peer
@@ -718,6 +1310,43 @@ func (m *PeerManager) GetPeersByMail(mail string) []Peer {
 	return peers
 }
 
+// IdentifierExistsForMail returns true if another peer (with a different public key) of the given email on the given
+// device already uses the identifier. Identifiers are compared case-insensitive.
+func (m *PeerManager) IdentifierExistsForMail(device, mail, identifier, publicKey string) bool {
+	var count int64
+	m.db.Model(&Peer{}).Where("device_name = ? AND email = ? AND LOWER(identifier) = ? AND public_key <> ?",
+		device, strings.ToLower(mail), strings.ToLower(identifier), publicKey).Count(&count)
+	return count > 0
+}
+
+// GetDuplicateIdentifiers returns the lowercase identifiers that are used by more than one peer of the given device.
+// Identifiers only have to be unique per email address, lists show the short key of these peers to tell them apart.
+func (m *PeerManager) GetDuplicateIdentifiers(device string) map[string]bool {
+	var identifiers []string
+	m.db.Model(&Peer{}).Where("device_name = ?", device).Group("LOWER(identifier)").
+		Having("COUNT(*) > 1").Pluck("LOWER(identifier)", &identifiers)
+
+	duplicates := make(map[string]bool, len(identifiers))
+	for _, identifier := range identifiers {
+		duplicates[identifier] = true
+	}
+	return duplicates
+}
+
+// CountPeers returns the number of peers (including disabled ones) of the given device.
+func (m *PeerManager) CountPeers(device string) int64 {
+	var count int64
+	m.db.Model(&Peer{}).Where("device_name = ?", device).Count(&count)
+	return count
+}
+
+// CountPeersByMail returns the number of peers (including disabled ones) of all devices that belong to the given email.
+func (m *PeerManager) CountPeersByMail(mail string) int64 {
+	var count int64
+	m.db.Model(&Peer{}).Where("email = ?", strings.ToLower(mail)).Count(&count)
+	return count
+}
+
 // ---- Database helpers -----
 
 func (m *PeerManager) CreatePeer(peer Peer) error {
@@ -755,6 +1384,137 @@ func (m *PeerManager) DeletePeer(peer Peer) error {
 		return errors.Wrap(res.Error, "failed to delete peer")
 	}
 
+	if err := m.db.Where("public_key = ?", peer.PublicKey).Delete(&PeerStatistic{}).Error; err != nil {
+		logrus.Warnf("failed to delete statistics of peer %s: %v", peer.PublicKey, err)
+	}
+	if err := m.db.Where("public_key = ?", peer.PublicKey).Delete(&PeerConnection{}).Error; err != nil {
+		logrus.Warnf("failed to delete connection history of peer %s: %v", peer.PublicKey, err)
+	}
+
+	return nil
+}
+
+// PeerChange is a change of a stored peer together with the configuration that applies it to the interface.
+type PeerChange struct {
+	Peer   Peer
+	Delete bool               // the peer is removed from the database, otherwise it is created or updated
+	Config wgtypes.PeerConfig // applied to the interface
+}
+
+// ApplyPeerChanges stores the peers and applies their configurations to the interface as one unit. The database
+// changes are made in a transaction that is only committed after the configuration call succeeded. If the call or the
+// commit fails, the transaction is rolled back and the changed peers of the interface are set back to their previous
+// state, so the database and the interface stay consistent.
+func (m *PeerManager) ApplyPeerChanges(device string, changes []PeerChange) error {
+	cfgs := make([]wgtypes.PeerConfig, len(changes))
+	for i := range changes {
+		cfgs[i] = changes[i].Config
+	}
+	snapshot, err := m.wg.SnapshotPeers(device, cfgs)
+	if err != nil {
+		return errors.WithMessage(err, "failed to read the WireGuard peers before the change")
+	}
+
+	tx := m.db.Begin()
+	if tx.Error != nil {
+		return errors.Wrap(tx.Error, "failed to start transaction")
+	}
+	for _, change := range changes {
+		if err := storePeerChange(tx, change); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := m.wg.ConfigurePeers(device, cfgs); err != nil {
+		tx.Rollback()
+		m.restorePeers(snapshot)
+		return errors.WithMessage(err, "failed to update WireGuard peers")
+	}
+	if err := tx.Commit().Error; err != nil {
+		m.restorePeers(snapshot)
+		return errors.Wrap(err, "failed to store peers")
+	}
+
+	return nil
+}
+
+// DeletePeers removes the peers from the database in one transaction, the interface is not changed.
+func (m *PeerManager) DeletePeers(peers []Peer) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		for _, peer := range peers {
+			if err := storePeerChange(tx, PeerChange{Peer: peer, Delete: true}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *PeerManager) restorePeers(snapshot *PeerSnapshot) {
+	if err := m.wg.RestorePeers(snapshot); err != nil {
+		logrus.Errorf("%v, the interface is inconsistent until it is restored", err)
+	}
+}
+
+// storePeerChange stores a single change of ApplyPeerChanges like CreatePeer, UpdatePeer and DeletePeer do.
+func storePeerChange(tx *gorm.DB, change PeerChange) error {
+	peer := change.Peer
+	if change.Delete {
+		if err := tx.Delete(&peer).Error; err != nil {
+			return errors.Wrapf(err, "failed to delete peer %s", peer.PublicKey)
+		}
+		if err := tx.Where("public_key = ?", peer.PublicKey).Delete(&PeerStatistic{}).Error; err != nil {
+			return errors.Wrapf(err, "failed to delete statistics of peer %s", peer.PublicKey)
+		}
+		if err := tx.Where("public_key = ?", peer.PublicKey).Delete(&PeerConnection{}).Error; err != nil {
+			return errors.Wrapf(err, "failed to delete connection history of peer %s", peer.PublicKey)
+		}
+		return nil
+	}
+
+	if peer.UID == "" {
+		peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(peer.PublicKey)))
+	}
+	if peer.CreatedAt.IsZero() {
+		peer.CreatedAt = time.Now()
+	}
+	peer.UpdatedAt = time.Now()
+	peer.Email = strings.ToLower(peer.Email)
+	if err := tx.Save(&peer).Error; err != nil {
+		return errors.Wrapf(err, "failed to store peer %s", peer.PublicKey)
+	}
+
+	return nil
+}
+
+// RotatePeerKeys stores the peer under its new public key and removes the entry of the old public key. The statistics
+// and the connection history of the old public key are moved to the new one.
+func (m *PeerManager) RotatePeerKeys(oldPublicKey string, peer Peer) error {
+	peer.UID = fmt.Sprintf("u%x", md5.Sum([]byte(peer.PublicKey)))
+	peer.UpdatedAt = time.Now()
+
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("public_key = ?", oldPublicKey).Delete(&Peer{}).Error; err != nil {
+			return errors.Wrap(err, "failed to remove old peer key")
+		}
+		if err := tx.Create(&peer).Error; err != nil {
+			return errors.Wrap(err, "failed to store new peer key")
+		}
+		if err := tx.Model(&PeerStatistic{}).Where("public_key = ?", oldPublicKey).
+			Update("public_key", peer.PublicKey).Error; err != nil {
+			return errors.Wrap(err, "failed to move peer statistics")
+		}
+		if err := tx.Model(&PeerConnection{}).Where("public_key = ?", oldPublicKey).
+			Update("public_key", peer.PublicKey).Error; err != nil {
+			return errors.Wrap(err, "failed to move peer connection history")
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("failed to rotate keys of peer %s: %v", oldPublicKey, err)
+		return err
+	}
+
 	return nil
 }
 
@@ -770,11 +1530,44 @@ func (m *PeerManager) UpdateDevice(device Device) error {
 	return nil
 }
 
+// DeleteDevice removes the device together with all of its peers, their statistics and connection history, the
+// allowed IPs presets and the ip reservations.
+func (m *PeerManager) DeleteDevice(device string) error {
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("device_name = ?", device).Delete(&AllowedIPsPreset{}).Error; err != nil {
+			return errors.Wrap(err, "failed to delete allowed IPs presets")
+		}
+		if err := tx.Where("device_name = ?", device).Delete(&IPReservation{}).Error; err != nil {
+			return errors.Wrap(err, "failed to delete ip reservations")
+		}
+		if err := tx.Where("device_name = ?", device).Delete(&PeerStatistic{}).Error; err != nil {
+			return errors.Wrap(err, "failed to delete peer statistics")
+		}
+		if err := tx.Where("device_name = ?", device).Delete(&PeerConnection{}).Error; err != nil {
+			return errors.Wrap(err, "failed to delete peer connection history")
+		}
+		if err := tx.Where("device_name = ?", device).Delete(&Peer{}).Error; err != nil {
+			return errors.Wrap(err, "failed to delete peers")
+		}
+		if err := tx.Where("device_name = ?", device).Delete(&Device{}).Error; err != nil {
+			return errors.Wrap(err, "failed to delete device")
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("failed to delete device %s: %v", device, err)
+		return err
+	}
+
+	return nil
+}
+
 // ---- IP helpers ----
 
 func (m *PeerManager) GetAllReservedIps(device string) ([]string, error) {
 	reservedIps := make([]string, 0)
-	peers := m.GetAllPeers(device)
+	peers := make([]Peer, 0)
+	m.db.Where("device_name = ?", device).Find(&peers) // no live data needed
 	for _, user := range peers {
 		for _, cidr := range user.GetIPAddresses() {
 			if cidr == "" {
@@ -846,6 +1639,7 @@ func (m *PeerManager) GetAvailableIp(device string, cidr string) (string, error)
 	// this two addresses are not usable
 	broadcastAddr := common.BroadcastAddr(ipnet).String()
 	networkAddr := ipnet.IP.String()
+	reservations := m.GetIPReservations(device) // reserved addresses are never allocated automatically
 
 	for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); common.IncreaseIP(ip) {
 		ok := true
@@ -856,6 +1650,12 @@ func (m *PeerManager) GetAvailableIp(device string, cidr string) (string, error)
 				break
 			}
 		}
+		for _, r := range reservations {
+			if r.Contains(ip) {
+				ok = false
+				break
+			}
+		}
 		if ok && address != networkAddr && address != broadcastAddr {
 			netMask := "/32"
 			if common.IsIPv6(address) {
@@ -0,0 +1,69 @@
+//go:build !linux
+// +build !linux
+
+package wireguard
+
+import (
+	"net"
+	"os"
+)
+
+// Interfaces, routes and policy routing rules are only managed on Linux. On other platforms the portal configures
+// existing interfaces and wireguard-go interfaces with wgctrl, and manages external interfaces and remote hosts.
+
+func newInterfaceManager() InterfaceManager {
+	return platformNotSupported()
+}
+
+// openNamespace fails, network namespaces only exist on Linux.
+func openNamespace(string) (*os.File, error) {
+	return nil, platformNotSupported().err("network namespaces")
+}
+
+// inNamespace runs fn if no network namespace is given, network namespaces only exist on Linux.
+func inNamespace(namespace string, fn func() error) error {
+	if namespace != "" {
+		return platformNotSupported().err("network namespaces")
+	}
+	return fn()
+}
+
+func linkExists(device string) error {
+	_, err := net.InterfaceByName(device)
+	return err
+}
+
+// kernelModuleAvailable is always false, new interfaces are created with wireguard-go in auto mode.
+func kernelModuleAvailable() bool {
+	return false
+}
+
+// RouteList returns no routes, the routes of the interfaces are not managed on this platform.
+func (m *Manager) RouteList(string) ([]Route, error) {
+	return []Route{}, nil
+}
+
+func (m *Manager) RouteAdd(string, Route) error {
+	return platformNotSupported().err("managing routes")
+}
+
+func (m *Manager) RouteReplace(string, Route) error {
+	return platformNotSupported().err("managing routes")
+}
+
+func (m *Manager) RouteDel(string, Route) error {
+	return platformNotSupported().err("managing routes")
+}
+
+// RuleList returns no rules, policy routing rules are not managed on this platform.
+func (m *Manager) RuleList() ([]Rule, error) {
+	return []Rule{}, nil
+}
+
+func (m *Manager) RuleAdd(Rule) error {
+	return platformNotSupported().err("managing routing rules")
+}
+
+func (m *Manager) RuleDel(Rule) error {
+	return platformNotSupported().err("managing routing rules")
+}
@@ -0,0 +1,80 @@
+package wireguard
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AllowedIPsPreset is a named list of client side allowed IPs of an interface, for example "full tunnel" or
+// "intranet only". Peers reference presets by ID, so changes of a preset can be applied to all dependent peers.
+type AllowedIPsPreset struct {
+	ID            uint   `gorm:"primaryKey" form:"id"`
+	DeviceName    string `gorm:"index" form:"-"`
+	Name          string `form:"name" binding:"required,max=64"`
+	AllowedIPsStr string `form:"allowedip" binding:"required,cidrlist"` // comma separated list of networks
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// AllowedIPsPresetConfig describes a preset in the configuration file. It is created at startup if the interface has
+// no preset with the same name.
+type AllowedIPsPresetConfig struct {
+	Device     string   `yaml:"device"`
+	Name       string   `yaml:"name"`
+	AllowedIPs []string `yaml:"allowedIPs"`
+}
+
+func (m *PeerManager) GetAllowedIPsPresets(device string) []AllowedIPsPreset {
+	presets := make([]AllowedIPsPreset, 0)
+	m.db.Where("device_name = ?", device).Order("name").Find(&presets)
+	return presets
+}
+
+func (m *PeerManager) GetAllowedIPsPreset(id uint) (AllowedIPsPreset, error) {
+	preset := AllowedIPsPreset{}
+	if err := m.db.First(&preset, id).Error; err != nil {
+		return AllowedIPsPreset{}, errors.Wrapf(err, "failed to load allowed IPs preset %d", id)
+	}
+	return preset, nil
+}
+
+func (m *PeerManager) AllowedIPsPresetNameExists(device, name string, id uint) bool {
+	var count int64
+	m.db.Model(&AllowedIPsPreset{}).Where("device_name = ? AND name = ? AND id <> ?", device, name, id).Count(&count)
+	return count > 0
+}
+
+func (m *PeerManager) SaveAllowedIPsPreset(preset *AllowedIPsPreset) error {
+	if err := m.db.Save(preset).Error; err != nil {
+		return errors.Wrapf(err, "failed to save allowed IPs preset %s", preset.Name)
+	}
+	return nil
+}
+
+// DeleteAllowedIPsPreset removes the preset, dependent peers keep their current allowed IPs as custom value. New peers
+// of an interface that used the preset as default get the default allowed IPs of the interface again.
+func (m *PeerManager) DeleteAllowedIPsPreset(id uint) error {
+	if err := m.db.Model(&Peer{}).Where("allowed_ips_preset_id = ?", id).Update("allowed_ips_preset_id", 0).Error; err != nil {
+		return errors.Wrapf(err, "failed to detach peers from allowed IPs preset %d", id)
+	}
+	if err := m.db.Model(&Device{}).Where("default_allowed_ips_preset_id = ?", id).
+		Update("default_allowed_ips_preset_id", 0).Error; err != nil {
+		return errors.Wrapf(err, "failed to detach interfaces from allowed IPs preset %d", id)
+	}
+	if err := m.db.Delete(&AllowedIPsPreset{}, id).Error; err != nil {
+		return errors.Wrapf(err, "failed to delete allowed IPs preset %d", id)
+	}
+	return nil
+}
+
+// GetPeersByAllowedIPsPreset returns all peers that use the given preset.
+func (m *PeerManager) GetPeersByAllowedIPsPreset(id uint) []Peer {
+	peers := make([]Peer, 0)
+	m.db.Where("allowed_ips_preset_id = ?", id).Find(&peers)
+	for i := range peers {
+		m.populatePeerData(&peers[i])
+	}
+	return peers
+}
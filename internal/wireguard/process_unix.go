@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package wireguard
+
+import "syscall"
+
+// detachedProcessAttributes starts the process in its own process group, so it keeps running if the portal is stopped.
+func detachedProcessAttributes() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,8 @@
+package wireguard
+
+import "syscall"
+
+// detachedProcessAttributes starts the process in its own process group, so it keeps running if the portal is stopped.
+func detachedProcessAttributes() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
@@ -0,0 +1,159 @@
+package wireguard
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/pkg/errors"
+)
+
+// IPReservation reserves a single address or a range of addresses of an interface. Reservations with an owner (an
+// email address, a peer identifier or both) belong to the matching peers, a peer that is created again gets the same
+// address. Reservations without owner keep the range free for manual assignment. Reserved addresses are never
+// allocated automatically.
+type IPReservation struct {
+	ID          uint   `gorm:"primaryKey" form:"id"`
+	DeviceName  string `gorm:"index" form:"-"`
+	Network     string `form:"network" binding:"required,max=64"` // an address (/32 or /128) or a range in CIDR notation
+	Email       string `form:"email" binding:"omitempty,email"`
+	Identifier  string `form:"identifier" binding:"max=64"`
+	Description string `form:"description" binding:"max=256"`
+
+	CreatedBy string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// IsManual is true for reservations without owner, their addresses are only assigned manually.
+func (r IPReservation) IsManual() bool {
+	return r.Email == "" && r.Identifier == ""
+}
+
+// IsRange is true if the reservation contains more than one address.
+func (r IPReservation) IsRange() bool {
+	_, ipNet, err := net.ParseCIDR(r.Network)
+	if err != nil {
+		return false
+	}
+	ones, bits := ipNet.Mask.Size()
+	return ones != bits
+}
+
+// Matches reports whether the peer is the owner of the reservation. Emails and identifiers are compared
+// case-insensitive.
+func (r IPReservation) Matches(peer Peer) bool {
+	if r.IsManual() {
+		return false
+	}
+	return (r.Email == "" || strings.EqualFold(r.Email, peer.Email)) &&
+		(r.Identifier == "" || strings.EqualFold(r.Identifier, peer.Identifier))
+}
+
+// Contains reports whether the address is part of the reservation.
+func (r IPReservation) Contains(ip net.IP) bool {
+	_, ipNet, err := net.ParseCIDR(r.Network)
+	return err == nil && ipNet.Contains(ip)
+}
+
+// Owner describes the owner of the reservation.
+func (r IPReservation) Owner() string {
+	switch {
+	case r.IsManual():
+		return "manual assignment"
+	case r.Email == "":
+		return "peers named " + r.Identifier
+	case r.Identifier == "":
+		return r.Email
+	default:
+		return r.Identifier + " (" + r.Email + ")"
+	}
+}
+
+func (m *PeerManager) GetIPReservations(device string) []IPReservation {
+	reservations := make([]IPReservation, 0)
+	m.db.Where("device_name = ?", device).Order("network").Find(&reservations)
+	return reservations
+}
+
+func (m *PeerManager) GetIPReservation(id uint) (IPReservation, error) {
+	reservation := IPReservation{}
+	if err := m.db.First(&reservation, id).Error; err != nil {
+		return IPReservation{}, errors.Wrapf(err, "failed to load ip reservation %d", id)
+	}
+	return reservation, nil
+}
+
+// SaveIPReservation normalizes and stores the reservation. Plain addresses are reserved as single address. The network
+// must be part of the networks of the interface and must not overlap another reservation of the interface.
+func (m *PeerManager) SaveIPReservation(reservation *IPReservation) error {
+	network := strings.TrimSpace(reservation.Network)
+	if !strings.Contains(network, "/") {
+		network += "/32"
+		if common.IsIPv6(strings.TrimSpace(reservation.Network)) {
+			network = strings.TrimSuffix(network, "/32") + "/128"
+		}
+	}
+	ip, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return errors.Errorf("invalid network %s", reservation.Network)
+	}
+	if ones, bits := ipNet.Mask.Size(); ones != bits {
+		ip = ip.Mask(ipNet.Mask)
+	}
+	reservation.Network = (&net.IPNet{IP: ip, Mask: ipNet.Mask}).String()
+
+	device := Device{}
+	if err := m.db.Where("device_name = ?", reservation.DeviceName).First(&device).Error; err != nil {
+		return errors.Wrapf(err, "failed to load interface %s", reservation.DeviceName)
+	}
+	inInterface := false
+	for _, cidr := range device.GetIPAddresses() {
+		if _, deviceNet, err := net.ParseCIDR(cidr); err == nil && deviceNet.Contains(ip) {
+			inInterface = true
+		}
+	}
+	if !inInterface {
+		return errors.Errorf("%s is not part of the networks of interface %s", reservation.Network,
+			reservation.DeviceName)
+	}
+	for _, other := range m.GetIPReservations(reservation.DeviceName) {
+		_, otherNet, err := net.ParseCIDR(other.Network)
+		if err != nil || other.ID == reservation.ID {
+			continue
+		}
+		if otherNet.Contains(ip) || ipNet.Contains(otherNet.IP) {
+			return errors.Errorf("%s overlaps the reservation %s for %s", reservation.Network, other.Network,
+				other.Owner())
+		}
+	}
+
+	reservation.Email = strings.ToLower(strings.TrimSpace(reservation.Email))
+	reservation.Identifier = strings.TrimSpace(reservation.Identifier)
+	if err := m.db.Save(reservation).Error; err != nil {
+		return errors.Wrapf(err, "failed to save ip reservation %s", reservation.Network)
+	}
+	return nil
+}
+
+func (m *PeerManager) DeleteIPReservation(id uint) error {
+	if err := m.db.Delete(&IPReservation{}, id).Error; err != nil {
+		return errors.Wrapf(err, "failed to delete ip reservation %d", id)
+	}
+	return nil
+}
+
+// GetPeerByIP returns the peer of the interface that uses the address, the returned peer is empty if no peer uses it.
+func (m *PeerManager) GetPeerByIP(device string, ip net.IP) Peer {
+	peers := make([]Peer, 0)
+	m.db.Where("device_name = ?", device).Find(&peers) // no live data needed
+	for _, peer := range peers {
+		for _, cidr := range peer.GetIPAddresses() {
+			if peerIP, _, err := net.ParseCIDR(cidr); err == nil && peerIP.Equal(ip) {
+				return peer
+			}
+		}
+	}
+	return Peer{}
+}
@@ -0,0 +1,295 @@
+package wireguard
+
+import (
+	"context"
+	"time"
+
+	"github.com/h44z/wg-portal/internal/common"
+	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// PeerStatistic is a single traffic and handshake sample of a peer. Delta values contain the traffic since the previous
+// sample of the same peer, they are never negative.
+type PeerStatistic struct {
+	ID            uint      `gorm:"primaryKey"`
+	PublicKey     string    `gorm:"index"`
+	DeviceName    string    `gorm:"index"`
+	CollectedAt   time.Time `gorm:"index"`
+	LastHandshake *time.Time
+	ReceiveBytes  int64
+	TransmitBytes int64
+	ReceiveDelta  int64
+	TransmitDelta int64
+}
+
+// PeerConnection is a connection of a peer from a single endpoint. As long as the peer keeps renewing its handshakes
+// from the same endpoint, LastHandshake of the connection is updated instead of storing a new entry.
+type PeerConnection struct {
+	ID             uint   `gorm:"primaryKey"`
+	PublicKey      string `gorm:"index"`
+	DeviceName     string `gorm:"index"`
+	Endpoint       string // empty if the endpoint is unknown
+	FirstHandshake time.Time
+	LastHandshake  time.Time `gorm:"index"`
+}
+
+// Duration is the time between the first and the last handshake of the connection.
+func (p PeerConnection) Duration() time.Duration {
+	return p.LastHandshake.Sub(p.FirstHandshake).Round(time.Second)
+}
+
+// connectionGap is the maximum time between two handshakes of the same connection. WireGuard renews the handshake
+// every two minutes while a peer is active.
+const connectionGap = 5 * time.Minute
+
+// StatisticsCollector periodically polls all WireGuard devices and stores the traffic of the managed peers. The traffic
+// deltas are also accounted per peer and day, and per user and month, see PeerTrafficDay and UserTrafficMonth.
+type StatisticsCollector struct {
+	db *gorm.DB
+	wg *Manager
+
+	last        map[string]PeerStatistic  // public key -> most recent sample
+	connections map[string]PeerConnection // public key -> most recent connection
+	missing     map[string]bool           // devices that could not be found during the last poll
+}
+
+func NewStatisticsCollector(db *gorm.DB, wg *Manager) (*StatisticsCollector, error) {
+	c := &StatisticsCollector{
+		db:          db,
+		wg:          wg,
+		last:        make(map[string]PeerStatistic),
+		connections: make(map[string]PeerConnection),
+		missing:     make(map[string]bool),
+	}
+
+	// continue the delta calculation with the samples of the previous run
+	latest := make([]PeerStatistic, 0)
+	if latestIds := c.latestIds(); len(latestIds) > 0 {
+		db.Where("id IN ?", latestIds).Find(&latest)
+	}
+	for _, stat := range latest {
+		c.last[stat.PublicKey] = stat
+	}
+
+	connectionIds := make([]struct{ ID uint }, 0)
+	db.Model(&PeerConnection{}).Select("MAX(id) AS id").Group("public_key").Scan(&connectionIds)
+	for _, row := range connectionIds {
+		connection := PeerConnection{}
+		if db.First(&connection, row.ID).Error == nil {
+			c.connections[connection.PublicKey] = connection
+		}
+	}
+
+	return c, nil
+}
+
+// Run polls the devices until the given context is cancelled.
+func (c *StatisticsCollector) Run(ctx context.Context) {
+	interval := c.wg.Cfg.StatisticsInterval
+	logrus.Debugf("starting statistics collector, interval: %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.collect()
+		c.prune()
+
+		select {
+		case <-ctx.Done():
+			logrus.Debug("statistics collector stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *StatisticsCollector) collect() {
+	devices, err := c.wg.GetDevices()
+	if err != nil {
+		logrus.Warnf("failed to collect peer statistics: %v", err)
+		return
+	}
+
+	found := make(map[string]bool, len(devices))
+	now := time.Now()
+	for _, device := range devices {
+		if !common.ListContains(c.wg.Cfg.DeviceNames, device.Name) || c.wg.IsExternalDevice(device.Name) {
+			continue // unmanaged device, or a local interface with the name of an external one
+		}
+		found[device.Name] = true
+		if c.missing[device.Name] {
+			logrus.Infof("device %s is available again, resuming statistics collection", device.Name)
+			delete(c.missing, device.Name)
+		}
+
+		stats := make([]PeerStatistic, 0, len(device.Peers))
+		for _, peer := range device.Peers {
+			if stat, changed := c.sample(device.Name, peer, now); changed {
+				stats = append(stats, stat)
+			}
+			c.recordConnection(device.Name, peer)
+		}
+		if len(stats) == 0 {
+			continue
+		}
+		if err := c.db.Create(&stats).Error; err != nil {
+			logrus.Errorf("failed to store peer statistics for device %s: %v", device.Name, err)
+			continue
+		}
+		for _, stat := range stats {
+			c.last[stat.PublicKey] = stat
+		}
+		if err := c.account(device.Name, stats); err != nil {
+			logrus.Errorf("failed to account peer traffic for device %s: %v", device.Name, err)
+		}
+	}
+
+	// the device might be down or being recreated, the counters will be reset once it is back
+	for _, deviceName := range c.wg.Cfg.DeviceNames {
+		if !found[deviceName] && !c.missing[deviceName] && !c.wg.IsExternalDevice(deviceName) {
+			logrus.Warnf("device %s not found, pausing statistics collection", deviceName)
+			c.missing[deviceName] = true
+		}
+	}
+}
+
+// sample creates a new statistic entry for the given peer. The second return value is false if nothing changed since
+// the previous sample, in that case, no new entry needs to be stored.
+func (c *StatisticsCollector) sample(device string, peer wgtypes.Peer, now time.Time) (PeerStatistic, bool) {
+	stat := PeerStatistic{
+		PublicKey:     peer.PublicKey.String(),
+		DeviceName:    device,
+		CollectedAt:   now,
+		ReceiveBytes:  peer.ReceiveBytes,
+		TransmitBytes: peer.TransmitBytes,
+	}
+	if !peer.LastHandshakeTime.IsZero() {
+		handshake := peer.LastHandshakeTime
+		stat.LastHandshake = &handshake
+	}
+
+	last, ok := c.last[stat.PublicKey]
+	if !ok {
+		return stat, true // first sample, no deltas available
+	}
+
+	lastHandshakeUnchanged := (last.LastHandshake == nil && stat.LastHandshake == nil) ||
+		(last.LastHandshake != nil && stat.LastHandshake != nil && last.LastHandshake.Equal(*stat.LastHandshake))
+	if lastHandshakeUnchanged && last.ReceiveBytes == stat.ReceiveBytes && last.TransmitBytes == stat.TransmitBytes {
+		return stat, false
+	}
+
+	// If the counters were reset (interface restart, or the peer was removed and added again), the current values are
+	// the traffic since the reset. Both counters of a peer are reset together, a decrease of one of them is enough.
+	if stat.ReceiveBytes < last.ReceiveBytes || stat.TransmitBytes < last.TransmitBytes {
+		stat.ReceiveDelta, stat.TransmitDelta = stat.ReceiveBytes, stat.TransmitBytes
+	} else {
+		stat.ReceiveDelta = stat.ReceiveBytes - last.ReceiveBytes
+		stat.TransmitDelta = stat.TransmitBytes - last.TransmitBytes
+	}
+
+	return stat, true
+}
+
+// recordConnection updates the connection history of the peer. A new connection is stored if the endpoint changed or
+// if the peer did not renew its handshake in time, otherwise the last handshake of the current connection is updated.
+func (c *StatisticsCollector) recordConnection(device string, peer wgtypes.Peer) {
+	if peer.LastHandshakeTime.IsZero() {
+		return // never connected
+	}
+	endpoint := ""
+	if peer.Endpoint != nil {
+		endpoint = peer.Endpoint.String()
+	}
+
+	publicKey := peer.PublicKey.String()
+	connection, ok := c.connections[publicKey]
+	if ok && !peer.LastHandshakeTime.After(connection.LastHandshake) {
+		return // no new handshake
+	}
+
+	gap := connectionGap
+	if interval := 2 * c.wg.Cfg.StatisticsInterval; interval > gap {
+		gap = interval // handshakes between two polls are not visible
+	}
+	if ok && connection.Endpoint == endpoint && peer.LastHandshakeTime.Sub(connection.LastHandshake) <= gap {
+		connection.LastHandshake = peer.LastHandshakeTime
+		if err := c.db.Model(&connection).Update("last_handshake", connection.LastHandshake).Error; err != nil {
+			logrus.Errorf("failed to update connection of peer %s: %v", publicKey, err)
+			return
+		}
+	} else {
+		connection = PeerConnection{
+			PublicKey:      publicKey,
+			DeviceName:     device,
+			Endpoint:       endpoint,
+			FirstHandshake: peer.LastHandshakeTime,
+			LastHandshake:  peer.LastHandshakeTime,
+		}
+		if err := c.db.Create(&connection).Error; err != nil {
+			logrus.Errorf("failed to store connection of peer %s: %v", publicKey, err)
+			return
+		}
+	}
+	c.connections[publicKey] = connection
+}
+
+// GetConnectionHistory returns the most recent connections of the peer, newest first.
+func (c *StatisticsCollector) GetConnectionHistory(publicKey string, limit int) []PeerConnection {
+	connections := make([]PeerConnection, 0)
+	c.db.Where("public_key = ?", publicKey).Order("first_handshake DESC").Limit(limit).Find(&connections)
+	return connections
+}
+
+// GetDeviceTraffic returns the received and transmitted bytes of all peers of the interface since the given time.
+func (c *StatisticsCollector) GetDeviceTraffic(device string, since time.Time) (int64, int64) {
+	var traffic struct{ Rx, Tx int64 }
+	c.db.Model(&PeerStatistic{}).
+		Select("COALESCE(SUM(receive_delta), 0) AS rx, COALESCE(SUM(transmit_delta), 0) AS tx").
+		Where("device_name = ? AND collected_at >= ?", device, since).Scan(&traffic)
+	return traffic.Rx, traffic.Tx
+}
+
+func (c *StatisticsCollector) prune() {
+	c.pruneTraffic()
+	if retention := c.wg.Cfg.ConnectionHistoryRetention; retention > 0 {
+		res := c.db.Where("last_handshake < ?", time.Now().Add(-retention)).Delete(&PeerConnection{})
+		if res.Error != nil {
+			logrus.Errorf("failed to prune peer connection history: %v", res.Error)
+		} else if res.RowsAffected > 0 {
+			logrus.Debugf("pruned %d peer connection entries", res.RowsAffected)
+		}
+	}
+
+	retention := c.wg.Cfg.StatisticsRetention
+	if retention <= 0 {
+		return // keep all samples
+	}
+
+	// the most recent sample of each peer is kept, so that the latest values remain available
+	latestIds := c.latestIds()
+	if len(latestIds) == 0 {
+		return
+	}
+	res := c.db.Where("collected_at < ? AND id NOT IN ?", time.Now().Add(-retention), latestIds).Delete(&PeerStatistic{})
+	if res.Error != nil {
+		logrus.Errorf("failed to prune peer statistics: %v", res.Error)
+	} else if res.RowsAffected > 0 {
+		logrus.Debugf("pruned %d peer statistic entries", res.RowsAffected)
+	}
+}
+
+// latestIds returns the ids of the most recent sample of each peer.
+func (c *StatisticsCollector) latestIds() []uint {
+	rows := make([]struct{ ID uint }, 0)
+	c.db.Model(&PeerStatistic{}).Select("MAX(id) AS id").Group("public_key").Scan(&rows)
+
+	ids := make([]uint, len(rows))
+	for i := range rows {
+		ids[i] = rows[i].ID
+	}
+	return ids
+}
@@ -11,9 +11,18 @@ var Templates embed.FS
 
 var templateCache *template.Template
 
+// singleLine strips line breaks from the given value. Free-text fields like names or hook commands must not be able
+// to inject additional configuration lines into the generated files.
+func singleLine(value string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
 func init() {
 	var err error
-	templateCache, err = template.New("server").Funcs(template.FuncMap{"StringsJoin": strings.Join}).ParseFS(Templates, "tpl/*.tpl")
+	templateCache, err = template.New("server").Funcs(template.FuncMap{
+		"StringsJoin": strings.Join,
+		"SingleLine":  singleLine,
+	}).ParseFS(Templates, "tpl/*.tpl")
 	if err != nil {
 		panic(err)
 	}
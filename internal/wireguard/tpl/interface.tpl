@@ -1,6 +1,6 @@
 # AUTOGENERATED FILE - DO NOT EDIT
 # -WGP- Interface: {{ .Interface.DeviceName }} / Updated: {{ .Interface.UpdatedAt }} / Created: {{ .Interface.CreatedAt }}
-# -WGP- Interface display name: {{ .Interface.DisplayName }}
+# -WGP- Interface display name: {{ SingleLine .Interface.DisplayName }}
 # -WGP- Interface mode: {{ .Interface.Type }}
 # -WGP- PublicKey = {{ .Interface.PublicKey }}
 
@@ -24,7 +24,7 @@ DNS = {{ .Interface.DNSStr }}
 FwMark = {{.Interface.FirewallMark}}
 {{- end}}
 {{- if ne .Interface.RoutingTable ""}}
-Table = {{.Interface.RoutingTable}}
+Table = {{ SingleLine .Interface.RoutingTable }}
 {{- end}}
 {{- if .Interface.SaveConfig}}
 SaveConfig = true
@@ -32,16 +32,16 @@ SaveConfig = true
 
 # Interface hooks (optional)
 {{- if .Interface.PreUp}}
-PreUp = {{ .Interface.PreUp }}
+PreUp = {{ SingleLine .Interface.PreUp }}
 {{- end}}
 {{- if .Interface.PostUp}}
-PostUp = {{ .Interface.PostUp }}
+PostUp = {{ SingleLine .Interface.PostUp }}
 {{- end}}
 {{- if .Interface.PreDown}}
-PreDown = {{ .Interface.PreDown }}
+PreDown = {{ SingleLine .Interface.PreDown }}
 {{- end}}
 {{- if .Interface.PostDown}}
-PostDown = {{ .Interface.PostDown }}
+PostDown = {{ SingleLine .Interface.PostDown }}
 {{- end}}
 
 #
@@ -50,21 +50,21 @@ PostDown = {{ .Interface.PostDown }}
 
 {{range .Peers}}
 {{- if not .DeactivatedAt}}
-# -WGP- Peer: {{.Identifier}} / Updated: {{.UpdatedAt}} / Created: {{.CreatedAt}}
-# -WGP- Peer email: {{.Email}}
+# -WGP- Peer: {{ SingleLine .Identifier }} / Updated: {{.UpdatedAt}} / Created: {{.CreatedAt}}
+# -WGP- Peer email: {{ SingleLine .Email }}
 {{- if .PrivateKey}}
 # -WGP- PrivateKey: {{.PrivateKey}}
 {{- end}}
 [Peer]
 {{- if $.FriendlyNames}}
-# friendly_name = {{ .Identifier }}
+# friendly_name = {{ SingleLine .Identifier }}
 {{- end}}
 PublicKey = {{ .PublicKey }}
 {{- if .PresharedKey}}
 PresharedKey = {{ .PresharedKey }}
 {{- end}}
 {{- if eq $.Interface.Type "server"}}
-AllowedIPs = {{ .IPsStr }}{{if ne .AllowedIPsSrvStr ""}}, {{ .AllowedIPsSrvStr }}{{end}}
+AllowedIPs = {{ StringsJoin .GetServerAllowedIPs ", " }}
 {{- end}}
 {{- if eq $.Interface.Type "client"}}
 {{- if .AllowedIPsStr}}
@@ -73,6 +73,8 @@ AllowedIPs = {{ .AllowedIPsStr }}
 {{- end}}
 {{- if and (ne .Endpoint "") (eq $.Interface.Type "client")}}
 Endpoint = {{ .Endpoint }}
+{{- else if ne .SiteEndpoint ""}}
+Endpoint = {{ .SiteEndpoint }}
 {{- end}}
 {{- if ne .PersistentKeepalive 0}}
 PersistentKeepalive = {{ .PersistentKeepalive }}
@@ -1,12 +1,19 @@
 # AUTOGENERATED FILE - PROVIDED BY WIREGUARD PORTAL
-# WireGuard configuration: {{ .Peer.Identifier }}
+# WireGuard configuration: {{ SingleLine .Peer.Identifier }}
 # -WGP- PublicKey: {{ .Peer.PublicKey }}
 
 [Interface]
 
 # Core settings
+{{- if .Peer.PrivateKey}}
 PrivateKey = {{ .Peer.PrivateKey }}
+{{- else}}
+# The private key is not stored by the portal, insert the private key of this peer below.
+PrivateKey = <insert-your-private-key>
+{{- end}}
+{{- if .Peer.IPsStr}}
 Address = {{ .Peer.IPsStr }}
+{{- end}}
 
 # Misc. settings (optional)
 {{- if .Peer.DNSStr}}
@@ -18,7 +25,9 @@ MTU = {{.Peer.Mtu}}
 
 [Peer]
 PublicKey = {{ .Interface.PublicKey }}
+{{- if .Peer.Endpoint}}
 Endpoint = {{ .Peer.Endpoint }}
+{{- end}}
 {{- if .Peer.AllowedIPsStr}}
 AllowedIPs = {{ .Peer.AllowedIPsStr }}
 {{- end}}
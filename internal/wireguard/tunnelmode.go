@@ -0,0 +1,57 @@
+package wireguard
+
+import (
+	"net"
+
+	"github.com/h44z/wg-portal/internal/common"
+)
+
+// TunnelMode describes which traffic of the peers is routed through an interface in server mode. It drives the
+// allowed IPs of new peers.
+type TunnelMode string
+
+const (
+	TunnelModeCustom  TunnelMode = ""        // new peers use the default allowed IPs of the interface
+	TunnelModeGateway TunnelMode = "gateway" // full tunnel, all traffic of the peers is routed through the interface
+	TunnelModeSplit   TunnelMode = "split"   // split tunnel, only traffic to the interface subnets is routed
+)
+
+// Description returns a human readable name of the tunnel mode.
+func (m TunnelMode) Description() string {
+	switch m {
+	case TunnelModeGateway:
+		return "full tunnel gateway"
+	case TunnelModeSplit:
+		return "split tunnel"
+	default:
+		return "custom"
+	}
+}
+
+// TunnelModeAllowedIPs returns the allowed IPs of new peers of the interface in its tunnel mode. Gateways route
+// 0.0.0.0/0, and ::/0 if the interface has an IPv6 address. Split tunnels route the subnets of the interface
+// addresses. In custom mode the default allowed IPs of the interface are returned.
+func (d Device) TunnelModeAllowedIPs() string {
+	allowedIPs := make([]string, 0)
+	switch d.TunnelMode {
+	case TunnelModeGateway:
+		allowedIPs = append(allowedIPs, "0.0.0.0/0")
+		for _, addr := range d.GetIPAddresses() {
+			if ip, _, err := net.ParseCIDR(addr); err == nil && ip.To4() == nil {
+				allowedIPs = append(allowedIPs, "::/0")
+				break
+			}
+		}
+	case TunnelModeSplit:
+		for _, addr := range d.GetIPAddresses() {
+			_, network, err := net.ParseCIDR(addr)
+			if err != nil || common.ListContains(allowedIPs, network.String()) {
+				continue
+			}
+			allowedIPs = append(allowedIPs, network.String())
+		}
+	default:
+		return d.DefaultAllowedIPsStr
+	}
+	return common.ListToString(allowedIPs)
+}